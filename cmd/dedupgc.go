@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/freshvolk/sftpgo/config"
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dedupGCVerify bool
+	dedupGCDryRun bool
+	dedupGCCmd    = &cobra.Command{
+		Use:   "dedupgc",
+		Short: "Check the deduplicating stores and remove the orphan blobs",
+		Long: `The blob stores used by the users and virtual folders with the deduplicating filesystem
+are checked against the files inside their home directories and mapped paths.
+The blobs no longer referenced are removed and the reference counters are fixed.
+Use the "verify" flag to check the contents of each referenced blob against its hash
+and the "dry-run" flag to report the results without modifying anything.
+
+The SFTPGo service must be stopped while this command runs.
+
+The configuration is read as for the "serve" command, please take a look at the usage below
+to customize the options`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logLevel := zerolog.DebugLevel
+			if !logVerbose {
+				logLevel = zerolog.InfoLevel
+			}
+			logger.InitLogger(logFilePath, logMaxSize, logMaxBackups, logMaxAge, logCompress, logLevel)
+			logger.EnableConsoleLogger(logLevel)
+			if len(logFilePath) == 0 {
+				logger.DisableLogger()
+			}
+			config.LoadConfig(configDir, configFile)
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.ErrorToConsole("the deduplicating stores cannot be checked using the memory data provider")
+				os.Exit(1)
+			}
+			if err := dataprovider.Initialize(providerConf, configDir); err != nil {
+				logger.ErrorToConsole("error initializing data provider: %v", err)
+				os.Exit(1)
+			}
+			results, err := dataprovider.CollectDedupGarbage(dataprovider.GetProvider(), dedupGCVerify, dedupGCDryRun)
+			hasErrors := err != nil
+			for storePath, result := range results {
+				logger.InfoToConsole("store %#v: blobs: %v, referenced: %v, orphans: %v (%v bytes), fixed counters: %v, "+
+					"dry run: %v", storePath, result.Blobs, result.ReferencedBlobs, result.OrphanBlobs, result.OrphanSize,
+					result.FixedCounters, dedupGCDryRun)
+				for _, hash := range result.MissingBlobs {
+					logger.ErrorToConsole("store %#v: referenced blob %#v is missing", storePath, hash)
+				}
+				for _, hash := range result.CorruptedBlobs {
+					logger.ErrorToConsole("store %#v: the content of blob %#v does not match its hash", storePath, hash)
+				}
+				for _, name := range result.InvalidRefs {
+					logger.WarnToConsole("store %#v: %#v is not a valid reference", storePath, name)
+				}
+				if len(result.MissingBlobs) > 0 || len(result.CorruptedBlobs) > 0 {
+					hasErrors = true
+				}
+			}
+			if err != nil {
+				logger.ErrorToConsole("error checking the deduplicating stores: %v", err)
+			}
+			if hasErrors {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(dedupGCCmd)
+	addServeFlags(dedupGCCmd)
+	dedupGCCmd.Flags().BoolVar(&dedupGCVerify, "verify", false, "Check the contents of the referenced blobs against "+
+		"their hashes")
+	dedupGCCmd.Flags().BoolVar(&dedupGCDryRun, "dry-run", false, "Report the results without removing the orphan "+
+		"blobs or fixing the reference counters")
+}
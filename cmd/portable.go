@@ -30,13 +30,39 @@ var (
 	portableS3Region             string
 	portableS3AccessKey          string
 	portableS3AccessSecret       string
+	portableS3RoleARN            string
+	portableS3ExternalID         string
 	portableS3Endpoint           string
 	portableS3StorageClass       string
+	portableS3UploadPartSize     int
 	portableS3KeyPrefix          string
+	portableS3SSE                string
+	portableS3SSEKMSKeyID        string
+	portableS3SSECustomerKey     string
 	portableGCSBucket            string
 	portableGCSCredentialsFile   string
 	portableGCSStorageClass      string
 	portableGCSKeyPrefix         string
+	portableAzContainer          string
+	portableAzAccountName        string
+	portableAzAccountKey         string
+	portableAzEndpoint           string
+	portableAzSASURL             string
+	portableAzKeyPrefix          string
+	portableAzAccessTier         string
+	portableAzUploadPartSize     int
+	portableAzUploadConcurrency  int
+	portableAzUseEmulator        bool
+	portableSFTPEndpoint         string
+	portableSFTPUsername         string
+	portableSFTPPassword         string
+	portableSFTPPrivateKeyPath   string
+	portableSFTPFingerprints     []string
+	portableSFTPPrefix           string
+	portableMemMaxSize           int64
+	portableMemClearOnLogout     bool
+	portableDedupStorePath       string
+	portableCryptPassphrase      string
 	portableCmd                  = &cobra.Command{
 		Use:   "portable",
 		Short: "Serve a single directory",
@@ -53,7 +79,8 @@ Please take a look at the usage below to customize the serving parameters`,
 			permissions := make(map[string][]string)
 			permissions["/"] = portablePermissions
 			portableGCSCredentials := ""
-			if portableFsProvider == 2 {
+			// without a credentials file Application Default Credentials are used
+			if portableFsProvider == 2 && len(portableGCSCredentialsFile) > 0 {
 				fi, err := os.Stat(portableGCSCredentialsFile)
 				if err != nil {
 					fmt.Printf("Invalid GCS credentials file: %v\n", err)
@@ -70,6 +97,15 @@ Please take a look at the usage below to customize the serving parameters`,
 				}
 				portableGCSCredentials = base64.StdEncoding.EncodeToString(creds)
 			}
+			portableSFTPPrivateKey := ""
+			if portableFsProvider == 4 && len(portableSFTPPrivateKeyPath) > 0 {
+				key, err := ioutil.ReadFile(portableSFTPPrivateKeyPath)
+				if err != nil {
+					fmt.Printf("Unable to read SFTP private key file: %v\n", err)
+					return
+				}
+				portableSFTPPrivateKey = string(key)
+			}
 			service := service.Service{
 				ConfigDir:     defaultConfigDir,
 				ConfigFile:    defaultConfigName,
@@ -91,19 +127,56 @@ Please take a look at the usage below to customize the serving parameters`,
 					FsConfig: dataprovider.Filesystem{
 						Provider: portableFsProvider,
 						S3Config: vfs.S3FsConfig{
-							Bucket:       portableS3Bucket,
-							Region:       portableS3Region,
-							AccessKey:    portableS3AccessKey,
-							AccessSecret: portableS3AccessSecret,
-							Endpoint:     portableS3Endpoint,
-							StorageClass: portableS3StorageClass,
-							KeyPrefix:    portableS3KeyPrefix,
+							Bucket:               portableS3Bucket,
+							Region:               portableS3Region,
+							AccessKey:            portableS3AccessKey,
+							AccessSecret:         portableS3AccessSecret,
+							RoleARN:              portableS3RoleARN,
+							ExternalID:           portableS3ExternalID,
+							Endpoint:             portableS3Endpoint,
+							StorageClass:         portableS3StorageClass,
+							KeyPrefix:            portableS3KeyPrefix,
+							UploadPartSize:       int64(portableS3UploadPartSize),
+							ServerSideEncryption: portableS3SSE,
+							SSEKMSKeyID:          portableS3SSEKMSKeyID,
+							SSECustomerKey:       portableS3SSECustomerKey,
 						},
 						GCSConfig: vfs.GCSFsConfig{
-							Bucket:       portableGCSBucket,
-							Credentials:  portableGCSCredentials,
-							StorageClass: portableGCSStorageClass,
-							KeyPrefix:    portableGCSKeyPrefix,
+							Bucket:               portableGCSBucket,
+							Credentials:          portableGCSCredentials,
+							AutomaticCredentials: len(portableGCSCredentials) == 0,
+							StorageClass:         portableGCSStorageClass,
+							KeyPrefix:            portableGCSKeyPrefix,
+						},
+						AzBlobConfig: vfs.AzBlobFsConfig{
+							Container:         portableAzContainer,
+							AccountName:       portableAzAccountName,
+							AccountKey:        portableAzAccountKey,
+							Endpoint:          portableAzEndpoint,
+							SASURL:            portableAzSASURL,
+							KeyPrefix:         portableAzKeyPrefix,
+							UploadPartSize:    int64(portableAzUploadPartSize),
+							UploadConcurrency: portableAzUploadConcurrency,
+							UseEmulator:       portableAzUseEmulator,
+							AccessTier:        portableAzAccessTier,
+						},
+						SFTPConfig: vfs.SFTPFsConfig{
+							Endpoint:     portableSFTPEndpoint,
+							Username:     portableSFTPUsername,
+							Password:     portableSFTPPassword,
+							PrivateKey:   portableSFTPPrivateKey,
+							Fingerprints: portableSFTPFingerprints,
+							Prefix:       portableSFTPPrefix,
+						},
+						MemConfig: vfs.MemFsConfig{
+							MaxSize:       portableMemMaxSize,
+							ClearOnLogout: portableMemClearOnLogout,
+						},
+						DedupConfig: vfs.DedupFsConfig{
+							StorePath: portableDedupStorePath,
+						},
+						CryptConfig: vfs.CryptFsConfig{
+							Passphrase: portableCryptPassphrase,
 						},
 					},
 				},
@@ -133,19 +206,63 @@ func init() {
 	portableCmd.Flags().BoolVarP(&portableAdvertiseCredentials, "advertise-credentials", "C", false,
 		"If the SFTP service is advertised via multicast DNS this flag allows to put username/password inside the advertised TXT record")
 	portableCmd.Flags().IntVarP(&portableFsProvider, "fs-provider", "f", 0, "0 means local filesystem, 1 Amazon S3 compatible, "+
-		"2 Google Cloud Storage")
+		"2 Google Cloud Storage, 3 Azure Blob Storage, 4 remote SFTP server, 5 in memory filesystem, 6 local deduplicating "+
+		"filesystem")
 	portableCmd.Flags().StringVar(&portableS3Bucket, "s3-bucket", "", "")
 	portableCmd.Flags().StringVar(&portableS3Region, "s3-region", "", "")
-	portableCmd.Flags().StringVar(&portableS3AccessKey, "s3-access-key", "", "")
+	portableCmd.Flags().StringVar(&portableS3AccessKey, "s3-access-key", "", "Leave access key and secret empty to "+
+		"use the default AWS credential chain")
 	portableCmd.Flags().StringVar(&portableS3AccessSecret, "s3-access-secret", "", "")
+	portableCmd.Flags().StringVar(&portableS3RoleARN, "s3-role-arn", "", "Optional role to assume")
+	portableCmd.Flags().StringVar(&portableS3ExternalID, "s3-external-id", "", "External ID to use when assuming "+
+		"the role")
 	portableCmd.Flags().StringVar(&portableS3Endpoint, "s3-endpoint", "", "")
 	portableCmd.Flags().StringVar(&portableS3StorageClass, "s3-storage-class", "", "")
 	portableCmd.Flags().StringVar(&portableS3KeyPrefix, "s3-key-prefix", "", "Allows to restrict access to the virtual folder "+
 		"identified by this prefix and its contents")
+	portableCmd.Flags().IntVar(&portableS3UploadPartSize, "s3-upload-part-size", 5, "The buffer size for multipart uploads (MB)")
+	portableCmd.Flags().StringVar(&portableS3SSE, "s3-sse", "", "Server side encryption for the uploaded objects: "+
+		"\"AES256\" (SSE-S3) or \"aws:kms\" (SSE-KMS)")
+	portableCmd.Flags().StringVar(&portableS3SSEKMSKeyID, "s3-sse-kms-key-id", "", "KMS key ID for SSE-KMS, the AWS "+
+		"managed key is used if empty")
+	portableCmd.Flags().StringVar(&portableS3SSECustomerKey, "s3-sse-customer-key", "", "Base64 encoded 256 bit "+
+		"key for SSE-C")
 	portableCmd.Flags().StringVar(&portableGCSBucket, "gcs-bucket", "", "")
 	portableCmd.Flags().StringVar(&portableGCSStorageClass, "gcs-storage-class", "", "")
 	portableCmd.Flags().StringVar(&portableGCSKeyPrefix, "gcs-key-prefix", "", "Allows to restrict access to the virtual folder "+
 		"identified by this prefix and its contents")
-	portableCmd.Flags().StringVar(&portableGCSCredentialsFile, "gcs-credentials-file", "", "Google Cloud Storage JSON credentials file")
+	portableCmd.Flags().StringVar(&portableGCSCredentialsFile, "gcs-credentials-file", "", "Google Cloud Storage JSON credentials file. "+
+		"Leave empty to use Application Default Credentials")
+	portableCmd.Flags().StringVar(&portableAzContainer, "az-container", "", "")
+	portableCmd.Flags().StringVar(&portableAzAccountName, "az-account-name", "", "")
+	portableCmd.Flags().StringVar(&portableAzAccountKey, "az-account-key", "", "")
+	portableCmd.Flags().StringVar(&portableAzSASURL, "az-sas-url", "", "Shared access signature URL")
+	portableCmd.Flags().StringVar(&portableAzEndpoint, "az-endpoint", "", "Leave empty to use the default: "+
+		"\"blob.core.windows.net\"")
+	portableCmd.Flags().StringVar(&portableAzKeyPrefix, "az-key-prefix", "", "Allows to restrict access to the virtual folder "+
+		"identified by this prefix and its contents")
+	portableCmd.Flags().StringVar(&portableAzAccessTier, "az-access-tier", "", "Leave empty to use the default "+
+		"container setting")
+	portableCmd.Flags().IntVar(&portableAzUploadPartSize, "az-upload-part-size", 4, "The buffer size for multipart uploads (MB)")
+	portableCmd.Flags().IntVar(&portableAzUploadConcurrency, "az-upload-concurrency", 2, "How many parts are uploaded in "+
+		"parallel")
+	portableCmd.Flags().BoolVar(&portableAzUseEmulator, "az-use-emulator", false, "")
+	portableCmd.Flags().StringVar(&portableSFTPEndpoint, "sftp-endpoint", "", "Remote SFTP server as host:port")
+	portableCmd.Flags().StringVar(&portableSFTPUsername, "sftp-username", "", "")
+	portableCmd.Flags().StringVar(&portableSFTPPassword, "sftp-password", "", "")
+	portableCmd.Flags().StringVar(&portableSFTPPrivateKeyPath, "sftp-key-path", "", "Path to the private key to use to "+
+		"authenticate against the remote SFTP server")
+	portableCmd.Flags().StringSliceVar(&portableSFTPFingerprints, "sftp-fingerprints", []string{}, "SHA256 fingerprints "+
+		"to use for host key verification. At least one is required")
+	portableCmd.Flags().StringVar(&portableSFTPPrefix, "sftp-prefix", "", "Allows to restrict access to this remote "+
+		"directory and its contents")
+	portableCmd.Flags().Int64Var(&portableMemMaxSize, "mem-max-size", 0, "Maximum size, as bytes, of the files stored "+
+		"in memory. 0 means unlimited")
+	portableCmd.Flags().BoolVar(&portableMemClearOnLogout, "mem-clear-on-logout", false, "Remove the files stored in "+
+		"memory when the last connection is closed")
+	portableCmd.Flags().StringVar(&portableDedupStorePath, "dedup-store-path", "", "Absolute path to the local directory "+
+		"where the deduplicated file contents are stored")
+	portableCmd.Flags().StringVar(&portableCryptPassphrase, "crypt-passphrase", "", "If set, the file contents are "+
+		"encrypted using a key derived from this passphrase before storing them")
 	rootCmd.AddCommand(portableCmd)
 }
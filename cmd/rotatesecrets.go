@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/freshvolk/sftpgo/config"
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/secrets"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rotateSecretsCmd = &cobra.Command{
+		Use:   "rotatesecrets",
+		Short: "Encrypt the stored secrets using the current master key",
+		Long: `The users and virtual folders secrets, such as the cloud storage credentials, are encrypted
+again using the last key defined inside the configured master key file.
+Secrets encrypted before configuring a master key are encrypted too.
+
+To rotate the master key append a new key to the master key file, for example:
+
+openssl rand -base64 32 >> master.key
+
+and then run:
+
+sftpgo rotatesecrets
+
+The previous keys can be removed from the master key file once this command succeeds.
+If you use SQLite or bolt as data provider the SFTPGo service must be stopped.
+
+The configuration is read as for the "serve" command, please take a look at the usage below
+to customize the options`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logLevel := zerolog.DebugLevel
+			if !logVerbose {
+				logLevel = zerolog.InfoLevel
+			}
+			logger.InitLogger(logFilePath, logMaxSize, logMaxBackups, logMaxAge, logCompress, logLevel)
+			logger.EnableConsoleLogger(logLevel)
+			if len(logFilePath) == 0 {
+				logger.DisableLogger()
+			}
+			config.LoadConfig(configDir, configFile)
+			if err := secrets.Initialize(config.GetSecretsConfig(), configDir); err != nil {
+				logger.ErrorToConsole("error initializing secrets provider: %v", err)
+				os.Exit(1)
+			}
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.ErrorToConsole("secrets rotation is not supported for the memory data provider")
+				os.Exit(1)
+			}
+			if err := dataprovider.Initialize(providerConf, configDir); err != nil {
+				logger.ErrorToConsole("error initializing data provider: %v", err)
+				os.Exit(1)
+			}
+			numUsers, numFolders, err := dataprovider.RotateSecrets(dataprovider.GetProvider())
+			if err != nil {
+				logger.ErrorToConsole("error rotating secrets, updated users: %v, updated folders: %v, error: %v",
+					numUsers, numFolders, err)
+				os.Exit(1)
+			}
+			logger.InfoToConsole("secrets rotated, updated users: %v, updated folders: %v", numUsers, numFolders)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(rotateSecretsCmd)
+	addServeFlags(rotateSecretsCmd)
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/freshvolk/sftpgo/dataprovider"
 	"github.com/freshvolk/sftpgo/httpd"
 	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/secrets"
 	"github.com/freshvolk/sftpgo/sftpd"
 	"github.com/freshvolk/sftpgo/utils"
 	"github.com/spf13/viper"
@@ -36,6 +37,7 @@ type globalConfig struct {
 	SFTPD        sftpd.Configuration `json:"sftpd" mapstructure:"sftpd"`
 	ProviderConf dataprovider.Config `json:"data_provider" mapstructure:"data_provider"`
 	HTTPDConfig  httpd.Conf          `json:"httpd" mapstructure:"httpd"`
+	Secrets      secrets.Config      `json:"secrets" mapstructure:"secrets"`
 }
 
 func init() {
@@ -62,6 +64,14 @@ func init() {
 			LoginBannerFile:            "",
 			EnabledSSHCommands:         sftpd.GetDefaultSSHCommands(),
 			KeyboardInteractiveProgram: "",
+			S3UploadsStatePath:         "s3_uploads",
+			S3UploadsMaxAge:            24,
+			CloudMetadataCacheTTL:      0,
+			ReplicationQueuePath:       "replication_queue",
+			TieringStatePath:           "tiering_state",
+			QuotaScanParallelism:       4,
+			QuotaScanStatePath:         "quota_scan_state",
+			MaxUploadFileSize:          0,
 		},
 		ProviderConf: dataprovider.Config{
 			Driver:           "sqlite",
@@ -96,6 +106,9 @@ func init() {
 			CertificateFile:    "",
 			CertificateKeyFile: "",
 		},
+		Secrets: secrets.Config{
+			MasterKeyPath: "",
+		},
 	}
 
 	viper.SetEnvPrefix(configEnvPrefix)
@@ -136,6 +149,16 @@ func SetProviderConf(config dataprovider.Config) {
 	globalConf.ProviderConf = config
 }
 
+// GetSecretsConfig returns the configuration for the secrets encryption
+func GetSecretsConfig() secrets.Config {
+	return globalConf.Secrets
+}
+
+// SetSecretsConfig sets the configuration for the secrets encryption
+func SetSecretsConfig(config secrets.Config) {
+	globalConf.Secrets = config
+}
+
 func getRedactedGlobalConf() globalConfig {
 	conf := globalConf
 	conf.ProviderConf.Password = "[redacted]"
@@ -159,4 +159,10 @@ func TestSetGetConfig(t *testing.T) {
 	if config.GetHTTPDConfig().BindAddress != httpdConf.BindAddress {
 		t.Errorf("set httpd conf failed")
 	}
+	secretsConf := config.GetSecretsConfig()
+	secretsConf.MasterKeyPath = "master.key"
+	config.SetSecretsConfig(secretsConf)
+	if config.GetSecretsConfig().MasterKeyPath != secretsConf.MasterKeyPath {
+		t.Errorf("set secrets conf failed")
+	}
 }
@@ -18,10 +18,15 @@ const (
 )
 
 var (
-	usersBucket      = []byte("users")
-	usersIDIdxBucket = []byte("users_id_idx")
-	dbVersionBucket  = []byte("db_version")
-	dbVersionKey     = []byte("version")
+	usersBucket          = []byte("users")
+	usersIDIdxBucket     = []byte("users_id_idx")
+	foldersBucket        = []byte("folders")
+	foldersIDIdxBucket   = []byte("folders_id_idx")
+	dirQuotasBucket      = []byte("directory_quotas")
+	transferQuotasBucket = []byte("transfer_quotas")
+	retentionLocksBucket = []byte("retention_locks")
+	dbVersionBucket      = []byte("db_version")
+	dbVersionKey         = []byte("version")
 )
 
 // BoltProvider auth provider for bolt key/value store
@@ -84,6 +89,46 @@ func initializeBoltProvider(basePath string) error {
 			providerLog(logger.LevelWarn, "error creating username idx bucket: %v", err)
 			return err
 		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(foldersBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating folders bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(foldersIDIdxBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating folders idx bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(dirQuotasBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating directory quotas bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(transferQuotasBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating transfer quotas bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(retentionLocksBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating retention locks bucket: %v", err)
+			return err
+		}
 		err = dbHandle.Update(func(tx *bolt.Tx) error {
 			_, e := tx.CreateBucketIfNotExists(dbVersionBucket)
 			return e
@@ -147,7 +192,12 @@ func (p BoltProvider) getUserByID(ID int64) (User, error) {
 		if u == nil {
 			return &RecordNotFoundError{err: fmt.Sprintf("username %#v and ID: %v does not exist", string(username), ID)}
 		}
-		return json.Unmarshal(u, &user)
+		folderBucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		user, err = joinUserAndFolders(u, folderBucket)
+		return err
 	})
 
 	return user, err
@@ -228,7 +278,12 @@ func (p BoltProvider) userExists(username string) (User, error) {
 		if u == nil {
 			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
 		}
-		return json.Unmarshal(u, &user)
+		folderBucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		user, err = joinUserAndFolders(u, folderBucket)
+		return err
 	})
 	return user, err
 }
@@ -246,12 +301,24 @@ func (p BoltProvider) addUser(user User) error {
 		if u := bucket.Get([]byte(user.Username)); u != nil {
 			return fmt.Errorf("username %v already exists", user.Username)
 		}
+		folderBucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		err = checkBoltUserVirtualFolders(&user, folderBucket)
+		if err != nil {
+			return err
+		}
 		id, err := bucket.NextSequence()
 		if err != nil {
 			return err
 		}
 		user.ID = int64(id)
-		buf, err := json.Marshal(user)
+		err = addUserToBoltFolders(user.Username, user.VirtualFolders, folderBucket)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(getUserForBoltStorage(user))
 		if err != nil {
 			return err
 		}
@@ -274,10 +341,36 @@ func (p BoltProvider) updateUser(user User) error {
 		if err != nil {
 			return err
 		}
-		if u := bucket.Get([]byte(user.Username)); u == nil {
+		var u []byte
+		if u = bucket.Get([]byte(user.Username)); u == nil {
 			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", user.Username)}
 		}
-		buf, err := json.Marshal(user)
+		var oldUser User
+		err = json.Unmarshal(u, &oldUser)
+		if err != nil {
+			return err
+		}
+		folderBucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		err = checkBoltUserVirtualFolders(&user, folderBucket)
+		if err != nil {
+			return err
+		}
+		err = removeUserFromBoltFolders(oldUser.Username, oldUser.VirtualFolders, folderBucket)
+		if err != nil {
+			return err
+		}
+		err = addUserToBoltFolders(user.Username, user.VirtualFolders, folderBucket)
+		if err != nil {
+			return err
+		}
+		err = clearRemovedBoltDirQuotas(user, tx)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(getUserForBoltStorage(user))
 		if err != nil {
 			return err
 		}
@@ -296,6 +389,47 @@ func (p BoltProvider) deleteUser(user User) error {
 		if userName == nil {
 			return &RecordNotFoundError{err: fmt.Sprintf("user with id %v does not exist", user.ID)}
 		}
+		if u := bucket.Get(userName); u != nil {
+			var oldUser User
+			err = json.Unmarshal(u, &oldUser)
+			if err != nil {
+				return err
+			}
+			folderBucket, _, err := getFolderBuckets(tx)
+			if err != nil {
+				return err
+			}
+			err = removeUserFromBoltFolders(oldUser.Username, oldUser.VirtualFolders, folderBucket)
+			if err != nil {
+				return err
+			}
+		}
+		quotasBucket, err := getDirQuotasBucket(tx)
+		if err != nil {
+			return err
+		}
+		err = quotasBucket.Delete(userName)
+		if err != nil {
+			return err
+		}
+		transferBucket, err := getTransferQuotasBucket(tx)
+		if err != nil {
+			return err
+		}
+		err = transferBucket.Delete(userName)
+		if err != nil {
+			return err
+		}
+		locksBucket, err := getRetentionLocksBucket(tx)
+		if err != nil {
+			return err
+		}
+		if locksBucket.Bucket(userName) != nil {
+			err = locksBucket.DeleteBucket(userName)
+			if err != nil {
+				return err
+			}
+		}
 		err = bucket.Delete(userName)
 		if err != nil {
 			return err
@@ -312,10 +446,13 @@ func (p BoltProvider) dumpUsers() ([]User, error) {
 		if err != nil {
 			return err
 		}
+		folderBucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
 		cursor := bucket.Cursor()
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			var user User
-			err = json.Unmarshal(v, &user)
+			user, err := joinUserAndFolders(v, folderBucket)
 			if err != nil {
 				return err
 			}
@@ -350,6 +487,10 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 		if err != nil {
 			return err
 		}
+		folderBucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
 		cursor := bucket.Cursor()
 		itNum := 0
 		if order == "ASC" {
@@ -358,8 +499,7 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 				if itNum <= offset {
 					continue
 				}
-				var user User
-				err = json.Unmarshal(v, &user)
+				user, err := joinUserAndFolders(v, folderBucket)
 				if err == nil {
 					users = append(users, HideUserSensitiveData(&user))
 				}
@@ -373,8 +513,7 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 				if itNum <= offset {
 					continue
 				}
-				var user User
-				err = json.Unmarshal(v, &user)
+				user, err := joinUserAndFolders(v, folderBucket)
 				if err == nil {
 					users = append(users, HideUserSensitiveData(&user))
 				}
@@ -388,6 +527,428 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 	return users, err
 }
 
+func (p BoltProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		folder, err := getBoltFolder(name, bucket)
+		if err != nil {
+			return err
+		}
+		if reset {
+			folder.UsedQuotaSize = sizeAdd
+			folder.UsedQuotaFiles = filesAdd
+		} else {
+			folder.UsedQuotaSize += sizeAdd
+			folder.UsedQuotaFiles += filesAdd
+		}
+		folder.LastQuotaUpdate = utils.GetTimeAsMsSinceEpoch(time.Now())
+		return putBoltFolder(folder, bucket)
+	})
+}
+
+func (p BoltProvider) getUsedFolderQuota(name string) (int, int64, error) {
+	folder, err := p.folderExists(name)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for folder %#v error: %v", name, err)
+		return 0, 0, err
+	}
+	return folder.UsedQuotaFiles, folder.UsedQuotaSize, err
+}
+
+func (p BoltProvider) updateDirQuota(username, dirPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDirQuotasBucket(tx)
+		if err != nil {
+			return err
+		}
+		usersBucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if u := usersBucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
+		}
+		usage, err := getBoltDirQuotas(username, bucket)
+		if err != nil {
+			return err
+		}
+		idx := -1
+		for i, u := range usage {
+			if u.Path == dirPath {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			usage = append(usage, DirQuotaUsage{DirQuota: DirQuota{Path: dirPath}})
+			idx = len(usage) - 1
+		}
+		if reset {
+			usage[idx].UsedQuotaSize = sizeAdd
+			usage[idx].UsedQuotaFiles = filesAdd
+		} else {
+			usage[idx].UsedQuotaSize += sizeAdd
+			usage[idx].UsedQuotaFiles += filesAdd
+		}
+		usage[idx].LastQuotaUpdate = utils.GetTimeAsMsSinceEpoch(time.Now())
+		providerLog(logger.LevelDebug, "quota updated for user %#v, directory %#v, files increment: %v size increment: %v "+
+			"is reset? %v", username, dirPath, filesAdd, sizeAdd, reset)
+		return putBoltDirQuotas(username, usage, bucket)
+	})
+}
+
+func (p BoltProvider) getUsedDirQuotas(username string) ([]DirQuotaUsage, error) {
+	var usage []DirQuotaUsage
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDirQuotasBucket(tx)
+		if err != nil {
+			return err
+		}
+		usage, err = getBoltDirQuotas(username, bucket)
+		return err
+	})
+	return usage, err
+}
+
+func (p BoltProvider) updateTransferQuota(username string, uploadAdd, downloadAdd, periodStart int64, reset bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getTransferQuotasBucket(tx)
+		if err != nil {
+			return err
+		}
+		usersBucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if u := usersBucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
+		}
+		var usage TransferQuotaUsage
+		if v := bucket.Get([]byte(username)); v != nil {
+			err = json.Unmarshal(v, &usage)
+			if err != nil {
+				return err
+			}
+		}
+		if reset || usage.PeriodStart < periodStart {
+			usage.UsedUploadSize = uploadAdd
+			usage.UsedDownloadSize = downloadAdd
+			usage.PeriodStart = periodStart
+		} else if usage.PeriodStart == periodStart {
+			usage.UsedUploadSize += uploadAdd
+			usage.UsedDownloadSize += downloadAdd
+		}
+		buf, err := json.Marshal(usage)
+		if err != nil {
+			return err
+		}
+		providerLog(logger.LevelDebug, "transfer quota updated for user %#v, upload increment: %v download increment: %v "+
+			"is reset? %v", username, uploadAdd, downloadAdd, reset)
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
+// the times until the files are locked are stored inside a nested bucket for each user,
+// the file path is the key
+func (p BoltProvider) updateRetainUntil(username, filePath string, retainUntil int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getRetentionLocksBucket(tx)
+		if err != nil {
+			return err
+		}
+		usersBucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if u := usersBucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
+		}
+		if retainUntil == 0 {
+			if userBucket := bucket.Bucket([]byte(username)); userBucket != nil {
+				return userBucket.Delete([]byte(filePath))
+			}
+			return nil
+		}
+		userBucket, err := bucket.CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+		return userBucket.Put([]byte(filePath), itob(retainUntil))
+	})
+}
+
+func (p BoltProvider) getRetainUntil(username, filePath string) (int64, error) {
+	var retainUntil int64
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getRetentionLocksBucket(tx)
+		if err != nil {
+			return err
+		}
+		if userBucket := bucket.Bucket([]byte(username)); userBucket != nil {
+			if v := userBucket.Get([]byte(filePath)); len(v) == 8 {
+				retainUntil = int64(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+	return retainUntil, err
+}
+
+func (p BoltProvider) getUsedTransferQuota(username string) (int64, int64, int64, error) {
+	var usage TransferQuotaUsage
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getTransferQuotasBucket(tx)
+		if err != nil {
+			return err
+		}
+		if v := bucket.Get([]byte(username)); v != nil {
+			return json.Unmarshal(v, &usage)
+		}
+		return nil
+	})
+	return usage.UsedUploadSize, usage.UsedDownloadSize, usage.PeriodStart, err
+}
+
+func (p BoltProvider) folderExists(name string) (BaseVirtualFolder, error) {
+	var folder BaseVirtualFolder
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		folder, err = getBoltFolder(name, bucket)
+		return err
+	})
+	return folder, err
+}
+
+func (p BoltProvider) getFolderByID(ID int64) (BaseVirtualFolder, error) {
+	var folder BaseVirtualFolder
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		name := idxBucket.Get(itob(ID))
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("folder with ID %v does not exist", ID)}
+		}
+		folder, err = getBoltFolder(string(name), bucket)
+		return err
+	})
+	return folder, err
+}
+
+func (p BoltProvider) addFolder(folder BaseVirtualFolder) error {
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if f := bucket.Get([]byte(folder.Name)); f != nil {
+			return fmt.Errorf("folder %#v already exists", folder.Name)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		folder.ID = int64(id)
+		folder.UsedQuotaSize = 0
+		folder.UsedQuotaFiles = 0
+		folder.LastQuotaUpdate = 0
+		folder.Users = nil
+		err = putBoltFolder(folder, bucket)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Put(itob(folder.ID), []byte(folder.Name))
+	})
+}
+
+func (p BoltProvider) updateFolder(folder BaseVirtualFolder) error {
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		oldFolder, err := getBoltFolder(folder.Name, bucket)
+		if err != nil {
+			return err
+		}
+		folder.ID = oldFolder.ID
+		folder.UsedQuotaSize = oldFolder.UsedQuotaSize
+		folder.UsedQuotaFiles = oldFolder.UsedQuotaFiles
+		folder.LastQuotaUpdate = oldFolder.LastQuotaUpdate
+		folder.Users = oldFolder.Users
+		usersBucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		for _, username := range folder.Users {
+			u := usersBucket.Get([]byte(username))
+			if u == nil {
+				continue
+			}
+			var user User
+			err = json.Unmarshal(u, &user)
+			if err != nil {
+				return err
+			}
+			for idx, v := range user.VirtualFolders {
+				if v.Name == folder.Name {
+					err = checkVirtualFolderForUser(&user, idx, folder)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return putBoltFolder(folder, bucket)
+	})
+}
+
+func (p BoltProvider) deleteFolder(folder BaseVirtualFolder) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		oldFolder, err := getBoltFolder(folder.Name, bucket)
+		if err != nil {
+			return err
+		}
+		usersBucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		for _, username := range oldFolder.Users {
+			u := usersBucket.Get([]byte(username))
+			if u == nil {
+				continue
+			}
+			var user User
+			err = json.Unmarshal(u, &user)
+			if err != nil {
+				return err
+			}
+			var virtualFolders []VirtualFolder
+			for _, v := range user.VirtualFolders {
+				if v.Name != oldFolder.Name {
+					virtualFolders = append(virtualFolders, v)
+				}
+			}
+			user.VirtualFolders = virtualFolders
+			buf, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			err = usersBucket.Put([]byte(user.Username), buf)
+			if err != nil {
+				return err
+			}
+		}
+		err = bucket.Delete([]byte(oldFolder.Name))
+		if err != nil {
+			return err
+		}
+		return idxBucket.Delete(itob(oldFolder.ID))
+	})
+}
+
+func (p BoltProvider) getFolders(limit int, offset int, order string, name string) ([]BaseVirtualFolder, error) {
+	folders := []BaseVirtualFolder{}
+	var err error
+	if limit <= 0 {
+		return folders, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			folder, err := p.folderExists(name)
+			if err == nil {
+				folders = append(folders, HideFolderSensitiveData(&folder))
+			}
+		}
+		return folders, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		if order == "ASC" {
+			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+				var folder BaseVirtualFolder
+				err = json.Unmarshal(v, &folder)
+				if err == nil {
+					folders = append(folders, HideFolderSensitiveData(&folder))
+				}
+				if len(folders) >= limit {
+					break
+				}
+			}
+		} else {
+			for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+				var folder BaseVirtualFolder
+				err = json.Unmarshal(v, &folder)
+				if err == nil {
+					folders = append(folders, HideFolderSensitiveData(&folder))
+				}
+				if len(folders) >= limit {
+					break
+				}
+			}
+		}
+		return err
+	})
+	return folders, err
+}
+
+func (p BoltProvider) dumpFolders() ([]BaseVirtualFolder, error) {
+	folders := []BaseVirtualFolder{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getFolderBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var folder BaseVirtualFolder
+			err = json.Unmarshal(v, &folder)
+			if err != nil {
+				return err
+			}
+			err = addCredentialsToFolder(&folder)
+			if err != nil {
+				return err
+			}
+			folders = append(folders, folder)
+		}
+		return err
+	})
+	return folders, err
+}
+
 func (p BoltProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -413,6 +974,194 @@ func getBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
 	return bucket, idxBucket, err
 }
 
+func getDirQuotasBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(dirQuotasBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getTransferQuotasBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(transferQuotasBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getRetentionLocksBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(retentionLocksBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getBoltDirQuotas(username string, bucket *bolt.Bucket) ([]DirQuotaUsage, error) {
+	usage := []DirQuotaUsage{}
+	if v := bucket.Get([]byte(username)); v != nil {
+		err := json.Unmarshal(v, &usage)
+		if err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+func putBoltDirQuotas(username string, usage []DirQuotaUsage, bucket *bolt.Bucket) error {
+	if len(usage) == 0 {
+		return bucket.Delete([]byte(username))
+	}
+	buf, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(username), buf)
+}
+
+// clearRemovedBoltDirQuotas removes the used quota for the directories that have
+// no quota restrictions anymore
+func clearRemovedBoltDirQuotas(user User, tx *bolt.Tx) error {
+	bucket, err := getDirQuotasBucket(tx)
+	if err != nil {
+		return err
+	}
+	usage, err := getBoltDirQuotas(user.Username, bucket)
+	if err != nil {
+		return err
+	}
+	var kept []DirQuotaUsage
+	for _, u := range usage {
+		if user.hasDirQuota(u.Path) {
+			kept = append(kept, u)
+		}
+	}
+	if len(kept) == len(usage) {
+		return nil
+	}
+	return putBoltDirQuotas(user.Username, kept, bucket)
+}
+
+func getFolderBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(foldersBucket)
+	idxBucket := tx.Bucket(foldersIDIdxBucket)
+	if bucket == nil || idxBucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, idxBucket, err
+}
+
+func getBoltFolder(name string, bucket *bolt.Bucket) (BaseVirtualFolder, error) {
+	var folder BaseVirtualFolder
+	f := bucket.Get([]byte(name))
+	if f == nil {
+		return folder, &RecordNotFoundError{err: fmt.Sprintf("folder %#v does not exist", name)}
+	}
+	err := json.Unmarshal(f, &folder)
+	return folder, err
+}
+
+func putBoltFolder(folder BaseVirtualFolder, bucket *bolt.Bucket) error {
+	buf, err := json.Marshal(folder)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(folder.Name), buf)
+}
+
+// joinUserAndFolders unmarshals the stored user and refreshes the details for
+// its virtual folders from the folders bucket
+func joinUserAndFolders(u []byte, foldersBucket *bolt.Bucket) (User, error) {
+	var user User
+	err := json.Unmarshal(u, &user)
+	if err != nil {
+		return user, err
+	}
+	for idx := range user.VirtualFolders {
+		folder, err := getBoltFolder(user.VirtualFolders[idx].Name, foldersBucket)
+		if err == nil {
+			user.VirtualFolders[idx].BaseVirtualFolder = folder
+		}
+	}
+	return user, nil
+}
+
+// getUserForBoltStorage returns a copy of the user with only the folder names
+// for the mapped virtual folders, the folder details live in the folders bucket
+func getUserForBoltStorage(user User) User {
+	var virtualFolders []VirtualFolder
+	for _, v := range user.VirtualFolders {
+		virtualFolders = append(virtualFolders, VirtualFolder{
+			BaseVirtualFolder: BaseVirtualFolder{
+				Name: v.Name,
+			},
+			VirtualPath: v.VirtualPath,
+			QuotaSize:   v.QuotaSize,
+			QuotaFiles:  v.QuotaFiles,
+		})
+	}
+	user.VirtualFolders = virtualFolders
+	return user
+}
+
+func checkBoltUserVirtualFolders(user *User, foldersBucket *bolt.Bucket) error {
+	for idx, v := range user.VirtualFolders {
+		folder, err := getBoltFolder(v.Name, foldersBucket)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("unable to mount folder %#v: %v", v.Name, err)}
+		}
+		err = checkVirtualFolderForUser(user, idx, folder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addUserToBoltFolders(username string, virtualFolders []VirtualFolder, foldersBucket *bolt.Bucket) error {
+	for _, v := range virtualFolders {
+		folder, err := getBoltFolder(v.Name, foldersBucket)
+		if err != nil {
+			return err
+		}
+		if !utils.IsStringInSlice(username, folder.Users) {
+			folder.Users = append(folder.Users, username)
+			err = putBoltFolder(folder, foldersBucket)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeUserFromBoltFolders(username string, virtualFolders []VirtualFolder, foldersBucket *bolt.Bucket) error {
+	for _, v := range virtualFolders {
+		folder, err := getBoltFolder(v.Name, foldersBucket)
+		if err != nil {
+			// the folder could be already deleted
+			continue
+		}
+		var users []string
+		for _, u := range folder.Users {
+			if u != username {
+				users = append(users, u)
+			}
+		}
+		folder.Users = users
+		err = putBoltFolder(folder, foldersBucket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func checkBoltDatabaseVersion(dbHandle *bolt.DB) error {
 	dbVersion, err := getBoltDatabaseVersion(dbHandle)
 	if err != nil {
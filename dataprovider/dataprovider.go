@@ -37,6 +37,7 @@ import (
 
 	"github.com/freshvolk/sftpgo/logger"
 	"github.com/freshvolk/sftpgo/metrics"
+	"github.com/freshvolk/sftpgo/secrets"
 	"github.com/freshvolk/sftpgo/utils"
 	"github.com/freshvolk/sftpgo/vfs"
 	unixcrypt "github.com/nathanaelle/password"
@@ -190,7 +191,8 @@ type Config struct {
 
 // BackupData defines the structure for the backup/restore files
 type BackupData struct {
-	Users []User `json:"users"`
+	Users   []User              `json:"users"`
+	Folders []BaseVirtualFolder `json:"folders"`
 }
 
 type keyboardAuthProgramResponse struct {
@@ -255,6 +257,21 @@ type Provider interface {
 	dumpUsers() ([]User, error)
 	getUserByID(ID int64) (User, error)
 	updateLastLogin(username string) error
+	updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error
+	getUsedFolderQuota(name string) (int, int64, error)
+	updateDirQuota(username, dirPath string, filesAdd int, sizeAdd int64, reset bool) error
+	getUsedDirQuotas(username string) ([]DirQuotaUsage, error)
+	updateTransferQuota(username string, uploadAdd, downloadAdd, periodStart int64, reset bool) error
+	getUsedTransferQuota(username string) (int64, int64, int64, error)
+	updateRetainUntil(username, filePath string, retainUntil int64) error
+	getRetainUntil(username, filePath string) (int64, error)
+	folderExists(name string) (BaseVirtualFolder, error)
+	getFolderByID(ID int64) (BaseVirtualFolder, error)
+	addFolder(folder BaseVirtualFolder) error
+	updateFolder(folder BaseVirtualFolder) error
+	deleteFolder(folder BaseVirtualFolder) error
+	getFolders(limit int, offset int, order string, name string) ([]BaseVirtualFolder, error)
+	dumpFolders() ([]BaseVirtualFolder, error)
 	checkAvailability() error
 	close() error
 	reloadConfig() error
@@ -284,6 +301,9 @@ func Initialize(cnf Config, basePath string) error {
 	if err := validateCredentialsDir(basePath); err != nil {
 		return err
 	}
+	if config.TrackQuota > 0 && config.ManageUsers == 0 {
+		providerLog(logger.LevelWarn, "users management is disabled, the used transfer quota will not be recorded")
+	}
 
 	if config.Driver == SQLiteDataProviderName {
 		err = initializeSQLiteProvider(basePath)
@@ -414,6 +434,7 @@ func DeleteUser(p Provider, user User) error {
 	}
 	err := p.deleteUser(user)
 	if err == nil {
+		vfs.RemoveMemFsStorage(user.getMemStorageID())
 		go executeAction(operationDelete, user)
 	}
 	return err
@@ -441,6 +462,269 @@ func GetUserByID(p Provider, ID int64) (User, error) {
 	return p.getUserByID(ID)
 }
 
+// UpdateVirtualFolderQuota updates the quota for the given virtual folder adding filesAdd and sizeAdd.
+// If reset is true filesAdd and sizeAdd indicates the total files and the total size instead of the difference.
+// If track_quota is 2 the quota is updated only if the given folder mapping has quota restrictions
+func UpdateVirtualFolderQuota(p Provider, vfolder VirtualFolder, filesAdd int, sizeAdd int64, reset bool) error {
+	if config.TrackQuota == 0 {
+		return &MethodDisabledError{err: trackQuotaDisabledError}
+	} else if config.TrackQuota == 2 && !reset && !vfolder.HasQuotaRestrictions() {
+		return nil
+	}
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateFolderQuota(vfolder.Name, filesAdd, sizeAdd, reset)
+}
+
+// GetUsedVirtualFolderQuota returns the used quota for the given virtual folder.
+// TrackQuota must be >=1 to enable this method
+func GetUsedVirtualFolderQuota(p Provider, name string) (int, int64, error) {
+	if config.TrackQuota == 0 {
+		return 0, 0, &MethodDisabledError{err: trackQuotaDisabledError}
+	}
+	return p.getUsedFolderQuota(name)
+}
+
+// UpdateDirQuota updates the quota for the given user's directory adding filesAdd and sizeAdd.
+// If reset is true filesAdd and sizeAdd indicates the total files and the total size instead of the difference.
+func UpdateDirQuota(p Provider, user User, dirPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	if config.TrackQuota == 0 {
+		return &MethodDisabledError{err: trackQuotaDisabledError}
+	}
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateDirQuota(user.Username, dirPath, filesAdd, sizeAdd, reset)
+}
+
+// GetDirQuotasUsage returns the quota restrictions and the used quota for the given user's directories.
+// TrackQuota must be >=1 to enable this method
+func GetDirQuotasUsage(p Provider, user User) ([]DirQuotaUsage, error) {
+	if config.TrackQuota == 0 {
+		return nil, &MethodDisabledError{err: trackQuotaDisabledError}
+	}
+	used, err := p.getUsedDirQuotas(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DirQuotaUsage, 0, len(user.Filters.DirQuotas))
+	for _, q := range user.Filters.DirQuotas {
+		usage := DirQuotaUsage{DirQuota: q}
+		for _, u := range used {
+			if u.Path == q.Path {
+				usage.UsedQuotaSize = u.UsedQuotaSize
+				usage.UsedQuotaFiles = u.UsedQuotaFiles
+				usage.LastQuotaUpdate = u.LastQuotaUpdate
+				break
+			}
+		}
+		result = append(result, usage)
+	}
+	return result, nil
+}
+
+// UpdateTransferQuota updates the transfer quota for the given user adding uploadAdd and downloadAdd,
+// transferred in the period starting at periodStart. The used transfer quota restarts from zero if
+// the stored one belongs to a previous period and it is not updated if it belongs to a next period.
+// If reset is true uploadAdd and downloadAdd indicates the total bytes instead of the difference.
+func UpdateTransferQuota(p Provider, user User, uploadAdd, downloadAdd, periodStart int64, reset bool) error {
+	if config.TrackQuota == 0 {
+		return &MethodDisabledError{err: trackQuotaDisabledError}
+	}
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateTransferQuota(user.Username, uploadAdd, downloadAdd, periodStart, reset)
+}
+
+// GetTransferQuotaUsage returns the transfer quota limits and the data transferred in the current
+// period for the given user. TrackQuota must be >=1 to enable this method
+func GetTransferQuotaUsage(p Provider, user User) (TransferQuotaUsage, error) {
+	usage := TransferQuotaUsage{
+		TransferQuota: user.Filters.TransferQuota,
+		PeriodStart:   user.Filters.TransferQuota.GetPeriodStart(time.Now()),
+	}
+	if config.TrackQuota == 0 {
+		return usage, &MethodDisabledError{err: trackQuotaDisabledError}
+	}
+	uploadSize, downloadSize, periodStart, err := p.getUsedTransferQuota(user.Username)
+	if err != nil {
+		return usage, err
+	}
+	// the used transfer quota for a previous period is not relevant anymore
+	if periodStart >= usage.PeriodStart {
+		usage.UsedUploadSize = uploadSize
+		usage.UsedDownloadSize = downloadSize
+	}
+	return usage, nil
+}
+
+// UpdateRetainUntil stores the time until the given user's file is locked by a retention policy.
+// A zero time removes the stored time
+func UpdateRetainUntil(p Provider, user User, filePath string, retainUntil time.Time) error {
+	var ms int64
+	if !retainUntil.IsZero() {
+		ms = utils.GetTimeAsMsSinceEpoch(retainUntil)
+	}
+	return p.updateRetainUntil(user.Username, filePath, ms)
+}
+
+// GetRetainUntil returns the stored time until the given user's file is locked by a retention policy.
+// A zero time is returned if no time is stored for the file
+func GetRetainUntil(p Provider, user User, filePath string) (time.Time, error) {
+	ms, err := p.getRetainUntil(user.Username, filePath)
+	if err != nil || ms == 0 {
+		return time.Time{}, err
+	}
+	return utils.GetTimeFromMsecSinceEpoch(ms), nil
+}
+
+// FolderExists checks if the virtual folder with the given name exists, returns an error if no match is found
+func FolderExists(p Provider, name string) (BaseVirtualFolder, error) {
+	return p.folderExists(name)
+}
+
+// GetFolderByID returns the virtual folder with the given database ID if a match is found or an error
+func GetFolderByID(p Provider, ID int64) (BaseVirtualFolder, error) {
+	return p.getFolderByID(ID)
+}
+
+// AddFolder adds a new virtual folder.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddFolder(p Provider, folder BaseVirtualFolder) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.addFolder(folder)
+}
+
+// UpdateFolder updates an existing virtual folder.
+// ManageUsers configuration must be set to 1 to enable this method
+func UpdateFolder(p Provider, folder BaseVirtualFolder) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateFolder(folder)
+}
+
+// DeleteFolder deletes an existing virtual folder, the folder is removed from the users
+// that have it mounted too.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteFolder(p Provider, folder BaseVirtualFolder) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	err := p.deleteFolder(folder)
+	if err == nil {
+		vfs.RemoveMemFsStorage(folder.getMemStorageID())
+	}
+	return err
+}
+
+// GetFolders returns an array of virtual folders respecting limit and offset and filtered by name exact match if not empty
+func GetFolders(p Provider, limit int, offset int, order string, name string) ([]BaseVirtualFolder, error) {
+	return p.getFolders(limit, offset, order, name)
+}
+
+// DumpFolders returns an array with all virtual folders including their credentials
+func DumpFolders(p Provider) ([]BaseVirtualFolder, error) {
+	return p.dumpFolders()
+}
+
+// RotateSecrets encrypts again, using the current key of the configured secrets provider,
+// all the users and virtual folders secrets that are not encrypted using this key.
+// Secrets encrypted using the legacy format and plain GCS credentials files are encrypted too.
+// It returns the number of updated users and folders
+func RotateSecrets(p Provider) (int, int, error) {
+	if !secrets.IsConfigured() {
+		return 0, 0, errors.New("no secrets provider configured")
+	}
+	users, err := p.dumpUsers()
+	if err != nil {
+		return 0, 0, err
+	}
+	numUsers := 0
+	for _, user := range users {
+		rotated, err := rotateFilesystemSecrets(&user.FsConfig)
+		if err != nil {
+			return numUsers, 0, fmt.Errorf("unable to rotate secrets for user %#v: %v", user.Username, err)
+		}
+		if !rotated {
+			continue
+		}
+		if err = p.updateUser(user); err != nil {
+			return numUsers, 0, fmt.Errorf("unable to update user %#v: %v", user.Username, err)
+		}
+		providerLog(logger.LevelInfo, "secrets rotated for user %#v", user.Username)
+		numUsers++
+	}
+	folders, err := p.dumpFolders()
+	if err != nil {
+		return numUsers, 0, err
+	}
+	numFolders := 0
+	for _, folder := range folders {
+		rotated, err := rotateFilesystemSecrets(&folder.FsConfig)
+		if err != nil {
+			return numUsers, numFolders, fmt.Errorf("unable to rotate secrets for folder %#v: %v", folder.Name, err)
+		}
+		if !rotated {
+			continue
+		}
+		if err = p.updateFolder(folder); err != nil {
+			return numUsers, numFolders, fmt.Errorf("unable to update folder %#v: %v", folder.Name, err)
+		}
+		providerLog(logger.LevelInfo, "secrets rotated for folder %#v", folder.Name)
+		numFolders++
+	}
+	return numUsers, numFolders, nil
+}
+
+// CollectDedupGarbage checks all the blob stores used by the deduplicating users and folders.
+// Orphan blobs are removed and the reference counters are fixed, nothing is modified if dryRun is true.
+// The results are returned for each store path
+func CollectDedupGarbage(p Provider, verify, dryRun bool) (map[string]vfs.DedupStoreGCResult, error) {
+	results := make(map[string]vfs.DedupStoreGCResult)
+	namespaces := make(map[string][]string)
+	addNamespace := func(storePath, namespace string) {
+		for _, n := range namespaces[storePath] {
+			if n == namespace {
+				return
+			}
+		}
+		namespaces[storePath] = append(namespaces[storePath], namespace)
+	}
+	users, err := p.dumpUsers()
+	if err != nil {
+		return results, err
+	}
+	for _, user := range users {
+		if user.FsConfig.Provider == 6 {
+			addNamespace(user.FsConfig.DedupConfig.StorePath, user.GetHomeDir())
+		}
+	}
+	folders, err := p.dumpFolders()
+	if err != nil {
+		return results, err
+	}
+	for _, folder := range folders {
+		if folder.FsConfig.Provider == 6 {
+			addNamespace(folder.FsConfig.DedupConfig.StorePath, folder.GetMappedPath())
+		}
+	}
+	for storePath, storeNamespaces := range namespaces {
+		result, err := vfs.CollectDedupStoreGarbage(storePath, storeNamespaces, verify, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("unable to check store %#v: %v", storePath, err)
+		}
+		providerLog(logger.LevelInfo, "store %#v checked, blobs: %v, orphans: %v, fixed counters: %v, dry run: %v",
+			storePath, result.Blobs, result.OrphanBlobs, result.FixedCounters, dryRun)
+		results[storePath] = result
+	}
+	return results, nil
+}
+
 // GetProviderStatus returns an error if the provider is not available
 func GetProviderStatus(p Provider) error {
 	return p.checkAvailability()
@@ -529,53 +813,279 @@ func validateFilters(user *User) error {
 			return &ValidationError{err: fmt.Sprintf("could not parse allowed IP/Mask %#v : %v", IPMask, err)}
 		}
 	}
+	if user.Filters.MaxUploadFileSize < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid max upload file size: %v", user.Filters.MaxUploadFileSize)}
+	}
+	if user.Filters.Trash.RetentionDays < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid trash retention days: %v", user.Filters.Trash.RetentionDays)}
+	}
+	if err := validateRetentionPolicies(user); err != nil {
+		return err
+	}
+	if err := validateDirQuotas(user); err != nil {
+		return err
+	}
+	if err := validateFilePatterns(user); err != nil {
+		return err
+	}
+	return validateTransferQuota(user)
+}
+
+func validateFilePatterns(user *User) error {
+	var filters []PatternsFilter
+	for _, f := range user.Filters.FilePatterns {
+		if !path.IsAbs(f.Path) {
+			return &ValidationError{err: fmt.Sprintf("invalid file patterns path %#v, it must be an absolute path", f.Path)}
+		}
+		f.Path = path.Clean(f.Path)
+		if len(f.AllowedPatterns) == 0 && len(f.DeniedPatterns) == 0 {
+			return &ValidationError{err: fmt.Sprintf("no file patterns defined for path %#v", f.Path)}
+		}
+		allowed, err := validatePatterns(f.AllowedPatterns)
+		if err != nil {
+			return err
+		}
+		denied, err := validatePatterns(f.DeniedPatterns)
+		if err != nil {
+			return err
+		}
+		for _, existing := range filters {
+			if existing.Path == f.Path {
+				return &ValidationError{err: fmt.Sprintf("duplicate file patterns for path %#v", f.Path)}
+			}
+		}
+		f.AllowedPatterns = allowed
+		f.DeniedPatterns = denied
+		filters = append(filters, f)
+	}
+	user.Filters.FilePatterns = filters
+	return nil
+}
+
+func validatePatterns(patterns []string) ([]string, error) {
+	var result []string
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if strings.Contains(pattern, "/") {
+			return nil, &ValidationError{err: fmt.Sprintf("invalid file pattern %#v, it cannot contain a path separator",
+				pattern)}
+		}
+		if _, err := path.Match(pattern, "abc"); err != nil {
+			return nil, &ValidationError{err: fmt.Sprintf("invalid file pattern %#v: %v", pattern, err)}
+		}
+		if !utils.IsStringInSlice(pattern, result) {
+			result = append(result, pattern)
+		}
+	}
+	return result, nil
+}
+
+func validateTransferQuota(user *User) error {
+	quota := &user.Filters.TransferQuota
+	if quota.UploadSize < 0 || quota.DownloadSize < 0 {
+		return &ValidationError{err: "invalid transfer quota, the limits cannot be negative"}
+	}
+	switch quota.Period {
+	case "":
+		if quota.UploadSize > 0 || quota.DownloadSize > 0 {
+			return &ValidationError{err: "invalid transfer quota, a period is required"}
+		}
+	case TransferQuotaPeriodDaily, TransferQuotaPeriodMonthly:
+		if quota.UploadSize == 0 && quota.DownloadSize == 0 {
+			return &ValidationError{err: "invalid transfer quota, no limits defined"}
+		}
+	default:
+		return &ValidationError{err: fmt.Sprintf("invalid transfer quota period: %#v", quota.Period)}
+	}
 	return nil
 }
 
-func saveGCSCredentials(user *User) error {
-	if user.FsConfig.Provider != 2 {
+func validateDirQuotas(user *User) error {
+	var quotas []DirQuota
+	for _, quota := range user.Filters.DirQuotas {
+		if !path.IsAbs(quota.Path) {
+			return &ValidationError{err: fmt.Sprintf("invalid directory quota path %#v, it must be an absolute path",
+				quota.Path)}
+		}
+		quota.Path = path.Clean(quota.Path)
+		if quota.Path == "/" {
+			return &ValidationError{err: "invalid directory quota path \"/\", use the user's quota instead"}
+		}
+		if quota.QuotaSize < 0 || quota.QuotaFiles < 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid quota for directory %#v", quota.Path)}
+		}
+		if quota.QuotaSize == 0 && quota.QuotaFiles == 0 {
+			return &ValidationError{err: fmt.Sprintf("no quota restrictions defined for directory %#v", quota.Path)}
+		}
+		if _, err := user.GetVirtualFolderForPath(quota.Path); err == nil {
+			return &ValidationError{err: fmt.Sprintf("invalid directory quota path %#v, it is inside a virtual folder",
+				quota.Path)}
+		}
+		for _, q := range quotas {
+			if q.Path == quota.Path {
+				return &ValidationError{err: fmt.Sprintf("duplicate directory quota for path %#v", quota.Path)}
+			}
+		}
+		quotas = append(quotas, quota)
+	}
+	user.Filters.DirQuotas = quotas
+	return nil
+}
+
+func validateRetentionPolicies(user *User) error {
+	var policies []vfs.RetentionPolicy
+	for _, policy := range user.Filters.RetentionPolicies {
+		if !path.IsAbs(policy.Path) {
+			return &ValidationError{err: fmt.Sprintf("invalid retention policy path %#v, it must be an absolute path",
+				policy.Path)}
+		}
+		policy.Path = path.Clean(policy.Path)
+		if policy.Days <= 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid retention days %v for path %#v", policy.Days, policy.Path)}
+		}
+		for _, p := range policies {
+			if p.Path == policy.Path {
+				return &ValidationError{err: fmt.Sprintf("duplicate retention policy for path %#v", policy.Path)}
+			}
+		}
+		policies = append(policies, policy)
+	}
+	user.Filters.RetentionPolicies = policies
+	return nil
+}
+
+func saveGCSCredentials(fsConfig *Filesystem, credentialsFilePath string) error {
+	if fsConfig.Provider != 2 {
 		return nil
 	}
-	if len(user.FsConfig.GCSConfig.Credentials) == 0 {
+	if fsConfig.GCSConfig.AutomaticCredentials {
+		// credentials are not needed anymore, remove the stored ones, if any
+		if err := os.Remove(credentialsFilePath); err != nil && !os.IsNotExist(err) {
+			providerLog(logger.LevelWarn, "unable to remove GCS credentials file %#v: %v", credentialsFilePath, err)
+		}
 		return nil
 	}
-	decoded, err := base64.StdEncoding.DecodeString(user.FsConfig.GCSConfig.Credentials)
-	if err != nil {
-		return &ValidationError{err: fmt.Sprintf("could not validate GCS credentials: %v", err)}
+	if len(fsConfig.GCSConfig.Credentials) == 0 {
+		return nil
+	}
+	// credentials restored from a dump are already encrypted
+	credentials := fsConfig.GCSConfig.Credentials
+	if !secrets.IsEncrypted(credentials) {
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate GCS credentials: %v", err)}
+		}
+		credentials, err = secrets.Encrypt(string(decoded))
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt GCS credentials: %v", err)}
+		}
 	}
-	err = ioutil.WriteFile(user.getGCSCredentialsFilePath(), decoded, 0600)
+	err := ioutil.WriteFile(credentialsFilePath, []byte(credentials), 0600)
 	if err != nil {
 		return &ValidationError{err: fmt.Sprintf("could not save GCS credentials: %v", err)}
 	}
-	user.FsConfig.GCSConfig.Credentials = ""
+	fsConfig.GCSConfig.Credentials = ""
 	return nil
 }
 
-func validateFilesystemConfig(user *User) error {
-	if user.FsConfig.Provider == 1 {
-		err := vfs.ValidateS3FsConfig(&user.FsConfig.S3Config)
+func validateFilesystemConfig(fsConfig *Filesystem, gcsCredentialsFilePath string) error {
+	if fsConfig.Provider == 1 {
+		err := vfs.ValidateS3FsConfig(&fsConfig.S3Config)
 		if err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate s3config: %v", err)}
 		}
-		vals := strings.Split(user.FsConfig.S3Config.AccessSecret, "$")
-		if !strings.HasPrefix(user.FsConfig.S3Config.AccessSecret, "$aes$") || len(vals) != 4 {
-			accessSecret, err := utils.EncryptData(user.FsConfig.S3Config.AccessSecret)
+		if len(fsConfig.S3Config.AccessSecret) > 0 && !secrets.IsEncrypted(fsConfig.S3Config.AccessSecret) {
+			accessSecret, err := secrets.Encrypt(fsConfig.S3Config.AccessSecret)
 			if err != nil {
 				return &ValidationError{err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
 			}
-			user.FsConfig.S3Config.AccessSecret = accessSecret
+			fsConfig.S3Config.AccessSecret = accessSecret
+		}
+		if len(fsConfig.S3Config.SSECustomerKey) > 0 && !secrets.IsEncrypted(fsConfig.S3Config.SSECustomerKey) {
+			sseCustomerKey, err := secrets.Encrypt(fsConfig.S3Config.SSECustomerKey)
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not encrypt s3 SSE customer key: %v", err)}
+			}
+			fsConfig.S3Config.SSECustomerKey = sseCustomerKey
 		}
 		return nil
-	} else if user.FsConfig.Provider == 2 {
-		err := vfs.ValidateGCSFsConfig(&user.FsConfig.GCSConfig, user.getGCSCredentialsFilePath())
+	} else if fsConfig.Provider == 2 {
+		err := vfs.ValidateGCSFsConfig(&fsConfig.GCSConfig, gcsCredentialsFilePath)
 		if err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate GCS config: %v", err)}
 		}
 		return nil
+	} else if fsConfig.Provider == 3 {
+		err := vfs.ValidateAzBlobFsConfig(&fsConfig.AzBlobConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate Azure Blob config: %v", err)}
+		}
+		if len(fsConfig.AzBlobConfig.AccountKey) > 0 && !secrets.IsEncrypted(fsConfig.AzBlobConfig.AccountKey) {
+			accountKey, err := secrets.Encrypt(fsConfig.AzBlobConfig.AccountKey)
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not encrypt Azure blob account key: %v", err)}
+			}
+			fsConfig.AzBlobConfig.AccountKey = accountKey
+		}
+		if len(fsConfig.AzBlobConfig.SASURL) > 0 && !secrets.IsEncrypted(fsConfig.AzBlobConfig.SASURL) {
+			_, err := url.ParseRequestURI(fsConfig.AzBlobConfig.SASURL)
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("invalid Azure blob SAS URL: %v", err)}
+			}
+			sasURL, err := secrets.Encrypt(fsConfig.AzBlobConfig.SASURL)
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not encrypt Azure blob SAS URL: %v", err)}
+			}
+			fsConfig.AzBlobConfig.SASURL = sasURL
+		}
+		return nil
+	} else if fsConfig.Provider == 4 {
+		err := vfs.ValidateSFTPFsConfig(&fsConfig.SFTPConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate SFTP config: %v", err)}
+		}
+		if len(fsConfig.SFTPConfig.Password) > 0 && !secrets.IsEncrypted(fsConfig.SFTPConfig.Password) {
+			password, err := secrets.Encrypt(fsConfig.SFTPConfig.Password)
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not encrypt SFTP password: %v", err)}
+			}
+			fsConfig.SFTPConfig.Password = password
+		}
+		if len(fsConfig.SFTPConfig.PrivateKey) > 0 && !secrets.IsEncrypted(fsConfig.SFTPConfig.PrivateKey) {
+			_, err := ssh.ParsePrivateKey([]byte(fsConfig.SFTPConfig.PrivateKey))
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("invalid SFTP private key: %v", err)}
+			}
+			privateKey, err := secrets.Encrypt(fsConfig.SFTPConfig.PrivateKey)
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not encrypt SFTP private key: %v", err)}
+			}
+			fsConfig.SFTPConfig.PrivateKey = privateKey
+		}
+		return nil
+	} else if fsConfig.Provider == 5 {
+		err := vfs.ValidateMemFsConfig(&fsConfig.MemConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate memory filesystem config: %v", err)}
+		}
+		return nil
+	} else if fsConfig.Provider == 6 {
+		err := vfs.ValidateDedupFsConfig(&fsConfig.DedupConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate deduplicating filesystem config: %v", err)}
+		}
+		return nil
 	}
-	user.FsConfig.Provider = 0
-	user.FsConfig.S3Config = vfs.S3FsConfig{}
-	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	fsConfig.Provider = 0
+	fsConfig.S3Config = vfs.S3FsConfig{}
+	fsConfig.GCSConfig = vfs.GCSFsConfig{}
+	fsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	fsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	fsConfig.MemConfig = vfs.MemFsConfig{}
+	fsConfig.DedupConfig = vfs.DedupFsConfig{}
 	return nil
 }
 
@@ -592,6 +1102,110 @@ func validateBaseParams(user *User) error {
 	return nil
 }
 
+func validateCryptConfig(fsConfig *Filesystem) error {
+	if len(fsConfig.CryptConfig.Passphrase) == 0 || secrets.IsEncrypted(fsConfig.CryptConfig.Passphrase) {
+		return nil
+	}
+	passphrase, err := secrets.Encrypt(fsConfig.CryptConfig.Passphrase)
+	if err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt passphrase: %v", err)}
+	}
+	fsConfig.CryptConfig.Passphrase = passphrase
+	return nil
+}
+
+func validateVirtualFolders(user *User) error {
+	if len(user.VirtualFolders) == 0 {
+		user.VirtualFolders = nil
+		return nil
+	}
+	var virtualFolders []VirtualFolder
+	folderNames := make(map[string]bool)
+	for _, v := range user.VirtualFolders {
+		if len(v.Name) == 0 {
+			return &ValidationError{err: fmt.Sprintf("the folder name for the virtual path %#v is mandatory", v.VirtualPath)}
+		}
+		cleanedVPath := filepath.ToSlash(path.Clean(v.VirtualPath))
+		if !path.IsAbs(cleanedVPath) || cleanedVPath == "/" {
+			return &ValidationError{err: fmt.Sprintf("invalid virtual folder path %#v for folder %#v", v.VirtualPath, v.Name)}
+		}
+		if v.QuotaSize < 0 || v.QuotaFiles < 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid quota for virtual folder %#v", v.VirtualPath)}
+		}
+		if folderNames[v.Name] {
+			return &ValidationError{err: fmt.Sprintf("folder %#v is mounted more than once", v.Name)}
+		}
+		for _, other := range virtualFolders {
+			if other.IsInside(cleanedVPath) || strings.HasPrefix(other.VirtualPath, cleanedVPath+"/") {
+				return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v, it overlaps with %#v",
+					v.VirtualPath, other.VirtualPath)}
+			}
+		}
+		folderNames[v.Name] = true
+		virtualFolders = append(virtualFolders, VirtualFolder{
+			BaseVirtualFolder: BaseVirtualFolder{
+				Name: v.Name,
+			},
+			VirtualPath: cleanedVPath,
+			QuotaSize:   v.QuotaSize,
+			QuotaFiles:  v.QuotaFiles,
+		})
+	}
+	user.VirtualFolders = virtualFolders
+	return nil
+}
+
+// checkVirtualFolderForUser checks that the given folder can be mounted for the specified user
+// and sets the folder details inside the matching user's virtual folder
+func checkVirtualFolderForUser(user *User, idx int, folder BaseVirtualFolder) error {
+	if folder.FsConfig.isLocal() && user.FsConfig.isLocal() {
+		mappedPath := folder.GetMappedPath()
+		homeDir := user.GetHomeDir()
+		if isLocalPathInside(mappedPath, homeDir) || isLocalPathInside(homeDir, mappedPath) {
+			return &ValidationError{err: fmt.Sprintf("the mapped path %#v for folder %#v overlaps with the home dir %#v",
+				folder.MappedPath, folder.Name, user.HomeDir)}
+		}
+	}
+	user.VirtualFolders[idx].BaseVirtualFolder = folder
+	return nil
+}
+
+// isLocalPathInside returns true if the local path p is dir or it is inside dir
+func isLocalPathInside(p, dir string) bool {
+	if p == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(os.PathSeparator)) {
+		dir += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(p, dir)
+}
+
+func validateFolder(folder *BaseVirtualFolder) error {
+	if len(folder.Name) == 0 {
+		return &ValidationError{err: "folder name is mandatory"}
+	}
+	if strings.ContainsAny(folder.Name, "/\\") {
+		return &ValidationError{err: fmt.Sprintf("invalid folder name %#v, it cannot contain path separators", folder.Name)}
+	}
+	if folder.FsConfig.isLocal() {
+		if !filepath.IsAbs(folder.MappedPath) {
+			return &ValidationError{err: fmt.Sprintf("invalid mapped path %#v for folder %#v, it must be an absolute path",
+				folder.MappedPath, folder.Name)}
+		}
+		folder.MappedPath = folder.GetMappedPath()
+	} else {
+		folder.MappedPath = ""
+	}
+	if err := validateFilesystemConfig(&folder.FsConfig, folder.getGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	if err := validateCryptConfig(&folder.FsConfig); err != nil {
+		return err
+	}
+	return saveGCSCredentials(&folder.FsConfig, folder.getGCSCredentialsFilePath())
+}
+
 func validateUser(user *User) error {
 	buildUserHomeDir(user)
 	if err := validateBaseParams(user); err != nil {
@@ -600,7 +1214,13 @@ func validateUser(user *User) error {
 	if err := validatePermissions(user); err != nil {
 		return err
 	}
-	if err := validateFilesystemConfig(user); err != nil {
+	if err := validateFilesystemConfig(&user.FsConfig, user.getGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	if err := validateCryptConfig(&user.FsConfig); err != nil {
+		return err
+	}
+	if err := validateVirtualFolders(user); err != nil {
 		return err
 	}
 	if user.Status < 0 || user.Status > 1 {
@@ -619,9 +1239,88 @@ func validateUser(user *User) error {
 	if err := validateFilters(user); err != nil {
 		return err
 	}
-	if err := saveGCSCredentials(user); err != nil {
+	if err := validateReplicationConfig(user); err != nil {
+		return err
+	}
+	if err := validateTieringConfig(user); err != nil {
+		return err
+	}
+	if err := saveGCSCredentials(&user.FsConfig, user.getGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	if err := saveGCSCredentials(&user.Filters.Replication.FsConfig, user.getReplicaGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	return saveGCSCredentials(&user.Filters.Tiering.FsConfig, user.getTieringGCSCredentialsFilePath())
+}
+
+func validateReplicationConfig(user *User) error {
+	config := &user.Filters.Replication
+	if !config.Enabled {
+		user.Filters.Replication = ReplicationConfig{}
+		return nil
+	}
+	if config.FsConfig.Provider == 5 {
+		return &ValidationError{err: "the in memory filesystem cannot be used as replica"}
+	}
+	if err := validateFilesystemConfig(&config.FsConfig, user.getReplicaGCSCredentialsFilePath()); err != nil {
+		return &ValidationError{err: fmt.Sprintf("invalid replica: %v", err)}
+	}
+	if err := validateCryptConfig(&config.FsConfig); err != nil {
+		return err
+	}
+	if !config.FsConfig.isLocal() {
+		config.LocalPath = ""
+		return nil
+	}
+	if !filepath.IsAbs(config.LocalPath) {
+		return &ValidationError{err: fmt.Sprintf("invalid replica local path %#v, it must be an absolute path",
+			config.LocalPath)}
+	}
+	config.LocalPath = filepath.Clean(config.LocalPath)
+	homeDir := user.GetHomeDir()
+	if isLocalPathInside(config.LocalPath, homeDir) || isLocalPathInside(homeDir, config.LocalPath) {
+		return &ValidationError{err: fmt.Sprintf("the replica local path %#v overlaps with the home dir %#v",
+			config.LocalPath, user.HomeDir)}
+	}
+	return nil
+}
+
+func validateTieringConfig(user *User) error {
+	config := &user.Filters.Tiering
+	if !config.Enabled {
+		user.Filters.Tiering = TieringConfig{}
+		return nil
+	}
+	if user.FsConfig.Provider != 0 || len(user.FsConfig.CryptConfig.Passphrase) > 0 {
+		return &ValidationError{err: "tiering is supported for the unencrypted local filesystem only"}
+	}
+	if config.Days <= 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid tiering days: %v, it must be greater than 0", config.Days)}
+	}
+	if config.FsConfig.Provider == 5 {
+		return &ValidationError{err: "the in memory filesystem cannot be used as cold tier"}
+	}
+	if err := validateFilesystemConfig(&config.FsConfig, user.getTieringGCSCredentialsFilePath()); err != nil {
+		return &ValidationError{err: fmt.Sprintf("invalid cold tier: %v", err)}
+	}
+	if err := validateCryptConfig(&config.FsConfig); err != nil {
 		return err
 	}
+	if !config.FsConfig.isLocal() {
+		config.LocalPath = ""
+		return nil
+	}
+	if !filepath.IsAbs(config.LocalPath) {
+		return &ValidationError{err: fmt.Sprintf("invalid cold tier local path %#v, it must be an absolute path",
+			config.LocalPath)}
+	}
+	config.LocalPath = filepath.Clean(config.LocalPath)
+	homeDir := user.GetHomeDir()
+	if isLocalPathInside(config.LocalPath, homeDir) || isLocalPathInside(homeDir, config.LocalPath) {
+		return &ValidationError{err: fmt.Sprintf("the cold tier local path %#v overlaps with the home dir %#v",
+			config.LocalPath, user.HomeDir)}
+	}
 	return nil
 }
 
@@ -761,26 +1460,136 @@ func comparePbkdf2PasswordAndHash(password, hashedPassword string) (bool, error)
 // HideUserSensitiveData hides user sensitive data
 func HideUserSensitiveData(user *User) User {
 	user.Password = ""
-	if user.FsConfig.Provider == 1 {
-		user.FsConfig.S3Config.AccessSecret = utils.RemoveDecryptionKey(user.FsConfig.S3Config.AccessSecret)
-	} else if user.FsConfig.Provider == 2 {
-		user.FsConfig.GCSConfig.Credentials = ""
+	hideFilesystemSensitiveData(&user.FsConfig)
+	for idx := range user.VirtualFolders {
+		hideFilesystemSensitiveData(&user.VirtualFolders[idx].FsConfig)
 	}
+	hideFilesystemSensitiveData(&user.Filters.Replication.FsConfig)
+	hideFilesystemSensitiveData(&user.Filters.Tiering.FsConfig)
 	return *user
 }
 
+// HideFolderSensitiveData hides folder sensitive data
+func HideFolderSensitiveData(folder *BaseVirtualFolder) BaseVirtualFolder {
+	hideFilesystemSensitiveData(&folder.FsConfig)
+	return *folder
+}
+
+func hideFilesystemSensitiveData(fsConfig *Filesystem) {
+	if fsConfig.Provider == 1 {
+		fsConfig.S3Config.AccessSecret = secrets.Mask(fsConfig.S3Config.AccessSecret)
+		fsConfig.S3Config.SSECustomerKey = secrets.Mask(fsConfig.S3Config.SSECustomerKey)
+	} else if fsConfig.Provider == 2 {
+		fsConfig.GCSConfig.Credentials = ""
+	} else if fsConfig.Provider == 3 {
+		fsConfig.AzBlobConfig.AccountKey = secrets.Mask(fsConfig.AzBlobConfig.AccountKey)
+		fsConfig.AzBlobConfig.SASURL = secrets.Mask(fsConfig.AzBlobConfig.SASURL)
+	} else if fsConfig.Provider == 4 {
+		fsConfig.SFTPConfig.Password = secrets.Mask(fsConfig.SFTPConfig.Password)
+		fsConfig.SFTPConfig.PrivateKey = secrets.Mask(fsConfig.SFTPConfig.PrivateKey)
+	}
+	fsConfig.CryptConfig.Passphrase = secrets.Mask(fsConfig.CryptConfig.Passphrase)
+}
+
 func addCredentialsToUser(user *User) error {
-	if user.FsConfig.Provider != 2 {
+	if err := addGCSCredentials(&user.FsConfig, user.getGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	if err := addGCSCredentials(&user.Filters.Replication.FsConfig, user.getReplicaGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	return addGCSCredentials(&user.Filters.Tiering.FsConfig, user.getTieringGCSCredentialsFilePath())
+}
+
+func addCredentialsToFolder(folder *BaseVirtualFolder) error {
+	return addGCSCredentials(&folder.FsConfig, folder.getGCSCredentialsFilePath())
+}
+
+func addGCSCredentials(fsConfig *Filesystem, credentialsFilePath string) error {
+	if fsConfig.Provider != 2 || fsConfig.GCSConfig.AutomaticCredentials {
 		return nil
 	}
-	cred, err := ioutil.ReadFile(user.getGCSCredentialsFilePath())
+	cred, err := ioutil.ReadFile(credentialsFilePath)
 	if err != nil {
 		return err
 	}
-	user.FsConfig.GCSConfig.Credentials = base64.StdEncoding.EncodeToString(cred)
+	// encrypted credentials are dumped as they are, so they can be restored without decrypting them
+	if secrets.IsEncrypted(string(cred)) {
+		fsConfig.GCSConfig.Credentials = string(cred)
+	} else {
+		fsConfig.GCSConfig.Credentials = base64.StdEncoding.EncodeToString(cred)
+	}
 	return nil
 }
 
+// readGCSCredentials returns the base64 encoded and decrypted GCS credentials
+// stored inside the given file. Credentials saved before the encryption support
+// are stored as plain JSON
+func readGCSCredentials(credentialsFilePath string) (string, error) {
+	cred, err := ioutil.ReadFile(credentialsFilePath)
+	if err != nil {
+		return "", err
+	}
+	if secrets.IsEncrypted(string(cred)) {
+		decrypted, err := secrets.Decrypt(string(cred))
+		if err != nil {
+			return "", err
+		}
+		cred = []byte(decrypted)
+	}
+	return base64.StdEncoding.EncodeToString(cred), nil
+}
+
+// rotateFilesystemSecrets encrypts again the secrets for the given filesystem,
+// if needed, and returns true if at least a secret was changed.
+// The GCS credentials are expected as returned by addGCSCredentials
+func rotateFilesystemSecrets(fsConfig *Filesystem) (bool, error) {
+	var toRotate []*string
+	switch fsConfig.Provider {
+	case 1:
+		toRotate = append(toRotate, &fsConfig.S3Config.AccessSecret, &fsConfig.S3Config.SSECustomerKey)
+	case 2:
+		credentials := fsConfig.GCSConfig.Credentials
+		if len(credentials) > 0 && !secrets.IsEncrypted(credentials) {
+			decoded, err := base64.StdEncoding.DecodeString(credentials)
+			if err != nil {
+				return false, err
+			}
+			credentials, err = secrets.Encrypt(string(decoded))
+			if err != nil {
+				return false, err
+			}
+			fsConfig.GCSConfig.Credentials = credentials
+			return true, nil
+		}
+		toRotate = append(toRotate, &fsConfig.GCSConfig.Credentials)
+	case 3:
+		toRotate = append(toRotate, &fsConfig.AzBlobConfig.AccountKey, &fsConfig.AzBlobConfig.SASURL)
+	case 4:
+		toRotate = append(toRotate, &fsConfig.SFTPConfig.Password, &fsConfig.SFTPConfig.PrivateKey)
+	}
+	toRotate = append(toRotate, &fsConfig.CryptConfig.Passphrase)
+	result := false
+	for _, secret := range toRotate {
+		rotated, changed, err := secrets.Rotate(*secret)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			*secret = rotated
+			result = true
+		}
+	}
+	return result, nil
+}
+
+func decryptSecret(secret string) (string, error) {
+	if len(secret) == 0 {
+		return secret, nil
+	}
+	return secrets.Decrypt(secret)
+}
+
 func getSSLMode() string {
 	if config.Driver == PGSQLDataProviderName {
 		if config.SSLMode == 0 {
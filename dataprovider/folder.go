@@ -0,0 +1,137 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+// BaseVirtualFolder defines a storage location that can be mounted inside the
+// namespace of one or more users
+type BaseVirtualFolder struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique name for this folder, it is used to reference the folder from the users
+	Name string `json:"name"`
+	// Absolute path to the local directory to expose. It is used if the filesystem provider is local
+	MappedPath string `json:"mapped_path,omitempty"`
+	// Used quota as bytes
+	UsedQuotaSize int64 `json:"used_quota_size"`
+	// Used quota as number of files
+	UsedQuotaFiles int `json:"used_quota_files"`
+	// Last quota update as unix timestamp in milliseconds
+	LastQuotaUpdate int64 `json:"last_quota_update"`
+	// Users with this folder mounted. This field is read only
+	Users []string `json:"users,omitempty"`
+	// Filesystem configuration details
+	FsConfig Filesystem `json:"filesystem"`
+}
+
+// VirtualFolder defines a mapping between an SFTP path and a base virtual folder
+type VirtualFolder struct {
+	BaseVirtualFolder
+	// The SFTP path where the folder is mounted
+	VirtualPath string `json:"virtual_path"`
+	// Maximum size allowed as bytes. 0 means unlimited
+	QuotaSize int64 `json:"quota_size"`
+	// Maximum number of files allowed. 0 means unlimited
+	QuotaFiles int `json:"quota_files"`
+}
+
+// GetFilesystem returns the filesystem for this folder.
+// localTempDir is used by remote filesystems to store temporary files
+func (v *BaseVirtualFolder) GetFilesystem(connectionID, localTempDir string) (vfs.Fs, error) {
+	rootDir := localTempDir
+	if v.FsConfig.isLocal() {
+		rootDir = v.GetMappedPath()
+	}
+	return v.FsConfig.getFilesystem(connectionID, rootDir, v.getGCSCredentialsFilePath(), v.getMemStorageID())
+}
+
+// GetMappedPath returns the shortest path name equivalent to the mapped local directory
+func (v *BaseVirtualFolder) GetMappedPath() string {
+	return filepath.Clean(v.MappedPath)
+}
+
+// GetStorageDescription returns the mapped path for local folders or the storage
+// provider for remote ones
+func (v *BaseVirtualFolder) GetStorageDescription() string {
+	switch v.FsConfig.Provider {
+	case 1:
+		return "S3"
+	case 2:
+		return "GCS"
+	case 3:
+		return "Azure"
+	case 4:
+		return "SFTP"
+	case 5:
+		return "Memory"
+	case 6:
+		return "Dedup: " + v.MappedPath
+	}
+	return v.MappedPath
+}
+
+// GetQuotaSummary returns the used quota
+func (v *BaseVirtualFolder) GetQuotaSummary() string {
+	result := "Files: " + strconv.Itoa(v.UsedQuotaFiles)
+	if v.UsedQuotaSize > 0 {
+		result += ". Size: " + utils.ByteCountSI(v.UsedQuotaSize)
+	}
+	return result
+}
+
+// GetFsConfigAsJSON returns the filesystem config as json byte array
+func (v *BaseVirtualFolder) GetFsConfigAsJSON() ([]byte, error) {
+	return json.Marshal(v.FsConfig)
+}
+
+func (v *BaseVirtualFolder) getGCSCredentialsFilePath() string {
+	return filepath.Join(credentialsDirPath, fmt.Sprintf("folder_%v_gcs_credentials.json", v.Name))
+}
+
+func (v *BaseVirtualFolder) getMemStorageID() string {
+	return fmt.Sprintf("folder_%v", v.Name)
+}
+
+func (v *BaseVirtualFolder) getACopy() BaseVirtualFolder {
+	users := make([]string, len(v.Users))
+	copy(users, v.Users)
+	return BaseVirtualFolder{
+		ID:              v.ID,
+		Name:            v.Name,
+		MappedPath:      v.MappedPath,
+		UsedQuotaSize:   v.UsedQuotaSize,
+		UsedQuotaFiles:  v.UsedQuotaFiles,
+		LastQuotaUpdate: v.LastQuotaUpdate,
+		Users:           users,
+		FsConfig:        v.FsConfig.getACopy(),
+	}
+}
+
+// HasQuotaRestrictions returns true if there is a quota restriction on number of files or size or both
+func (v *VirtualFolder) HasQuotaRestrictions() bool {
+	return v.QuotaFiles > 0 || v.QuotaSize > 0
+}
+
+// GetRelativePath returns the path, inside the folder, for the given SFTP path.
+// The SFTP path must be inside this folder
+func (v *VirtualFolder) GetRelativePath(sftpPath string) string {
+	rel := strings.TrimPrefix(path.Clean(sftpPath), v.VirtualPath)
+	if len(rel) == 0 {
+		return "/"
+	}
+	return rel
+}
+
+// IsInside returns true if the given SFTP path is the folder mount point or it is inside the folder
+func (v *VirtualFolder) IsInside(sftpPath string) bool {
+	return sftpPath == v.VirtualPath || strings.HasPrefix(sftpPath, v.VirtualPath+"/")
+}
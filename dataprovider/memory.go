@@ -27,6 +27,19 @@ type memoryProviderHandle struct {
 	usersIdx map[int64]string
 	// map for users, username is the key
 	users map[string]User
+	// slice with ordered folder names
+	vfoldersNames []string
+	// mapping between ID and folder name
+	vfoldersIdx map[int64]string
+	// map for virtual folders, the folder name is the key
+	vfolders map[string]BaseVirtualFolder
+	// used quota for the users' directories, the username and the directory path are the keys
+	dirQuotas map[string]map[string]DirQuotaUsage
+	// used transfer quota for the users, the username is the key
+	transferQuotas map[string]TransferQuotaUsage
+	// times until the users' files are locked by a retention policy, the username and the file path are the keys.
+	// They are not cleared on config reload
+	retentionLocks map[string]map[string]int64
 	// configuration file to use for loading users
 	configFile string
 	lock       *sync.Mutex
@@ -47,12 +60,18 @@ func initializeMemoryProvider(basePath string) error {
 	}
 	provider = MemoryProvider{
 		dbHandle: &memoryProviderHandle{
-			isClosed:   false,
-			usernames:  []string{},
-			usersIdx:   make(map[int64]string),
-			users:      make(map[string]User),
-			configFile: configFile,
-			lock:       new(sync.Mutex),
+			isClosed:       false,
+			usernames:      []string{},
+			usersIdx:       make(map[int64]string),
+			users:          make(map[string]User),
+			vfoldersNames:  []string{},
+			vfoldersIdx:    make(map[int64]string),
+			vfolders:       make(map[string]BaseVirtualFolder),
+			dirQuotas:      make(map[string]map[string]DirQuotaUsage),
+			transferQuotas: make(map[string]TransferQuotaUsage),
+			retentionLocks: make(map[string]map[string]int64),
+			configFile:     configFile,
+			lock:           new(sync.Mutex),
 		},
 	}
 	return provider.reloadConfig()
@@ -181,7 +200,12 @@ func (p MemoryProvider) addUser(user User) error {
 	if err == nil {
 		return fmt.Errorf("username %v already exists", user.Username)
 	}
+	err = p.checkVirtualFolders(&user)
+	if err != nil {
+		return err
+	}
 	user.ID = p.getNextID()
+	p.addUserToFolders(user.Username, user.VirtualFolders)
 	p.dbHandle.users[user.Username] = user
 	p.dbHandle.usersIdx[user.ID] = user.Username
 	p.dbHandle.usernames = append(p.dbHandle.usernames, user.Username)
@@ -199,10 +223,21 @@ func (p MemoryProvider) updateUser(user User) error {
 	if err != nil {
 		return err
 	}
-	_, err = p.userExistsInternal(user.Username)
+	u, err := p.userExistsInternal(user.Username)
 	if err != nil {
 		return err
 	}
+	err = p.checkVirtualFolders(&user)
+	if err != nil {
+		return err
+	}
+	p.removeUserFromFolders(u.Username, u.VirtualFolders)
+	p.addUserToFolders(user.Username, user.VirtualFolders)
+	for dirPath := range p.dbHandle.dirQuotas[user.Username] {
+		if !user.hasDirQuota(dirPath) {
+			delete(p.dbHandle.dirQuotas[user.Username], dirPath)
+		}
+	}
 	p.dbHandle.users[user.Username] = user
 	return nil
 }
@@ -213,10 +248,14 @@ func (p MemoryProvider) deleteUser(user User) error {
 	if p.dbHandle.isClosed {
 		return errMemoryProviderClosed
 	}
-	_, err := p.userExistsInternal(user.Username)
+	u, err := p.userExistsInternal(user.Username)
 	if err != nil {
 		return err
 	}
+	p.removeUserFromFolders(u.Username, u.VirtualFolders)
+	delete(p.dbHandle.dirQuotas, user.Username)
+	delete(p.dbHandle.transferQuotas, user.Username)
+	delete(p.dbHandle.retentionLocks, user.Username)
 	delete(p.dbHandle.users, user.Username)
 	delete(p.dbHandle.usersIdx, user.ID)
 	// this could be more efficient
@@ -237,7 +276,7 @@ func (p MemoryProvider) dumpUsers() ([]User, error) {
 		return users, errMemoryProviderClosed
 	}
 	for _, username := range p.dbHandle.usernames {
-		user := p.dbHandle.users[username]
+		user := p.getUserWithFolders(username)
 		err = addCredentialsToUser(&user)
 		if err != nil {
 			return users, err
@@ -274,7 +313,7 @@ func (p MemoryProvider) getUsers(limit int, offset int, order string, username s
 			if itNum <= offset {
 				continue
 			}
-			user := p.dbHandle.users[username]
+			user := p.getUserWithFolders(username)
 			users = append(users, HideUserSensitiveData(&user))
 			if len(users) >= limit {
 				break
@@ -287,7 +326,7 @@ func (p MemoryProvider) getUsers(limit int, offset int, order string, username s
 				continue
 			}
 			username := p.dbHandle.usernames[i]
-			user := p.dbHandle.users[username]
+			user := p.getUserWithFolders(username)
 			users = append(users, HideUserSensitiveData(&user))
 			if len(users) >= limit {
 				break
@@ -307,12 +346,406 @@ func (p MemoryProvider) userExists(username string) (User, error) {
 }
 
 func (p MemoryProvider) userExistsInternal(username string) (User, error) {
-	if val, ok := p.dbHandle.users[username]; ok {
-		return val.getACopy(), nil
+	if _, ok := p.dbHandle.users[username]; ok {
+		return p.getUserWithFolders(username), nil
 	}
 	return User{}, &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
 }
 
+// getUserWithFolders returns a copy of the user with the given username and the
+// current details for its virtual folders. The user must exist
+func (p MemoryProvider) getUserWithFolders(username string) User {
+	val := p.dbHandle.users[username]
+	user := val.getACopy()
+	for idx := range user.VirtualFolders {
+		if folder, ok := p.dbHandle.vfolders[user.VirtualFolders[idx].Name]; ok {
+			user.VirtualFolders[idx].BaseVirtualFolder = folder.getACopy()
+		}
+	}
+	return user
+}
+
+func (p MemoryProvider) checkVirtualFolders(user *User) error {
+	for idx, v := range user.VirtualFolders {
+		folder, err := p.folderExistsInternal(v.Name)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("unable to mount folder %#v: %v", v.Name, err)}
+		}
+		err = checkVirtualFolderForUser(user, idx, folder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p MemoryProvider) addUserToFolders(username string, virtualFolders []VirtualFolder) {
+	for _, v := range virtualFolders {
+		if folder, ok := p.dbHandle.vfolders[v.Name]; ok {
+			if !utils.IsStringInSlice(username, folder.Users) {
+				folder.Users = append(folder.Users, username)
+				p.dbHandle.vfolders[folder.Name] = folder
+			}
+		}
+	}
+}
+
+func (p MemoryProvider) removeUserFromFolders(username string, virtualFolders []VirtualFolder) {
+	for _, v := range virtualFolders {
+		if folder, ok := p.dbHandle.vfolders[v.Name]; ok {
+			var users []string
+			for _, u := range folder.Users {
+				if u != username {
+					users = append(users, u)
+				}
+			}
+			folder.Users = users
+			p.dbHandle.vfolders[folder.Name] = folder
+		}
+	}
+}
+
+func (p MemoryProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	folder, err := p.folderExistsInternal(name)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to update quota for folder %#v error: %v", name, err)
+		return err
+	}
+	if reset {
+		folder.UsedQuotaSize = sizeAdd
+		folder.UsedQuotaFiles = filesAdd
+	} else {
+		folder.UsedQuotaSize += sizeAdd
+		folder.UsedQuotaFiles += filesAdd
+	}
+	folder.LastQuotaUpdate = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.vfolders[folder.Name] = folder
+	return nil
+}
+
+func (p MemoryProvider) getUsedFolderQuota(name string) (int, int64, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, 0, errMemoryProviderClosed
+	}
+	folder, err := p.folderExistsInternal(name)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for folder %#v error: %v", name, err)
+		return 0, 0, err
+	}
+	return folder.UsedQuotaFiles, folder.UsedQuotaSize, err
+}
+
+func (p MemoryProvider) updateDirQuota(username, dirPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, err := p.userExistsInternal(username); err != nil {
+		providerLog(logger.LevelWarn, "unable to update quota for user %v, directory %#v error: %v", username, dirPath, err)
+		return err
+	}
+	if _, ok := p.dbHandle.dirQuotas[username]; !ok {
+		p.dbHandle.dirQuotas[username] = make(map[string]DirQuotaUsage)
+	}
+	usage := p.dbHandle.dirQuotas[username][dirPath]
+	usage.Path = dirPath
+	if reset {
+		usage.UsedQuotaSize = sizeAdd
+		usage.UsedQuotaFiles = filesAdd
+	} else {
+		usage.UsedQuotaSize += sizeAdd
+		usage.UsedQuotaFiles += filesAdd
+	}
+	usage.LastQuotaUpdate = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.dirQuotas[username][dirPath] = usage
+	return nil
+}
+
+func (p MemoryProvider) getUsedDirQuotas(username string) ([]DirQuotaUsage, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	usage := []DirQuotaUsage{}
+	for _, u := range p.dbHandle.dirQuotas[username] {
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+func (p MemoryProvider) updateTransferQuota(username string, uploadAdd, downloadAdd, periodStart int64, reset bool) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, err := p.userExistsInternal(username); err != nil {
+		providerLog(logger.LevelWarn, "unable to update transfer quota for user %v error: %v", username, err)
+		return err
+	}
+	usage := p.dbHandle.transferQuotas[username]
+	if reset || usage.PeriodStart < periodStart {
+		usage.UsedUploadSize = uploadAdd
+		usage.UsedDownloadSize = downloadAdd
+		usage.PeriodStart = periodStart
+	} else if usage.PeriodStart == periodStart {
+		usage.UsedUploadSize += uploadAdd
+		usage.UsedDownloadSize += downloadAdd
+	}
+	p.dbHandle.transferQuotas[username] = usage
+	return nil
+}
+
+func (p MemoryProvider) getUsedTransferQuota(username string) (int64, int64, int64, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, 0, 0, errMemoryProviderClosed
+	}
+	usage := p.dbHandle.transferQuotas[username]
+	return usage.UsedUploadSize, usage.UsedDownloadSize, usage.PeriodStart, nil
+}
+
+func (p MemoryProvider) updateRetainUntil(username, filePath string, retainUntil int64) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, err := p.userExistsInternal(username); err != nil {
+		providerLog(logger.LevelWarn, "unable to update retain until for user %v error: %v", username, err)
+		return err
+	}
+	if retainUntil == 0 {
+		delete(p.dbHandle.retentionLocks[username], filePath)
+		return nil
+	}
+	if _, ok := p.dbHandle.retentionLocks[username]; !ok {
+		p.dbHandle.retentionLocks[username] = make(map[string]int64)
+	}
+	p.dbHandle.retentionLocks[username][filePath] = retainUntil
+	return nil
+}
+
+func (p MemoryProvider) getRetainUntil(username, filePath string) (int64, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, errMemoryProviderClosed
+	}
+	return p.dbHandle.retentionLocks[username][filePath], nil
+}
+
+func (p MemoryProvider) folderExists(name string) (BaseVirtualFolder, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return BaseVirtualFolder{}, errMemoryProviderClosed
+	}
+	return p.folderExistsInternal(name)
+}
+
+func (p MemoryProvider) folderExistsInternal(name string) (BaseVirtualFolder, error) {
+	if val, ok := p.dbHandle.vfolders[name]; ok {
+		return val.getACopy(), nil
+	}
+	return BaseVirtualFolder{}, &RecordNotFoundError{err: fmt.Sprintf("folder %#v does not exist", name)}
+}
+
+func (p MemoryProvider) getFolderByID(ID int64) (BaseVirtualFolder, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return BaseVirtualFolder{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.vfoldersIdx[ID]; ok {
+		return p.folderExistsInternal(val)
+	}
+	return BaseVirtualFolder{}, &RecordNotFoundError{err: fmt.Sprintf("folder with ID %v does not exist", ID)}
+}
+
+func (p MemoryProvider) addFolder(folder BaseVirtualFolder) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	_, err = p.folderExistsInternal(folder.Name)
+	if err == nil {
+		return fmt.Errorf("folder %#v already exists", folder.Name)
+	}
+	folder.ID = p.getNextFolderID()
+	folder.UsedQuotaSize = 0
+	folder.UsedQuotaFiles = 0
+	folder.LastQuotaUpdate = 0
+	folder.Users = nil
+	p.dbHandle.vfolders[folder.Name] = folder
+	p.dbHandle.vfoldersIdx[folder.ID] = folder.Name
+	p.dbHandle.vfoldersNames = append(p.dbHandle.vfoldersNames, folder.Name)
+	sort.Strings(p.dbHandle.vfoldersNames)
+	return nil
+}
+
+func (p MemoryProvider) updateFolder(folder BaseVirtualFolder) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	f, err := p.folderExistsInternal(folder.Name)
+	if err != nil {
+		return err
+	}
+	folder.ID = f.ID
+	folder.UsedQuotaSize = f.UsedQuotaSize
+	folder.UsedQuotaFiles = f.UsedQuotaFiles
+	folder.LastQuotaUpdate = f.LastQuotaUpdate
+	folder.Users = f.Users
+	for _, username := range folder.Users {
+		user := p.getUserWithFolders(username)
+		for idx, v := range user.VirtualFolders {
+			if v.Name == folder.Name {
+				err = checkVirtualFolderForUser(&user, idx, folder)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	p.dbHandle.vfolders[folder.Name] = folder
+	return nil
+}
+
+func (p MemoryProvider) deleteFolder(folder BaseVirtualFolder) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	f, err := p.folderExistsInternal(folder.Name)
+	if err != nil {
+		return err
+	}
+	for _, username := range f.Users {
+		if user, ok := p.dbHandle.users[username]; ok {
+			var virtualFolders []VirtualFolder
+			for _, v := range user.VirtualFolders {
+				if v.Name != f.Name {
+					virtualFolders = append(virtualFolders, v)
+				}
+			}
+			user.VirtualFolders = virtualFolders
+			p.dbHandle.users[username] = user
+		}
+	}
+	delete(p.dbHandle.vfolders, f.Name)
+	delete(p.dbHandle.vfoldersIdx, f.ID)
+	p.dbHandle.vfoldersNames = []string{}
+	for name := range p.dbHandle.vfolders {
+		p.dbHandle.vfoldersNames = append(p.dbHandle.vfoldersNames, name)
+	}
+	sort.Strings(p.dbHandle.vfoldersNames)
+	return nil
+}
+
+func (p MemoryProvider) getFolders(limit int, offset int, order string, name string) ([]BaseVirtualFolder, error) {
+	folders := []BaseVirtualFolder{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return folders, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return folders, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			folder, err := p.folderExistsInternal(name)
+			if err == nil {
+				folders = append(folders, HideFolderSensitiveData(&folder))
+			}
+		}
+		return folders, err
+	}
+	itNum := 0
+	if order == "ASC" {
+		for _, name := range p.dbHandle.vfoldersNames {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			val := p.dbHandle.vfolders[name]
+			folder := val.getACopy()
+			folders = append(folders, HideFolderSensitiveData(&folder))
+			if len(folders) >= limit {
+				break
+			}
+		}
+	} else {
+		for i := len(p.dbHandle.vfoldersNames) - 1; i >= 0; i-- {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			val := p.dbHandle.vfolders[p.dbHandle.vfoldersNames[i]]
+			folder := val.getACopy()
+			folders = append(folders, HideFolderSensitiveData(&folder))
+			if len(folders) >= limit {
+				break
+			}
+		}
+	}
+	return folders, err
+}
+
+func (p MemoryProvider) dumpFolders() ([]BaseVirtualFolder, error) {
+	folders := []BaseVirtualFolder{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return folders, errMemoryProviderClosed
+	}
+	for _, name := range p.dbHandle.vfoldersNames {
+		val := p.dbHandle.vfolders[name]
+		folder := val.getACopy()
+		err = addCredentialsToFolder(&folder)
+		if err != nil {
+			return folders, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, err
+}
+
+func (p MemoryProvider) getNextFolderID() int64 {
+	nextID := int64(1)
+	for id := range p.dbHandle.vfoldersIdx {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	return nextID
+}
+
 func (p MemoryProvider) getNextID() int64 {
 	nextID := int64(1)
 	for id := range p.dbHandle.usersIdx {
@@ -323,12 +756,17 @@ func (p MemoryProvider) getNextID() int64 {
 	return nextID
 }
 
-func (p MemoryProvider) clearUsers() {
+func (p MemoryProvider) clearUsersAndFolders() {
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
 	p.dbHandle.usernames = []string{}
 	p.dbHandle.usersIdx = make(map[int64]string)
 	p.dbHandle.users = make(map[string]User)
+	p.dbHandle.vfoldersNames = []string{}
+	p.dbHandle.vfoldersIdx = make(map[int64]string)
+	p.dbHandle.vfolders = make(map[string]BaseVirtualFolder)
+	p.dbHandle.dirQuotas = make(map[string]map[string]DirQuotaUsage)
+	p.dbHandle.transferQuotas = make(map[string]TransferQuotaUsage)
 }
 
 func (p MemoryProvider) reloadConfig() error {
@@ -363,7 +801,14 @@ func (p MemoryProvider) reloadConfig() error {
 		providerLog(logger.LevelWarn, "error loading users: %v", err)
 		return err
 	}
-	p.clearUsers()
+	p.clearUsersAndFolders()
+	for _, folder := range dump.Folders {
+		err = p.addFolder(folder)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding folder %#v: %v", folder.Name, err)
+			return err
+		}
+	}
 	for _, user := range dump.Users {
 		u, err := p.userExists(user.Username)
 		if err == nil {
@@ -95,6 +95,66 @@ func (p PGSQLProvider) getUsers(limit int, offset int, order string, username st
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p PGSQLProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateFolderQuota(name, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p PGSQLProvider) getUsedFolderQuota(name string) (int, int64, error) {
+	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateDirQuota(username, dirPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateDirQuota(username, dirPath, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p PGSQLProvider) getUsedDirQuotas(username string) ([]DirQuotaUsage, error) {
+	return sqlCommonGetUsedDirQuotas(username, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateTransferQuota(username string, uploadAdd, downloadAdd, periodStart int64, reset bool) error {
+	return sqlCommonUpdateTransferQuota(username, uploadAdd, downloadAdd, periodStart, reset, p.dbHandle)
+}
+
+func (p PGSQLProvider) getUsedTransferQuota(username string) (int64, int64, int64, error) {
+	return sqlCommonGetUsedTransferQuota(username, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateRetainUntil(username, filePath string, retainUntil int64) error {
+	return sqlCommonUpdateRetainUntil(username, filePath, retainUntil, p.dbHandle)
+}
+
+func (p PGSQLProvider) getRetainUntil(username, filePath string) (int64, error) {
+	return sqlCommonGetRetainUntil(username, filePath, p.dbHandle)
+}
+
+func (p PGSQLProvider) folderExists(name string) (BaseVirtualFolder, error) {
+	return sqlCommonGetFolder(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) getFolderByID(ID int64) (BaseVirtualFolder, error) {
+	return sqlCommonGetFolderByID(ID, p.dbHandle)
+}
+
+func (p PGSQLProvider) addFolder(folder BaseVirtualFolder) error {
+	return sqlCommonAddFolder(folder, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateFolder(folder BaseVirtualFolder) error {
+	return sqlCommonUpdateFolder(folder, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteFolder(folder BaseVirtualFolder) error {
+	return sqlCommonDeleteFolder(folder, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpFolders() ([]BaseVirtualFolder, error) {
+	return sqlCommonDumpFolders(p.dbHandle)
+}
+
+func (p PGSQLProvider) getFolders(limit int, offset int, order string, name string) ([]BaseVirtualFolder, error) {
+	return sqlCommonGetFolders(limit, offset, order, name, p.dbHandle)
+}
+
 func (p PGSQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -5,12 +5,19 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/freshvolk/sftpgo/logger"
 	"github.com/freshvolk/sftpgo/utils"
 )
 
+// sqlQuerier defines the methods shared by a database handle and a transaction
+// that are required to execute our queries
+type sqlQuerier interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
 func getUserByUsername(username string, dbHandle *sql.DB) (User, error) {
 	var user User
 	q := getUserByUsernameQuery()
@@ -22,7 +29,11 @@ func getUserByUsername(username string, dbHandle *sql.DB) (User, error) {
 	defer stmt.Close()
 
 	row := stmt.QueryRow(username)
-	return getUserFromDbRow(row, nil)
+	user, err = getUserFromDbRow(row, nil)
+	if err != nil {
+		return user, err
+	}
+	return getUserWithVirtualFolders(user, dbHandle)
 }
 
 func sqlCommonValidateUserAndPass(username string, password string, dbHandle *sql.DB) (User, error) {
@@ -68,7 +79,11 @@ func sqlCommonGetUserByID(ID int64, dbHandle *sql.DB) (User, error) {
 	defer stmt.Close()
 
 	row := stmt.QueryRow(ID)
-	return getUserFromDbRow(row, nil)
+	user, err = getUserFromDbRow(row, nil)
+	if err != nil {
+		return user, err
+	}
+	return getUserWithVirtualFolders(user, dbHandle)
 }
 
 func sqlCommonUpdateQuota(username string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
@@ -135,7 +150,11 @@ func sqlCommonCheckUserExists(username string, dbHandle *sql.DB) (User, error) {
 	}
 	defer stmt.Close()
 	row := stmt.QueryRow(username)
-	return getUserFromDbRow(row, nil)
+	user, err = getUserFromDbRow(row, nil)
+	if err != nil {
+		return user, err
+	}
+	return getUserWithVirtualFolders(user, dbHandle)
 }
 
 func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
@@ -143,33 +162,56 @@ func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	err = sqlCommonCheckUserVirtualFolders(&user, tx)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
 	q := getAddUserQuery()
-	stmt, err := dbHandle.Prepare(q)
+	stmt, err := tx.Prepare(q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	defer stmt.Close()
 	permissions, err := user.GetPermissionsAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	publicKeys, err := user.GetPublicKeysAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	filters, err := user.GetFiltersAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	fsConfig, err := user.GetFsConfigAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	_, err = stmt.Exec(user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate, string(filters),
 		string(fsConfig))
-	return err
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = generateVirtualFoldersMapping(user, tx)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	return tx.Commit()
 }
 
 func sqlCommonUpdateUser(user User, dbHandle *sql.DB) error {
@@ -177,45 +219,94 @@ func sqlCommonUpdateUser(user User, dbHandle *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	err = sqlCommonCheckUserVirtualFolders(&user, tx)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
 	q := getUpdateUserQuery()
-	stmt, err := dbHandle.Prepare(q)
+	stmt, err := tx.Prepare(q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	defer stmt.Close()
 	permissions, err := user.GetPermissionsAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	publicKeys, err := user.GetPublicKeysAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	filters, err := user.GetFiltersAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	fsConfig, err := user.GetFsConfigAsJSON()
 	if err != nil {
+		tx.Rollback() //nolint:errcheck
 		return err
 	}
 	_, err = stmt.Exec(user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate,
 		string(filters), string(fsConfig), user.ID)
-	return err
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = generateVirtualFoldersMapping(user, tx)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = clearRemovedDirQuotas(user, tx)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	return tx.Commit()
 }
 
 func sqlCommonDeleteUser(user User, dbHandle *sql.DB) error {
-	q := getDeleteUserQuery()
-	stmt, err := dbHandle.Prepare(q)
+	tx, err := dbHandle.Begin()
 	if err != nil {
-		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(user.ID)
-	return err
+	err = sqlCommonExecInTx(getDeleteUserDirQuotasQuery(), tx, user.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteUserTransferQuotaQuery(), tx, user.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteUserRetentionLocksQuery(), tx, user.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteUserFolderMappingQuery(), tx, user.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteUserQuery(), tx, user.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	return tx.Commit()
 }
 
 func sqlCommonDumpUsers(dbHandle *sql.DB) ([]User, error) {
@@ -241,9 +332,13 @@ func sqlCommonDumpUsers(dbHandle *sql.DB) ([]User, error) {
 			}
 			users = append(users, u)
 		}
+		err = rows.Err()
+		rows.Close()
 	}
-
-	return users, err
+	if err != nil {
+		return users, err
+	}
+	return getUsersWithVirtualFolders(users, dbHandle)
 }
 
 func sqlCommonGetUsers(limit int, offset int, order string, username string, dbHandle *sql.DB) ([]User, error) {
@@ -266,13 +361,23 @@ func sqlCommonGetUsers(limit int, offset int, order string, username string, dbH
 		for rows.Next() {
 			u, err := getUserFromDbRow(nil, rows)
 			if err == nil {
-				users = append(users, HideUserSensitiveData(&u))
+				users = append(users, u)
 			} else {
 				break
 			}
 		}
+		rows.Close()
+	}
+	if err != nil {
+		return users, err
+	}
+	users, err = getUsersWithVirtualFolders(users, dbHandle)
+	if err != nil {
+		return users, err
+	}
+	for idx := range users {
+		users[idx] = HideUserSensitiveData(&users[idx])
 	}
-
 	return users, err
 }
 
@@ -350,3 +455,621 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 	}
 	return user, err
 }
+
+func sqlCommonExecInTx(q string, tx *sql.Tx, args ...interface{}) error {
+	stmt, err := tx.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(args...)
+	return err
+}
+
+// sqlCommonCheckUserVirtualFolders checks that the folders mapped inside the
+// user exist and can be mounted
+func sqlCommonCheckUserVirtualFolders(user *User, dbHandle sqlQuerier) error {
+	for idx, v := range user.VirtualFolders {
+		folder, err := sqlCommonCheckFolderExists(v.Name, dbHandle)
+		if err != nil {
+			if _, ok := err.(*RecordNotFoundError); ok {
+				return &ValidationError{err: fmt.Sprintf("unable to mount folder %#v: %v", v.Name, err)}
+			}
+			return err
+		}
+		err = checkVirtualFolderForUser(user, idx, folder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateVirtualFoldersMapping(user User, tx *sql.Tx) error {
+	err := sqlCommonExecInTx(getClearUserFolderMappingQuery(), tx, user.Username)
+	if err != nil {
+		return err
+	}
+	for _, v := range user.VirtualFolders {
+		err = sqlCommonExecInTx(getAddFolderMappingQuery(), tx, v.VirtualPath, v.QuotaSize, v.QuotaFiles, v.Name,
+			user.Username)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getUserWithVirtualFolders(user User, dbHandle *sql.DB) (User, error) {
+	users, err := getUsersWithVirtualFolders([]User{user}, dbHandle)
+	if err != nil {
+		return user, err
+	}
+	if len(users) == 0 {
+		return user, errors.New("unable to associate virtual folders to user")
+	}
+	return users[0], err
+}
+
+func getUsersWithVirtualFolders(users []User, dbHandle *sql.DB) ([]User, error) {
+	if len(users) == 0 {
+		return users, nil
+	}
+	usersVirtualFolders := make(map[int64][]VirtualFolder)
+	q := getRelatedFoldersForUsersQuery(users)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var folder VirtualFolder
+		var userID int64
+		var mappedPath sql.NullString
+		var fsConfig sql.NullString
+		err = rows.Scan(&folder.ID, &folder.Name, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
+			&folder.LastQuotaUpdate, &fsConfig, &folder.VirtualPath, &folder.QuotaSize, &folder.QuotaFiles, &userID)
+		if err != nil {
+			return users, err
+		}
+		if mappedPath.Valid {
+			folder.MappedPath = mappedPath.String
+		}
+		folder.FsConfig = getFolderFsConfigFromDb(fsConfig)
+		usersVirtualFolders[userID] = append(usersVirtualFolders[userID], folder)
+	}
+	err = rows.Err()
+	if err != nil {
+		return users, err
+	}
+	for idx := range users {
+		users[idx].VirtualFolders = usersVirtualFolders[users[idx].ID]
+	}
+	return users, err
+}
+
+func sqlCommonUpdateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
+	q := getUpdateFolderQuotaQuery(reset)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(sizeAdd, filesAdd, utils.GetTimeAsMsSinceEpoch(time.Now()), name)
+	if err == nil {
+		providerLog(logger.LevelDebug, "quota updated for folder %#v, files increment: %v size increment: %v is reset? %v",
+			name, filesAdd, sizeAdd, reset)
+	} else {
+		providerLog(logger.LevelWarn, "error updating quota for folder %#v: %v", name, err)
+	}
+	return err
+}
+
+func sqlCommonGetFolderUsedQuota(name string, dbHandle *sql.DB) (int, int64, error) {
+	q := getQuotaFolderQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	var usedFiles int
+	var usedSize int64
+	err = stmt.QueryRow(name).Scan(&usedSize, &usedFiles)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting quota for folder: %v, error: %v", name, err)
+		if err == sql.ErrNoRows {
+			return 0, 0, &RecordNotFoundError{err: err.Error()}
+		}
+		return 0, 0, err
+	}
+	return usedFiles, usedSize, err
+}
+
+func sqlCommonUpdateDirQuota(username, dirPath string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
+	q := getUpdateDirQuotaQuery(reset)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	res, err := stmt.Exec(sizeAdd, filesAdd, now, username, dirPath)
+	if err == nil {
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err == nil && affected == 0 {
+			// first update for this directory, the used quota starts from zero
+			err = sqlCommonAddDirQuota(username, dirPath, filesAdd, sizeAdd, now, dbHandle)
+		}
+	}
+	if err == nil {
+		providerLog(logger.LevelDebug, "quota updated for user %#v, directory %#v, files increment: %v size increment: %v "+
+			"is reset? %v", username, dirPath, filesAdd, sizeAdd, reset)
+	} else {
+		providerLog(logger.LevelWarn, "error updating quota for user %#v, directory %#v: %v", username, dirPath, err)
+	}
+	return err
+}
+
+func sqlCommonAddDirQuota(username, dirPath string, files int, size int64, lastUpdate int64, dbHandle *sql.DB) error {
+	q := getAddDirQuotaQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(size, files, lastUpdate, username, dirPath)
+	return err
+}
+
+func sqlCommonGetUsedDirQuotas(username string, dbHandle *sql.DB) ([]DirQuotaUsage, error) {
+	usage := []DirQuotaUsage{}
+	q := getDirQuotasQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting directory quotas for user %#v: %v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u DirQuotaUsage
+		err = rows.Scan(&u.Path, &u.UsedQuotaSize, &u.UsedQuotaFiles, &u.LastQuotaUpdate)
+		if err != nil {
+			return usage, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+func sqlCommonUpdateTransferQuota(username string, uploadAdd, downloadAdd, periodStart int64, reset bool, dbHandle *sql.DB) error {
+	q := getUpdateTransferQuotaQuery(reset)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	var res sql.Result
+	if reset {
+		res, err = stmt.Exec(uploadAdd, downloadAdd, periodStart, now, username)
+	} else {
+		res, err = stmt.Exec(periodStart, uploadAdd, periodStart, uploadAdd, periodStart, downloadAdd, periodStart,
+			downloadAdd, now, periodStart, periodStart, username)
+	}
+	if err == nil {
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err == nil && affected == 0 {
+			// first update for this user, the used transfer quota starts from zero
+			err = sqlCommonAddTransferQuota(username, uploadAdd, downloadAdd, periodStart, now, dbHandle)
+		}
+	}
+	if err == nil {
+		providerLog(logger.LevelDebug, "transfer quota updated for user %#v, upload increment: %v download increment: %v "+
+			"is reset? %v", username, uploadAdd, downloadAdd, reset)
+	} else {
+		providerLog(logger.LevelWarn, "error updating transfer quota for user %#v: %v", username, err)
+	}
+	return err
+}
+
+func sqlCommonAddTransferQuota(username string, uploadSize, downloadSize, periodStart, lastUpdate int64, dbHandle *sql.DB) error {
+	q := getAddTransferQuotaQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(uploadSize, downloadSize, periodStart, lastUpdate, username)
+	return err
+}
+
+func sqlCommonGetUsedTransferQuota(username string, dbHandle *sql.DB) (int64, int64, int64, error) {
+	q := getTransferQuotaQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, 0, 0, err
+	}
+	defer stmt.Close()
+	var uploadSize, downloadSize, periodStart int64
+	err = stmt.QueryRow(username).Scan(&uploadSize, &downloadSize, &periodStart)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting transfer quota for user %#v: %v", username, err)
+		return 0, 0, 0, err
+	}
+	return uploadSize, downloadSize, periodStart, nil
+}
+
+// sqlCommonUpdateRetainUntil replaces the time until the given file is locked, the row is
+// replaced instead of updated since MySQL reports no affected rows if the value is unchanged
+func sqlCommonUpdateRetainUntil(username, filePath string, retainUntil int64, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteRetainUntilQuery(), tx, username, filePath)
+	if err == nil && retainUntil > 0 {
+		err = sqlCommonExecInTx(getAddRetainUntilQuery(), tx, retainUntil, username, filePath)
+	}
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		providerLog(logger.LevelWarn, "error updating retain until for user %#v, path %#v: %v", username, filePath, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlCommonGetRetainUntil(username, filePath string, dbHandle *sql.DB) (int64, error) {
+	q := getRetainUntilQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, err
+	}
+	defer stmt.Close()
+	var retainUntil int64
+	err = stmt.QueryRow(username, filePath).Scan(&retainUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting retain until for user %#v, path %#v: %v", username, filePath, err)
+		return 0, err
+	}
+	return retainUntil, nil
+}
+
+// clearRemovedDirQuotas removes the used quota for the directories that have
+// no quota restrictions anymore
+func clearRemovedDirQuotas(user User, tx *sql.Tx) error {
+	q := getDirQuotaPathsQuery()
+	stmt, err := tx.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(user.ID)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for rows.Next() {
+		var dirPath string
+		if err = rows.Scan(&dirPath); err != nil {
+			rows.Close()
+			return err
+		}
+		if !user.hasDirQuota(dirPath) {
+			removed = append(removed, dirPath)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, dirPath := range removed {
+		err = sqlCommonExecInTx(getDeleteDirQuotaQuery(), tx, user.ID, dirPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlCommonCheckFolderExists(name string, dbHandle sqlQuerier) (BaseVirtualFolder, error) {
+	var folder BaseVirtualFolder
+	q := getFolderByNameQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return folder, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(name)
+	return getFolderFromDbRow(row, nil)
+}
+
+func sqlCommonGetFolder(name string, dbHandle *sql.DB) (BaseVirtualFolder, error) {
+	folder, err := sqlCommonCheckFolderExists(name, dbHandle)
+	if err != nil {
+		return folder, err
+	}
+	return getVirtualFolderWithUsers(folder, dbHandle)
+}
+
+func sqlCommonGetFolderByID(ID int64, dbHandle *sql.DB) (BaseVirtualFolder, error) {
+	var folder BaseVirtualFolder
+	q := getFolderByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return folder, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(ID)
+	folder, err = getFolderFromDbRow(row, nil)
+	if err != nil {
+		return folder, err
+	}
+	return getVirtualFolderWithUsers(folder, dbHandle)
+}
+
+func sqlCommonAddFolder(folder BaseVirtualFolder, dbHandle *sql.DB) error {
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	fsConfig, err := folder.GetFsConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	q := getAddFolderQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(folder.Name, folder.MappedPath, string(fsConfig))
+	return err
+}
+
+func sqlCommonUpdateFolder(folder BaseVirtualFolder, dbHandle *sql.DB) error {
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	oldFolder, err := sqlCommonGetFolder(folder.Name, dbHandle)
+	if err != nil {
+		return err
+	}
+	for _, username := range oldFolder.Users {
+		user, err := getUserByUsername(username, dbHandle)
+		if err != nil {
+			return err
+		}
+		for idx, v := range user.VirtualFolders {
+			if v.Name == folder.Name {
+				err = checkVirtualFolderForUser(&user, idx, folder)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	fsConfig, err := folder.GetFsConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	q := getUpdateFolderQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(folder.MappedPath, string(fsConfig), oldFolder.ID)
+	return err
+}
+
+func sqlCommonDeleteFolder(folder BaseVirtualFolder, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteFolderMappingQuery(), tx, folder.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	err = sqlCommonExecInTx(getDeleteFolderQuery(), tx, folder.ID)
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlCommonDumpFolders(dbHandle *sql.DB) ([]BaseVirtualFolder, error) {
+	folders := []BaseVirtualFolder{}
+	q := getDumpFoldersQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		for rows.Next() {
+			f, err := getFolderFromDbRow(nil, rows)
+			if err != nil {
+				rows.Close()
+				return folders, err
+			}
+			err = addCredentialsToFolder(&f)
+			if err != nil {
+				rows.Close()
+				return folders, err
+			}
+			folders = append(folders, f)
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	if err != nil {
+		return folders, err
+	}
+	return getVirtualFoldersWithUsers(folders, dbHandle)
+}
+
+func sqlCommonGetFolders(limit int, offset int, order string, name string, dbHandle *sql.DB) ([]BaseVirtualFolder, error) {
+	folders := []BaseVirtualFolder{}
+	q := getFoldersQuery(order, name)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(name) > 0 {
+		rows, err = stmt.Query(name, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		for rows.Next() {
+			f, err := getFolderFromDbRow(nil, rows)
+			if err == nil {
+				folders = append(folders, f)
+			} else {
+				break
+			}
+		}
+		rows.Close()
+	}
+	if err != nil {
+		return folders, err
+	}
+	folders, err = getVirtualFoldersWithUsers(folders, dbHandle)
+	if err != nil {
+		return folders, err
+	}
+	for idx := range folders {
+		folders[idx] = HideFolderSensitiveData(&folders[idx])
+	}
+	return folders, err
+}
+
+func getVirtualFolderWithUsers(folder BaseVirtualFolder, dbHandle *sql.DB) (BaseVirtualFolder, error) {
+	folders, err := getVirtualFoldersWithUsers([]BaseVirtualFolder{folder}, dbHandle)
+	if err != nil {
+		return folder, err
+	}
+	if len(folders) == 0 {
+		return folder, errors.New("unable to associate users to folder")
+	}
+	return folders[0], err
+}
+
+func getVirtualFoldersWithUsers(folders []BaseVirtualFolder, dbHandle *sql.DB) ([]BaseVirtualFolder, error) {
+	if len(folders) == 0 {
+		return folders, nil
+	}
+	foldersUsers := make(map[int64][]string)
+	q := getRelatedUsersForFoldersQuery(folders)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var folderID int64
+		var username string
+		err = rows.Scan(&folderID, &username)
+		if err != nil {
+			return folders, err
+		}
+		foldersUsers[folderID] = append(foldersUsers[folderID], username)
+	}
+	err = rows.Err()
+	if err != nil {
+		return folders, err
+	}
+	for idx := range folders {
+		folders[idx].Users = foldersUsers[folders[idx].ID]
+	}
+	return folders, err
+}
+
+func getFolderFromDbRow(row *sql.Row, rows *sql.Rows) (BaseVirtualFolder, error) {
+	var folder BaseVirtualFolder
+	var mappedPath sql.NullString
+	var fsConfig sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&folder.ID, &folder.Name, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
+			&folder.LastQuotaUpdate, &fsConfig)
+	} else {
+		err = rows.Scan(&folder.ID, &folder.Name, &mappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
+			&folder.LastQuotaUpdate, &fsConfig)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return folder, &RecordNotFoundError{err: err.Error()}
+		}
+		return folder, err
+	}
+	if mappedPath.Valid {
+		folder.MappedPath = mappedPath.String
+	}
+	folder.FsConfig = getFolderFsConfigFromDb(fsConfig)
+	return folder, err
+}
+
+func getFolderFsConfigFromDb(fsConfig sql.NullString) Filesystem {
+	if fsConfig.Valid {
+		var fs Filesystem
+		err := json.Unmarshal([]byte(fsConfig.String), &fs)
+		if err == nil {
+			return fs
+		}
+	}
+	return Filesystem{
+		Provider: 0,
+	}
+}
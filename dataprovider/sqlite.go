@@ -102,6 +102,66 @@ func (p SQLiteProvider) getUsers(limit int, offset int, order string, username s
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p SQLiteProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateFolderQuota(name, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p SQLiteProvider) getUsedFolderQuota(name string) (int, int64, error) {
+	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateDirQuota(username, dirPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateDirQuota(username, dirPath, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p SQLiteProvider) getUsedDirQuotas(username string) ([]DirQuotaUsage, error) {
+	return sqlCommonGetUsedDirQuotas(username, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateTransferQuota(username string, uploadAdd, downloadAdd, periodStart int64, reset bool) error {
+	return sqlCommonUpdateTransferQuota(username, uploadAdd, downloadAdd, periodStart, reset, p.dbHandle)
+}
+
+func (p SQLiteProvider) getUsedTransferQuota(username string) (int64, int64, int64, error) {
+	return sqlCommonGetUsedTransferQuota(username, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateRetainUntil(username, filePath string, retainUntil int64) error {
+	return sqlCommonUpdateRetainUntil(username, filePath, retainUntil, p.dbHandle)
+}
+
+func (p SQLiteProvider) getRetainUntil(username, filePath string) (int64, error) {
+	return sqlCommonGetRetainUntil(username, filePath, p.dbHandle)
+}
+
+func (p SQLiteProvider) folderExists(name string) (BaseVirtualFolder, error) {
+	return sqlCommonGetFolder(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) getFolderByID(ID int64) (BaseVirtualFolder, error) {
+	return sqlCommonGetFolderByID(ID, p.dbHandle)
+}
+
+func (p SQLiteProvider) addFolder(folder BaseVirtualFolder) error {
+	return sqlCommonAddFolder(folder, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateFolder(folder BaseVirtualFolder) error {
+	return sqlCommonUpdateFolder(folder, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteFolder(folder BaseVirtualFolder) error {
+	return sqlCommonDeleteFolder(folder, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpFolders() ([]BaseVirtualFolder, error) {
+	return sqlCommonDumpFolders(p.dbHandle)
+}
+
+func (p SQLiteProvider) getFolders(limit int, offset int, order string, name string) ([]BaseVirtualFolder, error) {
+	return sqlCommonGetFolders(limit, offset, order, name, p.dbHandle)
+}
+
 func (p SQLiteProvider) close() error {
 	return p.dbHandle.Close()
 }
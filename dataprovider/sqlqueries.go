@@ -1,10 +1,20 @@
 package dataprovider
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 const (
 	selectUserFields = "id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,used_quota_size," +
 		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem"
+	selectFolderFields      = "id,name,mapped_path,used_quota_size,used_quota_files,last_quota_update,filesystem"
+	foldersTableName        = "folders"
+	foldersMappingTableName = "folders_mapping"
+	dirQuotasTableName      = "directory_quotas"
+	transferQuotasTableName = "transfer_quotas"
+	retentionLocksTableName = "retention_locks"
 )
 
 func getSQLPlaceholders() []string {
@@ -79,3 +89,183 @@ func getUpdateUserQuery() string {
 func getDeleteUserQuery() string {
 	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, config.UsersTable, sqlPlaceholders[0])
 }
+
+func getFolderByNameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectFolderFields, foldersTableName, sqlPlaceholders[0])
+}
+
+func getFolderByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectFolderFields, foldersTableName, sqlPlaceholders[0])
+}
+
+func getFoldersQuery(order string, name string) string {
+	if len(name) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v ORDER BY name %v LIMIT %v OFFSET %v`,
+			selectFolderFields, foldersTableName, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY name %v LIMIT %v OFFSET %v`, selectFolderFields, foldersTableName,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpFoldersQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectFolderFields, foldersTableName)
+}
+
+func getAddFolderQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (name,mapped_path,used_quota_size,used_quota_files,last_quota_update,filesystem)
+		VALUES (%v,%v,0,0,0,%v)`, foldersTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getUpdateFolderQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET mapped_path=%v,filesystem=%v WHERE id = %v`, foldersTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteFolderQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, foldersTableName, sqlPlaceholders[0])
+}
+
+func getUpdateFolderQuotaQuery(reset bool) string {
+	if reset {
+		return fmt.Sprintf(`UPDATE %v SET used_quota_size = %v,used_quota_files = %v,last_quota_update = %v
+			WHERE name = %v`, foldersTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+	}
+	return fmt.Sprintf(`UPDATE %v SET used_quota_size = used_quota_size + %v,used_quota_files = used_quota_files + %v,last_quota_update = %v
+		WHERE name = %v`, foldersTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+}
+
+func getQuotaFolderQuery() string {
+	return fmt.Sprintf(`SELECT used_quota_size,used_quota_files FROM %v WHERE name = %v`, foldersTableName,
+		sqlPlaceholders[0])
+}
+
+func getAddFolderMappingQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (virtual_path,quota_size,quota_files,folder_id,user_id)
+		VALUES (%v,%v,%v,(SELECT id FROM %v WHERE name = %v),(SELECT id FROM %v WHERE username = %v))`,
+		foldersMappingTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], foldersTableName,
+		sqlPlaceholders[3], config.UsersTable, sqlPlaceholders[4])
+}
+
+func getClearUserFolderMappingQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = (SELECT id FROM %v WHERE username = %v)`, foldersMappingTableName,
+		config.UsersTable, sqlPlaceholders[0])
+}
+
+func getDeleteUserFolderMappingQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = %v`, foldersMappingTableName, sqlPlaceholders[0])
+}
+
+func getDeleteFolderMappingQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE folder_id = %v`, foldersMappingTableName, sqlPlaceholders[0])
+}
+
+func getRelatedFoldersForUsersQuery(users []User) string {
+	var ids []string
+	for _, u := range users {
+		ids = append(ids, strconv.FormatInt(u.ID, 10))
+	}
+	return fmt.Sprintf(`SELECT f.id,f.name,f.mapped_path,f.used_quota_size,f.used_quota_files,f.last_quota_update,f.filesystem,
+		fm.virtual_path,fm.quota_size,fm.quota_files,fm.user_id FROM %v f INNER JOIN %v fm ON f.id = fm.folder_id
+		WHERE fm.user_id IN (%v) ORDER BY fm.virtual_path`, foldersTableName, foldersMappingTableName, strings.Join(ids, ","))
+}
+
+func getRelatedUsersForFoldersQuery(folders []BaseVirtualFolder) string {
+	var ids []string
+	for _, f := range folders {
+		ids = append(ids, strconv.FormatInt(f.ID, 10))
+	}
+	return fmt.Sprintf(`SELECT fm.folder_id,u.username FROM %v fm INNER JOIN %v u ON fm.user_id = u.id
+		WHERE fm.folder_id IN (%v) ORDER BY u.username`, foldersMappingTableName, config.UsersTable, strings.Join(ids, ","))
+}
+
+func getUpdateDirQuotaQuery(reset bool) string {
+	if reset {
+		return fmt.Sprintf(`UPDATE %v SET used_quota_size = %v,used_quota_files = %v,last_quota_update = %v
+			WHERE user_id = (SELECT id FROM %v WHERE username = %v) AND path = %v`, dirQuotasTableName, sqlPlaceholders[0],
+			sqlPlaceholders[1], sqlPlaceholders[2], config.UsersTable, sqlPlaceholders[3], sqlPlaceholders[4])
+	}
+	return fmt.Sprintf(`UPDATE %v SET used_quota_size = used_quota_size + %v,used_quota_files = used_quota_files + %v,last_quota_update = %v
+		WHERE user_id = (SELECT id FROM %v WHERE username = %v) AND path = %v`, dirQuotasTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], config.UsersTable, sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
+func getAddDirQuotaQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (used_quota_size,used_quota_files,last_quota_update,user_id,path)
+		VALUES (%v,%v,%v,(SELECT id FROM %v WHERE username = %v),%v)`, dirQuotasTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], config.UsersTable, sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
+func getDirQuotasQuery() string {
+	return fmt.Sprintf(`SELECT dq.path,dq.used_quota_size,dq.used_quota_files,dq.last_quota_update FROM %v dq
+		INNER JOIN %v u ON dq.user_id = u.id WHERE u.username = %v ORDER BY dq.path`, dirQuotasTableName, config.UsersTable,
+		sqlPlaceholders[0])
+}
+
+func getDirQuotaPathsQuery() string {
+	return fmt.Sprintf(`SELECT path FROM %v WHERE user_id = %v`, dirQuotasTableName, sqlPlaceholders[0])
+}
+
+func getDeleteDirQuotaQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = %v AND path = %v`, dirQuotasTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getDeleteUserDirQuotasQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = %v`, dirQuotasTableName, sqlPlaceholders[0])
+}
+
+func getUpdateTransferQuotaQuery(reset bool) string {
+	if reset {
+		return fmt.Sprintf(`UPDATE %v SET used_upload_size = %v,used_download_size = %v,period_start = %v,last_update = %v
+			WHERE user_id = (SELECT id FROM %v WHERE username = %v)`, transferQuotasTableName, sqlPlaceholders[0],
+			sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], config.UsersTable, sqlPlaceholders[4])
+	}
+	// the used transfer quota restarts from zero if the stored one belongs to a previous period and
+	// it is not updated if it belongs to a next one.
+	// period_start must be the last column updated: MySQL uses the updated values for the next assignments
+	return fmt.Sprintf(`UPDATE %v SET used_upload_size = CASE WHEN period_start < %v THEN %v
+		WHEN period_start > %v THEN used_upload_size ELSE used_upload_size + %v END,
+		used_download_size = CASE WHEN period_start < %v THEN %v
+		WHEN period_start > %v THEN used_download_size ELSE used_download_size + %v END,last_update = %v,
+		period_start = CASE WHEN period_start < %v THEN %v ELSE period_start END
+		WHERE user_id = (SELECT id FROM %v WHERE username = %v)`, transferQuotasTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5],
+		sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10],
+		config.UsersTable, sqlPlaceholders[11])
+}
+
+func getAddTransferQuotaQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (used_upload_size,used_download_size,period_start,last_update,user_id)
+		VALUES (%v,%v,%v,%v,(SELECT id FROM %v WHERE username = %v))`, transferQuotasTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], config.UsersTable, sqlPlaceholders[4])
+}
+
+func getTransferQuotaQuery() string {
+	return fmt.Sprintf(`SELECT tq.used_upload_size,tq.used_download_size,tq.period_start FROM %v tq
+		INNER JOIN %v u ON tq.user_id = u.id WHERE u.username = %v`, transferQuotasTableName, config.UsersTable,
+		sqlPlaceholders[0])
+}
+
+func getDeleteUserTransferQuotaQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = %v`, transferQuotasTableName, sqlPlaceholders[0])
+}
+
+func getDeleteRetainUntilQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = (SELECT id FROM %v WHERE username = %v) AND path = %v`,
+		retentionLocksTableName, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddRetainUntilQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (retain_until,user_id,path) VALUES (%v,(SELECT id FROM %v WHERE username = %v),%v)`,
+		retentionLocksTableName, sqlPlaceholders[0], config.UsersTable, sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getRetainUntilQuery() string {
+	return fmt.Sprintf(`SELECT rl.retain_until FROM %v rl INNER JOIN %v u ON rl.user_id = u.id
+		WHERE u.username = %v AND rl.path = %v`, retentionLocksTableName, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getDeleteUserRetentionLocksQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = %v`, retentionLocksTableName, sqlPlaceholders[0])
+}
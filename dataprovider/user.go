@@ -2,13 +2,18 @@ package dataprovider
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/secrets"
 	"github.com/freshvolk/sftpgo/utils"
 	"github.com/freshvolk/sftpgo/vfs"
 )
@@ -42,6 +47,18 @@ const (
 	PermChtimes = "chtimes"
 )
 
+// Available periods for transfer quotas
+const (
+	// the used transfer quota is reset every day at midnight UTC
+	TransferQuotaPeriodDaily = "daily"
+	// the used transfer quota is reset on the first day of every month at midnight UTC
+	TransferQuotaPeriodMonthly = "monthly"
+)
+
+var (
+	errNoMatchingVirtualFolder = errors.New("no matching virtual folder found")
+)
+
 // UserFilters defines additional restrictions for a user
 type UserFilters struct {
 	// only clients connecting from these IP/Mask are allowed.
@@ -51,14 +68,187 @@ type UserFilters struct {
 	// clients connecting from these IP/Mask are not allowed.
 	// Denied rules will be evaluated before allowed ones
 	DeniedIP []string `json:"denied_ip"`
+	// if enabled the deleted files and directories are moved inside a
+	// hidden trash directory instead of being removed permanently
+	Trash TrashConfig `json:"trash"`
+	// write-once retention policies: the files uploaded inside these directories cannot
+	// be overwritten, renamed, removed or modified until the retention period expires,
+	// regardless of the user's permissions
+	RetentionPolicies []vfs.RetentionPolicy `json:"retention_policies"`
+	// if enabled the user's files are mirrored to a secondary storage
+	Replication ReplicationConfig `json:"replication"`
+	// if enabled the cold files are moved from the local disk to a secondary storage
+	Tiering TieringConfig `json:"tiering"`
+	// quota restrictions for directories inside the user's home. They apply in addition
+	// to the user's quota, the files inside virtual folders are not included
+	DirQuotas []DirQuota `json:"directory_quotas"`
+	// limits for the data uploaded and downloaded in a period
+	TransferQuota TransferQuota `json:"transfer_quota"`
+	// file name filters based on shell patterns for directories inside the user's home
+	FilePatterns []PatternsFilter `json:"file_patterns"`
+	// maximum size allowed, as bytes, for a single uploaded file.
+	// 0 means the global limit, if any, applies
+	MaxUploadFileSize int64 `json:"max_upload_file_size"`
+}
+
+// PatternsFilter defines the allowed and denied file name patterns for a directory.
+// The patterns are shell patterns, as defined by path.Match, and they are matched
+// against the lowercase name of the files and directories. The filter applies to
+// the directory and its sub directories, the most specific filter wins
+type PatternsFilter struct {
+	// SFTP path, for example "/inbound"
+	Path string `json:"path"`
+	// if not empty only the names matching at least one of these patterns are allowed
+	AllowedPatterns []string `json:"allowed_patterns,omitempty"`
+	// the names matching one of these patterns are not allowed.
+	// Denied patterns are evaluated before the allowed ones
+	DeniedPatterns []string `json:"denied_patterns,omitempty"`
+}
+
+// GetAllowedPatternsAsString returns the allowed patterns as comma separated string
+func (f PatternsFilter) GetAllowedPatternsAsString() string {
+	return strings.Join(f.AllowedPatterns, ",")
+}
+
+// GetDeniedPatternsAsString returns the denied patterns as comma separated string
+func (f PatternsFilter) GetDeniedPatternsAsString() string {
+	return strings.Join(f.DeniedPatterns, ",")
+}
+
+// TransferQuota defines the maximum data a user can upload and download in a period.
+// The used transfer quota is reset automatically when a new period starts
+type TransferQuota struct {
+	// "daily" or "monthly", empty means no transfer quota
+	Period string `json:"period"`
+	// Maximum bytes that can be uploaded in a period. 0 means unlimited
+	UploadSize int64 `json:"upload_size"`
+	// Maximum bytes that can be downloaded in a period. 0 means unlimited
+	DownloadSize int64 `json:"download_size"`
+}
+
+// TransferQuotaUsage defines the transfer quota limits for a user and the data
+// transferred in the current period
+type TransferQuotaUsage struct {
+	TransferQuota
+	// Bytes uploaded in the current period
+	UsedUploadSize int64 `json:"used_upload_size"`
+	// Bytes downloaded in the current period
+	UsedDownloadSize int64 `json:"used_download_size"`
+	// Current period start as unix timestamp in milliseconds
+	PeriodStart int64 `json:"period_start"`
+}
+
+// DirQuota defines the quota restrictions for a directory inside the user's home.
+// The restrictions apply to the files inside the directory and its sub directories
+type DirQuota struct {
+	// SFTP path, for example "/uploads"
+	Path string `json:"path"`
+	// Maximum size allowed as bytes. 0 means unlimited
+	QuotaSize int64 `json:"quota_size"`
+	// Maximum number of files allowed. 0 means unlimited
+	QuotaFiles int `json:"quota_files"`
+}
+
+// DirQuotaUsage defines the quota restrictions for a directory and its used quota
+type DirQuotaUsage struct {
+	DirQuota
+	// Used quota as bytes
+	UsedQuotaSize int64 `json:"used_quota_size"`
+	// Used quota as number of files
+	UsedQuotaFiles int `json:"used_quota_files"`
+	// Last quota update as unix timestamp in milliseconds
+	LastQuotaUpdate int64 `json:"last_quota_update"`
+}
+
+// TrashConfig defines the trash settings for a user.
+// The trash is stored inside the user's home directory, so on the same
+// storage backend, and it is not available to the SFTP/SCP clients.
+// Deletes inside virtual folders are always permanent
+type TrashConfig struct {
+	Enabled bool `json:"enabled"`
+	// the items deleted since more than the specified days are purged
+	// automatically. 0 means no automatic purge
+	RetentionDays int `json:"retention_days"`
+	// if true the trashed items are included in the user's used quota
+	// and they are removed from it only when they are purged
+	CountInQuota bool `json:"count_in_quota"`
+}
+
+// ReplicationConfig defines the settings to mirror the user's files to a secondary storage.
+// The uploaded files are copied asynchronously once the upload completes, directory creations,
+// renames and removes are mirrored too. Virtual folders are not replicated
+type ReplicationConfig struct {
+	Enabled bool `json:"enabled"`
+	// secondary storage, any provider except the in memory filesystem is supported
+	FsConfig Filesystem `json:"filesystem"`
+	// root directory for local and deduplicating replicas. It must be an absolute
+	// path outside the user's home directory
+	LocalPath string `json:"local_path,omitempty"`
+}
+
+// GetStorageDescription returns the local path for local replicas or the storage
+// provider for remote ones
+func (r ReplicationConfig) GetStorageDescription() string {
+	return getStorageDescription(&r.FsConfig, r.LocalPath)
+}
+
+// TieringConfig defines the settings to move the files not accessed for a while from the
+// local disk to a secondary storage, the cold tier. Each tiered file is replaced by a stub
+// that keeps its size and modification time, the contents are read from the cold tier
+// or recalled to the local disk when the file is accessed again.
+// Tiering is supported for users with unencrypted local filesystem only,
+// virtual folders are not tiered
+type TieringConfig struct {
+	Enabled bool `json:"enabled"`
+	// files not accessed or modified for the specified days are moved to the cold tier
+	Days int `json:"days"`
+	// cold tier, any provider except the in memory filesystem is supported,
+	// object storages such as S3 and GCS are the expected choice
+	FsConfig Filesystem `json:"filesystem"`
+	// root directory for local and deduplicating cold tiers. It must be an absolute
+	// path outside the user's home directory
+	LocalPath string `json:"local_path,omitempty"`
+	// if true the tiered files are recalled to the local disk when opened for reading,
+	// otherwise their contents are streamed from the cold tier
+	RecallOnAccess bool `json:"recall_on_access"`
+}
+
+// GetStorageDescription returns the local path for local cold tiers or the storage
+// provider for remote ones
+func (t TieringConfig) GetStorageDescription() string {
+	return fmt.Sprintf("%v days, %v", t.Days, getStorageDescription(&t.FsConfig, t.LocalPath))
+}
+
+func getStorageDescription(fsConfig *Filesystem, localPath string) string {
+	switch fsConfig.Provider {
+	case 1:
+		return "S3"
+	case 2:
+		return "GCS"
+	case 3:
+		return "Azure"
+	case 4:
+		return "SFTP"
+	case 6:
+		return "Dedup: " + localPath
+	}
+	return localPath
 }
 
 // Filesystem defines cloud storage filesystem details
 type Filesystem struct {
-	// 0 local filesystem, 1 Amazon S3 compatible, 2 Google Cloud Storage
-	Provider  int             `json:"provider"`
-	S3Config  vfs.S3FsConfig  `json:"s3config,omitempty"`
-	GCSConfig vfs.GCSFsConfig `json:"gcsconfig,omitempty"`
+	// 0 local filesystem, 1 Amazon S3 compatible, 2 Google Cloud Storage, 3 Azure Blob Storage,
+	// 4 remote SFTP server, 5 in memory filesystem, 6 local deduplicating filesystem
+	Provider     int                `json:"provider"`
+	S3Config     vfs.S3FsConfig     `json:"s3config,omitempty"`
+	GCSConfig    vfs.GCSFsConfig    `json:"gcsconfig,omitempty"`
+	AzBlobConfig vfs.AzBlobFsConfig `json:"azblobconfig,omitempty"`
+	SFTPConfig   vfs.SFTPFsConfig   `json:"sftpconfig,omitempty"`
+	MemConfig    vfs.MemFsConfig    `json:"memconfig,omitempty"`
+	DedupConfig  vfs.DedupFsConfig  `json:"dedupconfig,omitempty"`
+	// if a passphrase is defined the file contents are encrypted before
+	// storing them using the configured provider
+	CryptConfig vfs.CryptFsConfig `json:"cryptconfig,omitempty"`
 }
 
 // User defines an SFTP user
@@ -108,18 +298,343 @@ type User struct {
 	Filters UserFilters `json:"filters"`
 	// Filesystem configuration details
 	FsConfig Filesystem `json:"filesystem"`
+	// Virtual folders mounted inside the user's namespace
+	VirtualFolders []VirtualFolder `json:"virtual_folders,omitempty"`
 }
 
 // GetFilesystem returns the filesystem for this user
 func (u *User) GetFilesystem(connectionID string) (vfs.Fs, error) {
-	if u.FsConfig.Provider == 1 {
-		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), u.FsConfig.S3Config)
-	} else if u.FsConfig.Provider == 2 {
-		config := u.FsConfig.GCSConfig
-		config.CredentialFile = u.getGCSCredentialsFilePath()
-		return vfs.NewGCSFs(connectionID, u.GetHomeDir(), config)
+	if u.Filters.Tiering.Enabled {
+		return u.getTieredFilesystem(connectionID)
+	}
+	fsConfig := u.FsConfig
+	// S3 maps the retention policies to Object Lock retention for the uploaded objects
+	fsConfig.S3Config.RetentionPolicies = u.Filters.RetentionPolicies
+	return fsConfig.getFilesystem(connectionID, u.GetHomeDir(), u.getGCSCredentialsFilePath(), u.getMemStorageID())
+}
+
+// GetReplicaFilesystem returns the filesystem for the user's replica
+func (u *User) GetReplicaFilesystem(connectionID string) (vfs.Fs, error) {
+	if !u.Filters.Replication.Enabled {
+		return nil, errors.New("replication is not enabled")
+	}
+	rootDir := u.GetHomeDir()
+	if u.Filters.Replication.FsConfig.isLocal() {
+		rootDir = u.Filters.Replication.LocalPath
+	}
+	return u.Filters.Replication.FsConfig.getFilesystem(connectionID, rootDir, u.getReplicaGCSCredentialsFilePath(), "")
+}
+
+func (u *User) getTieredFilesystem(connectionID string) (vfs.Fs, error) {
+	rootDir := u.GetHomeDir()
+	if u.Filters.Tiering.FsConfig.isLocal() {
+		rootDir = u.Filters.Tiering.LocalPath
+	}
+	tier, err := u.Filters.Tiering.FsConfig.getFilesystem(connectionID, rootDir, u.getTieringGCSCredentialsFilePath(), "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the cold tier: %v", err)
+	}
+	return vfs.NewTieredFs(connectionID, u.GetHomeDir(), u.Username, tier, u.Filters.Tiering.RecallOnAccess)
+}
+
+// getFilesystem returns the filesystem for this configuration. rootDir is the root
+// directory for the local filesystem, remote filesystems use it for temporary files.
+// memStorageID identifies the storage for the in memory filesystem.
+// The stored secrets are decrypted here, they are never decrypted elsewhere
+func (f *Filesystem) getFilesystem(connectionID, rootDir, gcsCredentialsFilePath, memStorageID string) (vfs.Fs, error) {
+	fs, err := f.getStorageFilesystem(connectionID, rootDir, gcsCredentialsFilePath, memStorageID)
+	if err != nil || len(f.CryptConfig.Passphrase) == 0 {
+		return fs, err
+	}
+	config := f.CryptConfig
+	config.Passphrase, err = secrets.Decrypt(config.Passphrase)
+	if err != nil {
+		fs.Close()
+		return nil, fmt.Errorf("unable to decrypt passphrase: %v", err)
+	}
+	return vfs.NewCryptFs(fs, rootDir, config)
+}
+
+func (f *Filesystem) getStorageFilesystem(connectionID, rootDir, gcsCredentialsFilePath, memStorageID string) (vfs.Fs, error) {
+	var err error
+	if f.Provider == 1 {
+		config := f.S3Config
+		if config.AccessSecret, err = decryptSecret(config.AccessSecret); err != nil {
+			return nil, fmt.Errorf("unable to decrypt s3 access secret: %v", err)
+		}
+		if config.SSECustomerKey, err = decryptSecret(config.SSECustomerKey); err != nil {
+			return nil, fmt.Errorf("unable to decrypt s3 SSE customer key: %v", err)
+		}
+		return vfs.NewS3Fs(connectionID, rootDir, config)
+	} else if f.Provider == 2 {
+		config := f.GCSConfig
+		config.CredentialFile = gcsCredentialsFilePath
+		if !config.AutomaticCredentials {
+			if config.Credentials, err = readGCSCredentials(gcsCredentialsFilePath); err != nil {
+				return nil, fmt.Errorf("unable to read GCS credentials: %v", err)
+			}
+		}
+		return vfs.NewGCSFs(connectionID, rootDir, config)
+	} else if f.Provider == 3 {
+		config := f.AzBlobConfig
+		if config.AccountKey, err = decryptSecret(config.AccountKey); err != nil {
+			return nil, fmt.Errorf("unable to decrypt Azure blob account key: %v", err)
+		}
+		if config.SASURL, err = decryptSecret(config.SASURL); err != nil {
+			return nil, fmt.Errorf("unable to decrypt Azure blob SAS URL: %v", err)
+		}
+		return vfs.NewAzBlobFs(connectionID, rootDir, config)
+	} else if f.Provider == 4 {
+		config := f.SFTPConfig
+		if config.Password, err = decryptSecret(config.Password); err != nil {
+			return nil, fmt.Errorf("unable to decrypt SFTP password: %v", err)
+		}
+		if config.PrivateKey, err = decryptSecret(config.PrivateKey); err != nil {
+			return nil, fmt.Errorf("unable to decrypt SFTP private key: %v", err)
+		}
+		return vfs.NewSFTPFs(connectionID, rootDir, config)
+	} else if f.Provider == 5 {
+		config := f.MemConfig
+		config.StorageID = memStorageID
+		return vfs.NewMemFs(connectionID, config)
+	} else if f.Provider == 6 {
+		return vfs.NewDedupFs(connectionID, rootDir, f.DedupConfig)
+	}
+	return vfs.NewOsFs(connectionID, rootDir), nil
+}
+
+// isLocal returns true if the files are stored inside a local directory tree
+func (f *Filesystem) isLocal() bool {
+	return f.Provider == 0 || f.Provider == 6
+}
+
+func (f *Filesystem) getACopy() Filesystem {
+	fingerprints := make([]string, len(f.SFTPConfig.Fingerprints))
+	copy(fingerprints, f.SFTPConfig.Fingerprints)
+	return Filesystem{
+		Provider: f.Provider,
+		S3Config: vfs.S3FsConfig{
+			Bucket:               f.S3Config.Bucket,
+			Region:               f.S3Config.Region,
+			AccessKey:            f.S3Config.AccessKey,
+			AccessSecret:         f.S3Config.AccessSecret,
+			RoleARN:              f.S3Config.RoleARN,
+			ExternalID:           f.S3Config.ExternalID,
+			Endpoint:             f.S3Config.Endpoint,
+			StorageClass:         f.S3Config.StorageClass,
+			KeyPrefix:            f.S3Config.KeyPrefix,
+			UploadPartSize:       f.S3Config.UploadPartSize,
+			ServerSideEncryption: f.S3Config.ServerSideEncryption,
+			SSEKMSKeyID:          f.S3Config.SSEKMSKeyID,
+			SSECustomerKey:       f.S3Config.SSECustomerKey,
+			ObjectLockMode:       f.S3Config.ObjectLockMode,
+		},
+		GCSConfig: vfs.GCSFsConfig{
+			Bucket:               f.GCSConfig.Bucket,
+			CredentialFile:       f.GCSConfig.CredentialFile,
+			AutomaticCredentials: f.GCSConfig.AutomaticCredentials,
+			StorageClass:         f.GCSConfig.StorageClass,
+			KeyPrefix:            f.GCSConfig.KeyPrefix,
+		},
+		AzBlobConfig: vfs.AzBlobFsConfig{
+			Container:         f.AzBlobConfig.Container,
+			AccountName:       f.AzBlobConfig.AccountName,
+			AccountKey:        f.AzBlobConfig.AccountKey,
+			Endpoint:          f.AzBlobConfig.Endpoint,
+			SASURL:            f.AzBlobConfig.SASURL,
+			KeyPrefix:         f.AzBlobConfig.KeyPrefix,
+			UploadPartSize:    f.AzBlobConfig.UploadPartSize,
+			UploadConcurrency: f.AzBlobConfig.UploadConcurrency,
+			UseEmulator:       f.AzBlobConfig.UseEmulator,
+			AccessTier:        f.AzBlobConfig.AccessTier,
+		},
+		SFTPConfig: vfs.SFTPFsConfig{
+			Endpoint:     f.SFTPConfig.Endpoint,
+			Username:     f.SFTPConfig.Username,
+			Password:     f.SFTPConfig.Password,
+			PrivateKey:   f.SFTPConfig.PrivateKey,
+			Fingerprints: fingerprints,
+			Prefix:       f.SFTPConfig.Prefix,
+		},
+		MemConfig: vfs.MemFsConfig{
+			MaxSize:       f.MemConfig.MaxSize,
+			ClearOnLogout: f.MemConfig.ClearOnLogout,
+		},
+		DedupConfig: vfs.DedupFsConfig{
+			StorePath: f.DedupConfig.StorePath,
+		},
+		CryptConfig: vfs.CryptFsConfig{
+			Passphrase: f.CryptConfig.Passphrase,
+		},
+	}
+}
+
+// GetVirtualFolderForPath returns the virtual folder containing the specified SFTP path.
+// If the path is not inside a virtual folder an error is returned
+func (u *User) GetVirtualFolderForPath(sftpPath string) (VirtualFolder, error) {
+	var folder VirtualFolder
+	if len(u.VirtualFolders) == 0 {
+		return folder, errNoMatchingVirtualFolder
+	}
+	sftpPath = path.Clean(sftpPath)
+	for _, v := range u.VirtualFolders {
+		if v.IsInside(sftpPath) {
+			return v, nil
+		}
+	}
+	return folder, errNoMatchingVirtualFolder
+}
+
+// IsVirtualFolder returns true if the specified SFTP path is a virtual folder mount point
+func (u *User) IsVirtualFolder(sftpPath string) bool {
+	sftpPath = path.Clean(sftpPath)
+	for _, v := range u.VirtualFolders {
+		if sftpPath == v.VirtualPath {
+			return true
+		}
+	}
+	return false
+}
+
+// HasVirtualFoldersInside returns true if there are virtual folders mounted inside the
+// specified SFTP path. The mount point for a virtual folder at the same path is not considered
+func (u *User) HasVirtualFoldersInside(sftpPath string) bool {
+	sftpPath = path.Clean(sftpPath)
+	for _, v := range u.VirtualFolders {
+		if len(v.VirtualPath) > len(sftpPath) && (sftpPath == "/" || strings.HasPrefix(v.VirtualPath, sftpPath+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRetentionPolicy returns the write-once retention policy for the specified SFTP path, if any
+func (u *User) GetRetentionPolicy(sftpPath string) (vfs.RetentionPolicy, bool) {
+	return vfs.GetRetentionPolicyForPath(u.Filters.RetentionPolicies, sftpPath)
+}
+
+// HasRetentionPoliciesFor returns true if a retention policy applies to the specified
+// SFTP directory or to any directory inside it
+func (u *User) HasRetentionPoliciesFor(sftpPath string) bool {
+	if _, ok := u.GetRetentionPolicy(sftpPath); ok {
+		return true
+	}
+	sftpPath = path.Clean(sftpPath)
+	for _, policy := range u.Filters.RetentionPolicies {
+		if sftpPath == "/" || strings.HasPrefix(policy.Path, sftpPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDirQuotasForPath returns the directory quotas that include the given SFTP path
+func (u *User) GetDirQuotasForPath(sftpPath string) []DirQuota {
+	var quotas []DirQuota
+	for _, q := range u.Filters.DirQuotas {
+		if sftpPath == q.Path || strings.HasPrefix(sftpPath, q.Path+"/") {
+			quotas = append(quotas, q)
+		}
+	}
+	return quotas
+}
+
+func (u *User) hasDirQuota(dirPath string) bool {
+	for _, q := range u.Filters.DirQuotas {
+		if q.Path == dirPath {
+			return true
+		}
+	}
+	return false
+}
+
+// getPatternsFilterForPath returns the most specific file patterns filter for the
+// directory containing the given SFTP path
+func (u *User) getPatternsFilterForPath(sftpPath string) (PatternsFilter, bool) {
+	if len(u.Filters.FilePatterns) == 0 {
+		return PatternsFilter{}, false
+	}
+	dirPath := path.Dir(path.Clean(sftpPath))
+	for {
+		for _, f := range u.Filters.FilePatterns {
+			if f.Path == dirPath {
+				return f, true
+			}
+		}
+		if dirPath == "/" {
+			break
+		}
+		dirPath = path.Dir(dirPath)
+	}
+	return PatternsFilter{}, false
+}
+
+// IsFileAllowed returns true if the name of the file or directory at the given SFTP path
+// is allowed by the file patterns filters
+func (u *User) IsFileAllowed(sftpPath string) bool {
+	filter, ok := u.getPatternsFilterForPath(sftpPath)
+	if !ok {
+		return true
+	}
+	name := strings.ToLower(path.Base(sftpPath))
+	for _, pattern := range filter.DeniedPatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(filter.AllowedPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range filter.AllowedPatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFilePatternsFor returns true if a file patterns filter applies to the given SFTP path
+// or to a path inside it
+func (u *User) HasFilePatternsFor(sftpPath string) bool {
+	if _, ok := u.getPatternsFilterForPath(sftpPath); ok {
+		return true
+	}
+	sftpPath = path.Clean(sftpPath)
+	for _, f := range u.Filters.FilePatterns {
+		if sftpPath == "/" || f.Path == sftpPath || strings.HasPrefix(f.Path, sftpPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AddVirtualDirs adds the virtual folders mounted directly inside the specified SFTP
+// path to the given directory listing, if they are not already there
+func (u *User) AddVirtualDirs(list []os.FileInfo, sftpPath string) []os.FileInfo {
+	if len(u.VirtualFolders) == 0 {
+		return list
+	}
+	sftpPath = path.Clean(sftpPath)
+	for _, v := range u.VirtualFolders {
+		if path.Dir(v.VirtualPath) != sftpPath {
+			continue
+		}
+		name := path.Base(v.VirtualPath)
+		found := false
+		for idx, fi := range list {
+			if fi.Name() == name {
+				if !fi.IsDir() {
+					list[idx] = vfs.NewFileInfo(name, true, 0, fi.ModTime())
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, vfs.NewFileInfo(name, true, 0, time.Now()))
+		}
 	}
-	return vfs.NewOsFs(connectionID, u.GetHomeDir()), nil
+	return list
 }
 
 // GetPermissionsForPath returns the permissions for the given path.
@@ -280,6 +795,74 @@ func (u *User) GetQuotaSummary() string {
 	return result
 }
 
+// IsEnabled returns true if a transfer quota period is defined
+func (q *TransferQuota) IsEnabled() bool {
+	return q.Period != ""
+}
+
+// GetPeriodStart returns the start of the period that includes the given time as unix timestamp
+// in milliseconds. 0 is returned if the transfer quota is not enabled
+func (q *TransferQuota) GetPeriodStart(t time.Time) int64 {
+	t = t.UTC()
+	switch q.Period {
+	case TransferQuotaPeriodDaily:
+		return utils.GetTimeAsMsSinceEpoch(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+	case TransferQuotaPeriodMonthly:
+		return utils.GetTimeAsMsSinceEpoch(time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC))
+	}
+	return 0
+}
+
+// GetRemainingUpload returns the bytes that can still be uploaded in the current period.
+// 0 means unlimited, a negative value means that the upload limit is exceeded
+func (u *TransferQuotaUsage) GetRemainingUpload() int64 {
+	return getRemainingTransfer(u.UploadSize, u.UsedUploadSize)
+}
+
+// GetRemainingDownload returns the bytes that can still be downloaded in the current period.
+// 0 means unlimited, a negative value means that the download limit is exceeded
+func (u *TransferQuotaUsage) GetRemainingDownload() int64 {
+	return getRemainingTransfer(u.DownloadSize, u.UsedDownloadSize)
+}
+
+// GetQuotaSummary returns the transferred data and the limits if defined
+func (u *TransferQuotaUsage) GetQuotaSummary() string {
+	result := "Upload: " + utils.ByteCountSI(u.UsedUploadSize)
+	if u.UploadSize > 0 {
+		result += "/" + utils.ByteCountSI(u.UploadSize)
+	}
+	result += ". Download: " + utils.ByteCountSI(u.UsedDownloadSize)
+	if u.DownloadSize > 0 {
+		result += "/" + utils.ByteCountSI(u.DownloadSize)
+	}
+	return result
+}
+
+func getRemainingTransfer(limit, used int64) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	if used >= limit {
+		return -1
+	}
+	return limit - used
+}
+
+// GetQuotaSummary returns used quota and limits if defined
+func (u *DirQuotaUsage) GetQuotaSummary() string {
+	result := "Files: " + strconv.Itoa(u.UsedQuotaFiles)
+	if u.QuotaFiles > 0 {
+		result += "/" + strconv.Itoa(u.QuotaFiles)
+	}
+	if u.UsedQuotaSize > 0 || u.QuotaSize > 0 {
+		result += ". Size: " + utils.ByteCountSI(u.UsedQuotaSize)
+		if u.QuotaSize > 0 {
+			result += "/" + utils.ByteCountSI(u.QuotaSize)
+		}
+	}
+	return result
+}
+
 // GetPermissionsAsString returns the user's permissions as comma separated string
 func (u *User) GetPermissionsAsString() string {
 	result := ""
@@ -338,6 +921,17 @@ func (u *User) GetInfoString() string {
 		result += fmt.Sprintf("Storage: S3 ")
 	} else if u.FsConfig.Provider == 2 {
 		result += fmt.Sprintf("Storage: GCS ")
+	} else if u.FsConfig.Provider == 3 {
+		result += fmt.Sprintf("Storage: Azure ")
+	} else if u.FsConfig.Provider == 4 {
+		result += fmt.Sprintf("Storage: SFTP ")
+	} else if u.FsConfig.Provider == 5 {
+		result += fmt.Sprintf("Storage: Memory ")
+	} else if u.FsConfig.Provider == 6 {
+		result += fmt.Sprintf("Storage: Dedup ")
+	}
+	if len(u.FsConfig.CryptConfig.Passphrase) > 0 {
+		result += fmt.Sprintf("Encrypted ")
 	}
 	if len(u.PublicKeys) > 0 {
 		result += fmt.Sprintf("Public keys: %v ", len(u.PublicKeys))
@@ -351,12 +945,27 @@ func (u *User) GetInfoString() string {
 	if u.GID > 0 {
 		result += fmt.Sprintf("GID: %v ", u.GID)
 	}
+	if len(u.VirtualFolders) > 0 {
+		result += fmt.Sprintf("Virtual folders: %v ", len(u.VirtualFolders))
+	}
 	if len(u.Filters.DeniedIP) > 0 {
 		result += fmt.Sprintf("Denied IP/Mask: %v ", len(u.Filters.DeniedIP))
 	}
 	if len(u.Filters.AllowedIP) > 0 {
 		result += fmt.Sprintf("Allowed IP/Mask: %v ", len(u.Filters.AllowedIP))
 	}
+	if len(u.Filters.RetentionPolicies) > 0 {
+		result += fmt.Sprintf("Retention policies: %v ", len(u.Filters.RetentionPolicies))
+	}
+	if u.Filters.Trash.Enabled {
+		result += "Trash enabled "
+	}
+	if u.Filters.Replication.Enabled {
+		result += "Replication enabled "
+	}
+	if u.Filters.Tiering.Enabled {
+		result += "Tiering enabled "
+	}
 	return result
 }
 
@@ -407,23 +1016,45 @@ func (u *User) getACopy() User {
 	copy(filters.AllowedIP, u.Filters.AllowedIP)
 	filters.DeniedIP = make([]string, len(u.Filters.DeniedIP))
 	copy(filters.DeniedIP, u.Filters.DeniedIP)
-	fsConfig := Filesystem{
-		Provider: u.FsConfig.Provider,
-		S3Config: vfs.S3FsConfig{
-			Bucket:       u.FsConfig.S3Config.Bucket,
-			Region:       u.FsConfig.S3Config.Region,
-			AccessKey:    u.FsConfig.S3Config.AccessKey,
-			AccessSecret: u.FsConfig.S3Config.AccessSecret,
-			Endpoint:     u.FsConfig.S3Config.Endpoint,
-			StorageClass: u.FsConfig.S3Config.StorageClass,
-			KeyPrefix:    u.FsConfig.S3Config.KeyPrefix,
-		},
-		GCSConfig: vfs.GCSFsConfig{
-			Bucket:         u.FsConfig.GCSConfig.Bucket,
-			CredentialFile: u.FsConfig.GCSConfig.CredentialFile,
-			StorageClass:   u.FsConfig.GCSConfig.StorageClass,
-			KeyPrefix:      u.FsConfig.GCSConfig.KeyPrefix,
-		},
+	filters.Trash = u.Filters.Trash
+	filters.RetentionPolicies = make([]vfs.RetentionPolicy, len(u.Filters.RetentionPolicies))
+	copy(filters.RetentionPolicies, u.Filters.RetentionPolicies)
+	filters.DirQuotas = make([]DirQuota, len(u.Filters.DirQuotas))
+	copy(filters.DirQuotas, u.Filters.DirQuotas)
+	filters.TransferQuota = u.Filters.TransferQuota
+	filters.MaxUploadFileSize = u.Filters.MaxUploadFileSize
+	filters.FilePatterns = make([]PatternsFilter, len(u.Filters.FilePatterns))
+	for idx, f := range u.Filters.FilePatterns {
+		allowed := make([]string, len(f.AllowedPatterns))
+		copy(allowed, f.AllowedPatterns)
+		denied := make([]string, len(f.DeniedPatterns))
+		copy(denied, f.DeniedPatterns)
+		filters.FilePatterns[idx] = PatternsFilter{
+			Path:            f.Path,
+			AllowedPatterns: allowed,
+			DeniedPatterns:  denied,
+		}
+	}
+	filters.Replication = ReplicationConfig{
+		Enabled:   u.Filters.Replication.Enabled,
+		FsConfig:  u.Filters.Replication.FsConfig.getACopy(),
+		LocalPath: u.Filters.Replication.LocalPath,
+	}
+	filters.Tiering = TieringConfig{
+		Enabled:        u.Filters.Tiering.Enabled,
+		Days:           u.Filters.Tiering.Days,
+		FsConfig:       u.Filters.Tiering.FsConfig.getACopy(),
+		LocalPath:      u.Filters.Tiering.LocalPath,
+		RecallOnAccess: u.Filters.Tiering.RecallOnAccess,
+	}
+	virtualFolders := make([]VirtualFolder, 0, len(u.VirtualFolders))
+	for _, v := range u.VirtualFolders {
+		virtualFolders = append(virtualFolders, VirtualFolder{
+			BaseVirtualFolder: v.BaseVirtualFolder.getACopy(),
+			VirtualPath:       v.VirtualPath,
+			QuotaSize:         v.QuotaSize,
+			QuotaFiles:        v.QuotaFiles,
+		})
 	}
 
 	return User{
@@ -447,7 +1078,8 @@ func (u *User) getACopy() User {
 		ExpirationDate:    u.ExpirationDate,
 		LastLogin:         u.LastLogin,
 		Filters:           filters,
-		FsConfig:          fsConfig,
+		FsConfig:          u.FsConfig.getACopy(),
+		VirtualFolders:    virtualFolders,
 	}
 }
 
@@ -483,3 +1115,15 @@ func (u *User) getNotificationFieldsAsEnvVars(action string) []string {
 func (u *User) getGCSCredentialsFilePath() string {
 	return filepath.Join(credentialsDirPath, fmt.Sprintf("%v_gcs_credentials.json", u.Username))
 }
+
+func (u *User) getReplicaGCSCredentialsFilePath() string {
+	return filepath.Join(credentialsDirPath, fmt.Sprintf("%v_replica_gcs_credentials.json", u.Username))
+}
+
+func (u *User) getTieringGCSCredentialsFilePath() string {
+	return filepath.Join(credentialsDirPath, fmt.Sprintf("%v_tiering_gcs_credentials.json", u.Username))
+}
+
+func (u *User) getMemStorageID() string {
+	return fmt.Sprintf("user_%v", u.Username)
+}
@@ -45,14 +45,22 @@ func dumpData(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	folders, err := dataprovider.DumpFolders(dataProvider)
+	if err != nil {
+		logger.Warn(logSender, "", "dumping folders error: %v, output file: %#v", err, outputFile)
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
 	var dump []byte
 	if indent == "1" {
 		dump, err = json.MarshalIndent(dataprovider.BackupData{
-			Users: users,
+			Users:   users,
+			Folders: folders,
 		}, "", "  ")
 	} else {
 		dump, err = json.Marshal(dataprovider.BackupData{
-			Users: users,
+			Users:   users,
+			Folders: folders,
 		})
 	}
 	if err == nil {
@@ -101,6 +109,11 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = restoreFolders(dump.Folders, inputFile, mode, scanQuota); err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+
 	for _, user := range dump.Users {
 		u, err := dataprovider.UserExists(dataProvider, user.Username)
 		if err == nil {
@@ -130,14 +143,45 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		if needQuotaScan(scanQuota, &user) {
 			if sftpd.AddQuotaScan(user.Username) {
 				logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
-				go doQuotaScan(user)
+				go doQuotaScan(user, false)
 			}
 		}
 	}
-	logger.Debug(logSender, "", "backup restored, users: %v", len(dump.Users))
+	logger.Debug(logSender, "", "backup restored, users: %v, folders: %v", len(dump.Users), len(dump.Folders))
 	sendAPIResponse(w, r, err, "Data restored", http.StatusOK)
 }
 
+func restoreFolders(folders []dataprovider.BaseVirtualFolder, inputFile string, mode, scanQuota int) error {
+	for _, folder := range folders {
+		f, err := dataprovider.FolderExists(dataProvider, folder.Name)
+		if err == nil {
+			if mode == 1 {
+				logger.Debug(logSender, "", "loaddata mode 1, existing folder %#v not updated", f.Name)
+				continue
+			}
+			folder.ID = f.ID
+			folder.UsedQuotaSize = f.UsedQuotaSize
+			folder.UsedQuotaFiles = f.UsedQuotaFiles
+			folder.LastQuotaUpdate = f.LastQuotaUpdate
+			err = dataprovider.UpdateFolder(dataProvider, folder)
+			logger.Debug(logSender, "", "restoring existing folder: %#v, dump file: %#v, error: %v", folder.Name, inputFile, err)
+		} else {
+			err = dataprovider.AddFolder(dataProvider, folder)
+			logger.Debug(logSender, "", "adding new folder: %#v, dump file: %#v, error: %v", folder.Name, inputFile, err)
+		}
+		if err != nil {
+			return err
+		}
+		if scanQuota >= 1 {
+			if sftpd.AddVFolderQuotaScan(folder.Name) {
+				logger.Debug(logSender, "", "starting quota scan for restored folder: %#v", folder.Name)
+				go doFolderQuotaScan(folder, false)
+			}
+		}
+	}
+	return nil
+}
+
 func needQuotaScan(scanQuota int, user *dataprovider.User) bool {
 	return scanQuota == 1 || (scanQuota == 2 && user.HasQuotaRestrictions())
 }
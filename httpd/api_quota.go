@@ -1,11 +1,17 @@
 package httpd
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/freshvolk/sftpgo/dataprovider"
 	"github.com/freshvolk/sftpgo/logger"
 	"github.com/freshvolk/sftpgo/sftpd"
+	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
 
@@ -13,10 +19,57 @@ func getQuotaScans(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, sftpd.GetQuotaScans())
 }
 
+func getDirQuotasUsage(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	usage, err := dataprovider.GetDirQuotasUsage(dataProvider, user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, usage)
+}
+
+func getTransferQuotaUsage(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	usage, err := dataprovider.GetTransferQuotaUsage(dataProvider, user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, usage)
+}
+
+func resetTransferQuota(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	// the data transferred by the active transfers before the reset must not be added
+	sftpd.ResetTransferQuota(user.Username)
+	periodStart := user.Filters.TransferQuota.GetPeriodStart(time.Now())
+	err := dataprovider.UpdateTransferQuota(dataProvider, user, 0, 0, periodStart, true)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, err, "Transfer quota reset", http.StatusOK)
+}
+
 func startQuotaScan(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	incremental, err := getQuotaScanMode(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
 	var u dataprovider.User
-	err := render.DecodeJSON(r.Body, &u)
+	err = render.DecodeJSON(r.Body, &u)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
@@ -27,26 +80,131 @@ func startQuotaScan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if sftpd.AddQuotaScan(user.Username) {
-		go doQuotaScan(user)
+		go doQuotaScan(user, incremental)
 		sendAPIResponse(w, r, err, "Scan started", http.StatusCreated)
 	} else {
 		sendAPIResponse(w, r, err, "Another scan is already in progress", http.StatusConflict)
 	}
 }
 
-func doQuotaScan(user dataprovider.User) error {
+func cancelQuotaScan(w http.ResponseWriter, r *http.Request) {
+	username, err := url.PathUnescape(chi.URLParam(r, "username"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if err = sftpd.CancelQuotaScan(username); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Scan cancellation requested", http.StatusOK)
+}
+
+func doQuotaScan(user dataprovider.User, incremental bool) error {
 	defer sftpd.RemoveQuotaScan(user.Username)
 	fs, err := user.GetFilesystem("")
 	if err != nil {
 		logger.Warn(logSender, "", "unable scan quota for user %#v error creating filesystem: %v", user.Username, err)
 		return err
 	}
-	numFiles, size, err := fs.ScanRootDirContents()
+	defer fs.Close()
+	numFiles, size, err := sftpd.ScanUserQuota(user.Username, fs, incremental)
 	if err != nil {
 		logger.Warn(logSender, "", "error scanning user home dir %#v: %v", user.Username, err)
 	} else {
+		if user.Filters.Trash.Enabled && !user.Filters.Trash.CountInQuota {
+			trashFiles, trashSize, err := sftpd.GetTrashUsage(fs)
+			if err != nil {
+				logger.Warn(logSender, "", "error scanning the trash for user %#v: %v", user.Username, err)
+				return err
+			}
+			numFiles -= trashFiles
+			size -= trashSize
+		}
 		err = dataprovider.UpdateUserQuota(dataProvider, user, numFiles, size, true)
 		logger.Debug(logSender, "", "user home dir scanned, user: %#v, error: %v", user.Username, err)
+		if err == nil {
+			err = sftpd.ScanUserDirQuotas(user, fs)
+			if err != nil {
+				logger.Warn(logSender, "", "error scanning directory quotas for user %#v: %v", user.Username, err)
+			}
+		}
 	}
 	return err
 }
+
+func getFoldersQuotaScans(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, sftpd.GetVFoldersQuotaScans())
+}
+
+func startFolderQuotaScan(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	incremental, err := getQuotaScanMode(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	var f dataprovider.BaseVirtualFolder
+	err = render.DecodeJSON(r.Body, &f)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	folder, err := dataprovider.FolderExists(dataProvider, f.Name)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	}
+	if sftpd.AddVFolderQuotaScan(folder.Name) {
+		go doFolderQuotaScan(folder, incremental)
+		sendAPIResponse(w, r, err, "Scan started", http.StatusCreated)
+	} else {
+		sendAPIResponse(w, r, err, "Another scan is already in progress", http.StatusConflict)
+	}
+}
+
+func cancelFolderQuotaScan(w http.ResponseWriter, r *http.Request) {
+	folderName, err := url.PathUnescape(chi.URLParam(r, "folderName"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if err = sftpd.CancelVFolderQuotaScan(folderName); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Scan cancellation requested", http.StatusOK)
+}
+
+func doFolderQuotaScan(folder dataprovider.BaseVirtualFolder, incremental bool) error {
+	defer sftpd.RemoveVFolderQuotaScan(folder.Name)
+	fs, err := folder.GetFilesystem("", "")
+	if err != nil {
+		logger.Warn(logSender, "", "unable scan quota for folder %#v error creating filesystem: %v", folder.Name, err)
+		return err
+	}
+	defer fs.Close()
+	numFiles, size, err := sftpd.ScanVFolderQuota(folder.Name, fs, incremental)
+	if err != nil {
+		logger.Warn(logSender, "", "error scanning folder %#v: %v", folder.Name, err)
+	} else {
+		err = dataprovider.UpdateVirtualFolderQuota(dataProvider, dataprovider.VirtualFolder{BaseVirtualFolder: folder},
+			numFiles, size, true)
+		logger.Debug(logSender, "", "folder %#v scanned, error: %v", folder.Name, err)
+	}
+	return err
+}
+
+func getQuotaScanMode(r *http.Request) (bool, error) {
+	if _, ok := r.URL.Query()["incremental"]; !ok {
+		return false, nil
+	}
+	incremental, err := strconv.Atoi(r.URL.Query().Get("incremental"))
+	if err != nil {
+		return false, fmt.Errorf("invalid incremental: %v", err)
+	}
+	if incremental == 1 && !sftpd.IsIncrementalQuotaScanEnabled() {
+		return false, errors.New("incremental quota scans are disabled: the quota scan state path is not configured")
+	}
+	return incremental == 1, nil
+}
@@ -0,0 +1,37 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/freshvolk/sftpgo/sftpd"
+	"github.com/go-chi/render"
+)
+
+func getRetentionStatus(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := r.URL.Query()["path"]; !ok {
+		sendAPIResponse(w, r, errors.New("path is mandatory"), "", http.StatusBadRequest)
+		return
+	}
+	status, err := sftpd.GetRetentionStatus(user, r.URL.Query().Get("path"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRetentionRespStatus(err))
+		return
+	}
+	render.JSON(w, r, status)
+}
+
+func getRetentionRespStatus(err error) int {
+	if err == sftpd.ErrInvalidRetentionPath {
+		return http.StatusBadRequest
+	}
+	if os.IsNotExist(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
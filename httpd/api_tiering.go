@@ -0,0 +1,17 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/freshvolk/sftpgo/sftpd"
+	"github.com/go-chi/render"
+)
+
+func getTieringStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := sftpd.GetTieringStatus()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, status)
+}
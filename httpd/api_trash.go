@@ -0,0 +1,95 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/sftpd"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getTrashEntries(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	entries, err := sftpd.GetTrashEntries(user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(err))
+		return
+	}
+	render.JSON(w, r, entries)
+}
+
+func restoreTrashEntry(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	err := sftpd.RestoreTrashEntry(user, chi.URLParam(r, "entryID"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, err, "Trash entry restored", http.StatusOK)
+}
+
+func purgeTrashEntry(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	err := sftpd.PurgeTrashEntry(user, chi.URLParam(r, "entryID"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, err, "Trash entry purged", http.StatusOK)
+}
+
+func purgeTrash(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	purged, err := sftpd.PurgeTrash(user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getTrashRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, err, "Trash purged, removed entries: "+strconv.Itoa(purged), http.StatusOK)
+}
+
+func getUserFromURLParam(w http.ResponseWriter, r *http.Request) (dataprovider.User, bool) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return dataprovider.User{}, false
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+		return user, false
+	}
+	return user, true
+}
+
+func getTrashRespStatus(err error) int {
+	switch err {
+	case sftpd.ErrTrashDisabled:
+		return http.StatusBadRequest
+	case sftpd.ErrTrashEntryNotFound:
+		return http.StatusNotFound
+	case sftpd.ErrTrashRestoreConflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -6,7 +6,7 @@ import (
 	"strconv"
 
 	"github.com/freshvolk/sftpgo/dataprovider"
-	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/secrets"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
@@ -103,10 +103,9 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user, err := dataprovider.GetUserByID(dataProvider, userID)
 	currentPermissions := user.Permissions
-	currentS3AccessSecret := ""
-	if user.FsConfig.Provider == 1 {
-		currentS3AccessSecret = user.FsConfig.S3Config.AccessSecret
-	}
+	currentSecrets := getFsSecrets(&user.FsConfig)
+	currentReplicaSecrets := getFsSecrets(&user.Filters.Replication.FsConfig)
+	currentTieringSecrets := getFsSecrets(&user.Filters.Tiering.FsConfig)
 	user.Permissions = make(map[string][]string)
 	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
 		sendAPIResponse(w, r, err, "", http.StatusNotFound)
@@ -124,13 +123,9 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if len(user.Permissions) == 0 {
 		user.Permissions = currentPermissions
 	}
-	// we use the new access secret if different from the old one and not empty
-	if user.FsConfig.Provider == 1 {
-		if utils.RemoveDecryptionKey(currentS3AccessSecret) == user.FsConfig.S3Config.AccessSecret ||
-			len(user.FsConfig.S3Config.AccessSecret) == 0 {
-			user.FsConfig.S3Config.AccessSecret = currentS3AccessSecret
-		}
-	}
+	restoreFsSecrets(&user.FsConfig, currentSecrets)
+	restoreFsSecrets(&user.Filters.Replication.FsConfig, currentReplicaSecrets)
+	restoreFsSecrets(&user.Filters.Tiering.FsConfig, currentTieringSecrets)
 	if user.ID != userID {
 		sendAPIResponse(w, r, err, "user ID in request body does not match user ID in path parameter", http.StatusBadRequest)
 		return
@@ -165,3 +160,79 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "User deleted", http.StatusOK)
 	}
 }
+
+// fsSecrets contains the stored secrets for a filesystem configuration.
+// The API returns them masked so they must be restored if they are sent back unchanged
+type fsSecrets struct {
+	s3AccessSecret string
+	s3SSEKey       string
+	azAccountKey   string
+	azSASURL       string
+	sftpPassword   string
+	sftpPrivateKey string
+	passphrase     string
+}
+
+func getFsSecrets(fsConfig *dataprovider.Filesystem) fsSecrets {
+	current := fsSecrets{
+		passphrase: fsConfig.CryptConfig.Passphrase,
+	}
+	if fsConfig.Provider == 1 {
+		current.s3AccessSecret = fsConfig.S3Config.AccessSecret
+		current.s3SSEKey = fsConfig.S3Config.SSECustomerKey
+	} else if fsConfig.Provider == 3 {
+		current.azAccountKey = fsConfig.AzBlobConfig.AccountKey
+		current.azSASURL = fsConfig.AzBlobConfig.SASURL
+	} else if fsConfig.Provider == 4 {
+		current.sftpPassword = fsConfig.SFTPConfig.Password
+		current.sftpPrivateKey = fsConfig.SFTPConfig.PrivateKey
+	}
+	return current
+}
+
+func restoreFsSecrets(fsConfig *dataprovider.Filesystem, current fsSecrets) {
+	// we use the new access secret if different from the old one and not empty.
+	// An empty access key means the default credential chain, no secret is needed
+	if fsConfig.Provider == 1 {
+		if secrets.Mask(current.s3AccessSecret) == fsConfig.S3Config.AccessSecret ||
+			(len(fsConfig.S3Config.AccessSecret) == 0 && len(fsConfig.S3Config.AccessKey) > 0) {
+			fsConfig.S3Config.AccessSecret = current.s3AccessSecret
+		}
+		if len(current.s3SSEKey) > 0 && secrets.Mask(current.s3SSEKey) == fsConfig.S3Config.SSECustomerKey {
+			fsConfig.S3Config.SSECustomerKey = current.s3SSEKey
+		}
+	} else if fsConfig.Provider == 3 {
+		updateAzBlobSecrets(fsConfig, current.azAccountKey, current.azSASURL)
+	} else if fsConfig.Provider == 4 {
+		updateSFTPSecrets(fsConfig, current.sftpPassword, current.sftpPrivateKey)
+	}
+	// the passphrase is hidden in API responses, keep the current one if it is unchanged
+	if len(current.passphrase) > 0 && secrets.Mask(current.passphrase) == fsConfig.CryptConfig.Passphrase {
+		fsConfig.CryptConfig.Passphrase = current.passphrase
+	}
+}
+
+// updateAzBlobSecrets restores the stored Azure Blob credentials if the
+// request contains the masked values returned by the API or, for the
+// account key, if it is empty and no SAS URL is provided
+func updateAzBlobSecrets(fsConfig *dataprovider.Filesystem, currentAccountKey, currentSASURL string) {
+	if len(currentSASURL) > 0 && secrets.Mask(currentSASURL) == fsConfig.AzBlobConfig.SASURL {
+		fsConfig.AzBlobConfig.SASURL = currentSASURL
+	}
+	if len(currentAccountKey) == 0 {
+		return
+	}
+	if secrets.Mask(currentAccountKey) == fsConfig.AzBlobConfig.AccountKey ||
+		(len(fsConfig.AzBlobConfig.AccountKey) == 0 && len(fsConfig.AzBlobConfig.SASURL) == 0) {
+		fsConfig.AzBlobConfig.AccountKey = currentAccountKey
+	}
+}
+
+func updateSFTPSecrets(fsConfig *dataprovider.Filesystem, currentPassword, currentPrivateKey string) {
+	if len(currentPassword) > 0 && secrets.Mask(currentPassword) == fsConfig.SFTPConfig.Password {
+		fsConfig.SFTPConfig.Password = currentPassword
+	}
+	if len(currentPrivateKey) > 0 && secrets.Mask(currentPrivateKey) == fsConfig.SFTPConfig.PrivateKey {
+		fsConfig.SFTPConfig.PrivateKey = currentPrivateKey
+	}
+}
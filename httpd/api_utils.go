@@ -12,11 +12,13 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/secrets"
 	"github.com/freshvolk/sftpgo/sftpd"
 	"github.com/freshvolk/sftpgo/utils"
 	"github.com/go-chi/render"
@@ -235,12 +237,379 @@ func GetQuotaScans(expectedStatusCode int) ([]sftpd.ActiveQuotaScan, []byte, err
 
 // StartQuotaScan start a new quota scan for the given user and checks the received HTTP Status code against expectedStatusCode.
 func StartQuotaScan(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	return sendQuotaScanRequest(quotaScanPath, user, false, expectedStatusCode)
+}
+
+// StartIncrementalQuotaScan start a new incremental quota scan for the given user and checks the received
+// HTTP Status code against expectedStatusCode.
+func StartIncrementalQuotaScan(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	return sendQuotaScanRequest(quotaScanPath, user, true, expectedStatusCode)
+}
+
+// CancelQuotaScan requests the cancellation of the active quota scan for the given user and checks the
+// received HTTP Status code against expectedStatusCode.
+func CancelQuotaScan(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
 	var body []byte
-	userAsJSON, err := json.Marshal(user)
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(quotaScanPath, url.PathEscape(user.Username)),
+		nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+func sendQuotaScanRequest(scanPath string, obj interface{}, incremental bool, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	asJSON, err := json.Marshal(obj)
+	if err != nil {
+		return body, err
+	}
+	url, err := url.Parse(buildURLRelativeToBase(scanPath))
+	if err != nil {
+		return body, err
+	}
+	if incremental {
+		q := url.Query()
+		q.Add("incremental", "1")
+		url.RawQuery = q.Encode()
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, url.String(), bytes.NewBuffer(asJSON), "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetTrashEntries returns the items inside the trash for the given user and checks the received HTTP Status code
+// against expectedStatusCode.
+func GetTrashEntries(user dataprovider.User, expectedStatusCode int) ([]sftpd.TrashEntry, []byte, error) {
+	var entries []sftpd.TrashEntry
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10), "trash"),
+		nil, "")
+	if err != nil {
+		return entries, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &entries)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return entries, body, err
+}
+
+// RestoreTrashEntry restores the trash entry with the given ID for the given user and checks the received HTTP Status
+// code against expectedStatusCode.
+func RestoreTrashEntry(user dataprovider.User, entryID string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10), "trash",
+		entryID, "restore"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// PurgeTrashEntry permanently removes the trash entry with the given ID for the given user and checks the received
+// HTTP Status code against expectedStatusCode.
+// An empty entryID purges the whole trash
+func PurgeTrashEntry(user dataprovider.User, entryID string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10), "trash",
+		entryID), nil, "")
 	if err != nil {
 		return body, err
 	}
-	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(quotaScanPath), bytes.NewBuffer(userAsJSON), "")
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetDirQuotasUsage returns the quota restrictions and the used quota for the given user's directories
+// and checks the received HTTP Status code against expectedStatusCode.
+func GetDirQuotasUsage(user dataprovider.User, expectedStatusCode int) ([]dataprovider.DirQuotaUsage, []byte, error) {
+	var usage []dataprovider.DirQuotaUsage
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"directory_quotas"), nil, "")
+	if err != nil {
+		return usage, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &usage)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return usage, body, err
+}
+
+// GetTransferQuotaUsage returns the transfer quota limits and the data transferred in the current period
+// by the given user and checks the received HTTP Status code against expectedStatusCode.
+func GetTransferQuotaUsage(user dataprovider.User, expectedStatusCode int) (dataprovider.TransferQuotaUsage, []byte, error) {
+	var usage dataprovider.TransferQuotaUsage
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"transfer_quota"), nil, "")
+	if err != nil {
+		return usage, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &usage)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return usage, body, err
+}
+
+// ResetTransferQuota resets the data transferred in the current period by the given user
+// and checks the received HTTP Status code against expectedStatusCode.
+func ResetTransferQuota(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"transfer_quota"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetRetentionStatus returns the write-once retention status for the given user's SFTP path and checks the received
+// HTTP Status code against expectedStatusCode.
+func GetRetentionStatus(user dataprovider.User, sftpPath string, expectedStatusCode int) (sftpd.RetentionStatus, []byte, error) {
+	var status sftpd.RetentionStatus
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10), "retention"))
+	if err != nil {
+		return status, body, err
+	}
+	q := url.Query()
+	q.Add("path", sftpPath)
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
+// GetTieringStatus returns the tiering statistics for the users with tiering enabled and checks
+// the received HTTP Status code against expectedStatusCode.
+func GetTieringStatus(expectedStatusCode int) ([]sftpd.TieringStatus, []byte, error) {
+	var status []sftpd.TieringStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(tieringPath), nil, "")
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
+// GetReplicationStatus returns the replication state for the users with pending operations and checks
+// the received HTTP Status code against expectedStatusCode.
+func GetReplicationStatus(expectedStatusCode int) ([]sftpd.ReplicationStatus, []byte, error) {
+	var status []sftpd.ReplicationStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(replicationPath), nil, "")
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
+// AddFolder adds a new virtual folder and checks the received HTTP Status code against expectedStatusCode.
+func AddFolder(folder dataprovider.BaseVirtualFolder, expectedStatusCode int) (dataprovider.BaseVirtualFolder, []byte, error) {
+	var newFolder dataprovider.BaseVirtualFolder
+	var body []byte
+	folderAsJSON, err := json.Marshal(folder)
+	if err != nil {
+		return newFolder, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(folderPath), bytes.NewBuffer(folderAsJSON),
+		"application/json")
+	if err != nil {
+		return newFolder, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newFolder, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newFolder)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkFolder(&folder, &newFolder)
+	}
+	return newFolder, body, err
+}
+
+// UpdateFolder updates an existing virtual folder and checks the received HTTP Status code against expectedStatusCode.
+func UpdateFolder(folder dataprovider.BaseVirtualFolder, expectedStatusCode int) (dataprovider.BaseVirtualFolder, []byte, error) {
+	var newFolder dataprovider.BaseVirtualFolder
+	var body []byte
+	folderAsJSON, err := json.Marshal(folder)
+	if err != nil {
+		return folder, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(folderPath, strconv.FormatInt(folder.ID, 10)),
+		bytes.NewBuffer(folderAsJSON), "application/json")
+	if err != nil {
+		return folder, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newFolder, body, err
+	}
+	if err == nil {
+		newFolder, body, err = GetFolderByID(folder.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkFolder(&folder, &newFolder)
+	}
+	return newFolder, body, err
+}
+
+// RemoveFolder removes an existing virtual folder and checks the received HTTP Status code against expectedStatusCode.
+func RemoveFolder(folder dataprovider.BaseVirtualFolder, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(folderPath, strconv.FormatInt(folder.ID, 10)), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetFolderByID gets a virtual folder by database id and checks the received HTTP Status code against expectedStatusCode.
+func GetFolderByID(folderID int64, expectedStatusCode int) (dataprovider.BaseVirtualFolder, []byte, error) {
+	var folder dataprovider.BaseVirtualFolder
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(folderPath, strconv.FormatInt(folderID, 10)), nil, "")
+	if err != nil {
+		return folder, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &folder)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return folder, body, err
+}
+
+// GetFolders allows to get a list of virtual folders and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a folder name, the name filter is an exact match
+func GetFolders(limit int64, offset int64, name string, expectedStatusCode int) ([]dataprovider.BaseVirtualFolder, []byte, error) {
+	var folders []dataprovider.BaseVirtualFolder
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(folderPath))
+	if err != nil {
+		return folders, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(name) > 0 {
+		q.Add("name", name)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return folders, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &folders)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return folders, body, err
+}
+
+// GetFoldersQuotaScans gets active quota scans for virtual folders and checks the received HTTP Status code against expectedStatusCode.
+func GetFoldersQuotaScans(expectedStatusCode int) ([]sftpd.ActiveVirtualFolderQuotaScan, []byte, error) {
+	var quotaScans []sftpd.ActiveVirtualFolderQuotaScan
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(folderQuotaScanPath), nil, "")
+	if err != nil {
+		return quotaScans, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &quotaScans)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return quotaScans, body, err
+}
+
+// StartFolderQuotaScan start a new quota scan for the given virtual folder and checks the received HTTP Status code against expectedStatusCode.
+func StartFolderQuotaScan(folder dataprovider.BaseVirtualFolder, expectedStatusCode int) ([]byte, error) {
+	return sendQuotaScanRequest(folderQuotaScanPath, folder, false, expectedStatusCode)
+}
+
+// StartIncrementalFolderQuotaScan start a new incremental quota scan for the given folder and checks the
+// received HTTP Status code against expectedStatusCode.
+func StartIncrementalFolderQuotaScan(folder dataprovider.BaseVirtualFolder, expectedStatusCode int) ([]byte, error) {
+	return sendQuotaScanRequest(folderQuotaScanPath, folder, true, expectedStatusCode)
+}
+
+// CancelFolderQuotaScan requests the cancellation of the active quota scan for the given folder and checks
+// the received HTTP Status code against expectedStatusCode.
+func CancelFolderQuotaScan(folder dataprovider.BaseVirtualFolder, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(folderQuotaScanPath,
+		url.PathEscape(folder.Name)), nil, "")
 	if err != nil {
 		return body, err
 	}
@@ -422,72 +791,233 @@ func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if err := compareUserFsConfig(expected, actual); err != nil {
 		return err
 	}
+	if err := compareUserVirtualFolders(expected, actual); err != nil {
+		return err
+	}
 
 	return compareEqualsUserFields(expected, actual)
 }
 
+func checkFolder(expected *dataprovider.BaseVirtualFolder, actual *dataprovider.BaseVirtualFolder) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual folder ID must be > 0")
+		}
+	} else {
+		if actual.ID != expected.ID {
+			return errors.New("folder ID mismatch")
+		}
+	}
+	if expected.Name != actual.Name {
+		return errors.New("folder name mismatch")
+	}
+	if (expected.FsConfig.Provider == 0 || expected.FsConfig.Provider == 6) && expected.GetMappedPath() != actual.MappedPath {
+		return errors.New("mapped path mismatch")
+	}
+	return compareFsConfig(&expected.FsConfig, &actual.FsConfig)
+}
+
+func compareUserVirtualFolders(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.VirtualFolders) != len(actual.VirtualFolders) {
+		return errors.New("Virtual folders mismatch")
+	}
+	for _, v := range actual.VirtualFolders {
+		found := false
+		for _, v1 := range expected.VirtualFolders {
+			if path.Clean(v.VirtualPath) == path.Clean(v1.VirtualPath) && v.Name == v1.Name {
+				if v.QuotaSize != v1.QuotaSize || v.QuotaFiles != v1.QuotaFiles {
+					return errors.New("Virtual folder quota mismatch")
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Virtual folders mismatch")
+		}
+	}
+	return nil
+}
+
 func compareUserFsConfig(expected *dataprovider.User, actual *dataprovider.User) error {
-	if expected.FsConfig.Provider != actual.FsConfig.Provider {
+	return compareFsConfig(&expected.FsConfig, &actual.FsConfig)
+}
+
+func compareFsConfig(expected *dataprovider.Filesystem, actual *dataprovider.Filesystem) error {
+	if expected.Provider != actual.Provider {
 		return errors.New("Fs provider mismatch")
 	}
-	if expected.FsConfig.S3Config.Bucket != actual.FsConfig.S3Config.Bucket {
+	if err := compareS3Config(expected, actual); err != nil {
+		return err
+	}
+	if expected.GCSConfig.Bucket != actual.GCSConfig.Bucket {
+		return errors.New("GCS bucket mismatch")
+	}
+	if expected.GCSConfig.AutomaticCredentials != actual.GCSConfig.AutomaticCredentials {
+		return errors.New("GCS automatic credentials mismatch")
+	}
+	if expected.GCSConfig.StorageClass != actual.GCSConfig.StorageClass {
+		return errors.New("GCS storage class mismatch")
+	}
+	if expected.GCSConfig.KeyPrefix != actual.GCSConfig.KeyPrefix &&
+		expected.GCSConfig.KeyPrefix+"/" != actual.GCSConfig.KeyPrefix {
+		return errors.New("GCS key prefix mismatch")
+	}
+	if err := compareAzBlobConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareSFTPConfig(expected, actual); err != nil {
+		return err
+	}
+	if expected.MemConfig.MaxSize != actual.MemConfig.MaxSize {
+		return errors.New("memory filesystem max size mismatch")
+	}
+	if expected.MemConfig.ClearOnLogout != actual.MemConfig.ClearOnLogout {
+		return errors.New("memory filesystem clear on logout mismatch")
+	}
+	if expected.Provider == 6 && filepath.Clean(expected.DedupConfig.StorePath) != actual.DedupConfig.StorePath {
+		return errors.New("deduplicating filesystem store path mismatch")
+	}
+	return checkEncryptedSecret("passphrase", expected.CryptConfig.Passphrase,
+		actual.CryptConfig.Passphrase)
+}
+
+func compareS3Config(expected *dataprovider.Filesystem, actual *dataprovider.Filesystem) error {
+	if expected.S3Config.Bucket != actual.S3Config.Bucket {
 		return errors.New("S3 bucket mismatch")
 	}
-	if expected.FsConfig.S3Config.Region != actual.FsConfig.S3Config.Region {
+	if expected.S3Config.Region != actual.S3Config.Region {
 		return errors.New("S3 region mismatch")
 	}
-	if expected.FsConfig.S3Config.AccessKey != actual.FsConfig.S3Config.AccessKey {
+	if expected.S3Config.AccessKey != actual.S3Config.AccessKey {
 		return errors.New("S3 access key mismatch")
 	}
-	if err := checkS3AccessSecret(expected.FsConfig.S3Config.AccessSecret, actual.FsConfig.S3Config.AccessSecret); err != nil {
+	if err := checkEncryptedSecret("S3 access secret", expected.S3Config.AccessSecret,
+		actual.S3Config.AccessSecret); err != nil {
 		return err
 	}
-	if expected.FsConfig.S3Config.Endpoint != actual.FsConfig.S3Config.Endpoint {
+	if expected.S3Config.RoleARN != actual.S3Config.RoleARN {
+		return errors.New("S3 role ARN mismatch")
+	}
+	if expected.S3Config.ExternalID != actual.S3Config.ExternalID {
+		return errors.New("S3 external ID mismatch")
+	}
+	if expected.S3Config.Endpoint != actual.S3Config.Endpoint {
 		return errors.New("S3 endpoint mismatch")
 	}
-	if expected.FsConfig.S3Config.StorageClass != actual.FsConfig.S3Config.StorageClass {
+	if expected.S3Config.StorageClass != actual.S3Config.StorageClass {
 		return errors.New("S3 storage class mismatch")
 	}
-	if expected.FsConfig.S3Config.KeyPrefix != actual.FsConfig.S3Config.KeyPrefix &&
-		expected.FsConfig.S3Config.KeyPrefix+"/" != actual.FsConfig.S3Config.KeyPrefix {
+	if expected.S3Config.UploadPartSize != actual.S3Config.UploadPartSize {
+		return errors.New("S3 upload part size mismatch")
+	}
+	if expected.S3Config.KeyPrefix != actual.S3Config.KeyPrefix &&
+		expected.S3Config.KeyPrefix+"/" != actual.S3Config.KeyPrefix {
 		return errors.New("S3 key prefix mismatch")
 	}
-	if expected.FsConfig.GCSConfig.Bucket != actual.FsConfig.GCSConfig.Bucket {
-		return errors.New("GCS bucket mismatch")
+	if expected.S3Config.ServerSideEncryption != actual.S3Config.ServerSideEncryption {
+		return errors.New("S3 server side encryption mismatch")
 	}
-	if expected.FsConfig.GCSConfig.StorageClass != actual.FsConfig.GCSConfig.StorageClass {
-		return errors.New("GCS storage class mismatch")
+	if expected.S3Config.SSEKMSKeyID != actual.S3Config.SSEKMSKeyID {
+		return errors.New("S3 SSE KMS key ID mismatch")
 	}
-	if expected.FsConfig.GCSConfig.KeyPrefix != actual.FsConfig.GCSConfig.KeyPrefix &&
-		expected.FsConfig.GCSConfig.KeyPrefix+"/" != actual.FsConfig.GCSConfig.KeyPrefix {
-		return errors.New("GCS key prefix mismatch")
+	if expected.S3Config.ObjectLockMode != actual.S3Config.ObjectLockMode {
+		return errors.New("S3 object lock mode mismatch")
+	}
+	return checkEncryptedSecret("S3 SSE customer key", expected.S3Config.SSECustomerKey,
+		actual.S3Config.SSECustomerKey)
+}
+
+func compareAzBlobConfig(expected *dataprovider.Filesystem, actual *dataprovider.Filesystem) error {
+	if expected.AzBlobConfig.Container != actual.AzBlobConfig.Container {
+		return errors.New("Azure Blob container mismatch")
+	}
+	if expected.AzBlobConfig.AccountName != actual.AzBlobConfig.AccountName {
+		return errors.New("Azure Blob account name mismatch")
+	}
+	if err := checkEncryptedSecret("Azure Blob account key", expected.AzBlobConfig.AccountKey,
+		actual.AzBlobConfig.AccountKey); err != nil {
+		return err
+	}
+	if err := checkEncryptedSecret("Azure Blob SAS URL", expected.AzBlobConfig.SASURL,
+		actual.AzBlobConfig.SASURL); err != nil {
+		return err
+	}
+	if expected.AzBlobConfig.Endpoint != actual.AzBlobConfig.Endpoint {
+		return errors.New("Azure Blob endpoint mismatch")
+	}
+	if expected.AzBlobConfig.KeyPrefix != actual.AzBlobConfig.KeyPrefix &&
+		expected.AzBlobConfig.KeyPrefix+"/" != actual.AzBlobConfig.KeyPrefix {
+		return errors.New("Azure Blob key prefix mismatch")
+	}
+	if expected.AzBlobConfig.UploadPartSize != actual.AzBlobConfig.UploadPartSize {
+		return errors.New("Azure Blob upload part size mismatch")
+	}
+	if expected.AzBlobConfig.UploadConcurrency != actual.AzBlobConfig.UploadConcurrency {
+		return errors.New("Azure Blob upload concurrency mismatch")
+	}
+	if expected.AzBlobConfig.UseEmulator != actual.AzBlobConfig.UseEmulator {
+		return errors.New("Azure Blob use emulator mismatch")
+	}
+	if expected.AzBlobConfig.AccessTier != actual.AzBlobConfig.AccessTier {
+		return errors.New("Azure Blob access tier mismatch")
 	}
 	return nil
 }
 
-func checkS3AccessSecret(expectedAccessSecret, actualAccessSecret string) error {
-	if len(expectedAccessSecret) > 0 {
-		vals := strings.Split(expectedAccessSecret, "$")
-		if strings.HasPrefix(expectedAccessSecret, "$aes$") && len(vals) == 4 {
-			expectedAccessSecret = utils.RemoveDecryptionKey(expectedAccessSecret)
-			if expectedAccessSecret != actualAccessSecret {
-				return fmt.Errorf("S3 access secret mismatch, expected: %v", expectedAccessSecret)
+func compareSFTPConfig(expected *dataprovider.Filesystem, actual *dataprovider.Filesystem) error {
+	if expected.SFTPConfig.Endpoint != actual.SFTPConfig.Endpoint {
+		return errors.New("SFTP endpoint mismatch")
+	}
+	if expected.SFTPConfig.Username != actual.SFTPConfig.Username {
+		return errors.New("SFTP username mismatch")
+	}
+	if err := checkEncryptedSecret("SFTP password", expected.SFTPConfig.Password,
+		actual.SFTPConfig.Password); err != nil {
+		return err
+	}
+	if err := checkEncryptedSecret("SFTP private key", expected.SFTPConfig.PrivateKey,
+		actual.SFTPConfig.PrivateKey); err != nil {
+		return err
+	}
+	if len(expected.SFTPConfig.Fingerprints) != len(actual.SFTPConfig.Fingerprints) {
+		return errors.New("SFTP fingerprints mismatch")
+	}
+	for _, value := range expected.SFTPConfig.Fingerprints {
+		if !utils.IsStringInSlice(value, actual.SFTPConfig.Fingerprints) {
+			return errors.New("SFTP fingerprints contents mismatch")
+		}
+	}
+	if expected.SFTPConfig.Prefix != actual.SFTPConfig.Prefix &&
+		(len(expected.SFTPConfig.Prefix) > 0 || actual.SFTPConfig.Prefix != "/") {
+		return errors.New("SFTP prefix mismatch")
+	}
+	return nil
+}
+
+func checkEncryptedSecret(secretName, expectedSecret, actualSecret string) error {
+	if len(expectedSecret) > 0 {
+		vals := strings.Split(expectedSecret, "$")
+		if secrets.IsEncrypted(expectedSecret) {
+			expectedSecret = secrets.Mask(expectedSecret)
+			if expectedSecret != actualSecret {
+				return fmt.Errorf("%v mismatch, expected: %v", secretName, expectedSecret)
 			}
-		} else {
-			// here we check that actualAccessSecret is aes encrypted without the nonce
-			parts := strings.Split(actualAccessSecret, "$")
-			if !strings.HasPrefix(actualAccessSecret, "$aes$") || len(parts) != 3 {
-				return errors.New("Invalid S3 access secret")
+		} else if !secrets.IsEncrypted(actualSecret) {
+			// here we check that actualSecret is aes encrypted without the nonce
+			parts := strings.Split(actualSecret, "$")
+			if !strings.HasPrefix(actualSecret, "$aes$") || len(parts) != 3 {
+				return fmt.Errorf("Invalid %v", secretName)
 			}
 			if len(parts) == len(vals) {
-				if expectedAccessSecret != actualAccessSecret {
-					return errors.New("S3 encrypted access secret mismatch")
+				if expectedSecret != actualSecret {
+					return fmt.Errorf("encrypted %v mismatch", secretName)
 				}
 			}
 		}
 	} else {
-		if expectedAccessSecret != actualAccessSecret {
-			return errors.New("S3 access secret mismatch")
+		if expectedSecret != actualSecret {
+			return fmt.Errorf("%v mismatch", secretName)
 		}
 	}
 	return nil
@@ -510,9 +1040,155 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 			return errors.New("DeniedIP contents mismatch")
 		}
 	}
+	if expected.Filters.Trash != actual.Filters.Trash {
+		return errors.New("Trash mismatch")
+	}
+	if err := compareReplicationConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareTieringConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareRetentionPolicies(expected, actual); err != nil {
+		return err
+	}
+	if err := compareDirQuotas(expected, actual); err != nil {
+		return err
+	}
+	if err := compareFilePatterns(expected, actual); err != nil {
+		return err
+	}
+	if expected.Filters.TransferQuota != actual.Filters.TransferQuota {
+		return errors.New("Transfer quota mismatch")
+	}
+	if expected.Filters.MaxUploadFileSize != actual.Filters.MaxUploadFileSize {
+		return errors.New("Max upload file size mismatch")
+	}
 	return nil
 }
 
+func compareReplicationConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.Filters.Replication.Enabled != actual.Filters.Replication.Enabled {
+		return errors.New("Replication enabled mismatch")
+	}
+	if !expected.Filters.Replication.Enabled {
+		return nil
+	}
+	if expected.Filters.Replication.FsConfig.Provider == 0 || expected.Filters.Replication.FsConfig.Provider == 6 {
+		if filepath.Clean(expected.Filters.Replication.LocalPath) != actual.Filters.Replication.LocalPath {
+			return errors.New("Replication local path mismatch")
+		}
+	}
+	if err := compareFsConfig(&expected.Filters.Replication.FsConfig, &actual.Filters.Replication.FsConfig); err != nil {
+		return fmt.Errorf("Replication %v", err)
+	}
+	return nil
+}
+
+func compareTieringConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.Filters.Tiering.Enabled != actual.Filters.Tiering.Enabled {
+		return errors.New("Tiering enabled mismatch")
+	}
+	if !expected.Filters.Tiering.Enabled {
+		return nil
+	}
+	if expected.Filters.Tiering.Days != actual.Filters.Tiering.Days {
+		return errors.New("Tiering days mismatch")
+	}
+	if expected.Filters.Tiering.RecallOnAccess != actual.Filters.Tiering.RecallOnAccess {
+		return errors.New("Tiering recall on access mismatch")
+	}
+	if expected.Filters.Tiering.FsConfig.Provider == 0 || expected.Filters.Tiering.FsConfig.Provider == 6 {
+		if filepath.Clean(expected.Filters.Tiering.LocalPath) != actual.Filters.Tiering.LocalPath {
+			return errors.New("Tiering local path mismatch")
+		}
+	}
+	if err := compareFsConfig(&expected.Filters.Tiering.FsConfig, &actual.Filters.Tiering.FsConfig); err != nil {
+		return fmt.Errorf("Tiering %v", err)
+	}
+	return nil
+}
+
+func compareRetentionPolicies(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.RetentionPolicies) != len(actual.Filters.RetentionPolicies) {
+		return errors.New("Retention policies mismatch")
+	}
+	for _, policy := range expected.Filters.RetentionPolicies {
+		found := false
+		for _, p := range actual.Filters.RetentionPolicies {
+			if path.Clean(policy.Path) == p.Path && policy.Days == p.Days {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Retention policies contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareDirQuotas(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.DirQuotas) != len(actual.Filters.DirQuotas) {
+		return errors.New("Directory quotas mismatch")
+	}
+	for _, quota := range expected.Filters.DirQuotas {
+		found := false
+		for _, q := range actual.Filters.DirQuotas {
+			if path.Clean(quota.Path) == q.Path && quota.QuotaSize == q.QuotaSize && quota.QuotaFiles == q.QuotaFiles {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Directory quotas contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareFilePatterns(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.FilePatterns) != len(actual.Filters.FilePatterns) {
+		return errors.New("File patterns mismatch")
+	}
+	for _, filter := range expected.Filters.FilePatterns {
+		found := false
+		for _, f := range actual.Filters.FilePatterns {
+			if path.Clean(filter.Path) == f.Path {
+				if !comparePatterns(filter.AllowedPatterns, f.AllowedPatterns) ||
+					!comparePatterns(filter.DeniedPatterns, f.DeniedPatterns) {
+					return fmt.Errorf("File patterns contents mismatch for path %#v", f.Path)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("File patterns contents mismatch")
+		}
+	}
+	return nil
+}
+
+func comparePatterns(expected, actual []string) bool {
+	var cleaned []string
+	for _, p := range expected {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" && !utils.IsStringInSlice(p, cleaned) {
+			cleaned = append(cleaned, p)
+		}
+	}
+	if len(cleaned) != len(actual) {
+		return false
+	}
+	for _, p := range cleaned {
+		if !utils.IsStringInSlice(p, actual) {
+			return false
+		}
+	}
+	return true
+}
+
 func compareEqualsUserFields(expected *dataprovider.User, actual *dataprovider.User) error {
 	if expected.Username != actual.Username {
 		return errors.New("Username mismatch")
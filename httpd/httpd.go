@@ -23,15 +23,21 @@ const (
 	apiPrefix             = "/api/v1"
 	activeConnectionsPath = "/api/v1/connection"
 	quotaScanPath         = "/api/v1/quota_scan"
+	folderQuotaScanPath   = "/api/v1/folder_quota_scan"
 	userPath              = "/api/v1/user"
+	folderPath            = "/api/v1/folder"
 	versionPath           = "/api/v1/version"
 	providerStatusPath    = "/api/v1/providerstatus"
 	dumpDataPath          = "/api/v1/dumpdata"
 	loadDataPath          = "/api/v1/loaddata"
+	replicationPath       = "/api/v1/replication"
+	tieringPath           = "/api/v1/tiering"
 	metricsPath           = "/metrics"
 	webBasePath           = "/web"
 	webUsersPath          = "/web/users"
 	webUserPath           = "/web/user"
+	webFoldersPath        = "/web/folders"
+	webFolderPath         = "/web/folder"
 	webConnectionsPath    = "/web/connections"
 	webStaticFilesPath    = "/static"
 	maxRestoreSize        = 10485760 // 10 MB
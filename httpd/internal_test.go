@@ -266,8 +266,31 @@ func TestCompareUserFsConfig(t *testing.T) {
 	if err == nil {
 		t.Errorf("S3 access secret does not match")
 	}
+	expected.FsConfig.S3Config.AccessSecret = "$enc$local$0123456789abcdef$aabbcc"
+	actual.FsConfig.S3Config.AccessSecret = "$enc$local$0123456789abcdef$aabbccdd"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 access secret does not match")
+	}
+	expected.FsConfig.S3Config.AccessSecret = "test"
+	err = compareUserFsConfig(expected, actual)
+	if err != nil {
+		t.Errorf("S3 access secret encrypted using the master key must match: %v", err)
+	}
 	expected.FsConfig.S3Config.AccessSecret = ""
 	actual.FsConfig.S3Config.AccessSecret = ""
+	expected.FsConfig.S3Config.RoleARN = "arn:aws:iam::123456789012:role/sftpgo"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 role ARN does not match")
+	}
+	expected.FsConfig.S3Config.RoleARN = ""
+	expected.FsConfig.S3Config.ExternalID = "external id"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 external ID does not match")
+	}
+	expected.FsConfig.S3Config.ExternalID = ""
 	expected.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000/"
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
@@ -286,6 +309,24 @@ func TestCompareUserFsConfig(t *testing.T) {
 		t.Errorf("S3 key prefix does not match")
 	}
 	expected.FsConfig.S3Config.KeyPrefix = ""
+	expected.FsConfig.S3Config.ServerSideEncryption = "AES256"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 server side encryption does not match")
+	}
+	expected.FsConfig.S3Config.ServerSideEncryption = ""
+	expected.FsConfig.S3Config.SSEKMSKeyID = "key id"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 SSE KMS key ID does not match")
+	}
+	expected.FsConfig.S3Config.SSEKMSKeyID = ""
+	actual.FsConfig.S3Config.SSECustomerKey = "customer key"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 SSE customer key does not match")
+	}
+	actual.FsConfig.S3Config.SSECustomerKey = ""
 	expected.FsConfig.GCSConfig.KeyPrefix = "somedir/subdir"
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
@@ -298,12 +339,131 @@ func TestCompareUserFsConfig(t *testing.T) {
 		t.Errorf("GCS bucket does not match")
 	}
 	expected.FsConfig.GCSConfig.Bucket = ""
+	expected.FsConfig.GCSConfig.AutomaticCredentials = true
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("GCS automatic credentials does not match")
+	}
+	expected.FsConfig.GCSConfig.AutomaticCredentials = false
 	expected.FsConfig.GCSConfig.StorageClass = "Standard"
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
 		t.Errorf("GCS storage class does not match")
 	}
 	expected.FsConfig.GCSConfig.StorageClass = ""
+	expected.FsConfig.AzBlobConfig.Container = "container"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob container does not match")
+	}
+	expected.FsConfig.AzBlobConfig.Container = ""
+	expected.FsConfig.AzBlobConfig.AccountName = "name"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob account name does not match")
+	}
+	expected.FsConfig.AzBlobConfig.AccountName = ""
+	expected.FsConfig.AzBlobConfig.AccountKey = "key"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob account key does not match")
+	}
+	expected.FsConfig.AzBlobConfig.AccountKey = ""
+	actual.FsConfig.AzBlobConfig.SASURL = "http://127.0.0.1/"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob SAS URL does not match")
+	}
+	actual.FsConfig.AzBlobConfig.SASURL = ""
+	expected.FsConfig.AzBlobConfig.Endpoint = "http://127.0.0.1:10000"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob endpoint does not match")
+	}
+	expected.FsConfig.AzBlobConfig.Endpoint = ""
+	expected.FsConfig.AzBlobConfig.KeyPrefix = "somedir/subdir"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob key prefix does not match")
+	}
+	expected.FsConfig.AzBlobConfig.KeyPrefix = ""
+	expected.FsConfig.AzBlobConfig.UploadPartSize = 10
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob upload part size does not match")
+	}
+	expected.FsConfig.AzBlobConfig.UploadPartSize = 0
+	expected.FsConfig.AzBlobConfig.UploadConcurrency = 3
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob upload concurrency does not match")
+	}
+	expected.FsConfig.AzBlobConfig.UploadConcurrency = 0
+	expected.FsConfig.AzBlobConfig.UseEmulator = true
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob use emulator does not match")
+	}
+	expected.FsConfig.AzBlobConfig.UseEmulator = false
+	expected.FsConfig.AzBlobConfig.AccessTier = "Hot"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob access tier does not match")
+	}
+	expected.FsConfig.AzBlobConfig.AccessTier = ""
+	expected.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:2022"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP endpoint does not match")
+	}
+	expected.FsConfig.SFTPConfig.Endpoint = ""
+	expected.FsConfig.SFTPConfig.Username = "user"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP username does not match")
+	}
+	expected.FsConfig.SFTPConfig.Username = ""
+	expected.FsConfig.SFTPConfig.Password = "password"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP password does not match")
+	}
+	expected.FsConfig.SFTPConfig.Password = ""
+	expected.FsConfig.SFTPConfig.PrivateKey = "key"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP private key does not match")
+	}
+	expected.FsConfig.SFTPConfig.PrivateKey = ""
+	expected.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:fp"}
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP fingerprints do not match")
+	}
+	actual.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:fp1"}
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP fingerprints do not match")
+	}
+	expected.FsConfig.SFTPConfig.Fingerprints = nil
+	actual.FsConfig.SFTPConfig.Fingerprints = nil
+	actual.FsConfig.SFTPConfig.Prefix = "/"
+	err = compareUserFsConfig(expected, actual)
+	if err != nil {
+		t.Errorf("empty SFTP prefix must match the root prefix: %v", err)
+	}
+	expected.FsConfig.SFTPConfig.Prefix = "/remote"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTP prefix does not match")
+	}
+	expected.FsConfig.SFTPConfig.Prefix = ""
+	expected.FsConfig.CryptConfig.Passphrase = "passphrase"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("passphrase does not match")
+	}
+	expected.FsConfig.CryptConfig.Passphrase = ""
 }
 
 func TestGCSWebInvalidFormFile(t *testing.T) {
@@ -520,7 +680,7 @@ func TestQuotaScanInvalidFs(t *testing.T) {
 		},
 	}
 	sftpd.AddQuotaScan(user.Username)
-	err := doQuotaScan(user)
+	err := doQuotaScan(user, false)
 	if err == nil {
 		t.Error("quota scan with bad fs must fail")
 	}
@@ -71,10 +71,34 @@ func initializeRouter(staticFilesPath string) {
 			getQuotaScans(w, r)
 		})
 
+		router.Get(replicationPath, func(w http.ResponseWriter, r *http.Request) {
+			render.JSON(w, r, sftpd.GetReplicationStatus())
+		})
+
+		router.Get(tieringPath, func(w http.ResponseWriter, r *http.Request) {
+			getTieringStatus(w, r)
+		})
+
 		router.Post(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
 			startQuotaScan(w, r)
 		})
 
+		router.Delete(quotaScanPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+			cancelQuotaScan(w, r)
+		})
+
+		router.Get(folderQuotaScanPath, func(w http.ResponseWriter, r *http.Request) {
+			getFoldersQuotaScans(w, r)
+		})
+
+		router.Post(folderQuotaScanPath, func(w http.ResponseWriter, r *http.Request) {
+			startFolderQuotaScan(w, r)
+		})
+
+		router.Delete(folderQuotaScanPath+"/{folderName}", func(w http.ResponseWriter, r *http.Request) {
+			cancelFolderQuotaScan(w, r)
+		})
+
 		router.Get(userPath, func(w http.ResponseWriter, r *http.Request) {
 			getUsers(w, r)
 		})
@@ -95,6 +119,58 @@ func initializeRouter(staticFilesPath string) {
 			deleteUser(w, r)
 		})
 
+		router.Get(userPath+"/{userID}/directory_quotas", func(w http.ResponseWriter, r *http.Request) {
+			getDirQuotasUsage(w, r)
+		})
+
+		router.Get(userPath+"/{userID}/transfer_quota", func(w http.ResponseWriter, r *http.Request) {
+			getTransferQuotaUsage(w, r)
+		})
+
+		router.Delete(userPath+"/{userID}/transfer_quota", func(w http.ResponseWriter, r *http.Request) {
+			resetTransferQuota(w, r)
+		})
+
+		router.Get(userPath+"/{userID}/retention", func(w http.ResponseWriter, r *http.Request) {
+			getRetentionStatus(w, r)
+		})
+
+		router.Get(userPath+"/{userID}/trash", func(w http.ResponseWriter, r *http.Request) {
+			getTrashEntries(w, r)
+		})
+
+		router.Delete(userPath+"/{userID}/trash", func(w http.ResponseWriter, r *http.Request) {
+			purgeTrash(w, r)
+		})
+
+		router.Post(userPath+"/{userID}/trash/{entryID}/restore", func(w http.ResponseWriter, r *http.Request) {
+			restoreTrashEntry(w, r)
+		})
+
+		router.Delete(userPath+"/{userID}/trash/{entryID}", func(w http.ResponseWriter, r *http.Request) {
+			purgeTrashEntry(w, r)
+		})
+
+		router.Get(folderPath, func(w http.ResponseWriter, r *http.Request) {
+			getFolders(w, r)
+		})
+
+		router.Post(folderPath, func(w http.ResponseWriter, r *http.Request) {
+			addFolder(w, r)
+		})
+
+		router.Get(folderPath+"/{folderID}", func(w http.ResponseWriter, r *http.Request) {
+			getFolderByID(w, r)
+		})
+
+		router.Put(folderPath+"/{folderID}", func(w http.ResponseWriter, r *http.Request) {
+			updateFolder(w, r)
+		})
+
+		router.Delete(folderPath+"/{folderID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteFolder(w, r)
+		})
+
 		router.Get(dumpDataPath, func(w http.ResponseWriter, r *http.Request) {
 			dumpData(w, r)
 		})
@@ -123,6 +199,18 @@ func initializeRouter(staticFilesPath string) {
 			handleWebUpdateUserPost(chi.URLParam(r, "userID"), w, r)
 		})
 
+		router.Get(webFoldersPath, func(w http.ResponseWriter, r *http.Request) {
+			handleGetWebFolders(w, r)
+		})
+
+		router.Get(webFolderPath, func(w http.ResponseWriter, r *http.Request) {
+			handleWebAddFolderGet(w, r)
+		})
+
+		router.Post(webFolderPath, func(w http.ResponseWriter, r *http.Request) {
+			handleWebAddFolderPost(w, r)
+		})
+
 		router.Get(webConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
 			handleWebGetConnections(w, r)
 		})
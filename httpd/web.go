@@ -15,15 +15,19 @@ import (
 	"github.com/freshvolk/sftpgo/dataprovider"
 	"github.com/freshvolk/sftpgo/sftpd"
 	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
 )
 
 const (
 	templateBase           = "base.html"
 	templateUsers          = "users.html"
 	templateUser           = "user.html"
+	templateFolders        = "folders.html"
+	templateFolder         = "folder.html"
 	templateConnections    = "connections.html"
 	templateMessage        = "message.html"
 	pageUsersTitle         = "Users"
+	pageFoldersTitle       = "Folders"
 	pageConnectionsTitle   = "Connections"
 	page400Title           = "Bad request"
 	page404Title           = "Not found"
@@ -39,17 +43,22 @@ var (
 )
 
 type basePage struct {
-	Title             string
-	CurrentURL        string
-	UsersURL          string
-	UserURL           string
-	APIUserURL        string
-	APIConnectionsURL string
-	APIQuotaScanURL   string
-	ConnectionsURL    string
-	UsersTitle        string
-	ConnectionsTitle  string
-	Version           string
+	Title                 string
+	CurrentURL            string
+	UsersURL              string
+	UserURL               string
+	APIUserURL            string
+	APIConnectionsURL     string
+	APIQuotaScanURL       string
+	ConnectionsURL        string
+	FoldersURL            string
+	FolderURL             string
+	APIFoldersURL         string
+	APIFolderQuotaScanURL string
+	UsersTitle            string
+	ConnectionsTitle      string
+	FoldersTitle          string
+	Version               string
 }
 
 type usersPage struct {
@@ -57,6 +66,17 @@ type usersPage struct {
 	Users []dataprovider.User
 }
 
+type foldersPage struct {
+	basePage
+	Folders []dataprovider.BaseVirtualFolder
+}
+
+type folderPage struct {
+	basePage
+	Folder dataprovider.BaseVirtualFolder
+	Error  string
+}
+
 type connectionsPage struct {
 	basePage
 	Connections []sftpd.ConnectionStatus
@@ -70,6 +90,10 @@ type userPage struct {
 	Error        string
 	ValidPerms   []string
 	RootDirPerms []string
+	// used quota for the directories with a quota restriction, available for existing users only
+	DirQuotasUsage []dataprovider.DirQuotaUsage
+	// data transferred in the current period, available for existing users with a transfer quota only
+	TransferQuotaUsage *dataprovider.TransferQuotaUsage
 }
 
 type messagePage struct {
@@ -87,6 +111,14 @@ func loadTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateBase),
 		filepath.Join(templatesPath, templateUser),
 	}
+	foldersPaths := []string{
+		filepath.Join(templatesPath, templateBase),
+		filepath.Join(templatesPath, templateFolders),
+	}
+	folderPaths := []string{
+		filepath.Join(templatesPath, templateBase),
+		filepath.Join(templatesPath, templateFolder),
+	}
 	connectionsPaths := []string{
 		filepath.Join(templatesPath, templateBase),
 		filepath.Join(templatesPath, templateConnections),
@@ -97,11 +129,15 @@ func loadTemplates(templatesPath string) {
 	}
 	usersTmpl := template.Must(template.ParseFiles(usersPaths...))
 	userTmpl := template.Must(template.ParseFiles(userPaths...))
+	foldersTmpl := template.Must(template.ParseFiles(foldersPaths...))
+	folderTmpl := template.Must(template.ParseFiles(folderPaths...))
 	connectionsTmpl := template.Must(template.ParseFiles(connectionsPaths...))
 	messageTmpl := template.Must(template.ParseFiles(messagePath...))
 
 	templates[templateUsers] = usersTmpl
 	templates[templateUser] = userTmpl
+	templates[templateFolders] = foldersTmpl
+	templates[templateFolder] = folderTmpl
 	templates[templateConnections] = connectionsTmpl
 	templates[templateMessage] = messageTmpl
 }
@@ -109,17 +145,22 @@ func loadTemplates(templatesPath string) {
 func getBasePageData(title, currentURL string) basePage {
 	version := utils.GetAppVersion()
 	return basePage{
-		Title:             title,
-		CurrentURL:        currentURL,
-		UsersURL:          webUsersPath,
-		UserURL:           webUserPath,
-		APIUserURL:        userPath,
-		APIConnectionsURL: activeConnectionsPath,
-		APIQuotaScanURL:   quotaScanPath,
-		ConnectionsURL:    webConnectionsPath,
-		UsersTitle:        pageUsersTitle,
-		ConnectionsTitle:  pageConnectionsTitle,
-		Version:           version.GetVersionAsString(),
+		Title:                 title,
+		CurrentURL:            currentURL,
+		UsersURL:              webUsersPath,
+		UserURL:               webUserPath,
+		APIUserURL:            userPath,
+		APIConnectionsURL:     activeConnectionsPath,
+		APIQuotaScanURL:       quotaScanPath,
+		ConnectionsURL:        webConnectionsPath,
+		FoldersURL:            webFoldersPath,
+		FolderURL:             webFolderPath,
+		APIFoldersURL:         folderPath,
+		APIFolderQuotaScanURL: folderQuotaScanPath,
+		UsersTitle:            pageUsersTitle,
+		ConnectionsTitle:      pageConnectionsTitle,
+		FoldersTitle:          pageFoldersTitle,
+		Version:               version.GetVersionAsString(),
 	}
 }
 
@@ -180,9 +221,59 @@ func renderUpdateUserPage(w http.ResponseWriter, user dataprovider.User, error s
 		ValidPerms:   dataprovider.ValidPerms,
 		RootDirPerms: user.GetPermissionsForPath("/"),
 	}
+	if usage, err := dataprovider.GetDirQuotasUsage(dataProvider, user); err == nil {
+		data.DirQuotasUsage = usage
+	}
+	if user.Filters.TransferQuota.IsEnabled() {
+		if usage, err := dataprovider.GetTransferQuotaUsage(dataProvider, user); err == nil {
+			data.TransferQuotaUsage = &usage
+		}
+	}
 	renderTemplate(w, templateUser, data)
 }
 
+func renderAddFolderPage(w http.ResponseWriter, folder dataprovider.BaseVirtualFolder, error string) {
+	data := folderPage{
+		basePage: getBasePageData("Add a new folder", webFolderPath),
+		Error:    error,
+		Folder:   folder,
+	}
+	renderTemplate(w, templateFolder, data)
+}
+
+func getVirtualFoldersFromPostFields(r *http.Request) ([]dataprovider.VirtualFolder, error) {
+	var virtualFolders []dataprovider.VirtualFolder
+	for _, cleaned := range getSliceFromDelimitedValues(r.Form.Get("virtual_folders"), "\n") {
+		if !strings.Contains(cleaned, "::") {
+			continue
+		}
+		mapping := strings.Split(cleaned, "::")
+		if len(mapping) < 2 {
+			continue
+		}
+		vfolder := dataprovider.VirtualFolder{
+			VirtualPath: strings.TrimSpace(mapping[0]),
+		}
+		vfolder.Name = strings.TrimSpace(mapping[1])
+		if len(mapping) > 2 {
+			quotaSize, err := strconv.ParseInt(strings.TrimSpace(mapping[2]), 10, 64)
+			if err != nil {
+				return virtualFolders, fmt.Errorf("invalid quota size for virtual folder %#v: %v", vfolder.Name, err)
+			}
+			vfolder.QuotaSize = quotaSize
+		}
+		if len(mapping) > 3 {
+			quotaFiles, err := strconv.Atoi(strings.TrimSpace(mapping[3]))
+			if err != nil {
+				return virtualFolders, fmt.Errorf("invalid quota files for virtual folder %#v: %v", vfolder.Name, err)
+			}
+			vfolder.QuotaFiles = quotaFiles
+		}
+		virtualFolders = append(virtualFolders, vfolder)
+	}
+	return virtualFolders, nil
+}
+
 func getUserPermissionsFromPostFields(r *http.Request) map[string][]string {
 	permissions := make(map[string][]string)
 	permissions["/"] = r.Form["permissions"]
@@ -220,11 +311,135 @@ func getSliceFromDelimitedValues(values, delimiter string) []string {
 	return result
 }
 
-func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
+func getFiltersFromUserPostFields(r *http.Request) (dataprovider.UserFilters, error) {
 	var filters dataprovider.UserFilters
 	filters.AllowedIP = getSliceFromDelimitedValues(r.Form.Get("allowed_ip"), ",")
 	filters.DeniedIP = getSliceFromDelimitedValues(r.Form.Get("denied_ip"), ",")
-	return filters
+	filters.Trash.Enabled = len(r.Form.Get("trash_enabled")) > 0
+	filters.Trash.CountInQuota = len(r.Form.Get("trash_count_in_quota")) > 0
+	if retentionDays := r.Form.Get("trash_retention_days"); len(retentionDays) > 0 {
+		days, err := strconv.Atoi(retentionDays)
+		if err != nil {
+			return filters, err
+		}
+		filters.Trash.RetentionDays = days
+	}
+	retentionPolicies, err := getRetentionPoliciesFromPostFields(r)
+	if err != nil {
+		return filters, err
+	}
+	filters.RetentionPolicies = retentionPolicies
+	dirQuotas, err := getDirQuotasFromPostFields(r)
+	if err != nil {
+		return filters, err
+	}
+	filters.DirQuotas = dirQuotas
+	filePatterns, err := getFilePatternsFromPostFields(r)
+	if err != nil {
+		return filters, err
+	}
+	filters.FilePatterns = filePatterns
+	if maxFileSize := r.Form.Get("max_upload_file_size"); len(maxFileSize) > 0 {
+		size, err := strconv.ParseInt(maxFileSize, 10, 64)
+		if err != nil {
+			return filters, err
+		}
+		filters.MaxUploadFileSize = size
+	}
+	filters.TransferQuota.Period = r.Form.Get("transfer_quota_period")
+	if uploadSize := r.Form.Get("transfer_quota_upload_size"); len(uploadSize) > 0 {
+		size, err := strconv.ParseInt(uploadSize, 10, 64)
+		if err != nil {
+			return filters, err
+		}
+		filters.TransferQuota.UploadSize = size
+	}
+	if downloadSize := r.Form.Get("transfer_quota_download_size"); len(downloadSize) > 0 {
+		size, err := strconv.ParseInt(downloadSize, 10, 64)
+		if err != nil {
+			return filters, err
+		}
+		filters.TransferQuota.DownloadSize = size
+	}
+	return filters, nil
+}
+
+func getDirQuotasFromPostFields(r *http.Request) ([]dataprovider.DirQuota, error) {
+	var quotas []dataprovider.DirQuota
+	for _, cleaned := range getSliceFromDelimitedValues(r.Form.Get("directory_quotas"), "\n") {
+		fields := strings.Split(cleaned, "::")
+		if len(fields) != 3 {
+			return quotas, fmt.Errorf("invalid directory quota %#v, it must be formatted as dir::quota_size::quota_files",
+				cleaned)
+		}
+		quota := dataprovider.DirQuota{
+			Path: strings.TrimSpace(fields[0]),
+		}
+		quotaSize, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			return quotas, fmt.Errorf("invalid quota size for directory %#v: %v", quota.Path, err)
+		}
+		quota.QuotaSize = quotaSize
+		quotaFiles, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return quotas, fmt.Errorf("invalid quota files for directory %#v: %v", quota.Path, err)
+		}
+		quota.QuotaFiles = quotaFiles
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+func getFilePatternsFromPostFields(r *http.Request) ([]dataprovider.PatternsFilter, error) {
+	var filters []dataprovider.PatternsFilter
+	for _, field := range []string{"allowed_patterns", "denied_patterns"} {
+		for _, cleaned := range getSliceFromDelimitedValues(r.Form.Get(field), "\n") {
+			fields := strings.Split(cleaned, "::")
+			if len(fields) != 2 {
+				return filters, fmt.Errorf("invalid file patterns %#v, they must be formatted as dir::pattern1,pattern2",
+					cleaned)
+			}
+			dir := strings.TrimSpace(fields[0])
+			patterns := getSliceFromDelimitedValues(fields[1], ",")
+			idx := -1
+			for i, f := range filters {
+				if f.Path == dir {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				filters = append(filters, dataprovider.PatternsFilter{Path: dir})
+				idx = len(filters) - 1
+			}
+			if field == "allowed_patterns" {
+				filters[idx].AllowedPatterns = append(filters[idx].AllowedPatterns, patterns...)
+			} else {
+				filters[idx].DeniedPatterns = append(filters[idx].DeniedPatterns, patterns...)
+			}
+		}
+	}
+	return filters, nil
+}
+
+func getRetentionPoliciesFromPostFields(r *http.Request) ([]vfs.RetentionPolicy, error) {
+	var policies []vfs.RetentionPolicy
+	for _, cleaned := range getSliceFromDelimitedValues(r.Form.Get("retention_policies"), "\n") {
+		// the days are after the last colon, the directory name can contain colons
+		idx := strings.LastIndex(cleaned, ":")
+		if idx < 0 {
+			return policies, fmt.Errorf("invalid retention policy %#v, it must be formatted as dir:days", cleaned)
+		}
+		days, err := strconv.Atoi(strings.TrimSpace(cleaned[idx+1:]))
+		if err != nil {
+			return policies, fmt.Errorf("invalid retention days for policy %#v: %v", cleaned, err)
+		}
+		policies = append(policies, vfs.RetentionPolicy{
+			Path: strings.TrimSpace(cleaned[:idx]),
+			Days: days,
+		})
+	}
+	return policies, nil
 }
 
 func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, error) {
@@ -234,20 +449,32 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		provider = 0
 	}
 	fs.Provider = provider
+	fs.CryptConfig.Passphrase = r.Form.Get("crypt_passphrase")
 	if fs.Provider == 1 {
 		fs.S3Config.Bucket = r.Form.Get("s3_bucket")
 		fs.S3Config.Region = r.Form.Get("s3_region")
 		fs.S3Config.AccessKey = r.Form.Get("s3_access_key")
 		fs.S3Config.AccessSecret = r.Form.Get("s3_access_secret")
+		fs.S3Config.RoleARN = r.Form.Get("s3_role_arn")
+		fs.S3Config.ExternalID = r.Form.Get("s3_external_id")
 		fs.S3Config.Endpoint = r.Form.Get("s3_endpoint")
 		fs.S3Config.StorageClass = r.Form.Get("s3_storage_class")
+		fs.S3Config.UploadPartSize, err = strconv.ParseInt(r.Form.Get("s3_upload_part_size"), 10, 64)
+		if err != nil {
+			return fs, err
+		}
 		fs.S3Config.KeyPrefix = r.Form.Get("s3_key_prefix")
+		fs.S3Config.ServerSideEncryption = r.Form.Get("s3_server_side_encryption")
+		fs.S3Config.SSEKMSKeyID = r.Form.Get("s3_sse_kms_key_id")
+		fs.S3Config.SSECustomerKey = r.Form.Get("s3_sse_customer_key")
+		fs.S3Config.ObjectLockMode = r.Form.Get("s3_object_lock_mode")
 	} else if fs.Provider == 2 {
 		fs.GCSConfig.Bucket = r.Form.Get("gcs_bucket")
 		fs.GCSConfig.StorageClass = r.Form.Get("gcs_storage_class")
 		fs.GCSConfig.KeyPrefix = r.Form.Get("gcs_key_prefix")
+		fs.GCSConfig.AutomaticCredentials = len(r.Form.Get("gcs_auto_credentials")) > 0
 		credentials, _, err := r.FormFile("gcs_credential_file")
-		if err == http.ErrMissingFile {
+		if err == http.ErrMissingFile || fs.GCSConfig.AutomaticCredentials {
 			return fs, nil
 		}
 		if err != nil {
@@ -262,6 +489,38 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 			return fs, err
 		}
 		fs.GCSConfig.Credentials = base64.StdEncoding.EncodeToString(fileBytes)
+	} else if fs.Provider == 3 {
+		fs.AzBlobConfig.Container = r.Form.Get("az_container")
+		fs.AzBlobConfig.AccountName = r.Form.Get("az_account_name")
+		fs.AzBlobConfig.AccountKey = r.Form.Get("az_account_key")
+		fs.AzBlobConfig.SASURL = r.Form.Get("az_sas_url")
+		fs.AzBlobConfig.Endpoint = r.Form.Get("az_endpoint")
+		fs.AzBlobConfig.KeyPrefix = r.Form.Get("az_key_prefix")
+		fs.AzBlobConfig.AccessTier = r.Form.Get("az_access_tier")
+		fs.AzBlobConfig.UseEmulator = len(r.Form.Get("az_use_emulator")) > 0
+		fs.AzBlobConfig.UploadPartSize, err = strconv.ParseInt(r.Form.Get("az_upload_part_size"), 10, 64)
+		if err != nil {
+			return fs, err
+		}
+		fs.AzBlobConfig.UploadConcurrency, err = strconv.Atoi(r.Form.Get("az_upload_concurrency"))
+		if err != nil {
+			return fs, err
+		}
+	} else if fs.Provider == 4 {
+		fs.SFTPConfig.Endpoint = r.Form.Get("sftp_endpoint")
+		fs.SFTPConfig.Username = r.Form.Get("sftp_username")
+		fs.SFTPConfig.Password = r.Form.Get("sftp_password")
+		fs.SFTPConfig.PrivateKey = strings.TrimSpace(r.Form.Get("sftp_private_key"))
+		fs.SFTPConfig.Fingerprints = getSliceFromDelimitedValues(r.Form.Get("sftp_fingerprints"), "\n")
+		fs.SFTPConfig.Prefix = r.Form.Get("sftp_prefix")
+	} else if fs.Provider == 5 {
+		fs.MemConfig.ClearOnLogout = len(r.Form.Get("mem_clear_on_logout")) > 0
+		fs.MemConfig.MaxSize, err = strconv.ParseInt(r.Form.Get("mem_max_size"), 10, 64)
+		if err != nil {
+			return fs, err
+		}
+	} else if fs.Provider == 6 {
+		fs.DedupConfig.StorePath = r.Form.Get("dedup_store_path")
 	}
 	return fs, nil
 }
@@ -306,6 +565,10 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 	if err != nil {
 		return user, err
 	}
+	filters, err := getFiltersFromUserPostFields(r)
+	if err != nil {
+		return user, err
+	}
 	expirationDateMillis := int64(0)
 	expirationDateString := r.Form.Get("expiration_date")
 	if len(strings.TrimSpace(expirationDateString)) > 0 {
@@ -319,6 +582,10 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 	if err != nil {
 		return user, err
 	}
+	virtualFolders, err := getVirtualFoldersFromPostFields(r)
+	if err != nil {
+		return user, err
+	}
 	user = dataprovider.User{
 		Username:          r.Form.Get("username"),
 		Password:          r.Form.Get("password"),
@@ -334,8 +601,9 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 		DownloadBandwidth: bandwidthDL,
 		Status:            status,
 		ExpirationDate:    expirationDateMillis,
-		Filters:           getFiltersFromUserPostFields(r),
+		Filters:           filters,
 		FsConfig:          fsConfig,
+		VirtualFolders:    virtualFolders,
 	}
 	return user, err
 }
@@ -430,6 +698,9 @@ func handleWebUpdateUserPost(userID string, w http.ResponseWriter, r *http.Reque
 	if len(updatedUser.Password) == 0 {
 		updatedUser.Password = user.Password
 	}
+	// the replication and the tiering cannot be configured using the web interface, keep the current settings
+	updatedUser.Filters.Replication = user.Filters.Replication
+	updatedUser.Filters.Tiering = user.Filters.Tiering
 	err = dataprovider.UpdateUser(dataProvider, updatedUser)
 	if err == nil {
 		http.Redirect(w, r, webUsersPath, http.StatusSeeOther)
@@ -446,3 +717,56 @@ func handleWebGetConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	renderTemplate(w, templateConnections, data)
 }
+
+func handleGetWebFolders(w http.ResponseWriter, r *http.Request) {
+	limit := defaultUsersQueryLimit
+	if _, ok := r.URL.Query()["qlimit"]; ok {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("qlimit"))
+		if err != nil {
+			limit = defaultUsersQueryLimit
+		}
+	}
+	var folders []dataprovider.BaseVirtualFolder
+	f, err := dataprovider.GetFolders(dataProvider, limit, 0, "ASC", "")
+	folders = append(folders, f...)
+	for len(f) == limit {
+		f, err = dataprovider.GetFolders(dataProvider, limit, len(folders), "ASC", "")
+		if err == nil && len(f) > 0 {
+			folders = append(folders, f...)
+		} else {
+			break
+		}
+	}
+	if err != nil {
+		renderInternalServerErrorPage(w, err)
+		return
+	}
+	data := foldersPage{
+		basePage: getBasePageData(pageFoldersTitle, webFoldersPath),
+		Folders:  folders,
+	}
+	renderTemplate(w, templateFolders, data)
+}
+
+func handleWebAddFolderGet(w http.ResponseWriter, r *http.Request) {
+	renderAddFolderPage(w, dataprovider.BaseVirtualFolder{}, "")
+}
+
+func handleWebAddFolderPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	folder := dataprovider.BaseVirtualFolder{}
+	err := r.ParseForm()
+	if err != nil {
+		renderAddFolderPage(w, folder, err.Error())
+		return
+	}
+	folder.Name = r.Form.Get("name")
+	folder.MappedPath = r.Form.Get("mapped_path")
+	err = dataprovider.AddFolder(dataProvider, folder)
+	if err == nil {
+		http.Redirect(w, r, webFoldersPath, http.StatusSeeOther)
+	} else {
+		renderAddFolderPage(w, folder, err.Error())
+	}
+}
@@ -2,6 +2,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -210,6 +212,18 @@ var (
 		Help: "The total number of successful S3 list objects requests",
 	})
 
+	// totalS3MetadataCacheHits is the metric that reports the total S3 metadata cache hits
+	totalS3MetadataCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_s3_metadata_cache_hits",
+		Help: "The total number of S3 stat and list requests served from the metadata cache",
+	})
+
+	// totalS3MetadataCacheMisses is the metric that reports the total S3 metadata cache misses
+	totalS3MetadataCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_s3_metadata_cache_misses",
+		Help: "The total number of S3 stat and list requests not found inside the metadata cache",
+	})
+
 	// totalS3CopyObject is the metric that reports the total successful S3 copy object requests
 	totalS3CopyObject = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_s3_copy_object",
@@ -294,6 +308,18 @@ var (
 		Help: "The total number of successful GCS list objects requests",
 	})
 
+	// totalGCSMetadataCacheHits is the metric that reports the total GCS metadata cache hits
+	totalGCSMetadataCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_gcs_metadata_cache_hits",
+		Help: "The total number of GCS stat and list requests served from the metadata cache",
+	})
+
+	// totalGCSMetadataCacheMisses is the metric that reports the total GCS metadata cache misses
+	totalGCSMetadataCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_gcs_metadata_cache_misses",
+		Help: "The total number of GCS stat and list requests not found inside the metadata cache",
+	})
+
 	// totalGCSCopyObject is the metric that reports the total successful GCS copy object requests
 	totalGCSCopyObject = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_gcs_copy_object",
@@ -335,6 +361,143 @@ var (
 		Name: "sftpgo_gcs_head_bucket_errors",
 		Help: "The total number of GCS head bucket errors",
 	})
+	// totalAZUploads is the metric that reports the total number of successful Azure uploads
+	totalAZUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_uploads_total",
+		Help: "The total number of successful Azure uploads",
+	})
+
+	// totalAZDownloads is the metric that reports the total number of successful Azure downloads
+	totalAZDownloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_downloads_total",
+		Help: "The total number of successful Azure downloads",
+	})
+
+	// totalAZUploadErrors is the metric that reports the total number of Azure upload errors
+	totalAZUploadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_upload_errors_total",
+		Help: "The total number of Azure upload errors",
+	})
+
+	// totalAZDownloadErrors is the metric that reports the total number of Azure download errors
+	totalAZDownloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_download_errors_total",
+		Help: "The total number of Azure download errors",
+	})
+
+	// totalAZUploadSize is the metric that reports the total Azure uploads size as bytes
+	totalAZUploadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_upload_size",
+		Help: "The total Azure upload size as bytes, partial uploads are included",
+	})
+
+	// totalAZDownloadSize is the metric that reports the total Azure downloads size as bytes
+	totalAZDownloadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_download_size",
+		Help: "The total Azure download size as bytes, partial downloads are included",
+	})
+
+	// totalAZListObjects is the metric that reports the total successful Azure list objects requests
+	totalAZListObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_list_objects",
+		Help: "The total number of successful Azure list objects requests",
+	})
+
+	// totalAZCopyObject is the metric that reports the total successful Azure copy object requests
+	totalAZCopyObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_copy_object",
+		Help: "The total number of successful Azure copy object requests",
+	})
+
+	// totalAZDeleteObject is the metric that reports the total successful Azure delete object requests
+	totalAZDeleteObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_delete_object",
+		Help: "The total number of successful Azure delete object requests",
+	})
+
+	// totalAZListObjectsErrors is the metric that reports the total Azure list objects errors
+	totalAZListObjectsErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_list_objects_errors",
+		Help: "The total number of Azure list objects errors",
+	})
+
+	// totalAZCopyObjectErrors is the metric that reports the total Azure copy object errors
+	totalAZCopyObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_copy_object_errors",
+		Help: "The total number of Azure copy object errors",
+	})
+
+	// totalAZDeleteObjectErrors is the metric that reports the total Azure delete object errors
+	totalAZDeleteObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_delete_object_errors",
+		Help: "The total number of Azure delete object errors",
+	})
+
+	// totalAZHeadContainer is the metric that reports the total successful Azure head container requests
+	totalAZHeadContainer = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_head_container",
+		Help: "The total number of successful Azure head container requests",
+	})
+
+	// totalAZHeadContainerErrors is the metric that reports the total Azure head container errors
+	totalAZHeadContainerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_head_container_errors",
+		Help: "The total number of Azure head container errors",
+	})
+
+	// replicationPendingOperations is the metric that reports the number of operations waiting to be replicated
+	replicationPendingOperations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_replication_pending_operations",
+		Help: "Number of operations waiting to be replicated to the secondary storage",
+	})
+
+	// replicationLag is the metric that reports the age of the oldest operation waiting to be replicated
+	replicationLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_replication_lag_seconds",
+		Help: "Age, as seconds, of the oldest operation waiting to be replicated, 0 means no pending operations",
+	})
+
+	// totalReplicatedOperations is the metric that reports the total number of replicated operations
+	totalReplicatedOperations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_replicated_operations_total",
+		Help: "The total number of operations replicated to the secondary storage",
+	})
+
+	// totalReplicatedSize is the metric that reports the total bytes copied to the secondary storage
+	totalReplicatedSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_replicated_bytes_total",
+		Help: "The total number of bytes copied to the secondary storage",
+	})
+
+	// totalReplicationErrors is the metric that reports the total number of failed replication attempts
+	totalReplicationErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_replication_errors_total",
+		Help: "The total number of failed replication attempts, failed operations are retried",
+	})
+
+	// totalTieredFiles is the metric that reports the total number of files moved to the cold tier
+	totalTieredFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiered_files_total",
+		Help: "The total number of files moved from the local disk to the cold tier",
+	})
+
+	// totalTieredSize is the metric that reports the total size of the files moved to the cold tier
+	totalTieredSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiered_bytes_total",
+		Help: "The total size, as bytes, of the files moved from the local disk to the cold tier",
+	})
+
+	// totalRecalledFiles is the metric that reports the total number of files recalled from the cold tier
+	totalRecalledFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_recalled_files_total",
+		Help: "The total number of files recalled from the cold tier to the local disk",
+	})
+
+	// totalTieringErrors is the metric that reports the total number of failed tiering and recall attempts
+	totalTieringErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_tiering_errors_total",
+		Help: "The total number of files that could not be moved to or recalled from the cold tier",
+	})
 )
 
 // TransferCompleted updates metrics after an upload or a download
@@ -388,6 +551,16 @@ func S3ListObjectsCompleted(err error) {
 	}
 }
 
+// S3MetadataCacheHit updates metrics after an S3 stat or list request is served from the metadata cache
+func S3MetadataCacheHit() {
+	totalS3MetadataCacheHits.Inc()
+}
+
+// S3MetadataCacheMiss updates metrics after an S3 stat or list request is not found inside the metadata cache
+func S3MetadataCacheMiss() {
+	totalS3MetadataCacheMisses.Inc()
+}
+
 // S3CopyObjectCompleted updates metrics after an S3 copy object request terminates
 func S3CopyObjectCompleted(err error) {
 	if err == nil {
@@ -445,6 +618,16 @@ func GCSListObjectsCompleted(err error) {
 	}
 }
 
+// GCSMetadataCacheHit updates metrics after a GCS stat or list request is served from the metadata cache
+func GCSMetadataCacheHit() {
+	totalGCSMetadataCacheHits.Inc()
+}
+
+// GCSMetadataCacheMiss updates metrics after a GCS stat or list request is not found inside the metadata cache
+func GCSMetadataCacheMiss() {
+	totalGCSMetadataCacheMisses.Inc()
+}
+
 // GCSCopyObjectCompleted updates metrics after a GCS copy object request terminates
 func GCSCopyObjectCompleted(err error) {
 	if err == nil {
@@ -472,6 +655,98 @@ func GCSHeadBucketCompleted(err error) {
 	}
 }
 
+// AZTransferCompleted updates metrics after an Azure upload or a download
+func AZTransferCompleted(bytes int64, transferKind int, err error) {
+	if transferKind == 0 {
+		// upload
+		if err == nil {
+			totalAZUploads.Inc()
+		} else {
+			totalAZUploadErrors.Inc()
+		}
+		totalAZUploadSize.Add(float64(bytes))
+	} else {
+		// download
+		if err == nil {
+			totalAZDownloads.Inc()
+		} else {
+			totalAZDownloadErrors.Inc()
+		}
+		totalAZDownloadSize.Add(float64(bytes))
+	}
+}
+
+// AZListObjectsCompleted updates metrics after an Azure list objects request terminates
+func AZListObjectsCompleted(err error) {
+	if err == nil {
+		totalAZListObjects.Inc()
+	} else {
+		totalAZListObjectsErrors.Inc()
+	}
+}
+
+// AZCopyObjectCompleted updates metrics after an Azure copy object request terminates
+func AZCopyObjectCompleted(err error) {
+	if err == nil {
+		totalAZCopyObject.Inc()
+	} else {
+		totalAZCopyObjectErrors.Inc()
+	}
+}
+
+// AZDeleteObjectCompleted updates metrics after an Azure delete object request terminates
+func AZDeleteObjectCompleted(err error) {
+	if err == nil {
+		totalAZDeleteObject.Inc()
+	} else {
+		totalAZDeleteObjectErrors.Inc()
+	}
+}
+
+// AZHeadContainerCompleted updates metrics after an Azure head container request terminates
+func AZHeadContainerCompleted(err error) {
+	if err == nil {
+		totalAZHeadContainer.Inc()
+	} else {
+		totalAZHeadContainerErrors.Inc()
+	}
+}
+
+// ReplicationOperationCompleted updates metrics after a replication attempt
+func ReplicationOperationCompleted(bytes int64, err error) {
+	if err == nil {
+		totalReplicatedOperations.Inc()
+		totalReplicatedSize.Add(float64(bytes))
+	} else {
+		totalReplicationErrors.Inc()
+	}
+}
+
+// UpdateReplicationQueue sets the metrics for the operations waiting to be replicated
+func UpdateReplicationQueue(pending int, lag time.Duration) {
+	replicationPendingOperations.Set(float64(pending))
+	replicationLag.Set(lag.Seconds())
+}
+
+// FileTiered updates metrics after an attempt to move a file to the cold tier
+func FileTiered(bytes int64, err error) {
+	if err == nil {
+		totalTieredFiles.Inc()
+		totalTieredSize.Add(float64(bytes))
+	} else {
+		totalTieringErrors.Inc()
+	}
+}
+
+// FileRecalled updates metrics after an attempt to recall a file from the cold tier
+func FileRecalled(err error) {
+	if err == nil {
+		totalRecalledFiles.Inc()
+	} else {
+		totalTieringErrors.Inc()
+	}
+}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(err error) {
 	if err == nil {
@@ -33,11 +33,15 @@ class SFTPGoApiRequests:
 	def __init__(self, debug, baseUrl, authType, authUser, authPassword, secure, no_color):
 		self.userPath = urlparse.urljoin(baseUrl, '/api/v1/user')
 		self.quotaScanPath = urlparse.urljoin(baseUrl, '/api/v1/quota_scan')
+		self.folderPath = urlparse.urljoin(baseUrl, '/api/v1/folder')
+		self.folderQuotaScanPath = urlparse.urljoin(baseUrl, '/api/v1/folder_quota_scan')
 		self.activeConnectionsPath = urlparse.urljoin(baseUrl, '/api/v1/connection')
 		self.versionPath = urlparse.urljoin(baseUrl, '/api/v1/version')
 		self.providerStatusPath = urlparse.urljoin(baseUrl, '/api/v1/providerstatus')
 		self.dumpDataPath = urlparse.urljoin(baseUrl, '/api/v1/dumpdata')
 		self.loadDataPath = urlparse.urljoin(baseUrl, '/api/v1/loaddata')
+		self.replicationPath = urlparse.urljoin(baseUrl, '/api/v1/replication')
+		self.tieringPath = urlparse.urljoin(baseUrl, '/api/v1/tiering')
 		self.debug = debug
 		if authType == 'basic':
 			self.auth = requests.auth.HTTPBasicAuth(authUser, authPassword)
@@ -75,7 +79,15 @@ class SFTPGoApiRequests:
 					max_sessions=0, quota_size=0, quota_files=0, permissions={}, upload_bandwidth=0, download_bandwidth=0,
 					status=1, expiration_date=0, allowed_ip=[], denied_ip=[], fs_provider='local', s3_bucket='',
 					s3_region='', s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='',
-					s3_key_prefix='', gcs_bucket='', gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file=''):
+					s3_key_prefix='', s3_upload_part_size=0, s3_sse='', s3_sse_kms_key_id='', s3_sse_customer_key='', s3_role_arn='', s3_external_id='', gcs_bucket='', gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file='', gcs_automatic_credentials=False,
+					az_container='', az_account_name='', az_account_key='', az_sas_url='', az_endpoint='', az_key_prefix='',
+					az_upload_part_size=0, az_upload_concurrency=0, az_use_emulator=False, az_access_tier='',
+					sftp_endpoint='', sftp_username='', sftp_password='', sftp_private_key_path='', sftp_fingerprints=[],
+					sftp_prefix='', mem_max_size=0, mem_clear_on_logout=False, dedup_store_path='', crypt_passphrase='', virtual_folders=[], trash_enabled=False, trash_retention_days=0,
+					trash_count_in_quota=False, retention_policies=[], s3_object_lock_mode='', replication_file='',
+					disable_replication=False, tiering_file='', disable_tiering=False, dir_quotas=[],
+					transfer_quota_period='', transfer_quota_upload_size=0, transfer_quota_download_size=0,
+					allowed_patterns=[], denied_patterns=[], max_upload_file_size=0):
 		user = {'id':user_id, 'username':username, 'uid':uid, 'gid':gid,
 			'max_sessions':max_sessions, 'quota_size':quota_size, 'quota_files':quota_files,
 			'upload_bandwidth':upload_bandwidth, 'download_bandwidth':download_bandwidth,
@@ -91,11 +103,26 @@ class SFTPGoApiRequests:
 			user.update({'home_dir':home_dir})
 		if permissions:
 			user.update({'permissions':permissions})
-		if allowed_ip or denied_ip:
-			user.update({'filters':self.buildFilters(allowed_ip, denied_ip)})
+		if (allowed_ip or denied_ip or trash_enabled or retention_policies or replication_file or disable_replication or
+				tiering_file or disable_tiering or dir_quotas or transfer_quota_period or allowed_patterns or denied_patterns or
+				max_upload_file_size):
+			user.update({'filters':self.buildFilters(allowed_ip, denied_ip, trash_enabled, trash_retention_days,
+													trash_count_in_quota, retention_policies, replication_file,
+													disable_replication, tiering_file, disable_tiering, dir_quotas,
+													transfer_quota_period, transfer_quota_upload_size,
+													transfer_quota_download_size, allowed_patterns, denied_patterns,
+													max_upload_file_size)})
+		if virtual_folders:
+			user.update({'virtual_folders':self.buildVirtualFolders(virtual_folders)})
 		user.update({'filesystem':self.buildFsConfig(fs_provider, s3_bucket, s3_region, s3_access_key, s3_access_secret,
-													s3_endpoint, s3_storage_class, s3_key_prefix, gcs_bucket,
-													gcs_key_prefix, gcs_storage_class, gcs_credentials_file)})
+													s3_endpoint, s3_storage_class, s3_key_prefix, s3_upload_part_size, s3_sse, s3_sse_kms_key_id, s3_sse_customer_key, s3_role_arn, s3_external_id, gcs_bucket,
+													gcs_key_prefix, gcs_storage_class, gcs_credentials_file, gcs_automatic_credentials,
+													az_container, az_account_name, az_account_key, az_sas_url,
+													az_endpoint, az_key_prefix, az_upload_part_size,
+													az_upload_concurrency, az_use_emulator, az_access_tier,
+													sftp_endpoint, sftp_username, sftp_password, sftp_private_key_path,
+													sftp_fingerprints, sftp_prefix, mem_max_size, mem_clear_on_logout, dedup_store_path,
+													crypt_passphrase, s3_object_lock_mode)})
 		return user
 
 	def buildPermissions(self, root_perms, subdirs_perms):
@@ -115,7 +142,26 @@ class SFTPGoApiRequests:
 					permissions.update({directory:values})
 		return permissions
 
-	def buildFilters(self, allowed_ip, denied_ip):
+	def buildVirtualFolders(self, vfolders):
+		result = []
+		for f in vfolders:
+			if '::' in f:
+				values = [v.strip() for v in f.split('::')]
+				if len(values) < 2 or not values[0] or not values[1]:
+					continue
+				vfolder = {'virtual_path':values[0], 'name':values[1]}
+				if len(values) > 2:
+					vfolder.update({'quota_size':int(values[2])})
+				if len(values) > 3:
+					vfolder.update({'quota_files':int(values[3])})
+				result.append(vfolder)
+		return result
+
+	def buildFilters(self, allowed_ip, denied_ip, trash_enabled=False, trash_retention_days=0,
+					trash_count_in_quota=False, retention_policies=[], replication_file='', disable_replication=False,
+					tiering_file='', disable_tiering=False, dir_quotas=[], transfer_quota_period='',
+					transfer_quota_upload_size=0, transfer_quota_download_size=0, allowed_patterns=[],
+					denied_patterns=[], max_upload_file_size=0):
 		filters = {}
 		if allowed_ip:
 			if len(allowed_ip) == 1 and not allowed_ip[0]:
@@ -127,22 +173,119 @@ class SFTPGoApiRequests:
 				filters.update({'denied_ip':[]})
 			else:
 				filters.update({'denied_ip':denied_ip})
+		if trash_enabled:
+			filters.update({'trash':{'enabled':True, 'retention_days':trash_retention_days,
+									'count_in_quota':trash_count_in_quota}})
+		if retention_policies:
+			if len(retention_policies) == 1 and not retention_policies[0]:
+				filters.update({'retention_policies':[]})
+			else:
+				filters.update({'retention_policies':self.buildRetentionPolicies(retention_policies)})
+		if replication_file:
+			with open(replication_file) as replication:
+				filters.update({'replication':json.load(replication)})
+		elif disable_replication:
+			filters.update({'replication':{'enabled':False}})
+		if tiering_file:
+			with open(tiering_file) as tiering:
+				filters.update({'tiering':json.load(tiering)})
+		elif disable_tiering:
+			filters.update({'tiering':{'enabled':False}})
+		if dir_quotas:
+			if len(dir_quotas) == 1 and not dir_quotas[0]:
+				filters.update({'directory_quotas':[]})
+			else:
+				filters.update({'directory_quotas':self.buildDirQuotas(dir_quotas)})
+		if transfer_quota_period:
+			filters.update({'transfer_quota':{'period':transfer_quota_period, 'upload_size':transfer_quota_upload_size,
+											'download_size':transfer_quota_download_size}})
+		if allowed_patterns or denied_patterns:
+			if (len(allowed_patterns) == 1 and not allowed_patterns[0]) or (len(denied_patterns) == 1 and
+																			not denied_patterns[0]):
+				filters.update({'file_patterns':[]})
+			else:
+				filters.update({'file_patterns':self.buildFilePatterns(allowed_patterns, denied_patterns)})
+		if max_upload_file_size:
+			filters.update({'max_upload_file_size':max_upload_file_size})
 		return filters
 
+	def buildRetentionPolicies(self, retention_policies):
+		result = []
+		for p in retention_policies:
+			if ':' in p:
+				directory, days = p.rsplit(':', 1)
+				if directory.strip() and days.strip():
+					result.append({'path':directory.strip(), 'days':int(days)})
+		return result
+
+	def buildDirQuotas(self, dir_quotas):
+		result = []
+		for q in dir_quotas:
+			if '::' in q:
+				values = [v.strip() for v in q.split('::')]
+				if len(values) != 3 or not values[0]:
+					continue
+				result.append({'path':values[0], 'quota_size':int(values[1]), 'quota_files':int(values[2])})
+		return result
+
+	def buildFilePatterns(self, allowed_patterns, denied_patterns):
+		result = []
+		for key, values in [('allowed_patterns', allowed_patterns), ('denied_patterns', denied_patterns)]:
+			for f in values:
+				if '::' in f:
+					directory, patterns = [v.strip() for v in f.split('::', 1)]
+					patterns = [p.strip() for p in patterns.split(',') if p.strip()]
+					if not directory or not patterns:
+						continue
+					for r in result:
+						if r['path'] == directory:
+							r.update({key:r.get(key, []) + patterns})
+							break
+					else:
+						result.append({'path':directory, key:patterns})
+		return result
+
 	def buildFsConfig(self, fs_provider, s3_bucket, s3_region, s3_access_key, s3_access_secret, s3_endpoint,
-					s3_storage_class, s3_key_prefix, gcs_bucket, gcs_key_prefix, gcs_storage_class, gcs_credentials_file):
+					s3_storage_class, s3_key_prefix, s3_upload_part_size, s3_sse, s3_sse_kms_key_id, s3_sse_customer_key, s3_role_arn, s3_external_id, gcs_bucket, gcs_key_prefix, gcs_storage_class, gcs_credentials_file, gcs_automatic_credentials,
+					az_container, az_account_name, az_account_key, az_sas_url, az_endpoint, az_key_prefix,
+					az_upload_part_size, az_upload_concurrency, az_use_emulator, az_access_tier, sftp_endpoint,
+					sftp_username, sftp_password, sftp_private_key_path, sftp_fingerprints, sftp_prefix, mem_max_size, mem_clear_on_logout, dedup_store_path,
+					crypt_passphrase, s3_object_lock_mode=''):
 		fs_config = {'provider':0}
 		if fs_provider == 'S3':
 			s3config = {'bucket':s3_bucket, 'region':s3_region, 'access_key':s3_access_key, 'access_secret':
 					s3_access_secret, 'endpoint':s3_endpoint, 'storage_class':s3_storage_class, 'key_prefix':
-					s3_key_prefix}
+					s3_key_prefix, 'upload_part_size':s3_upload_part_size, 'server_side_encryption':s3_sse,
+					'sse_kms_key_id':s3_sse_kms_key_id, 'sse_customer_key':s3_sse_customer_key, 'role_arn':s3_role_arn,
+					'external_id':s3_external_id, 'object_lock_mode':s3_object_lock_mode}
 			fs_config.update({'provider':1, 's3config':s3config})
 		elif fs_provider == 'GCS':
-			gcsconfig = {'bucket':gcs_bucket, 'key_prefix':gcs_key_prefix, 'storage_class':gcs_storage_class}
-			if gcs_credentials_file:
+			gcsconfig = {'bucket':gcs_bucket, 'key_prefix':gcs_key_prefix, 'storage_class':gcs_storage_class,
+					'automatic_credentials':gcs_automatic_credentials}
+			if gcs_credentials_file and not gcs_automatic_credentials:
 				with open(gcs_credentials_file) as creds:
 					gcsconfig.update({'credentials':base64.b64encode(creds.read().encode('UTF-8')).decode('UTF-8')})
 			fs_config.update({'provider':2, 'gcsconfig':gcsconfig})
+		elif fs_provider == 'AzureBlob':
+			azureconfig = {'container':az_container, 'account_name':az_account_name, 'account_key':az_account_key,
+						'sas_url':az_sas_url, 'endpoint':az_endpoint, 'key_prefix':az_key_prefix, 'upload_part_size':
+						az_upload_part_size, 'upload_concurrency':az_upload_concurrency, 'use_emulator':
+						az_use_emulator, 'access_tier':az_access_tier}
+			fs_config.update({'provider':3, 'azblobconfig':azureconfig})
+		elif fs_provider == 'SFTP':
+			sftpconfig = {'endpoint':sftp_endpoint, 'username':sftp_username, 'password':sftp_password,
+						'fingerprints':sftp_fingerprints, 'prefix':sftp_prefix}
+			if sftp_private_key_path:
+				with open(sftp_private_key_path) as key:
+					sftpconfig.update({'private_key':key.read()})
+			fs_config.update({'provider':4, 'sftpconfig':sftpconfig})
+		elif fs_provider == 'Memory':
+			fs_config.update({'provider':5, 'memconfig':{'max_size':mem_max_size,
+													'clear_on_logout':mem_clear_on_logout}})
+		elif fs_provider == 'Dedup':
+			fs_config.update({'provider':6, 'dedupconfig':{'store_path':dedup_store_path}})
+		if crypt_passphrase:
+			fs_config.update({'cryptconfig':{'passphrase':crypt_passphrase}})
 		return fs_config
 
 	def getUsers(self, limit=100, offset=0, order='ASC', username=''):
@@ -157,13 +300,27 @@ class SFTPGoApiRequests:
 	def addUser(self, username='', password='', public_keys='', home_dir='', uid=0, gid=0, max_sessions=0, quota_size=0,
 			quota_files=0, perms=[], upload_bandwidth=0, download_bandwidth=0, status=1, expiration_date=0,
 			subdirs_permissions=[], allowed_ip=[], denied_ip=[], fs_provider='local', s3_bucket='', s3_region='',
-			s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='', s3_key_prefix='', gcs_bucket='',
-			gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file=''):
+			s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='', s3_key_prefix='', s3_upload_part_size=0, s3_sse='', s3_sse_kms_key_id='', s3_sse_customer_key='', s3_role_arn='', s3_external_id='', gcs_bucket='',
+			gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file='', gcs_automatic_credentials=False, az_container='', az_account_name='', az_account_key='', az_sas_url='', az_endpoint='', az_key_prefix='',
+			az_upload_part_size=0, az_upload_concurrency=0, az_use_emulator=False, az_access_tier='',
+					sftp_endpoint='', sftp_username='', sftp_password='', sftp_private_key_path='', sftp_fingerprints=[],
+					sftp_prefix='', mem_max_size=0, mem_clear_on_logout=False, dedup_store_path='', crypt_passphrase='', virtual_folders=[], trash_enabled=False, trash_retention_days=0,
+					trash_count_in_quota=False, retention_policies=[], s3_object_lock_mode='', replication_file='',
+					disable_replication=False, tiering_file='', disable_tiering=False, dir_quotas=[],
+					transfer_quota_period='', transfer_quota_upload_size=0, transfer_quota_download_size=0,
+					allowed_patterns=[], denied_patterns=[], max_upload_file_size=0):
 		u = self.buildUserObject(0, username, password, public_keys, home_dir, uid, gid, max_sessions,
 			quota_size, quota_files, self.buildPermissions(perms, subdirs_permissions), upload_bandwidth, download_bandwidth,
 			status, expiration_date, allowed_ip, denied_ip, fs_provider, s3_bucket, s3_region, s3_access_key,
-			s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix, gcs_bucket, gcs_key_prefix, gcs_storage_class,
-			gcs_credentials_file)
+			s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix, s3_upload_part_size, s3_sse, s3_sse_kms_key_id, s3_sse_customer_key, s3_role_arn, s3_external_id, gcs_bucket, gcs_key_prefix, gcs_storage_class,
+			gcs_credentials_file, gcs_automatic_credentials, az_container, az_account_name, az_account_key, az_sas_url, az_endpoint, az_key_prefix,
+			az_upload_part_size, az_upload_concurrency, az_use_emulator, az_access_tier, sftp_endpoint, sftp_username,
+			sftp_password, sftp_private_key_path, sftp_fingerprints, sftp_prefix, mem_max_size, mem_clear_on_logout, dedup_store_path, crypt_passphrase,
+			virtual_folders,
+			trash_enabled, trash_retention_days, trash_count_in_quota, retention_policies, s3_object_lock_mode,
+			replication_file, disable_replication, tiering_file, disable_tiering, dir_quotas, transfer_quota_period,
+			transfer_quota_upload_size, transfer_quota_download_size, allowed_patterns, denied_patterns,
+			max_upload_file_size)
 		r = requests.post(self.userPath, json=u, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
@@ -171,12 +328,27 @@ class SFTPGoApiRequests:
 				quota_size=0, quota_files=0, perms=[], upload_bandwidth=0, download_bandwidth=0, status=1,
 				expiration_date=0, subdirs_permissions=[], allowed_ip=[], denied_ip=[], fs_provider='local',
 				s3_bucket='', s3_region='', s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='',
-				s3_key_prefix='', gcs_bucket='', gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file=''):
+				s3_key_prefix='', s3_upload_part_size=0, s3_sse='', s3_sse_kms_key_id='', s3_sse_customer_key='', s3_role_arn='', s3_external_id='', gcs_bucket='', gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file='', gcs_automatic_credentials=False,
+				az_container='', az_account_name='', az_account_key='', az_sas_url='', az_endpoint='', az_key_prefix='',
+				az_upload_part_size=0, az_upload_concurrency=0, az_use_emulator=False, az_access_tier='',
+					sftp_endpoint='', sftp_username='', sftp_password='', sftp_private_key_path='', sftp_fingerprints=[],
+					sftp_prefix='', mem_max_size=0, mem_clear_on_logout=False, dedup_store_path='', crypt_passphrase='', virtual_folders=[], trash_enabled=False, trash_retention_days=0,
+					trash_count_in_quota=False, retention_policies=[], s3_object_lock_mode='', replication_file='',
+					disable_replication=False, tiering_file='', disable_tiering=False, dir_quotas=[],
+					transfer_quota_period='', transfer_quota_upload_size=0, transfer_quota_download_size=0,
+					allowed_patterns=[], denied_patterns=[], max_upload_file_size=0):
 		u = self.buildUserObject(user_id, username, password, public_keys, home_dir, uid, gid, max_sessions,
 			quota_size, quota_files, self.buildPermissions(perms, subdirs_permissions), upload_bandwidth, download_bandwidth,
 			status, expiration_date, allowed_ip, denied_ip, fs_provider, s3_bucket, s3_region, s3_access_key,
-			s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix, gcs_bucket, gcs_key_prefix, gcs_storage_class,
-			gcs_credentials_file)
+			s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix, s3_upload_part_size, s3_sse, s3_sse_kms_key_id, s3_sse_customer_key, s3_role_arn, s3_external_id, gcs_bucket, gcs_key_prefix, gcs_storage_class,
+			gcs_credentials_file, gcs_automatic_credentials, az_container, az_account_name, az_account_key, az_sas_url, az_endpoint, az_key_prefix,
+			az_upload_part_size, az_upload_concurrency, az_use_emulator, az_access_tier, sftp_endpoint, sftp_username,
+			sftp_password, sftp_private_key_path, sftp_fingerprints, sftp_prefix, mem_max_size, mem_clear_on_logout, dedup_store_path, crypt_passphrase,
+			virtual_folders,
+			trash_enabled, trash_retention_days, trash_count_in_quota, retention_policies, s3_object_lock_mode,
+			replication_file, disable_replication, tiering_file, disable_tiering, dir_quotas, transfer_quota_period,
+			transfer_quota_upload_size, transfer_quota_download_size, allowed_patterns, denied_patterns,
+			max_upload_file_size)
 		r = requests.put(urlparse.urljoin(self.userPath, 'user/' + str(user_id)), json=u, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
@@ -184,6 +356,54 @@ class SFTPGoApiRequests:
 		r = requests.delete(urlparse.urljoin(self.userPath, 'user/' + str(user_id)), auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
+	def getDirQuotas(self, user_id):
+		r = requests.get(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/directory_quotas'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getTransferQuota(self, user_id):
+		r = requests.get(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/transfer_quota'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def resetTransferQuota(self, user_id):
+		r = requests.delete(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/transfer_quota'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getRetentionStatus(self, user_id, path):
+		r = requests.get(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/retention'), params={'path':path},
+						auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def getTrashEntries(self, user_id):
+		r = requests.get(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/trash'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def restoreTrashEntry(self, user_id, entry_id):
+		r = requests.post(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/trash/' + str(entry_id) + '/restore'),
+						auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def purgeTrashEntry(self, user_id, entry_id):
+		r = requests.delete(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/trash/' + str(entry_id)),
+						auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def purgeTrash(self, user_id):
+		r = requests.delete(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/trash'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getReplicationStatus(self):
+		r = requests.get(self.replicationPath, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def getTieringStatus(self):
+		r = requests.get(self.tieringPath, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
 	def getConnections(self):
 		r = requests.get(self.activeConnectionsPath, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
@@ -196,9 +416,54 @@ class SFTPGoApiRequests:
 		r = requests.get(self.quotaScanPath, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
-	def startQuotaScan(self, username):
+	def startQuotaScan(self, username, incremental=False):
 		u = self.buildUserObject(0, username)
-		r = requests.post(self.quotaScanPath, json=u, auth=self.auth, verify=self.verify)
+		r = requests.post(self.quotaScanPath, params={'incremental':1 if incremental else 0}, json=u, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def cancelQuotaScan(self, username):
+		r = requests.delete(urlparse.urljoin(self.quotaScanPath, 'quota_scan/' + username), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getFolders(self, limit=100, offset=0, order='ASC', name=''):
+		r = requests.get(self.folderPath, params={'limit':limit, 'offset':offset, 'order':order,
+											'name':name}, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def getFolderByID(self, folder_id):
+		r = requests.get(urlparse.urljoin(self.folderPath, 'folder/' + str(folder_id)), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def addFolder(self, name, mapped_path):
+		f = {'name':name, 'mapped_path':mapped_path}
+		r = requests.post(self.folderPath, json=f, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def updateFolder(self, folder_id, name, mapped_path):
+		f = {'id':folder_id, 'name':name, 'mapped_path':mapped_path}
+		r = requests.put(urlparse.urljoin(self.folderPath, 'folder/' + str(folder_id)), json=f, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def deleteFolder(self, folder_id):
+		r = requests.delete(urlparse.urljoin(self.folderPath, 'folder/' + str(folder_id)), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getFoldersQuotaScans(self):
+		r = requests.get(self.folderQuotaScanPath, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def startFolderQuotaScan(self, name, incremental=False):
+		r = requests.post(self.folderQuotaScanPath, params={'incremental':1 if incremental else 0}, json={'name':name},
+						auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def cancelFolderQuotaScan(self, name):
+		r = requests.delete(urlparse.urljoin(self.folderQuotaScanPath, 'folder_quota_scan/' + name), auth=self.auth,
+						verify=self.verify)
 		self.printResponse(r)
 
 	def getVersion(self):
@@ -431,7 +696,47 @@ def addCommonUserArguments(parser):
 					help='Allowed IP/Mask in CIDR notation. For example "192.168.2.0/24" or "2001:db8::/32". Default: %(default)s')
 	parser.add_argument('-N', '--denied-ip', type=str, nargs='+', default=[],
 					help='Denied IP/Mask in CIDR notation. For example "192.168.2.0/24" or "2001:db8::/32". Default: %(default)s')
-	parser.add_argument('--fs', type=str, default='local', choices=['local', 'S3', 'GCS'],
+	parser.add_argument('--trash', dest='trash_enabled', action='store_true',
+					help='Move the deleted files and directories inside the user\'s trash. Default: %(default)s')
+	parser.set_defaults(trash_enabled=False)
+	parser.add_argument('--trash-retention-days', type=int, default=0,
+					help='Purge the trash entries older than the specified days. 0 means no automatic purge. '
+					+'Default: %(default)s')
+	parser.add_argument('--trash-count-in-quota', dest='trash_count_in_quota', action='store_true',
+					help='Include the trash entries in the user\'s quota. Default: %(default)s')
+	parser.set_defaults(trash_count_in_quota=False)
+	parser.add_argument('--retention-policies', type=str, nargs='*', default=[], help='Write-once retention policies ' +
+					'as "dir:days". The files inside these directories cannot be modified, renamed or removed for the ' +
+					'given days. For example: "/archive:365" Default: %(default)s')
+	parser.add_argument('--replication-file', type=str, default='', help='Path to a JSON file with the replication ' +
+					'settings, as defined for the "replication" user filter in the REST API schema. Default: %(default)s')
+	parser.add_argument('--disable-replication', dest='disable_replication', action='store_true',
+					help='Disable the replication. Ignored if --replication-file is set. Default: %(default)s')
+	parser.set_defaults(disable_replication=False)
+	parser.add_argument('--tiering-file', type=str, default='', help='Path to a JSON file with the tiering ' +
+					'settings, as defined for the "tiering" user filter in the REST API schema. Default: %(default)s')
+	parser.add_argument('--disable-tiering', dest='disable_tiering', action='store_true',
+					help='Disable the tiering. Ignored if --tiering-file is set. Default: %(default)s')
+	parser.set_defaults(disable_tiering=False)
+	parser.add_argument('--dir-quotas', type=str, nargs='*', default=[], help='Quota restrictions for directories ' +
+					'inside the user\'s home as "dir::quota_size::quota_files", 0 means unlimited. For example ' +
+					'"/uploads::5368709120::0". Default: %(default)s')
+	parser.add_argument('--transfer-quota-period', type=str, default='', choices=['', 'daily', 'monthly'],
+					help='The used transfer quota is reset at midnight UTC every day or on the first day of every ' +
+					'month. Empty means no transfer quota. Default: %(default)s')
+	parser.add_argument('--transfer-quota-upload-size', type=int, default=0, help='Maximum bytes that can be ' +
+					'uploaded in a period. 0 means unlimited. Default: %(default)s')
+	parser.add_argument('--transfer-quota-download-size', type=int, default=0, help='Maximum bytes that can be ' +
+					'downloaded in a period. 0 means unlimited. Default: %(default)s')
+	parser.add_argument('--max-upload-file-size', type=int, default=0, help='Maximum size, as bytes, allowed for ' +
+					'a single uploaded file. 0 means the global limit, if any, applies. Default: %(default)s')
+	parser.add_argument('--allowed-patterns', type=str, nargs='*', default=[], help='Allowed file name shell ' +
+					'patterns for directories inside the user\'s home as "dir::pattern1,pattern2". If set only the ' +
+					'matching names are allowed. For example "/inbound::*.csv". Default: %(default)s')
+	parser.add_argument('--denied-patterns', type=str, nargs='*', default=[], help='Denied file name shell ' +
+					'patterns for directories inside the user\'s home as "dir::pattern1,pattern2". For example ' +
+					'"/::*.exe,*.bat". Default: %(default)s')
+	parser.add_argument('--fs', type=str, default='local', choices=['local', 'S3', 'GCS', 'AzureBlob', 'SFTP', 'Memory', 'Dedup'],
 					help='Filesystem provider. Default: %(default)s')
 	parser.add_argument('--s3-bucket', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--s3-key-prefix', type=str, default='', help='Virtual root directory. If non empty only this ' +
@@ -440,14 +745,70 @@ def addCommonUserArguments(parser):
 	parser.add_argument('--s3-region', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--s3-access-key', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--s3-access-secret', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-role-arn', type=str, default='', help='IAM role to assume. Leave access key and secret ' +
+					'empty to assume the role using the default credential chain. Default: %(default)s')
+	parser.add_argument('--s3-external-id', type=str, default='', help='External ID to use when assuming the role. ' +
+					'Default: %(default)s')
 	parser.add_argument('--s3-endpoint', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--s3-storage-class', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-upload-part-size', type=int, default=0, help='The buffer size for multipart uploads (MB). ' +
+					'Zero means the default (5 MB). Default: %(default)s')
+	parser.add_argument('--s3-sse', type=str, default='', choices=['', 'AES256', 'aws:kms'],
+					help='Server-side encryption: "AES256" means SSE-S3, "aws:kms" means SSE-KMS. Default: %(default)s')
+	parser.add_argument('--s3-sse-kms-key-id', type=str, default='', help='KMS key ID for SSE-KMS. Empty means the ' +
+					'AWS managed key. Default: %(default)s')
+	parser.add_argument('--s3-sse-customer-key', type=str, default='', help='Base64 encoded 256 bit key for SSE-C. ' +
+					'Default: %(default)s')
+	parser.add_argument('--s3-object-lock-mode', type=str, default='', choices=['', 'GOVERNANCE', 'COMPLIANCE'],
+					help='Protect the objects uploaded inside the retention directories using S3 Object Lock. ' +
+					'Default: %(default)s')
 	parser.add_argument('--gcs-bucket', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--gcs-key-prefix', type=str, default='', help='Virtual root directory. If non empty only this ' +
 					'directory and its contents will be available. Cannot start with "/". For example "folder/subfolder/".' +
 					' Default: %(default)s')
 	parser.add_argument('--gcs-storage-class', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--gcs-credentials-file', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--gcs-automatic-credentials', dest='gcs_automatic_credentials', action='store_true',
+					help='Use Application Default Credentials instead of a credentials file. Default: %(default)s')
+	parser.set_defaults(gcs_automatic_credentials=False)
+	parser.add_argument('--az-container', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-account-name', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-account-key', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-sas-url', type=str, default='', help='Shared access signature URL. Default: %(default)s')
+	parser.add_argument('--az-endpoint', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-key-prefix', type=str, default='', help='Virtual root directory. If non empty only this ' +
+					'directory and its contents will be available. Cannot start with "/". For example "folder/subfolder/".' +
+					' Default: %(default)s')
+	parser.add_argument('--az-upload-part-size', type=int, default=0, help='The buffer size for multipart uploads (MB). ' +
+					'Zero means the default (4 MB). Default: %(default)s')
+	parser.add_argument('--az-upload-concurrency', type=int, default=0, help='How many parts are uploaded in parallel. ' +
+					'Zero means the default (2). Default: %(default)s')
+	parser.add_argument('--az-use-emulator', dest='az_use_emulator', action='store_true')
+	parser.set_defaults(az_use_emulator=False)
+	parser.add_argument('--az-access-tier', type=str, default='', choices=['', 'Hot', 'Cool', 'Archive'],
+					help='Default: %(default)s')
+	parser.add_argument('--sftp-endpoint', type=str, default='', help='Remote SFTP server as host:port. ' +
+					'Default: %(default)s')
+	parser.add_argument('--sftp-username', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--sftp-password', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--sftp-private-key-path', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--sftp-fingerprints', type=str, nargs='+', default=[], help='SHA256 fingerprints to use for ' +
+					'host key verification. Default: %(default)s')
+	parser.add_argument('--sftp-prefix', type=str, default='', help='Virtual root directory. If non empty only this ' +
+					'remote directory and its contents will be available. It must be an absolute path. For example ' +
+					'"/folder/subfolder". Default: %(default)s')
+	parser.add_argument('--mem-max-size', type=int, default=0, help='Maximum size, as bytes, of the files stored in ' +
+					'memory. 0 means unlimited. Default: %(default)s')
+	parser.add_argument('--mem-clear-on-logout', dest='mem_clear_on_logout', action='store_true',
+					help='Remove the files stored in memory when the last connection is closed. Default: %(default)s')
+	parser.set_defaults(mem_clear_on_logout=False)
+	parser.add_argument('--dedup-store-path', type=str, default='', help='Absolute path to the local directory where ' +
+					'the deduplicated file contents are stored. Default: %(default)s')
+	parser.add_argument('--crypt-passphrase', type=str, default='', help='If set, the file contents are encrypted ' +
+					'using a key derived from this passphrase before storing them. Default: %(default)s')
+	parser.add_argument('--virtual-folders', type=str, nargs='*', default=[], help='Virtual folder mapping. For example: '
+					+'"/vpath::folder_name" "/vpath1::other_folder::quota_size::quota_files". The folders must already '
+					+'exist. Default: %(default)s')
 
 
 if __name__ == '__main__':
@@ -497,6 +858,45 @@ if __name__ == '__main__':
 	parserGetUserByID = subparsers.add_parser('get-user-by-id', help='Find user by ID')
 	parserGetUserByID.add_argument('id', type=int)
 
+	parserGetDirQuotas = subparsers.add_parser('get-dir-quotas', help='Get the quota restrictions and the used quota '
+											+'for the user\'s directories')
+	parserGetDirQuotas.add_argument('id', type=int, help='User\'s ID')
+
+	parserGetTransferQuota = subparsers.add_parser('get-transfer-quota', help='Get the transfer quota limits and the '
+											+'data transferred in the current period')
+	parserGetTransferQuota.add_argument('id', type=int, help='User\'s ID')
+
+	parserResetTransferQuota = subparsers.add_parser('reset-transfer-quota', help='Reset the data transferred in the '
+											+'current period')
+	parserResetTransferQuota.add_argument('id', type=int, help='User\'s ID')
+
+	parserGetRetentionStatus = subparsers.add_parser('get-retention-status', help='Get the write-once retention '
+													+'status for a path')
+	parserGetRetentionStatus.add_argument('id', type=int, help='User\'s ID')
+	parserGetRetentionStatus.add_argument('path', type=str, help='Absolute SFTP path')
+
+	parserGetTrash = subparsers.add_parser('get-trash', help='Get the entries inside the user\'s trash')
+	parserGetTrash.add_argument('id', type=int, help='User\'s ID')
+
+	parserRestoreTrashEntry = subparsers.add_parser('restore-trash-entry',
+												help='Restore a trash entry to its original path')
+	parserRestoreTrashEntry.add_argument('id', type=int, help='User\'s ID')
+	parserRestoreTrashEntry.add_argument('entry_id', type=str, help='Trash entry ID')
+
+	parserPurgeTrashEntry = subparsers.add_parser('purge-trash-entry', help='Permanently remove a trash entry')
+	parserPurgeTrashEntry.add_argument('id', type=int, help='User\'s ID')
+	parserPurgeTrashEntry.add_argument('entry_id', type=str, help='Trash entry ID')
+
+	parserPurgeTrash = subparsers.add_parser('purge-trash', help='Permanently remove all the entries inside the '
+											+'user\'s trash')
+	parserPurgeTrash.add_argument('id', type=int, help='User\'s ID')
+
+	parserGetReplicationStatus = subparsers.add_parser('get-replication-status', help='Get the users with operations ' +
+													'not yet mirrored on their replica')
+
+	parserGetTieringStatus = subparsers.add_parser('get-tiering-status', help='Get the tiering statistics for the ' +
+												'users with tiering enabled')
+
 	parserGetConnections = subparsers.add_parser('get-connections',
 													help='Get the active users and info about their uploads/downloads')
 
@@ -507,6 +907,47 @@ if __name__ == '__main__':
 
 	parserStartQuotaScans = subparsers.add_parser('start-quota-scan', help='Start a new quota scan')
 	addCommonUserArguments(parserStartQuotaScans)
+	parserStartQuotaScans.add_argument('--incremental', dest='incremental', action='store_true',
+									help='Skip the directories unchanged since the previous scan. Default: %(default)s')
+
+	parserCancelQuotaScan = subparsers.add_parser('cancel-quota-scan', help='Cancel an active quota scan')
+	parserCancelQuotaScan.add_argument('username', type=str)
+
+	parserAddFolder = subparsers.add_parser('add-folder', help='Add a new virtual folder mapped to a local directory')
+	parserAddFolder.add_argument('name', type=str)
+	parserAddFolder.add_argument('mapped_path', type=str, help='Absolute path to a local directory')
+
+	parserUpdateFolder = subparsers.add_parser('update-folder', help='Update an existing virtual folder')
+	parserUpdateFolder.add_argument('id', type=int, help='Folder\'s ID to update')
+	parserUpdateFolder.add_argument('name', type=str, help='The folder name cannot be changed')
+	parserUpdateFolder.add_argument('mapped_path', type=str, help='Absolute path to a local directory')
+
+	parserDeleteFolder = subparsers.add_parser('delete-folder', help='Delete an existing virtual folder')
+	parserDeleteFolder.add_argument('id', type=int, help='Folder\'s ID to delete')
+
+	parserGetFolders = subparsers.add_parser('get-folders', help='Returns an array with one or more virtual folders')
+	parserGetFolders.add_argument('-L', '--limit', type=int, default=100, choices=range(1, 501),
+							help='Maximum allowed value is 500. Default: %(default)s', metavar='[1...500]')
+	parserGetFolders.add_argument('-O', '--offset', type=int, default=0, help='Default: %(default)s')
+	parserGetFolders.add_argument('-N', '--name', type=str, default='', help='Default: %(default)s')
+	parserGetFolders.add_argument('-S', '--order', type=str, choices=['ASC', 'DESC'], default='ASC',
+							help='default: %(default)s')
+
+	parserGetFolderByID = subparsers.add_parser('get-folder-by-id', help='Find virtual folder by ID')
+	parserGetFolderByID.add_argument('id', type=int)
+
+	parserGetFoldersQuotaScans = subparsers.add_parser('get-folders-quota-scans',
+													help='Get the active quota scans for virtual folders')
+
+	parserStartFolderQuotaScan = subparsers.add_parser('start-folder-quota-scan',
+													help='Start a new quota scan for a virtual folder')
+	parserStartFolderQuotaScan.add_argument('name', type=str)
+	parserStartFolderQuotaScan.add_argument('--incremental', dest='incremental', action='store_true',
+									help='Skip the directories unchanged since the previous scan. Default: %(default)s')
+
+	parserCancelFolderQuotaScan = subparsers.add_parser('cancel-folder-quota-scan',
+													help='Cancel an active quota scan for a virtual folder')
+	parserCancelFolderQuotaScan.add_argument('name', type=str)
 
 	parserGetVersion = subparsers.add_parser('get-version', help='Get version details')
 
@@ -557,22 +998,58 @@ if __name__ == '__main__':
 				args.quota_size, args.quota_files, args.permissions, args.upload_bandwidth, args.download_bandwidth,
 				args.status, getDatetimeAsMillisSinceEpoch(args.expiration_date), args.subdirs_permissions, args.allowed_ip,
 				args.denied_ip, args.fs, args.s3_bucket, args.s3_region, args.s3_access_key, args.s3_access_secret,
-				args.s3_endpoint, args.s3_storage_class, args.s3_key_prefix, args.gcs_bucket, args.gcs_key_prefix,
-				args.gcs_storage_class, args.gcs_credentials_file)
+				args.s3_endpoint, args.s3_storage_class, args.s3_key_prefix, args.s3_upload_part_size, args.s3_sse, args.s3_sse_kms_key_id, args.s3_sse_customer_key, args.s3_role_arn, args.s3_external_id, args.gcs_bucket, args.gcs_key_prefix,
+				args.gcs_storage_class, args.gcs_credentials_file, args.gcs_automatic_credentials, args.az_container, args.az_account_name, args.az_account_key, args.az_sas_url, args.az_endpoint,
+				args.az_key_prefix, args.az_upload_part_size, args.az_upload_concurrency, args.az_use_emulator, args.az_access_tier,
+				args.sftp_endpoint, args.sftp_username, args.sftp_password, args.sftp_private_key_path, args.sftp_fingerprints,
+				args.sftp_prefix, args.mem_max_size, args.mem_clear_on_logout, args.dedup_store_path, args.crypt_passphrase, args.virtual_folders,
+				args.trash_enabled, args.trash_retention_days, args.trash_count_in_quota, args.retention_policies,
+				args.s3_object_lock_mode, args.replication_file, args.disable_replication, args.tiering_file,
+				args.disable_tiering, args.dir_quotas, args.transfer_quota_period, args.transfer_quota_upload_size,
+				args.transfer_quota_download_size, args.allowed_patterns, args.denied_patterns,
+				args.max_upload_file_size)
 	elif args.command == 'update-user':
 		api.updateUser(args.id, args.username, args.password, args.public_keys, args.home_dir, args.uid, args.gid,
 					args.max_sessions, args.quota_size, args.quota_files, args.permissions, args.upload_bandwidth,
 					args.download_bandwidth, args.status, getDatetimeAsMillisSinceEpoch(args.expiration_date),
 					args.subdirs_permissions, args.allowed_ip, args.denied_ip, args.fs, args.s3_bucket, args.s3_region,
 					args.s3_access_key, args.s3_access_secret, args.s3_endpoint, args.s3_storage_class,
-					args.s3_key_prefix, args.gcs_bucket, args.gcs_key_prefix, args.gcs_storage_class,
-					args.gcs_credentials_file)
+					args.s3_key_prefix, args.s3_upload_part_size, args.s3_sse, args.s3_sse_kms_key_id, args.s3_sse_customer_key, args.s3_role_arn, args.s3_external_id, args.gcs_bucket, args.gcs_key_prefix, args.gcs_storage_class,
+					args.gcs_credentials_file, args.gcs_automatic_credentials, args.az_container, args.az_account_name, args.az_account_key, args.az_sas_url, args.az_endpoint,
+					args.az_key_prefix, args.az_upload_part_size, args.az_upload_concurrency, args.az_use_emulator, args.az_access_tier,
+					args.sftp_endpoint, args.sftp_username, args.sftp_password, args.sftp_private_key_path,
+					args.sftp_fingerprints, args.sftp_prefix, args.mem_max_size, args.mem_clear_on_logout, args.dedup_store_path, args.crypt_passphrase, args.virtual_folders,
+				args.trash_enabled, args.trash_retention_days, args.trash_count_in_quota, args.retention_policies,
+				args.s3_object_lock_mode, args.replication_file, args.disable_replication, args.tiering_file,
+				args.disable_tiering, args.dir_quotas, args.transfer_quota_period, args.transfer_quota_upload_size,
+				args.transfer_quota_download_size, args.allowed_patterns, args.denied_patterns,
+				args.max_upload_file_size)
 	elif args.command == 'delete-user':
 		api.deleteUser(args.id)
 	elif args.command == 'get-users':
 		api.getUsers(args.limit, args.offset, args.order, args.username)
 	elif args.command == 'get-user-by-id':
 		api.getUserByID(args.id)
+	elif args.command == 'get-dir-quotas':
+		api.getDirQuotas(args.id)
+	elif args.command == 'get-transfer-quota':
+		api.getTransferQuota(args.id)
+	elif args.command == 'reset-transfer-quota':
+		api.resetTransferQuota(args.id)
+	elif args.command == 'get-retention-status':
+		api.getRetentionStatus(args.id, args.path)
+	elif args.command == 'get-trash':
+		api.getTrashEntries(args.id)
+	elif args.command == 'restore-trash-entry':
+		api.restoreTrashEntry(args.id, args.entry_id)
+	elif args.command == 'purge-trash-entry':
+		api.purgeTrashEntry(args.id, args.entry_id)
+	elif args.command == 'purge-trash':
+		api.purgeTrash(args.id)
+	elif args.command == 'get-replication-status':
+		api.getReplicationStatus()
+	elif args.command == 'get-tiering-status':
+		api.getTieringStatus()
 	elif args.command == 'get-connections':
 		api.getConnections()
 	elif args.command == 'close-connection':
@@ -580,7 +1057,25 @@ if __name__ == '__main__':
 	elif args.command == 'get-quota-scans':
 		api.getQuotaScans()
 	elif args.command == 'start-quota-scan':
-		api.startQuotaScan(args.username)
+		api.startQuotaScan(args.username, args.incremental)
+	elif args.command == 'cancel-quota-scan':
+		api.cancelQuotaScan(args.username)
+	elif args.command == 'add-folder':
+		api.addFolder(args.name, args.mapped_path)
+	elif args.command == 'update-folder':
+		api.updateFolder(args.id, args.name, args.mapped_path)
+	elif args.command == 'delete-folder':
+		api.deleteFolder(args.id)
+	elif args.command == 'get-folders':
+		api.getFolders(args.limit, args.offset, args.order, args.name)
+	elif args.command == 'get-folder-by-id':
+		api.getFolderByID(args.id)
+	elif args.command == 'get-folders-quota-scans':
+		api.getFoldersQuotaScans()
+	elif args.command == 'start-folder-quota-scan':
+		api.startFolderQuotaScan(args.name, args.incremental)
+	elif args.command == 'cancel-folder-quota-scan':
+		api.cancelFolderQuotaScan(args.name)
 	elif args.command == 'get-version':
 		api.getVersion()
 	elif args.command == 'get-provider-status':
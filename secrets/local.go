@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const localProviderName = "local"
+
+// localProvider encrypts the secrets using AES-256-GCM and the master keys
+// read from a local file. The file contains a base64 encoded 256 bit key for
+// each line, empty lines and lines starting with "#" are ignored.
+// The last key is used to encrypt new secrets, the previous ones are used only
+// for decryption, so a key can be rotated appending a new one to the file
+type localProvider struct {
+	keys         map[string][]byte
+	currentKeyID string
+}
+
+func newLocalProvider(masterKeyPath string) (*localProvider, error) {
+	f, err := os.Open(masterKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &localProvider{
+		keys: make(map[string][]byte),
+	}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key at line %v, it must be base64 encoded: %v", lineNumber, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid master key at line %v, it must be a 256 bit key, got %v bits",
+				lineNumber, len(key)*8)
+		}
+		keyID := getKeyID(key)
+		p.keys[keyID] = key
+		p.currentKeyID = keyID
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.keys) == 0 {
+		return nil, fmt.Errorf("no master key found in %#v", masterKeyPath)
+	}
+	return p, nil
+}
+
+func (p *localProvider) Name() string {
+	return localProviderName
+}
+
+func (p *localProvider) CurrentKeyID() string {
+	return p.currentKeyID
+}
+
+func (p *localProvider) Encrypt(data []byte) (string, string, error) {
+	gcm, err := p.getAEAD(p.currentKeyID)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, data, []byte(p.currentKeyID))
+	return p.currentKeyID, hex.EncodeToString(ciphertext), nil
+}
+
+func (p *localProvider) Decrypt(keyID, payload string) ([]byte, error) {
+	gcm, err := p.getAEAD(keyID)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(encrypted) < nonceSize {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce, ciphertext := encrypted[:nonceSize], encrypted[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func (p *localProvider) getAEAD(keyID string) (cipher.AEAD, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key with id %#v not found", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,168 @@
+// Package secrets provides encryption for the sensitive data, such as cloud
+// storage credentials, stored inside the data provider.
+// The secrets are encrypted using the configured provider, if any, before
+// they are saved and they are decrypted only when the filesystem is built.
+// If no provider is configured the secrets are encrypted using a random key
+// stored together with the encrypted data, this is the legacy behaviour
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/utils"
+)
+
+const (
+	logSender    = "secrets"
+	legacyPrefix = "$aes$"
+	prefix       = "$enc$"
+)
+
+var (
+	provider Provider
+)
+
+// Config defines the configuration for the secrets encryption
+type Config struct {
+	// Path to the file containing the master keys used to encrypt the secrets.
+	// This can be an absolute path or a path relative to the config dir.
+	// Leave empty to use the legacy encryption, the key is stored together
+	// with the encrypted data in this case
+	MasterKeyPath string `json:"master_key_path" mapstructure:"master_key_path"`
+}
+
+// Provider defines the interface for the secrets encryption backends
+type Provider interface {
+	// Name returns the provider name, it is stored together with the encrypted
+	// data and so it must not contain the "$" character
+	Name() string
+	// CurrentKeyID returns the identifier of the key used to encrypt new secrets
+	CurrentKeyID() string
+	// Encrypt encrypts data using the current key and returns the key identifier
+	// and the encrypted payload
+	Encrypt(data []byte) (string, string, error)
+	// Decrypt decrypts the given payload using the key with the given identifier
+	Decrypt(keyID, payload string) ([]byte, error)
+}
+
+// Initialize configures the secrets provider.
+// configDir is used as the base for the master key file if it is a relative path
+func Initialize(config Config, configDir string) error {
+	provider = nil
+	if len(config.MasterKeyPath) == 0 {
+		logger.Debug(logSender, "", "no master key configured, the legacy encryption will be used")
+		return nil
+	}
+	masterKeyPath := config.MasterKeyPath
+	if !filepath.IsAbs(masterKeyPath) {
+		masterKeyPath = filepath.Join(configDir, masterKeyPath)
+	}
+	p, err := newLocalProvider(masterKeyPath)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to initialize the local secrets provider: %v", err)
+		return err
+	}
+	provider = p
+	logger.Debug(logSender, "", "secrets provider %#v initialized, current key id: %#v", p.Name(), p.CurrentKeyID())
+	return nil
+}
+
+// IsConfigured returns true if a secrets provider is configured
+func IsConfigured() bool {
+	return provider != nil
+}
+
+// Encrypt encrypts the given secret using the configured provider
+func Encrypt(secret string) (string, error) {
+	if provider == nil {
+		return utils.EncryptData(secret)
+	}
+	keyID, payload, err := provider.Encrypt([]byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v%v$%v$%v", prefix, provider.Name(), keyID, payload), nil
+}
+
+// Decrypt decrypts a secret encrypted using Encrypt
+func Decrypt(secret string) (string, error) {
+	if isLegacyEncrypted(secret) {
+		return utils.DecryptData(secret)
+	}
+	if !isProviderEncrypted(secret) {
+		return "", errors.New("data to decrypt is not in the correct format")
+	}
+	vals := strings.Split(secret, "$")
+	if provider == nil {
+		return "", fmt.Errorf("unable to decrypt, secrets provider %#v is not configured", vals[2])
+	}
+	if vals[2] != provider.Name() {
+		return "", fmt.Errorf("unable to decrypt, secrets provider %#v does not match the configured one %#v",
+			vals[2], provider.Name())
+	}
+	plaintext, err := provider.Decrypt(vals[3], vals[4])
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted returns true if the given secret is already encrypted
+func IsEncrypted(secret string) bool {
+	return isLegacyEncrypted(secret) || isProviderEncrypted(secret)
+}
+
+// Mask returns the given encrypted secret without any key material so it can be
+// safely returned to the REST API clients
+func Mask(secret string) string {
+	if strings.HasPrefix(secret, legacyPrefix) {
+		return utils.RemoveDecryptionKey(secret)
+	}
+	// the key is not stored together with the data
+	return secret
+}
+
+// NeedsRotation returns true if the given encrypted secret is not encrypted using the
+// current key of the configured provider and so it should be encrypted again
+func NeedsRotation(secret string) bool {
+	if provider == nil {
+		return false
+	}
+	if isLegacyEncrypted(secret) {
+		return true
+	}
+	if !isProviderEncrypted(secret) {
+		return false
+	}
+	vals := strings.Split(secret, "$")
+	return vals[2] == provider.Name() && vals[3] != provider.CurrentKeyID()
+}
+
+// Rotate decrypts the given secret and encrypts it again using the current key.
+// The secret is returned unchanged if no rotation is needed
+func Rotate(secret string) (string, bool, error) {
+	if !NeedsRotation(secret) {
+		return secret, false, nil
+	}
+	plaintext, err := Decrypt(secret)
+	if err != nil {
+		return secret, false, err
+	}
+	encrypted, err := Encrypt(plaintext)
+	if err != nil {
+		return secret, false, err
+	}
+	return encrypted, true, nil
+}
+
+func isLegacyEncrypted(secret string) bool {
+	return strings.HasPrefix(secret, legacyPrefix) && len(strings.Split(secret, "$")) == 4
+}
+
+func isProviderEncrypted(secret string) bool {
+	return strings.HasPrefix(secret, prefix) && len(strings.Split(secret, "$")) == 5
+}
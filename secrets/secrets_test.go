@@ -0,0 +1,226 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/freshvolk/sftpgo/utils"
+)
+
+var (
+	testKey1 = []byte("0123456789abcdef0123456789abcdef")
+	testKey2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func writeMasterKeys(t *testing.T, dir string, lines ...string) string {
+	masterKeyPath := filepath.Join(dir, "master.key")
+	if err := ioutil.WriteFile(masterKeyPath, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("unable to write master keys: %v", err)
+	}
+	return masterKeyPath
+}
+
+func encodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func initializeTestProvider(t *testing.T, dir string, lines ...string) {
+	writeMasterKeys(t, dir, lines...)
+	if err := Initialize(Config{MasterKeyPath: "master.key"}, dir); err != nil {
+		t.Fatalf("unable to initialize secrets provider: %v", err)
+	}
+}
+
+func TestMasterKeysFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer Initialize(Config{}, dir) //nolint:errcheck
+
+	tests := []struct {
+		name         string
+		lines        []string
+		valid        bool
+		currentKeyID string
+	}{
+		{"single key", []string{encodeKey(testKey1)}, true, getKeyID(testKey1)},
+		{"the last key is the current one", []string{encodeKey(testKey1), encodeKey(testKey2)}, true, getKeyID(testKey2)},
+		{"comments and empty lines", []string{"# old key", encodeKey(testKey1), "", "  ", "# new key",
+			"  " + encodeKey(testKey2) + "  ", ""}, true, getKeyID(testKey2)},
+		{"no keys", []string{"# no key", ""}, false, ""},
+		{"not base64", []string{encodeKey(testKey1), "not base64!"}, false, ""},
+		{"short key", []string{base64.StdEncoding.EncodeToString(testKey1[:16])}, false, ""},
+	}
+	for _, test := range tests {
+		writeMasterKeys(t, dir, test.lines...)
+		err := Initialize(Config{MasterKeyPath: "master.key"}, dir)
+		if test.valid {
+			if err != nil || !IsConfigured() || provider.CurrentKeyID() != test.currentKeyID {
+				t.Errorf("%v: unexpected result, configured: %v err: %v", test.name, IsConfigured(), err)
+			}
+		} else if err == nil || IsConfigured() {
+			t.Errorf("%v: initialization must fail", test.name)
+		}
+	}
+	err = Initialize(Config{MasterKeyPath: filepath.Join(dir, "missing.key")}, dir)
+	if err == nil || IsConfigured() {
+		t.Errorf("initialization with a missing master key file must fail")
+	}
+	err = Initialize(Config{}, dir)
+	if err != nil || IsConfigured() {
+		t.Errorf("an empty master key path must disable the provider, err: %v", err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer Initialize(Config{}, dir) //nolint:errcheck
+
+	initializeTestProvider(t, dir, encodeKey(testKey1))
+	secret := "my secret $ with separators $"
+	encrypted, err := Encrypt(secret)
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	expectedPrefix := "$enc$local$" + getKeyID(testKey1) + "$"
+	if !strings.HasPrefix(encrypted, expectedPrefix) {
+		t.Errorf("unexpected encrypted secret %#v, expected prefix %#v", encrypted, expectedPrefix)
+	}
+	if strings.Contains(encrypted, secret) || !IsEncrypted(encrypted) || Mask(encrypted) != encrypted {
+		t.Errorf("unexpected encrypted secret %#v", encrypted)
+	}
+	decrypted, err := Decrypt(encrypted)
+	if err != nil || decrypted != secret {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", decrypted, err)
+	}
+	payload := strings.TrimPrefix(encrypted, expectedPrefix)
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"empty", ""},
+		{"plaintext", secret},
+		{"missing payload", "$enc$local$" + getKeyID(testKey1)},
+		{"too many fields", encrypted + "$extra"},
+		{"other provider", "$enc$vault$" + getKeyID(testKey1) + "$" + payload},
+		{"unknown key id", "$enc$local$0011223344556677$" + payload},
+		{"payload not hex", expectedPrefix + "not hex"},
+		{"payload too short", expectedPrefix + "0011"},
+		{"tampered payload", expectedPrefix + payload[:len(payload)-2] + "00"},
+		{"legacy without key", "$aes$" + payload},
+	}
+	for _, test := range tests {
+		if _, err := Decrypt(test.secret); err == nil {
+			t.Errorf("%v: decrypting %#v must fail", test.name, test.secret)
+		}
+		// the secrets that cannot be decrypted are never rotated
+		if rotated, changed, _ := Rotate(test.secret); changed || rotated != test.secret {
+			t.Errorf("%v: %#v must not be rotated", test.name, test.secret)
+		}
+	}
+	// a secret encrypted using a removed key cannot be decrypted
+	initializeTestProvider(t, dir, encodeKey(testKey2))
+	if _, err = Decrypt(encrypted); err == nil {
+		t.Errorf("decrypting with a removed key must fail")
+	}
+	// the key id is authenticated, a secret cannot be moved to another key
+	initializeTestProvider(t, dir, encodeKey(testKey1), encodeKey(testKey2))
+	if _, err = Decrypt("$enc$local$" + getKeyID(testKey2) + "$" + payload); err == nil {
+		t.Errorf("decrypting with a different key id must fail")
+	}
+	// without a provider the secrets encrypted using a master key cannot be decrypted
+	err = Initialize(Config{}, dir)
+	if err != nil {
+		t.Fatalf("unable to disable the secrets provider: %v", err)
+	}
+	if _, err = Decrypt(encrypted); err == nil {
+		t.Errorf("decrypting without a provider must fail")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer Initialize(Config{}, dir) //nolint:errcheck
+
+	secret := "rotated secret"
+	if err = Initialize(Config{}, dir); err != nil {
+		t.Fatalf("unable to disable the secrets provider: %v", err)
+	}
+	legacy, err := Encrypt(secret)
+	if err != nil || !strings.HasPrefix(legacy, "$aes$") {
+		t.Fatalf("unexpected legacy secret %#v, err: %v", legacy, err)
+	}
+	if NeedsRotation(legacy) {
+		t.Errorf("without a provider no rotation is needed")
+	}
+	initializeTestProvider(t, dir, encodeKey(testKey1))
+	oldKeySecret, err := Encrypt(secret)
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	initializeTestProvider(t, dir, encodeKey(testKey1), encodeKey(testKey2))
+	currentKeySecret, err := Encrypt(secret)
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	tests := []struct {
+		name          string
+		secret        string
+		needsRotation bool
+	}{
+		{"legacy", legacy, true},
+		{"previous key", oldKeySecret, true},
+		{"current key", currentKeySecret, false},
+		{"plaintext", secret, false},
+	}
+	for _, test := range tests {
+		if NeedsRotation(test.secret) != test.needsRotation {
+			t.Errorf("%v: unexpected rotation needed for %#v", test.name, test.secret)
+		}
+		rotated, changed, err := Rotate(test.secret)
+		if err != nil || changed != test.needsRotation {
+			t.Errorf("%v: unexpected rotation result, changed: %v err: %v", test.name, changed, err)
+		}
+		if !test.needsRotation {
+			if rotated != test.secret {
+				t.Errorf("%v: the secret must not be changed", test.name)
+			}
+			continue
+		}
+		if !strings.HasPrefix(rotated, "$enc$local$"+getKeyID(testKey2)+"$") || NeedsRotation(rotated) {
+			t.Errorf("%v: the secret must be encrypted using the current key: %#v", test.name, rotated)
+		}
+		decrypted, err := Decrypt(rotated)
+		if err != nil || decrypted != secret {
+			t.Errorf("%v: unexpected decrypted secret %#v, err: %v", test.name, decrypted, err)
+		}
+	}
+	// the legacy secrets can be decrypted with or without a provider
+	decrypted, err := Decrypt(legacy)
+	if err != nil || decrypted != secret {
+		t.Errorf("unexpected decrypted legacy secret %#v, err: %v", decrypted, err)
+	}
+	if Mask(legacy) != utils.RemoveDecryptionKey(legacy) || Mask(legacy) == legacy {
+		t.Errorf("the key must be removed from the masked legacy secret")
+	}
+	// a secret that cannot be decrypted is not rotated
+	broken := oldKeySecret[:len(oldKeySecret)-2] + "00"
+	rotated, changed, err := Rotate(broken)
+	if err == nil || changed || rotated != broken {
+		t.Errorf("rotating an invalid secret must fail, changed: %v err: %v", changed, err)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/freshvolk/sftpgo/dataprovider"
 	"github.com/freshvolk/sftpgo/httpd"
 	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/secrets"
 	"github.com/freshvolk/sftpgo/sftpd"
 	"github.com/freshvolk/sftpgo/utils"
 	"github.com/grandcat/zeroconf"
@@ -67,7 +68,20 @@ func (s *Service) Start() error {
 	}
 	providerConf := config.GetProviderConf()
 
-	err := dataprovider.Initialize(providerConf, s.ConfigDir)
+	err := secrets.Initialize(config.GetSecretsConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing secrets provider: %v", err)
+		logger.ErrorToConsole("error initializing secrets provider: %v", err)
+		return err
+	}
+	if !secrets.IsConfigured() && s.PortableMode != 1 {
+		logger.Warn(logSender, "", "no master key configured, the secrets stored inside the data provider are "+
+			"encrypted using keys stored together with them, configure \"master_key_path\" to protect them")
+		logger.WarnToConsole("no master key configured, the secrets stored inside the data provider are " +
+			"encrypted using keys stored together with them, configure \"master_key_path\" to protect them")
+	}
+
+	err = dataprovider.Initialize(providerConf, s.ConfigDir)
 	if err != nil {
 		logger.Error(logSender, "", "error initializing data provider: %v", err)
 		logger.ErrorToConsole("error initializing data provider: %v", err)
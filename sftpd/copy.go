@@ -0,0 +1,149 @@
+package sftpd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+var (
+	// SSH commands that copy a file server side
+	copySSHCommands = []string{"sftpgo-copy", "cp"}
+	errCopyUsage    = errors.New("usage: sftpgo-copy <source file> <destination>")
+)
+
+// handleSFTPGoCopy copies a file without transferring it to the client
+func (c *sshCommand) handleSFTPGoCopy() error {
+	if len(c.args) != 2 {
+		return c.sendErrorResponse(errCopyUsage)
+	}
+	if err := c.connection.copyFile(c.connection.getSSHPath(c.args[0]), c.getDestPath()); err != nil {
+		return c.sendErrorResponse(err)
+	}
+	c.sendExitStatus(nil)
+	return nil
+}
+
+// copyFile copies a file inside the user's filesystem.
+// The cloud storage backends that support it copy the file server side.
+// The destination is checked as an upload: permissions, file name filters,
+// retention policies, quotas and the upload size limit apply
+func (c Connection) copyFile(sshSourcePath, sshDestPath string) error {
+	fs, sourcePath, err := c.getFsAndResolvedPath(sshSourcePath)
+	if err != nil {
+		return err
+	}
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(sshSourcePath)) || !c.isFileAllowed(sshSourcePath) {
+		return errPermissionDenied
+	}
+	srcInfo, err := fs.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return fmt.Errorf("%#v is not a regular file", sshSourcePath)
+	}
+	if c.isCrossFoldersRequest(sshSourcePath, sshDestPath) {
+		return errCrossFolders
+	}
+	_, destPath, err := c.getFsAndResolvedPath(sshDestPath)
+	if err != nil {
+		return err
+	}
+	if destInfo, err := fs.Stat(destPath); err == nil && destInfo.IsDir() {
+		sshDestPath = path.Join(sshDestPath, path.Base(sshSourcePath))
+		if c.isCrossFoldersRequest(sshSourcePath, sshDestPath) {
+			return errCrossFolders
+		}
+		_, destPath, err = c.getFsAndResolvedPath(sshDestPath)
+		if err != nil {
+			return err
+		}
+	}
+	if c.User.IsVirtualFolder(sshDestPath) || sshSourcePath == sshDestPath {
+		return errPermissionDenied
+	}
+	numFiles := 1
+	var initialSize int64
+	destInfo, err := fs.Lstat(destPath)
+	if err == nil {
+		if !destInfo.Mode().IsRegular() {
+			return fmt.Errorf("%#v is not a regular file", sshDestPath)
+		}
+		// for example an hard link to the source
+		if os.SameFile(srcInfo, destInfo) {
+			return fmt.Errorf("%#v and %#v are the same file", sshSourcePath, sshDestPath)
+		}
+		if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(sshDestPath)) {
+			return errPermissionDenied
+		}
+		numFiles = 0
+		initialSize = destInfo.Size()
+	} else if !fs.IsNotExist(err) {
+		return err
+	} else if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(sshDestPath)) {
+		return errPermissionDenied
+	}
+	if !c.isFileAllowed(sshDestPath) {
+		return errPermissionDenied
+	}
+	if err = c.checkRetention(fs, destPath, sshDestPath); err != nil {
+		if err == errRetentionActive {
+			return errPermissionDenied
+		}
+		return err
+	}
+	if !c.hasSpace(numFiles > 0, sshDestPath) {
+		return errQuotaExceeded
+	}
+	if maxSize := c.getMaxUploadFileSize(); maxSize > 0 && srcInfo.Size() > maxSize {
+		go executeAction(operationUploadSizeExceeded, c.User.Username, destPath, "", "", srcInfo.Size(),
+			vfs.IsLocalOsFs(fs))
+		return errUploadFileSizeExceeded
+	}
+	if err = c.checkServerSideTransferQuota(srcInfo.Size()); err != nil {
+		return err
+	}
+	if err = c.copyFileContents(fs, sourcePath, destPath); err != nil {
+		return err
+	}
+	vfs.SetPathPermissions(fs, destPath, c.User.GetUID(), c.User.GetGID())
+	if retentionPath, retentionDays := c.getUploadRetention(fs, destPath, sshDestPath); retentionDays > 0 {
+		updateRetainUntil(c.User, retentionPath, retentionDays, c.ID)
+	}
+	updateUserOrFolderQuota(c.User, sshDestPath, numFiles, srcInfo.Size()-initialSize)
+	c.updateServerSideTransferQuota(srcInfo.Size())
+	enqueueReplication(c.User, replicationOpSync, sshDestPath, "")
+	go executeAction(operationUpload, c.User.Username, destPath, "", "", srcInfo.Size(), vfs.IsLocalOsFs(fs))
+	return nil
+}
+
+// copyFileContents copies sourcePath to destPath. If the filesystem supports atomic uploads the
+// contents are copied to a temporary file that is then renamed, as for the atomic uploads, so an
+// existing destination is never truncated and a failed copy leaves it unchanged
+func (c Connection) copyFileContents(fs vfs.Fs, sourcePath, destPath string) error {
+	copyPath := destPath
+	if fs.IsAtomicUploadSupported() {
+		copyPath = fs.GetAtomicUploadPath(destPath)
+	}
+	c.Log(logger.LevelDebug, logSenderSSH, "copying %#v -> %#v", sourcePath, copyPath)
+	err := vfs.CopyFile(fs, sourcePath, copyPath)
+	if err == nil && copyPath != destPath {
+		err = fs.Rename(copyPath, destPath)
+	}
+	if err != nil {
+		c.Log(logger.LevelWarn, logSenderSSH, "unable to copy %#v -> %#v: %v", sourcePath, destPath, err)
+		if copyPath != destPath {
+			if errRemove := fs.Remove(copyPath, false); errRemove != nil && !fs.IsNotExist(errRemove) {
+				c.Log(logger.LevelWarn, logSenderSSH, "unable to remove the temporary copy %#v: %v", copyPath, errRemove)
+			}
+		}
+		return err
+	}
+	return nil
+}
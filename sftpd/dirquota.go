@@ -0,0 +1,191 @@
+package sftpd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+// updateDirQuotas updates the used quota for the user's directory quotas that include the given SFTP path
+func updateDirQuotas(user dataprovider.User, requestPath string, filesAdd int, sizeAdd int64) {
+	for _, q := range user.GetDirQuotasForPath(requestPath) {
+		dataprovider.UpdateDirQuota(dataProvider, user, q.Path, filesAdd, sizeAdd, false) //nolint:errcheck
+	}
+}
+
+// hasDirSpace returns false if a directory quota that includes the given SFTP path is exceeded
+func (c Connection) hasDirSpace(checkFiles bool, requestPath string) bool {
+	quotas := c.User.GetDirQuotasForPath(requestPath)
+	if len(quotas) == 0 {
+		return true
+	}
+	usage, err := dataprovider.GetDirQuotasUsage(dataProvider, c.User)
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			c.Log(logger.LevelWarn, logSender, "directory quota enforcement not possible for user %#v: %v", c.User.Username, err)
+			return true
+		}
+		c.Log(logger.LevelWarn, logSender, "error getting used directory quotas for %#v: %v", c.User.Username, err)
+		return false
+	}
+	for _, q := range quotas {
+		for _, u := range usage {
+			if u.Path != q.Path {
+				continue
+			}
+			if (checkFiles && u.QuotaFiles > 0 && u.UsedQuotaFiles >= u.QuotaFiles) ||
+				(u.QuotaSize > 0 && u.UsedQuotaSize >= u.QuotaSize) {
+				c.Log(logger.LevelDebug, logSender, "quota exceed for user %#v, directory %#v, num files: %v/%v, size: %v/%v "+
+					"check files: %v", c.User.Username, u.Path, u.UsedQuotaFiles, u.QuotaFiles, u.UsedQuotaSize, u.QuotaSize,
+					checkFiles)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getRenameDirQuotas returns the directory quotas that include only the source path
+// and the ones that include only the target path
+func getRenameDirQuotas(user dataprovider.User, source, target string) ([]dataprovider.DirQuota, []dataprovider.DirQuota) {
+	sourceQuotas := user.GetDirQuotasForPath(source)
+	targetQuotas := user.GetDirQuotasForPath(target)
+	return getMissingDirQuotas(sourceQuotas, targetQuotas), getMissingDirQuotas(targetQuotas, sourceQuotas)
+}
+
+// getMissingDirQuotas returns the quotas inside list that are not inside others
+func getMissingDirQuotas(list, others []dataprovider.DirQuota) []dataprovider.DirQuota {
+	var result []dataprovider.DirQuota
+	for _, q := range list {
+		found := false
+		for _, o := range others {
+			if o.Path == q.Path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, q)
+		}
+	}
+	return result
+}
+
+// checkRenameDirQuotas returns the number of files, and their size, moved between directory quotas
+// renaming sourcePath. An error is returned if the moved files exceed a target directory quota
+func (c Connection) checkRenameDirQuotas(fs vfs.Fs, sourcePath, source, target string) (int, int64, error) {
+	removed, added := getRenameDirQuotas(c.User, source, target)
+	if len(removed) == 0 && len(added) == 0 {
+		return 0, 0, nil
+	}
+	numFiles, size, err := getDirContentsUsage(context.Background(), fs, sourcePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(added) == 0 || (numFiles == 0 && size == 0) {
+		return numFiles, size, nil
+	}
+	usage, err := dataprovider.GetDirQuotasUsage(dataProvider, c.User)
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			return numFiles, size, nil
+		}
+		return numFiles, size, err
+	}
+	for _, q := range added {
+		for _, u := range usage {
+			if u.Path != q.Path {
+				continue
+			}
+			if (u.QuotaFiles > 0 && u.UsedQuotaFiles+numFiles > u.QuotaFiles) ||
+				(u.QuotaSize > 0 && u.UsedQuotaSize+size > u.QuotaSize) {
+				return numFiles, size, fmt.Errorf("quota exceeded for directory %#v", u.Path)
+			}
+		}
+	}
+	return numFiles, size, nil
+}
+
+// updateRenameDirQuotas moves the given number of files, and their size, from the directory
+// quotas that include only the source path to the ones that include only the target path
+func updateRenameDirQuotas(user dataprovider.User, source, target string, numFiles int, size int64) {
+	if numFiles == 0 && size == 0 {
+		return
+	}
+	removed, added := getRenameDirQuotas(user, source, target)
+	for _, q := range removed {
+		dataprovider.UpdateDirQuota(dataProvider, user, q.Path, -numFiles, -size, false) //nolint:errcheck
+	}
+	for _, q := range added {
+		dataprovider.UpdateDirQuota(dataProvider, user, q.Path, numFiles, size, false) //nolint:errcheck
+	}
+}
+
+// getDirContentsUsage returns the number of regular files, and their size, for the given
+// file or for the files inside the given directory and its sub directories
+func getDirContentsUsage(ctx context.Context, fs vfs.Fs, fsPath string) (int, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	fi, err := fs.Lstat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return 0, 0, nil
+	}
+	if !fi.IsDir() {
+		return 1, fi.Size(), nil
+	}
+	contents, err := fs.ReadDir(fsPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	numFiles := 0
+	size := int64(0)
+	for _, child := range contents {
+		if child.IsDir() {
+			files, dirSize, err := getDirContentsUsage(ctx, fs, fs.Join(fsPath, child.Name()))
+			if err != nil {
+				return numFiles, size, err
+			}
+			numFiles += files
+			size += dirSize
+		} else if child.Mode().IsRegular() {
+			numFiles++
+			size += child.Size()
+		}
+	}
+	return numFiles, size, nil
+}
+
+// ScanUserDirQuotas scans the directories with a quota restriction for the active quota scan
+// added for the specified user using AddQuotaScan and updates their used quota
+func ScanUserDirQuotas(user dataprovider.User, fs vfs.Fs) error {
+	monitor := getQuotaScanMonitor(user.Username)
+	if monitor == nil {
+		return fmt.Errorf("quota scan not found for user: %v", user.Username)
+	}
+	for _, q := range user.Filters.DirQuotas {
+		fsPath, err := fs.ResolvePath(q.Path)
+		if err != nil {
+			return err
+		}
+		numFiles, size, err := getDirContentsUsage(monitor.ctx, fs, fsPath)
+		if err != nil {
+			return err
+		}
+		err = dataprovider.UpdateDirQuota(dataProvider, user, q.Path, numFiles, size, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
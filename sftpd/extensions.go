@@ -0,0 +1,202 @@
+package sftpd
+
+import (
+	"math"
+	"os"
+	"path"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/vfs"
+	"github.com/pkg/sftp"
+)
+
+const (
+	linkLogSender = "Link"
+	// block size reported by statvfs if the filesystem ones cannot be read
+	defaultStatVFSBlockSize = 4096
+	defaultStatVFSNameMax   = 255
+)
+
+// PosixRename is the handler for the posix-rename@openssh.com extension.
+// Our renames always overwrite an existing target, so the same checks as
+// for standard renames apply
+func (c Connection) PosixRename(request *sftp.Request) error {
+	return c.Filecmd(request)
+}
+
+// StatVFS is the handler for the statvfs@openssh.com extension.
+// If the user, or the virtual folder containing the requested path, has a quota
+// restriction the quota limits and the remaining quota are reported, otherwise
+// the stats for the underlying local filesystem are returned if available
+func (c Connection) StatVFS(request *sftp.Request) (*sftp.StatVFS, error) {
+	updateConnectionActivity(c.ID)
+
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	fs, p, err := c.getFsAndResolvedPath(request.Filepath)
+	if err != nil {
+		return nil, vfs.GetSFTPError(fs, err)
+	}
+	c.Log(logger.LevelDebug, logSender, "requested statvfs for path: %#v", p)
+
+	var fsStat *sftp.StatVFS
+	if vfs.IsLocalOsFs(fs) {
+		fsStat, err = getStatVFS(p)
+		if err != nil && err != sftp.ErrSSHFxOpUnsupported {
+			c.Log(logger.LevelWarn, logSender, "unable to get filesystem stats for path %#v: %v", p, err)
+			return nil, vfs.GetSFTPError(fs, err)
+		}
+	}
+	quotaFiles, quotaSize, usedFiles, usedSize, err := c.getQuotaUsage(request.Filepath)
+	if err != nil {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	if quotaFiles == 0 && quotaSize == 0 {
+		if fsStat == nil {
+			return nil, sftp.ErrSSHFxOpUnsupported
+		}
+		return fsStat, nil
+	}
+	return getQuotaStatVFS(fsStat, quotaFiles, quotaSize, usedFiles, usedSize), nil
+}
+
+// getQuotaUsage returns the quota limits and the used quota for the given SFTP path.
+// The limits are 0 if quota tracking is disabled
+func (c Connection) getQuotaUsage(requestPath string) (int, int64, int, int64, error) {
+	var quotaFiles, usedFiles int
+	var quotaSize, usedSize int64
+	var err error
+	if folder, errFolder := c.User.GetVirtualFolderForPath(requestPath); errFolder == nil {
+		quotaFiles, quotaSize = folder.QuotaFiles, folder.QuotaSize
+		if quotaFiles == 0 && quotaSize == 0 {
+			return 0, 0, 0, 0, nil
+		}
+		usedFiles, usedSize, err = dataprovider.GetUsedVirtualFolderQuota(dataProvider, folder.Name)
+	} else {
+		quotaFiles, quotaSize = c.User.QuotaFiles, c.User.QuotaSize
+		if quotaFiles == 0 && quotaSize == 0 {
+			return 0, 0, 0, 0, nil
+		}
+		usedFiles, usedSize, err = dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+	}
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			return 0, 0, 0, 0, nil
+		}
+		c.Log(logger.LevelWarn, logSender, "error getting used quota for path %#v: %v", requestPath, err)
+		return 0, 0, 0, 0, err
+	}
+	return quotaFiles, quotaSize, usedFiles, usedSize, nil
+}
+
+// getQuotaStatVFS returns the statvfs response for a quota restricted path.
+// The free space is the remaining quota capped to the filesystem free space, if known
+func getQuotaStatVFS(fsStat *sftp.StatVFS, quotaFiles int, quotaSize int64, usedFiles int, usedSize int64) *sftp.StatVFS {
+	stat := &sftp.StatVFS{
+		Bsize:   defaultStatVFSBlockSize,
+		Frsize:  defaultStatVFSBlockSize,
+		Blocks:  math.MaxUint64 / defaultStatVFSBlockSize,
+		Bfree:   math.MaxUint64 / defaultStatVFSBlockSize,
+		Bavail:  math.MaxUint64 / defaultStatVFSBlockSize,
+		Files:   math.MaxUint64,
+		Ffree:   math.MaxUint64,
+		Favail:  math.MaxUint64,
+		Namemax: defaultStatVFSNameMax,
+	}
+	if fsStat != nil {
+		*stat = *fsStat
+	}
+	if stat.Frsize == 0 {
+		stat.Frsize = stat.Bsize
+	}
+	if quotaSize > 0 {
+		var remaining uint64
+		if usedSize < quotaSize {
+			remaining = uint64(quotaSize-usedSize) / stat.Frsize
+		}
+		stat.Blocks = uint64(quotaSize) / stat.Frsize
+		stat.Bfree = minUint64(remaining, stat.Bfree)
+		stat.Bavail = minUint64(remaining, stat.Bavail)
+	}
+	if quotaFiles > 0 {
+		var remaining uint64
+		if usedFiles < quotaFiles {
+			remaining = uint64(quotaFiles - usedFiles)
+		}
+		stat.Files = uint64(quotaFiles)
+		stat.Ffree = minUint64(remaining, stat.Ffree)
+		stat.Favail = minUint64(remaining, stat.Favail)
+	}
+	return stat
+}
+
+// handleSFTPLink creates an hard link, this is only supported for the local filesystem.
+// The new link is a new file for quota purposes, the quota scans count it too
+func (c Connection) handleSFTPLink(fs vfs.Fs, sourcePath string, targetPath string, request *sftp.Request) error {
+	if !vfs.IsLocalOsFs(fs) {
+		c.Log(logger.LevelWarn, logSender, "hard links are not supported for filesystem %v", fs.Name())
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if c.User.IsVirtualFolder(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "hard linking to a virtual folder is not allowed")
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if c.isCrossFoldersRequest(request.Filepath, request.Target) {
+		c.Log(logger.LevelWarn, logSender, "cannot create hard link %#v -> %#v: %v", request.Filepath, request.Target,
+			errCrossFolders)
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if !c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(request.Target)) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	// the link gives access to the source contents, so the same permissions as for a copy are required
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) ||
+		!c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.isFileAllowed(request.Filepath) || !c.isFileAllowed(request.Target) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	info, err := fs.Lstat(sourcePath)
+	if err != nil {
+		return vfs.GetSFTPError(fs, err)
+	}
+	if !info.Mode().IsRegular() {
+		c.Log(logger.LevelWarn, logSender, "hard links are only allowed for regular files, source: %#v", request.Filepath)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	// a link shares the contents with its source, a locked file could be modified using a link and
+	// a file inside a retention directory could be modified using its source
+	if err := c.checkRetention(fs, sourcePath, request.Filepath); err != nil {
+		if err == errRetentionActive {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return vfs.GetSFTPError(fs, err)
+	}
+	if c.isRetentionPath(fs, targetPath, request.Target) {
+		c.Log(logger.LevelInfo, logSender, "hard links inside the retention directories are not allowed, target: %#v",
+			request.Target)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.hasSpace(true, request.Target) {
+		c.Log(logger.LevelInfo, logSender, "denying hard link creation due to space limit")
+		return sftp.ErrSSHFxFailure
+	}
+	if err := os.Link(sourcePath, targetPath); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to create hard link %#v -> %#v: %v", sourcePath, targetPath, err)
+		return vfs.GetSFTPError(fs, err)
+	}
+	updateUserOrFolderQuota(c.User, request.Target, 1, info.Size())
+	logger.CommandLog(linkLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	enqueueReplication(c.User, replicationOpSync, request.Target, "")
+	return nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,34 @@
+package sftpd
+
+import (
+	"os"
+	"path"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+)
+
+// isFileAllowed returns false, and logs the denied request, if the file patterns filters
+// do not allow the file or directory with the given SFTP path
+func (c Connection) isFileAllowed(requestPath string) bool {
+	if c.User.IsFileAllowed(requestPath) {
+		return true
+	}
+	c.Log(logger.LevelInfo, logSender, "file name %#v is denied by the file patterns filters", requestPath)
+	return false
+}
+
+// hideDeniedFiles removes the files and directories denied by the file patterns filters
+// from the given directory listing
+func hideDeniedFiles(user dataprovider.User, files []os.FileInfo, requestPath string) []os.FileInfo {
+	if len(user.Filters.FilePatterns) == 0 {
+		return files
+	}
+	result := files[:0]
+	for _, fi := range files {
+		if user.IsFileAllowed(path.Join(requestPath, fi.Name())) {
+			result = append(result, fi)
+		}
+	}
+	return result
+}
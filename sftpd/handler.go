@@ -1,6 +1,8 @@
 package sftpd
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -36,8 +38,17 @@ type Connection struct {
 	channel      ssh.Channel
 	command      string
 	fs           vfs.Fs
+	// filesystems for the user's virtual folders, the virtual path is the key
+	folderFs map[string]vfs.Fs
+	// current directory for SSH commands and the interactive shell, nil means "/"
+	workingDir *sshWorkingDir
 }
 
+var (
+	errFolderUnavailable = errors.New("virtual folder unavailable")
+	errCrossFolders      = errors.New("operation across different virtual folders is not allowed")
+)
+
 // Log outputs a log entry to the configured logger
 func (c Connection) Log(level logger.LogLevel, sender string, format string, v ...interface{}) {
 	logger.Log(level, sender, c.ID, format, v...)
@@ -51,20 +62,30 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	p, err := c.fs.ResolvePath(request.Filepath)
+	if !c.isFileAllowed(request.Filepath) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	fs, p, err := c.getFsAndResolvedPath(request.Filepath)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
-	fi, err := c.fs.Stat(p)
+	fi, err := fs.Stat(p)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
-	file, r, cancelFn, err := c.fs.Open(p)
+	_, err = c.getRemainingTransferQuota(transferDownload)
+	if err != nil {
+		c.Log(logger.LevelInfo, logSender, "denying file read: %v", err)
+		return nil, sftp.ErrSSHFxFailure
+	}
+
+	file, r, cancelFn, err := fs.Open(p)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "could not open file %#v for reading: %v", p, err)
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	c.Log(logger.LevelDebug, logSender, "fileread requested for path: %#v", p)
@@ -75,6 +96,7 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		writerAt:       nil,
 		cancelFn:       cancelFn,
 		path:           p,
+		requestPath:    request.Filepath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -97,27 +119,30 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 // Filewrite handles the write actions for a file on the system.
 func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	updateConnectionActivity(c.ID)
-	p, err := c.fs.ResolvePath(request.Filepath)
+	if !c.isFileAllowed(request.Filepath) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	fs, p, err := c.getFsAndResolvedPath(request.Filepath)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	filePath := p
-	if isAtomicUploadEnabled() && c.fs.IsAtomicUploadSupported() {
-		filePath = c.fs.GetAtomicUploadPath(p)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		filePath = fs.GetAtomicUploadPath(p)
 	}
 
-	stat, statErr := c.fs.Stat(p)
-	if c.fs.IsNotExist(statErr) {
+	stat, statErr := fs.Stat(p)
+	if fs.IsNotExist(statErr) {
 		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSSHFxPermissionDenied
 		}
-		return c.handleSFTPUploadToNewFile(p, filePath)
+		return c.handleSFTPUploadToNewFile(fs, p, filePath, request.Filepath)
 	}
 
 	if statErr != nil {
 		c.Log(logger.LevelError, logSender, "error performing file stat %#v: %v", p, statErr)
-		return nil, vfs.GetSFTPError(c.fs, statErr)
+		return nil, vfs.GetSFTPError(fs, statErr)
 	}
 
 	// This happen if we upload a file that has the same name of an existing directory
@@ -130,7 +155,11 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	return c.handleSFTPUploadToExistingFile(request.Pflags(), p, filePath, stat.Size())
+	if err = c.checkRetention(fs, p, request.Filepath); err != nil {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	return c.handleSFTPUploadToExistingFile(fs, request.Pflags(), p, filePath, stat.Size(), request.Filepath)
 }
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
@@ -138,9 +167,9 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 func (c Connection) Filecmd(request *sftp.Request) error {
 	updateConnectionActivity(c.ID)
 
-	p, err := c.fs.ResolvePath(request.Filepath)
+	fs, p, err := c.getFsAndResolvedPath(request.Filepath)
 	if err != nil {
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 	target, err := c.getSFTPCmdTargetPath(request.Target)
 	if err != nil {
@@ -152,28 +181,33 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 
 	switch request.Method {
 	case "Setstat":
-		return c.handleSFTPSetstat(p, request)
-	case "Rename":
-		if err = c.handleSFTPRename(p, target, request); err != nil {
+		return c.handleSFTPSetstat(fs, p, request)
+	case "Rename", "PosixRename":
+		if err = c.handleSFTPRename(fs, p, target, request); err != nil {
 			return err
 		}
 		break
 	case "Rmdir":
-		return c.handleSFTPRmdir(p, request)
+		return c.handleSFTPRmdir(fs, p, request)
 
 	case "Mkdir":
-		err = c.handleSFTPMkdir(p, request)
+		err = c.handleSFTPMkdir(fs, p, request)
 		if err != nil {
 			return err
 		}
 		break
 	case "Symlink":
-		if err = c.handleSFTPSymlink(p, target, request); err != nil {
+		if err = c.handleSFTPSymlink(fs, p, target, request); err != nil {
 			return err
 		}
 		break
 	case "Remove":
-		return c.handleSFTPRemove(p, request)
+		return c.handleSFTPRemove(fs, p, request)
+	case "Link":
+		if err = c.handleSFTPLink(fs, p, target, request); err != nil {
+			return err
+		}
+		break
 
 	default:
 		return sftp.ErrSSHFxOpUnsupported
@@ -185,7 +219,7 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 	}
 
 	// we return if we remove a file or a dir so source path or target path always exists here
-	vfs.SetPathPermissions(c.fs, fileLocation, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, fileLocation, c.User.GetUID(), c.User.GetGID())
 
 	return sftp.ErrSSHFxOk
 }
@@ -194,9 +228,9 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 // a directory as well as perform file/folder stat calls.
 func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	updateConnectionActivity(c.ID)
-	p, err := c.fs.ResolvePath(request.Filepath)
+	fs, p, err := c.getFsAndResolvedPath(request.Filepath)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	switch request.Method {
@@ -207,23 +241,28 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 
 		c.Log(logger.LevelDebug, logSender, "requested list file for dir: %#v", p)
 
-		files, err := c.fs.ReadDir(p)
+		files, err := fs.ReadDir(p)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error listing directory: %#v", err)
-			return nil, vfs.GetSFTPError(c.fs, err)
+			return nil, vfs.GetSFTPError(fs, err)
+		}
+
+		if c.User.Filters.Trash.Enabled {
+			files = hideTrashDir(files, request.Filepath)
 		}
+		files = hideDeniedFiles(c.User, files, request.Filepath)
 
-		return listerAt(files), nil
+		return listerAt(c.User.AddVirtualDirs(files, request.Filepath)), nil
 	case "Stat":
 		if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSSHFxPermissionDenied
 		}
 
 		c.Log(logger.LevelDebug, logSender, "requested stat for path: %#v", p)
-		s, err := c.fs.Stat(p)
+		s, err := fs.Stat(p)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error running stat on path: %#v", err)
-			return nil, vfs.GetSFTPError(c.fs, err)
+			return nil, vfs.GetSFTPError(fs, err)
 		}
 
 		return listerAt([]os.FileInfo{s}), nil
@@ -238,33 +277,86 @@ func (c Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	// location for the server. If it is not, return an error
 	if len(requestTarget) > 0 {
 		var err error
-		target, err = c.fs.ResolvePath(requestTarget)
+		var fs vfs.Fs
+		fs, target, err = c.getFsAndResolvedPath(requestTarget)
 		if err != nil {
-			return target, vfs.GetSFTPError(c.fs, err)
+			return target, vfs.GetSFTPError(fs, err)
 		}
 	}
 	return target, nil
 }
 
-func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) error {
+// getFsForPath returns the filesystem that serves the given SFTP path and the
+// virtual folder that contains it, if any. If the path is inside a virtual
+// folder whose filesystem cannot be used the user's filesystem is returned
+// together with an error
+func (c Connection) getFsForPath(sftpPath string) (vfs.Fs, dataprovider.VirtualFolder, error) {
+	folder, err := c.User.GetVirtualFolderForPath(sftpPath)
+	if err != nil {
+		return c.fs, folder, nil
+	}
+	if fs, ok := c.folderFs[folder.VirtualPath]; ok {
+		return fs, folder, nil
+	}
+	c.Log(logger.LevelWarn, logSender, "no filesystem available for virtual folder %#v mounted on %#v", folder.Name,
+		folder.VirtualPath)
+	return c.fs, folder, errFolderUnavailable
+}
+
+// getFsAndResolvedPath returns the filesystem that serves the given SFTP path and the
+// path resolved for that filesystem
+func (c Connection) getFsAndResolvedPath(sftpPath string) (vfs.Fs, string, error) {
+	if c.User.Filters.Trash.Enabled && isTrashPath(sftpPath) {
+		c.Log(logger.LevelWarn, logSender, "access to the trash is not allowed, path: %#v", sftpPath)
+		return c.fs, "", &os.PathError{Op: "access", Path: sftpPath, Err: os.ErrPermission}
+	}
+	fs, folder, err := c.getFsForPath(sftpPath)
+	if err != nil {
+		return fs, "", err
+	}
+	if len(folder.VirtualPath) > 0 {
+		sftpPath = folder.GetRelativePath(sftpPath)
+	}
+	resolved, err := fs.ResolvePath(sftpPath)
+	return fs, resolved, err
+}
+
+// isCrossFoldersRequest returns true if the given SFTP paths are served by different
+// filesystems, for example the user's home dir and a virtual folder
+func (c Connection) isCrossFoldersRequest(sourcePath, targetPath string) bool {
+	sourceFolder, errSrc := c.User.GetVirtualFolderForPath(sourcePath)
+	targetFolder, errDst := c.User.GetVirtualFolderForPath(targetPath)
+	if errSrc != nil && errDst != nil {
+		return false
+	}
+	if errSrc == nil && errDst == nil {
+		return sourceFolder.VirtualPath != targetFolder.VirtualPath
+	}
+	return true
+}
+
+func (c Connection) handleSFTPSetstat(fs vfs.Fs, filePath string, request *sftp.Request) error {
 	if setstatMode == 1 {
 		return nil
 	}
 	pathForPerms := request.Filepath
-	if fi, err := c.fs.Lstat(filePath); err == nil {
+	if fi, err := fs.Lstat(filePath); err == nil {
 		if fi.IsDir() {
 			pathForPerms = path.Dir(request.Filepath)
 		}
 	}
+	if err := c.checkRetention(fs, filePath, request.Filepath); err != nil {
+		return sftp.ErrSSHFxPermissionDenied
+	}
 	attrFlags := request.AttrFlags()
 	if attrFlags.Permissions {
 		if !c.User.HasPerm(dataprovider.PermChmod, pathForPerms) {
 			return sftp.ErrSSHFxPermissionDenied
 		}
 		fileMode := request.Attributes().FileMode()
-		if err := c.fs.Chmod(filePath, fileMode); err != nil {
+		if err := fs.Chmod(filePath, fileMode); err != nil {
 			c.Log(logger.LevelWarn, logSender, "failed to chmod path %#v, mode: %v, err: %v", filePath, fileMode.String(), err)
-			return vfs.GetSFTPError(c.fs, err)
+			return vfs.GetSFTPError(fs, err)
 		}
 		logger.CommandLog(chmodLogSender, filePath, "", c.User.Username, fileMode.String(), c.ID, c.protocol, -1, -1, "", "", "")
 		return nil
@@ -274,9 +366,9 @@ func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) er
 		}
 		uid := int(request.Attributes().UID)
 		gid := int(request.Attributes().GID)
-		if err := c.fs.Chown(filePath, uid, gid); err != nil {
+		if err := fs.Chown(filePath, uid, gid); err != nil {
 			c.Log(logger.LevelWarn, logSender, "failed to chown path %#v, uid: %v, gid: %v, err: %v", filePath, uid, gid, err)
-			return vfs.GetSFTPError(c.fs, err)
+			return vfs.GetSFTPError(fs, err)
 		}
 		logger.CommandLog(chownLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, uid, gid, "", "", "")
 		return nil
@@ -289,10 +381,10 @@ func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) er
 		modificationTime := time.Unix(int64(request.Attributes().Mtime), 0)
 		accessTimeString := accessTime.Format(dateFormat)
 		modificationTimeString := modificationTime.Format(dateFormat)
-		if err := c.fs.Chtimes(filePath, accessTime, modificationTime); err != nil {
+		if err := fs.Chtimes(filePath, accessTime, modificationTime); err != nil {
 			c.Log(logger.LevelWarn, logSender, "failed to chtimes for path %#v, access time: %v, modification time: %v, err: %v",
 				filePath, accessTime, modificationTime, err)
-			return vfs.GetSFTPError(c.fs, err)
+			return vfs.GetSFTPError(fs, err)
 		}
 		logger.CommandLog(chtimesLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, accessTimeString,
 			modificationTimeString, "")
@@ -301,84 +393,148 @@ func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) er
 	return nil
 }
 
-func (c Connection) handleSFTPRename(sourcePath string, targetPath string, request *sftp.Request) error {
-	if c.fs.GetRelativePath(sourcePath) == "/" {
+func (c Connection) handleSFTPRename(fs vfs.Fs, sourcePath string, targetPath string, request *sftp.Request) error {
+	if c.User.IsVirtualFolder(request.Filepath) || c.User.IsVirtualFolder(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "renaming a virtual folder is not allowed")
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if fs.GetRelativePath(sourcePath) == "/" {
 		c.Log(logger.LevelWarn, logSender, "renaming root dir is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
+	if c.User.HasVirtualFoldersInside(request.Filepath) || c.User.HasVirtualFoldersInside(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "renaming a directory with virtual folders inside is not allowed")
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if c.isCrossFoldersRequest(request.Filepath, request.Target) {
+		c.Log(logger.LevelWarn, logSender, "cannot rename %#v -> %#v: %v", request.Filepath, request.Target, errCrossFolders)
+		return sftp.ErrSSHFxOpUnsupported
+	}
 	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(request.Target)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
-	if err := c.fs.Rename(sourcePath, targetPath); err != nil {
+	if !c.isFileAllowed(request.Target) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if err := c.checkRenameRetention(fs, sourcePath, targetPath, request.Filepath, request.Target); err != nil {
+		if err == errRetentionActive {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return vfs.GetSFTPError(fs, err)
+	}
+	movedFiles, movedSize, err := c.checkRenameDirQuotas(fs, sourcePath, request.Filepath, request.Target)
+	if err != nil {
+		c.Log(logger.LevelInfo, logSender, "denying rename %#v -> %#v: %v", request.Filepath, request.Target, err)
+		return sftp.ErrSSHFxFailure
+	}
+	if err := fs.Rename(sourcePath, targetPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to rename file, source: %#v target: %#v: %v", sourcePath, targetPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
+	updateRenameDirQuotas(c.User, request.Filepath, request.Target, movedFiles, movedSize)
 	logger.CommandLog(renameLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
-	go executeAction(operationRename, c.User.Username, sourcePath, targetPath, "", 0, vfs.IsLocalOsFs(c.fs))
+	enqueueReplication(c.User, replicationOpRename, request.Filepath, request.Target)
+	go executeAction(operationRename, c.User.Username, sourcePath, targetPath, "", 0, vfs.IsLocalOsFs(fs))
 	return nil
 }
 
-func (c Connection) handleSFTPRmdir(dirPath string, request *sftp.Request) error {
-	if c.fs.GetRelativePath(dirPath) == "/" {
+func (c Connection) handleSFTPRmdir(fs vfs.Fs, dirPath string, request *sftp.Request) error {
+	if c.User.IsVirtualFolder(request.Filepath) {
+		c.Log(logger.LevelWarn, logSender, "removing a virtual folder is not allowed: %#v", request.Filepath)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if fs.GetRelativePath(dirPath) == "/" {
 		c.Log(logger.LevelWarn, logSender, "removing root dir is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
+	if c.User.HasVirtualFoldersInside(request.Filepath) {
+		c.Log(logger.LevelWarn, logSender, "removing a directory with virtual folders inside is not allowed: %#v",
+			request.Filepath)
+		return sftp.ErrSSHFxOpUnsupported
+	}
 	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(request.Filepath)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
 
 	var fi os.FileInfo
 	var err error
-	if fi, err = c.fs.Lstat(dirPath); err != nil {
+	if fi, err = fs.Lstat(dirPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove a dir %#v: stat error: %v", dirPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 	if !fi.IsDir() || fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		c.Log(logger.LevelDebug, logSender, "cannot remove %#v is not a directory", dirPath)
 		return sftp.ErrSSHFxFailure
 	}
 
-	if err = c.fs.Remove(dirPath, true); err != nil {
+	if c.isTrashEnabledForPath(request.Filepath) {
+		err = c.moveDirToTrash(fs, dirPath, request.Filepath)
+	} else {
+		err = fs.Remove(dirPath, true)
+	}
+	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove directory %#v: %v", dirPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 
 	logger.CommandLog(rmdirLogSender, dirPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	enqueueReplication(c.User, replicationOpRemove, request.Filepath, "")
 	return sftp.ErrSSHFxOk
 }
 
-func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string, request *sftp.Request) error {
-	if c.fs.GetRelativePath(sourcePath) == "/" {
+func (c Connection) handleSFTPSymlink(fs vfs.Fs, sourcePath string, targetPath string, request *sftp.Request) error {
+	if fs.GetRelativePath(sourcePath) == "/" {
 		c.Log(logger.LevelWarn, logSender, "symlinking root dir is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
+	if c.User.IsVirtualFolder(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "symlinking a virtual folder is not allowed")
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if c.isCrossFoldersRequest(request.Filepath, request.Target) {
+		c.Log(logger.LevelWarn, logSender, "cannot create symlink %#v -> %#v: %v", request.Filepath, request.Target,
+			errCrossFolders)
+		return sftp.ErrSSHFxOpUnsupported
+	}
 	if !c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(request.Target)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
-	if err := c.fs.Symlink(sourcePath, targetPath); err != nil {
+	if !c.isFileAllowed(request.Target) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if c.isRetentionPath(fs, sourcePath, request.Filepath) {
+		c.Log(logger.LevelInfo, logSender, "symlinks to the retention directories are not allowed, target: %#v",
+			request.Filepath)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if err := fs.Symlink(sourcePath, targetPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to create symlink %#v -> %#v: %v", sourcePath, targetPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 
 	logger.CommandLog(symlinkLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
 	return nil
 }
 
-func (c Connection) handleSFTPMkdir(dirPath string, request *sftp.Request) error {
+func (c Connection) handleSFTPMkdir(fs vfs.Fs, dirPath string, request *sftp.Request) error {
 	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(request.Filepath)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
-	if err := c.fs.Mkdir(dirPath); err != nil {
+	if !c.isFileAllowed(request.Filepath) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if err := fs.Mkdir(dirPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "error creating missing dir: %#v error: %v", dirPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
-	vfs.SetPathPermissions(c.fs, dirPath, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, dirPath, c.User.GetUID(), c.User.GetGID())
 
 	logger.CommandLog(mkdirLogSender, dirPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	enqueueReplication(c.User, replicationOpSync, request.Filepath, "")
 	return nil
 }
 
-func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) error {
+func (c Connection) handleSFTPRemove(fs vfs.Fs, filePath string, request *sftp.Request) error {
 	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(request.Filepath)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
@@ -386,49 +542,96 @@ func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) err
 	var size int64
 	var fi os.FileInfo
 	var err error
-	if fi, err = c.fs.Lstat(filePath); err != nil {
+	if fi, err = fs.Lstat(filePath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove a file %#v: stat error: %v", filePath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 	if fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink {
 		c.Log(logger.LevelDebug, logSender, "cannot remove %#v is not a file/symlink", filePath)
 		return sftp.ErrSSHFxFailure
 	}
+	if err = c.checkRetentionNoFollow(fs, filePath, request.Filepath); err != nil {
+		return sftp.ErrSSHFxPermissionDenied
+	}
 	size = fi.Size()
-	if err := c.fs.Remove(filePath, false); err != nil {
+	isTrashed := c.isTrashEnabledForPath(request.Filepath)
+	if isTrashed {
+		err = moveToTrash(fs, c.User, filePath, request.Filepath)
+	} else {
+		err = fs.Remove(filePath, false)
+	}
+	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove a file/symlink %#v: %v", filePath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 
 	logger.CommandLog(removeLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	enqueueReplication(c.User, replicationOpRemove, request.Filepath, "")
+	// the trashed files are removed from the quota when they are purged if they are included in it
 	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -size, false)
+		if !isTrashed || !c.User.Filters.Trash.CountInQuota {
+			updateUserOrFolderQuota(c.User, request.Filepath, -1, -size)
+		} else {
+			// the trash is outside the directories with a quota restriction
+			updateDirQuotas(c.User, request.Filepath, -1, -size)
+		}
 	}
-	go executeAction(operationDelete, c.User.Username, filePath, "", "", fi.Size(), vfs.IsLocalOsFs(c.fs))
+	go executeAction(operationDelete, c.User.Username, filePath, "", "", fi.Size(), vfs.IsLocalOsFs(fs))
 
 	return sftp.ErrSSHFxOk
 }
 
-func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.WriterAt, error) {
-	if !c.hasSpace(true) {
+// isTrashEnabledForPath returns true if the deletes for the given SFTP path must be
+// moved to the trash. Virtual folders have no trash
+func (c Connection) isTrashEnabledForPath(sftpPath string) bool {
+	if !c.User.Filters.Trash.Enabled {
+		return false
+	}
+	_, err := c.User.GetVirtualFolderForPath(sftpPath)
+	return err != nil
+}
+
+// moveDirToTrash moves an empty directory to the trash. Non empty directories
+// cannot be removed, as for the permanent deletes
+func (c Connection) moveDirToTrash(fs vfs.Fs, dirPath, sftpPath string) error {
+	contents, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(contents) > 0 {
+		return fmt.Errorf("cannot remove non empty directory: %#v", dirPath)
+	}
+	return moveToTrash(fs, c.User, dirPath, sftpPath)
+}
+
+func (c Connection) handleSFTPUploadToNewFile(fs vfs.Fs, resolvedPath, filePath, requestPath string) (io.WriterAt, error) {
+	if !c.hasSpace(true, requestPath) {
 		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSSHFxFailure
 	}
 
-	file, w, cancelFn, err := c.fs.Create(filePath, 0)
+	_, err := c.getRemainingTransferQuota(transferUpload)
+	if err != nil {
+		c.Log(logger.LevelInfo, logSender, "denying file write: %v", err)
+		return nil, sftp.ErrSSHFxFailure
+	}
+
+	file, w, cancelFn, err := fs.Create(filePath, 0)
 	if err != nil {
-		c.Log(logger.LevelWarn, logSender, "error creating file %#v: %v", requestPath, err)
-		return nil, vfs.GetSFTPError(c.fs, err)
+		c.Log(logger.LevelWarn, logSender, "error creating file %#v: %v", resolvedPath, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
-	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, filePath, c.User.GetUID(), c.User.GetGID())
+	retentionPath, retentionDays := c.getUploadRetention(fs, resolvedPath, requestPath)
 
 	transfer := Transfer{
 		file:           file,
 		writerAt:       w,
 		readerAt:       nil,
 		cancelFn:       cancelFn,
-		path:           requestPath,
+		path:           resolvedPath,
+		requestPath:    requestPath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -441,64 +644,92 @@ func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.
 		transferError:  nil,
 		isFinished:     false,
 		minWriteOffset: 0,
+		maxWriteSize:   c.getMaxUploadFileSize(),
+		retentionPath:  retentionPath,
+		retentionDays:  retentionDays,
 		lock:           new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
 }
 
-func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, requestPath, filePath string,
-	fileSize int64) (io.WriterAt, error) {
+func (c Connection) handleSFTPUploadToExistingFile(fs vfs.Fs, pflags sftp.FileOpenFlags, resolvedPath, filePath string,
+	fileSize int64, requestPath string) (io.WriterAt, error) {
 	var err error
-	if !c.hasSpace(false) {
+	if !c.hasSpace(false, requestPath) {
 		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSSHFxFailure
 	}
 
+	_, err = c.getRemainingTransferQuota(transferUpload)
+	if err != nil {
+		c.Log(logger.LevelInfo, logSender, "denying file write: %v", err)
+		return nil, sftp.ErrSSHFxFailure
+	}
+
 	minWriteOffset := int64(0)
 	osFlags := getOSOpenFlags(pflags)
+	isResume := pflags.Append && osFlags&os.O_TRUNC == 0
+	isS3Resume := false
+	if osFlags&os.O_TRUNC == 0 && vfs.HasInterruptedS3Upload(fs, resolvedPath) {
+		// S3 objects cannot be modified in place, opening a file with an interrupted
+		// upload without truncating it means that the client wants to resume the upload
+		isResume = true
+		isS3Resume = true
+	}
 
-	if pflags.Append && osFlags&os.O_TRUNC == 0 && !c.fs.IsUploadResumeSupported() {
+	if isResume && !fs.IsUploadResumeSupported() {
 		c.Log(logger.LevelInfo, logSender, "upload resume requested for path: %#v but not supported in fs implementation",
-			requestPath)
+			resolvedPath)
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
 
-	if isAtomicUploadEnabled() && c.fs.IsAtomicUploadSupported() {
-		err = c.fs.Rename(requestPath, filePath)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		err = fs.Rename(resolvedPath, filePath)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %v",
-				requestPath, filePath, err)
-			return nil, vfs.GetSFTPError(c.fs, err)
+				resolvedPath, filePath, err)
+			return nil, vfs.GetSFTPError(fs, err)
 		}
 	}
 
-	file, w, cancelFn, err := c.fs.Create(filePath, osFlags)
+	if isResume && !vfs.IsLocalOsFs(fs) {
+		// remote filesystems receive the data to append using a pipe, they need to know that this is an upload resume
+		osFlags |= os.O_APPEND
+	}
+
+	file, w, cancelFn, err := fs.Create(filePath, osFlags)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "error opening existing file, flags: %v, source: %#v, err: %v", pflags, filePath, err)
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	initialSize := int64(0)
-	if pflags.Append && osFlags&os.O_TRUNC == 0 {
+	if isResume {
 		c.Log(logger.LevelDebug, logSender, "upload resume requested, file path: %#v initial size: %v", filePath, fileSize)
 		minWriteOffset = fileSize
+		if isS3Resume {
+			// interrupted S3 uploads are not included in the quota, the whole file will be added when the upload completes
+			initialSize = -fileSize
+		}
 	} else {
-		if vfs.IsLocalOsFs(c.fs) {
-			dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+		if vfs.IsLocalOsFs(fs) {
+			updateUserOrFolderQuota(c.User, requestPath, 0, -fileSize)
 		} else {
 			initialSize = fileSize
 		}
 	}
 
-	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, filePath, c.User.GetUID(), c.User.GetGID())
+	retentionPath, retentionDays := c.getUploadRetention(fs, resolvedPath, requestPath)
 
 	transfer := Transfer{
 		file:           file,
 		writerAt:       w,
 		readerAt:       nil,
 		cancelFn:       cancelFn,
-		path:           requestPath,
+		path:           resolvedPath,
+		requestPath:    requestPath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -506,19 +737,25 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 		connectionID:   c.ID,
 		transferType:   transferUpload,
 		lastActivity:   time.Now(),
-		isNewFile:      false,
+		isNewFile:      isS3Resume,
 		protocol:       c.protocol,
 		transferError:  nil,
 		isFinished:     false,
 		minWriteOffset: minWriteOffset,
 		initialSize:    initialSize,
+		maxWriteSize:   c.getMaxUploadFileSize(),
+		retentionPath:  retentionPath,
+		retentionDays:  retentionDays,
 		lock:           new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
 }
 
-func (c Connection) hasSpace(checkFiles bool) bool {
+func (c Connection) hasSpace(checkFiles bool, requestPath string) bool {
+	if folder, err := c.User.GetVirtualFolderForPath(requestPath); err == nil {
+		return c.hasFolderSpace(checkFiles, folder)
+	}
 	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
 		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
 		if err != nil {
@@ -536,6 +773,27 @@ func (c Connection) hasSpace(checkFiles bool) bool {
 			return false
 		}
 	}
+	return c.hasDirSpace(checkFiles, requestPath)
+}
+
+func (c Connection) hasFolderSpace(checkFiles bool, folder dataprovider.VirtualFolder) bool {
+	if (checkFiles && folder.QuotaFiles > 0) || folder.QuotaSize > 0 {
+		numFile, size, err := dataprovider.GetUsedVirtualFolderQuota(dataProvider, folder.Name)
+		if err != nil {
+			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+				c.Log(logger.LevelWarn, logSender, "quota enforcement not possible for virtual folder %#v: %v", folder.Name, err)
+				return true
+			}
+			c.Log(logger.LevelWarn, logSender, "error getting used quota for virtual folder %#v: %v", folder.Name, err)
+			return false
+		}
+		if (checkFiles && folder.QuotaFiles > 0 && numFile >= folder.QuotaFiles) ||
+			(folder.QuotaSize > 0 && size >= folder.QuotaSize) {
+			c.Log(logger.LevelDebug, logSender, "quota exceed for virtual folder %#v, num files: %v/%v, size: %v/%v check files: %v",
+				folder.Name, numFile, folder.QuotaFiles, size, folder.QuotaSize, checkFiles)
+			return false
+		}
+	}
 	return true
 }
 
@@ -569,3 +827,15 @@ func getOSOpenFlags(requestFlags sftp.FileOpenFlags) (flags int) {
 	}
 	return osFlags
 }
+
+// updateUserOrFolderQuota updates the quota for the virtual folder that contains the given
+// SFTP path or the user quota, and the matching directory quotas, if the path is not inside
+// a virtual folder
+func updateUserOrFolderQuota(user dataprovider.User, requestPath string, filesAdd int, sizeAdd int64) {
+	if folder, err := user.GetVirtualFolderForPath(requestPath); err == nil {
+		dataprovider.UpdateVirtualFolderQuota(dataProvider, folder, filesAdd, sizeAdd, false)
+		return
+	}
+	dataprovider.UpdateUserQuota(dataProvider, user, filesAdd, sizeAdd, false)
+	updateDirQuotas(user, requestPath, filesAdd, sizeAdd)
+}
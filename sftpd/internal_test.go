@@ -2,6 +2,7 @@ package sftpd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -395,7 +396,7 @@ func TestMockFsErrors(t *testing.T) {
 	testfile := filepath.Join(u.HomeDir, "testfile")
 	request := sftp.NewRequest("Remove", testfile)
 	ioutil.WriteFile(testfile, []byte("test"), 0666)
-	err := c.handleSFTPRemove(testfile, request)
+	err := c.handleSFTPRemove(c.fs, testfile, request)
 	if err != sftp.ErrSSHFxFailure {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -407,7 +408,7 @@ func TestMockFsErrors(t *testing.T) {
 	flags.Write = true
 	flags.Trunc = false
 	flags.Append = true
-	_, err = c.handleSFTPUploadToExistingFile(flags, testfile, testfile, 0)
+	_, err = c.handleSFTPUploadToExistingFile(c.fs, flags, testfile, testfile, 0, "/testfile")
 	if err != sftp.ErrSSHFxOpUnsupported {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -423,12 +424,12 @@ func TestUploadFiles(t *testing.T) {
 	var flags sftp.FileOpenFlags
 	flags.Write = true
 	flags.Trunc = true
-	_, err := c.handleSFTPUploadToExistingFile(flags, "missing_path", "other_missing_path", 0)
+	_, err := c.handleSFTPUploadToExistingFile(c.fs, flags, "missing_path", "other_missing_path", 0, "/missing_path")
 	if err == nil {
 		t.Errorf("upload to existing file must fail if one or both paths are invalid")
 	}
 	uploadMode = uploadModeStandard
-	_, err = c.handleSFTPUploadToExistingFile(flags, "missing_path", "other_missing_path", 0)
+	_, err = c.handleSFTPUploadToExistingFile(c.fs, flags, "missing_path", "other_missing_path", 0, "/missing_path")
 	if err == nil {
 		t.Errorf("upload to existing file must fail if one or both paths are invalid")
 	}
@@ -436,14 +437,14 @@ func TestUploadFiles(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		missingFile = "missing\\relative\\file.txt"
 	}
-	_, err = c.handleSFTPUploadToNewFile(".", missingFile)
+	_, err = c.handleSFTPUploadToNewFile(c.fs, ".", missingFile, "/missing")
 	if err == nil {
 		t.Errorf("upload new file in missing path must fail")
 	}
 	c.fs = newMockOsFs(nil, nil, false, "123", os.TempDir())
 	f, _ := ioutil.TempFile("", "temp")
 	f.Close()
-	_, err = c.handleSFTPUploadToExistingFile(flags, f.Name(), f.Name(), 123)
+	_, err = c.handleSFTPUploadToExistingFile(c.fs, flags, f.Name(), f.Name(), 123, f.Name())
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -527,7 +528,7 @@ func TestSetstatModeIgnore(t *testing.T) {
 	originalMode := setstatMode
 	setstatMode = 1
 	connection := Connection{}
-	err := connection.handleSFTPSetstat("invalid", nil)
+	err := connection.handleSFTPSetstat(connection.fs, "invalid", nil)
 	if err != nil {
 		t.Errorf("unexpected error: %v setstat should be silently ignore in mode 1", err)
 	}
@@ -545,7 +546,7 @@ func TestSFTPGetUsedQuota(t *testing.T) {
 	connection := Connection{
 		User: u,
 	}
-	res := connection.hasSpace(false)
+	res := connection.hasSpace(false, "/")
 	if res != false {
 		t.Errorf("has space must return false if the user is invalid")
 	}
@@ -628,6 +629,55 @@ func TestSSHCommandPath(t *testing.T) {
 	if path != "/" {
 		t.Errorf("unexpected path: %v", path)
 	}
+	// the quotes are removed while parsing the command, they are part of the file name here
+	sshCommand.args = []string{"-t", "/dir with spaces/'quoted'"}
+	path = sshCommand.getDestPath()
+	if path != "/dir with spaces/'quoted'" {
+		t.Errorf("unexpected path: %v", path)
+	}
+	sshCommand.args = []string{"-t", "dir with spaces/"}
+	path = sshCommand.getDestPath()
+	if path != "/dir with spaces/" {
+		t.Errorf("unexpected path: %v", path)
+	}
+}
+
+func TestParseCommandPayload(t *testing.T) {
+	tests := []struct {
+		command      string
+		expectedName string
+		expectedArgs []string
+	}{
+		{"md5sum", "md5sum", nil},
+		{"  ls  -la\tdir  ", "ls", []string{"-la", "dir"}},
+		{"ls 'dir with spaces'", "ls", []string{"dir with spaces"}},
+		{`ls "dir with spaces"`, "ls", []string{"dir with spaces"}},
+		{`ls dir\ with\ spaces`, "ls", []string{"dir with spaces"}},
+		{`ls /dir/'file name'.txt`, "ls", []string{"/dir/file name.txt"}},
+		{`ls "it's" 'say "hi"' say\"hi\"`, "ls", []string{"it's", `say "hi"`, `say"hi"`}},
+		{`ls 'it'\''s'`, "ls", []string{"it's"}},
+		{`ls '' ""`, "ls", []string{"", ""}},
+		{"git-upload-pack '/my repo.git'", "git-upload-pack", []string{"/my repo.git"}},
+		{"ls file#1", "ls", []string{"file#1"}},
+	}
+	for _, test := range tests {
+		name, args, err := parseCommandPayload(test.command)
+		if err != nil || name != test.expectedName || len(args) != len(test.expectedArgs) {
+			t.Errorf("unexpected command %#v args %#v for %#v, err: %v", name, args, test.command, err)
+			continue
+		}
+		for idx := range args {
+			if args[idx] != test.expectedArgs[idx] {
+				t.Errorf("unexpected args for %#v: %#v", test.command, args)
+				break
+			}
+		}
+	}
+	for _, command := range []string{"", "  ", "ls 'unterminated", `ls "unterminated`, `ls trailing\`} {
+		if _, _, err := parseCommandPayload(command); err == nil {
+			t.Errorf("parsing %#v must fail", command)
+		}
+	}
 }
 
 func TestSSHCommandErrors(t *testing.T) {
@@ -755,9 +805,10 @@ func TestSSHCommandsRemoteFs(t *testing.T) {
 		connection: connection,
 		args:       []string{},
 	}
+	// the hash commands read the files using the Fs, so they work for remote filesystems too
 	err := cmd.handleHashCommands()
-	if err == nil {
-		t.Error("command must fail for a non local filesystem")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
 	command, err := cmd.getSystemCommand()
 	if err != nil {
@@ -769,6 +820,73 @@ func TestSSHCommandsRemoteFs(t *testing.T) {
 	}
 }
 
+func TestQuotaScanProgressAndCancel(t *testing.T) {
+	username := "quota_scan_user"
+	folderName := "quota_scan_folder"
+	rootDir := filepath.Join(os.TempDir(), "quota_scan_root")
+	os.MkdirAll(filepath.Join(rootDir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(rootDir, "file1"), []byte("data"), 0666)
+	ioutil.WriteFile(filepath.Join(rootDir, "sub", "file2"), []byte("more data"), 0666)
+	fs := vfs.NewOsFs("", rootDir)
+	if err := CancelQuotaScan(username); err == nil {
+		t.Errorf("cancelling a missing quota scan must fail")
+	}
+	if err := CancelVFolderQuotaScan(folderName); err == nil {
+		t.Errorf("cancelling a missing folder quota scan must fail")
+	}
+	if _, _, err := ScanUserQuota(username, fs, false); err == nil {
+		t.Errorf("scanning without an active quota scan must fail")
+	}
+	if _, _, err := ScanVFolderQuota(folderName, fs, false); err == nil {
+		t.Errorf("scanning without an active folder quota scan must fail")
+	}
+	AddQuotaScan(username)
+	numFiles, size, err := ScanUserQuota(username, fs, true)
+	if err != nil || numFiles != 2 || size != 13 {
+		t.Errorf("unexpected quota scan result, files: %v size: %v err: %v", numFiles, size, err)
+	}
+	scans := GetQuotaScans()
+	if len(scans) != 1 || !scans[0].Incremental || scans[0].ScannedFiles != 2 || scans[0].ScannedSize != 13 {
+		t.Errorf("unexpected quota scan progress: %+v", scans)
+	}
+	if err = CancelQuotaScan(username); err != nil {
+		t.Errorf("unable to cancel the quota scan: %v", err)
+	}
+	_, _, err = ScanUserQuota(username, fs, false)
+	if err != context.Canceled {
+		t.Errorf("a cancelled quota scan must fail, err: %v", err)
+	}
+	RemoveQuotaScan(username)
+
+	AddVFolderQuotaScan(folderName)
+	if err = CancelVFolderQuotaScan(folderName); err != nil {
+		t.Errorf("unable to cancel the folder quota scan: %v", err)
+	}
+	_, _, err = ScanVFolderQuota(folderName, fs, false)
+	if err != context.Canceled {
+		t.Errorf("a cancelled folder quota scan must fail, err: %v", err)
+	}
+	folderScans := GetVFoldersQuotaScans()
+	if len(folderScans) != 1 || folderScans[0].Incremental || folderScans[0].ScannedFiles != 0 {
+		t.Errorf("unexpected folder quota scan progress: %+v", folderScans)
+	}
+	RemoveVFolderQuotaScan(folderName)
+
+	statePath := quotaScanStatePath
+	quotaScanStatePath = ""
+	AddQuotaScan(username)
+	if _, _, err = ScanUserQuota(username, fs, true); err == nil {
+		t.Errorf("incremental quota scans must fail if the state path is not configured")
+	}
+	numFiles, _, err = ScanUserQuota(username, fs, false)
+	if err != nil || numFiles != 2 {
+		t.Errorf("unexpected quota scan result, files: %v err: %v", numFiles, err)
+	}
+	RemoveQuotaScan(username)
+	quotaScanStatePath = statePath
+	os.RemoveAll(rootDir)
+}
+
 func TestSSHCommandQuotaScan(t *testing.T) {
 	buf := make([]byte, 65535)
 	stdErrBuf := make([]byte, 65535)
@@ -1261,7 +1379,7 @@ func TestSCPErrorsMockFs(t *testing.T) {
 	testfile := filepath.Join(u.HomeDir, "testfile")
 	ioutil.WriteFile(testfile, []byte("test"), 0666)
 	stat, _ := os.Stat(u.HomeDir)
-	err = scpCommand.handleRecursiveDownload(u.HomeDir, stat)
+	err = scpCommand.handleRecursiveDownload(scpCommand.connection.fs, u.HomeDir, "/", stat)
 	if err != errFake {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -1270,7 +1388,7 @@ func TestSCPErrorsMockFs(t *testing.T) {
 	if err != errFake {
 		t.Errorf("unexpected error: %v", err)
 	}
-	err = scpCommand.handleUploadFile(testfile, testfile, 0, false, 4)
+	err = scpCommand.handleUploadFile(scpCommand.connection.fs, testfile, testfile, 0, false, 4, "/testfile")
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -1306,7 +1424,7 @@ func TestSCPRecursiveDownloadErrors(t *testing.T) {
 	path := "testDir"
 	os.Mkdir(path, 0777)
 	stat, _ := os.Stat(path)
-	err := scpCommand.handleRecursiveDownload("invalid_dir", stat)
+	err := scpCommand.handleRecursiveDownload(scpCommand.connection.fs, "invalid_dir", "/invalid_dir", stat)
 	if err != writeErr {
 		t.Errorf("recursive upload download must fail with the expected error: %v", err)
 	}
@@ -1317,7 +1435,7 @@ func TestSCPRecursiveDownloadErrors(t *testing.T) {
 		WriteError:   nil,
 	}
 	scpCommand.connection.channel = &mockSSHChannel
-	err = scpCommand.handleRecursiveDownload("invalid_dir", stat)
+	err = scpCommand.handleRecursiveDownload(scpCommand.connection.fs, "invalid_dir", "/invalid_dir", stat)
 	if err == nil {
 		t.Errorf("recursive upload download must fail for a non existing dir")
 	}
@@ -1599,6 +1717,95 @@ func TestUploadError(t *testing.T) {
 	uploadMode = oldUploadMode
 }
 
+func TestUploadPipeReaderError(t *testing.T) {
+	r, w, err := pipeat.Pipe()
+	if err != nil {
+		t.Fatalf("unable to create pipe: %v", err)
+	}
+	transfer := Transfer{
+		writerAt:      w,
+		path:          "testfile",
+		start:         time.Now(),
+		user:          dataprovider.User{Username: "testuser"},
+		transferType:  transferUpload,
+		lastActivity:  time.Now(),
+		isNewFile:     true,
+		protocol:      protocolSFTP,
+		transferError: nil,
+		isFinished:    false,
+		lock:          new(sync.Mutex),
+	}
+	addTransfer(&transfer)
+	errFake := errors.New("fake storage error")
+	go func() {
+		ioutil.ReadAll(r)
+		r.CloseWithError(errFake)
+	}()
+	err = transfer.Close()
+	if err != errFake {
+		t.Errorf("the storage error must be returned, got: %v", err)
+	}
+	if transfer.transferError != errFake {
+		t.Errorf("unexpected transfer error: %v", transfer.transferError)
+	}
+}
+
+func TestMemFsClearOnLogout(t *testing.T) {
+	user := dataprovider.User{
+		Username: "memfs_test_user",
+		HomeDir:  filepath.Join(os.TempDir(), "memfs_test_user"),
+	}
+	user.FsConfig.Provider = 5
+	fs, err := user.GetFilesystem("id1")
+	if err != nil {
+		t.Fatalf("unable to get memory filesystem: %v", err)
+	}
+	err = fs.Mkdir("/dir")
+	if err != nil {
+		t.Errorf("unable to create dir: %v", err)
+	}
+	fs1, err := user.GetFilesystem("id2")
+	if err != nil {
+		t.Fatalf("unable to get memory filesystem: %v", err)
+	}
+	fs.Close()
+	// closing twice must not release the storage twice
+	fs.Close()
+	_, err = fs1.Stat("/dir")
+	if err != nil {
+		t.Errorf("the storage must be shared between connections: %v", err)
+	}
+	fs1.Close()
+	fs, err = user.GetFilesystem("id3")
+	if err != nil {
+		t.Fatalf("unable to get memory filesystem: %v", err)
+	}
+	_, err = fs.Stat("/dir")
+	if err != nil {
+		t.Errorf("the stored files must be preserved if clear on logout is disabled: %v", err)
+	}
+	fs.Close()
+	user.FsConfig.MemConfig.ClearOnLogout = true
+	fs, err = user.GetFilesystem("id4")
+	if err != nil {
+		t.Fatalf("unable to get memory filesystem: %v", err)
+	}
+	fs.Close()
+	fs, err = user.GetFilesystem("id5")
+	if err != nil {
+		t.Fatalf("unable to get memory filesystem: %v", err)
+	}
+	_, err = fs.Stat("/dir")
+	if !fs.IsNotExist(err) {
+		t.Errorf("the stored files must be removed on logout: %v", err)
+	}
+	fs.Close()
+	_, err = os.Stat(user.GetHomeDir())
+	if !os.IsNotExist(err) {
+		t.Errorf("the memory filesystem must not create the home dir: %v", err)
+	}
+}
+
 func TestConnectionStatusStruct(t *testing.T) {
 	var transfers []connectionTransfer
 	transferUL := connectionTransfer{
@@ -1655,3 +1862,439 @@ func TestSFTPExtensions(t *testing.T) {
 	}
 	sftpExtensions = initialSFTPExtensions
 }
+
+func TestTieringStaleStubs(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "tiering_test_user")
+	coldDir := filepath.Join(os.TempDir(), "tiering_test_cold")
+	os.MkdirAll(filepath.Join(homeDir, "dir"), 0755)
+	filePath := filepath.Join(homeDir, "dir", "file")
+	ioutil.WriteFile(filePath, []byte("cold data"), 0666)
+	coldTime := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filePath, coldTime, coldTime)
+	fs, err := vfs.NewTieredFs("", homeDir, "tiering_test_user", vfs.NewOsFs("", coldDir), false)
+	if err != nil {
+		t.Fatalf("unable to create tiered fs: %v", err)
+	}
+	defer fs.Close()
+	fs.CheckRootPath("tiering_test_user", -1, -1)
+	tieredFs := fs.(*vfs.TieredFs)
+	files, size, err := tieredFs.TierColdFiles(time.Now().Add(-1 * time.Hour))
+	if err != nil || files != 1 || size != 9 {
+		t.Errorf("unexpected tiering result, files: %v size: %v err: %v", files, size, err)
+	}
+	files, size, err = vfs.GetTieringUsage("tiering_test_user")
+	if err != nil || files != 1 || size != 9 {
+		t.Errorf("unexpected tiering usage, files: %v size: %v err: %v", files, size, err)
+	}
+	// a stub modified outside SFTPGo is no longer a stub
+	ioutil.WriteFile(filePath, []byte("new data"), 0666)
+	f, _, _, err := fs.Open(filePath)
+	if err != nil {
+		t.Errorf("unable to open file: %v", err)
+	} else {
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "new data" {
+			t.Errorf("unexpected file contents: %#v", string(data))
+		}
+	}
+	files, _, err = tieredFs.TierColdFiles(time.Now().Add(-1 * time.Hour))
+	if err != nil || files != 0 {
+		t.Errorf("unexpected tiering result, files: %v err: %v", files, err)
+	}
+	files, _, err = vfs.GetTieringUsage("tiering_test_user")
+	if err != nil || files != 0 {
+		t.Errorf("the stale metadata must be removed, files: %v err: %v", files, err)
+	}
+	contents, err := ioutil.ReadDir(coldDir)
+	if err != nil || len(contents) != 0 {
+		t.Errorf("the stale contents must be removed from the cold tier, contents: %v err: %v", len(contents), err)
+	}
+	os.RemoveAll(homeDir)
+	os.RemoveAll(coldDir)
+}
+
+func TestCryptFsRandomAccess(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "cryptfs_test_user")
+	os.MkdirAll(homeDir, 0755)
+	fs, err := vfs.NewCryptFs(vfs.NewOsFs("", homeDir), homeDir, vfs.CryptFsConfig{Passphrase: "test passphrase"})
+	if err != nil {
+		t.Fatalf("unable to create crypt fs: %v", err)
+	}
+	defer fs.Close()
+	filePath := filepath.Join(homeDir, "file")
+	writeFile := func(data []byte) {
+		_, w, _, err := fs.Create(filePath, 0)
+		if err != nil {
+			t.Fatalf("unable to create file: %v", err)
+		}
+		w.Write(data) //nolint:errcheck
+		w.Close()
+		if err = w.WaitForReader(); err != nil && err != io.EOF {
+			t.Errorf("unable to write file: %v", err)
+		}
+	}
+	for _, size := range []int{0, 1000, 65536, 131082} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		writeFile(data)
+		_, r, _, err := fs.Open(filePath)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+			continue
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(contents, data) {
+			t.Errorf("unexpected contents for size %v, err: %v", size, err)
+		}
+		for _, off := range []int{0, 1, 65000, 65536, 70000, size - 1, size} {
+			if off < 0 || off > size {
+				continue
+			}
+			buf := make([]byte, 1000)
+			n, err := r.ReadAt(buf, int64(off))
+			end := off + len(buf)
+			if end > size {
+				end = size
+			}
+			if n != end-off || !bytes.Equal(buf[:n], data[off:end]) {
+				t.Errorf("unexpected data for size %v at offset %v, read: %v", size, off, n)
+			}
+			if n < len(buf) && err != io.EOF {
+				t.Errorf("short reads must return io.EOF, size %v offset %v err: %v", size, off, err)
+			}
+		}
+		r.Close()
+		// the plaintext is never stored
+		files, err := ioutil.ReadDir(homeDir)
+		if err != nil || len(files) != 1 {
+			t.Errorf("unexpected files inside the home dir: %v, err: %v", len(files), err)
+		}
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("unable to stat file: %v", err)
+	}
+	// remove the last chunk and then the last two ones
+	for _, size := range []int64{stat.Size() - 26, stat.Size() - 26 - 65552} {
+		os.Truncate(filePath, size)
+		_, r, _, err := fs.Open(filePath)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+			continue
+		}
+		_, err = ioutil.ReadAll(r)
+		if err == nil || !strings.Contains(err.Error(), "truncated") {
+			t.Errorf("reading a truncated file must fail, err: %v", err)
+		}
+		r.Close()
+	}
+	// a full size last chunk followed by more data
+	writeFile(make([]byte, 65536))
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	f.Write([]byte("trailing data")) //nolint:errcheck
+	f.Close()
+	_, r, _, err := fs.Open(filePath)
+	if err == nil {
+		_, err = r.ReadAt(make([]byte, 10), 0)
+		r.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "after the last") {
+		t.Errorf("reading a file with trailing data must fail, err: %v", err)
+	}
+	ioutil.WriteFile(filePath, []byte("not encrypted"), 0666)
+	_, r, _, err = fs.Open(filePath)
+	if err == nil {
+		_, err = r.ReadAt(make([]byte, 10), 0)
+		r.Close()
+	}
+	if err == nil {
+		t.Errorf("reading a file without a valid header must fail")
+	}
+	os.RemoveAll(homeDir)
+}
+
+func TestReplicationOps(t *testing.T) {
+	user := dataprovider.User{
+		Username: "replication_test_user",
+		HomeDir:  filepath.Join(os.TempDir(), "replication_test_user"),
+	}
+	replicaDir := filepath.Join(os.TempDir(), "replication_test_replica")
+	os.MkdirAll(filepath.Join(user.HomeDir, "dir", "sub"), 0755)
+	os.MkdirAll(replicaDir, 0755)
+	ioutil.WriteFile(filepath.Join(user.HomeDir, "dir", "sub", "file"), []byte("data"), 0666)
+	os.Symlink(filepath.Join(user.HomeDir, "dir", "sub", "file"), filepath.Join(user.HomeDir, "dir", "link"))
+	fs := vfs.NewOsFs("", user.HomeDir)
+	replicaFs := vfs.NewOsFs("", replicaDir)
+	size, err := replicatePath(fs, replicaFs, user, "/dir")
+	if err != nil || size != 4 {
+		t.Errorf("unexpected replication result, size: %v, err: %v", size, err)
+	}
+	if _, err = os.Stat(filepath.Join(replicaDir, "dir", "sub", "file")); err != nil {
+		t.Errorf("the file must be replicated: %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(replicaDir, "dir", "link")); !os.IsNotExist(err) {
+		t.Errorf("symlinks must not be replicated: %v", err)
+	}
+	size, err = replicatePath(fs, replicaFs, user, "/missing")
+	if err != nil || size != 0 {
+		t.Errorf("a missing source must be ignored, size: %v, err: %v", size, err)
+	}
+	// the source is missing on the replica, the target must be copied
+	err = os.Rename(filepath.Join(user.HomeDir, "dir"), filepath.Join(user.HomeDir, "dir1"))
+	if err != nil {
+		t.Errorf("rename error: %v", err)
+	}
+	os.RemoveAll(filepath.Join(replicaDir, "dir"))
+	size, err = replicateRename(fs, replicaFs, user, "/dir", "/dir1")
+	if err != nil || size != 4 {
+		t.Errorf("unexpected rename result, size: %v, err: %v", size, err)
+	}
+	if _, err = os.Stat(filepath.Join(replicaDir, "dir1", "sub", "file")); err != nil {
+		t.Errorf("the renamed dir must be copied: %v", err)
+	}
+	err = removeReplicaPath(replicaFs, "/")
+	if err == nil {
+		t.Errorf("removing the replica root must fail")
+	}
+	err = removeReplicaPath(replicaFs, "/dir1")
+	if err != nil {
+		t.Errorf("remove error: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(replicaDir, "dir1")); !os.IsNotExist(err) {
+		t.Errorf("the dir must be removed from the replica: %v", err)
+	}
+	// operations for missing users are discarded
+	size, err = executeReplicationOp(&replicationOp{
+		ID:        "1",
+		Username:  "missing_replication_user",
+		Operation: replicationOpSync,
+		Path:      "/",
+	})
+	if err != nil || size != 0 {
+		t.Errorf("unexpected result for a missing user, size: %v, err: %v", size, err)
+	}
+	os.RemoveAll(user.HomeDir)
+	os.RemoveAll(replicaDir)
+}
+
+func TestMaxUploadFileSize(t *testing.T) {
+	buf := make([]byte, 65535)
+	stdErrBuf := make([]byte, 65535)
+	mockSSHChannel := MockChannel{
+		Buffer:       bytes.NewBuffer(buf),
+		StdErrBuffer: bytes.NewBuffer(stdErrBuf),
+	}
+	connection := Connection{
+		User: dataprovider.User{
+			Username: "testuser",
+			HomeDir:  os.TempDir(),
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermAny},
+			},
+		},
+		protocol: protocolSCP,
+		channel:  &mockSSHChannel,
+		fs:       vfs.NewOsFs("123", os.TempDir()),
+	}
+	if connection.getMaxUploadFileSize() != 0 {
+		t.Errorf("unexpected max upload file size")
+	}
+	maxUploadFileSize = 100
+	if connection.getMaxUploadFileSize() != 100 {
+		t.Errorf("the global max upload file size must apply")
+	}
+	connection.User.Filters.MaxUploadFileSize = 10
+	if connection.getMaxUploadFileSize() != 10 {
+		t.Errorf("the user's max upload file size must override the global one")
+	}
+	maxUploadFileSize = 0
+	scpCommand := scpCommand{
+		sshCommand: sshCommand{
+			command:    "scp",
+			connection: connection,
+			args:       []string{"-t", "/"},
+		},
+	}
+	testFileName := "test_max_upload_size"
+	err := scpCommand.handleUpload("/"+testFileName, 11)
+	if err != errUploadFileSizeExceeded {
+		t.Errorf("upload must fail with the expected error: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(os.TempDir(), testFileName)); !os.IsNotExist(err) {
+		t.Errorf("the oversized file must not be created: %v", err)
+	}
+	file, err := os.Create(filepath.Join(os.TempDir(), testFileName))
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	transfer := Transfer{
+		file:          file,
+		path:          file.Name(),
+		start:         time.Now(),
+		user:          connection.User,
+		transferType:  transferUpload,
+		lastActivity:  time.Now(),
+		isNewFile:     true,
+		protocol:      connection.protocol,
+		transferError: nil,
+		isFinished:    false,
+		maxWriteSize:  connection.getMaxUploadFileSize(),
+		lock:          new(sync.Mutex),
+	}
+	_, err = transfer.WriteAt(make([]byte, 10), 0)
+	if err != nil {
+		t.Errorf("write within the max upload file size must succeed: %v", err)
+	}
+	_, err = transfer.WriteAt(make([]byte, 1), 10)
+	if err != errUploadFileSizeExceeded {
+		t.Errorf("write must fail with the expected error: %v", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func TestTransferQuotaTracker(t *testing.T) {
+	user := dataprovider.User{
+		Username: "transfer_quota_user",
+		HomeDir:  os.TempDir(),
+		Filters: dataprovider.UserFilters{
+			TransferQuota: dataprovider.TransferQuota{
+				Period:       dataprovider.TransferQuotaPeriodDaily,
+				UploadSize:   100,
+				DownloadSize: 50,
+			},
+		},
+	}
+	tracker := &transferQuotaTracker{
+		usage: dataprovider.TransferQuotaUsage{
+			TransferQuota:  user.Filters.TransferQuota,
+			PeriodStart:    user.Filters.TransferQuota.GetPeriodStart(time.Now()),
+			UsedUploadSize: 20,
+		},
+		refs: 1,
+	}
+	transferQuotaMutex.Lock()
+	transferQuotaTrackers[user.Username] = tracker
+	transferQuotaMutex.Unlock()
+	if getTransferQuotaTracker(user.Username, true) != tracker {
+		t.Errorf("the active tracker must be returned")
+	}
+	connection := Connection{
+		User: user,
+	}
+	remaining, err := connection.getRemainingTransferQuota(transferUpload)
+	if err != nil || remaining != 80 {
+		t.Errorf("unexpected remaining upload transfer quota: %v, err: %v", remaining, err)
+	}
+	upload1 := Transfer{
+		user:          user,
+		transferType:  transferUpload,
+		transferQuota: tracker,
+	}
+	upload2 := upload1
+	// concurrent transfers share the same counter
+	if err = upload1.checkTransferQuota(40); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = upload2.checkTransferQuota(40); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = upload1.checkTransferQuota(1); err != errTransferQuotaExceeded {
+		t.Errorf("the transfer quota must be exceeded: %v", err)
+	}
+	_, err = connection.getRemainingTransferQuota(transferUpload)
+	if err != errTransferQuotaExceeded {
+		t.Errorf("new uploads must be denied: %v", err)
+	}
+	download := Transfer{
+		user:          user,
+		transferType:  transferDownload,
+		transferQuota: tracker,
+	}
+	if err = download.checkTransferQuota(50); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = download.checkTransferQuota(1); err != errTransferQuotaExceeded {
+		t.Errorf("the transfer quota must be exceeded: %v", err)
+	}
+	// the used transfer quota restarts from zero in a new period
+	tracker.Lock()
+	tracker.usage.PeriodStart--
+	tracker.Unlock()
+	usage := tracker.getUsage(user.Filters.TransferQuota)
+	if usage.UsedUploadSize != 0 || usage.UsedDownloadSize != 0 {
+		t.Errorf("unexpected usage in a new period: %+v", usage)
+	}
+	// the data transferred in a previous period are not added to the current one
+	if _, err = tracker.add(transferUpload, 1000, user.Filters.TransferQuota, usage.PeriodStart-1); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = upload1.checkTransferQuota(10); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	usage = tracker.getUsage(user.Filters.TransferQuota)
+	if usage.UsedUploadSize != 10 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+	// a reset discards the data transferred so far by the active transfers
+	ResetTransferQuota(user.Username)
+	usage = tracker.getUsage(user.Filters.TransferQuota)
+	if usage.UsedUploadSize != 0 || usage.UsedDownloadSize != 0 {
+		t.Errorf("unexpected usage after a reset: %+v", usage)
+	}
+	if err = upload1.checkTransferQuota(5); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(upload1.transferQuotaUsage) != 1 || upload1.transferQuotaUsage[0].uploaded != 5 ||
+		upload1.transferQuotaUsage[0].periodStart != usage.PeriodStart {
+		t.Errorf("unexpected transfer usage after a reset: %+v", upload1.transferQuotaUsage)
+	}
+	upload2.updateTransferQuota()
+	if len(upload2.transferQuotaUsage) != 0 {
+		t.Errorf("the data transferred before a reset must be discarded: %+v", upload2.transferQuotaUsage)
+	}
+	releaseTransferQuotaTracker(user.Username, tracker)
+	if getTransferQuotaTracker(user.Username, false) != tracker {
+		t.Errorf("the tracker must be kept while there are active transfers")
+	}
+	releaseTransferQuotaTracker(user.Username, tracker)
+	if getTransferQuotaTracker(user.Username, false) != nil {
+		t.Errorf("the tracker must be removed after the last transfer")
+	}
+}
+
+func TestSSHWorkingDir(t *testing.T) {
+	connection := Connection{}
+	if connection.getSSHPath("dir/../file") != "/file" {
+		t.Errorf("unexpected path: %v", connection.getSSHPath("dir/../file"))
+	}
+	connection.setWorkingDir("/dir")
+	if connection.getWorkingDir() != "/" {
+		t.Errorf("working dir must be / if not initialized")
+	}
+	connection.workingDir = &sshWorkingDir{path: "/"}
+	connection.setWorkingDir("/dir")
+	if connection.getSSHPath("sub dir/it's") != "/dir/sub dir/it's" {
+		t.Errorf("unexpected path: %v", connection.getSSHPath("sub dir/it's"))
+	}
+	if connection.getSSHPath("/file") != "/file" {
+		t.Errorf("unexpected path: %v", connection.getSSHPath("/file"))
+	}
+	options, paths, err := parseArgs([]string{"-rf", "dir", "-"}, "r", "f")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !options["r"] || !options["f"] || len(paths) != 2 {
+		t.Errorf("unexpected options: %v paths: %v", options, paths)
+	}
+	_, _, err = parseArgs([]string{"-l"}, "r")
+	if err == nil {
+		t.Errorf("invalid option must fail")
+	}
+}
@@ -0,0 +1,431 @@
+package sftpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/metrics"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+const (
+	replicationLogSender    = "Replication"
+	replicationOpSync       = "sync"
+	replicationOpRename     = "rename"
+	replicationOpRemove     = "remove"
+	replicationCheckPeriod  = 30 * time.Second
+	replicationMinRetryWait = 10 * time.Second
+	replicationMaxRetryWait = 1 * time.Hour
+)
+
+var (
+	replicationMutex    sync.Mutex
+	replicationQueueDir string
+	replicationQueue    []*replicationOp
+	replicationNotify   chan bool
+	replicationCounter  uint32
+)
+
+// replicationOp defines an operation to mirror on a user's replica. Each pending
+// operation is persisted as a JSON file inside the queue directory, so it survives
+// a restart and it is retried until it succeeds
+type replicationOp struct {
+	// sortable identifier, the operations are executed in this order
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Operation string `json:"operation"`
+	// SFTP path for the operation, source path for renames
+	Path string `json:"path"`
+	// SFTP target path for renames
+	Target string `json:"target,omitempty"`
+	// creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// failed attempts, the retry delay doubles after each failure
+	Attempts int `json:"attempts"`
+	// the next attempt is not executed before this time, as unix timestamp in milliseconds
+	NextRetry int64  `json:"next_retry"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (op *replicationOp) getFilePath() string {
+	return filepath.Join(replicationQueueDir, op.ID+".json")
+}
+
+func (op *replicationOp) save() error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	tmpPath := op.getFilePath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, op.getFilePath())
+}
+
+// ReplicationStatus defines the replication state for a user with pending operations
+type ReplicationStatus struct {
+	Username string `json:"username"`
+	// number of operations not yet mirrored on the replica
+	PendingOperations int `json:"pending_operations"`
+	// creation time of the oldest pending operation as unix timestamp in milliseconds
+	OldestPending int64 `json:"oldest_pending"`
+	// failed attempts for the oldest pending operation
+	Attempts int `json:"attempts"`
+	// next attempt for the oldest pending operation as unix timestamp in milliseconds,
+	// 0 if it never failed
+	NextRetry int64 `json:"next_retry"`
+	// error for the last failed attempt, if any
+	LastError string `json:"last_error,omitempty"`
+}
+
+// configureReplication loads the pending operations from the queue directory and
+// starts the replication worker. An empty path disables the replication
+func configureReplication(queuePath string) error {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	if len(queuePath) == 0 || replicationNotify != nil {
+		return nil
+	}
+	if err := os.MkdirAll(queuePath, 0700); err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadDir(queuePath)
+	if err != nil {
+		return err
+	}
+	replicationQueueDir = queuePath
+	for _, fi := range contents {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(queuePath, fi.Name()))
+		if err != nil {
+			logger.Warn(replicationLogSender, "", "unable to read replication operation %#v: %v", fi.Name(), err)
+			continue
+		}
+		var op replicationOp
+		if err = json.Unmarshal(data, &op); err != nil || op.ID+".json" != fi.Name() {
+			logger.Warn(replicationLogSender, "", "skipping invalid replication operation %#v: %v", fi.Name(), err)
+			continue
+		}
+		replicationQueue = append(replicationQueue, &op)
+	}
+	sort.Slice(replicationQueue, func(i, j int) bool {
+		return replicationQueue[i].ID < replicationQueue[j].ID
+	})
+	logger.Info(replicationLogSender, "", "replication queue loaded from %#v, pending operations: %v", queuePath,
+		len(replicationQueue))
+	updateReplicationMetrics()
+	replicationNotify = make(chan bool, 1)
+	go replicationWorker(replicationNotify)
+	return nil
+}
+
+func replicationWorker(notify chan bool) {
+	ticker := time.NewTicker(replicationCheckPeriod)
+	for {
+		processReplicationQueue()
+		select {
+		case <-notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueReplication adds an operation to the replication queue if the user has
+// the replication enabled. Paths inside virtual folders are not replicated
+func enqueueReplication(user dataprovider.User, operation, sftpPath, target string) {
+	if !user.Filters.Replication.Enabled || isTrashPath(sftpPath) {
+		return
+	}
+	if _, err := user.GetVirtualFolderForPath(sftpPath); err == nil {
+		return
+	}
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	if replicationNotify == nil {
+		logger.Warn(replicationLogSender, "", "replication queue not configured, operation %#v for user %#v path %#v "+
+			"not replicated", operation, user.Username, sftpPath)
+		return
+	}
+	now := time.Now()
+	op := &replicationOp{
+		ID:        fmt.Sprintf("%020d-%010d", now.UnixNano(), atomic.AddUint32(&replicationCounter, 1)),
+		Username:  user.Username,
+		Operation: operation,
+		Path:      path.Clean("/" + sftpPath),
+		CreatedAt: utils.GetTimeAsMsSinceEpoch(now),
+	}
+	if len(target) > 0 {
+		op.Target = path.Clean("/" + target)
+	}
+	if err := op.save(); err != nil {
+		logger.Warn(replicationLogSender, "", "unable to persist replication operation %#v for user %#v path %#v: %v",
+			operation, user.Username, sftpPath, err)
+	}
+	replicationQueue = append(replicationQueue, op)
+	updateReplicationMetrics()
+	select {
+	case replicationNotify <- true:
+	default:
+	}
+}
+
+// processReplicationQueue executes the pending operations in order. The operations for a
+// user are not executed while a previous one is waiting for a retry, so the replica never
+// sees them out of order
+func processReplicationQueue() {
+	replicationMutex.Lock()
+	ops := make([]*replicationOp, len(replicationQueue))
+	copy(ops, replicationQueue)
+	replicationMutex.Unlock()
+
+	blockedUsers := make(map[string]bool)
+	for _, op := range ops {
+		if blockedUsers[op.Username] {
+			continue
+		}
+		if op.NextRetry > 0 && time.Now().Before(utils.GetTimeFromMsecSinceEpoch(op.NextRetry)) {
+			blockedUsers[op.Username] = true
+			continue
+		}
+		size, err := executeReplicationOp(op)
+		metrics.ReplicationOperationCompleted(size, err)
+		replicationMutex.Lock()
+		if err != nil {
+			op.Attempts++
+			wait := replicationMaxRetryWait
+			if op.Attempts <= 10 {
+				wait = replicationMinRetryWait << uint(op.Attempts-1)
+			}
+			if wait > replicationMaxRetryWait {
+				wait = replicationMaxRetryWait
+			}
+			op.NextRetry = utils.GetTimeAsMsSinceEpoch(time.Now().Add(wait))
+			op.LastError = err.Error()
+			if errSave := op.save(); errSave != nil {
+				logger.Warn(replicationLogSender, "", "unable to persist replication operation %#v: %v", op.ID, errSave)
+			}
+			blockedUsers[op.Username] = true
+			logger.Warn(replicationLogSender, "", "replication operation %#v for user %#v failed, attempts: %v, "+
+				"next retry in %v: %v", op.ID, op.Username, op.Attempts, wait, err)
+		} else {
+			removeReplicationOp(op)
+		}
+		updateReplicationMetrics()
+		replicationMutex.Unlock()
+	}
+}
+
+// removeReplicationOp removes a completed operation, replicationMutex must be locked
+func removeReplicationOp(op *replicationOp) {
+	if err := os.Remove(op.getFilePath()); err != nil && !os.IsNotExist(err) {
+		logger.Warn(replicationLogSender, "", "unable to remove replication operation %#v: %v", op.ID, err)
+	}
+	for idx, queued := range replicationQueue {
+		if queued == op {
+			replicationQueue = append(replicationQueue[:idx], replicationQueue[idx+1:]...)
+			break
+		}
+	}
+}
+
+// updateReplicationMetrics updates the queue metrics, replicationMutex must be locked
+func updateReplicationMetrics() {
+	var lag time.Duration
+	if len(replicationQueue) > 0 {
+		lag = time.Since(utils.GetTimeFromMsecSinceEpoch(replicationQueue[0].CreatedAt))
+	}
+	metrics.UpdateReplicationQueue(len(replicationQueue), lag)
+}
+
+// executeReplicationOp mirrors the given operation on the user's replica and returns
+// the number of bytes copied. Operations for removed users or for users without the
+// replication enabled are discarded
+func executeReplicationOp(op *replicationOp) (int64, error) {
+	user, err := dataprovider.UserExists(dataProvider, op.Username)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			logger.Debug(replicationLogSender, "", "discarding replication operation %#v, user %#v does not exist",
+				op.ID, op.Username)
+			return 0, nil
+		}
+		return 0, err
+	}
+	if !user.Filters.Replication.Enabled {
+		logger.Debug(replicationLogSender, "", "discarding replication operation %#v, replication is disabled for "+
+			"user %#v", op.ID, op.Username)
+		return 0, nil
+	}
+	connectionID := "replication_" + op.ID
+	fs, err := user.GetFilesystem(connectionID)
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Close()
+	replicaFs, err := user.GetReplicaFilesystem(connectionID)
+	if err != nil {
+		return 0, err
+	}
+	defer replicaFs.Close()
+	replicaFs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+
+	var size int64
+	switch op.Operation {
+	case replicationOpSync:
+		size, err = replicatePath(fs, replicaFs, user, op.Path)
+	case replicationOpRename:
+		size, err = replicateRename(fs, replicaFs, user, op.Path, op.Target)
+	case replicationOpRemove:
+		err = removeReplicaPath(replicaFs, op.Path)
+	default:
+		logger.Warn(replicationLogSender, "", "discarding replication operation %#v, unknown operation %#v", op.ID,
+			op.Operation)
+		return 0, nil
+	}
+	logger.Debug(replicationLogSender, connectionID, "operation %#v for user %#v, path %#v target %#v replicated, "+
+		"bytes: %v, error: %v", op.Operation, op.Username, op.Path, op.Target, size, err)
+	return size, err
+}
+
+// replicatePath copies the given SFTP path, and its contents for directories, from the user's
+// filesystem to the replica. Symlinks are not replicated and a missing source is not an error,
+// it was removed or renamed after the operation was queued and a later operation handles it
+func replicatePath(fs, replicaFs vfs.Fs, user dataprovider.User, sftpPath string) (int64, error) {
+	if isTrashPath(sftpPath) {
+		return 0, nil
+	}
+	if _, err := user.GetVirtualFolderForPath(sftpPath); err == nil {
+		return 0, nil
+	}
+	fsPath, err := fs.ResolvePath(sftpPath)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := fs.Lstat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return 0, nil
+	}
+	if !fi.IsDir() {
+		if err = createMissingDirs(replicaFs, user, path.Dir(sftpPath)); err != nil {
+			return 0, err
+		}
+		replicaPath, err := replicaFs.ResolvePath(sftpPath)
+		if err != nil {
+			return 0, err
+		}
+		return copyFileToReplica(fs, replicaFs, user, fsPath, replicaPath)
+	}
+	if err = createMissingDirs(replicaFs, user, sftpPath); err != nil {
+		return 0, err
+	}
+	contents, err := fs.ReadDir(fsPath)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, child := range contents {
+		n, err := replicatePath(fs, replicaFs, user, path.Join(sftpPath, child.Name()))
+		size += n
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+func copyFileToReplica(fs, replicaFs vfs.Fs, user dataprovider.User, fsPath, replicaPath string) (int64, error) {
+	n, err := vfs.StreamFile(fs, replicaFs, fsPath, replicaPath)
+	if err != nil {
+		return n, err
+	}
+	vfs.SetPathPermissions(replicaFs, replicaPath, user.GetUID(), user.GetGID())
+	return n, nil
+}
+
+// replicateRename renames the given path on the replica. If the rename fails, for example
+// because the source is missing on the replica or the storage cannot rename directories,
+// the target is copied from the user's filesystem and the source is removed
+func replicateRename(fs, replicaFs vfs.Fs, user dataprovider.User, source, target string) (int64, error) {
+	replicaSource, err := replicaFs.ResolvePath(source)
+	if err != nil {
+		return 0, err
+	}
+	replicaTarget, err := replicaFs.ResolvePath(target)
+	if err != nil {
+		return 0, err
+	}
+	if err = createMissingDirs(replicaFs, user, path.Dir(target)); err != nil {
+		return 0, err
+	}
+	if err = replicaFs.Rename(replicaSource, replicaTarget); err == nil {
+		return 0, nil
+	}
+	logger.Debug(replicationLogSender, replicaFs.ConnectionID(), "unable to rename %#v -> %#v on the replica, the "+
+		"target will be copied: %v", source, target, err)
+	if err = removeAll(replicaFs, replicaTarget); err != nil {
+		return 0, err
+	}
+	size, err := replicatePath(fs, replicaFs, user, target)
+	if err != nil {
+		return size, err
+	}
+	return size, removeAll(replicaFs, replicaSource)
+}
+
+func removeReplicaPath(replicaFs vfs.Fs, sftpPath string) error {
+	if path.Clean(sftpPath) == "/" {
+		return errors.New("removing the replica root is not allowed")
+	}
+	replicaPath, err := replicaFs.ResolvePath(sftpPath)
+	if err != nil {
+		return err
+	}
+	return removeAll(replicaFs, replicaPath)
+}
+
+// GetReplicationStatus returns the replication state for the users with pending operations
+func GetReplicationStatus() []ReplicationStatus {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	status := []ReplicationStatus{}
+	usersIdx := make(map[string]int)
+	for _, op := range replicationQueue {
+		if idx, ok := usersIdx[op.Username]; ok {
+			status[idx].PendingOperations++
+			continue
+		}
+		usersIdx[op.Username] = len(status)
+		status = append(status, ReplicationStatus{
+			Username:          op.Username,
+			PendingOperations: 1,
+			OldestPending:     op.CreatedAt,
+			Attempts:          op.Attempts,
+			NextRetry:         op.NextRetry,
+			LastError:         op.LastError,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Username < status[j].Username
+	})
+	return status
+}
@@ -0,0 +1,287 @@
+package sftpd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+var (
+	// ErrInvalidRetentionPath is returned if the path for a retention status request is not valid
+	ErrInvalidRetentionPath = errors.New("the path must be an absolute SFTP path")
+	errRetentionActive      = errors.New("the file is locked by a retention policy")
+)
+
+// RetentionStatus defines the write-once retention state for a path
+type RetentionStatus struct {
+	// SFTP path
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	// directory of the retention policy that applies to this path, empty if there is no policy
+	PolicyPath string `json:"policy_path,omitempty"`
+	// retention period as number of days, 0 if there is no policy
+	RetentionDays int `json:"retention_days"`
+	// the file cannot be modified, renamed or removed until this time, as unix timestamp in
+	// milliseconds. 0 for directories and for paths without a policy
+	RetainUntil int64 `json:"retain_until"`
+	// true if the retention period is not expired
+	IsLocked bool `json:"is_locked"`
+}
+
+// getRetainUntil returns the time until the given file cannot be modified. The retention starts
+// when the upload completes and the retain until time is stored inside the data provider at this
+// time. For the files without a stored time, for example the ones uploaded before the times were
+// stored, the retention starts from the last modification time. A zero time is returned for
+// directories, symlinks and files without a retention policy
+func getRetainUntil(user dataprovider.User, fi os.FileInfo, sftpPath string) (time.Time, error) {
+	if !fi.Mode().IsRegular() {
+		return time.Time{}, nil
+	}
+	policy, ok := user.GetRetentionPolicy(sftpPath)
+	if !ok {
+		return time.Time{}, nil
+	}
+	retainUntil, err := dataprovider.GetRetainUntil(dataProvider, user, sftpPath)
+	if err != nil || !retainUntil.IsZero() {
+		return retainUntil, err
+	}
+	return fi.ModTime().Add(time.Duration(policy.Days) * 24 * time.Hour), nil
+}
+
+// updateRetainUntil stores the time until a file uploaded inside a retention directory is locked,
+// the retention starts now
+func updateRetainUntil(user dataprovider.User, sftpPath string, days int, connectionID string) {
+	retainUntil := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	if err := dataprovider.UpdateRetainUntil(dataProvider, user, sftpPath, retainUntil); err != nil {
+		logger.Warn(logSender, connectionID, "unable to store the retain until time for %#v: %v", sftpPath, err)
+	}
+}
+
+// getUploadRetention returns the resolved SFTP path and the retention period, as number of days,
+// for a file uploaded to the given paths. The period is 0 if no retention policy applies
+func (c Connection) getUploadRetention(fs vfs.Fs, fsPath, sftpPath string) (string, int) {
+	if len(c.User.Filters.RetentionPolicies) == 0 {
+		return "", 0
+	}
+	if _, resolvedPath, err := c.resolveRetentionPath(fs, fsPath, sftpPath, true); err == nil {
+		sftpPath = resolvedPath
+	}
+	policy, ok := c.User.GetRetentionPolicy(sftpPath)
+	if !ok {
+		return "", 0
+	}
+	return sftpPath, policy.Days
+}
+
+// checkRetention returns errRetentionActive if the file at the given paths is locked
+// by a retention policy. Missing files are not locked. Symlinks are followed, this must
+// be used for the operations that modify the symlink target, such as writes and setstat
+func (c Connection) checkRetention(fs vfs.Fs, fsPath, sftpPath string) error {
+	if len(c.User.Filters.RetentionPolicies) == 0 {
+		return nil
+	}
+	fsPath, sftpPath, err := c.resolveRetentionPath(fs, fsPath, sftpPath, true)
+	if err != nil {
+		return err
+	}
+	return c.checkResolvedRetention(fs, fsPath, sftpPath)
+}
+
+// checkRetentionNoFollow is like checkRetention but a symlink at the given paths is not
+// followed, this must be used for the operations that modify the symlink itself, such as removes
+func (c Connection) checkRetentionNoFollow(fs vfs.Fs, fsPath, sftpPath string) error {
+	if len(c.User.Filters.RetentionPolicies) == 0 {
+		return nil
+	}
+	fsPath, sftpPath, err := c.resolveRetentionPath(fs, fsPath, sftpPath, false)
+	if err != nil {
+		return err
+	}
+	return c.checkResolvedRetention(fs, fsPath, sftpPath)
+}
+
+func (c Connection) checkResolvedRetention(fs vfs.Fs, fsPath, sftpPath string) error {
+	fi, err := fs.Lstat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	retainUntil, err := getRetainUntil(c.User, fi, sftpPath)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to get the retain until time for %#v: %v", sftpPath, err)
+		return err
+	}
+	if time.Now().Before(retainUntil) {
+		c.Log(logger.LevelInfo, logSender, "path %#v is locked by a retention policy until %v", sftpPath,
+			retainUntil.Format(time.RFC3339))
+		return errRetentionActive
+	}
+	return nil
+}
+
+// resolveRetentionPath returns the filesystem and SFTP paths of the real file for the given paths.
+// On the local filesystem a file inside a retention directory can be reached using a symlink, to it
+// or to one of its parent directories, so the policies must be evaluated for the real path.
+// If followSymlinks is false only the parent directories are resolved
+func (c Connection) resolveRetentionPath(fs vfs.Fs, fsPath, sftpPath string, followSymlinks bool) (string, string, error) {
+	if !vfs.IsLocalOsFs(fs) {
+		return fsPath, sftpPath, nil
+	}
+	rootPath, err := fs.ResolvePath("/")
+	if err != nil {
+		return "", "", err
+	}
+	if rootPath, err = filepath.EvalSymlinks(rootPath); err != nil {
+		return "", "", err
+	}
+	realPath, err := filepath.EvalSymlinks(filepath.Dir(fsPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the parent directory is missing and so the file too
+			return fsPath, sftpPath, nil
+		}
+		return "", "", err
+	}
+	realPath = filepath.Join(realPath, filepath.Base(fsPath))
+	if followSymlinks {
+		p, err := filepath.EvalSymlinks(realPath)
+		if err == nil {
+			realPath = p
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	rel, err := filepath.Rel(rootPath, realPath)
+	if err != nil {
+		return "", "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", "", fmt.Errorf("path %#v is outside the root dir %#v", realPath, rootPath)
+	}
+	realSFTPPath := path.Clean("/" + rel)
+	if folder, err := c.User.GetVirtualFolderForPath(sftpPath); err == nil {
+		realSFTPPath = path.Join(folder.VirtualPath, realSFTPPath)
+	}
+	return realPath, realSFTPPath, nil
+}
+
+// isRetentionPath returns true if the given paths, once resolved, are a retention
+// directory, a directory containing one or a file inside one. This is used to deny
+// symlinks and hard links that could bypass the retention policies
+func (c Connection) isRetentionPath(fs vfs.Fs, fsPath, sftpPath string) bool {
+	if len(c.User.Filters.RetentionPolicies) == 0 {
+		return false
+	}
+	_, sftpPath, err := c.resolveRetentionPath(fs, fsPath, sftpPath, true)
+	if err != nil {
+		return true
+	}
+	return c.User.HasRetentionPoliciesFor(sftpPath)
+}
+
+// checkRenameRetention returns errRetentionActive if the rename is not allowed by the retention policies.
+// Locked files cannot be renamed or replaced, directories cannot be renamed if a policy applies to them
+// or to their contents, files can be moved inside a retention directory only by uploading them
+func (c Connection) checkRenameRetention(fs vfs.Fs, sourcePath, targetPath, sftpSource, sftpTarget string) error {
+	if len(c.User.Filters.RetentionPolicies) == 0 {
+		return nil
+	}
+	sourcePath, sftpSource, err := c.resolveRetentionPath(fs, sourcePath, sftpSource, false)
+	if err != nil {
+		return err
+	}
+	targetPath, sftpTarget, err = c.resolveRetentionPath(fs, targetPath, sftpTarget, false)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.Lstat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if c.User.HasRetentionPoliciesFor(sftpSource) || c.User.HasRetentionPoliciesFor(sftpTarget) {
+			c.Log(logger.LevelInfo, logSender, "renaming directory %#v -> %#v is not allowed by the retention policies",
+				sftpSource, sftpTarget)
+			return errRetentionActive
+		}
+		return nil
+	}
+	if err = c.checkResolvedRetention(fs, sourcePath, sftpSource); err != nil {
+		return err
+	}
+	if err = c.checkResolvedRetention(fs, targetPath, sftpTarget); err != nil {
+		return err
+	}
+	if _, ok := c.User.GetRetentionPolicy(sftpTarget); ok {
+		if _, ok = c.User.GetRetentionPolicy(sftpSource); !ok {
+			c.Log(logger.LevelInfo, logSender, "moving %#v inside the retention directory %#v is not allowed",
+				sftpSource, path.Dir(sftpTarget))
+			return errRetentionActive
+		}
+	}
+	return nil
+}
+
+// GetRetentionStatus returns the write-once retention state for the given user's SFTP path
+func GetRetentionStatus(user dataprovider.User, sftpPath string) (RetentionStatus, error) {
+	if !path.IsAbs(sftpPath) {
+		return RetentionStatus{}, ErrInvalidRetentionPath
+	}
+	sftpPath = path.Clean(sftpPath)
+	status := RetentionStatus{
+		Path: sftpPath,
+	}
+	var fs vfs.Fs
+	var err error
+	fsPath := sftpPath
+	if folder, errFolder := user.GetVirtualFolderForPath(sftpPath); errFolder == nil {
+		fs, err = folder.GetFilesystem("", user.GetHomeDir())
+		fsPath = folder.GetRelativePath(sftpPath)
+	} else {
+		fs, err = user.GetFilesystem("")
+		if err == nil {
+			// the home dir is created on the first login, as for a login we create it if missing
+			fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+		}
+	}
+	if err != nil {
+		return status, err
+	}
+	defer fs.Close()
+	if fsPath, err = fs.ResolvePath(fsPath); err != nil {
+		return status, err
+	}
+	fi, err := fs.Lstat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return status, os.ErrNotExist
+		}
+		return status, err
+	}
+	status.IsDir = fi.IsDir()
+	if policy, ok := user.GetRetentionPolicy(sftpPath); ok {
+		status.PolicyPath = policy.Path
+		status.RetentionDays = policy.Days
+	}
+	retainUntil, err := getRetainUntil(user, fi, sftpPath)
+	if err != nil {
+		return status, err
+	}
+	if !retainUntil.IsZero() {
+		status.RetainUntil = utils.GetTimeAsMsSinceEpoch(retainUntil)
+		status.IsLocked = time.Now().Before(retainUntil)
+	}
+	return status, nil
+}
@@ -116,7 +116,7 @@ func (c *scpCommand) handleRecursiveUpload() error {
 
 func (c *scpCommand) handleCreateDir(dirPath string) error {
 	updateConnectionActivity(c.connection.ID)
-	p, err := c.connection.fs.ResolvePath(dirPath)
+	fs, p, err := c.connection.getFsAndResolvedPath(dirPath)
 	if err != nil {
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error creating dir: %#v, invalid file path, err: %v", dirPath, err)
 		c.sendErrorMessage(err.Error())
@@ -128,12 +128,18 @@ func (c *scpCommand) handleCreateDir(dirPath string) error {
 		c.sendErrorMessage(err.Error())
 		return err
 	}
+	if !c.connection.isFileAllowed(dirPath) {
+		err := fmt.Errorf("Permission denied")
+		c.sendErrorMessage(err.Error())
+		return err
+	}
 
-	err = c.createDir(p)
+	err = c.createDir(fs, p)
 	if err != nil {
 		return err
 	}
 	c.connection.Log(logger.LevelDebug, mkdirLogSender, "created dir %#v", dirPath)
+	enqueueReplication(c.connection.User, replicationOpSync, dirPath, "")
 	return nil
 }
 
@@ -157,7 +163,12 @@ func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *Transfer) err
 				transfer.Close()
 				return err
 			}
-			transfer.WriteAt(buf[:n], sizeToRead-remaining)
+			_, err = transfer.WriteAt(buf[:n], sizeToRead-remaining)
+			if err != nil {
+				c.sendErrorMessage(err.Error())
+				transfer.Close()
+				return err
+			}
 			remaining -= int64(n)
 			if remaining <= 0 {
 				break
@@ -181,37 +192,47 @@ func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *Transfer) err
 	return c.sendConfirmationMessage()
 }
 
-func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead int64, isNewFile bool, fileSize int64) error {
-	if !c.connection.hasSpace(true) {
+func (c *scpCommand) handleUploadFile(fs vfs.Fs, resolvedPath, filePath string, sizeToRead int64, isNewFile bool, fileSize int64,
+	requestPath string) error {
+	if !c.connection.hasSpace(true, requestPath) {
 		err := fmt.Errorf("denying file write due to space limit")
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", filePath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
 
+	_, err := c.connection.getRemainingTransferQuota(transferUpload)
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", filePath, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
 	initialSize := int64(0)
 	if !isNewFile {
-		if vfs.IsLocalOsFs(c.connection.fs) {
-			dataprovider.UpdateUserQuota(dataProvider, c.connection.User, 0, -fileSize, false)
+		if vfs.IsLocalOsFs(fs) {
+			updateUserOrFolderQuota(c.connection.User, requestPath, 0, -fileSize)
 		} else {
 			initialSize = fileSize
 		}
 	}
-	file, w, cancelFn, err := c.connection.fs.Create(filePath, 0)
+	file, w, cancelFn, err := fs.Create(filePath, 0)
 	if err != nil {
-		c.connection.Log(logger.LevelError, logSenderSCP, "error creating file %#v: %v", requestPath, err)
+		c.connection.Log(logger.LevelError, logSenderSCP, "error creating file %#v: %v", resolvedPath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
 
-	vfs.SetPathPermissions(c.connection.fs, filePath, c.connection.User.GetUID(), c.connection.User.GetGID())
+	vfs.SetPathPermissions(fs, filePath, c.connection.User.GetUID(), c.connection.User.GetGID())
+	retentionPath, retentionDays := c.connection.getUploadRetention(fs, resolvedPath, requestPath)
 
 	transfer := Transfer{
 		file:           file,
 		readerAt:       nil,
 		writerAt:       w,
 		cancelFn:       cancelFn,
-		path:           requestPath,
+		path:           resolvedPath,
+		requestPath:    requestPath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -225,6 +246,9 @@ func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead i
 		isFinished:     false,
 		minWriteOffset: 0,
 		initialSize:    initialSize,
+		maxWriteSize:   c.connection.getMaxUploadFileSize(),
+		retentionPath:  retentionPath,
+		retentionDays:  retentionDays,
 		lock:           new(sync.Mutex),
 	}
 	addTransfer(&transfer)
@@ -237,25 +261,39 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 
 	updateConnectionActivity(c.connection.ID)
 
-	p, err := c.connection.fs.ResolvePath(uploadFilePath)
+	if !c.connection.isFileAllowed(uploadFilePath) {
+		err := fmt.Errorf("Permission denied")
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
+	fs, p, err := c.connection.getFsAndResolvedPath(uploadFilePath)
 	if err != nil {
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", uploadFilePath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
+	// the SCP header announces the file size, an oversized upload is rejected before receiving any data
+	if maxSize := c.connection.getMaxUploadFileSize(); maxSize > 0 && sizeToRead > maxSize {
+		c.connection.Log(logger.LevelInfo, logSenderSCP, "denying upload of file %#v, size %v, max allowed size: %v",
+			uploadFilePath, sizeToRead, maxSize)
+		go executeAction(operationUploadSizeExceeded, c.connection.User.Username, p, "", "", sizeToRead, vfs.IsLocalOsFs(fs))
+		c.sendErrorMessage(errUploadFileSizeExceeded.Error())
+		return errUploadFileSizeExceeded
+	}
 	filePath := p
-	if isAtomicUploadEnabled() && c.connection.fs.IsAtomicUploadSupported() {
-		filePath = c.connection.fs.GetAtomicUploadPath(p)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		filePath = fs.GetAtomicUploadPath(p)
 	}
-	stat, statErr := c.connection.fs.Stat(p)
-	if c.connection.fs.IsNotExist(statErr) {
+	stat, statErr := fs.Stat(p)
+	if fs.IsNotExist(statErr) {
 		if !c.connection.User.HasPerm(dataprovider.PermUpload, path.Dir(uploadFilePath)) {
 			err := fmt.Errorf("Permission denied")
 			c.connection.Log(logger.LevelWarn, logSenderSCP, "cannot upload file: %#v, permission denied", uploadFilePath)
 			c.sendErrorMessage(err.Error())
 			return err
 		}
-		return c.handleUploadFile(p, filePath, sizeToRead, true, 0)
+		return c.handleUploadFile(fs, p, filePath, sizeToRead, true, 0, uploadFilePath)
 	}
 
 	if statErr != nil {
@@ -278,8 +316,13 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return err
 	}
 
-	if isAtomicUploadEnabled() && c.connection.fs.IsAtomicUploadSupported() {
-		err = c.connection.fs.Rename(p, filePath)
+	if err = c.connection.checkRetention(fs, p, uploadFilePath); err != nil {
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		err = fs.Rename(p, filePath)
 		if err != nil {
 			c.connection.Log(logger.LevelError, logSenderSCP, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %v",
 				p, filePath, err)
@@ -288,10 +331,10 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		}
 	}
 
-	return c.handleUploadFile(p, filePath, sizeToRead, false, stat.Size())
+	return c.handleUploadFile(fs, p, filePath, sizeToRead, false, stat.Size(), uploadFilePath)
 }
 
-func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileInfo) error {
+func (c *scpCommand) sendDownloadProtocolMessages(dirName string, stat os.FileInfo) error {
 	var err error
 	if c.sendFileTime() {
 		modTime := stat.ModTime().UnixNano() / 1000000000
@@ -306,7 +349,7 @@ func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileIn
 		}
 	}
 
-	fileMode := fmt.Sprintf("D%v 0 %v\n", getFileModeAsString(stat.Mode(), stat.IsDir()), filepath.Base(dirPath))
+	fileMode := fmt.Sprintf("D%v 0 %v\n", getFileModeAsString(stat.Mode(), stat.IsDir()), dirName)
 	err = c.sendProtocolMessage(fileMode)
 	if err != nil {
 		return err
@@ -317,22 +360,31 @@ func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileIn
 
 // we send first all the files in the root directory and then the directories
 // for each directory we recursively call this method again
-func (c *scpCommand) handleRecursiveDownload(dirPath string, stat os.FileInfo) error {
+func (c *scpCommand) handleRecursiveDownload(fs vfs.Fs, dirPath, requestPath string, stat os.FileInfo) error {
 	var err error
 	if c.isRecursive() {
 		c.connection.Log(logger.LevelDebug, logSenderSCP, "recursive download, dir path: %#v", dirPath)
-		err = c.sendDownloadProtocolMessages(dirPath, stat)
+		dirName := filepath.Base(dirPath)
+		if c.connection.User.IsVirtualFolder(requestPath) {
+			dirName = path.Base(requestPath)
+		}
+		err = c.sendDownloadProtocolMessages(dirName, stat)
 		if err != nil {
 			return err
 		}
-		files, err := c.connection.fs.ReadDir(dirPath)
+		files, err := fs.ReadDir(dirPath)
 		if err != nil {
 			c.sendErrorMessage(err.Error())
 			return err
 		}
+		if c.connection.User.Filters.Trash.Enabled {
+			files = hideTrashDir(files, requestPath)
+		}
+		files = hideDeniedFiles(c.connection.User, files, requestPath)
+		files = c.connection.User.AddVirtualDirs(files, requestPath)
 		var dirs []string
 		for _, file := range files {
-			filePath := c.connection.fs.GetRelativePath(c.connection.fs.Join(dirPath, file.Name()))
+			filePath := path.Join(requestPath, file.Name())
 			if file.Mode().IsRegular() || file.Mode()&os.ModeSymlink == os.ModeSymlink {
 				err = c.handleDownload(filePath)
 				if err != nil {
@@ -429,7 +481,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 
 	updateConnectionActivity(c.connection.ID)
 
-	p, err := c.connection.fs.ResolvePath(filePath)
+	fs, p, err := c.connection.getFsAndResolvedPath(filePath)
 	if err != nil {
 		err := fmt.Errorf("Invalid file path")
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error downloading file: %#v, invalid file path", filePath)
@@ -437,8 +489,14 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		return err
 	}
 
+	if !c.connection.isFileAllowed(filePath) {
+		err := fmt.Errorf("Permission denied")
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
 	var stat os.FileInfo
-	if stat, err = c.connection.fs.Stat(p); err != nil {
+	if stat, err = fs.Stat(p); err != nil {
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error downloading file: %#v, err: %v", p, err)
 		c.sendErrorMessage(err.Error())
 		return err
@@ -451,7 +509,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 			c.sendErrorMessage(err.Error())
 			return err
 		}
-		err = c.handleRecursiveDownload(p, stat)
+		err = c.handleRecursiveDownload(fs, p, filePath, stat)
 		return err
 	}
 
@@ -462,7 +520,14 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		return err
 	}
 
-	file, r, cancelFn, err := c.connection.fs.Open(p)
+	_, err = c.connection.getRemainingTransferQuota(transferDownload)
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error downloading file: %#v, err: %v", p, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
+	file, r, cancelFn, err := fs.Open(p)
 	if err != nil {
 		c.connection.Log(logger.LevelError, logSenderSCP, "could not open file %#v for reading: %v", p, err)
 		c.sendErrorMessage(err.Error())
@@ -475,6 +540,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		writerAt:       nil,
 		cancelFn:       cancelFn,
 		path:           p,
+		requestPath:    filePath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -619,14 +685,14 @@ func (c *scpCommand) getNextUploadProtocolMessage() (string, error) {
 	return command, err
 }
 
-func (c *scpCommand) createDir(dirPath string) error {
+func (c *scpCommand) createDir(fs vfs.Fs, dirPath string) error {
 	var err error
-	if err = c.connection.fs.Mkdir(dirPath); err != nil {
+	if err = fs.Mkdir(dirPath); err != nil {
 		c.connection.Log(logger.LevelError, logSenderSCP, "error creating dir: %v", dirPath)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
-	vfs.SetPathPermissions(c.connection.fs, dirPath, c.connection.User.GetUID(), c.connection.User.GetGID())
+	vfs.SetPathPermissions(fs, dirPath, c.connection.User.GetUID(), c.connection.User.GetGID())
 	return err
 }
 
@@ -681,8 +747,8 @@ func (c *scpCommand) getFileUploadDestPath(scpDestPath, fileName string) string
 			// but if scpDestPath is an existing directory then we put the uploaded file
 			// inside that directory this is as scp command works, for example:
 			// scp fileName.txt user@127.0.0.1:/existing_dir
-			if p, err := c.connection.fs.ResolvePath(scpDestPath); err == nil {
-				if stat, err := c.connection.fs.Stat(p); err == nil {
+			if fs, p, err := c.connection.getFsAndResolvedPath(scpDestPath); err == nil {
+				if stat, err := fs.Stat(p); err == nil {
 					if stat.IsDir() {
 						return path.Join(scpDestPath, fileName)
 					}
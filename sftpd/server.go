@@ -20,13 +20,15 @@ import (
 	"github.com/freshvolk/sftpgo/logger"
 	"github.com/freshvolk/sftpgo/metrics"
 	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 const defaultPrivateKeyName = "id_rsa"
 
-var sftpExtensions = []string{"posix-rename@openssh.com"}
+var sftpExtensions = []string{"posix-rename@openssh.com", "hardlink@openssh.com", "statvfs@openssh.com",
+	"fsync@openssh.com", "limits@openssh.com", "copy-data", "check-file"}
 
 // Configuration for the SFTP server
 type Configuration struct {
@@ -100,6 +102,35 @@ type Configuration struct {
 	// Absolute path to an external program to use for keyboard interactive authentication.
 	// Leave empty to disable this authentication mode.
 	KeyboardInteractiveProgram string `json:"keyboard_interactive_auth_program" mapstructure:"keyboard_interactive_auth_program"`
+	// Directory where the state of the in progress S3 multipart uploads is persisted, this allows
+	// to resume S3 uploads interrupted by a client disconnection. The path can be absolute or
+	// relative to the configuration directory. Leave empty to disable upload resume for S3.
+	S3UploadsStatePath string `json:"s3_uploads_state_path" mapstructure:"s3_uploads_state_path"`
+	// Maximum age, as hours, for interrupted S3 multipart uploads. Uploads not resumed within
+	// this time are aborted by a background cleaner. 0 disables the cleaner
+	S3UploadsMaxAge int `json:"s3_uploads_max_age" mapstructure:"s3_uploads_max_age"`
+	// Time to live, as seconds, for the S3 and GCS metadata cache. Each connection caches the
+	// results of the stat and list requests and invalidates them on its own writes, renames and
+	// removes, changes made by other connections are visible after the TTL. 0 disables the cache
+	CloudMetadataCacheTTL int `json:"cloud_metadata_cache_ttl" mapstructure:"cloud_metadata_cache_ttl"`
+	// Directory where the pending operations for the users with replication enabled are persisted.
+	// The failed operations are retried from here, even after a restart. The path can be absolute or
+	// relative to the configuration directory. Leave empty to disable the replication
+	ReplicationQueuePath string `json:"replication_queue_path" mapstructure:"replication_queue_path"`
+	// Directory where the metadata for the files moved to the cold tier are stored. The path can be
+	// absolute or relative to the configuration directory. Leave empty to disable the tiering.
+	// The tiered files are unreadable without these metadata, this directory must be backed up
+	TieringStatePath string `json:"tiering_state_path" mapstructure:"tiering_state_path"`
+	// Maximum number of directories, or first level prefixes for S3, scanned concurrently
+	// by a quota scan. 0 or 1 means serial scans
+	QuotaScanParallelism int `json:"quota_scan_parallelism" mapstructure:"quota_scan_parallelism"`
+	// Directory where the per directory summaries for the incremental quota scans are stored.
+	// The path can be absolute or relative to the configuration directory. Leave empty to
+	// disable the incremental quota scans
+	QuotaScanStatePath string `json:"quota_scan_state_path" mapstructure:"quota_scan_state_path"`
+	// Maximum size, as bytes, allowed for a single uploaded file. It can be overridden for each
+	// user. 0 means unlimited
+	MaxUploadFileSize int64 `json:"max_upload_file_size" mapstructure:"max_upload_file_size"`
 }
 
 // Key contains information about host keys
@@ -178,6 +209,20 @@ func (c Configuration) Initialize(configDir string) error {
 	c.configureLoginBanner(serverConfig, configDir)
 	c.configureSFTPExtensions()
 	c.checkSSHCommands()
+	if err := c.configureS3Uploads(configDir); err != nil {
+		return err
+	}
+	vfs.SetMetadataCacheTTL(time.Duration(c.CloudMetadataCacheTTL) * time.Second)
+	if err := c.configureReplication(configDir); err != nil {
+		return err
+	}
+	if err := c.configureTiering(configDir); err != nil {
+		return err
+	}
+	if err := c.configureQuotaScans(configDir); err != nil {
+		return err
+	}
+	startTrashCleaner()
 
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
 	if err != nil {
@@ -188,6 +233,7 @@ func (c Configuration) Initialize(configDir string) error {
 	actions = c.Actions
 	uploadMode = c.UploadMode
 	setstatMode = c.SetstatMode
+	maxUploadFileSize = c.MaxUploadFileSize
 	logger.Info(logSender, "", "server listener registered address: %v", listener.Addr().String())
 	if c.IdleTimeout > 0 {
 		startIdleTimer(time.Duration(c.IdleTimeout) * time.Minute)
@@ -201,6 +247,61 @@ func (c Configuration) Initialize(configDir string) error {
 	}
 }
 
+func (c Configuration) configureS3Uploads(configDir string) error {
+	statePath := c.S3UploadsStatePath
+	if len(statePath) > 0 && !filepath.IsAbs(statePath) {
+		statePath = filepath.Join(configDir, statePath)
+	}
+	if err := vfs.SetS3UploadsStateDir(statePath); err != nil {
+		logger.Warn(logSender, "", "unable to set the S3 uploads state path %#v: %v", statePath, err)
+		return err
+	}
+	if len(statePath) > 0 && c.S3UploadsMaxAge > 0 {
+		startS3UploadsCleaner(time.Duration(c.S3UploadsMaxAge) * time.Hour)
+	}
+	return nil
+}
+
+func (c Configuration) configureReplication(configDir string) error {
+	queuePath := c.ReplicationQueuePath
+	if len(queuePath) > 0 && !filepath.IsAbs(queuePath) {
+		queuePath = filepath.Join(configDir, queuePath)
+	}
+	if err := configureReplication(queuePath); err != nil {
+		logger.Warn(logSender, "", "unable to set the replication queue path %#v: %v", queuePath, err)
+		return err
+	}
+	return nil
+}
+
+func (c Configuration) configureQuotaScans(configDir string) error {
+	statePath := c.QuotaScanStatePath
+	if len(statePath) > 0 {
+		if !filepath.IsAbs(statePath) {
+			statePath = filepath.Join(configDir, statePath)
+		}
+		if err := os.MkdirAll(statePath, 0700); err != nil {
+			logger.Warn(logSender, "", "unable to create the quota scan state path %#v: %v", statePath, err)
+			return err
+		}
+	}
+	quotaScanParallelism = c.QuotaScanParallelism
+	quotaScanStatePath = statePath
+	return nil
+}
+
+func (c Configuration) configureTiering(configDir string) error {
+	statePath := c.TieringStatePath
+	if len(statePath) > 0 && !filepath.IsAbs(statePath) {
+		statePath = filepath.Join(configDir, statePath)
+	}
+	if err := configureTiering(statePath); err != nil {
+		logger.Warn(logSender, "", "unable to set the tiering state path %#v: %v", statePath, err)
+		return err
+	}
+	return nil
+}
+
 func (c Configuration) configureSecurityOptions(serverConfig *ssh.ServerConfig) {
 	if len(c.KexAlgorithms) > 0 {
 		serverConfig.KeyExchanges = c.KexAlgorithms
@@ -303,6 +404,19 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 		conn.Close()
 		return
 	}
+	defer fs.Close()
+
+	folderFs := make(map[string]vfs.Fs)
+	for _, v := range user.VirtualFolders {
+		vfolderFs, err := v.GetFilesystem(connectionID, user.GetHomeDir())
+		if err != nil {
+			logger.Warn(logSender, connectionID, "unable to create filesystem for virtual folder %#v mounted on %#v: %v",
+				v.Name, v.VirtualPath, err)
+			continue
+		}
+		defer vfolderFs.Close()
+		folderFs[v.VirtualPath] = vfolderFs
+	}
 
 	connection := Connection{
 		ID:            connectionID,
@@ -314,9 +428,14 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 		netConn:       conn,
 		channel:       nil,
 		fs:            fs,
+		folderFs:      folderFs,
+		workingDir:    &sshWorkingDir{path: "/"},
 	}
 
 	connection.fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	for _, vfolderFs := range connection.folderFs {
+		vfolderFs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	}
 
 	connection.Log(logger.LevelInfo, logSender, "User id: %d, logged in with: %#v, username: %#v, home_dir: %#v remote addr: %#v",
 		user.ID, loginType, user.Username, user.HomeDir, remoteAddr.String())
@@ -340,8 +459,10 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 		}
 
 		// Channels have a type that is dependent on the protocol. For SFTP this is "subsystem"
-		// with a payload that (should) be "sftp". Discard anything else we receive ("pty", "shell", etc)
+		// with a payload that (should) be "sftp". "pty-req" and "shell" are accepted only if the
+		// interactive shell is enabled, discard anything else we receive
 		go func(in <-chan *ssh.Request) {
+			usePty := false
 			for req := range in {
 				ok := false
 
@@ -355,6 +476,11 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 					}
 				case "exec":
 					ok = processSSHCommand(req.Payload, &connection, channel, c.EnabledSSHCommands)
+				case "pty-req":
+					ok = utils.IsStringInSlice(shellSSHCommand, c.EnabledSSHCommands)
+					usePty = ok
+				case "shell":
+					ok = processShellRequest(&connection, channel, usePty, c.EnabledSSHCommands)
 				}
 				req.Reply(ok, nil)
 			}
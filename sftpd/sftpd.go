@@ -5,6 +5,8 @@ package sftpd
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -18,6 +20,7 @@ import (
 	"github.com/freshvolk/sftpgo/logger"
 	"github.com/freshvolk/sftpgo/metrics"
 	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
 )
 
 const (
@@ -53,18 +56,25 @@ const (
 )
 
 var (
-	mutex                sync.RWMutex
-	openConnections      map[string]Connection
-	activeTransfers      []*Transfer
-	idleConnectionTicker *time.Ticker
-	idleTimeout          time.Duration
-	activeQuotaScans     []ActiveQuotaScan
-	dataProvider         dataprovider.Provider
-	actions              Actions
-	uploadMode           int
-	setstatMode          int
-	supportedSSHCommands = []string{"scp", "md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum", "cd", "pwd",
-		"git-receive-pack", "git-upload-pack", "git-upload-archive", "rsync"}
+	mutex                   sync.RWMutex
+	openConnections         map[string]Connection
+	activeTransfers         []*Transfer
+	idleConnectionTicker    *time.Ticker
+	idleTimeout             time.Duration
+	s3UploadsCleanupTicker  *time.Ticker
+	s3UploadsMaxAge         time.Duration
+	activeQuotaScans        []ActiveQuotaScan
+	activeVFoldersQuotaScan []ActiveVirtualFolderQuotaScan
+	quotaScanParallelism    int
+	quotaScanStatePath      string
+	dataProvider            dataprovider.Provider
+	actions                 Actions
+	uploadMode              int
+	setstatMode             int
+	maxUploadFileSize       int64
+	supportedSSHCommands    = []string{"scp", "md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum", "cd", "pwd",
+		"ls", "mkdir", "rm", "mv", "du", "df", "stat", "cat", "touch", "shell", "git-receive-pack", "git-upload-pack",
+		"git-upload-archive", "rsync", "sftpgo-copy", "cp"}
 	defaultSSHCommands = []string{"md5sum", "sha1sum", "cd", "pwd"}
 	sshHashCommands    = []string{"md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum"}
 	systemCommands     = []string{"git-receive-pack", "git-upload-pack", "git-upload-archive", "rsync"}
@@ -84,12 +94,61 @@ type ActiveQuotaScan struct {
 	Username string `json:"username"`
 	// quota scan start time as unix timestamp in milliseconds
 	StartTime int64 `json:"start_time"`
+	QuotaScanProgress
+	monitor *quotaScanMonitor
+}
+
+// ActiveVirtualFolderQuotaScan defines an active quota scan for a virtual folder
+type ActiveVirtualFolderQuotaScan struct {
+	// folder name to which the quota scan refers
+	Name string `json:"name"`
+	// quota scan start time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	QuotaScanProgress
+	monitor *quotaScanMonitor
+}
+
+// QuotaScanProgress defines the progress for an active quota scan
+type QuotaScanProgress struct {
+	// true if the files inside the directories unchanged since the previous incremental scan are not evaluated again
+	Incremental bool `json:"incremental"`
+	// number of files, and their size, scanned so far
+	ScannedFiles int   `json:"scanned_files"`
+	ScannedSize  int64 `json:"scanned_size"`
+	// elapsed time in milliseconds
+	Elapsed int64 `json:"elapsed"`
+}
+
+// quotaScanMonitor allows to track the progress of a quota scan and to cancel it
+type quotaScanMonitor struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	progress    vfs.ScanProgress
+	incremental bool
+}
+
+func newQuotaScanMonitor() *quotaScanMonitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &quotaScanMonitor{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (m *quotaScanMonitor) getProgress(startTime int64) QuotaScanProgress {
+	numFiles, size := m.progress.Get()
+	return QuotaScanProgress{
+		Incremental:  m.incremental,
+		ScannedFiles: numFiles,
+		ScannedSize:  size,
+		Elapsed:      utils.GetTimeAsMsSinceEpoch(time.Now()) - startTime,
+	}
 }
 
 // Actions to execute on SFTP create, download, delete and rename.
 // An external command can be executed and/or an HTTP notification can be fired
 type Actions struct {
-	// Valid values are download, upload, delete, rename, ssh_cmd. Empty slice to disable
+	// Valid values are download, upload, delete, rename, ssh_cmd, upload_size_exceeded. Empty slice to disable
 	ExecuteOn []string `json:"execute_on" mapstructure:"execute_on"`
 	// Absolute path to the command to execute, empty to disable
 	Command string `json:"command" mapstructure:"command"`
@@ -213,8 +272,14 @@ func getActiveSessions(username string) int {
 func GetQuotaScans() []ActiveQuotaScan {
 	mutex.RLock()
 	defer mutex.RUnlock()
-	scans := make([]ActiveQuotaScan, len(activeQuotaScans))
-	copy(scans, activeQuotaScans)
+	scans := make([]ActiveQuotaScan, 0, len(activeQuotaScans))
+	for _, s := range activeQuotaScans {
+		scans = append(scans, ActiveQuotaScan{
+			Username:          s.Username,
+			StartTime:         s.StartTime,
+			QuotaScanProgress: s.monitor.getProgress(s.StartTime),
+		})
+	}
 	return scans
 }
 
@@ -231,6 +296,7 @@ func AddQuotaScan(username string) bool {
 	activeQuotaScans = append(activeQuotaScans, ActiveQuotaScan{
 		Username:  username,
 		StartTime: utils.GetTimeAsMsSinceEpoch(time.Now()),
+		monitor:   newQuotaScanMonitor(),
 	})
 	return true
 }
@@ -248,6 +314,7 @@ func RemoveQuotaScan(username string) error {
 		}
 	}
 	if indexToRemove >= 0 {
+		activeQuotaScans[indexToRemove].monitor.cancel()
 		activeQuotaScans[indexToRemove] = activeQuotaScans[len(activeQuotaScans)-1]
 		activeQuotaScans = activeQuotaScans[:len(activeQuotaScans)-1]
 	} else {
@@ -257,6 +324,153 @@ func RemoveQuotaScan(username string) error {
 	return err
 }
 
+// GetVFoldersQuotaScans returns the active quota scans for virtual folders
+func GetVFoldersQuotaScans() []ActiveVirtualFolderQuotaScan {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	scans := make([]ActiveVirtualFolderQuotaScan, 0, len(activeVFoldersQuotaScan))
+	for _, s := range activeVFoldersQuotaScan {
+		scans = append(scans, ActiveVirtualFolderQuotaScan{
+			Name:              s.Name,
+			StartTime:         s.StartTime,
+			QuotaScanProgress: s.monitor.getProgress(s.StartTime),
+		})
+	}
+	return scans
+}
+
+// AddVFolderQuotaScan add a virtual folder to the ones with active quota scans.
+// Returns false if the folder has a quota scan already running
+func AddVFolderQuotaScan(folderName string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, s := range activeVFoldersQuotaScan {
+		if s.Name == folderName {
+			return false
+		}
+	}
+	activeVFoldersQuotaScan = append(activeVFoldersQuotaScan, ActiveVirtualFolderQuotaScan{
+		Name:      folderName,
+		StartTime: utils.GetTimeAsMsSinceEpoch(time.Now()),
+		monitor:   newQuotaScanMonitor(),
+	})
+	return true
+}
+
+// RemoveVFolderQuotaScan removes a folder from the ones with active quota scans
+func RemoveVFolderQuotaScan(folderName string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var err error
+	indexToRemove := -1
+	for i, s := range activeVFoldersQuotaScan {
+		if s.Name == folderName {
+			indexToRemove = i
+			break
+		}
+	}
+	if indexToRemove >= 0 {
+		activeVFoldersQuotaScan[indexToRemove].monitor.cancel()
+		activeVFoldersQuotaScan[indexToRemove] = activeVFoldersQuotaScan[len(activeVFoldersQuotaScan)-1]
+		activeVFoldersQuotaScan = activeVFoldersQuotaScan[:len(activeVFoldersQuotaScan)-1]
+	} else {
+		logger.Warn(logSender, "", "quota scan to remove not found for folder: %#v", folderName)
+		err = fmt.Errorf("quota scan to remove not found for folder: %#v", folderName)
+	}
+	return err
+}
+
+// CancelQuotaScan requests the cancellation of the active quota scan for the specified user.
+// The scan is removed from the active ones as soon as it stops
+func CancelQuotaScan(username string) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, s := range activeQuotaScans {
+		if s.Username == username {
+			s.monitor.cancel()
+			return nil
+		}
+	}
+	return fmt.Errorf("quota scan not found for user: %v", username)
+}
+
+// CancelVFolderQuotaScan requests the cancellation of the active quota scan for the specified folder.
+// The scan is removed from the active ones as soon as it stops
+func CancelVFolderQuotaScan(folderName string) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, s := range activeVFoldersQuotaScan {
+		if s.Name == folderName {
+			s.monitor.cancel()
+			return nil
+		}
+	}
+	return fmt.Errorf("quota scan not found for folder: %#v", folderName)
+}
+
+// IsIncrementalQuotaScanEnabled returns true if the incremental quota scans are enabled
+func IsIncrementalQuotaScanEnabled() bool {
+	return len(quotaScanStatePath) > 0
+}
+
+// ScanUserQuota scans the root directory of fs for the active quota scan added for the
+// specified user using AddQuotaScan. The scan can be cancelled using CancelQuotaScan
+func ScanUserQuota(username string, fs vfs.Fs, incremental bool) (int, int64, error) {
+	monitor := getQuotaScanMonitor(username)
+	if monitor == nil {
+		return 0, 0, fmt.Errorf("quota scan not found for user: %v", username)
+	}
+	mutex.Lock()
+	monitor.incremental = incremental
+	mutex.Unlock()
+	return scanQuota(monitor, fs, incremental, "user_"+username)
+}
+
+func getQuotaScanMonitor(username string) *quotaScanMonitor {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, s := range activeQuotaScans {
+		if s.Username == username {
+			return s.monitor
+		}
+	}
+	return nil
+}
+
+// ScanVFolderQuota scans the root directory of fs for the active quota scan added for the
+// specified folder using AddVFolderQuotaScan. The scan can be cancelled using CancelVFolderQuotaScan
+func ScanVFolderQuota(folderName string, fs vfs.Fs, incremental bool) (int, int64, error) {
+	var monitor *quotaScanMonitor
+	mutex.Lock()
+	for _, s := range activeVFoldersQuotaScan {
+		if s.Name == folderName {
+			monitor = s.monitor
+			monitor.incremental = incremental
+			break
+		}
+	}
+	mutex.Unlock()
+	if monitor == nil {
+		return 0, 0, fmt.Errorf("quota scan not found for folder: %#v", folderName)
+	}
+	return scanQuota(monitor, fs, incremental, "folder_"+folderName)
+}
+
+func scanQuota(monitor *quotaScanMonitor, fs vfs.Fs, incremental bool, summaryID string) (int, int64, error) {
+	if incremental && !IsIncrementalQuotaScanEnabled() {
+		return 0, 0, errors.New("incremental quota scans are disabled")
+	}
+	options := vfs.ScanOptions{
+		Parallelism: quotaScanParallelism,
+		Incremental: incremental,
+	}
+	// full scans refresh the summaries too
+	if IsIncrementalQuotaScanEnabled() {
+		options.SummaryFile = filepath.Join(quotaScanStatePath, fmt.Sprintf("%x.json", sha256.Sum256([]byte(summaryID))))
+	}
+	return vfs.ScanFsContents(monitor.ctx, fs, options, &monitor.progress)
+}
+
 // CloseActiveConnection closes an active SFTP connection.
 // It returns true on success
 func CloseActiveConnection(connectionID string) bool {
@@ -307,7 +521,7 @@ func GetConnectionsStats() []ConnectionStatus {
 					StartTime:     utils.GetTimeAsMsSinceEpoch(t.start),
 					Size:          size,
 					LastActivity:  utils.GetTimeAsMsSinceEpoch(t.lastActivity),
-					Path:          c.fs.GetRelativePath(t.path),
+					Path:          t.requestPath,
 				}
 				conn.Transfers = append(conn.Transfers, connTransfer)
 			}
@@ -327,6 +541,83 @@ func startIdleTimer(maxIdleTime time.Duration) {
 	}()
 }
 
+func startS3UploadsCleaner(maxAge time.Duration) {
+	s3UploadsMaxAge = maxAge
+	s3UploadsCleanupTicker = time.NewTicker(1 * time.Hour)
+	go func() {
+		for t := range s3UploadsCleanupTicker.C {
+			logger.Debug(logSender, "", "S3 uploads cleanup ticker %v", t)
+			CleanupStaleS3Uploads(s3UploadsMaxAge)
+		}
+	}()
+}
+
+// CleanupStaleS3Uploads aborts the interrupted S3 multipart uploads not resumed
+// within the specified max age
+func CleanupStaleS3Uploads(maxAge time.Duration) {
+	if !vfs.HasStaleS3Uploads(maxAge) {
+		return
+	}
+	aborted := 0
+	for _, fs := range getS3Filesystems() {
+		aborted += fs.AbortStaleUploads(maxAge)
+	}
+	removed := vfs.RemoveOrphanS3UploadStates(maxAge)
+	logger.Info(logSender, "", "S3 uploads cleanup done, aborted uploads: %v, orphan states removed: %v", aborted, removed)
+}
+
+// getS3Filesystems returns the S3 filesystems for all the users and virtual folders
+func getS3Filesystems() []vfs.S3Fs {
+	var result []vfs.S3Fs
+	addFs := func(fs vfs.Fs, err error) {
+		if err != nil {
+			return
+		}
+		if s3Fs, ok := fs.(vfs.S3Fs); ok {
+			result = append(result, s3Fs)
+		}
+	}
+	limit := 100
+	for offset := 0; ; offset += limit {
+		users, err := dataprovider.GetUsers(dataProvider, limit, offset, "ASC", "")
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get users for S3 uploads cleanup: %v", err)
+			break
+		}
+		for _, u := range users {
+			if u.FsConfig.Provider == 1 {
+				// users are returned without credentials
+				user, err := dataprovider.UserExists(dataProvider, u.Username)
+				if err == nil {
+					addFs(user.GetFilesystem(""))
+				}
+			}
+		}
+		if len(users) < limit {
+			break
+		}
+	}
+	for offset := 0; ; offset += limit {
+		folders, err := dataprovider.GetFolders(dataProvider, limit, offset, "ASC", "")
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get folders for S3 uploads cleanup: %v", err)
+			break
+		}
+		for _, f := range folders {
+			if f.FsConfig.Provider == 1 {
+				folder, err := dataprovider.GetFolderByID(dataProvider, f.ID)
+				if err == nil {
+					addFs(folder.GetFilesystem("", ""))
+				}
+			}
+		}
+		if len(folders) < limit {
+			break
+		}
+	}
+	return result
+}
+
 // CheckIdleConnections disconnects clients idle for too long, based on IdleTimeout setting
 func CheckIdleConnections() {
 	mutex.RLock()
@@ -376,6 +667,7 @@ func removeConnection(c Connection) {
 }
 
 func addTransfer(transfer *Transfer) {
+	transfer.transferQuota = acquireTransferQuotaTracker(transfer.user)
 	mutex.Lock()
 	defer mutex.Unlock()
 	activeTransfers = append(activeTransfers, transfer)
@@ -395,6 +687,7 @@ func removeTransfer(transfer *Transfer) error {
 	if indexToRemove >= 0 {
 		activeTransfers[indexToRemove] = activeTransfers[len(activeTransfers)-1]
 		activeTransfers = activeTransfers[:len(activeTransfers)-1]
+		releaseTransferQuotaTracker(transfer.user.Username, transfer.transferQuota)
 	} else {
 		logger.Warn(logSender, transfer.connectionID, "transfer to remove not found!")
 		err = fmt.Errorf("transfer to remove not found")
@@ -3,9 +3,12 @@ package sftpd_test
 import (
 	"bufio"
 	"bytes"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash"
@@ -19,6 +22,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -86,6 +90,12 @@ RLFFQ/5nclJSdzPBOmQouC0OBcMFSrYtMeknJ4VvueVvve5HcHFaEsaMc7ABAGaLYaBQOm
 iixITGvaNZh/tjAAAACW5pY29sYUBwMQE=
 -----END OPENSSH PRIVATE KEY-----`
 	configDir = ".."
+	// S3 tests require a MinIO server listening on this endpoint with an
+	// existing bucket, they are skipped otherwise
+	s3TestEndpoint  = "http://127.0.0.1:9000"
+	s3TestBucket    = "sftpgo-test"
+	s3TestAccessKey = "minioadmin"
+	s3TestSecret    = "minioadmin"
 )
 
 var (
@@ -145,6 +155,10 @@ func TestMain(m *testing.M) {
 	keyIntAuthPath = filepath.Join(homeBasePath, "keyintauth.sh")
 	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
 	sftpdConf.KeyboardInteractiveProgram = keyIntAuthPath
+	sftpdConf.S3UploadsStatePath = filepath.Join(homeBasePath, "s3_uploads_state")
+	sftpdConf.ReplicationQueuePath = filepath.Join(homeBasePath, "replication_queue")
+	sftpdConf.TieringStatePath = filepath.Join(homeBasePath, "tiering_state")
+	sftpdConf.QuotaScanStatePath = filepath.Join(homeBasePath, "quota_scan_state")
 
 	scpPath, err = exec.LookPath("scp")
 	if err != nil {
@@ -211,6 +225,10 @@ func TestMain(m *testing.M) {
 	os.Remove(gitWrapPath)
 	os.Remove(extAuthPath)
 	os.Remove(keyIntAuthPath)
+	os.RemoveAll(sftpdConf.S3UploadsStatePath)
+	os.RemoveAll(sftpdConf.ReplicationQueuePath)
+	os.RemoveAll(sftpdConf.TieringStatePath)
+	os.RemoveAll(sftpdConf.QuotaScanStatePath)
 	os.Exit(exitCode)
 }
 
@@ -221,7 +239,10 @@ func TestInitialization(t *testing.T) {
 	sftpdConf.BindPort = 2022
 	sftpdConf.LoginBannerFile = "invalid_file"
 	sftpdConf.IsSCPEnabled = true
-	sftpdConf.EnabledSSHCommands = append(sftpdConf.EnabledSSHCommands, "ls")
+	sftpdConf.EnabledSSHCommands = append(sftpdConf.EnabledSSHCommands, "uname")
+	// keep the state paths used by the running server
+	sftpdConf.TieringStatePath = filepath.Join(homeBasePath, "tiering_state")
+	sftpdConf.QuotaScanStatePath = filepath.Join(homeBasePath, "quota_scan_state")
 	err := sftpdConf.Initialize(configDir)
 	if err == nil {
 		t.Error("Inizialize must fail, a SFTP server should be already running")
@@ -372,142 +393,161 @@ func TestUploadResume(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestDirCommands(t *testing.T) {
+func TestSFTPFsBackend(t *testing.T) {
 	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	baseUser, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	// remove the home dir to test auto creation
-	os.RemoveAll(user.HomeDir)
+	hostKey, err := ioutil.ReadFile(filepath.Join(configDir, "id_rsa"))
+	if err != nil {
+		t.Errorf("unable to read host key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(hostKey)
+	if err != nil {
+		t.Errorf("unable to parse host key: %v", err)
+	}
+	u := getTestUser(usePubKey)
+	u.Username = defaultUsername + "_sftpfs"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	u.FsConfig.Provider = 4
+	u.FsConfig.SFTPConfig = vfs.SFTPFsConfig{
+		Endpoint:     sftpServerAddr,
+		Username:     baseUser.Username,
+		Password:     defaultPassword,
+		Fingerprints: []string{"SHA256:invalid"},
+		Prefix:       "/remote/dir",
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login must fail, the remote host key fingerprint is invalid")
+	}
+	user.FsConfig.SFTPConfig.Fingerprints = []string{ssh.FingerprintSHA256(signer.PublicKey())}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		err = client.Mkdir("test1")
+		remoteDir := filepath.Join(baseUser.GetHomeDir(), "remote", "dir")
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		appendDataSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("error mkdir: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
-		err = client.Rename("test1", "test")
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("error rename: %v", err)
-		}
-		_, err = client.Lstat("/test1")
-		if err == nil {
-			t.Errorf("stat for renamed dir must not succeed")
+			t.Errorf("file upload error: %v", err)
 		}
-		err = client.PosixRename("test", "test1")
+		fi, err := os.Stat(filepath.Join(remoteDir, testFileName))
 		if err != nil {
-			t.Errorf("error posix rename: %v", err)
+			t.Errorf("the uploaded file must be stored on the remote server: %v", err)
+		} else if fi.Size() != testFileSize {
+			t.Errorf("remote file size does not match, actual: %v, expected: %v", fi.Size(), testFileSize)
 		}
-		err = client.Remove("test1")
+		// overwrite the existing file
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("error rmdir: %v", err)
-		}
-		err = client.Mkdir("/test/test1")
-		if err == nil {
-			t.Errorf("recursive mkdir must fail")
+			t.Errorf("file upload error: %v", err)
 		}
-		client.Mkdir("/test")
-		err = client.Mkdir("/test/test1")
+		err = appendToTestFile(testFilePath, appendDataSize)
 		if err != nil {
-			t.Errorf("mkdir dir error: %v", err)
+			t.Errorf("unable to append to test file: %v", err)
 		}
-		_, err = client.ReadDir("/this/dir/does/not/exist")
-		if err == nil {
-			t.Errorf("reading a missing dir must fail")
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+appendDataSize, false, client)
+		if err != nil {
+			t.Errorf("file upload resume error: %v", err)
 		}
-		err = client.RemoveDirectory("/test/test1")
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize+appendDataSize, client)
 		if err != nil {
-			t.Errorf("remove dir error: %v", err)
+			t.Errorf("file download error: %v", err)
 		}
-		err = client.RemoveDirectory("/test")
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
 		if err != nil {
-			t.Errorf("remove dir error: %v", err)
+			t.Errorf("error computing file hash: %v", err)
 		}
-		_, err = client.Lstat("/test")
-		if err == nil {
-			t.Errorf("stat for deleted dir must not succeed")
+		donwloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil {
+			t.Errorf("error computing downloaded file hash: %v", err)
 		}
-		err = client.RemoveDirectory("/test")
-		if err == nil {
-			t.Errorf("remove missing path must fail")
+		if donwloadedFileHash != initialHash {
+			t.Errorf("file hash does not match")
 		}
-	}
-	httpd.RemoveUser(user, http.StatusOK)
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestRemove(t *testing.T) {
-	usePubKey := true
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		err = client.Mkdir("test")
+		files, err := client.ReadDir(".")
 		if err != nil {
-			t.Errorf("error mkdir: %v", err)
+			t.Errorf("unable to read dir: %v", err)
 		}
-		err = client.Mkdir("/test/test1")
-		if err != nil {
-			t.Errorf("error mkdir subdir: %v", err)
+		if len(files) != 1 {
+			t.Errorf("unexpected number of files, temporary files must be hidden: %v", len(files))
 		}
-		testFileName := "/test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		err = client.Mkdir("subdir")
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to create dir: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, path.Join("/test", testFileName), testFileSize, client)
+		err = client.Rename(testFileName, path.Join("subdir", testFileName))
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("unable to rename file: %v", err)
 		}
-		err = client.Remove("/test")
-		if err == nil {
-			t.Errorf("remove non empty dir must fail")
+		_, err = os.Stat(filepath.Join(remoteDir, "subdir", testFileName))
+		if err != nil {
+			t.Errorf("the renamed file must be stored on the remote server: %v", err)
 		}
-		err = client.RemoveDirectory(path.Join("/test", testFileName))
+		_, err = client.Stat(path.Join("..", "..", baseUser.Username))
 		if err == nil {
-			t.Errorf("remove a file with rmdir must fail")
+			t.Error("stat outside the remote prefix must fail")
 		}
-		err = client.Remove(path.Join("/test", testFileName))
+		err = client.Remove(path.Join("subdir", testFileName))
 		if err != nil {
-			t.Errorf("remove file error: %v", err)
-		}
-		err = client.Remove(path.Join("/test", testFileName))
-		if err == nil {
-			t.Errorf("remove missing file must fail")
+			t.Errorf("unable to remove file: %v", err)
 		}
-		err = client.Remove("/test/test1")
+		err = client.RemoveDirectory("subdir")
 		if err != nil {
-			t.Errorf("remove dir error: %v", err)
+			t.Errorf("unable to remove dir: %v", err)
 		}
-		err = client.Remove("/test")
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("remove dir error: %v", err)
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("unexpected quota, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
 		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
+	_, err = httpd.RemoveUser(baseUser, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
 	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(baseUser.GetHomeDir())
 }
 
-func TestLink(t *testing.T) {
+func TestMemFsBackend(t *testing.T) {
 	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.FsConfig.Provider = 5
+	u.FsConfig.MemConfig.MaxSize = 200000
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	os.RemoveAll(user.GetHomeDir())
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
@@ -516,6 +556,7 @@ func TestLink(t *testing.T) {
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
 		testFileSize := int64(65535)
+		appendDataSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
@@ -524,96 +565,155 @@ func TestLink(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = client.Symlink(testFileName, testFileName+".link")
+		_, err = os.Stat(user.GetHomeDir())
+		if !os.IsNotExist(err) {
+			t.Errorf("the memory filesystem must not write to the home dir: %v", err)
+		}
+		_, err = runSSHCommand("sftpgo-copy "+testFileName+" "+testFileName+".copy", user, usePubKey)
 		if err != nil {
-			t.Errorf("error creating symlink: %v", err)
+			t.Errorf("unexpected copy error: %v", err)
 		}
-		_, err = client.ReadLink(testFileName + ".link")
-		if err == nil {
-			t.Errorf("readlink is currently not implemented so must fail")
+		info, err := client.Stat(testFileName + ".copy")
+		if err != nil {
+			t.Errorf("copied file not found: %v", err)
+		} else if info.Size() != testFileSize {
+			t.Errorf("unexpected size for the copied file: %v", info.Size())
 		}
-		err = client.Symlink(testFileName, testFileName+".link")
-		if err == nil {
-			t.Errorf("creating a symlink to an existing one must fail")
+		err = client.Remove(testFileName + ".copy")
+		if err != nil {
+			t.Errorf("unable to remove the copied file: %v", err)
 		}
-		err = client.Link(testFileName, testFileName+".hlink")
-		if err == nil {
-			t.Errorf("hard link is not supported and must fail")
+		// overwrite the existing file
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
 		}
-		err = client.Remove(testFileName + ".link")
+		err = appendToTestFile(testFilePath, appendDataSize)
 		if err != nil {
-			t.Errorf("error removing symlink: %v", err)
+			t.Errorf("unable to append to test file: %v", err)
 		}
-		err = client.Remove(testFileName)
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+appendDataSize, false, client)
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("file upload resume error: %v", err)
 		}
-		os.Remove(testFilePath)
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
-	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestStat(t *testing.T) {
-	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		createTestFile(testFilePath, testFileSize)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize+appendDataSize, client)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("file download error: %v", err)
 		}
-		_, err := client.Lstat(testFileName)
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		donwloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil {
+			t.Errorf("error computing downloaded file hash: %v", err)
+		}
+		if donwloadedFileHash != initialHash {
+			t.Errorf("file hash does not match")
+		}
+		out, err := runSSHCommand("sha256sum "+testFileName, user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected hash command error: %v", err)
+		} else if !strings.Contains(string(out), initialHash) {
+			t.Errorf("invalid sha256sum: %v", string(out))
+		}
+		// the second client shares the same storage
+		client1, err := getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			fi, err := client1.Stat(testFileName)
+			if err != nil {
+				t.Errorf("stat error: %v", err)
+			} else if fi.Size() != testFileSize+appendDataSize {
+				t.Errorf("unexpected size: %v", fi.Size())
+			}
+			client1.Close()
+		}
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = client.Rename(testFileName, path.Join("subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to rename file: %v", err)
+		}
+		err = client.Symlink(path.Join("subdir", testFileName), testFileName+".link")
+		if err != nil {
+			t.Errorf("unable to create symlink: %v", err)
+		}
+		fi, err := client.Stat(testFileName + ".link")
 		if err != nil {
 			t.Errorf("stat error: %v", err)
+		} else if fi.Size() != testFileSize+appendDataSize {
+			t.Errorf("unexpected size for the symlink target: %v", fi.Size())
 		}
-		// mode 0666 and 0444 works on Windows too
-		newPerm := os.FileMode(0666)
-		err = client.Chmod(testFileName, newPerm)
+		err = client.Chmod(path.Join("subdir", testFileName), 0600)
 		if err != nil {
 			t.Errorf("chmod error: %v", err)
 		}
-		newFi, err := client.Lstat(testFileName)
+		fi, err = client.Stat(path.Join("subdir", testFileName))
 		if err != nil {
 			t.Errorf("stat error: %v", err)
+		} else if fi.Mode().Perm() != 0600 {
+			t.Errorf("unexpected mode: %v", fi.Mode())
 		}
-		if newPerm != newFi.Mode().Perm() {
-			t.Errorf("chmod failed expected: %v, actual: %v", newPerm, newFi.Mode().Perm())
+		files, err := client.ReadDir(".")
+		if err != nil {
+			t.Errorf("unable to read dir: %v", err)
 		}
-		newPerm = os.FileMode(0444)
-		err = client.Chmod(testFileName, newPerm)
+		if len(files) != 2 {
+			t.Errorf("unexpected number of files: %v", len(files))
+		}
+		err = client.RemoveDirectory("subdir")
+		if err == nil {
+			t.Error("removing a non empty dir must fail")
+		}
+		// this upload exceeds the size limit, the existing file must be preserved
+		bigFileSize := int64(250000)
+		err = createTestFile(testFilePath, bigFileSize)
 		if err != nil {
-			t.Errorf("chmod error: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
-		newFi, err = client.Lstat(testFileName)
+		err = sftpUploadFile(testFilePath, path.Join("subdir", testFileName), bigFileSize, client)
+		if err == nil {
+			t.Error("upload exceeding the memory filesystem size must fail")
+		}
+		fi, err = client.Stat(path.Join("subdir", testFileName))
 		if err != nil {
 			t.Errorf("stat error: %v", err)
+		} else if fi.Size() != testFileSize+appendDataSize {
+			t.Errorf("the existing file must be preserved, size: %v", fi.Size())
 		}
-		if newPerm != newFi.Mode().Perm() {
-			t.Errorf("chmod failed expected: %v, actual: %v", newPerm, newFi.Mode().Perm())
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
 		}
-		_, err = client.ReadLink(testFileName)
-		if err == nil {
-			t.Errorf("readlink is not supported and must fail")
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize+appendDataSize {
+			t.Errorf("unexpected quota, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-		err = client.Truncate(testFileName, 0)
+		err = client.Remove(testFileName + ".link")
 		if err != nil {
-			t.Errorf("truncate must be silently ignored: %v", err)
+			t.Errorf("unable to remove symlink: %v", err)
+		}
+		err = client.Remove(path.Join("subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		err = client.RemoveDirectory("subdir")
+		if err != nil {
+			t.Errorf("unable to remove dir: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("unexpected quota, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
 		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -622,206 +722,212 @@ func TestStat(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestStatChownChmod(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("chown is not supported on Windows, chmod is partially supported")
+func TestDedupFsBackend(t *testing.T) {
+	usePubKey := false
+	storePath := filepath.Join(homeBasePath, "dedup_store")
+	countBlobs := func() int {
+		numBlobs := 0
+		filepath.Walk(filepath.Join(storePath, "blobs"), func(walkedPath string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !strings.HasSuffix(info.Name(), ".refs") {
+				numBlobs++
+			}
+			return err
+		})
+		return numBlobs
 	}
-	usePubKey := true
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.FsConfig.Provider = 6
+	u.FsConfig.DedupConfig.StorePath = storePath
+	user1, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	u.Username = defaultUsername + "_dedup"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	user2, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		createTestFile(testFilePath, testFileSize)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	appendDataSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+	if err != nil {
+		t.Errorf("error computing file hash: %v", err)
+	}
+	for _, user := range []dataprovider.User{user1, user2} {
+		client, err := getSftpClient(user, usePubKey)
 		if err != nil {
-			t.Errorf("chown error: %v", err)
+			t.Errorf("unable to create sftp client: %v", err)
+			continue
 		}
-		newPerm := os.FileMode(0600)
-		err = client.Chmod(testFileName, newPerm)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("chmod error: %v", err)
+			t.Errorf("file upload error: %v", err)
 		}
-		newFi, err := client.Lstat(testFileName)
+		fi, err := client.Stat(testFileName)
 		if err != nil {
 			t.Errorf("stat error: %v", err)
+		} else if fi.Size() != testFileSize {
+			t.Errorf("unexpected size: %v", fi.Size())
 		}
-		if newPerm != newFi.Mode().Perm() {
-			t.Errorf("chown failed expected: %v, actual: %v", newPerm, newFi.Mode().Perm())
-		}
-		err = client.Remove(testFileName)
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
-		}
-		// l'errore viene riconvertito da sftp.ErrSSHFxNoSuchFile in os.ErrNotExist
-		err = client.Chmod(testFileName, newPerm)
-		if err != os.ErrNotExist {
-			t.Errorf("unexpected chmod error: %v expected: %v", err, os.ErrNotExist)
-		}
-		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
-		if err != os.ErrNotExist {
-			t.Errorf("unexpected chown error: %v expected: %v", err, os.ErrNotExist)
-		}
-		os.Remove(testFilePath)
+		client.Close()
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if numBlobs := countBlobs(); numBlobs != 1 {
+		t.Errorf("identical files must be stored once, blobs: %v", numBlobs)
+	}
+	refInfo, err := os.Stat(filepath.Join(user1.GetHomeDir(), testFileName))
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("the reference must be stored inside the home dir: %v", err)
+	} else if refInfo.Size() >= testFileSize {
+		t.Errorf("the file content must not be stored inside the home dir, size: %v", refInfo.Size())
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestChtimes(t *testing.T) {
-	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	user, _, err := httpd.GetUserByID(user2.ID, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("error getting user: %v", err)
+	} else if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+		t.Errorf("the quota must be charged by logical size, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	client, err := getSftpClient(user1, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		testDir := "test"
-		createTestFile(testFilePath, testFileSize)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = appendToTestFile(testFilePath, appendDataSize)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("unable to append to test file: %v", err)
 		}
-		acmodTime := time.Now()
-		err = client.Chtimes(testFileName, acmodTime, acmodTime)
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+appendDataSize, false, client)
 		if err != nil {
-			t.Errorf("error changing file times")
+			t.Errorf("file upload resume error: %v", err)
 		}
-		newFi, err := client.Lstat(testFileName)
+		if numBlobs := countBlobs(); numBlobs != 2 {
+			t.Errorf("unexpected number of blobs: %v", numBlobs)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize+appendDataSize, client)
 		if err != nil {
-			t.Errorf("file stat error: %v", err)
+			t.Errorf("file download error: %v", err)
 		}
-		diff := math.Abs(newFi.ModTime().Sub(acmodTime).Seconds())
-		if diff > 1 {
-			t.Errorf("diff between wanted and real modification time too big: %v", diff)
+		appendedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
 		}
-		err = client.Chtimes("invalidFile", acmodTime, acmodTime)
-		if !os.IsNotExist(err) {
-			t.Errorf("unexpected error: %v", err)
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil {
+			t.Errorf("error computing downloaded file hash: %v", err)
 		}
-		err = client.Mkdir(testDir)
+		if downloadedFileHash != appendedHash {
+			t.Errorf("file hash does not match")
+		}
+		err = client.Mkdir("subdir")
 		if err != nil {
 			t.Errorf("unable to create dir: %v", err)
 		}
-		err = client.Chtimes(testDir, acmodTime, acmodTime)
+		err = client.Rename(testFileName, path.Join("subdir", testFileName))
 		if err != nil {
-			t.Errorf("error changing dir times")
+			t.Errorf("unable to rename file: %v", err)
 		}
-		newFi, err = client.Lstat(testDir)
+		fi, err := client.Stat(path.Join("subdir", testFileName))
 		if err != nil {
-			t.Errorf("dir stat error: %v", err)
+			t.Errorf("stat error: %v", err)
+		} else if fi.Size() != testFileSize+appendDataSize {
+			t.Errorf("unexpected size: %v", fi.Size())
 		}
-		diff = math.Abs(newFi.ModTime().Sub(acmodTime).Seconds())
-		if diff > 1 {
-			t.Errorf("diff between wanted and real modification time too big: %v", diff)
+		err = client.Remove(path.Join("subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
 		}
-		os.Remove(testFilePath)
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
-	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-// basic tests to verify virtual chroot, should be improved to cover more cases ...
-func TestEscapeHomeDir(t *testing.T) {
-	usePubKey := true
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		// the blob referenced by the second user must be preserved
+		if numBlobs := countBlobs(); numBlobs != 1 {
+			t.Errorf("unexpected number of blobs: %v", numBlobs)
+		}
+		os.Remove(localDownloadPath)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	client2, err := getSftpClient(user2, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		defer client2.Close()
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client2)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("file download error: %v", err)
 		}
-		testDir := "testDir"
-		linkPath := filepath.Join(homeBasePath, defaultUsername, testDir)
-		err = os.Symlink(homeBasePath, linkPath)
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
 		if err != nil {
-			t.Errorf("error making local symlink: %v", err)
+			t.Errorf("error computing downloaded file hash: %v", err)
 		}
-		_, err = client.ReadDir(testDir)
-		if err == nil {
-			t.Errorf("reading a symbolic link outside home dir should not succeeded")
+		if downloadedFileHash != initialHash {
+			t.Errorf("file hash does not match")
 		}
-		os.Remove(linkPath)
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		os.Remove(localDownloadPath)
+		// add an orphan blob and a wrong reference counter
+		orphanHash := strings.Repeat("ab", sha256.Size)
+		orphanPath := filepath.Join(storePath, "blobs", orphanHash[:2], orphanHash)
+		os.MkdirAll(filepath.Dir(orphanPath), 0700)
+		err = ioutil.WriteFile(orphanPath, []byte("orphan"), 0600)
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to write orphan blob: %v", err)
 		}
-		remoteDestPath := path.Join("..", "..", testFileName)
-		err = sftpUploadFile(testFilePath, remoteDestPath, testFileSize, client)
+		err = ioutil.WriteFile(filepath.Join(storePath, "blobs", initialHash[:2], initialHash+".refs"), []byte("5"), 0600)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("unable to write reference counter: %v", err)
 		}
-		_, err = client.Lstat(testFileName)
+		namespaces := []string{user1.GetHomeDir(), user2.GetHomeDir()}
+		result, err := vfs.CollectDedupStoreGarbage(storePath, namespaces, true, true)
 		if err != nil {
-			t.Errorf("file stat error: %v the file was created outside the user dir!", err)
+			t.Errorf("unable to check store: %v", err)
 		}
-		err = client.Remove(testFileName)
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+		if result.Blobs != 2 || result.OrphanBlobs != 1 || result.FixedCounters != 1 || len(result.CorruptedBlobs) > 0 {
+			t.Errorf("unexpected dry run result: %+v", result)
 		}
-		linkPath = filepath.Join(homeBasePath, defaultUsername, testFileName)
-		err = os.Symlink(homeBasePath, linkPath)
+		if numBlobs := countBlobs(); numBlobs != 2 {
+			t.Errorf("a dry run must not remove blobs, blobs: %v", numBlobs)
+		}
+		result, err = vfs.CollectDedupStoreGarbage(storePath, namespaces, true, false)
 		if err != nil {
-			t.Errorf("error making local symlink: %v", err)
+			t.Errorf("unable to check store: %v", err)
 		}
-		err = sftpDownloadFile(testFileName, testFilePath, 0, client)
-		if err == nil {
-			t.Errorf("download file outside home dir must fail")
+		if result.OrphanBlobs != 1 || result.ReferencedBlobs != 1 || len(result.MissingBlobs) > 0 {
+			t.Errorf("unexpected result: %+v", result)
 		}
-		err = sftpUploadFile(testFilePath, remoteDestPath, testFileSize, client)
-		if err == nil {
-			t.Errorf("overwrite a file outside home dir must fail")
+		if numBlobs := countBlobs(); numBlobs != 1 {
+			t.Errorf("the orphan blob must be removed, blobs: %v", numBlobs)
 		}
-		err = client.Chmod(remoteDestPath, 0644)
-		if err == nil {
-			t.Errorf("setstat on a file outside home dir must fail")
+		err = client2.Remove(testFileName)
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		if numBlobs := countBlobs(); numBlobs != 0 {
+			t.Errorf("the blob must be removed with its last reference, blobs: %v", numBlobs)
 		}
-		os.Remove(linkPath)
-		os.Remove(testFilePath)
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	_, err = httpd.RemoveUser(user1, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
+	_, err = httpd.RemoveUser(user2, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user1.GetHomeDir())
+	os.RemoveAll(user2.GetHomeDir())
+	os.RemoveAll(storePath)
 }
 
-func TestHomeSpecialChars(t *testing.T) {
-	usePubKey := true
+func TestCryptFs(t *testing.T) {
+	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.HomeDir = filepath.Join(homeBasePath, "abc açà#&%lk")
+	u.QuotaFiles = 100
+	u.FsConfig.CryptConfig.Passphrase = "test passphrase"
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -831,13 +937,9 @@ func TestHomeSpecialChars(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
-		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
-		}
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
+		testFileSize := int64(131073)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
@@ -846,18 +948,112 @@ func TestHomeSpecialChars(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
+		plaintext, err := ioutil.ReadFile(testFilePath)
+		if err != nil {
+			t.Errorf("unable to read test file: %v", err)
+		}
+		encrypted, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName))
+		if err != nil {
+			t.Errorf("unable to read the stored file: %v", err)
+		}
+		if int64(len(encrypted)) <= testFileSize || bytes.Contains(encrypted, plaintext[:1024]) {
+			t.Error("the stored file must be encrypted")
+		}
 		files, err := client.ReadDir(".")
 		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+			t.Errorf("unable to read dir: %v", err)
 		}
-		if len(files) < 1 {
-			t.Errorf("expected at least 1 file in this dir")
+		if len(files) != 1 || files[0].Size() != testFileSize {
+			t.Errorf("unexpected dir listing, the plaintext size must be reported: %+v", files)
+		}
+		// overwrite the existing file
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("quota must be based on the plaintext size, files: %v size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize, false, client)
+		if err == nil {
+			t.Error("upload resume must fail for encrypted files")
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		donwloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil {
+			t.Errorf("error computing downloaded file hash: %v", err)
+		}
+		if donwloadedFileHash != initialHash {
+			t.Errorf("file hash does not match")
+		}
+		f, err := client.Open(testFileName)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+		} else {
+			buf := make([]byte, 1000)
+			off := int64(70000)
+			_, err = f.Seek(off, io.SeekStart)
+			if err != nil {
+				t.Errorf("unable to seek: %v", err)
+			}
+			n, err := io.ReadFull(f, buf)
+			if err != nil {
+				t.Errorf("unable to read at offset %v, n: %v, err: %v", off, n, err)
+			} else if !bytes.Equal(buf, plaintext[off:off+int64(n)]) {
+				t.Errorf("data read at offset %v does not match", off)
+			}
+			f.Close()
+		}
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("quota scan must report the plaintext size, files: %v size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		// tamper the stored file, the download must fail
+		encrypted, err = ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName))
+		if err != nil {
+			t.Errorf("unable to read the stored file: %v", err)
+		} else {
+			encrypted[len(encrypted)/2] ^= 0xff
+			err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), testFileName), encrypted, 0666)
+			if err != nil {
+				t.Errorf("unable to write the stored file: %v", err)
+			}
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Error("download of a tampered file must fail")
 		}
 		err = client.Remove(testFileName)
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("unable to remove file: %v", err)
 		}
 		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -866,326 +1062,384 @@ func TestHomeSpecialChars(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLogin(t *testing.T) {
-	u := getTestUser(false)
-	u.PublicKeys = []string{testPubKey}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestS3UploadResume(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaSize = 100 * 1024 * 1024
+	u.FsConfig.Provider = 1
+	u.FsConfig.S3Config = vfs.S3FsConfig{
+		Bucket:         s3TestBucket,
+		Region:         "us-east-1",
+		AccessKey:      s3TestAccessKey,
+		AccessSecret:   s3TestSecret,
+		Endpoint:       s3TestEndpoint,
+		KeyPrefix:      "resume/",
+		UploadPartSize: 5,
+	}
+	s3Fs, err := vfs.NewS3Fs("", homeBasePath, u.FsConfig.S3Config)
+	if err != nil {
+		t.Fatalf("unable to create S3 fs: %v", err)
+	}
+	if _, err = s3Fs.Stat("/"); err != nil {
+		t.Skipf("this test requires a MinIO server listening on %v with the bucket %#v", s3TestEndpoint, s3TestBucket)
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, false)
+	partSize := int64(5 * 1024 * 1024)
+	testFileName := "test_s3_resume.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := 2*partSize + 65535
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	err = interruptS3Upload(user, usePubKey, testFilePath, testFileName, 2*partSize)
+	if err != nil {
+		t.Errorf("unable to interrupt the upload: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		fi, err := client.Stat(testFileName)
 		if err != nil {
-			t.Errorf("sftp client with valid password must work")
+			t.Errorf("stat for an interrupted upload must succeed: %v", err)
+		} else if fi.Size() != 2*partSize {
+			t.Errorf("unexpected size for the interrupted upload: %v", fi.Size())
+		}
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize, false, client)
+		if err != nil {
+			t.Errorf("file upload resume error: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		donwloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil {
+			t.Errorf("error computing downloaded file hash: %v", err)
+		}
+		if donwloadedFileHash != initialHash {
+			t.Errorf("resume failed: file hash does not match")
 		}
 		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("error getting user: %v", err)
+			t.Errorf("unable to get user: %v", err)
 		}
-		if user.LastLogin <= 0 {
-			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-	}
-	client, err = getSftpClient(user, true)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		// the upload is completed, there is nothing to resume
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize, false, client)
+		if err == nil {
+			t.Errorf("resuming a completed upload must fail")
+		}
+		err = client.Remove(testFileName)
 		if err != nil {
-			t.Errorf("sftp client with valid public key must work")
+			t.Errorf("unable to remove file: %v", err)
 		}
+		os.Remove(localDownloadPath)
 	}
-	user.Password = "invalid password"
-	client, err = getSftpClient(user, false)
-	if err == nil {
-		t.Errorf("login with invalid password must fail")
-		defer client.Close()
-	}
-	// testPubKey1 is not authorized
-	user.PublicKeys = []string{testPubKey1}
-	user.Password = ""
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to update user: %v", err)
-	}
-	client, err = getSftpClient(user, true)
-	if err == nil {
-		t.Errorf("login with invalid public key must fail")
-		defer client.Close()
-	}
-	// login a user with multiple public keys, only the second one is valid
-	user.PublicKeys = []string{testPubKey1, testPubKey}
-	user.Password = ""
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	// opening the file without truncating it and writing at the uploaded size resumes the upload too
+	err = interruptS3Upload(user, usePubKey, testFilePath, testFileName, partSize)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to interrupt the upload: %v", err)
 	}
-	client, err = getSftpClient(user, true)
+	client, err = getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		data, err := ioutil.ReadFile(testFilePath)
 		if err != nil {
-			t.Errorf("sftp client with multiple public key must work if at least one public key is valid")
+			t.Errorf("unable to read test file: %v", err)
 		}
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
-	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestLoginUserStatus(t *testing.T) {
-	usePubKey := true
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		f, err := client.OpenFile(testFileName, os.O_WRONLY)
 		if err != nil {
-			t.Errorf("sftp client with valid credentials must work")
+			t.Errorf("unable to open file for writing: %v", err)
+		} else {
+			_, err = f.Seek(partSize, io.SeekStart)
+			if err != nil {
+				t.Errorf("unable to seek: %v", err)
+			}
+			_, err = f.Write(data[partSize:])
+			if err != nil {
+				t.Errorf("unable to write at offset %v: %v", partSize, err)
+			}
+			f.Close()
 		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		fi, err := client.Stat(testFileName)
 		if err != nil {
-			t.Errorf("error getting user: %v", err)
+			t.Errorf("stat error: %v", err)
+		} else if fi.Size() != testFileSize {
+			t.Errorf("unexpected size after resume: %v", fi.Size())
 		}
-		if user.LastLogin <= 0 {
-			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
 		}
 	}
-	user.Status = 0
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	// stale uploads must be aborted
+	err = interruptS3Upload(user, usePubKey, testFilePath, testFileName, partSize)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to interrupt the upload: %v", err)
 	}
-	client, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login for a disabled user must fail")
-		defer client.Close()
+	sftpd.CleanupStaleS3Uploads(0)
+	if _, err = s3Fs.Stat(s3Fs.Join("/", u.FsConfig.S3Config.KeyPrefix, testFileName)); err == nil {
+		t.Errorf("the stale upload was not aborted")
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
+	os.Remove(testFilePath)
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLoginUserExpiration(t *testing.T) {
+func TestS3MetadataCache(t *testing.T) {
 	usePubKey := true
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	u := getTestUser(usePubKey)
+	u.FsConfig.Provider = 1
+	u.FsConfig.S3Config = vfs.S3FsConfig{
+		Bucket:       s3TestBucket,
+		Region:       "us-east-1",
+		AccessKey:    s3TestAccessKey,
+		AccessSecret: s3TestSecret,
+		Endpoint:     s3TestEndpoint,
+		KeyPrefix:    "metadatacache/",
+	}
+	s3Fs, err := vfs.NewS3Fs("", homeBasePath, u.FsConfig.S3Config)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Fatalf("unable to create S3 fs: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	if _, err = s3Fs.Stat("/"); err != nil {
+		t.Skipf("this test requires a MinIO server listening on %v with the bucket %#v", s3TestEndpoint, s3TestBucket)
+	}
+	vfs.SetMetadataCacheTTL(1 * time.Minute)
+	defer vfs.SetMetadataCacheTTL(0)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
-		if err != nil {
-			t.Errorf("sftp client with valid credentials must work")
-		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
-		if err != nil {
-			t.Errorf("error getting user: %v", err)
-		}
-		if user.LastLogin <= 0 {
-			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
-		}
+		t.Errorf("unable to add user: %v", err)
 	}
-	user.ExpirationDate = utils.GetTimeAsMsSinceEpoch(time.Now()) - 120000
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to create test file: %v", err)
 	}
-	client, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login for an expired user must fail")
-		defer client.Close()
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Fatalf("unable to create sftp client: %v", err)
 	}
-	user.ExpirationDate = utils.GetTimeAsMsSinceEpoch(time.Now()) + 120000
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	defer client.Close()
+	otherClient, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Fatalf("unable to create sftp client: %v", err)
 	}
-	client, err = getSftpClient(user, usePubKey)
+	defer otherClient.Close()
+	files, err := client.ReadDir(".")
 	if err != nil {
-		t.Errorf("login for a non expired user must succeed: %v", err)
-	} else {
-		defer client.Close()
+		t.Errorf("unable to read dir: %v", err)
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if len(files) != 0 {
+		t.Errorf("unexpected directory contents: %v", len(files))
+	}
+	// the connection's own writes invalidate the cache
+	err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("file upload error: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestLoginInvalidFs(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
+	files, err = client.ReadDir(".")
+	if err != nil {
+		t.Errorf("unable to read dir: %v", err)
 	}
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	if providerConf.Driver != dataprovider.SQLiteDataProviderName {
-		t.Skip("this test require sqlite provider")
+	if len(files) != 1 || files[0].Size() != testFileSize {
+		t.Errorf("the uploaded file must be listed: %+v", files)
 	}
-	dbPath := providerConf.Name
-	if !filepath.IsAbs(dbPath) {
-		dbPath = filepath.Join(configDir, dbPath)
+	// the changes made by other connections are visible after the TTL
+	err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, otherClient)
+	if err != nil {
+		t.Errorf("file upload error: %v", err)
 	}
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	files, err = client.ReadDir(".")
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("unable to read dir: %v", err)
 	}
-	// we update the database using sqlite3 CLI since we cannot add an user with an invalid config
-	time.Sleep(200 * time.Millisecond)
-	updateUserQuery := fmt.Sprintf("UPDATE users SET filesystem='{\"provider\":1}' WHERE id=%v", user.ID)
-	cmd := exec.Command("sqlite3", dbPath, updateUserQuery)
-	out, err := cmd.CombinedOutput()
+	if len(files) != 1 {
+		t.Errorf("the directory listing must be cached: %+v", files)
+	}
+	err = client.Rename(testFileName, testFileName+"2")
 	if err != nil {
-		t.Errorf("unexpected error: %v, cmd out: %v", err, string(out))
+		t.Errorf("unable to rename file: %v", err)
 	}
-	time.Sleep(200 * time.Millisecond)
-	_, err = getSftpClient(user, usePubKey)
+	_, err = client.Stat(testFileName)
 	if err == nil {
-		t.Error("login must fail, the user has an invalid filesystem config")
+		t.Error("stat for a renamed file must fail")
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	fi, err := client.Stat(testFileName + "2")
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("stat for the renamed file must succeed: %v", err)
+	} else if fi.Size() != testFileSize {
+		t.Errorf("unexpected size for the renamed file: %v", fi.Size())
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestLoginWithIPFilters(t *testing.T) {
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Filters.DeniedIP = []string{"192.167.0.0/24", "172.18.0.0/16"}
-	u.Filters.AllowedIP = []string{}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	files, err = client.ReadDir(".")
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("unable to read dir: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
-		if err != nil {
-			t.Errorf("sftp client with valid credentials must work")
-		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if len(files) != 2 {
+		t.Errorf("the directory listing must be invalidated after a rename: %+v", files)
+	}
+	for _, name := range []string{testFileName + "1", testFileName + "2"} {
+		err = client.Remove(name)
 		if err != nil {
-			t.Errorf("error getting user: %v", err)
-		}
-		if user.LastLogin <= 0 {
-			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
+			t.Errorf("unable to remove file: %v", err)
 		}
 	}
-	user.Filters.AllowedIP = []string{"127.0.0.0/8"}
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to update user: %v", err)
-	}
-	client, err = getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("login from an allowed IP must succeed: %v", err)
-	} else {
-		defer client.Close()
-	}
-	user.Filters.AllowedIP = []string{"172.19.0.0/16"}
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	files, err = client.ReadDir(".")
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to read dir: %v", err)
 	}
-	client, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login from an not allowed IP must fail")
-		client.Close()
+	if len(files) != 0 {
+		t.Errorf("the directory listing must be invalidated after a remove: %+v", files)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
+	os.Remove(testFilePath)
 }
 
-func TestLoginAfterUserUpdateEmptyPwd(t *testing.T) {
+func TestDirCommands(t *testing.T) {
 	usePubKey := false
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = ""
-	user.PublicKeys = []string{}
-	// password and public key should remain unchanged
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to update user: %v", err)
-	}
+	// remove the home dir to test auto creation
+	os.RemoveAll(user.HomeDir)
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		err = client.Mkdir("test1")
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("error mkdir: %v", err)
 		}
-		_, err = client.ReadDir(".")
+		err = client.Rename("test1", "test")
 		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+			t.Errorf("error rename: %v", err)
+		}
+		_, err = client.Lstat("/test1")
+		if err == nil {
+			t.Errorf("stat for renamed dir must not succeed")
+		}
+		err = client.PosixRename("test", "test1")
+		if err != nil {
+			t.Errorf("error posix rename: %v", err)
+		}
+		err = client.Remove("test1")
+		if err != nil {
+			t.Errorf("error rmdir: %v", err)
+		}
+		err = client.Mkdir("/test/test1")
+		if err == nil {
+			t.Errorf("recursive mkdir must fail")
+		}
+		client.Mkdir("/test")
+		err = client.Mkdir("/test/test1")
+		if err != nil {
+			t.Errorf("mkdir dir error: %v", err)
+		}
+		_, err = client.ReadDir("/this/dir/does/not/exist")
+		if err == nil {
+			t.Errorf("reading a missing dir must fail")
+		}
+		err = client.RemoveDirectory("/test/test1")
+		if err != nil {
+			t.Errorf("remove dir error: %v", err)
+		}
+		err = client.RemoveDirectory("/test")
+		if err != nil {
+			t.Errorf("remove dir error: %v", err)
+		}
+		_, err = client.Lstat("/test")
+		if err == nil {
+			t.Errorf("stat for deleted dir must not succeed")
+		}
+		err = client.RemoveDirectory("/test")
+		if err == nil {
+			t.Errorf("remove missing path must fail")
 		}
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
-	}
+	httpd.RemoveUser(user, http.StatusOK)
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLoginAfterUserUpdateEmptyPubKey(t *testing.T) {
+func TestRemove(t *testing.T) {
 	usePubKey := true
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = ""
-	user.PublicKeys = []string{}
-	// password and public key should remain unchanged
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to update user: %v", err)
-	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		err = client.Mkdir("test")
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("error mkdir: %v", err)
 		}
-		_, err = client.ReadDir(".")
+		err = client.Mkdir("/test/test1")
 		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+			t.Errorf("error mkdir subdir: %v", err)
 		}
+		testFileName := "/test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/test", testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Remove("/test")
+		if err == nil {
+			t.Errorf("remove non empty dir must fail")
+		}
+		err = client.RemoveDirectory(path.Join("/test", testFileName))
+		if err == nil {
+			t.Errorf("remove a file with rmdir must fail")
+		}
+		err = client.Remove(path.Join("/test", testFileName))
+		if err != nil {
+			t.Errorf("remove file error: %v", err)
+		}
+		err = client.Remove(path.Join("/test", testFileName))
+		if err == nil {
+			t.Errorf("remove missing file must fail")
+		}
+		err = client.Remove("/test/test1")
+		if err != nil {
+			t.Errorf("remove dir error: %v", err)
+		}
+		err = client.Remove("/test")
+		if err != nil {
+			t.Errorf("remove dir error: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -1194,43 +1448,171 @@ func TestLoginAfterUserUpdateEmptyPubKey(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLoginKeyboardInteractiveAuth(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+func TestTrash(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.Filters.Trash.Enabled = true
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
-	client, err := getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		err = client.Mkdir("test")
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("error mkdir: %v", err)
 		}
-		_, err = client.ReadDir(".")
+		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
-	}
-	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, -1), 0755)
-	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
-	if err == nil {
-		t.Error("keyboard interactive auth must fail the script returned -1")
-	}
-	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, true, 1), 0755)
-	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
-	if err == nil {
-		t.Error("keyboard interactive auth must fail the script returned bad json")
-	}
-	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 5, true, 1), 0755)
-	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
-	if err == nil {
-		t.Error("keyboard interactive auth must fail the script returned bad json")
+		err = sftpUploadFile(testFilePath, path.Join("/test", testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Remove("/test")
+		if err == nil {
+			t.Errorf("remove non empty dir must fail")
+		}
+		err = client.Remove(path.Join("/test", testFileName))
+		if err != nil {
+			t.Errorf("remove file error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("trashed files must not be included in quota, files: %v, size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		err = client.RemoveDirectory("/test")
+		if err != nil {
+			t.Errorf("remove dir error: %v", err)
+		}
+		files, err := client.ReadDir("/")
+		if err != nil {
+			t.Errorf("unable to read dir: %v", err)
+		}
+		if len(files) != 0 {
+			t.Errorf("the trash dir must be hidden, files: %+v", files)
+		}
+		_, err = client.Stat("/.sftpgo-trash")
+		if err == nil {
+			t.Errorf("stat inside the trash must fail")
+		}
+		err = client.Mkdir("/.sftpgo-trash/dir")
+		if err == nil {
+			t.Errorf("mkdir inside the trash must fail")
+		}
+		err = sftpUploadFile(testFilePath, "/.sftpgo-trash/file", testFileSize, client)
+		if err == nil {
+			t.Errorf("upload inside the trash must fail")
+		}
+		entries, _, err := httpd.GetTrashEntries(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get trash entries: %v", err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("unexpected trash entries: %+v", entries)
+		}
+		var fileEntry, dirEntry sftpd.TrashEntry
+		for _, entry := range entries {
+			if entry.IsDir {
+				dirEntry = entry
+			} else {
+				fileEntry = entry
+			}
+		}
+		if fileEntry.Path != path.Join("/test", testFileName) || fileEntry.Size != testFileSize {
+			t.Errorf("unexpected file trash entry: %+v", fileEntry)
+		}
+		if dirEntry.Path != "/test" || dirEntry.DeletionTime < fileEntry.DeletionTime {
+			t.Errorf("unexpected dir trash entry: %+v", dirEntry)
+		}
+		_, err = httpd.RestoreTrashEntry(user, fileEntry.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to restore trash entry: %v", err)
+		}
+		info, err := client.Stat(path.Join("/test", testFileName))
+		if err != nil {
+			t.Errorf("restored file not found: %v", err)
+		} else if info.Size() != testFileSize {
+			t.Errorf("unexpected restored file size: %v", info.Size())
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("restored files must be included in quota, files: %v, size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		_, err = httpd.RestoreTrashEntry(user, dirEntry.ID, http.StatusConflict)
+		if err != nil {
+			t.Errorf("restore over an existing path must fail: %v", err)
+		}
+		_, err = httpd.RestoreTrashEntry(user, fileEntry.ID, http.StatusNotFound)
+		if err != nil {
+			t.Errorf("restore a missing trash entry must fail: %v", err)
+		}
+		_, err = httpd.RestoreTrashEntry(user, "..", http.StatusNotFound)
+		if err != nil {
+			t.Errorf("restore an invalid trash entry must fail: %v", err)
+		}
+		err = client.Remove(path.Join("/test", testFileName))
+		if err != nil {
+			t.Errorf("remove file error: %v", err)
+		}
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("quota scan must exclude the trash, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		_, err = httpd.PurgeTrashEntry(user, dirEntry.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to purge trash entry: %v", err)
+		}
+		entries, _, err = httpd.GetTrashEntries(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get trash entries: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("unexpected trash entries: %+v", entries)
+		}
+		_, err = httpd.PurgeTrashEntry(user, "", http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to purge trash: %v", err)
+		}
+		entries, _, err = httpd.GetTrashEntries(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get trash entries: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("the trash must be empty, entries: %+v", entries)
+		}
+		_, err = client.Stat("/test")
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -1239,35 +1621,25 @@ func TestLoginKeyboardInteractiveAuth(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	usePubKey := true
+func TestTrashCountInQuota(t *testing.T) {
+	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 0
-	err := dataprovider.Initialize(providerConf, configDir)
+	u.QuotaFiles = 100
+	u.Filters.Trash.Enabled = true
+	u.Filters.Trash.CountInQuota = true
+	u.Filters.Trash.RetentionDays = 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to add user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	client, err := getSftpClient(u, usePubKey)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
@@ -1276,397 +1648,431 @@ func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		os.Remove(testFilePath)
-	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
-	}
-	usePubKey = false
-	u = getTestUser(usePubKey)
-	u.PublicKeys = []string{}
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	client, err = getSftpClient(u, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		err = client.Remove(testFileName)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("remove file error: %v", err)
 		}
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
-	}
-	user := users[0]
-	if len(user.PublicKeys) != 0 {
-		t.Errorf("number of public keys mismatch, expected: 0, actual: %v", len(user.PublicKeys))
-	}
-	if user.UsedQuotaSize == 0 {
-		t.Error("quota size must be > 0")
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove: %v", err)
-	}
-	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
-}
-
-func TestLoginExternalAuthPwd(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 1
-	err := dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	client, err := getSftpClient(u, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("error getting user: %v", err)
 		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("trashed files must be included in quota, files: %v, size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		// the entry is not expired
+		sftpd.CleanupTrash()
+		entries, _, err := httpd.GetTrashEntries(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get trash entries: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("unexpected trash entries: %+v", entries)
+		} else {
+			// simulate an entry deleted two days ago
+			trashDir := filepath.Join(user.GetHomeDir(), ".sftpgo-trash")
+			deletionTime := time.Now().Add(-48 * time.Hour).UnixNano()
+			err = os.Rename(filepath.Join(trashDir, entries[0].ID), filepath.Join(trashDir, strconv.FormatInt(deletionTime, 10)))
+			if err != nil {
+				t.Errorf("unable to rename trash entry: %v", err)
+			}
+		}
+		sftpd.CleanupTrash()
+		entries, _, err = httpd.GetTrashEntries(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get trash entries: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("expired trash entries must be purged: %+v", entries)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("purged files must be removed from quota, files: %v, size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		os.Remove(testFilePath)
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
-	}
-	usePubKey = true
-	u = getTestUser(usePubKey)
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with valid user but invalid auth scope must fail")
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
-	}
-	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
 }
 
-func TestLoginExternalAuthPubKey(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
+func TestReplication(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 2
-	err := dataprovider.Initialize(providerConf, configDir)
+	u.Filters.Replication.Enabled = true
+	u.Filters.Replication.LocalPath = filepath.Join(homeBasePath, "replica_"+u.Username)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to add user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	client, err := getSftpClient(u, usePubKey)
+	replicaPath := user.Filters.Replication.LocalPath
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
+		err = client.Mkdir("/dir")
+		if err != nil {
+			t.Errorf("error mkdir: %v", err)
+		}
+		err = client.Mkdir("/empty")
+		if err != nil {
+			t.Errorf("error mkdir: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Rename(testFileName, path.Join("/dir", testFileName+"1"))
+		if err != nil {
+			t.Errorf("rename error: %v", err)
+		}
+		err = client.Remove(path.Join("/dir", testFileName))
+		if err != nil {
+			t.Errorf("remove error: %v", err)
+		}
+		err = client.Rename("/dir", "/dir1")
+		if err != nil {
+			t.Errorf("rename error: %v", err)
+		}
+		waitForReplication(t, user.Username)
+		fi, err := os.Stat(filepath.Join(replicaPath, "dir1", testFileName+"1"))
+		if err != nil {
+			t.Errorf("the renamed file must be replicated: %v", err)
+		} else if fi.Size() != testFileSize {
+			t.Errorf("unexpected replicated file size: %v", fi.Size())
+		}
+		for _, p := range []string{"dir", testFileName, filepath.Join("dir1", testFileName)} {
+			if _, err = os.Stat(filepath.Join(replicaPath, p)); !os.IsNotExist(err) {
+				t.Errorf("%#v must not exist on the replica, stat error: %v", p, err)
+			}
+		}
+		if fi, err = os.Stat(filepath.Join(replicaPath, "empty")); err != nil || !fi.IsDir() {
+			t.Errorf("the empty dir must be replicated: %v", err)
+		}
+		err = client.RemoveDirectory("/empty")
+		if err != nil {
+			t.Errorf("remove dir error: %v", err)
+		}
+		// the replica is updated if a file is overwritten
+		err = createTestFile(testFilePath, testFileSize/2)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/dir1", testFileName+"1"), testFileSize/2, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		waitForReplication(t, user.Username)
+		if _, err = os.Stat(filepath.Join(replicaPath, "empty")); !os.IsNotExist(err) {
+			t.Errorf("the removed dir must not exist on the replica, stat error: %v", err)
+		}
+		fi, err = os.Stat(filepath.Join(replicaPath, "dir1", testFileName+"1"))
+		if err != nil || fi.Size() != testFileSize/2 {
+			t.Errorf("the overwritten file must be replicated, err: %v", err)
+		}
+		user.Filters.Replication.Enabled = false
+		_, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize/2, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		waitForReplication(t, user.Username)
+		if _, err = os.Stat(filepath.Join(replicaPath, testFileName)); !os.IsNotExist(err) {
+			t.Errorf("files must not be replicated with the replication disabled, stat error: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
-	}
-	usePubKey = false
-	u = getTestUser(usePubKey)
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with valid user but invalid auth scope must fail")
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
-	}
-	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
+	os.RemoveAll(replicaPath)
 }
 
-func TestLoginExternalAuthInteractive(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	usePubKey := false
+func TestTiering(t *testing.T) {
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 4
-	err := dataprovider.Initialize(providerConf, configDir)
+	u.Filters.Tiering.Enabled = true
+	u.Filters.Tiering.Days = 1
+	u.Filters.Tiering.LocalPath = filepath.Join(homeBasePath, "cold_"+u.Username)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to add user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
-	client, err := getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
+	coldPath := user.Filters.Tiering.LocalPath
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+	coldTime := time.Now().Add(-48 * time.Hour)
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		err = client.Mkdir("/dir")
+		if err != nil {
+			t.Errorf("error mkdir: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/dir", testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+"_hot", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Chtimes(path.Join("/dir", testFileName), coldTime, coldTime)
+		if err != nil {
+			t.Errorf("chtimes error: %v", err)
+		}
+		sftpd.RunTiering()
+		checkTieringStatus(t, user.Username, 1, testFileSize)
+		checkColdTierFiles(t, coldPath, 1)
+		fi, err := client.Stat(path.Join("/dir", testFileName))
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		} else if fi.Size() != testFileSize || fi.ModTime().Unix() != coldTime.Unix() {
+			t.Errorf("the stub must keep size and modification time, size: %v mtime: %v", fi.Size(), fi.ModTime())
+		}
+		// stubs are read from the cold tier, renames keep them tiered
+		err = client.Rename("/dir", "/dir1")
+		if err != nil {
+			t.Errorf("rename error: %v", err)
+		}
+		err = sftpDownloadFile(path.Join("/dir1", testFileName), localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		downloadedHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil || downloadedHash != initialHash {
+			t.Errorf("the downloaded file does not match the tiered one, err: %v", err)
+		}
+		checkTieringStatus(t, user.Username, 1, testFileSize)
+		// a resumed upload recalls the file
+		extraData := []byte("appended data")
+		f, err := os.OpenFile(testFilePath, os.O_WRONLY|os.O_APPEND, 0666)
+		if err == nil {
+			_, err = f.Write(extraData)
+			f.Close()
+		}
+		if err != nil {
+			t.Errorf("unable to append to the test file: %v", err)
+		}
+		err = sftpUploadResumeFile(testFilePath, path.Join("/dir1", testFileName), testFileSize+int64(len(extraData)),
+			false, client)
+		if err != nil {
+			t.Errorf("resume upload error: %v", err)
+		}
+		checkTieringStatus(t, user.Username, 0, 0)
+		checkColdTierFiles(t, coldPath, 0)
+		err = sftpDownloadFile(path.Join("/dir1", testFileName), localDownloadPath, testFileSize+int64(len(extraData)), client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		resumedHash, _ := computeHashForFile(sha256.New(), testFilePath)
+		downloadedHash, err = computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil || downloadedHash != resumedHash {
+			t.Errorf("the downloaded file does not match the resumed one, err: %v", err)
+		}
+		// recall on access, the new settings apply to the new connections
+		user.Filters.Tiering.RecallOnAccess = true
+		_, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		client.Close()
+		client, err = getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Fatalf("unable to create sftp client: %v", err)
+		}
+		defer client.Close()
+		err = client.Chtimes(path.Join("/dir1", testFileName), coldTime, coldTime)
+		if err != nil {
+			t.Errorf("chtimes error: %v", err)
+		}
+		sftpd.RunTiering()
+		checkTieringStatus(t, user.Username, 1, testFileSize+int64(len(extraData)))
+		err = sftpDownloadFile(path.Join("/dir1", testFileName), localDownloadPath, testFileSize+int64(len(extraData)), client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		downloadedHash, err = computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil || downloadedHash != resumedHash {
+			t.Errorf("the downloaded file does not match the recalled one, err: %v", err)
+		}
+		checkTieringStatus(t, user.Username, 0, 0)
+		checkColdTierFiles(t, coldPath, 0)
+		// overwrites and removes delete the tiered contents
+		for _, p := range []string{testFileName + "_hot", path.Join("/dir1", testFileName)} {
+			err = client.Chtimes(p, coldTime, coldTime)
+			if err != nil {
+				t.Errorf("chtimes error: %v", err)
+			}
+		}
+		sftpd.RunTiering()
+		checkTieringStatus(t, user.Username, 2, 2*testFileSize+int64(len(extraData)))
+		checkColdTierFiles(t, coldPath, 2)
+		err = sftpUploadFile(testFilePath, testFileName+"_hot", testFileSize+int64(len(extraData)), client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Remove(path.Join("/dir1", testFileName))
+		if err != nil {
+			t.Errorf("remove error: %v", err)
+		}
+		checkTieringStatus(t, user.Username, 0, 0)
+		checkColdTierFiles(t, coldPath, 0)
+		// the hash commands read the files using the tiered filesystem
+		expectedHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		out, err := runSSHCommand("sha256sum "+testFileName+"_hot", user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected hash command error: %v", err)
+		} else if !strings.Contains(string(out), expectedHash) {
+			t.Errorf("invalid sha256sum: %v", string(out))
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
-	}
-	usePubKey = true
-	u = getTestUser(usePubKey)
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with valid user but invalid auth scope must fail")
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
-	}
-	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
+	os.RemoveAll(coldPath)
 }
 
-func TestLoginExternalAuthErrors(t *testing.T) {
+func TestRetentionSymlinks(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("this test is not available on Windows")
 	}
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, true), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 0
-	err := dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	_, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("login must fail, external auth returns a non json response")
-	}
-	usePubKey = false
-	u = getTestUser(usePubKey)
-	_, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("login must fail, external auth returns a non json response")
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 0 {
-		t.Errorf("number of users mismatch, expected: 0, actual: %v", len(users))
-	}
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
-}
-
-func TestQuotaDisabledError(t *testing.T) {
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	providerConf.TrackQuota = 0
-	err := dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
+	u.Filters.RetentionPolicies = []vfs.RetentionPolicy{
+		{
+			Path: "/worm",
+			Days: 1,
+		},
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.QuotaFiles = 10
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	lockedFile := path.Join("/worm", testFileName)
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
+		err = client.Mkdir("/worm")
+		if err != nil {
+			t.Errorf("error mkdir: %v", err)
+		}
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = sftpUploadFile(testFilePath, lockedFile, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		os.Remove(testFilePath)
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove: %v", err)
-	}
-	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-}
-
-func TestMaxSessions(t *testing.T) {
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Username += "1"
-	u.MaxSessions = 1
-	user, _, err := httpd.AddUser(u, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		err = client.Symlink(lockedFile, "/link")
+		if !os.IsPermission(err) {
+			t.Errorf("symlinks to a locked file must fail: %v", err)
+		}
+		err = client.Symlink("/worm", "/linkdir")
+		if !os.IsPermission(err) {
+			t.Errorf("symlinks to a retention directory must fail: %v", err)
+		}
+		// symlinks created before the retention policy or outside SFTPGo cannot be used to bypass it
+		err = os.Symlink(filepath.Join(user.GetHomeDir(), "worm", testFileName), filepath.Join(user.GetHomeDir(), "link"))
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to create symlink: %v", err)
 		}
-		_, err = client.ReadDir(".")
+		err = os.Symlink(filepath.Join(user.GetHomeDir(), "worm"), filepath.Join(user.GetHomeDir(), "linkdir"))
 		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+			t.Errorf("unable to create symlink: %v", err)
 		}
-		_, err = getSftpClient(user, usePubKey)
+		for _, p := range []string{"/link", path.Join("/linkdir", testFileName)} {
+			f, err := client.OpenFile(p, os.O_WRONLY|os.O_TRUNC)
+			if err == nil {
+				f.Write([]byte("data"))
+				f.Close()
+				t.Errorf("writing to a locked file using the symlink %#v must fail", p)
+			}
+			err = client.Chmod(p, 0600)
+			if err == nil {
+				t.Errorf("chmod on a locked file using the symlink %#v must fail", p)
+			}
+			err = client.Chtimes(p, time.Now(), time.Now().Add(-48*time.Hour))
+			if err == nil {
+				t.Errorf("chtimes on a locked file using the symlink %#v must fail", p)
+			}
+		}
+		err = client.Remove(path.Join("/linkdir", testFileName))
 		if err == nil {
-			t.Errorf("max sessions exceeded, new login should not succeed")
+			t.Errorf("removing a locked file using a symlink must fail")
+		}
+		info, err := os.Stat(filepath.Join(user.GetHomeDir(), "worm", testFileName))
+		if err != nil {
+			t.Errorf("the locked file must exist: %v", err)
+		} else if info.Size() != testFileSize {
+			t.Errorf("the locked file was modified, size: %v", info.Size())
+		}
+		err = client.Link(lockedFile, "/hlink")
+		if !os.IsPermission(err) {
+			t.Errorf("hard links to a locked file must fail: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
 		}
+		err = client.Link(testFileName, path.Join("/worm", "hlink"))
+		if !os.IsPermission(err) {
+			t.Errorf("hard links inside a retention directory must fail: %v", err)
+		}
+		// the symlinks are not locked
+		err = client.Remove("/link")
+		if err != nil {
+			t.Errorf("unable to remove symlink: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -1675,89 +2081,176 @@ func TestMaxSessions(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestQuotaFileReplace(t *testing.T) {
-	usePubKey := false
+func TestRetentionPolicies(t *testing.T) {
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
+	u.Filters.RetentionPolicies = []vfs.RetentionPolicy{
+		{
+			Path: "/worm",
+			Days: 1,
+		},
+	}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-	testFileSize := int64(65535)
 	testFileName := "test_file.dat"
 	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	lockedFile := path.Join("/worm", testFileName)
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		expectedQuotaSize := user.UsedQuotaSize + testFileSize
-		expectedQuotaFiles := user.UsedQuotaFiles + 1
-		err = createTestFile(testFilePath, testFileSize)
+		err = client.Mkdir("/worm")
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("error mkdir: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = client.Mkdir("/other")
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("error mkdir: %v", err)
 		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("error getting user: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
-		// now replace the same file, the quota must not change
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = sftpUploadFile(testFilePath, lockedFile, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
-		if err != nil {
-			t.Errorf("error getting user: %v", err)
+		err = sftpUploadFile(testFilePath, lockedFile, testFileSize, client)
+		if err == nil {
+			t.Errorf("overwriting a locked file must fail")
 		}
-		if expectedQuotaFiles != user.UsedQuotaFiles {
-			t.Errorf("quota files does not match, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+		err = client.Remove(lockedFile)
+		if err == nil {
+			t.Errorf("removing a locked file must fail")
 		}
-		if expectedQuotaSize != user.UsedQuotaSize {
-			t.Errorf("quota size does not match, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+		err = client.Rename(lockedFile, path.Join("/worm", testFileName+"1"))
+		if err == nil {
+			t.Errorf("renaming a locked file must fail")
 		}
-	}
-	// now set a quota size restriction and upload the same file, upload should fail for space limit exceeded
-	user.QuotaSize = testFileSize - 1
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("error updating user: %v", err)
-	}
-	client, err = getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = client.Chmod(lockedFile, 0600)
 		if err == nil {
-			t.Errorf("quota size exceeded, file upload must fail")
+			t.Errorf("chmod on a locked file must fail")
 		}
-		err = client.Remove(testFileName)
+		err = client.Chtimes(lockedFile, time.Now(), time.Now().Add(-48*time.Hour))
+		if err == nil {
+			t.Errorf("chtimes on a locked file must fail")
+		}
+		err = client.Rename("/worm", "/worm1")
+		if err == nil {
+			t.Errorf("renaming a retention directory must fail")
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/other", testFileName), testFileSize, client)
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Rename(path.Join("/other", testFileName), path.Join("/worm", testFileName+"1"))
+		if err == nil {
+			t.Errorf("moving a file inside a retention directory must fail")
+		}
+		err = client.Rename(path.Join("/other", testFileName), path.Join("/other", testFileName+"1"))
+		if err != nil {
+			t.Errorf("renaming a file without retention policy must succeed: %v", err)
+		}
+		status, _, err := httpd.GetRetentionStatus(user, lockedFile, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get retention status: %v", err)
+		}
+		if !status.IsLocked || status.PolicyPath != "/worm" || status.RetentionDays != 1 || status.IsDir {
+			t.Errorf("unexpected retention status: %+v", status)
 		}
+		retainUntil := utils.GetTimeFromMsecSinceEpoch(status.RetainUntil)
+		if retainUntil.Before(time.Now().Add(23*time.Hour)) || retainUntil.After(time.Now().Add(25*time.Hour)) {
+			t.Errorf("unexpected retain until: %v", retainUntil)
+		}
+		status, _, err = httpd.GetRetentionStatus(user, "/other", http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get retention status: %v", err)
+		}
+		if status.IsLocked || len(status.PolicyPath) > 0 || !status.IsDir || status.RetainUntil != 0 {
+			t.Errorf("unexpected retention status: %+v", status)
+		}
+		_, _, err = httpd.GetRetentionStatus(user, "/missing", http.StatusNotFound)
+		if err != nil {
+			t.Errorf("unexpected status code for a missing path: %v", err)
+		}
+		_, _, err = httpd.GetRetentionStatus(user, "worm", http.StatusBadRequest)
+		if err != nil {
+			t.Errorf("unexpected status code for a relative path: %v", err)
+		}
+		// the retain until time is stored when the upload completes, the modification time is not relevant
+		expired := time.Now().Add(-48 * time.Hour)
+		err = os.Chtimes(filepath.Join(user.GetHomeDir(), "worm", testFileName), expired, expired)
+		if err != nil {
+			t.Errorf("unable to change file times: %v", err)
+		}
+		status, _, err = httpd.GetRetentionStatus(user, lockedFile, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get retention status: %v", err)
+		}
+		if !status.IsLocked || status.RetainUntil != utils.GetTimeAsMsSinceEpoch(retainUntil) {
+			t.Errorf("the file must be locked until the stored time: %+v", status)
+		}
+		err = client.Remove(lockedFile)
+		if err == nil {
+			t.Errorf("removing a locked file must fail after a modification time change")
+		}
+		// simulate an expired retention
+		err = dataprovider.UpdateRetainUntil(dataprovider.GetProvider(), user, lockedFile, expired)
+		if err != nil {
+			t.Errorf("unable to update retain until: %v", err)
+		}
+		status, _, err = httpd.GetRetentionStatus(user, lockedFile, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get retention status: %v", err)
+		}
+		if status.IsLocked {
+			t.Errorf("the retention must be expired: %+v", status)
+		}
+		err = client.Remove(lockedFile)
+		if err != nil {
+			t.Errorf("removing a file with an expired retention must succeed: %v", err)
+		}
+		// the files without a stored retain until time are locked starting from the modification time
+		legacyFile := filepath.Join(user.GetHomeDir(), "worm", "legacy")
+		err = ioutil.WriteFile(legacyFile, []byte("legacy"), 0666)
+		if err != nil {
+			t.Errorf("unable to write file: %v", err)
+		}
+		err = client.Remove("/worm/legacy")
+		if err == nil {
+			t.Errorf("removing a recently modified file must fail")
+		}
+		err = os.Chtimes(legacyFile, expired, expired)
+		if err != nil {
+			t.Errorf("unable to change file times: %v", err)
+		}
+		err = client.Remove("/worm/legacy")
+		if err != nil {
+			t.Errorf("removing a file with an expired retention must succeed: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.Remove(testFilePath)
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestQuotaScan(t *testing.T) {
+func TestLink(t *testing.T) {
 	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	u.Permissions["/nodownload"] = []string{dataprovider.PermListItems, dataprovider.PermUpload,
+		dataprovider.PermCreateSymlinks}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	testFileSize := int64(65535)
-	expectedQuotaSize := user.UsedQuotaSize + testFileSize
-	expectedQuotaFiles := user.UsedQuotaFiles + 1
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
@@ -1765,6 +2258,7 @@ func TestQuotaScan(t *testing.T) {
 		defer client.Close()
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
@@ -1773,91 +2267,164 @@ func TestQuotaScan(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
+		err = client.Symlink(testFileName, testFileName+".link")
+		if err != nil {
+			t.Errorf("error creating symlink: %v", err)
+		}
+		_, err = client.ReadLink(testFileName + ".link")
+		if err == nil {
+			t.Errorf("readlink is currently not implemented so must fail")
+		}
+		err = client.Symlink(testFileName, testFileName+".link")
+		if err == nil {
+			t.Errorf("creating a symlink to an existing one must fail")
+		}
+		err = client.Link(testFileName, testFileName+".hlink")
+		if err != nil {
+			t.Errorf("error creating hard link: %v", err)
+		}
+		err = client.Link(testFileName, testFileName+".hlink")
+		if err == nil {
+			t.Errorf("creating an hard link to an existing file must fail")
+		}
+		err = client.Link(testFileName+".link", testFileName+".hlink1")
+		if err == nil {
+			t.Errorf("creating an hard link to a symlink must fail")
+		}
+		err = client.Link("/", "root.hlink")
+		if err == nil {
+			t.Errorf("creating an hard link to the root dir must fail")
+		}
+		err = client.Mkdir("/nodownload")
+		if err != nil {
+			t.Errorf("error mkdir: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/nodownload", testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Link(path.Join("/nodownload", testFileName), testFileName+".hlink1")
+		if !os.IsPermission(err) {
+			t.Errorf("hard link to a file that cannot be downloaded must fail: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 3 || user.UsedQuotaSize != 3*testFileSize {
+			t.Errorf("unexpected quota after hard link, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		err = client.Remove(testFileName + ".hlink")
+		if err != nil {
+			t.Errorf("error removing hard link: %v", err)
+		}
+		err = client.Remove(testFileName + ".link")
+		if err != nil {
+			t.Errorf("error removing symlink: %v", err)
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
 		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	// create user with the same home dir, so there is at least an untracked file
-	user, _, err = httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	_, err = httpd.StartQuotaScan(user, http.StatusCreated)
-	if err != nil {
-		t.Errorf("error starting quota scan: %v", err)
-	}
-	err = waitQuotaScans()
-	if err != nil {
-		t.Errorf("error waiting for active quota scans: %v", err)
-	}
-	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
-	if err != nil {
-		t.Errorf("error getting user: %v", err)
-	}
-	if expectedQuotaFiles != user.UsedQuotaFiles {
-		t.Errorf("quota files does not match after scan, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
-	}
-	if expectedQuotaSize != user.UsedQuotaSize {
-		t.Errorf("quota size does not match after scan, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
-	}
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestMultipleQuotaScans(t *testing.T) {
-	if !sftpd.AddQuotaScan(defaultUsername) {
-		t.Errorf("add quota failed")
-	}
-	if sftpd.AddQuotaScan(defaultUsername) {
-		t.Errorf("add quota must fail if another scan is already active")
-	}
-	sftpd.RemoveQuotaScan(defaultUsername)
-	activeScans := sftpd.GetQuotaScans()
-	if len(activeScans) > 0 {
-		t.Errorf("no quota scan must be active: %v", len(activeScans))
-	}
-}
-
-func TestQuotaSize(t *testing.T) {
-	usePubKey := false
-	testFileSize := int64(65535)
+func TestCopyData(t *testing.T) {
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1
-	u.QuotaSize = testFileSize - 1
+	u.QuotaFiles = 100
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(100000)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+		if _, ok := client.HasExtension("copy-data"); !ok {
+			t.Errorf("the copy-data extension must be advertised")
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".quota", testFileSize, client)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".quota.1", testFileSize, client)
+	}
+	session, err := newRawSFTPSession(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create SFTP session: %v", err)
+	} else {
+		defer session.Close()
+		// SSH_FXF_READ
+		readHandle, err := session.openFile(testFileName, 0x01)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+		}
+		// SSH_FXF_WRITE | SSH_FXF_CREAT | SSH_FXF_TRUNC
+		writeHandle, err := session.openFile(testFileName+".copy", 0x02|0x08|0x10)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+		}
+		err = session.copyData(readHandle, 0, 0, readHandle, 0)
 		if err == nil {
-			t.Errorf("user is over quota file upload must fail")
+			t.Errorf("copy-data using the same handle must fail")
 		}
-		err = client.Remove(testFileName + ".quota")
+		err = session.copyData(writeHandle, 0, 0, readHandle, 0)
+		if err == nil {
+			t.Errorf("copy-data to a file opened for reading must fail")
+		}
+		err = session.copyData(readHandle, 0, 0, "invalid handle", 0)
+		if err == nil {
+			t.Errorf("copy-data to an invalid handle must fail")
+		}
+		err = session.copyData(readHandle, 0, 65536, writeHandle, 0)
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("copy-data error: %v", err)
+		}
+		// the remaining data, the length is 0 so the copy stops at the end of the file
+		err = session.copyData(readHandle, 65536, 0, writeHandle, 65536)
+		if err != nil {
+			t.Errorf("copy-data error: %v", err)
+		}
+		for _, handle := range []string{readHandle, writeHandle} {
+			err = session.closeHandle(handle)
+			if err != nil {
+				t.Errorf("unable to close handle: %v", err)
+			}
+		}
+		original, err := ioutil.ReadFile(testFilePath)
+		if err != nil {
+			t.Errorf("unable to read test file: %v", err)
+		}
+		copied, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName+".copy"))
+		if err != nil {
+			t.Errorf("unable to read copied file: %v", err)
+		}
+		if !bytes.Equal(original, copied) {
+			t.Errorf("the copied file does not match, size: %v", len(copied))
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 2 || user.UsedQuotaSize != 2*testFileSize {
+			t.Errorf("unexpected quota after copy-data, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-		os.Remove(testFilePath)
 	}
+	os.Remove(testFilePath)
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -1865,73 +2432,112 @@ func TestQuotaSize(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestBandwidthAndConnections(t *testing.T) {
-	usePubKey := false
-	testFileSize := int64(131072)
-	u := getTestUser(usePubKey)
-	u.UploadBandwidth = 30
-	u.DownloadBandwidth = 25
-	wantedUploadElapsed := 1000 * (testFileSize / 1000) / u.UploadBandwidth
-	wantedDownloadElapsed := 1000 * (testFileSize / 1000) / u.DownloadBandwidth
-	// 100 ms tolerance
-	wantedUploadElapsed -= 100
-	wantedDownloadElapsed -= 100
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestCheckFile(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(100000)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	content, err := ioutil.ReadFile(testFilePath)
+	if err != nil {
+		t.Errorf("unable to read test file: %v", err)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+		if _, ok := client.HasExtension("check-file"); !ok {
+			t.Errorf("the check-file extension must be advertised")
 		}
-		startTime := time.Now()
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		elapsed := time.Since(startTime).Nanoseconds() / 1000000
-		if elapsed < (wantedUploadElapsed) {
-			t.Errorf("upload bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
-		}
-		startTime = time.Now()
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		c := sftpDownloadNonBlocking(testFileName, localDownloadPath, testFileSize, client)
-		waitForActiveTransfer()
-		// wait some additional arbitrary time to wait for transfer activity to happen
-		// it is need to reach all the code in CheckIdleConnections
-		time.Sleep(100 * time.Millisecond)
-		sftpd.CheckIdleConnections()
-		err = <-c
+	}
+	session, err := newRawSFTPSession(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create SFTP session: %v", err)
+	} else {
+		defer session.Close()
+		algorithm, hashes, err := session.checkFile("check-file-name", testFileName, "crc32,sha256,md5", 0, 0, 0)
 		if err != nil {
-			t.Errorf("file download error: %v", err)
+			t.Errorf("check-file error: %v", err)
 		}
-		elapsed = time.Since(startTime).Nanoseconds() / 1000000
-		if elapsed < (wantedDownloadElapsed) {
-			t.Errorf("download bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedDownloadElapsed)
+		sha256Sum := sha256.Sum256(content)
+		if algorithm != "sha256" || !bytes.Equal(hashes, sha256Sum[:]) {
+			t.Errorf("unexpected check-file result, algorithm: %v hashes: %x", algorithm, hashes)
 		}
-		// test disconnection
-		c = sftpUploadNonBlocking(testFilePath, testFileName+"_partial", testFileSize, client)
-		waitForActiveTransfer()
-		time.Sleep(100 * time.Millisecond)
-		sftpd.CheckIdleConnections()
-		stats := sftpd.GetConnectionsStats()
-		for _, stat := range stats {
-			sftpd.CloseActiveConnection(stat.ConnectionID)
+		// a range divided in blocks
+		algorithm, hashes, err = session.checkFile("check-file-name", testFileName, "md5", 1000, 70000, 65536)
+		if err != nil {
+			t.Errorf("check-file error: %v", err)
 		}
-		err = <-c
+		md5Block1 := md5.Sum(content[1000:66536])
+		md5Block2 := md5.Sum(content[66536:71000])
+		if algorithm != "md5" || !bytes.Equal(hashes, append(md5Block1[:], md5Block2[:]...)) {
+			t.Errorf("unexpected check-file result, algorithm: %v hashes: %x", algorithm, hashes)
+		}
+		readHandle, err := session.openFile(testFileName, 0x01)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+		}
+		// the length is capped to the file size
+		algorithm, hashes, err = session.checkFile("check-file-handle", readHandle, "sha1", 99000, 2000, 0)
+		if err != nil {
+			t.Errorf("check-file error: %v", err)
+		}
+		sha1Sum := sha1.Sum(content[99000:])
+		if algorithm != "sha1" || !bytes.Equal(hashes, sha1Sum[:]) {
+			t.Errorf("unexpected check-file result, algorithm: %v hashes: %x", algorithm, hashes)
+		}
+		// the file was not downloaded, so closing it reports an incomplete download
+		session.closeHandle(readHandle) //nolint:errcheck
+		_, _, err = session.checkFile("check-file-handle", readHandle, "sha1", 0, 0, 0)
 		if err == nil {
-			t.Errorf("connection closed upload must fail")
+			t.Errorf("check-file using a closed handle must fail")
+		}
+		_, _, err = session.checkFile("check-file-name", testFileName, "crc32", 0, 0, 0)
+		if err == nil {
+			t.Errorf("check-file using an unsupported algorithm must fail")
+		}
+		_, _, err = session.checkFile("check-file-name", testFileName, "md5", 0, 0, 100)
+		if err == nil {
+			t.Errorf("check-file using a block size too small must fail")
+		}
+		_, _, err = session.checkFile("check-file-name", "missing", "md5", 0, 0, 0)
+		if err == nil {
+			t.Errorf("check-file for a missing file must fail")
+		}
+		_, _, err = session.checkFile("check-file-name", "/", "md5", 0, 0, 0)
+		if err == nil {
+			t.Errorf("check-file for a directory must fail")
+		}
+	}
+	// check-file-name reads the file as a download does
+	user.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermUpload}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	session, err = newRawSFTPSession(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create SFTP session: %v", err)
+	} else {
+		defer session.Close()
+		_, _, err = session.checkFile("check-file-name", testFileName, "md5", 0, 0, 0)
+		if err == nil {
+			t.Errorf("check-file without the download permission must fail")
 		}
-		os.Remove(testFilePath)
-		os.Remove(localDownloadPath)
 	}
+	os.Remove(testFilePath)
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -1939,9 +2545,12 @@ func TestBandwidthAndConnections(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestMissingFile(t *testing.T) {
-	usePubKey := false
+func TestStatVFS(t *testing.T) {
+	usePubKey := true
+	testFileSize := int64(65535)
 	u := getTestUser(usePubKey)
+	u.QuotaFiles = 10
+	u.QuotaSize = 100 * testFileSize
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -1951,12 +2560,61 @@ func TestMissingFile(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		err = sftpDownloadFile("missing_file", localDownloadPath, 0, client)
+		stat, err := client.StatVFS("/")
+		if err != nil {
+			t.Errorf("statvfs error: %v", err)
+		} else {
+			if stat.Files != uint64(u.QuotaFiles) || stat.Ffree != uint64(u.QuotaFiles) {
+				t.Errorf("unexpected files stats: %v/%v", stat.Ffree, stat.Files)
+			}
+			if stat.TotalSpace() > uint64(u.QuotaSize) || stat.FreeSpace() > uint64(u.QuotaSize) {
+				t.Errorf("unexpected space stats: %v/%v", stat.FreeSpace(), stat.TotalSpace())
+			}
+		}
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		stat, err = client.StatVFS(testFileName)
+		if err != nil {
+			t.Errorf("statvfs error: %v", err)
+		} else {
+			if stat.Ffree != uint64(u.QuotaFiles-1) {
+				t.Errorf("unexpected free files: %v", stat.Ffree)
+			}
+			if stat.FreeSpace() > uint64(u.QuotaSize-testFileSize) {
+				t.Errorf("unexpected free space: %v", stat.FreeSpace())
+			}
+		}
+		_, err = client.StatVFS("missing")
 		if err == nil {
-			t.Errorf("download missing file must fail")
+			t.Errorf("statvfs for a missing path must fail")
+		}
+		os.Remove(testFilePath)
+	}
+	user.QuotaFiles = 0
+	user.QuotaSize = 0
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		stat, err := client.StatVFS("/")
+		if err != nil {
+			t.Errorf("statvfs error: %v", err)
+		} else if stat.TotalSpace() == 0 {
+			t.Errorf("unexpected filesystem stats: %+v", stat)
 		}
-		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -1965,71 +2623,86 @@ func TestMissingFile(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestOpenError(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestFsyncAndLimits(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		os.Chmod(user.GetHomeDir(), 0001)
-		_, err = client.ReadDir(".")
-		if err == nil {
-			t.Errorf("read dir must fail if we have no filesystem read permissions")
+		for _, ext := range []string{"fsync@openssh.com", "limits@openssh.com", "statvfs@openssh.com"} {
+			if _, ok := client.HasExtension(ext); !ok {
+				t.Errorf("extension %#v must be advertised", ext)
+			}
 		}
-		os.Chmod(user.GetHomeDir(), 0755)
-		testFileSize := int64(65535)
 		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(user.GetHomeDir(), testFileName)
-		err = createTestFile(testFilePath, testFileSize)
+		f, err := client.Create(testFileName)
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to create file: %v", err)
+		} else {
+			_, err = f.Write([]byte("test data"))
+			if err != nil {
+				t.Errorf("unable to write file: %v", err)
+			}
+			err = f.Sync()
+			if err != nil {
+				t.Errorf("fsync error: %v", err)
+			}
+			err = f.Close()
+			if err != nil {
+				t.Errorf("unable to close file: %v", err)
+			}
+			err = f.Sync()
+			if err == nil {
+				t.Errorf("fsync on a closed handle must fail")
+			}
 		}
-		_, err = client.Stat(testFileName)
+		f, err = client.Open(testFileName)
 		if err != nil {
-			t.Errorf("file stat error: %v", err)
+			t.Errorf("unable to open file: %v", err)
+		} else {
+			err = f.Sync()
+			if err != nil {
+				t.Errorf("fsync error: %v", err)
+			}
+			f.Close()
 		}
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		err = client.Remove(testFileName)
 		if err != nil {
-			t.Errorf("file download error: %v", err)
-		}
-		os.Chmod(testFilePath, 0001)
-		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
-		if err == nil {
-			t.Errorf("file download must fail if we have no filesystem read permissions")
-		}
-		err = sftpUploadFile(localDownloadPath, testFileName, testFileSize, client)
-		if err == nil {
-			t.Errorf("upload must fail if we have no filesystem write permissions")
+			t.Errorf("unable to remove file: %v", err)
 		}
-		err = client.Mkdir("test")
+	}
+	session, err := newRawSFTPSession(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create SFTP session: %v", err)
+	} else {
+		defer session.Close()
+		payload := marshalSFTPString(marshalSFTPUint32(nil, 1), "limits@openssh.com")
+		packetType, data, err := session.exchangePacket(200, payload)
 		if err != nil {
-			t.Errorf("error making dir: %v", err)
-		}
-		os.Chmod(user.GetHomeDir(), 0000)
-		_, err = client.Lstat(testFileName)
-		if err == nil {
-			t.Errorf("file stat must fail if we have no filesystem read permissions")
+			t.Errorf("limits request error: %v", err)
+		} else if packetType != 201 || len(data) != 36 {
+			t.Errorf("unexpected limits response, type: %v data: %v", packetType, data)
+		} else {
+			maxPacketLength := binary.BigEndian.Uint64(data[4:])
+			maxReadLength := binary.BigEndian.Uint64(data[12:])
+			maxWriteLength := binary.BigEndian.Uint64(data[20:])
+			if maxPacketLength != 256*1024 || maxReadLength != 32768 || maxWriteLength != 32768 {
+				t.Errorf("unexpected limits: %v %v %v", maxPacketLength, maxReadLength, maxWriteLength)
+			}
 		}
-		os.Chmod(user.GetHomeDir(), 0755)
-		os.Chmod(filepath.Join(user.GetHomeDir(), "test"), 0000)
-		err = client.Rename(testFileName, path.Join("test", testFileName))
-		if err == nil || !strings.Contains(err.Error(), sftp.ErrSSHFxPermissionDenied.Error()) {
-			t.Errorf("unexpected error: %v expected: %v", err, sftp.ErrSSHFxPermissionDenied)
+		// unknown extensions are still rejected by pkg/sftp
+		payload = marshalSFTPString(marshalSFTPUint32(nil, 2), "unknown@example.com")
+		packetType, data, err = session.exchangePacket(200, payload)
+		if err != nil {
+			t.Errorf("extended request error: %v", err)
+		} else if packetType != 101 || binary.BigEndian.Uint32(data[4:]) != 8 {
+			t.Errorf("unknown extensions must be unsupported, type: %v data: %v", packetType, data)
 		}
-		os.Chmod(filepath.Join(user.GetHomeDir(), "test"), 0755)
-		os.Remove(testFilePath)
-		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2038,10 +2711,9 @@ func TestOpenError(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestOverwriteDirWithFile(t *testing.T) {
+func TestPosixRename(t *testing.T) {
 	usePubKey := false
-	u := getTestUser(usePubKey)
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
@@ -2050,37 +2722,36 @@ func TestOverwriteDirWithFile(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileSize := int64(65535)
 		testFileName := "test_file.dat"
-		testDirName := "test_dir"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = client.Mkdir(testDirName)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("mkdir error: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testDirName, testFileSize, client)
-		if err == nil {
-			t.Errorf("copying a file over an existing dir must fail")
+			t.Errorf("file upload error: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = sftpUploadFile(testFilePath, testFileName+".rename", testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = client.Rename(testFileName, testDirName)
+		err = client.PosixRename(testFileName, testFileName+".rename")
+		if err != nil {
+			t.Errorf("posix rename error: %v", err)
+		}
+		_, err = client.Stat(testFileName)
 		if err == nil {
-			t.Errorf("rename a file over an existing dir must fail")
+			t.Errorf("the renamed file must not exist")
 		}
-		err = client.RemoveDirectory(testDirName)
-		if err != nil {
-			t.Errorf("dir remove error: %v", err)
+		err = client.PosixRename("/", "rootdir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error renaming root dir: %v", err)
 		}
-		err = client.Remove(testFileName)
+		err = client.Remove(testFileName + ".rename")
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("error removing renamed file: %v", err)
 		}
 		os.Remove(testFilePath)
 	}
@@ -2091,31 +2762,63 @@ func TestOverwriteDirWithFile(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPasswordsHashPbkdf2Sha1(t *testing.T) {
-	pbkdf2Pwd := "$pbkdf2-sha1$150000$DveVjgYUD05R$X6ydQZdyMeOvpgND2nqGR/0GGic="
-	pbkdf2ClearPwd := "password"
+func TestStat(t *testing.T) {
 	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Password = pbkdf2Pwd
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = pbkdf2ClearPwd
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to login with pkkdf2 sha1 password: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		createTestFile(testFilePath, testFileSize)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("unable to get working dir with pkkdf2 sha1 password: %v", err)
+			t.Errorf("file upload error: %v", err)
 		}
-	}
-	user.Password = pbkdf2Pwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
+		_, err := client.Lstat(testFileName)
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		}
+		// mode 0666 and 0444 works on Windows too
+		newPerm := os.FileMode(0666)
+		err = client.Chmod(testFileName, newPerm)
+		if err != nil {
+			t.Errorf("chmod error: %v", err)
+		}
+		newFi, err := client.Lstat(testFileName)
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		}
+		if newPerm != newFi.Mode().Perm() {
+			t.Errorf("chmod failed expected: %v, actual: %v", newPerm, newFi.Mode().Perm())
+		}
+		newPerm = os.FileMode(0444)
+		err = client.Chmod(testFileName, newPerm)
+		if err != nil {
+			t.Errorf("chmod error: %v", err)
+		}
+		newFi, err = client.Lstat(testFileName)
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		}
+		if newPerm != newFi.Mode().Perm() {
+			t.Errorf("chmod failed expected: %v, actual: %v", newPerm, newFi.Mode().Perm())
+		}
+		_, err = client.ReadLink(testFileName)
+		if err == nil {
+			t.Errorf("readlink is not supported and must fail")
+		}
+		err = client.Truncate(testFileName, 0)
+		if err != nil {
+			t.Errorf("truncate must be silently ignored: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2124,31 +2827,58 @@ func TestPasswordsHashPbkdf2Sha1(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPasswordsHashPbkdf2Sha256(t *testing.T) {
-	pbkdf2Pwd := "$pbkdf2-sha256$150000$E86a9YMX3zC7$R5J62hsSq+pYw00hLLPKBbcGXmq7fj5+/M0IFoYtZbo="
-	pbkdf2ClearPwd := "password"
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Password = pbkdf2Pwd
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestStatChownChmod(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("chown is not supported on Windows, chmod is partially supported")
+	}
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = pbkdf2ClearPwd
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to login with pkkdf2 sha1 password: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		createTestFile(testFilePath, testFileSize)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("unable to get working dir with pkkdf2 sha1 password: %v", err)
+			t.Errorf("file upload error: %v", err)
 		}
-	}
-	user.Password = pbkdf2Pwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
+		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
+		if err != nil {
+			t.Errorf("chown error: %v", err)
+		}
+		newPerm := os.FileMode(0600)
+		err = client.Chmod(testFileName, newPerm)
+		if err != nil {
+			t.Errorf("chmod error: %v", err)
+		}
+		newFi, err := client.Lstat(testFileName)
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		}
+		if newPerm != newFi.Mode().Perm() {
+			t.Errorf("chown failed expected: %v, actual: %v", newPerm, newFi.Mode().Perm())
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		// l'errore viene riconvertito da sftp.ErrSSHFxNoSuchFile in os.ErrNotExist
+		err = client.Chmod(testFileName, newPerm)
+		if err != os.ErrNotExist {
+			t.Errorf("unexpected chmod error: %v expected: %v", err, os.ErrNotExist)
+		}
+		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
+		if err != os.ErrNotExist {
+			t.Errorf("unexpected chown error: %v expected: %v", err, os.ErrNotExist)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2157,31 +2887,60 @@ func TestPasswordsHashPbkdf2Sha256(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPasswordsHashPbkdf2Sha512(t *testing.T) {
-	pbkdf2Pwd := "$pbkdf2-sha512$150000$dsu7T5R3IaVQ$1hFXPO1ntRBcoWkSLKw+s4sAP09Xtu4Ya7CyxFq64jM9zdUg8eRJVr3NcR2vQgb0W9HHvZaILHsL4Q/Vr6arCg=="
-	pbkdf2ClearPwd := "password"
+func TestChtimes(t *testing.T) {
 	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Password = pbkdf2Pwd
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = pbkdf2ClearPwd
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to login with pkkdf2 sha1 password: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		testDir := "test"
+		createTestFile(testFilePath, testFileSize)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("unable to get working dir with pkkdf2 sha1 password: %v", err)
+			t.Errorf("file upload error: %v", err)
 		}
-	}
-	user.Password = pbkdf2Pwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
+		acmodTime := time.Now()
+		err = client.Chtimes(testFileName, acmodTime, acmodTime)
+		if err != nil {
+			t.Errorf("error changing file times")
+		}
+		newFi, err := client.Lstat(testFileName)
+		if err != nil {
+			t.Errorf("file stat error: %v", err)
+		}
+		diff := math.Abs(newFi.ModTime().Sub(acmodTime).Seconds())
+		if diff > 1 {
+			t.Errorf("diff between wanted and real modification time too big: %v", diff)
+		}
+		err = client.Chtimes("invalidFile", acmodTime, acmodTime)
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Mkdir(testDir)
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = client.Chtimes(testDir, acmodTime, acmodTime)
+		if err != nil {
+			t.Errorf("error changing dir times")
+		}
+		newFi, err = client.Lstat(testDir)
+		if err != nil {
+			t.Errorf("dir stat error: %v", err)
+		}
+		diff = math.Abs(newFi.ModTime().Sub(acmodTime).Seconds())
+		if diff > 1 {
+			t.Errorf("diff between wanted and real modification time too big: %v", diff)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2190,31 +2949,72 @@ func TestPasswordsHashPbkdf2Sha512(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPasswordsHashBcrypt(t *testing.T) {
-	bcryptPwd := "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK"
-	bcryptClearPwd := "secret"
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Password = bcryptPwd
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+// basic tests to verify virtual chroot, should be improved to cover more cases ...
+func TestEscapeHomeDir(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = bcryptClearPwd
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to login with bcrypt password: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to get working dir with bcrypt password: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-	}
-	user.Password = bcryptPwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
+		testDir := "testDir"
+		linkPath := filepath.Join(homeBasePath, defaultUsername, testDir)
+		err = os.Symlink(homeBasePath, linkPath)
+		if err != nil {
+			t.Errorf("error making local symlink: %v", err)
+		}
+		_, err = client.ReadDir(testDir)
+		if err == nil {
+			t.Errorf("reading a symbolic link outside home dir should not succeeded")
+		}
+		os.Remove(linkPath)
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		remoteDestPath := path.Join("..", "..", testFileName)
+		err = sftpUploadFile(testFilePath, remoteDestPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		_, err = client.Lstat(testFileName)
+		if err != nil {
+			t.Errorf("file stat error: %v the file was created outside the user dir!", err)
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		linkPath = filepath.Join(homeBasePath, defaultUsername, testFileName)
+		err = os.Symlink(homeBasePath, linkPath)
+		if err != nil {
+			t.Errorf("error making local symlink: %v", err)
+		}
+		err = sftpDownloadFile(testFileName, testFilePath, 0, client)
+		if err == nil {
+			t.Errorf("download file outside home dir must fail")
+		}
+		err = sftpUploadFile(testFilePath, remoteDestPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("overwrite a file outside home dir must fail")
+		}
+		err = client.Chmod(remoteDestPath, 0644)
+		if err == nil {
+			t.Errorf("setstat on a file outside home dir must fail")
+		}
+		os.Remove(linkPath)
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2223,31 +3023,46 @@ func TestPasswordsHashBcrypt(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPasswordsHashSHA512Crypt(t *testing.T) {
-	sha512CryptPwd := "$6$459ead56b72e44bc$uog86fUxscjt28BZxqFBE2pp2QD8P/1e98MNF75Z9xJfQvOckZnQ/1YJqiq1XeytPuDieHZvDAMoP7352ELkO1"
-	clearPwd := "secret"
-	usePubKey := false
+func TestHomeSpecialChars(t *testing.T) {
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Password = sha512CryptPwd
+	u.HomeDir = filepath.Join(homeBasePath, "abc açà#&%lk")
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = clearPwd
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to login with sha512 crypt password: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to get working dir with sha512 crypt password: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-	}
-	user.Password = sha512CryptPwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		files, err := client.ReadDir(".")
+		if err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
+		}
+		if len(files) < 1 {
+			t.Errorf("expected at least 1 file in this dir")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2256,65 +3071,75 @@ func TestPasswordsHashSHA512Crypt(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPasswordsHashMD5Crypt(t *testing.T) {
-	md5CryptPwd := "$1$b5caebda$VODr/nyhGWgZaY8sJ4x05."
-	clearPwd := "password"
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Password = md5CryptPwd
+func TestLogin(t *testing.T) {
+	u := getTestUser(false)
+	u.PublicKeys = []string{testPubKey}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.Password = clearPwd
-	client, err := getSftpClient(user, usePubKey)
+	client, err := getSftpClient(user, false)
 	if err != nil {
-		t.Errorf("unable to login with md5 crypt password: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to get working dir with md5 crypt password: %v", err)
+			t.Errorf("sftp client with valid password must work")
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.LastLogin <= 0 {
+			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
 		}
 	}
-	user.Password = md5CryptPwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
-	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	client, err = getSftpClient(user, true)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("sftp client with valid public key must work")
+		}
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestPasswordsHashMD5CryptApr1(t *testing.T) {
-	md5CryptPwd := "$apr1$OBWLeSme$WoJbB736e7kKxMBIAqilb1"
-	clearPwd := "password"
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Password = md5CryptPwd
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user.Password = "invalid password"
+	client, err = getSftpClient(user, false)
+	if err == nil {
+		t.Errorf("login with invalid password must fail")
+		defer client.Close()
+	}
+	// testPubKey1 is not authorized
+	user.PublicKeys = []string{testPubKey1}
+	user.Password = ""
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("unable to update user: %v", err)
 	}
-	user.Password = clearPwd
-	client, err := getSftpClient(user, usePubKey)
+	client, err = getSftpClient(user, true)
+	if err == nil {
+		t.Errorf("login with invalid public key must fail")
+		defer client.Close()
+	}
+	// login a user with multiple public keys, only the second one is valid
+	user.PublicKeys = []string{testPubKey1, testPubKey}
+	user.Password = ""
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to login with md5 crypt password: %v", err)
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, true)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to get working dir with md5 crypt password: %v", err)
+			t.Errorf("sftp client with multiple public key must work if at least one public key is valid")
 		}
 	}
-	user.Password = md5CryptPwd
-	_, err = getSftpClient(user, usePubKey)
-	if err == nil {
-		t.Errorf("login with wrong password must fail")
-	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -2322,13 +3147,9 @@ func TestPasswordsHashMD5CryptApr1(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermList(t *testing.T) {
+func TestLoginUserStatus(t *testing.T) {
 	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete, dataprovider.PermRename,
-		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
@@ -2337,15 +3158,28 @@ func TestPermList(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.ReadDir(".")
-		if err == nil {
-			t.Errorf("read remote dir without permission should not succeed")
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("sftp client with valid credentials must work")
 		}
-		_, err = client.Stat("test_file")
-		if err == nil {
-			t.Errorf("stat remote file without permission should not succeed")
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.LastLogin <= 0 {
+			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
 		}
 	}
+	user.Status = 0
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login for a disabled user must fail")
+		defer client.Close()
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -2353,13 +3187,9 @@ func TestPermList(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermDownload(t *testing.T) {
+func TestLoginUserExpiration(t *testing.T) {
 	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermUpload, dataprovider.PermDelete, dataprovider.PermRename,
-		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
@@ -2368,28 +3198,38 @@ func TestPermDownload(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("sftp client with valid credentials must work")
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
-		if err == nil {
-			t.Errorf("file download without permission should not succeed")
+			t.Errorf("error getting user: %v", err)
 		}
-		err = client.Remove(testFileName)
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+		if user.LastLogin <= 0 {
+			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
 		}
-		os.Remove(testFilePath)
-		os.Remove(localDownloadPath)
+	}
+	user.ExpirationDate = utils.GetTimeAsMsSinceEpoch(time.Now()) - 120000
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login for an expired user must fail")
+		defer client.Close()
+	}
+	user.ExpirationDate = utils.GetTimeAsMsSinceEpoch(time.Now()) + 120000
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("login for a non expired user must succeed: %v", err)
+	} else {
+		defer client.Close()
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2398,33 +3238,37 @@ func TestPermDownload(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermUpload(t *testing.T) {
-	usePubKey := false
+func TestLoginInvalidFs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	if providerConf.Driver != dataprovider.SQLiteDataProviderName {
+		t.Skip("this test require sqlite provider")
+	}
+	dbPath := providerConf.Name
+	if !filepath.IsAbs(dbPath) {
+		dbPath = filepath.Join(configDir, dbPath)
+	}
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermDelete, dataprovider.PermRename,
-		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	// we update the database using sqlite3 CLI since we cannot add an user with an invalid config
+	time.Sleep(200 * time.Millisecond)
+	updateUserQuery := fmt.Sprintf("UPDATE users SET filesystem='{\"provider\":1}' WHERE id=%v", user.ID)
+	cmd := exec.Command("sqlite3", dbPath, updateUserQuery)
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err == nil {
-			t.Errorf("file upload without permission should not succeed")
-		}
-		os.Remove(testFilePath)
+		t.Errorf("unexpected error: %v, cmd out: %v", err, string(out))
+	}
+	time.Sleep(200 * time.Millisecond)
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login must fail, the user has an invalid filesystem config")
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2433,12 +3277,11 @@ func TestPermUpload(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermOverwrite(t *testing.T) {
-	usePubKey := false
+func TestLoginWithIPFilters(t *testing.T) {
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
+	u.Filters.DeniedIP = []string{"192.167.0.0/24", "172.18.0.0/16"}
+	u.Filters.AllowedIP = []string{}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -2448,22 +3291,38 @@ func TestPermOverwrite(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("sftp client with valid credentials must work")
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("error uploading file: %v", err)
+			t.Errorf("error getting user: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err == nil {
-			t.Errorf("file overwrite without permission should not succeed")
+		if user.LastLogin <= 0 {
+			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
 		}
-		os.Remove(testFilePath)
+	}
+	user.Filters.AllowedIP = []string{"127.0.0.0/8"}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("login from an allowed IP must succeed: %v", err)
+	} else {
+		defer client.Close()
+	}
+	user.Filters.AllowedIP = []string{"172.19.0.0/16"}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login from an not allowed IP must fail")
+		client.Close()
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2472,37 +3331,32 @@ func TestPermOverwrite(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermDelete(t *testing.T) {
+func TestLoginAfterUserUpdateEmptyPwd(t *testing.T) {
 	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermRename,
-		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	user.Password = ""
+	user.PublicKeys = []string{}
+	// password and public key should remain unchanged
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		_, err = client.ReadDir(".")
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		err = client.Remove(testFileName)
-		if err == nil {
-			t.Errorf("delete without permission should not succeed")
+			t.Errorf("unable to read remote dir: %v", err)
 		}
-		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2511,41 +3365,32 @@ func TestPermDelete(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermRename(t *testing.T) {
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestLoginAfterUserUpdateEmptyPubKey(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	user.Password = ""
+	user.PublicKeys = []string{}
+	// password and public key should remain unchanged
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		err = client.Rename(testFileName, testFileName+".rename")
-		if err == nil {
-			t.Errorf("rename without permission should not succeed")
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		err = client.Remove(testFileName)
+		_, err = client.ReadDir(".")
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("unable to read remote dir: %v", err)
 		}
-		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2554,26 +3399,44 @@ func TestPermRename(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermCreateDirs(t *testing.T) {
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestLoginKeyboardInteractiveAuth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
+	client, err := getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		err = client.Mkdir("testdir")
-		if err == nil {
-			t.Errorf("mkdir without permission should not succeed")
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+		_, err = client.ReadDir(".")
+		if err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
 		}
 	}
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, -1), 0755)
+	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
+	if err == nil {
+		t.Error("keyboard interactive auth must fail the script returned -1")
+	}
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, true, 1), 0755)
+	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
+	if err == nil {
+		t.Error("keyboard interactive auth must fail the script returned bad json")
+	}
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 5, true, 1), 0755)
+	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
+	if err == nil {
+		t.Error("keyboard interactive auth must fail the script returned bad json")
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -2581,17 +3444,28 @@ func TestPermCreateDirs(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermSymlink(t *testing.T) {
-	usePubKey := false
+func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermOverwrite, dataprovider.PermChmod, dataprovider.PermChown,
-		dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	u.QuotaFiles = 1000
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthProgram = extAuthPath
+	providerConf.ExternalAuthScope = 0
+	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("error initializing data provider")
 	}
-	client, err := getSftpClient(user, usePubKey)
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
@@ -2607,325 +3481,2702 @@ func TestPermSymlink(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = client.Symlink(testFilePath, testFilePath+".symlink")
-		if err == nil {
-			t.Errorf("symlink without permission should not succeed")
-		}
-		err = client.Remove(testFileName)
+		os.Remove(testFilePath)
+	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = false
+	u = getTestUser(usePubKey)
+	u.PublicKeys = []string{}
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	client, err = getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		os.Remove(testFilePath)
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	if len(user.PublicKeys) != 0 {
+		t.Errorf("number of public keys mismatch, expected: 0, actual: %v", len(user.PublicKeys))
+	}
+	if user.UsedQuotaSize == 0 {
+		t.Error("quota size must be > 0")
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to remove: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
 }
 
-func TestPermChmod(t *testing.T) {
+func TestLoginExternalAuthPwd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
-		dataprovider.PermChown, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthProgram = extAuthPath
+	providerConf.ExternalAuthScope = 1
+	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("error initializing data provider")
 	}
-	client, err := getSftpClient(user, usePubKey)
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		err = client.Chmod(testFileName, 0666)
-		if err == nil {
-			t.Errorf("chmod without permission should not succeed")
-		}
-		err = client.Remove(testFileName)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		os.Remove(testFilePath)
 	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = true
+	u = getTestUser(usePubKey)
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with valid user but invalid auth scope must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to remove: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
 }
 
-func TestPermChown(t *testing.T) {
-	usePubKey := false
+func TestLoginExternalAuthPubKey(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
-		dataprovider.PermChmod, dataprovider.PermChtimes}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthProgram = extAuthPath
+	providerConf.ExternalAuthScope = 2
+	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("error initializing data provider")
 	}
-	client, err := getSftpClient(user, usePubKey)
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
-		if err == nil {
-			t.Errorf("chown without permission should not succeed")
-		}
-		err = client.Remove(testFileName)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		os.Remove(testFilePath)
 	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = false
+	u = getTestUser(usePubKey)
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with valid user but invalid auth scope must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to remove: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
 }
 
-func TestPermChtimes(t *testing.T) {
+func TestLoginExternalAuthInteractive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
-		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
-		dataprovider.PermChmod, dataprovider.PermChown}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthProgram = extAuthPath
+	providerConf.ExternalAuthScope = 4
+	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("error initializing data provider")
 	}
-	client, err := getSftpClient(user, usePubKey)
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
+	client, err := getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		err = client.Chtimes(testFileName, time.Now(), time.Now())
-		if err == nil {
-			t.Errorf("chtimes without permission should not succeed")
-		}
-		err = client.Remove(testFileName)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		os.Remove(testFilePath)
 	}
+	u.Username = defaultUsername + "1"
+	client, err = getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = true
+	u = getTestUser(usePubKey)
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with valid user but invalid auth scope must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to remove: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
 }
 
-func TestSubDirsUploads(t *testing.T) {
+func TestLoginExternalAuthErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermChtimes, dataprovider.PermDownload}
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, true), 0755)
+	providerConf.ExternalAuthProgram = extAuthPath
+	providerConf.ExternalAuthScope = 0
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login must fail, external auth returns a non json response")
+	}
+	usePubKey = false
+	u = getTestUser(usePubKey)
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login must fail, external auth returns a non json response")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 0 {
+		t.Errorf("number of users mismatch, expected: 0, actual: %v", len(users))
+	}
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
+}
+
+func TestDirQuotas(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Filters.DirQuotas = []dataprovider.DirQuota{
+		{
+			Path:       "/uploads",
+			QuotaFiles: 1,
+		},
+	}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileSize := int64(65535)
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		err = client.Mkdir("subdir")
-		if err != nil {
-			t.Errorf("unexpected mkdir error: %v", err)
-		}
 		testFileName := "test_file.dat"
-		testFileNameSub := "/subdir/test_file_dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = client.Mkdir("/uploads")
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("/uploads", testFileName), testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileNameSub, testFileSize, client)
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected upload error: %v", err)
+		err = sftpUploadFile(testFilePath, path.Join("/uploads", testFileName+"1"), testFileSize, client)
+		if err == nil {
+			t.Errorf("upload must fail, the directory quota is exceeded")
 		}
-		err = client.Symlink(testFileName, testFileNameSub+".link")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected upload error: %v", err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("upload outside the directory quota must succeed: %v", err)
 		}
-		err = client.Symlink(testFileName, testFileName+".link")
+		err = client.Rename(testFileName, path.Join("/uploads", testFileName+"1"))
+		if err == nil {
+			t.Errorf("rename must fail, the directory quota is exceeded")
+		}
+		usage, _, err := httpd.GetDirQuotasUsage(user, http.StatusOK)
 		if err != nil {
-			t.Errorf("symlink error: %v", err)
+			t.Errorf("unable to get directory quotas usage: %v", err)
 		}
-		err = client.Rename(testFileName, testFileNameSub+".rename")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected rename error: %v", err)
+		if len(usage) != 1 || usage[0].UsedQuotaFiles != 1 || usage[0].UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected directory quotas usage: %+v", usage)
 		}
-		err = client.Rename(testFileName, testFileName+".rename")
+		err = client.Rename(path.Join("/uploads", testFileName), testFileName+"1")
 		if err != nil {
-			t.Errorf("rename error: %v", err)
+			t.Errorf("rename outside the directory quota must succeed: %v", err)
 		}
-		err = client.Remove(testFileNameSub)
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected upload error: %v", err)
+		usage, _, err = httpd.GetDirQuotasUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get directory quotas usage: %v", err)
 		}
-		err = client.Remove(testFileName + ".rename")
+		if len(usage) != 1 || usage[0].UsedQuotaFiles != 0 || usage[0].UsedQuotaSize != 0 {
+			t.Errorf("unexpected directory quotas usage: %+v", usage)
+		}
+		err = client.Rename(testFileName, path.Join("/uploads", testFileName))
 		if err != nil {
-			t.Errorf("remove error: %v", err)
+			t.Errorf("rename inside the directory quota must succeed: %v", err)
+		}
+		usage, _, err = httpd.GetDirQuotasUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get directory quotas usage: %v", err)
+		}
+		if len(usage) != 1 || usage[0].UsedQuotaFiles != 1 || usage[0].UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected directory quotas usage: %+v", usage)
+		}
+		err = client.Remove(path.Join("/uploads", testFileName))
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		usage, _, err = httpd.GetDirQuotasUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get directory quotas usage: %v", err)
+		}
+		if len(usage) != 1 || usage[0].UsedQuotaFiles != 0 || usage[0].UsedQuotaSize != 0 {
+			t.Errorf("unexpected directory quotas usage: %+v", usage)
+		}
+		// add an untracked file and check that a quota scan updates the usage
+		err = createTestFile(filepath.Join(user.GetHomeDir(), "uploads", testFileName), testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		usage, _, err = httpd.GetDirQuotasUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get directory quotas usage: %v", err)
+		}
+		if len(usage) != 1 || usage[0].UsedQuotaFiles != 1 || usage[0].UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected directory quotas usage after scan: %+v", usage)
 		}
 		os.Remove(testFilePath)
 	}
-	httpd.RemoveUser(user, http.StatusOK)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestSubDirsOverwrite(t *testing.T) {
+func TestFilePatterns(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermOverwrite, dataprovider.PermListItems}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:           "/",
+			DeniedPatterns: []string{"*.exe"},
+		},
+		{
+			Path:            "/inbound",
+			AllowedPatterns: []string{"*.csv"},
+		},
+	}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileSize := int64(65535)
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "/subdir/test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
-		testFileSFTPPath := filepath.Join(u.GetHomeDir(), "subdir", "test_file.dat")
-		testFileSize := int64(65535)
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = createTestFile(testFileSFTPPath, 16384)
+		err = client.Mkdir("/inbound")
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = client.Mkdir("/inbound/sub")
+		if err == nil {
+			t.Errorf("mkdir must fail, the directory name is not allowed")
+		}
+		err = client.Mkdir("/dir.EXE")
+		if err == nil {
+			t.Errorf("mkdir must fail, the directory name is denied")
+		}
+		err = sftpUploadFile(testFilePath, "/inbound/file.csv", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, "/inbound/file.txt", testFileSize, client)
+		if err == nil {
+			t.Errorf("upload must fail, the file name is not allowed")
+		}
+		err = sftpUploadFile(testFilePath, "/file.exe", testFileSize, client)
+		if err == nil {
+			t.Errorf("upload must fail, the file name is denied")
+		}
+		err = sftpUploadFile(testFilePath, "/file.txt", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Rename("/file.txt", "/inbound/file1.txt")
+		if err == nil {
+			t.Errorf("rename must fail, the target name is not allowed")
+		}
+		err = client.Symlink("/file.txt", "/inbound/link")
+		if err == nil {
+			t.Errorf("symlink must fail, the target name is not allowed")
+		}
+		err = client.Rename("/file.txt", "/inbound/file1.csv")
+		if err != nil {
+			t.Errorf("rename to an allowed name must succeed: %v", err)
+		}
+		// a file added bypassing SFTPGo must be hidden and it cannot be downloaded
+		err = createTestFile(filepath.Join(user.GetHomeDir(), "inbound", "hidden.txt"), testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".new", testFileSize, client)
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected upload error: %v", err)
+		files, err := client.ReadDir("/inbound")
+		if err != nil {
+			t.Errorf("unable to read dir: %v", err)
+		}
+		if len(files) != 2 {
+			t.Errorf("unexpected directory listing: %v", files)
+		}
+		for _, f := range files {
+			if f.Name() == "hidden.txt" {
+				t.Errorf("the denied file must be hidden")
+			}
+		}
+		err = sftpDownloadFile("/inbound/hidden.txt", localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("download must fail, the file name is not allowed")
+		}
+		err = sftpDownloadFile("/inbound/file1.csv", localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		_, err = runSSHCommand("md5sum inbound/hidden.txt", user, usePubKey)
+		if err == nil {
+			t.Errorf("hash command must fail, the file name is not allowed")
+		}
+		_, err = runSSHCommand("git-receive-pack inbound", user, usePubKey)
+		if err == nil {
+			t.Errorf("system commands must fail, file patterns are defined")
+		}
+		err = client.Remove("/inbound/hidden.txt")
+		if err != nil {
+			t.Errorf("removing a denied file must succeed: %v", err)
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestTransferQuota(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Filters.TransferQuota = dataprovider.TransferQuota{
+		Period:       dataprovider.TransferQuotaPeriodDaily,
+		UploadSize:   131072,
+		DownloadSize: 100000,
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(65535)
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
 		}
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("unexpected overwrite error: %v", err)
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		// only 2 bytes are left, the upload must be aborted
+		err = sftpUploadFile(testFilePath, testFileName+"2", testFileSize, client)
+		if err == nil {
+			t.Errorf("upload must fail, the transfer quota is exceeded")
+		}
+		err = sftpUploadFile(testFilePath, testFileName+"3", testFileSize, client)
+		if err == nil {
+			t.Errorf("upload must be denied, the transfer quota is exceeded")
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("download must fail, the transfer quota is exceeded")
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("download must be denied, the transfer quota is exceeded")
+		}
+		usage, _, err := httpd.GetTransferQuotaUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get transfer quota usage: %v", err)
+		}
+		if usage.UsedUploadSize <= usage.UploadSize || usage.UsedDownloadSize <= usage.DownloadSize {
+			t.Errorf("unexpected transfer quota usage: %+v", usage)
+		}
+		_, err = httpd.ResetTransferQuota(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to reset transfer quota: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+"3", testFileSize, client)
+		if err != nil {
+			t.Errorf("upload must succeed after a transfer quota reset: %v", err)
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("download must succeed after a transfer quota reset: %v", err)
+		}
+		usage, _, err = httpd.GetTransferQuotaUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get transfer quota usage: %v", err)
+		}
+		if usage.UsedUploadSize != testFileSize || usage.UsedDownloadSize != testFileSize {
+			t.Errorf("unexpected transfer quota usage: %+v", usage)
+		}
+		// the server side copies are charged as downloads and uploads
+		_, err = runSSHCommand("cp "+testFileName+" "+testFileName+".copy", user, usePubKey)
+		if err == nil {
+			t.Errorf("copy must fail, the transfer quota is exceeded")
+		}
+		_, err = httpd.ResetTransferQuota(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to reset transfer quota: %v", err)
+		}
+		_, err = runSSHCommand("cp "+testFileName+" "+testFileName+".copy", user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
+		}
+		usage, _, err = httpd.GetTransferQuotaUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get transfer quota usage: %v", err)
+		}
+		if usage.UsedUploadSize != testFileSize || usage.UsedDownloadSize != testFileSize {
+			t.Errorf("unexpected transfer quota usage after copy: %+v", usage)
+		}
+		// the data transferred in a previous period are not added to the current usage
+		err = dataprovider.UpdateTransferQuota(dataprovider.GetProvider(), user, 10, 10, usage.PeriodStart-1, false)
+		if err != nil {
+			t.Errorf("unable to update transfer quota: %v", err)
+		}
+		usage, _, err = httpd.GetTransferQuotaUsage(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get transfer quota usage: %v", err)
+		}
+		if usage.UsedUploadSize != testFileSize || usage.UsedDownloadSize != testFileSize {
+			t.Errorf("unexpected transfer quota usage after a previous period update: %+v", usage)
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestMaxUploadFileSizeLimit(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Filters.MaxUploadFileSize = 65535
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, 65535)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, 65535, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = createTestFile(testFilePath, 65536)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+"1", 65536, client)
+		if err == nil {
+			t.Errorf("upload must fail, the file exceeds the max upload file size")
+		}
+		_, err = runSSHCommand("git-receive-pack repo", user, usePubKey)
+		if err == nil {
+			t.Errorf("system commands must fail, a max upload file size is set")
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestQuotaDisabledError(t *testing.T) {
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.TrackQuota = 0
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 10
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
 		}
 		os.Remove(testFilePath)
 	}
-	httpd.RemoveUser(user, http.StatusOK)
-	os.RemoveAll(user.GetHomeDir())
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestMaxSessions(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Username += "1"
+	u.MaxSessions = 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+		_, err = client.ReadDir(".")
+		if err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
+		}
+		_, err = getSftpClient(user, usePubKey)
+		if err == nil {
+			t.Errorf("max sessions exceeded, new login should not succeed")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestQuotaFileReplace(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	testFileSize := int64(65535)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		expectedQuotaSize := user.UsedQuotaSize + testFileSize
+		expectedQuotaFiles := user.UsedQuotaFiles + 1
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		// now replace the same file, the quota must not change
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if expectedQuotaFiles != user.UsedQuotaFiles {
+			t.Errorf("quota files does not match, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+		}
+		if expectedQuotaSize != user.UsedQuotaSize {
+			t.Errorf("quota size does not match, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+		}
+	}
+	// now set a quota size restriction and upload the same file, upload should fail for space limit exceeded
+	user.QuotaSize = testFileSize - 1
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("error updating user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Errorf("quota size exceeded, file upload must fail")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestQuotaScan(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(65535)
+	expectedQuotaSize := user.UsedQuotaSize + testFileSize
+	expectedQuotaFiles := user.UsedQuotaFiles + 1
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	// create user with the same home dir, so there is at least an untracked file
+	user, _, err = httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+	if err != nil {
+		t.Errorf("error starting quota scan: %v", err)
+	}
+	err = waitQuotaScans()
+	if err != nil {
+		t.Errorf("error waiting for active quota scans: %v", err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("error getting user: %v", err)
+	}
+	if expectedQuotaFiles != user.UsedQuotaFiles {
+		t.Errorf("quota files does not match after scan, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+	}
+	if expectedQuotaSize != user.UsedQuotaSize {
+		t.Errorf("quota size does not match after scan, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestIncrementalQuotaScan(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	files := map[string]int64{
+		filepath.Join("dir1", "file1"):        100,
+		filepath.Join("dir1", "sub", "file2"): 200,
+		filepath.Join("dir2", "file3"):        300,
+	}
+	for name, size := range files {
+		filePath := filepath.Join(user.GetHomeDir(), name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err = createTestFile(filePath, size); err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+	}
+	// the directories, or files, modified just before the scan are always read again
+	oldTime := time.Now().Add(-1 * time.Hour)
+	for name := range files {
+		os.Chtimes(filepath.Join(user.GetHomeDir(), name), oldTime, oldTime)
+	}
+	for _, dir := range []string{"", "dir1", filepath.Join("dir1", "sub"), "dir2"} {
+		os.Chtimes(filepath.Join(user.GetHomeDir(), dir), oldTime, oldTime)
+	}
+	checkScan := func(incremental bool, expectedFiles int, expectedSize int64) {
+		if incremental {
+			_, err = httpd.StartIncrementalQuotaScan(user, http.StatusCreated)
+		} else {
+			_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		}
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		if err = waitQuotaScans(); err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != expectedFiles || user.UsedQuotaSize != expectedSize {
+			t.Errorf("unexpected quota after scan, incremental: %v expected files: %v size: %v actual files: %v size: %v",
+				incremental, expectedFiles, expectedSize, user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+	}
+	checkScan(false, 3, 600)
+	checkScan(true, 3, 600)
+	// an in place change does not update the directory modification time, an incremental scan
+	// detects it from the file size and modification time, even if the modification time is restored
+	file2 := filepath.Join(user.GetHomeDir(), "dir1", "sub", "file2")
+	f, err := os.OpenFile(file2, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Errorf("unable to open test file: %v", err)
+	} else {
+		f.Write(make([]byte, 50))
+		f.Close()
+	}
+	os.Chtimes(file2, oldTime, oldTime)
+	os.Chtimes(filepath.Dir(file2), oldTime, oldTime)
+	if err = createTestFile(filepath.Join(user.GetHomeDir(), "dir2", "file4"), 400); err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	checkScan(true, 4, 1050)
+	checkScan(false, 4, 1050)
+	// a non atomic overwrite of the same size changes the file modification time
+	if err = createTestFile(filepath.Join(user.GetHomeDir(), "dir2", "file3"), 100); err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	checkScan(true, 4, 850)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestMultipleQuotaScans(t *testing.T) {
+	if !sftpd.AddQuotaScan(defaultUsername) {
+		t.Errorf("add quota failed")
+	}
+	if sftpd.AddQuotaScan(defaultUsername) {
+		t.Errorf("add quota must fail if another scan is already active")
+	}
+	sftpd.RemoveQuotaScan(defaultUsername)
+	activeScans := sftpd.GetQuotaScans()
+	if len(activeScans) > 0 {
+		t.Errorf("no quota scan must be active: %v", len(activeScans))
+	}
+}
+
+func TestQuotaSize(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(65535)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1
+	u.QuotaSize = testFileSize - 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".quota", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".quota.1", testFileSize, client)
+		if err == nil {
+			t.Errorf("user is over quota file upload must fail")
+		}
+		err = client.Remove(testFileName + ".quota")
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestVirtualFolders(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(65535)
+	mappedPath := filepath.Join(os.TempDir(), "vdir")
+	folder, _, err := httpd.AddFolder(dataprovider.BaseVirtualFolder{
+		Name:       "vfolder",
+		MappedPath: mappedPath,
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add folder: %v", err)
+	}
+	vdirPath := "/vdir"
+	u := getTestUser(usePubKey)
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		BaseVirtualFolder: dataprovider.BaseVirtualFolder{Name: folder.Name},
+		VirtualPath:       vdirPath,
+		QuotaFiles:        1,
+		QuotaSize:         testFileSize + 1,
+	})
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		files, err := client.ReadDir("/")
+		if err != nil {
+			t.Errorf("unable to read root dir: %v", err)
+		}
+		found := false
+		for _, f := range files {
+			if f.Name() == path.Base(vdirPath) && f.IsDir() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("the virtual folder must be listed inside the root dir")
+		}
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		fi, err := os.Stat(filepath.Join(mappedPath, testFileName))
+		if err != nil {
+			t.Errorf("the uploaded file must be stored inside the mapped path: %v", err)
+		} else if fi.Size() != testFileSize {
+			t.Errorf("unexpected size for the uploaded file: %v", fi.Size())
+		}
+		folder, _, err = httpd.GetFolderByID(folder.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get folder: %v", err)
+		}
+		if folder.UsedQuotaFiles != 1 || folder.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected folder quota, files: %v, size: %v", folder.UsedQuotaFiles, folder.UsedQuotaSize)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("files inside virtual folders must not be included in the user quota")
+		}
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName+"1"), testFileSize, client)
+		if err == nil {
+			t.Errorf("the folder is over quota, file upload must fail")
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(path.Join(vdirPath, testFileName), localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		err = client.Rename(path.Join(vdirPath, testFileName), testFileName)
+		if err == nil {
+			t.Errorf("renaming a file outside a virtual folder must fail")
+		}
+		err = client.Rename(vdirPath, "/vdir1")
+		if err == nil {
+			t.Errorf("renaming a virtual folder must fail")
+		}
+		err = client.RemoveDirectory(vdirPath)
+		if err == nil {
+			t.Errorf("removing a virtual folder must fail")
+		}
+		err = client.Mkdir(path.Join(vdirPath, "subdir"))
+		if err != nil {
+			t.Errorf("unable to create a dir inside a virtual folder: %v", err)
+		}
+		err = client.Rename(path.Join(vdirPath, testFileName), path.Join(vdirPath, "subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to rename a file inside a virtual folder: %v", err)
+		}
+		err = client.Remove(path.Join(vdirPath, "subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to remove a file inside a virtual folder: %v", err)
+		}
+		folder, _, err = httpd.GetFolderByID(folder.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get folder: %v", err)
+		}
+		if folder.UsedQuotaFiles != 0 || folder.UsedQuotaSize != 0 {
+			t.Errorf("unexpected folder quota after remove, files: %v, size: %v", folder.UsedQuotaFiles, folder.UsedQuotaSize)
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	_, err = httpd.RemoveFolder(folder, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove folder: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(mappedPath)
+}
+
+func TestBandwidthAndConnections(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(131072)
+	u := getTestUser(usePubKey)
+	u.UploadBandwidth = 30
+	u.DownloadBandwidth = 25
+	wantedUploadElapsed := 1000 * (testFileSize / 1000) / u.UploadBandwidth
+	wantedDownloadElapsed := 1000 * (testFileSize / 1000) / u.DownloadBandwidth
+	// 100 ms tolerance
+	wantedUploadElapsed -= 100
+	wantedDownloadElapsed -= 100
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		startTime := time.Now()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		elapsed := time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < (wantedUploadElapsed) {
+			t.Errorf("upload bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
+		}
+		startTime = time.Now()
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		c := sftpDownloadNonBlocking(testFileName, localDownloadPath, testFileSize, client)
+		waitForActiveTransfer()
+		// wait some additional arbitrary time to wait for transfer activity to happen
+		// it is need to reach all the code in CheckIdleConnections
+		time.Sleep(100 * time.Millisecond)
+		sftpd.CheckIdleConnections()
+		err = <-c
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		elapsed = time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < (wantedDownloadElapsed) {
+			t.Errorf("download bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedDownloadElapsed)
+		}
+		// test disconnection
+		c = sftpUploadNonBlocking(testFilePath, testFileName+"_partial", testFileSize, client)
+		waitForActiveTransfer()
+		time.Sleep(100 * time.Millisecond)
+		sftpd.CheckIdleConnections()
+		stats := sftpd.GetConnectionsStats()
+		for _, stat := range stats {
+			sftpd.CloseActiveConnection(stat.ConnectionID)
+		}
+		err = <-c
+		if err == nil {
+			t.Errorf("connection closed upload must fail")
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestMissingFile(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile("missing_file", localDownloadPath, 0, client)
+		if err == nil {
+			t.Errorf("download missing file must fail")
+		}
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestOpenError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		os.Chmod(user.GetHomeDir(), 0001)
+		_, err = client.ReadDir(".")
+		if err == nil {
+			t.Errorf("read dir must fail if we have no filesystem read permissions")
+		}
+		os.Chmod(user.GetHomeDir(), 0755)
+		testFileSize := int64(65535)
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(user.GetHomeDir(), testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		_, err = client.Stat(testFileName)
+		if err != nil {
+			t.Errorf("file stat error: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		os.Chmod(testFilePath, 0001)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("file download must fail if we have no filesystem read permissions")
+		}
+		err = sftpUploadFile(localDownloadPath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Errorf("upload must fail if we have no filesystem write permissions")
+		}
+		err = client.Mkdir("test")
+		if err != nil {
+			t.Errorf("error making dir: %v", err)
+		}
+		os.Chmod(user.GetHomeDir(), 0000)
+		_, err = client.Lstat(testFileName)
+		if err == nil {
+			t.Errorf("file stat must fail if we have no filesystem read permissions")
+		}
+		os.Chmod(user.GetHomeDir(), 0755)
+		os.Chmod(filepath.Join(user.GetHomeDir(), "test"), 0000)
+		err = client.Rename(testFileName, path.Join("test", testFileName))
+		if err == nil || !strings.Contains(err.Error(), sftp.ErrSSHFxPermissionDenied.Error()) {
+			t.Errorf("unexpected error: %v expected: %v", err, sftp.ErrSSHFxPermissionDenied)
+		}
+		os.Chmod(filepath.Join(user.GetHomeDir(), "test"), 0755)
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestOverwriteDirWithFile(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileSize := int64(65535)
+		testFileName := "test_file.dat"
+		testDirName := "test_dir"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = client.Mkdir(testDirName)
+		if err != nil {
+			t.Errorf("mkdir error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testDirName, testFileSize, client)
+		if err == nil {
+			t.Errorf("copying a file over an existing dir must fail")
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Rename(testFileName, testDirName)
+		if err == nil {
+			t.Errorf("rename a file over an existing dir must fail")
+		}
+		err = client.RemoveDirectory(testDirName)
+		if err != nil {
+			t.Errorf("dir remove error: %v", err)
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashPbkdf2Sha1(t *testing.T) {
+	pbkdf2Pwd := "$pbkdf2-sha1$150000$DveVjgYUD05R$X6ydQZdyMeOvpgND2nqGR/0GGic="
+	pbkdf2ClearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = pbkdf2Pwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = pbkdf2ClearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with pkkdf2 sha1 password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with pkkdf2 sha1 password: %v", err)
+		}
+	}
+	user.Password = pbkdf2Pwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashPbkdf2Sha256(t *testing.T) {
+	pbkdf2Pwd := "$pbkdf2-sha256$150000$E86a9YMX3zC7$R5J62hsSq+pYw00hLLPKBbcGXmq7fj5+/M0IFoYtZbo="
+	pbkdf2ClearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = pbkdf2Pwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = pbkdf2ClearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with pkkdf2 sha1 password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with pkkdf2 sha1 password: %v", err)
+		}
+	}
+	user.Password = pbkdf2Pwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashPbkdf2Sha512(t *testing.T) {
+	pbkdf2Pwd := "$pbkdf2-sha512$150000$dsu7T5R3IaVQ$1hFXPO1ntRBcoWkSLKw+s4sAP09Xtu4Ya7CyxFq64jM9zdUg8eRJVr3NcR2vQgb0W9HHvZaILHsL4Q/Vr6arCg=="
+	pbkdf2ClearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = pbkdf2Pwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = pbkdf2ClearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with pkkdf2 sha1 password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with pkkdf2 sha1 password: %v", err)
+		}
+	}
+	user.Password = pbkdf2Pwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashBcrypt(t *testing.T) {
+	bcryptPwd := "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK"
+	bcryptClearPwd := "secret"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = bcryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = bcryptClearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with bcrypt password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with bcrypt password: %v", err)
+		}
+	}
+	user.Password = bcryptPwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashSHA512Crypt(t *testing.T) {
+	sha512CryptPwd := "$6$459ead56b72e44bc$uog86fUxscjt28BZxqFBE2pp2QD8P/1e98MNF75Z9xJfQvOckZnQ/1YJqiq1XeytPuDieHZvDAMoP7352ELkO1"
+	clearPwd := "secret"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = sha512CryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = clearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with sha512 crypt password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with sha512 crypt password: %v", err)
+		}
+	}
+	user.Password = sha512CryptPwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashMD5Crypt(t *testing.T) {
+	md5CryptPwd := "$1$b5caebda$VODr/nyhGWgZaY8sJ4x05."
+	clearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = md5CryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = clearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with md5 crypt password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with md5 crypt password: %v", err)
+		}
+	}
+	user.Password = md5CryptPwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashMD5CryptApr1(t *testing.T) {
+	md5CryptPwd := "$apr1$OBWLeSme$WoJbB736e7kKxMBIAqilb1"
+	clearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = md5CryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = clearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with md5 crypt password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with md5 crypt password: %v", err)
+		}
+	}
+	user.Password = md5CryptPwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermList(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete, dataprovider.PermRename,
+		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.ReadDir(".")
+		if err == nil {
+			t.Errorf("read remote dir without permission should not succeed")
+		}
+		_, err = client.Stat("test_file")
+		if err == nil {
+			t.Errorf("stat remote file without permission should not succeed")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermDownload(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermUpload, dataprovider.PermDelete, dataprovider.PermRename,
+		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("file download without permission should not succeed")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermUpload(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermDelete, dataprovider.PermRename,
+		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Errorf("file upload without permission should not succeed")
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermOverwrite(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("error uploading file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Errorf("file overwrite without permission should not succeed")
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermDelete(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermRename,
+		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Remove(testFileName)
+		if err == nil {
+			t.Errorf("delete without permission should not succeed")
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermRename(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Rename(testFileName, testFileName+".rename")
+		if err == nil {
+			t.Errorf("rename without permission should not succeed")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermCreateDirs(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite, dataprovider.PermChmod,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = client.Mkdir("testdir")
+		if err == nil {
+			t.Errorf("mkdir without permission should not succeed")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermSymlink(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermOverwrite, dataprovider.PermChmod, dataprovider.PermChown,
+		dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Symlink(testFilePath, testFilePath+".symlink")
+		if err == nil {
+			t.Errorf("symlink without permission should not succeed")
+		}
+		err = client.Link(testFileName, testFileName+".hlink")
+		if !os.IsPermission(err) {
+			t.Errorf("hard link without permission should not succeed: %v", err)
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermChmod(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
+		dataprovider.PermChown, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Chmod(testFileName, 0666)
+		if err == nil {
+			t.Errorf("chmod without permission should not succeed")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermChown(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
+		dataprovider.PermChmod, dataprovider.PermChtimes}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Chown(testFileName, os.Getuid(), os.Getgid())
+		if err == nil {
+			t.Errorf("chown without permission should not succeed")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermChtimes(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename, dataprovider.PermCreateDirs, dataprovider.PermCreateSymlinks, dataprovider.PermOverwrite,
+		dataprovider.PermChmod, dataprovider.PermChown}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Chtimes(testFileName, time.Now(), time.Now())
+		if err == nil {
+			t.Errorf("chtimes without permission should not succeed")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestSubDirsUploads(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermChtimes, dataprovider.PermDownload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unexpected mkdir error: %v", err)
+		}
+		testFileName := "test_file.dat"
+		testFileNameSub := "/subdir/test_file_dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileNameSub, testFileSize, client)
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected upload error: %v", err)
+		}
+		err = client.Symlink(testFileName, testFileNameSub+".link")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected upload error: %v", err)
+		}
+		err = client.Symlink(testFileName, testFileName+".link")
+		if err != nil {
+			t.Errorf("symlink error: %v", err)
+		}
+		err = client.Rename(testFileName, testFileNameSub+".rename")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected rename error: %v", err)
+		}
+		err = client.Rename(testFileName, testFileName+".rename")
+		if err != nil {
+			t.Errorf("rename error: %v", err)
+		}
+		err = client.Remove(testFileNameSub)
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected upload error: %v", err)
+		}
+		err = client.Remove(testFileName + ".rename")
+		if err != nil {
+			t.Errorf("remove error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestSubDirsOverwrite(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermOverwrite, dataprovider.PermListItems}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "/subdir/test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
+		testFileSFTPPath := filepath.Join(u.GetHomeDir(), "subdir", "test_file.dat")
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = createTestFile(testFileSFTPPath, 16384)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".new", testFileSize, client)
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("unexpected overwrite error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestSubDirsDownloads(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermChmod, dataprovider.PermUpload, dataprovider.PermListItems}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unexpected mkdir error: %v", err)
+		}
+		testFileName := "/subdir/test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected overwrite error: %v", err)
+		}
+		err = client.Chtimes(testFileName, time.Now(), time.Now())
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		err = client.Rename(testFileName, testFileName+".rename")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected rename error: %v", err)
+		}
+		err = client.Symlink(testFileName, testFileName+".link")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected symlink error: %v", err)
+		}
+		err = client.Remove(testFileName)
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected remove error: %v", err)
+		}
+		os.Remove(localDownloadPath)
+		os.Remove(testFilePath)
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermsSubDirsSetstat(t *testing.T) {
+	// for setstat we check the parent dir permission if the requested path is a dir
+	// otherwise the path permission
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermCreateDirs}
+	u.Permissions["/subdir"] = []string{dataprovider.PermAny}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unexpected mkdir error: %v", err)
+		}
+		testFileName := "/subdir/test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Chtimes("/subdir/", time.Now(), time.Now())
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		err = client.Chtimes("subdir/", time.Now(), time.Now())
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		err = client.Chtimes(testFileName, time.Now(), time.Now())
+		if err != nil {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermsSubDirsCommands(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		client.Mkdir("subdir")
+		acmodTime := time.Now()
+		err = client.Chtimes("/subdir", acmodTime, acmodTime)
+		if err != nil {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		_, err = client.Stat("/subdir")
+		if err != nil {
+			t.Errorf("unexpected stat error: %v", err)
+		}
+		_, err = client.ReadDir("/")
+		if err != nil {
+			t.Errorf("unexpected readdir error: %v", err)
+		}
+		_, err = client.ReadDir("/subdir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.RemoveDirectory("/subdir/dir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Mkdir("/subdir/dir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		client.Mkdir("/otherdir")
+		err = client.Rename("/otherdir", "/subdir/otherdir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Symlink("/otherdir", "/subdir/otherdir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Symlink("/otherdir", "/otherdir_link")
+		if err != nil {
+			t.Errorf("unexpected rename dir error: %v", err)
+		}
+		err = client.Rename("/otherdir", "/otherdir1")
+		if err != nil {
+			t.Errorf("unexpected rename dir error: %v", err)
+		}
+		err = client.RemoveDirectory("/subdir")
+		if err != nil {
+			t.Errorf("unexpected remove dir error: %v", err)
+		}
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestRootDirCommands(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = client.Rename("/", "rootdir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error renaming root dir: %v", err)
+		}
+		err = client.Symlink("/", "rootdir")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error symlinking root dir: %v", err)
+		}
+		err = client.RemoveDirectory("/")
+		if !os.IsPermission(err) {
+			t.Errorf("unexpected error removing root dir: %v", err)
+		}
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestRelativePaths(t *testing.T) {
+	user := getTestUser(true)
+	var path, rel string
+	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir())}
+	keyPrefix := strings.TrimPrefix(user.GetHomeDir(), "/") + "/"
+	s3config := vfs.S3FsConfig{
+		KeyPrefix: keyPrefix,
+	}
+	s3fs, _ := vfs.NewS3Fs("", user.GetHomeDir(), s3config)
+	gcsConfig := vfs.GCSFsConfig{
+		KeyPrefix: keyPrefix,
+	}
+	gcsfs, _ := vfs.NewGCSFs("", user.GetHomeDir(), gcsConfig)
+	if runtime.GOOS != "windows" {
+		filesystems = append(filesystems, s3fs, gcsfs)
+	}
+	for _, fs := range filesystems {
+		path = filepath.Join(user.HomeDir, "/")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "//")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "../..")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v path: %v fs: %v", rel, path, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "../../../../../")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "/..")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v path: %v fs: %v", rel, path, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "/../../../..")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, ".")
+		rel = fs.GetRelativePath(path)
+		if rel != "/" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "somedir")
+		rel = fs.GetRelativePath(path)
+		if rel != "/somedir" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+		path = filepath.Join(user.HomeDir, "/somedir/subdir")
+		rel = fs.GetRelativePath(path)
+		if rel != "/somedir/subdir" {
+			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		}
+	}
+}
+
+func TestResolvePaths(t *testing.T) {
+	user := getTestUser(true)
+	var path, resolved string
+	var err error
+	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir())}
+	keyPrefix := strings.TrimPrefix(user.GetHomeDir(), "/") + "/"
+	s3config := vfs.S3FsConfig{
+		KeyPrefix: keyPrefix,
+	}
+	os.MkdirAll(user.GetHomeDir(), 0777)
+	s3fs, _ := vfs.NewS3Fs("", user.GetHomeDir(), s3config)
+	gcsConfig := vfs.GCSFsConfig{
+		KeyPrefix: keyPrefix,
+	}
+	gcsfs, _ := vfs.NewGCSFs("", user.GetHomeDir(), gcsConfig)
+	if runtime.GOOS != "windows" {
+		filesystems = append(filesystems, s3fs, gcsfs)
+	}
+	for _, fs := range filesystems {
+		path = "/"
+		resolved, _ = fs.ResolvePath(filepath.ToSlash(path))
+		if resolved != fs.Join(user.GetHomeDir(), "/") {
+			t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		}
+		path = "."
+		resolved, _ = fs.ResolvePath(filepath.ToSlash(path))
+		if resolved != fs.Join(user.GetHomeDir(), "/") {
+			t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		}
+		path = "test/sub"
+		resolved, _ = fs.ResolvePath(filepath.ToSlash(path))
+		if resolved != fs.Join(user.GetHomeDir(), "/test/sub") {
+			t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		}
+		path = "../test/sub"
+		resolved, err = fs.ResolvePath(filepath.ToSlash(path))
+		if vfs.IsLocalOsFs(fs) {
+			if err == nil {
+				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+			}
+		} else {
+			if resolved != fs.Join(user.GetHomeDir(), "/test/sub") && err == nil {
+				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+			}
+		}
+		path = "../../../test/../sub"
+		resolved, err = fs.ResolvePath(filepath.ToSlash(path))
+		if vfs.IsLocalOsFs(fs) {
+			if err == nil {
+				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+			}
+		} else {
+			if resolved != fs.Join(user.GetHomeDir(), "/sub") && err == nil {
+				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+			}
+		}
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestUserPerms(t *testing.T) {
+	user := getTestUser(true)
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermListItems}
+	user.Permissions["/p"] = []string{dataprovider.PermDelete}
+	user.Permissions["/p/1"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	user.Permissions["/p/2"] = []string{dataprovider.PermCreateDirs}
+	user.Permissions["/p/3"] = []string{dataprovider.PermChmod}
+	user.Permissions["/p/3/4"] = []string{dataprovider.PermChtimes}
+	user.Permissions["/tmp"] = []string{dataprovider.PermRename}
+	if !user.HasPerm(dataprovider.PermListItems, "/") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermListItems, ".") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermListItems, "") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermListItems, "../") {
+		t.Error("expected permission not found")
+	}
+	// path p and /p are the same
+	if !user.HasPerm(dataprovider.PermDelete, "/p") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermDownload, "/p/1") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermCreateDirs, "p/2") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermChmod, "/p/3") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermChtimes, "p/3/4/") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermChtimes, "p/3/4/../4") {
+		t.Error("expected permission not found")
+	}
+	// undefined paths have permissions of the nearest path
+	if !user.HasPerm(dataprovider.PermListItems, "/p34") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermListItems, "/p34/p1/file.dat") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermChtimes, "/p/3/4/5/6") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermDownload, "/p/1/test/file.dat") {
+		t.Error("expected permission not found")
+	}
+}
+
+func TestUserFiltersIPMaskConditions(t *testing.T) {
+	user := getTestUser(true)
+	// with no filter login must be allowed even if the remoteIP is invalid
+	if !user.IsLoginAllowed("192.168.1.5") {
+		t.Error("unexpected login denied")
+	}
+	if !user.IsLoginAllowed("invalid") {
+		t.Error("unexpected login denied")
+	}
+	user.Filters.DeniedIP = append(user.Filters.DeniedIP, "192.168.1.0/24")
+	if user.IsLoginAllowed("192.168.1.5") {
+		t.Error("unexpected login allowed")
+	}
+	if !user.IsLoginAllowed("192.168.2.6") {
+		t.Error("unexpected login denied")
+	}
+	user.Filters.AllowedIP = append(user.Filters.AllowedIP, "192.168.1.5/32")
+	// if the same ip/mask is both denied and allowed then login must be denied
+	if user.IsLoginAllowed("192.168.1.5") {
+		t.Error("unexpected login allowed")
+	}
+	if user.IsLoginAllowed("192.168.3.6") {
+		t.Error("unexpected login allowed")
+	}
+	user.Filters.DeniedIP = []string{}
+	if !user.IsLoginAllowed("192.168.1.5") {
+		t.Error("unexpected login denied")
+	}
+	if user.IsLoginAllowed("192.168.1.6") {
+		t.Error("unexpected login allowed")
+	}
+	user.Filters.DeniedIP = []string{"192.168.0.0/16", "172.16.0.0/16"}
+	user.Filters.AllowedIP = []string{}
+	if user.IsLoginAllowed("192.168.5.255") {
+		t.Error("unexpected login allowed")
+	}
+	if user.IsLoginAllowed("172.16.1.2") {
+		t.Error("unexpected login allowed")
+	}
+	if !user.IsLoginAllowed("172.18.2.1") {
+		t.Error("unexpected login denied")
+	}
+	user.Filters.AllowedIP = []string{"10.4.4.0/24"}
+	if user.IsLoginAllowed("10.5.4.2") {
+		t.Error("unexpected login allowed")
+	}
+	if !user.IsLoginAllowed("10.4.4.2") {
+		t.Error("unexpected login denied")
+	}
+	if !user.IsLoginAllowed("invalid") {
+		t.Error("unexpected login denied")
+	}
 }
 
-func TestSubDirsDownloads(t *testing.T) {
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermChmod, dataprovider.PermUpload, dataprovider.PermListItems}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestSSHCommands(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	_, err = runSSHCommand("uname", user, usePubKey)
+	if err == nil {
+		t.Errorf("unsupported ssh command must fail")
+	}
+	_, err = runSSHCommand("cd", user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		err = client.Mkdir("subdir")
-		if err != nil {
-			t.Errorf("unexpected mkdir error: %v", err)
-		}
-		testFileName := "/subdir/test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected upload error: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected overwrite error: %v", err)
-		}
-		err = client.Chtimes(testFileName, time.Now(), time.Now())
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected chtimes error: %v", err)
-		}
-		err = client.Rename(testFileName, testFileName+".rename")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected rename error: %v", err)
-		}
-		err = client.Symlink(testFileName, testFileName+".link")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected symlink error: %v", err)
-		}
-		err = client.Remove(testFileName)
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected remove error: %v", err)
-		}
-		os.Remove(localDownloadPath)
-		os.Remove(testFilePath)
+		t.Errorf("unexpected error for ssh cd command: %v", err)
+	}
+	out, err := runSSHCommand("pwd", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		t.Fail()
+	}
+	if string(out) != "/\n" {
+		t.Errorf("invalid response for ssh pwd command: %v", string(out))
+	}
+	out, err = runSSHCommand("md5sum", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		t.Fail()
+	}
+	// echo -n '' | md5sum
+	if !strings.Contains(string(out), "d41d8cd98f00b204e9800998ecf8427e") {
+		t.Errorf("invalid md5sum: %v", string(out))
+	}
+	out, err = runSSHCommand("sha1sum", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		t.Fail()
+	}
+	if !strings.Contains(string(out), "da39a3ee5e6b4b0d3255bfef95601890afd80709") {
+		t.Errorf("invalid sha1sum: %v", string(out))
+	}
+	out, err = runSSHCommand("sha256sum", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		t.Fail()
+	}
+	if !strings.Contains(string(out), "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") {
+		t.Errorf("invalid sha256sum: %v", string(out))
+	}
+	out, err = runSSHCommand("sha384sum", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		t.Fail()
+	}
+	if !strings.Contains(string(out), "38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b") {
+		t.Errorf("invalid sha384sum: %v", string(out))
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
 	}
-	httpd.RemoveUser(user, http.StatusOK)
-	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPermsSubDirsSetstat(t *testing.T) {
-	// for setstat we check the parent dir permission if the requested path is a dir
-	// otherwise the path permission
+func TestSSHFileHash(t *testing.T) {
 	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermCreateDirs}
-	u.Permissions["/subdir"] = []string{dataprovider.PermAny}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
@@ -2934,12 +6185,8 @@ func TestPermsSubDirsSetstat(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		err = client.Mkdir("subdir")
-		if err != nil {
-			t.Errorf("unexpected mkdir error: %v", err)
-		}
-		testFileName := "/subdir/test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
 		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
@@ -2949,476 +6196,404 @@ func TestPermsSubDirsSetstat(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = client.Chtimes("/subdir/", time.Now(), time.Now())
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected chtimes error: %v", err)
-		}
-		err = client.Chtimes("subdir/", time.Now(), time.Now())
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected chtimes error: %v", err)
-		}
-		err = client.Chtimes(testFileName, time.Now(), time.Now())
+		user.Permissions = make(map[string][]string)
+		user.Permissions["/"] = []string{dataprovider.PermUpload}
+		_, _, err = httpd.UpdateUser(user, http.StatusOK)
 		if err != nil {
-			t.Errorf("unexpected chtimes error: %v", err)
+			t.Errorf("unable to update user: %v", err)
 		}
-		os.Remove(testFilePath)
-	}
-	httpd.RemoveUser(user, http.StatusOK)
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestPermsSubDirsCommands(t *testing.T) {
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		client.Mkdir("subdir")
-		acmodTime := time.Now()
-		err = client.Chtimes("/subdir", acmodTime, acmodTime)
-		if err != nil {
-			t.Errorf("unexpected chtimes error: %v", err)
+		_, err = runSSHCommand("sha512sum "+testFileName, user, usePubKey)
+		if err == nil {
+			t.Errorf("hash command with no list permission must fail")
 		}
-		_, err = client.Stat("/subdir")
+		user.Permissions["/"] = []string{dataprovider.PermAny}
+		_, _, err = httpd.UpdateUser(user, http.StatusOK)
 		if err != nil {
-			t.Errorf("unexpected stat error: %v", err)
+			t.Errorf("unable to update user: %v", err)
 		}
-		_, err = client.ReadDir("/")
+		initialHash, err := computeHashForFile(sha512.New(), testFilePath)
 		if err != nil {
-			t.Errorf("unexpected readdir error: %v", err)
-		}
-		_, err = client.ReadDir("/subdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
-		}
-		err = client.RemoveDirectory("/subdir/dir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
-		}
-		err = client.Mkdir("/subdir/dir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
-		}
-		client.Mkdir("/otherdir")
-		err = client.Rename("/otherdir", "/subdir/otherdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
+			t.Errorf("error computing file hash: %v", err)
 		}
-		err = client.Symlink("/otherdir", "/subdir/otherdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
+		out, err := runSSHCommand("sha512sum "+testFileName, user, usePubKey)
+		if err != nil {
 			t.Errorf("unexpected error: %v", err)
+			t.Fail()
 		}
-		err = client.Symlink("/otherdir", "/otherdir_link")
-		if err != nil {
-			t.Errorf("unexpected rename dir error: %v", err)
+		if !strings.Contains(string(out), initialHash) {
+			t.Errorf("invalid sha512sum: %v", string(out))
 		}
-		err = client.Rename("/otherdir", "/otherdir1")
-		if err != nil {
-			t.Errorf("unexpected rename dir error: %v", err)
+		_, err = runSSHCommand("sha512sum invalid_path", user, usePubKey)
+		if err == nil {
+			t.Errorf("hash for an invalid path must fail")
 		}
-		err = client.RemoveDirectory("/subdir")
-		if err != nil {
-			t.Errorf("unexpected remove dir error: %v", err)
+		_, err = runSSHCommand("sha512sum /", user, usePubKey)
+		if err == nil {
+			t.Errorf("hash for a directory must fail")
 		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
 	}
-	httpd.RemoveUser(user, http.StatusOK)
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestRootDirCommands(t *testing.T) {
+func TestSSHCopy(t *testing.T) {
 	usePubKey := true
+	testFileSize := int64(65535)
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+	u.QuotaFiles = 3
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:           "/",
+			DeniedPatterns: []string{"*.denied"},
+		},
 	}
-	client, err := getSftpClient(user, usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		err = client.Rename("/", "rootdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error renaming root dir: %v", err)
-		}
-		err = client.Symlink("/", "rootdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error symlinking root dir: %v", err)
-		}
-		err = client.RemoveDirectory("/")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error removing root dir: %v", err)
-		}
-	}
-	httpd.RemoveUser(user, http.StatusOK)
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestRelativePaths(t *testing.T) {
-	user := getTestUser(true)
-	var path, rel string
-	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir())}
-	keyPrefix := strings.TrimPrefix(user.GetHomeDir(), "/") + "/"
-	s3config := vfs.S3FsConfig{
-		KeyPrefix: keyPrefix,
-	}
-	s3fs, _ := vfs.NewS3Fs("", user.GetHomeDir(), s3config)
-	gcsConfig := vfs.GCSFsConfig{
-		KeyPrefix: keyPrefix,
-	}
-	gcsfs, _ := vfs.NewGCSFs("", user.GetHomeDir(), gcsConfig)
-	if runtime.GOOS != "windows" {
-		filesystems = append(filesystems, s3fs, gcsfs)
-	}
-	for _, fs := range filesystems {
-		path = filepath.Join(user.HomeDir, "/")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
 		}
-		path = filepath.Join(user.HomeDir, "//")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
 		}
-		path = filepath.Join(user.HomeDir, "../..")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v path: %v fs: %v", rel, path, fs.Name())
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unexpected mkdir error: %v", err)
 		}
-		path = filepath.Join(user.HomeDir, "../../../../../")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		_, err = runSSHCommand("sftpgo-copy "+testFileName, user, usePubKey)
+		if err == nil {
+			t.Errorf("copy without a destination must fail")
 		}
-		path = filepath.Join(user.HomeDir, "/..")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v path: %v fs: %v", rel, path, fs.Name())
+		_, err = runSSHCommand("sftpgo-copy subdir "+testFileName+".copy", user, usePubKey)
+		if err == nil {
+			t.Errorf("copying a directory must fail")
 		}
-		path = filepath.Join(user.HomeDir, "/../../../..")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		_, err = runSSHCommand("sftpgo-copy "+testFileName+" "+testFileName+".denied", user, usePubKey)
+		if err == nil {
+			t.Errorf("copying to a denied file name must fail")
 		}
-		path = filepath.Join(user.HomeDir, "")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		_, err = runSSHCommand("sftpgo-copy "+testFileName+" "+testFileName+".copy", user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
 		}
-		path = filepath.Join(user.HomeDir, ".")
-		rel = fs.GetRelativePath(path)
-		if rel != "/" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		_, err = runSSHCommand("cp "+testFileName+" /subdir/", user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
 		}
-		path = filepath.Join(user.HomeDir, "somedir")
-		rel = fs.GetRelativePath(path)
-		if rel != "/somedir" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		info, err := client.Stat(path.Join("/subdir", testFileName))
+		if err != nil {
+			t.Errorf("copied file not found: %v", err)
+		} else if info.Size() != testFileSize {
+			t.Errorf("unexpected size for the copied file: %v", info.Size())
 		}
-		path = filepath.Join(user.HomeDir, "/somedir/subdir")
-		rel = fs.GetRelativePath(path)
-		if rel != "/somedir/subdir" {
-			t.Errorf("Unexpected relative path: %v fs: %v", rel, fs.Name())
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
 		}
-	}
-}
-
-func TestResolvePaths(t *testing.T) {
-	user := getTestUser(true)
-	var path, resolved string
-	var err error
-	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir())}
-	keyPrefix := strings.TrimPrefix(user.GetHomeDir(), "/") + "/"
-	s3config := vfs.S3FsConfig{
-		KeyPrefix: keyPrefix,
-	}
-	os.MkdirAll(user.GetHomeDir(), 0777)
-	s3fs, _ := vfs.NewS3Fs("", user.GetHomeDir(), s3config)
-	gcsConfig := vfs.GCSFsConfig{
-		KeyPrefix: keyPrefix,
-	}
-	gcsfs, _ := vfs.NewGCSFs("", user.GetHomeDir(), gcsConfig)
-	if runtime.GOOS != "windows" {
-		filesystems = append(filesystems, s3fs, gcsfs)
-	}
-	for _, fs := range filesystems {
-		path = "/"
-		resolved, _ = fs.ResolvePath(filepath.ToSlash(path))
-		if resolved != fs.Join(user.GetHomeDir(), "/") {
-			t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		if user.UsedQuotaFiles != 3 || user.UsedQuotaSize != 3*testFileSize {
+			t.Errorf("unexpected quota after copy, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-		path = "."
-		resolved, _ = fs.ResolvePath(filepath.ToSlash(path))
-		if resolved != fs.Join(user.GetHomeDir(), "/") {
-			t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		_, err = runSSHCommand("cp "+testFileName+" "+testFileName+".copy1", user, usePubKey)
+		if err == nil {
+			t.Errorf("copy must fail if the quota is exceeded")
 		}
-		path = "test/sub"
-		resolved, _ = fs.ResolvePath(filepath.ToSlash(path))
-		if resolved != fs.Join(user.GetHomeDir(), "/test/sub") {
-			t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		// overwriting an existing file does not need a new file in quota
+		_, err = runSSHCommand("cp "+testFileName+" "+testFileName+".copy", user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
 		}
-		path = "../test/sub"
-		resolved, err = fs.ResolvePath(filepath.ToSlash(path))
-		if vfs.IsLocalOsFs(fs) {
-			if err == nil {
-				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
-			}
-		} else {
-			if resolved != fs.Join(user.GetHomeDir(), "/test/sub") && err == nil {
-				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
-			}
+		// an hard link to the source is the same file, the source must not be truncated
+		err = os.Link(filepath.Join(user.GetHomeDir(), testFileName), filepath.Join(user.GetHomeDir(), testFileName+".link"))
+		if err != nil {
+			t.Errorf("unable to create hard link: %v", err)
 		}
-		path = "../../../test/../sub"
-		resolved, err = fs.ResolvePath(filepath.ToSlash(path))
-		if vfs.IsLocalOsFs(fs) {
-			if err == nil {
-				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
-			}
-		} else {
-			if resolved != fs.Join(user.GetHomeDir(), "/sub") && err == nil {
-				t.Errorf("Unexpected resolved path: %v for: %v, fs: %v", resolved, path, fs.Name())
+		_, err = runSSHCommand("cp "+testFileName+" "+testFileName+".link", user, usePubKey)
+		if err == nil {
+			t.Errorf("copying a file to an hard link to it must fail")
+		}
+		info, err = client.Stat(testFileName)
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		} else if info.Size() != testFileSize {
+			t.Errorf("the source file was modified, size: %v", info.Size())
+		}
+		// the contents are copied to temporary files, they must be renamed
+		files, err := ioutil.ReadDir(user.GetHomeDir())
+		if err != nil {
+			t.Errorf("unable to read home dir: %v", err)
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), ".sftpgo-upload.") {
+				t.Errorf("temporary file %#v not removed", f.Name())
 			}
 		}
+		user.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload}
+		_, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		_, err = runSSHCommand("cp "+testFileName+" "+testFileName+".copy", user, usePubKey)
+		if err == nil {
+			t.Errorf("overwriting a file without permission must fail")
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestUserPerms(t *testing.T) {
-	user := getTestUser(true)
-	user.Permissions = make(map[string][]string)
-	user.Permissions["/"] = []string{dataprovider.PermListItems}
-	user.Permissions["/p"] = []string{dataprovider.PermDelete}
-	user.Permissions["/p/1"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
-	user.Permissions["/p/2"] = []string{dataprovider.PermCreateDirs}
-	user.Permissions["/p/3"] = []string{dataprovider.PermChmod}
-	user.Permissions["/p/3/4"] = []string{dataprovider.PermChtimes}
-	user.Permissions["/tmp"] = []string{dataprovider.PermRename}
-	if !user.HasPerm(dataprovider.PermListItems, "/") {
-		t.Error("expected permission not found")
-	}
-	if !user.HasPerm(dataprovider.PermListItems, ".") {
-		t.Error("expected permission not found")
+func TestSSHDuAndHiddenFiles(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/nolist"] = []string{dataprovider.PermUpload}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:           "/",
+			DeniedPatterns: []string{"*.denied"},
+		},
 	}
-	if !user.HasPerm(dataprovider.PermListItems, "") {
-		t.Error("expected permission not found")
+	u.Filters.Trash.Enabled = true
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
 	}
-	if !user.HasPerm(dataprovider.PermListItems, "../") {
-		t.Error("expected permission not found")
+	for _, p := range []string{"file", ".hidden", "file.denied", filepath.Join("nolist", "file"),
+		filepath.Join("sub", "file"), filepath.Join(".sftpgo-trash", "entry", "file")} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(user.GetHomeDir(), p)), 0755)
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), p), []byte("test data"), 0666)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
 	}
-	// path p and /p are the same
-	if !user.HasPerm(dataprovider.PermDelete, "/p") {
-		t.Error("expected permission not found")
+	// the files inside the directories that cannot be listed, the denied files and the trash are excluded
+	out, err := runSSHCommand("du", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	if !user.HasPerm(dataprovider.PermDownload, "/p/1") {
-		t.Error("expected permission not found")
+	if !strings.Contains(string(out), "\t3 files\t/\n") {
+		t.Errorf("unexpected du output: %v", string(out))
 	}
-	if !user.HasPerm(dataprovider.PermCreateDirs, "p/2") {
-		t.Error("expected permission not found")
+	out, err = runSSHCommand("du sub", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	if !user.HasPerm(dataprovider.PermChmod, "/p/3") {
-		t.Error("expected permission not found")
+	if !strings.Contains(string(out), "\t1 files\t/sub\n") {
+		t.Errorf("unexpected du output: %v", string(out))
 	}
-	if !user.HasPerm(dataprovider.PermChtimes, "p/3/4/") {
-		t.Error("expected permission not found")
+	for _, p := range []string{"/nolist", "/.sftpgo-trash", "/file.denied"} {
+		_, err = runSSHCommand("du "+p, user, usePubKey)
+		if err == nil {
+			t.Errorf("du for %#v must fail", p)
+		}
 	}
-	if !user.HasPerm(dataprovider.PermChtimes, "p/3/4/../4") {
-		t.Error("expected permission not found")
+	out, err = runSSHCommand("ls", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	// undefined paths have permissions of the nearest path
-	if !user.HasPerm(dataprovider.PermListItems, "/p34") {
-		t.Error("expected permission not found")
+	if strings.Contains(string(out), ".hidden") || !strings.Contains(string(out), "file\n") {
+		t.Errorf("unexpected ls output: %v", string(out))
 	}
-	if !user.HasPerm(dataprovider.PermListItems, "/p34/p1/file.dat") {
-		t.Error("expected permission not found")
+	out, err = runSSHCommand("ls -la", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	if !user.HasPerm(dataprovider.PermChtimes, "/p/3/4/5/6") {
-		t.Error("expected permission not found")
+	if !strings.Contains(string(out), ".hidden\n") || strings.Contains(string(out), ".sftpgo-trash") {
+		t.Errorf("unexpected ls output: %v", string(out))
 	}
-	if !user.HasPerm(dataprovider.PermDownload, "/p/1/test/file.dat") {
-		t.Error("expected permission not found")
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
 	}
+	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestUserFiltersIPMaskConditions(t *testing.T) {
-	user := getTestUser(true)
-	// with no filter login must be allowed even if the remoteIP is invalid
-	if !user.IsLoginAllowed("192.168.1.5") {
-		t.Error("unexpected login denied")
-	}
-	if !user.IsLoginAllowed("invalid") {
-		t.Error("unexpected login denied")
-	}
-	user.Filters.DeniedIP = append(user.Filters.DeniedIP, "192.168.1.0/24")
-	if user.IsLoginAllowed("192.168.1.5") {
-		t.Error("unexpected login allowed")
+func TestSSHBuiltinCommands(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 10
+	u.Permissions["/denied"] = []string{dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
 	}
-	if !user.IsLoginAllowed("192.168.2.6") {
-		t.Error("unexpected login denied")
+	out, err := runSSHCommands([]string{"mkdir -p dir1/sub", "cd dir1", "pwd", "touch file1", "ls", "cp file1 sub/",
+		"stat sub/file1"}, user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	user.Filters.AllowedIP = append(user.Filters.AllowedIP, "192.168.1.5/32")
-	// if the same ip/mask is both denied and allowed then login must be denied
-	if user.IsLoginAllowed("192.168.1.5") {
-		t.Error("unexpected login allowed")
+	if !strings.Contains(string(out), "/dir1\n") {
+		t.Errorf("unexpected working directory: %v", string(out))
 	}
-	if user.IsLoginAllowed("192.168.3.6") {
-		t.Error("unexpected login allowed")
+	if !strings.Contains(string(out), "file1\nsub\n") {
+		t.Errorf("unexpected ls output: %v", string(out))
 	}
-	user.Filters.DeniedIP = []string{}
-	if !user.IsLoginAllowed("192.168.1.5") {
-		t.Error("unexpected login denied")
+	if !strings.Contains(string(out), "File: /dir1/sub/file1") {
+		t.Errorf("unexpected stat output: %v", string(out))
 	}
-	if user.IsLoginAllowed("192.168.1.6") {
-		t.Error("unexpected login allowed")
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir1", "sub", "file1"))
+	if err != nil {
+		t.Errorf("file not found: %v", err)
 	}
-	user.Filters.DeniedIP = []string{"192.168.0.0/16", "172.16.0.0/16"}
-	user.Filters.AllowedIP = []string{}
-	if user.IsLoginAllowed("192.168.5.255") {
-		t.Error("unexpected login allowed")
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("error getting user: %v", err)
 	}
-	if user.IsLoginAllowed("172.16.1.2") {
-		t.Error("unexpected login allowed")
+	if user.UsedQuotaFiles != 2 {
+		t.Errorf("unexpected quota files: %v", user.UsedQuotaFiles)
 	}
-	if !user.IsLoginAllowed("172.18.2.1") {
-		t.Error("unexpected login denied")
+	// the working directory is not shared between different connections
+	out, err = runSSHCommand("pwd", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	user.Filters.AllowedIP = []string{"10.4.4.0/24"}
-	if user.IsLoginAllowed("10.5.4.2") {
-		t.Error("unexpected login allowed")
+	if string(out) != "/\n" {
+		t.Errorf("invalid response for ssh pwd command: %v", string(out))
 	}
-	if !user.IsLoginAllowed("10.4.4.2") {
-		t.Error("unexpected login denied")
+	_, err = runSSHCommand("cd missing", user, usePubKey)
+	if err == nil {
+		t.Errorf("cd to a missing directory must fail")
 	}
-	if !user.IsLoginAllowed("invalid") {
-		t.Error("unexpected login denied")
+	_, err = runSSHCommand("cd /dir1/sub/file1", user, usePubKey)
+	if err == nil {
+		t.Errorf("cd to a file must fail")
 	}
-}
-
-func TestSSHCommands(t *testing.T) {
-	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "dir1", "file2"), []byte("test content"), 0666)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("unable to create test file: %v", err)
+	}
+	out, err = runSSHCommand("cat /dir1/file2", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	_, err = runSSHCommand("ls", user, usePubKey)
+	if string(out) != "test content" {
+		t.Errorf("unexpected cat output: %v", string(out))
+	}
+	_, err = runSSHCommand("cat /dir1", user, usePubKey)
 	if err == nil {
-		t.Errorf("unsupported ssh command must fail")
+		t.Errorf("cat for a directory must fail")
 	}
-	_, err = runSSHCommand("cd", user, usePubKey)
+	_, err = runSSHCommands([]string{"cd /dir1", "mv file2 sub", "rm sub"}, user, usePubKey)
+	if err == nil {
+		t.Errorf("rm for a directory without -r must fail")
+	}
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir1", "sub", "file2"))
 	if err != nil {
-		t.Errorf("unexpected error for ssh cd command: %v", err)
+		t.Errorf("renamed file not found: %v", err)
 	}
-	out, err := runSSHCommand("pwd", user, usePubKey)
+	out, err = runSSHCommand("du /dir1", user, usePubKey)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
-		t.Fail()
 	}
-	if string(out) != "/\n" {
-		t.Errorf("invalid response for ssh pwd command: %v", string(out))
+	if !strings.Contains(string(out), "3 files") {
+		t.Errorf("unexpected du output: %v", string(out))
 	}
-	out, err = runSSHCommand("md5sum", user, usePubKey)
+	out, err = runSSHCommand("df", user, usePubKey)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
-		t.Fail()
 	}
-	// echo -n '' | md5sum
-	if !strings.Contains(string(out), "d41d8cd98f00b204e9800998ecf8427e") {
-		t.Errorf("invalid md5sum: %v", string(out))
+	if !strings.Contains(string(out), "FAvail") {
+		t.Errorf("unexpected df output: %v", string(out))
 	}
-	out, err = runSSHCommand("sha1sum", user, usePubKey)
+	_, err = runSSHCommand("mkdir /denied/sub", user, usePubKey)
+	if err == nil {
+		t.Errorf("mkdir without permission must fail")
+	}
+	_, err = runSSHCommand("ls -z", user, usePubKey)
+	if err == nil {
+		t.Errorf("ls with an invalid option must fail")
+	}
+	_, err = runSSHCommand("rm -r /dir1", user, usePubKey)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
-		t.Fail()
 	}
-	if !strings.Contains(string(out), "da39a3ee5e6b4b0d3255bfef95601890afd80709") {
-		t.Errorf("invalid sha1sum: %v", string(out))
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir1"))
+	if !os.IsNotExist(err) {
+		t.Errorf("directory must be removed: %v", err)
 	}
-	out, err = runSSHCommand("sha256sum", user, usePubKey)
+	// the arguments are parsed as a shell does, so the names can contain spaces and quotes
+	out, err = runSSHCommands([]string{"mkdir 'dir with spaces'", `cd "dir with spaces"`, `touch it\'s "say \"hi\""`,
+		`cp "it's" 'copy of it'\''s'`, "ls"}, user, usePubKey)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
-		t.Fail()
 	}
-	if !strings.Contains(string(out), "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") {
-		t.Errorf("invalid sha256sum: %v", string(out))
+	if string(out) != "copy of it's\nit's\nsay \"hi\"\n" {
+		t.Errorf("unexpected ls output: %#v", string(out))
 	}
-	out, err = runSSHCommand("sha384sum", user, usePubKey)
+	for _, name := range []string{"it's", "copy of it's", `say "hi"`} {
+		_, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir with spaces", name))
+		if err != nil {
+			t.Errorf("file %#v not found: %v", name, err)
+		}
+	}
+	_, err = runSSHCommand(`rm -r dir\ with\ spaces`, user, usePubKey)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
-		t.Fail()
 	}
-	if !strings.Contains(string(out), "38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b") {
-		t.Errorf("invalid sha384sum: %v", string(out))
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir with spaces"))
+	if !os.IsNotExist(err) {
+		t.Errorf("directory must be removed: %v", err)
+	}
+	_, err = runSSHCommand("ls 'unterminated", user, usePubKey)
+	if err == nil {
+		t.Errorf("a command with an unterminated quote must fail")
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
+	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestSSHFileHash(t *testing.T) {
-	usePubKey := true
+func TestSSHShell(t *testing.T) {
+	usePubKey := false
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	out, err := runSSHShell("mkdir dir\ncd dir\npwd\ntouch file\nls\nuname\nexit\npwd\n", user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		user.Permissions = make(map[string][]string)
-		user.Permissions["/"] = []string{dataprovider.PermUpload}
-		_, _, err = httpd.UpdateUser(user, http.StatusOK)
-		if err != nil {
-			t.Errorf("unable to update user: %v", err)
-		}
-		_, err = runSSHCommand("sha512sum "+testFileName, user, usePubKey)
-		if err == nil {
-			t.Errorf("hash command with no list permission must fail")
-		}
-		user.Permissions["/"] = []string{dataprovider.PermAny}
-		_, _, err = httpd.UpdateUser(user, http.StatusOK)
-		if err != nil {
-			t.Errorf("unable to update user: %v", err)
-		}
-		initialHash, err := computeHashForFile(sha512.New(), testFilePath)
-		if err != nil {
-			t.Errorf("error computing file hash: %v", err)
-		}
-		out, err := runSSHCommand("sha512sum "+testFileName, user, usePubKey)
-		if err != nil {
-			t.Errorf("unexpected error: %v", err)
-			t.Fail()
-		}
-		if !strings.Contains(string(out), initialHash) {
-			t.Errorf("invalid sha512sum: %v", string(out))
-		}
-		_, err = runSSHCommand("sha512sum invalid_path", user, usePubKey)
-		if err == nil {
-			t.Errorf("hash for an invalid path must fail")
-		}
-		os.Remove(testFilePath)
+		t.Errorf("unexpected error: %v", err)
+	}
+	if string(out) != "/dir\nfile\nuname: command not found\n" {
+		t.Errorf("unexpected shell output: %#v", string(out))
+	}
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), "dir", "file"))
+	if err != nil {
+		t.Errorf("file not found: %v", err)
+	}
+	out, err = runSSHShell("mkdir 'dir 1'\nls\nls \"dir 1\nexit\n", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(out), "dir\ndir 1\n") || !strings.Contains(string(out), "closing quote") {
+		t.Errorf("unexpected shell output: %#v", string(out))
+	}
+	out, err = runSSHShell("cat missing\n", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(out), "cat: ") {
+		t.Errorf("unexpected shell output: %#v", string(out))
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -4230,6 +7405,27 @@ func TestSCPErrors(t *testing.T) {
 
 // End SCP tests
 
+func waitForReplication(t *testing.T, username string) {
+	for i := 0; i < 100; i++ {
+		status, _, err := httpd.GetReplicationStatus(http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get the replication status: %v", err)
+			return
+		}
+		pending := false
+		for _, s := range status {
+			if s.Username == username {
+				pending = true
+			}
+		}
+		if !pending {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("pending replication operations for user %#v", username)
+}
+
 func waitTCPListening(address string) {
 	for {
 		conn, err := net.Dial("tcp", address)
@@ -4298,6 +7494,232 @@ func runSSHCommand(command string, user dataprovider.User, usePubKey bool) ([]by
 	return stdout.Bytes(), err
 }
 
+// runSSHCommands executes the given commands, one per session, using the same connection
+func runSSHCommands(commands []string, user dataprovider.User, usePubKey bool) ([]byte, error) {
+	var output []byte
+	conn, err := getSSHConnection(user, usePubKey)
+	if err != nil {
+		return output, err
+	}
+	defer conn.Close()
+	for _, command := range commands {
+		sshSession, err := conn.NewSession()
+		if err != nil {
+			return output, err
+		}
+		var stdout, stderr bytes.Buffer
+		sshSession.Stdout = &stdout
+		sshSession.Stderr = &stderr
+		err = sshSession.Run(command)
+		sshSession.Close()
+		if err != nil {
+			return output, fmt.Errorf("failed to run command %v: %v", command, stderr.Bytes())
+		}
+		output = append(output, stdout.Bytes()...)
+	}
+	return output, nil
+}
+
+// runSSHShell sends the given input to an interactive shell session without a pty
+func runSSHShell(input string, user dataprovider.User, usePubKey bool) ([]byte, error) {
+	var output []byte
+	conn, err := getSSHConnection(user, usePubKey)
+	if err != nil {
+		return output, err
+	}
+	defer conn.Close()
+	sshSession, err := conn.NewSession()
+	if err != nil {
+		return output, err
+	}
+	defer sshSession.Close()
+	var stdout bytes.Buffer
+	sshSession.Stdin = strings.NewReader(input)
+	sshSession.Stdout = &stdout
+	err = sshSession.Shell()
+	if err != nil {
+		return output, err
+	}
+	err = sshSession.Wait()
+	return stdout.Bytes(), err
+}
+
+// rawSFTPSession allows to send SFTP packets not supported by the SFTP client
+type rawSFTPSession struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	nextID  uint32
+}
+
+func newRawSFTPSession(user dataprovider.User, usePubKey bool) (*rawSFTPSession, error) {
+	conn, err := getSSHConnection(user, usePubKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &rawSFTPSession{conn: conn}
+	s.session, err = conn.NewSession()
+	if err == nil {
+		s.stdin, err = s.session.StdinPipe()
+	}
+	if err == nil {
+		s.stdout, err = s.session.StdoutPipe()
+	}
+	if err == nil {
+		err = s.session.RequestSubsystem("sftp")
+	}
+	if err == nil {
+		// SSH_FXP_INIT, version 3
+		var packetType byte
+		packetType, _, err = s.exchangePacket(1, marshalSFTPUint32(nil, 3))
+		if err == nil && packetType != 2 {
+			err = fmt.Errorf("unexpected packet type %v, version expected", packetType)
+		}
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rawSFTPSession) exchangePacket(packetType byte, payload []byte) (byte, []byte, error) {
+	packet := marshalSFTPUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, packetType)
+	packet = append(packet, payload...)
+	if _, err := s.stdin.Write(packet); err != nil {
+		return 0, nil, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(s.stdout, header); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(s.stdout, data); err != nil {
+		return 0, nil, err
+	}
+	return data[0], data[1:], nil
+}
+
+// openFile opens the given file with the given SFTP open flags and returns the handle
+func (s *rawSFTPSession) openFile(name string, pflags uint32) (string, error) {
+	s.nextID++
+	payload := marshalSFTPString(marshalSFTPUint32(nil, s.nextID), name)
+	payload = marshalSFTPUint32(payload, pflags)
+	// no attributes
+	payload = marshalSFTPUint32(payload, 0)
+	packetType, data, err := s.exchangePacket(3, payload)
+	if err != nil {
+		return "", err
+	}
+	if packetType != 102 || len(data) < 8 {
+		return "", fmt.Errorf("unable to open %#v, response type: %v data: %v", name, packetType, data)
+	}
+	return string(data[8:]), nil
+}
+
+func (s *rawSFTPSession) closeHandle(handle string) error {
+	s.nextID++
+	return s.checkStatus(s.exchangePacket(4, marshalSFTPString(marshalSFTPUint32(nil, s.nextID), handle)))
+}
+
+func (s *rawSFTPSession) copyData(readHandle string, readOffset, length uint64, writeHandle string, writeOffset uint64) error {
+	s.nextID++
+	payload := marshalSFTPString(marshalSFTPUint32(nil, s.nextID), "copy-data")
+	payload = marshalSFTPString(payload, readHandle)
+	payload = marshalSFTPUint64(payload, readOffset)
+	payload = marshalSFTPUint64(payload, length)
+	payload = marshalSFTPString(payload, writeHandle)
+	payload = marshalSFTPUint64(payload, writeOffset)
+	return s.checkStatus(s.exchangePacket(200, payload))
+}
+
+// checkFile sends a check-file-name or check-file-handle request and returns the used algorithm and the hashes
+func (s *rawSFTPSession) checkFile(request, nameOrHandle, algorithms string, offset, length uint64,
+	blockSize uint32) (string, []byte, error) {
+	s.nextID++
+	payload := marshalSFTPString(marshalSFTPUint32(nil, s.nextID), request)
+	payload = marshalSFTPString(payload, nameOrHandle)
+	payload = marshalSFTPString(payload, algorithms)
+	payload = marshalSFTPUint64(payload, offset)
+	payload = marshalSFTPUint64(payload, length)
+	payload = marshalSFTPUint32(payload, blockSize)
+	packetType, data, err := s.exchangePacket(200, payload)
+	if err != nil {
+		return "", nil, err
+	}
+	if packetType != 201 {
+		return "", nil, s.checkStatus(packetType, data, nil)
+	}
+	// id, "check-file", algorithm, hashes
+	data = data[4:]
+	var fields []string
+	for i := 0; i < 2 && len(data) >= 4; i++ {
+		length := binary.BigEndian.Uint32(data)
+		if uint32(len(data)-4) < length {
+			break
+		}
+		fields = append(fields, string(data[4:4+length]))
+		data = data[4+length:]
+	}
+	if len(fields) != 2 || fields[0] != "check-file" {
+		return "", nil, fmt.Errorf("invalid check-file response: %v", fields)
+	}
+	return fields[1], data, nil
+}
+
+func (s *rawSFTPSession) checkStatus(packetType byte, data []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if packetType != 101 || len(data) < 8 {
+		return fmt.Errorf("unexpected response, type: %v data: %v", packetType, data)
+	}
+	if code := binary.BigEndian.Uint32(data[4:]); code != 0 {
+		return fmt.Errorf("unexpected status code: %v", code)
+	}
+	return nil
+}
+
+func (s *rawSFTPSession) Close() {
+	if s.session != nil {
+		s.session.Close()
+	}
+	s.conn.Close()
+}
+
+func marshalSFTPUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func marshalSFTPUint64(b []byte, v uint64) []byte {
+	return marshalSFTPUint32(marshalSFTPUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func marshalSFTPString(b []byte, v string) []byte {
+	return append(marshalSFTPUint32(b, uint32(len(v))), v...)
+}
+
+func getSSHConnection(user dataprovider.User, usePubKey bool) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+	}
+	if usePubKey {
+		key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(key)}
+	} else {
+		config.Auth = []ssh.AuthMethod{ssh.Password(defaultPassword)}
+	}
+	return ssh.Dial("tcp", sftpServerAddr, config)
+}
+
 func getSftpClient(user dataprovider.User, usePubKey bool) (*sftp.Client, error) {
 	var sftpClient *sftp.Client
 	config := &ssh.ClientConfig{
@@ -4348,6 +7770,34 @@ func getKeyboardInteractiveSftpClient(user dataprovider.User, answers []string)
 	return sftpClient, err
 }
 
+func checkTieringStatus(t *testing.T, username string, expectedFiles int, expectedSize int64) {
+	status, _, err := httpd.GetTieringStatus(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get tiering status: %v", err)
+		return
+	}
+	for _, s := range status {
+		if s.Username == username {
+			if s.TieredFiles != expectedFiles || s.TieredSize != expectedSize {
+				t.Errorf("unexpected tiering status, expected files: %v size: %v, actual: %+v", expectedFiles,
+					expectedSize, s)
+			}
+			return
+		}
+	}
+	t.Errorf("tiering status not found for user %#v", username)
+}
+
+func checkColdTierFiles(t *testing.T, coldPath string, expectedFiles int) {
+	files, err := ioutil.ReadDir(coldPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Errorf("unable to read the cold tier: %v", err)
+	}
+	if len(files) != expectedFiles {
+		t.Errorf("unexpected number of files inside the cold tier: %v, expected: %v", len(files), expectedFiles)
+	}
+}
+
 func createTestFile(path string, size int64) error {
 	baseDir := filepath.Dir(path)
 	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
@@ -4458,6 +7908,41 @@ func sftpUploadResumeFile(localSourcePath string, remoteDestPath string, expecte
 	return err
 }
 
+// interruptS3Upload starts uploading localSourcePath and closes the connection
+// after the specified size is uploaded to S3, the upload will be resumable
+func interruptS3Upload(user dataprovider.User, usePubKey bool, localSourcePath, remoteDestPath string, size int64) error {
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	data, err := ioutil.ReadFile(localSourcePath)
+	if err != nil {
+		return err
+	}
+	destFile, err := client.Create(remoteDestPath)
+	if err != nil {
+		return err
+	}
+	// the last part is not completed and so it will be discarded
+	_, err = destFile.Write(data[:size+1024])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 200; i++ {
+		fi, err := client.Stat(remoteDestPath)
+		if err == nil && fi.Size() == size {
+			for _, stat := range sftpd.GetConnectionsStats() {
+				sftpd.CloseActiveConnection(stat.ConnectionID)
+			}
+			waitForNoActiveTransfer()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timeout waiting for %v bytes to be uploaded", size)
+}
+
 func sftpDownloadFile(remoteSourcePath string, localDestPath string, expectedSize int64, client *sftp.Client) error {
 	downloadDest, err := os.Create(localDestPath)
 	if err != nil {
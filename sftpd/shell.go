@@ -0,0 +1,679 @@
+package sftpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/metrics"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+const (
+	// name to add to the enabled SSH commands to allow interactive shell sessions
+	shellSSHCommand = "shell"
+	// maximum size for the files printed using cat
+	maxCatFileSize = 1048576
+	// SFTP attributes flag for access and modification times
+	sftpAttrACModTime = 0x00000008
+)
+
+var (
+	// commands implemented inside SFTPGo that can be executed using SSH exec requests and
+	// inside the restricted shell, the copy commands are available in the shell too
+	shellCommands     = []string{"cd", "pwd", "ls", "mkdir", "rm", "mv", "du", "df", "stat", "cat", "touch"}
+	errMissingOperand = errors.New("missing operand")
+	errIsADirectory   = errors.New("is a directory")
+	errNotADirectory  = errors.New("not a directory")
+)
+
+// sshWorkingDir is the current directory for an SSH connection.
+// It is shared by all the channels opened inside the connection
+type sshWorkingDir struct {
+	sync.RWMutex
+	path string
+}
+
+func (c Connection) getWorkingDir() string {
+	if c.workingDir == nil {
+		return "/"
+	}
+	c.workingDir.RLock()
+	defer c.workingDir.RUnlock()
+	return c.workingDir.path
+}
+
+func (c Connection) setWorkingDir(sshPath string) {
+	if c.workingDir == nil {
+		return
+	}
+	c.workingDir.Lock()
+	defer c.workingDir.Unlock()
+	c.workingDir.path = sshPath
+}
+
+// getSSHPath returns the SFTP path for an SSH command argument.
+// Relative paths are resolved from the working directory
+func (c Connection) getSSHPath(name string) string {
+	name = filepath.ToSlash(name)
+	if !path.IsAbs(name) {
+		name = path.Join(c.getWorkingDir(), name)
+	}
+	return path.Clean(name)
+}
+
+// shellCommand executes the built-in commands. The commands use the SFTP handlers
+// so permissions, quotas, file name filters, retention policies and actions apply
+type shellCommand struct {
+	connection Connection
+	out        io.Writer
+}
+
+func (s *shellCommand) execute(name string, args []string) error {
+	updateConnectionActivity(s.connection.ID)
+	var err error
+	switch name {
+	case "cd":
+		err = s.cd(args)
+	case "pwd":
+		_, err = fmt.Fprintf(s.out, "%v\n", s.connection.getWorkingDir())
+	case "ls":
+		err = s.ls(args)
+	case "mkdir":
+		err = s.mkdir(args)
+	case "rm":
+		err = s.rm(args)
+	case "mv":
+		err = s.mv(args)
+	case "du":
+		err = s.du(args)
+	case "df":
+		err = s.df(args)
+	case "stat":
+		err = s.stat(args)
+	case "cat":
+		err = s.cat(args)
+	case "touch":
+		err = s.touch(args)
+	case "cp", "sftpgo-copy":
+		if len(args) != 2 {
+			return errCopyUsage
+		}
+		err = s.connection.copyFile(s.connection.getSSHPath(args[0]), s.connection.getSSHPath(args[1]))
+	default:
+		err = fmt.Errorf("unsupported command %#v", name)
+	}
+	if err == sftp.ErrSSHFxOk {
+		return nil
+	}
+	return err
+}
+
+// parseArgs splits the given arguments in options and paths
+func parseArgs(args []string, allowedOptions ...string) (map[string]bool, []string, error) {
+	options := make(map[string]bool)
+	var paths []string
+	for _, arg := range args {
+		if len(arg) > 1 && strings.HasPrefix(arg, "-") {
+			for _, opt := range arg[1:] {
+				if !utils.IsStringInSlice(string(opt), allowedOptions) {
+					return options, paths, fmt.Errorf("invalid option -- '%v'", string(opt))
+				}
+				options[string(opt)] = true
+			}
+			continue
+		}
+		paths = append(paths, arg)
+	}
+	return options, paths, nil
+}
+
+func (s *shellCommand) stat(args []string) error {
+	if len(args) == 0 {
+		return errMissingOperand
+	}
+	for _, arg := range args {
+		info, err := s.statPath(s.connection.getSSHPath(arg))
+		if err != nil {
+			return err
+		}
+		fileType := "regular file"
+		if info.IsDir() {
+			fileType = "directory"
+		} else if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			fileType = "symbolic link"
+		}
+		fmt.Fprintf(s.out, "  File: %v\n  Size: %v\n  Type: %v\n  Mode: %v\nModify: %v\n", s.connection.getSSHPath(arg),
+			info.Size(), fileType, info.Mode(), info.ModTime().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *shellCommand) statPath(sshPath string) (os.FileInfo, error) {
+	lister, err := s.connection.Filelist(sftp.NewRequest("Stat", sshPath))
+	if err != nil {
+		return nil, err
+	}
+	files, err := readAllFiles(lister)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return files[0], nil
+}
+
+func (s *shellCommand) listDir(sshPath string) ([]os.FileInfo, error) {
+	lister, err := s.connection.Filelist(sftp.NewRequest("List", sshPath))
+	if err != nil {
+		return nil, err
+	}
+	return readAllFiles(lister)
+}
+
+func (s *shellCommand) cd(args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	sshPath := "/"
+	if len(args) == 1 {
+		sshPath = s.connection.getSSHPath(args[0])
+	}
+	if sshPath != "/" {
+		if !s.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		fs, p, err := s.connection.getFsAndResolvedPath(sshPath)
+		if err != nil {
+			return vfs.GetSFTPError(fs, err)
+		}
+		info, err := fs.Stat(p)
+		if err != nil {
+			return vfs.GetSFTPError(fs, err)
+		}
+		if !info.IsDir() {
+			return errNotADirectory
+		}
+	}
+	s.connection.setWorkingDir(sshPath)
+	return nil
+}
+
+func (s *shellCommand) ls(args []string) error {
+	options, paths, err := parseArgs(args, "l", "a")
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{s.connection.getWorkingDir()}
+	}
+	for idx, p := range paths {
+		sshPath := s.connection.getSSHPath(p)
+		info, err := s.statPath(sshPath)
+		if err != nil {
+			return err
+		}
+		files := []os.FileInfo{info}
+		if info.IsDir() {
+			files, err = s.listDir(sshPath)
+			if err != nil {
+				return err
+			}
+			if len(paths) > 1 {
+				if idx > 0 {
+					fmt.Fprintln(s.out)
+				}
+				fmt.Fprintf(s.out, "%v:\n", sshPath)
+			}
+		}
+		for _, fi := range files {
+			// hidden files are listed only if requested, as for the system command
+			if info.IsDir() && !options["a"] && strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			if options["l"] {
+				fmt.Fprintf(s.out, "%v %12d %v %v\n", fi.Mode(), fi.Size(), fi.ModTime().Format("Jan _2 15:04"), fi.Name())
+			} else {
+				fmt.Fprintf(s.out, "%v\n", fi.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (s *shellCommand) mkdir(args []string) error {
+	options, paths, err := parseArgs(args, "p")
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return errMissingOperand
+	}
+	for _, p := range paths {
+		sshPath := s.connection.getSSHPath(p)
+		if !options["p"] {
+			if err = s.connection.Filecmd(sftp.NewRequest("Mkdir", sshPath)); err != sftp.ErrSSHFxOk {
+				return err
+			}
+			continue
+		}
+		dirs := []string{}
+		for dir := sshPath; dir != "/"; dir = path.Dir(dir) {
+			dirs = append([]string{dir}, dirs...)
+		}
+		for _, dir := range dirs {
+			if info, err := s.statPath(dir); err == nil {
+				if !info.IsDir() {
+					return fmt.Errorf("%#v: %v", dir, errNotADirectory)
+				}
+				continue
+			}
+			if err = s.connection.Filecmd(sftp.NewRequest("Mkdir", dir)); err != sftp.ErrSSHFxOk {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *shellCommand) rm(args []string) error {
+	options, paths, err := parseArgs(args, "r", "R", "f")
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return errMissingOperand
+	}
+	recursive := options["r"] || options["R"]
+	for _, p := range paths {
+		sshPath := s.connection.getSSHPath(p)
+		info, err := s.statPath(sshPath)
+		if err != nil {
+			if options["f"] && err == sftp.ErrSSHFxNoSuchFile {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			if !recursive {
+				return fmt.Errorf("%#v: %v", sshPath, errIsADirectory)
+			}
+			err = s.removeDir(sshPath)
+		} else {
+			err = s.connection.Filecmd(sftp.NewRequest("Remove", sshPath))
+		}
+		if err != nil && err != sftp.ErrSSHFxOk {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDir removes a directory and its contents, files and directories are removed one by one
+// as for SFTP requests
+func (s *shellCommand) removeDir(sshPath string) error {
+	files, err := s.listDir(sshPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		childPath := path.Join(sshPath, fi.Name())
+		if fi.IsDir() {
+			err = s.removeDir(childPath)
+		} else {
+			err = s.connection.Filecmd(sftp.NewRequest("Remove", childPath))
+		}
+		if err != nil && err != sftp.ErrSSHFxOk {
+			return err
+		}
+	}
+	return s.connection.Filecmd(sftp.NewRequest("Rmdir", sshPath))
+}
+
+func (s *shellCommand) mv(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: mv <source> <destination>")
+	}
+	source := s.connection.getSSHPath(args[0])
+	target := s.connection.getSSHPath(args[1])
+	if info, err := s.statPath(target); err == nil && info.IsDir() {
+		target = path.Join(target, path.Base(source))
+	}
+	request := sftp.NewRequest("Rename", source)
+	request.Target = target
+	return s.connection.Filecmd(request)
+}
+
+func (s *shellCommand) du(args []string) error {
+	if len(args) == 0 {
+		args = []string{s.connection.getWorkingDir()}
+	}
+	for _, arg := range args {
+		sshPath := s.connection.getSSHPath(arg)
+		if s.connection.User.Filters.Trash.Enabled && isTrashPath(sshPath) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		if !s.connection.isFileAllowed(sshPath) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		info, err := s.statPath(sshPath)
+		if err != nil {
+			return err
+		}
+		var numFiles int
+		var size int64
+		if info.IsDir() {
+			numFiles, size, err = s.getDirUsage(sshPath)
+			if err != nil {
+				return err
+			}
+		} else if info.Mode().IsRegular() {
+			numFiles = 1
+			size = info.Size()
+		}
+		fmt.Fprintf(s.out, "%v\t%v files\t%v\n", utils.ByteCountSI(size), numFiles, sshPath)
+	}
+	return nil
+}
+
+// getDirUsage returns the number of files and their size for the given directory and its subdirectories.
+// The directories are listed as for SFTP requests, so the directories that cannot be listed, the denied
+// files and the trash are not included
+func (s *shellCommand) getDirUsage(sshPath string) (int, int64, error) {
+	files, err := s.listDir(sshPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var numFiles int
+	var size int64
+	for _, fi := range files {
+		if fi.IsDir() {
+			dirFiles, dirSize, err := s.getDirUsage(path.Join(sshPath, fi.Name()))
+			if err == sftp.ErrSSHFxPermissionDenied {
+				continue
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			numFiles += dirFiles
+			size += dirSize
+		} else if fi.Mode().IsRegular() {
+			numFiles++
+			size += fi.Size()
+		}
+	}
+	return numFiles, size, nil
+}
+
+func (s *shellCommand) df(args []string) error {
+	sshPath := s.connection.getWorkingDir()
+	if len(args) > 0 {
+		sshPath = s.connection.getSSHPath(args[0])
+	}
+	if !s.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	fs, p, err := s.connection.getFsAndResolvedPath(sshPath)
+	if err != nil {
+		return vfs.GetSFTPError(fs, err)
+	}
+	quotaFiles, quotaSize, usedFiles, usedSize, err := s.connection.getQuotaUsage(sshPath)
+	if err != nil {
+		return err
+	}
+	var fsStat *sftp.StatVFS
+	if vfs.IsLocalOsFs(fs) {
+		fsStat, _ = getStatVFS(p)
+	}
+	size, used, avail := "-", "-", "-"
+	if quotaSize > 0 {
+		size = utils.ByteCountSI(quotaSize)
+		used = utils.ByteCountSI(usedSize)
+		avail = utils.ByteCountSI(0)
+		if usedSize < quotaSize {
+			avail = utils.ByteCountSI(quotaSize - usedSize)
+		}
+	} else if fsStat != nil {
+		size = utils.ByteCountSI(int64(fsStat.TotalSpace()))
+		used = utils.ByteCountSI(int64(fsStat.TotalSpace() - fsStat.FreeSpace()))
+		avail = utils.ByteCountSI(int64(fsStat.Bavail * fsStat.Frsize))
+	}
+	files, filesUsed, filesAvail := "-", "-", "-"
+	if quotaFiles > 0 {
+		files = fmt.Sprintf("%v", quotaFiles)
+		filesUsed = fmt.Sprintf("%v", usedFiles)
+		filesAvail = "0"
+		if usedFiles < quotaFiles {
+			filesAvail = fmt.Sprintf("%v", quotaFiles-usedFiles)
+		}
+	}
+	fmt.Fprintf(s.out, "%-10v %-10v %-10v %-10v %-10v %-10v %v\n", "Size", "Used", "Avail", "Files", "FUsed", "FAvail",
+		"Path")
+	fmt.Fprintf(s.out, "%-10v %-10v %-10v %-10v %-10v %-10v %v\n", size, used, avail, files, filesUsed, filesAvail, sshPath)
+	return nil
+}
+
+func (s *shellCommand) cat(args []string) error {
+	if len(args) == 0 {
+		return errMissingOperand
+	}
+	for _, arg := range args {
+		sshPath := s.connection.getSSHPath(arg)
+		fs, p, err := s.connection.getFsAndResolvedPath(sshPath)
+		if err != nil {
+			return vfs.GetSFTPError(fs, err)
+		}
+		info, err := fs.Stat(p)
+		if err != nil {
+			return vfs.GetSFTPError(fs, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%#v: %v", sshPath, errIsADirectory)
+		}
+		if info.Size() > maxCatFileSize {
+			return fmt.Errorf("%#v: file too big, the maximum allowed size is %v", sshPath,
+				utils.ByteCountSI(maxCatFileSize))
+		}
+		reader, err := s.connection.Fileread(sftp.NewRequest("Get", sshPath))
+		if err != nil {
+			return err
+		}
+		transfer := reader.(*Transfer)
+		_, err = io.Copy(s.out, io.NewSectionReader(transfer, 0, info.Size()))
+		if errClose := transfer.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shellCommand) touch(args []string) error {
+	if len(args) == 0 {
+		return errMissingOperand
+	}
+	for _, arg := range args {
+		sshPath := s.connection.getSSHPath(arg)
+		if _, err := s.statPath(sshPath); err == nil {
+			now := uint32(time.Now().Unix())
+			attrs := make([]byte, 8)
+			binary.BigEndian.PutUint32(attrs, now)
+			binary.BigEndian.PutUint32(attrs[4:], now)
+			request := sftp.NewRequest("Setstat", sshPath)
+			request.Flags = sftpAttrACModTime
+			request.Attrs = attrs
+			if err = s.connection.Filecmd(request); err != sftp.ErrSSHFxOk {
+				return err
+			}
+			continue
+		} else if err != sftp.ErrSSHFxNoSuchFile {
+			return err
+		}
+		writer, err := s.connection.Filewrite(sftp.NewRequest("Put", sshPath))
+		if err != nil {
+			return err
+		}
+		if err = writer.(*Transfer).Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAllFiles(lister sftp.ListerAt) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	buf := make([]os.FileInfo, 100)
+	for {
+		n, err := lister.ListAt(buf, int64(len(result)))
+		result = append(result, buf[:n]...)
+		if err == io.EOF || (err == nil && n == 0) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *sshCommand) handleShellCommand() error {
+	cmd := shellCommand{
+		connection: c.connection,
+		out:        c.connection.channel,
+	}
+	if err := cmd.execute(c.command, c.args); err != nil {
+		return c.sendErrorResponse(err)
+	}
+	c.sendExitStatus(nil)
+	return nil
+}
+
+// restrictedShell is an interactive session that can only execute the enabled built-in commands
+type restrictedShell struct {
+	connection      Connection
+	enabledCommands []string
+	usePty          bool
+}
+
+func processShellRequest(connection *Connection, channel ssh.Channel, usePty bool, enabledSSHCommands []string) bool {
+	if !utils.IsStringInSlice(shellSSHCommand, enabledSSHCommands) {
+		connection.Log(logger.LevelInfo, logSenderSSH, "interactive shell not enabled")
+		return false
+	}
+	connection.protocol = protocolSSH
+	connection.channel = channel
+	connection.command = shellSSHCommand
+	shell := restrictedShell{
+		connection:      *connection,
+		enabledCommands: enabledSSHCommands,
+		usePty:          usePty,
+	}
+	go shell.serve()
+	return true
+}
+
+func (s *restrictedShell) serve() {
+	addConnection(s.connection)
+	defer removeConnection(s.connection)
+	s.connection.Log(logger.LevelDebug, logSenderSSH, "interactive shell started, pty: %v", s.usePty)
+
+	var out io.Writer = s.connection.channel
+	var terminal *term.Terminal
+	var scanner *bufio.Scanner
+	if s.usePty {
+		terminal = term.NewTerminal(s.connection.channel, s.getPrompt())
+		out = terminal
+	} else {
+		scanner = bufio.NewScanner(s.connection.channel)
+	}
+	for {
+		var line string
+		if terminal != nil {
+			var err error
+			if line, err = terminal.ReadLine(); err != nil {
+				break
+			}
+		} else {
+			if !scanner.Scan() {
+				break
+			}
+			line = scanner.Text()
+		}
+		fields, err := shlex.Split(line)
+		if err != nil {
+			fmt.Fprintf(out, "%v\n", err)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		name, args := fields[0], fields[1:]
+		if name == "exit" || name == "logout" {
+			break
+		}
+		s.executeCommand(name, args, line, out)
+		if terminal != nil {
+			terminal.SetPrompt(s.getPrompt())
+		}
+	}
+	exitStatus := sshSubsystemExitStatus{
+		Status: 0,
+	}
+	s.connection.channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatus))
+	s.connection.channel.Close()
+	s.connection.Log(logger.LevelDebug, logSenderSSH, "interactive shell ended")
+}
+
+func (s *restrictedShell) executeCommand(name string, args []string, line string, out io.Writer) {
+	if !s.isCommandAllowed(name) {
+		fmt.Fprintf(out, "%v: command not found\n", name)
+		return
+	}
+	cmd := shellCommand{
+		connection: s.connection,
+		out:        out,
+	}
+	err := cmd.execute(name, args)
+	metrics.SSHCommandCompleted(err)
+	if err != nil {
+		fmt.Fprintf(out, "%v: %v\n", name, err)
+		s.connection.Log(logger.LevelWarn, logSenderSSH, "command failed: %#v args: %v user: %v err: %v",
+			name, args, s.connection.User.Username, err)
+		return
+	}
+	logger.CommandLog(sshCommandLogSender, s.connection.getWorkingDir(), "", s.connection.User.Username, "",
+		s.connection.ID, protocolSSH, -1, -1, "", "", line)
+	fs, p, err := s.connection.getFsAndResolvedPath(s.connection.getWorkingDir())
+	if err == nil {
+		go executeAction(operationSSHCmd, s.connection.User.Username, p, "", name, 0, vfs.IsLocalOsFs(fs))
+	}
+}
+
+func (s *restrictedShell) isCommandAllowed(name string) bool {
+	if !utils.IsStringInSlice(name, s.enabledCommands) {
+		return false
+	}
+	return utils.IsStringInSlice(name, shellCommands) || utils.IsStringInSlice(name, copySSHCommands)
+}
+
+func (s *restrictedShell) getPrompt() string {
+	return fmt.Sprintf("%v:%v$ ", s.connection.User.Username, s.connection.getWorkingDir())
+}
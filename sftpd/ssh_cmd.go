@@ -11,7 +11,6 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -22,6 +21,7 @@ import (
 	"github.com/freshvolk/sftpgo/metrics"
 	"github.com/freshvolk/sftpgo/utils"
 	"github.com/freshvolk/sftpgo/vfs"
+	"github.com/google/shlex"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -29,6 +29,7 @@ var (
 	errQuotaExceeded     = errors.New("denying write due to space limit")
 	errPermissionDenied  = errors.New("Permission denied. You don't have the permissions to execute this command")
 	errUnsupportedConfig = errors.New("command unsupported for this configuration")
+	errEmptyCommand      = errors.New("empty command")
 )
 
 type sshCommand struct {
@@ -92,19 +93,23 @@ func (c *sshCommand) handle() error {
 			return c.sendErrorResponse(err)
 		}
 		return c.executeSystemCommand(command)
-	} else if c.command == "cd" {
-		c.sendExitStatus(nil)
-	} else if c.command == "pwd" {
-		// hard coded response to "/"
-		c.connection.channel.Write([]byte("/\n"))
-		c.sendExitStatus(nil)
+	} else if utils.IsStringInSlice(c.command, copySSHCommands) {
+		return c.handleSFTPGoCopy()
+	} else if utils.IsStringInSlice(c.command, shellCommands) {
+		return c.handleShellCommand()
 	}
 	return nil
 }
 
 func (c *sshCommand) handleHashCommands() error {
-	if !vfs.IsLocalOsFs(c.connection.fs) {
-		return c.sendErrorResponse(errUnsupportedConfig)
+	fs := c.connection.fs
+	var fsPath string
+	if len(c.args) > 0 {
+		var err error
+		fs, fsPath, err = c.connection.getFsAndResolvedPath(c.getDestPath())
+		if err != nil {
+			return c.sendErrorResponse(err)
+		}
 	}
 	var h hash.Hash
 	if c.command == "md5sum" {
@@ -130,14 +135,13 @@ func (c *sshCommand) handleHashCommands() error {
 		response = fmt.Sprintf("%x  -\n", h.Sum(nil))
 	} else {
 		sshPath := c.getDestPath()
-		fsPath, err := c.connection.fs.ResolvePath(sshPath)
-		if err != nil {
-			return c.sendErrorResponse(err)
-		}
 		if !c.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
 			return c.sendErrorResponse(errPermissionDenied)
 		}
-		hash, err := computeHashForFile(h, fsPath)
+		if !c.connection.isFileAllowed(sshPath) {
+			return c.sendErrorResponse(errPermissionDenied)
+		}
+		hash, err := computeHashForFile(fs, h, fsPath)
 		if err != nil {
 			return c.sendErrorResponse(err)
 		}
@@ -152,9 +156,44 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 	if !vfs.IsLocalOsFs(c.connection.fs) {
 		return c.sendErrorResponse(errUnsupportedConfig)
 	}
+	// system commands work on the local filesystem and so they cannot handle virtual folders
+	sshDestPath := c.getDestPath()
+	if _, err := c.connection.User.GetVirtualFolderForPath(sshDestPath); err == nil ||
+		c.connection.User.HasVirtualFoldersInside(sshDestPath) {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	// system commands delete the files directly bypassing the trash
+	if c.connection.User.Filters.Trash.Enabled {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	// system commands modify the files directly and so the changes cannot be replicated
+	if c.connection.User.Filters.Replication.Enabled {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	// system commands can modify or remove the files locked by a retention policy
+	if c.connection.User.HasRetentionPoliciesFor(sshDestPath) {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	// system commands cannot apply the file patterns filters to the files they transfer
+	if c.connection.User.HasFilePatternsFor(sshDestPath) {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	// system commands cannot limit the size of the single files they write
+	if c.connection.getMaxUploadFileSize() > 0 {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
 	if c.connection.User.QuotaFiles > 0 && c.connection.User.UsedQuotaFiles > c.connection.User.QuotaFiles {
 		return c.sendErrorResponse(errQuotaExceeded)
 	}
+	// the data flows in both directions for the system commands, so both limits are required
+	_, err := c.connection.getRemainingTransferQuota(transferUpload)
+	if err != nil {
+		return c.sendErrorResponse(err)
+	}
+	_, err = c.connection.getRemainingTransferQuota(transferDownload)
+	if err != nil {
+		return c.sendErrorResponse(err)
+	}
 	perms := []string{dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermCreateDirs, dataprovider.PermListItems,
 		dataprovider.PermOverwrite, dataprovider.PermDelete, dataprovider.PermRename}
 	if !c.connection.User.HasPerms(perms, c.getDestPath()) {
@@ -196,6 +235,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 		transfer := Transfer{
 			file:           nil,
 			path:           command.realPath,
+			requestPath:    sshDestPath,
 			start:          time.Now(),
 			bytesSent:      0,
 			bytesReceived:  0,
@@ -224,6 +264,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 		transfer := Transfer{
 			file:           nil,
 			path:           command.realPath,
+			requestPath:    sshDestPath,
 			start:          time.Now(),
 			bytesSent:      0,
 			bytesReceived:  0,
@@ -253,6 +294,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 		transfer := Transfer{
 			file:           nil,
 			path:           command.realPath,
+			requestPath:    sshDestPath,
 			start:          time.Now(),
 			bytesSent:      0,
 			bytesReceived:  0,
@@ -332,20 +374,26 @@ func (c *sshCommand) getSystemCommand() (systemCommand, error) {
 
 func (c *sshCommand) rescanHomeDir() error {
 	quotaTracking := dataprovider.GetQuotaTracking()
-	if (!c.connection.User.HasQuotaRestrictions() && quotaTracking == 2) || quotaTracking == 0 {
+	if (!c.connection.User.HasQuotaRestrictions() && len(c.connection.User.Filters.DirQuotas) == 0 && quotaTracking == 2) ||
+		quotaTracking == 0 {
 		return nil
 	}
 	var err error
 	var numFiles int
 	var size int64
 	if AddQuotaScan(c.connection.User.Username) {
-		numFiles, size, err = c.connection.fs.ScanRootDirContents()
+		numFiles, size, err = ScanUserQuota(c.connection.User.Username, c.connection.fs, false)
 		if err != nil {
 			c.connection.Log(logger.LevelWarn, logSenderSSH, "error scanning user home dir %#v: %v", c.connection.User.HomeDir, err)
 		} else {
 			err := dataprovider.UpdateUserQuota(dataProvider, c.connection.User, numFiles, size, true)
 			c.connection.Log(logger.LevelDebug, logSenderSSH, "user home dir scanned, user: %#v, dir: %#v, error: %v",
 				c.connection.User.Username, c.connection.User.HomeDir, err)
+			err = ScanUserDirQuotas(c.connection.User, c.connection.fs)
+			if err != nil {
+				c.connection.Log(logger.LevelWarn, logSenderSSH, "error scanning directory quotas for user %#v: %v",
+					c.connection.User.Username, err)
+			}
 		}
 		RemoveQuotaScan(c.connection.User.Username)
 	}
@@ -357,13 +405,8 @@ func (c *sshCommand) getDestPath() string {
 	if len(c.args) == 0 {
 		return ""
 	}
-	destPath := strings.Trim(c.args[len(c.args)-1], "'")
-	destPath = strings.Trim(destPath, "\"")
-	destPath = filepath.ToSlash(destPath)
-	if !path.IsAbs(destPath) {
-		destPath = "/" + destPath
-	}
-	result := path.Clean(destPath)
+	destPath := filepath.ToSlash(c.args[len(c.args)-1])
+	result := c.connection.getSSHPath(destPath)
 	if strings.HasSuffix(destPath, "/") && !strings.HasSuffix(result, "/") {
 		result += "/"
 	}
@@ -396,34 +439,54 @@ func (c *sshCommand) sendExitStatus(err error) {
 	// for scp we notify single uploads/downloads
 	if err == nil && c.command != "scp" {
 		realPath := c.getDestPath()
+		fs := c.connection.fs
 		if len(realPath) > 0 {
-			p, err := c.connection.fs.ResolvePath(realPath)
+			var p string
+			fs, p, err = c.connection.getFsAndResolvedPath(realPath)
 			if err == nil {
 				realPath = p
 			}
 		}
-		go executeAction(operationSSHCmd, c.connection.User.Username, realPath, "", c.command, 0, vfs.IsLocalOsFs(c.connection.fs))
+		go executeAction(operationSSHCmd, c.connection.User.Username, realPath, "", c.command, 0, vfs.IsLocalOsFs(fs))
 	}
 }
 
-func computeHashForFile(hasher hash.Hash, path string) (string, error) {
+// computeHashForFile reads the file using the given Fs, so the hash can be
+// computed for any storage backend
+func computeHashForFile(fs vfs.Fs, hasher hash.Hash, path string) (string, error) {
 	hash := ""
-	f, err := os.Open(path)
+	info, err := fs.Stat(path)
 	if err != nil {
 		return hash, err
 	}
-	defer f.Close()
-	_, err = io.Copy(hasher, f)
+	if info.IsDir() {
+		return hash, fmt.Errorf("%#v is a directory", fs.GetRelativePath(path))
+	}
+	file, r, cancelFn, err := fs.Open(path)
+	if err != nil {
+		return hash, err
+	}
+	var reader io.ReadCloser = file
+	if file == nil {
+		reader = r
+	}
+	defer reader.Close()
+	_, err = io.Copy(hasher, reader)
 	if err == nil {
 		hash = fmt.Sprintf("%x", hasher.Sum(nil))
+	} else if cancelFn != nil {
+		cancelFn()
 	}
 	return hash, err
 }
 
 func parseCommandPayload(command string) (string, []string, error) {
-	parts := strings.Split(command, " ")
-	if len(parts) < 2 {
-		return parts[0], []string{}, nil
+	parts, err := shlex.Split(command)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(parts) == 0 {
+		return "", nil, errEmptyCommand
 	}
 	return parts[0], parts[1:], nil
 }
@@ -0,0 +1,11 @@
+// +build !linux
+
+package sftpd
+
+import (
+	"github.com/pkg/sftp"
+)
+
+func getStatVFS(name string) (*sftp.StatVFS, error) {
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
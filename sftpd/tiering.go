@@ -0,0 +1,174 @@
+package sftpd
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+const (
+	tieringLogSender = "Tiering"
+	tieringPeriod    = 1 * time.Hour
+)
+
+var (
+	tieringTicker *time.Ticker
+	// the tiering runs are serialized
+	tieringMutex     sync.Mutex
+	tieringRuns      = make(map[string]tieringRun)
+	tieringRunsMutex sync.RWMutex
+)
+
+// tieringRun defines the results of the last tiering run for a user
+type tieringRun struct {
+	time  time.Time
+	files int
+	size  int64
+	err   error
+}
+
+// TieringStatus defines the tiering statistics for a user with tiering enabled
+type TieringStatus struct {
+	Username string `json:"username"`
+	// number of files currently stored inside the cold tier
+	TieredFiles int `json:"tiered_files"`
+	// size of the files currently stored inside the cold tier
+	TieredSize int64 `json:"tiered_size"`
+	// last run of the tiering job as unix timestamp in milliseconds, 0 if it never ran since startup
+	LastRun int64 `json:"last_run"`
+	// number of files moved to the cold tier in the last run
+	LastRunFiles int `json:"last_run_files"`
+	// size of the files moved to the cold tier in the last run
+	LastRunSize int64 `json:"last_run_size"`
+	// error for the last run, if any
+	LastError string `json:"last_error,omitempty"`
+}
+
+// configureTiering sets the directory for the tiering metadata and starts the
+// tiering job. An empty path disables the tiering
+func configureTiering(statePath string) error {
+	if err := vfs.SetTieringStateDir(statePath); err != nil {
+		return err
+	}
+	if len(statePath) > 0 && tieringTicker == nil {
+		tieringTicker = time.NewTicker(tieringPeriod)
+		go func() {
+			for t := range tieringTicker.C {
+				logger.Debug(tieringLogSender, "", "tiering ticker %v", t)
+				RunTiering()
+			}
+		}()
+	}
+	return nil
+}
+
+// RunTiering moves to the cold tier the files not accessed since the days configured
+// for each user with tiering enabled
+func RunTiering() {
+	tieringMutex.Lock()
+	defer tieringMutex.Unlock()
+
+	limit := 100
+	tieredFiles := 0
+	tieredSize := int64(0)
+	for offset := 0; ; offset += limit {
+		users, err := dataprovider.GetUsers(dataProvider, limit, offset, "ASC", "")
+		if err != nil {
+			logger.Warn(tieringLogSender, "", "unable to get users for tiering: %v", err)
+			break
+		}
+		for _, u := range users {
+			if !u.Filters.Tiering.Enabled {
+				continue
+			}
+			// users are returned without credentials
+			user, err := dataprovider.UserExists(dataProvider, u.Username)
+			if err != nil {
+				continue
+			}
+			run := tieringRun{
+				time: time.Now(),
+			}
+			run.files, run.size, run.err = tierUserFiles(user)
+			if run.err != nil {
+				logger.Warn(tieringLogSender, "", "unable to move the cold files to the cold tier for user %#v: %v",
+					user.Username, run.err)
+			}
+			tieringRunsMutex.Lock()
+			tieringRuns[user.Username] = run
+			tieringRunsMutex.Unlock()
+			tieredFiles += run.files
+			tieredSize += run.size
+		}
+		if len(users) < limit {
+			break
+		}
+	}
+	if tieredFiles > 0 {
+		logger.Info(tieringLogSender, "", "tiering done, files moved to the cold tier: %v, size: %v", tieredFiles,
+			tieredSize)
+	}
+}
+
+func tierUserFiles(user dataprovider.User) (int, int64, error) {
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fs.Close()
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	tieredFs, ok := fs.(*vfs.TieredFs)
+	if !ok {
+		return 0, 0, errors.New("tiering is not supported for this filesystem")
+	}
+	coldBefore := time.Now().Add(-time.Duration(user.Filters.Tiering.Days) * 24 * time.Hour)
+	return tieredFs.TierColdFiles(coldBefore)
+}
+
+// GetTieringStatus returns the tiering statistics for the users with tiering enabled
+func GetTieringStatus() ([]TieringStatus, error) {
+	status := []TieringStatus{}
+	limit := 100
+	for offset := 0; ; offset += limit {
+		users, err := dataprovider.GetUsers(dataProvider, limit, offset, "ASC", "")
+		if err != nil {
+			return status, err
+		}
+		for _, u := range users {
+			if !u.Filters.Tiering.Enabled {
+				continue
+			}
+			s := TieringStatus{
+				Username: u.Username,
+			}
+			s.TieredFiles, s.TieredSize, err = vfs.GetTieringUsage(u.Username)
+			if err != nil {
+				return status, err
+			}
+			tieringRunsMutex.RLock()
+			if run, ok := tieringRuns[u.Username]; ok {
+				s.LastRun = utils.GetTimeAsMsSinceEpoch(run.time)
+				s.LastRunFiles = run.files
+				s.LastRunSize = run.size
+				if run.err != nil {
+					s.LastError = run.err.Error()
+				}
+			}
+			tieringRunsMutex.RUnlock()
+			status = append(status, s)
+		}
+		if len(users) < limit {
+			break
+		}
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Username < status[j].Username
+	})
+	return status, nil
+}
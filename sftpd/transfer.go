@@ -11,7 +11,9 @@ import (
 	"github.com/freshvolk/sftpgo/dataprovider"
 	"github.com/freshvolk/sftpgo/logger"
 	"github.com/freshvolk/sftpgo/metrics"
+	"github.com/freshvolk/sftpgo/vfs"
 	"github.com/eikenb/pipeat"
+	"github.com/pkg/sftp"
 )
 
 const (
@@ -28,9 +30,10 @@ var (
 type Transfer struct {
 	file           *os.File
 	writerAt       *pipeat.PipeWriterAt
-	readerAt       *pipeat.PipeReaderAt
+	readerAt       vfs.FileReader
 	cancelFn       func()
 	path           string
+	requestPath    string
 	start          time.Time
 	bytesSent      int64
 	bytesReceived  int64
@@ -45,7 +48,19 @@ type Transfer struct {
 	minWriteOffset int64
 	expectedSize   int64
 	initialSize    int64
-	lock           *sync.Mutex
+	// tracker for the data transferred by the user's active transfers, nil if there is no transfer quota
+	transferQuota *transferQuotaTracker
+	// data transferred for each transfer quota period, they are added to the used transfer quota when
+	// the transfer ends, and the tracker generation they belong to
+	transferQuotaUsage      []transferQuotaPeriodUsage
+	transferQuotaGeneration int
+	// maximum size allowed for the uploaded file, 0 means unlimited
+	maxWriteSize int64
+	// resolved SFTP path and retention period, as number of days, for an upload inside a
+	// retention directory. The retain until time is stored when the upload ends
+	retentionPath string
+	retentionDays int
+	lock         *sync.Mutex
 }
 
 // TransferError is called if there is an unexpected error.
@@ -78,6 +93,9 @@ func (t *Transfer) ReadAt(p []byte, off int64) (n int, err error) {
 	}
 	t.lock.Lock()
 	t.bytesSent += int64(readed)
+	if err := t.checkTransferQuota(int64(readed)); err != nil && (e == nil || e == io.EOF) {
+		e = err
+	}
 	t.lock.Unlock()
 	if e != nil && e != io.EOF {
 		t.TransferError(e)
@@ -96,15 +114,23 @@ func (t *Transfer) WriteAt(p []byte, off int64) (n int, err error) {
 		t.TransferError(err)
 		return 0, err
 	}
+	if err := t.checkUploadFileSize(off, len(p)); err != nil {
+		t.TransferError(err)
+		return 0, err
+	}
 	var written int
 	var e error
 	if t.writerAt != nil {
-		written, e = t.writerAt.WriteAt(p, off)
+		// for resumed uploads the pipe receives only the data to append
+		written, e = t.writerAt.WriteAt(p, off-t.minWriteOffset)
 	} else {
 		written, e = t.file.WriteAt(p, off)
 	}
 	t.lock.Lock()
 	t.bytesReceived += int64(written)
+	if err := t.checkTransferQuota(int64(written)); err != nil && e == nil {
+		e = err
+	}
 	t.lock.Unlock()
 	if e != nil {
 		t.TransferError(e)
@@ -114,6 +140,21 @@ func (t *Transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	return written, e
 }
 
+// Sync commits the data written so far to stable storage, it is called by pkg/sftp
+// for the fsync@openssh.com requests on this transfer's handle.
+// This is only supported for local files
+func (t *Transfer) Sync() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isFinished {
+		return errTransferClosed
+	}
+	if t.file == nil {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return t.file.Sync()
+}
+
 // Close it is called when the transfer is completed.
 // It closes the underlying file, logs the transfer info, updates the user quota (for uploads)
 // and executes any defined action.
@@ -133,11 +174,16 @@ func (t *Transfer) Close() error {
 	}
 	t.checkDownloadSize()
 	metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, t.transferError)
+	t.updateTransferQuota()
+	// the local files are written in place, while the remote ones are stored only if the upload succeeds
+	isStored := t.file != nil || (err == nil && t.transferError == nil)
 	if t.transferType == transferUpload && t.file != nil && t.file.Name() != t.path {
+		isStored = false
 		if t.transferError == nil || uploadMode == uploadModeAtomicWithResume {
 			err = os.Rename(t.file.Name(), t.path)
 			logger.Debug(logSender, t.connectionID, "atomic upload completed, rename: %#v -> %#v, error: %v",
 				t.file.Name(), t.path, err)
+			isStored = err == nil
 		} else {
 			err = os.Remove(t.file.Name())
 			logger.Warn(logSender, t.connectionID, "atomic upload completed with error: \"%v\", delete temporary file: %#v, "+
@@ -148,6 +194,9 @@ func (t *Transfer) Close() error {
 			}
 		}
 	}
+	if t.transferType == transferUpload && t.retentionDays > 0 && isStored {
+		updateRetainUntil(t.user, t.retentionPath, t.retentionDays, t.connectionID)
+	}
 	if t.transferError == nil {
 		elapsed := time.Since(t.start).Nanoseconds() / 1000000
 		if t.transferType == transferDownload {
@@ -155,10 +204,15 @@ func (t *Transfer) Close() error {
 			go executeAction(operationDownload, t.user.Username, t.path, "", "", t.bytesSent, (t.file != nil))
 		} else {
 			logger.TransferLog(uploadLogSender, t.path, elapsed, t.bytesReceived, t.user.Username, t.connectionID, t.protocol)
+			enqueueReplication(t.user, replicationOpSync, t.requestPath, "")
 			go executeAction(operationUpload, t.user.Username, t.path, "", "", t.bytesReceived+t.minWriteOffset, (t.file != nil))
 		}
 	} else {
 		logger.Warn(logSender, t.connectionID, "transfer error: %v, path: %#v", t.transferError, t.path)
+		if t.transferError == errUploadFileSizeExceeded {
+			go executeAction(operationUploadSizeExceeded, t.user.Username, t.path, "", "", t.bytesReceived+t.minWriteOffset,
+				(t.file != nil))
+		}
 		if err == nil {
 			err = t.transferError
 		}
@@ -172,6 +226,13 @@ func (t *Transfer) closeIO() error {
 	var err error
 	if t.writerAt != nil {
 		err = t.writerAt.Close()
+		// the pipe reader is closed with the error returned by the storage backend, if any
+		if readErr := t.writerAt.WaitForReader(); readErr != nil && readErr != io.EOF {
+			if t.transferError == nil {
+				t.transferError = readErr
+			}
+			err = readErr
+		}
 	} else if t.readerAt != nil {
 		err = t.readerAt.Close()
 	} else {
@@ -186,7 +247,7 @@ func (t *Transfer) updateQuota(numFiles int) bool {
 		return false
 	}
 	if t.transferType == transferUpload && (numFiles != 0 || t.bytesReceived > 0) {
-		dataprovider.UpdateUserQuota(dataProvider, t.user, numFiles, t.bytesReceived-t.initialSize, false)
+		updateUserOrFolderQuota(t.user, t.requestPath, numFiles, t.bytesReceived-t.initialSize)
 		return true
 	}
 	return false
@@ -242,10 +303,15 @@ func (t *Transfer) copyFromReaderToWriter(dst io.Writer, src io.Reader, maxWrite
 				} else {
 					t.bytesReceived = written
 				}
+				quotaErr := t.checkTransferQuota(int64(nw))
 				if maxWriteSize > 0 && written > maxWriteSize {
 					err = errQuotaExceeded
 					break
 				}
+				if quotaErr != nil {
+					err = quotaErr
+					break
+				}
 			}
 			if ew != nil {
 				err = ew
@@ -268,5 +334,6 @@ func (t *Transfer) copyFromReaderToWriter(dst io.Writer, src io.Reader, maxWrite
 	if t.bytesSent > 0 || t.bytesReceived > 0 || err != nil {
 		metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, t.transferError)
 	}
+	t.updateTransferQuota()
 	return written, err
 }
@@ -0,0 +1,278 @@
+package sftpd
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+)
+
+var (
+	errTransferQuotaExceeded = errors.New("denying transfer due to transfer quota limit")
+	transferQuotaTrackers    = make(map[string]*transferQuotaTracker)
+	transferQuotaMutex       sync.Mutex
+)
+
+// transferQuotaTracker tracks the data transferred by a user in the current period. It is shared
+// by all the active transfers for the user, so the limits are checked while the data is transferred.
+// The used transfer quota is loaded from the data provider when the first transfer starts and the
+// tracker is removed when the last transfer ends. The data provider is updated when each transfer ends
+type transferQuotaTracker struct {
+	sync.Mutex
+	usage dataprovider.TransferQuotaUsage
+	refs  int
+	// incremented each time the used transfer quota is reset, the data transferred by the
+	// active transfers before a reset are not added to the used transfer quota
+	generation int
+}
+
+// transferQuotaPeriodUsage defines the data transferred by a transfer within a transfer quota period
+type transferQuotaPeriodUsage struct {
+	periodStart int64
+	uploaded    int64
+	downloaded  int64
+}
+
+// getUsage returns the usage for the current period. The limits are the given ones, they could
+// be changed while the transfers are running
+func (t *transferQuotaTracker) getUsage(quota dataprovider.TransferQuota) dataprovider.TransferQuotaUsage {
+	t.Lock()
+	defer t.Unlock()
+	t.checkPeriod(quota, quota.GetPeriodStart(time.Now()))
+	return t.usage
+}
+
+// add adds the bytes transferred in the period starting at periodStart and returns errTransferQuotaExceeded
+// if the limit is exceeded. The current generation is returned too
+func (t *transferQuotaTracker) add(transferType int, size int64, quota dataprovider.TransferQuota,
+	periodStart int64) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.checkPeriod(quota, periodStart)
+	if periodStart < t.usage.PeriodStart {
+		// the data belong to a previous period
+		return t.generation, nil
+	}
+	if transferType == transferUpload {
+		t.usage.UsedUploadSize += size
+		if t.usage.UploadSize > 0 && t.usage.UsedUploadSize > t.usage.UploadSize {
+			return t.generation, errTransferQuotaExceeded
+		}
+	} else {
+		t.usage.UsedDownloadSize += size
+		if t.usage.DownloadSize > 0 && t.usage.UsedDownloadSize > t.usage.DownloadSize {
+			return t.generation, errTransferQuotaExceeded
+		}
+	}
+	return t.generation, nil
+}
+
+// reset clears the usage for the current period and starts a new generation
+func (t *transferQuotaTracker) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.usage.PeriodStart = t.usage.TransferQuota.GetPeriodStart(time.Now())
+	t.usage.UsedUploadSize = 0
+	t.usage.UsedDownloadSize = 0
+	t.generation++
+}
+
+func (t *transferQuotaTracker) getGeneration() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.generation
+}
+
+func (t *transferQuotaTracker) checkPeriod(quota dataprovider.TransferQuota, periodStart int64) {
+	t.usage.TransferQuota = quota
+	if periodStart > t.usage.PeriodStart {
+		t.usage.PeriodStart = periodStart
+		t.usage.UsedUploadSize = 0
+		t.usage.UsedDownloadSize = 0
+	}
+}
+
+// ResetTransferQuota resets the used transfer quota tracked for the active transfers of the given user.
+// The data transferred so far by these transfers are not added to the used transfer quota when they end.
+// It must be called before resetting the used transfer quota stored inside the data provider
+func ResetTransferQuota(username string) {
+	if tracker := getTransferQuotaTracker(username, false); tracker != nil {
+		tracker.reset()
+	}
+}
+
+// acquireTransferQuotaTracker returns the transfer quota tracker for the given user, creating it if needed.
+// nil is returned if the transfer quota is disabled or cannot be enforced
+func acquireTransferQuotaTracker(user dataprovider.User) *transferQuotaTracker {
+	if !user.Filters.TransferQuota.IsEnabled() {
+		return nil
+	}
+	if tracker := getTransferQuotaTracker(user.Username, true); tracker != nil {
+		return tracker
+	}
+	usage, err := dataprovider.GetTransferQuotaUsage(dataProvider, user)
+	if err != nil {
+		return nil
+	}
+	transferQuotaMutex.Lock()
+	defer transferQuotaMutex.Unlock()
+	// another transfer could be started while we were reading the usage from the data provider
+	if tracker, ok := transferQuotaTrackers[user.Username]; ok {
+		tracker.refs++
+		return tracker
+	}
+	tracker := &transferQuotaTracker{
+		usage: usage,
+		refs:  1,
+	}
+	transferQuotaTrackers[user.Username] = tracker
+	return tracker
+}
+
+func getTransferQuotaTracker(username string, acquire bool) *transferQuotaTracker {
+	transferQuotaMutex.Lock()
+	defer transferQuotaMutex.Unlock()
+	tracker, ok := transferQuotaTrackers[username]
+	if !ok {
+		return nil
+	}
+	if acquire {
+		tracker.refs++
+	}
+	return tracker
+}
+
+func releaseTransferQuotaTracker(username string, tracker *transferQuotaTracker) {
+	if tracker == nil {
+		return
+	}
+	transferQuotaMutex.Lock()
+	defer transferQuotaMutex.Unlock()
+	tracker.refs--
+	if tracker.refs <= 0 && transferQuotaTrackers[username] == tracker {
+		delete(transferQuotaTrackers, username)
+	}
+}
+
+// getRemainingTransferQuota returns the bytes that the user can still transfer, for the given
+// transfer type, in the current period. 0 means unlimited.
+// If the user has active transfers the usage, including the data they transferred so far, is
+// read from their shared tracker, otherwise from the data provider
+func (c Connection) getRemainingTransferQuota(transferType int) (int64, error) {
+	if !c.User.Filters.TransferQuota.IsEnabled() {
+		return 0, nil
+	}
+	var usage dataprovider.TransferQuotaUsage
+	if tracker := getTransferQuotaTracker(c.User.Username, false); tracker != nil {
+		usage = tracker.getUsage(c.User.Filters.TransferQuota)
+	} else {
+		var err error
+		usage, err = dataprovider.GetTransferQuotaUsage(dataProvider, c.User)
+		if err != nil {
+			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+				c.Log(logger.LevelWarn, logSender, "transfer quota enforcement not possible for user %#v: %v", c.User.Username, err)
+				return 0, nil
+			}
+			c.Log(logger.LevelWarn, logSender, "error getting used transfer quota for %#v: %v", c.User.Username, err)
+			return 0, err
+		}
+	}
+	var remaining int64
+	if transferType == transferUpload {
+		remaining = usage.GetRemainingUpload()
+	} else {
+		remaining = usage.GetRemainingDownload()
+	}
+	if remaining < 0 {
+		c.Log(logger.LevelDebug, logSender, "transfer quota exceeded for user %#v, upload: %v/%v, download: %v/%v",
+			c.User.Username, usage.UsedUploadSize, usage.UploadSize, usage.UsedDownloadSize, usage.DownloadSize)
+		return 0, errTransferQuotaExceeded
+	}
+	return remaining, nil
+}
+
+// checkServerSideTransferQuota returns an error if the user cannot download and upload the given size.
+// The server side copies read and write the data without a transfer, they are charged as both
+func (c Connection) checkServerSideTransferQuota(size int64) error {
+	for _, transferType := range []int{transferDownload, transferUpload} {
+		remaining, err := c.getRemainingTransferQuota(transferType)
+		if err != nil {
+			return err
+		}
+		if remaining > 0 && size > remaining {
+			c.Log(logger.LevelDebug, logSender, "transfer quota exceeded for user %#v, size: %v remaining: %v",
+				c.User.Username, size, remaining)
+			return errTransferQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// updateServerSideTransferQuota charges the data copied server side to the user's transfer quota,
+// the active transfers see the new usage too
+func (c Connection) updateServerSideTransferQuota(size int64) {
+	if !c.User.Filters.TransferQuota.IsEnabled() || size <= 0 {
+		return
+	}
+	periodStart := c.User.Filters.TransferQuota.GetPeriodStart(time.Now())
+	if tracker := getTransferQuotaTracker(c.User.Username, true); tracker != nil {
+		tracker.add(transferUpload, size, c.User.Filters.TransferQuota, periodStart)   //nolint:errcheck
+		tracker.add(transferDownload, size, c.User.Filters.TransferQuota, periodStart) //nolint:errcheck
+		releaseTransferQuotaTracker(c.User.Username, tracker)
+	}
+	err := dataprovider.UpdateTransferQuota(dataProvider, c.User, size, size, periodStart, false)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to update the used transfer quota for user %#v, size: %v, error: %v",
+			c.User.Username, size, err)
+	}
+}
+
+// checkTransferQuota records the given transferred bytes for the current period, adds them to the
+// user's shared tracker and returns an error if the transfer quota is exceeded
+func (t *Transfer) checkTransferQuota(size int64) error {
+	if !t.user.Filters.TransferQuota.IsEnabled() || size <= 0 {
+		return nil
+	}
+	periodStart := t.user.Filters.TransferQuota.GetPeriodStart(time.Now())
+	var err error
+	if t.transferQuota != nil {
+		var generation int
+		generation, err = t.transferQuota.add(t.transferType, size, t.user.Filters.TransferQuota, periodStart)
+		if generation != t.transferQuotaGeneration {
+			// the used transfer quota was reset, the data transferred before are not counted
+			t.transferQuotaUsage = nil
+			t.transferQuotaGeneration = generation
+		}
+	}
+	last := len(t.transferQuotaUsage) - 1
+	if last < 0 || t.transferQuotaUsage[last].periodStart != periodStart {
+		t.transferQuotaUsage = append(t.transferQuotaUsage, transferQuotaPeriodUsage{periodStart: periodStart})
+		last++
+	}
+	if t.transferType == transferUpload {
+		t.transferQuotaUsage[last].uploaded += size
+	} else {
+		t.transferQuotaUsage[last].downloaded += size
+	}
+	return err
+}
+
+// updateTransferQuota adds the transferred bytes to the user's used transfer quota, for the
+// period in which they were transferred
+func (t *Transfer) updateTransferQuota() {
+	if t.transferQuota != nil && t.transferQuota.getGeneration() != t.transferQuotaGeneration {
+		// the used transfer quota was reset after the last transferred data
+		t.transferQuotaUsage = nil
+	}
+	for _, usage := range t.transferQuotaUsage {
+		err := dataprovider.UpdateTransferQuota(dataProvider, t.user, usage.uploaded, usage.downloaded,
+			usage.periodStart, false)
+		if err != nil {
+			logger.Warn(logSender, t.connectionID, "unable to update the used transfer quota for user %#v, uploaded: %v "+
+				"downloaded: %v, error: %v", t.user.Username, usage.uploaded, usage.downloaded, err)
+		}
+	}
+	t.transferQuotaUsage = nil
+}
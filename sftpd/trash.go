@@ -0,0 +1,416 @@
+package sftpd
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freshvolk/sftpgo/dataprovider"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/freshvolk/sftpgo/vfs"
+)
+
+const (
+	// the trash is a hidden directory inside the user's home. Each deleted item is stored
+	// as "<trash dir>/<deletion time as unix nanoseconds>/<original path>", so we can
+	// restore it without keeping any additional metadata
+	trashDirPath       = "/.sftpgo-trash"
+	trashLogSender     = "Trash"
+	trashCleanupPeriod = 1 * time.Hour
+)
+
+var (
+	// ErrTrashDisabled is returned for trash operations on users without the trash enabled
+	ErrTrashDisabled = errors.New("the trash is not enabled for this user")
+	// ErrTrashEntryNotFound is returned if the requested trash entry does not exist
+	ErrTrashEntryNotFound = errors.New("trash entry not found")
+	// ErrTrashRestoreConflict is returned if a trash entry cannot be restored because
+	// its original path is already in use
+	ErrTrashRestoreConflict = errors.New("the original path already exists or it is inside a virtual folder")
+	trashCleanupTicker      *time.Ticker
+)
+
+// TrashEntry defines a deleted file or directory stored inside a user's trash
+type TrashEntry struct {
+	// unique identifier for the entry inside the user's trash
+	ID string `json:"id"`
+	// original path for the deleted item
+	Path string `json:"path"`
+	// deletion time as unix timestamp in milliseconds
+	DeletionTime int64 `json:"deletion_time"`
+	// file size, 0 for directories
+	Size  int64 `json:"size"`
+	IsDir bool  `json:"is_dir"`
+	// filesystem path for the trashed item
+	fsPath    string
+	isSymlink bool
+}
+
+// isRegularFile returns true if the entry must be included in quota calculations
+func (e *TrashEntry) isRegularFile() bool {
+	return !e.IsDir && !e.isSymlink
+}
+
+// isTrashPath returns true if the given SFTP path is the trash directory or it is inside it
+func isTrashPath(sftpPath string) bool {
+	p := path.Clean("/" + sftpPath)
+	return p == trashDirPath || strings.HasPrefix(p, trashDirPath+"/")
+}
+
+// hideTrashDir removes the trash directory from the given root directory listing
+func hideTrashDir(files []os.FileInfo, requestPath string) []os.FileInfo {
+	if path.Clean("/"+requestPath) != "/" {
+		return files
+	}
+	result := files[:0]
+	for _, fi := range files {
+		if fi.Name() != path.Base(trashDirPath) {
+			result = append(result, fi)
+		}
+	}
+	return result
+}
+
+// moveToTrash moves the item with the given filesystem and SFTP paths inside the user's trash
+func moveToTrash(fs vfs.Fs, user dataprovider.User, fsPath, sftpPath string) error {
+	entryID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	entryPath := path.Join(trashDirPath, entryID, path.Clean("/"+sftpPath))
+	if err := createMissingDirs(fs, user, path.Dir(entryPath)); err != nil {
+		return err
+	}
+	target, err := fs.ResolvePath(entryPath)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(fsPath, target)
+}
+
+// createMissingDirs creates the given SFTP directory and any missing parent
+func createMissingDirs(fs vfs.Fs, user dataprovider.User, dirPath string) error {
+	var dirs []string
+	for p := path.Clean("/" + dirPath); p != "/"; p = path.Dir(p) {
+		dirs = append(dirs, p)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fsPath, err := fs.ResolvePath(dirs[i])
+		if err != nil {
+			return err
+		}
+		_, err = fs.Stat(fsPath)
+		if err == nil {
+			continue
+		}
+		if !fs.IsNotExist(err) {
+			return err
+		}
+		if err = fs.Mkdir(fsPath); err != nil {
+			return err
+		}
+		vfs.SetPathPermissions(fs, fsPath, user.GetUID(), user.GetGID())
+	}
+	return nil
+}
+
+// removeAll removes the given path and any children it contains
+func removeAll(fs vfs.Fs, fsPath string) error {
+	fi, err := fs.Lstat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	isDir := fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink
+	if isDir {
+		contents, err := fs.ReadDir(fsPath)
+		if err != nil {
+			return err
+		}
+		for _, child := range contents {
+			if err = removeAll(fs, fs.Join(fsPath, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err = fs.Remove(fsPath, isDir); err != nil && !fs.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func getTrashDir(fs vfs.Fs) (string, error) {
+	return fs.ResolvePath(trashDirPath)
+}
+
+// getTrashEntry returns the entry with the given ID. The original path is found
+// walking the trash entry directory, each level contains a single item
+func getTrashEntry(fs vfs.Fs, entryID string) (TrashEntry, error) {
+	entry := TrashEntry{
+		ID:    entryID,
+		IsDir: true,
+	}
+	deletionTime, err := strconv.ParseInt(entryID, 10, 64)
+	if err != nil || deletionTime <= 0 {
+		return entry, ErrTrashEntryNotFound
+	}
+	entry.DeletionTime = utils.GetTimeAsMsSinceEpoch(time.Unix(0, deletionTime))
+	trashDir, err := getTrashDir(fs)
+	if err != nil {
+		return entry, err
+	}
+	entry.fsPath = fs.Join(trashDir, entryID)
+	if _, err = fs.Stat(entry.fsPath); err != nil {
+		if fs.IsNotExist(err) {
+			return entry, ErrTrashEntryNotFound
+		}
+		return entry, err
+	}
+	entryPath := "/"
+	for {
+		contents, err := fs.ReadDir(entry.fsPath)
+		if err != nil {
+			return entry, err
+		}
+		if len(contents) != 1 {
+			break
+		}
+		child := contents[0]
+		entryPath = path.Join(entryPath, child.Name())
+		entry.fsPath = fs.Join(entry.fsPath, child.Name())
+		if !child.IsDir() || child.Mode()&os.ModeSymlink == os.ModeSymlink {
+			entry.IsDir = false
+			entry.isSymlink = child.Mode()&os.ModeSymlink == os.ModeSymlink
+			entry.Size = child.Size()
+			break
+		}
+	}
+	if entryPath == "/" {
+		return entry, ErrTrashEntryNotFound
+	}
+	entry.Path = entryPath
+	return entry, nil
+}
+
+func getTrashEntries(fs vfs.Fs) ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+	trashDir, err := getTrashDir(fs)
+	if err != nil {
+		return entries, err
+	}
+	contents, err := fs.ReadDir(trashDir)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, err
+	}
+	for _, fi := range contents {
+		entry, err := getTrashEntry(fs, fi.Name())
+		if err != nil {
+			logger.Warn(trashLogSender, fs.ConnectionID(), "skipping invalid trash entry %#v: %v", fi.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func purgeTrashEntry(fs vfs.Fs, user dataprovider.User, entry TrashEntry) error {
+	trashDir, err := getTrashDir(fs)
+	if err != nil {
+		return err
+	}
+	if err = removeAll(fs, fs.Join(trashDir, entry.ID)); err != nil {
+		logger.Warn(trashLogSender, "", "unable to purge trash entry %#v for user %#v: %v", entry.ID, user.Username, err)
+		return err
+	}
+	logger.Debug(trashLogSender, "", "trash entry %#v purged for user %#v, path: %#v", entry.ID, user.Username, entry.Path)
+	if user.Filters.Trash.CountInQuota && entry.isRegularFile() {
+		dataprovider.UpdateUserQuota(dataProvider, user, -1, -entry.Size, false)
+	}
+	return nil
+}
+
+func getTrashFilesystem(user dataprovider.User) (vfs.Fs, error) {
+	if !user.Filters.Trash.Enabled {
+		return nil, ErrTrashDisabled
+	}
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		return fs, err
+	}
+	// the home dir is created on the first login, as for a login we create it if missing
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	return fs, nil
+}
+
+// GetTrashEntries returns the items inside the given user's trash
+func GetTrashEntries(user dataprovider.User) ([]TrashEntry, error) {
+	fs, err := getTrashFilesystem(user)
+	if err != nil {
+		return []TrashEntry{}, err
+	}
+	defer fs.Close()
+	return getTrashEntries(fs)
+}
+
+// RestoreTrashEntry moves the trash entry with the given ID back to its original path
+func RestoreTrashEntry(user dataprovider.User, entryID string) error {
+	fs, err := getTrashFilesystem(user)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	entry, err := getTrashEntry(fs, entryID)
+	if err != nil {
+		return err
+	}
+	if _, err = user.GetVirtualFolderForPath(entry.Path); err == nil || user.HasVirtualFoldersInside(entry.Path) {
+		return ErrTrashRestoreConflict
+	}
+	target, err := fs.ResolvePath(entry.Path)
+	if err != nil {
+		return err
+	}
+	if _, err = fs.Lstat(target); err == nil {
+		return ErrTrashRestoreConflict
+	} else if !fs.IsNotExist(err) {
+		return err
+	}
+	if err = createMissingDirs(fs, user, path.Dir(entry.Path)); err != nil {
+		return err
+	}
+	if err = fs.Rename(entry.fsPath, target); err != nil {
+		logger.Warn(trashLogSender, "", "unable to restore trash entry %#v for user %#v: %v", entry.ID, user.Username, err)
+		return err
+	}
+	trashDir, err := getTrashDir(fs)
+	if err == nil {
+		err = removeAll(fs, fs.Join(trashDir, entry.ID))
+	}
+	if err != nil {
+		logger.Warn(trashLogSender, "", "unable to remove the restored trash entry %#v for user %#v: %v", entry.ID,
+			user.Username, err)
+	}
+	logger.Debug(trashLogSender, "", "trash entry %#v restored for user %#v, path: %#v", entry.ID, user.Username, entry.Path)
+	enqueueReplication(user, replicationOpSync, entry.Path, "")
+	if entry.isRegularFile() {
+		if !user.Filters.Trash.CountInQuota {
+			dataprovider.UpdateUserQuota(dataProvider, user, 1, entry.Size, false)
+		}
+		updateDirQuotas(user, entry.Path, 1, entry.Size)
+	}
+	return nil
+}
+
+// PurgeTrashEntry permanently removes the trash entry with the given ID
+func PurgeTrashEntry(user dataprovider.User, entryID string) error {
+	fs, err := getTrashFilesystem(user)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	entry, err := getTrashEntry(fs, entryID)
+	if err != nil {
+		return err
+	}
+	return purgeTrashEntry(fs, user, entry)
+}
+
+// PurgeTrash permanently removes all the items inside the given user's trash
+// and returns the number of purged entries
+func PurgeTrash(user dataprovider.User) (int, error) {
+	return purgeTrashEntries(user, time.Time{})
+}
+
+// purgeTrashEntries removes the trash entries deleted before the given time,
+// all the entries are removed for a zero time
+func purgeTrashEntries(user dataprovider.User, deletedBefore time.Time) (int, error) {
+	fs, err := getTrashFilesystem(user)
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Close()
+	entries, err := getTrashEntries(fs)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, entry := range entries {
+		if !deletedBefore.IsZero() && !utils.GetTimeFromMsecSinceEpoch(entry.DeletionTime).Before(deletedBefore) {
+			continue
+		}
+		if err = purgeTrashEntry(fs, user, entry); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// GetTrashUsage returns the number of files and their size inside the trash for the given filesystem
+func GetTrashUsage(fs vfs.Fs) (int, int64, error) {
+	entries, err := getTrashEntries(fs)
+	if err != nil {
+		return 0, 0, err
+	}
+	numFiles := 0
+	size := int64(0)
+	for _, entry := range entries {
+		if entry.isRegularFile() {
+			numFiles++
+			size += entry.Size
+		}
+	}
+	return numFiles, size, nil
+}
+
+func startTrashCleaner() {
+	trashCleanupTicker = time.NewTicker(trashCleanupPeriod)
+	go func() {
+		for t := range trashCleanupTicker.C {
+			logger.Debug(trashLogSender, "", "trash cleanup ticker %v", t)
+			CleanupTrash()
+		}
+	}()
+}
+
+// CleanupTrash purges the trashed items deleted before the retention period
+// configured for each user
+func CleanupTrash() {
+	limit := 100
+	purged := 0
+	for offset := 0; ; offset += limit {
+		users, err := dataprovider.GetUsers(dataProvider, limit, offset, "ASC", "")
+		if err != nil {
+			logger.Warn(trashLogSender, "", "unable to get users for trash cleanup: %v", err)
+			break
+		}
+		for _, u := range users {
+			if !u.Filters.Trash.Enabled || u.Filters.Trash.RetentionDays <= 0 {
+				continue
+			}
+			// users are returned without credentials
+			user, err := dataprovider.UserExists(dataProvider, u.Username)
+			if err != nil {
+				continue
+			}
+			retention := time.Duration(user.Filters.Trash.RetentionDays) * 24 * time.Hour
+			n, err := purgeTrashEntries(user, time.Now().Add(-retention))
+			if err != nil {
+				logger.Warn(trashLogSender, "", "unable to cleanup the trash for user %#v: %v", user.Username, err)
+			}
+			purged += n
+		}
+		if len(users) < limit {
+			break
+		}
+	}
+	if purged > 0 {
+		logger.Info(trashLogSender, "", "trash cleanup done, purged entries: %v", purged)
+	}
+}
@@ -0,0 +1,35 @@
+package sftpd
+
+import (
+	"errors"
+)
+
+const (
+	// action executed when an upload is aborted since the file exceeds the maximum allowed size
+	operationUploadSizeExceeded = "upload_size_exceeded"
+)
+
+var (
+	errUploadFileSizeExceeded = errors.New("denying write: the file exceeds the maximum allowed upload size")
+)
+
+// getMaxUploadFileSize returns the maximum size allowed for a single uploaded file.
+// The user's limit, if any, overrides the global one. 0 means unlimited
+func (c Connection) getMaxUploadFileSize() int64 {
+	if c.User.Filters.MaxUploadFileSize > 0 {
+		return c.User.Filters.MaxUploadFileSize
+	}
+	return maxUploadFileSize
+}
+
+// checkUploadFileSize returns an error if writing size bytes at the given offset
+// makes the uploaded file bigger than the maximum allowed size
+func (t *Transfer) checkUploadFileSize(off int64, size int) error {
+	if t.maxWriteSize <= 0 {
+		return nil
+	}
+	if off+int64(size) > t.maxWriteSize {
+		return errUploadFileSizeExceeded
+	}
+	return nil
+}
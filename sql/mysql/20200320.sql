@@ -0,0 +1,8 @@
+BEGIN;
+--
+-- Create model DirectoryQuota
+--
+CREATE TABLE `directory_quotas` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `path` varchar(512) NOT NULL, `used_quota_size` bigint NOT NULL, `used_quota_files` integer NOT NULL, `last_quota_update` bigint NOT NULL, `user_id` integer NOT NULL);
+ALTER TABLE `directory_quotas` ADD CONSTRAINT `directory_quotas_user_id_path_uniq` UNIQUE (`user_id`, `path`);
+ALTER TABLE `directory_quotas` ADD CONSTRAINT `directory_quotas_user_id_fk_users_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+COMMIT;
\ No newline at end of file
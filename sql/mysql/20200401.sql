@@ -0,0 +1,8 @@
+BEGIN;
+--
+-- Create model RetentionLock
+--
+CREATE TABLE `retention_locks` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `path` varchar(512) NOT NULL, `retain_until` bigint NOT NULL, `user_id` integer NOT NULL);
+ALTER TABLE `retention_locks` ADD CONSTRAINT `retention_locks_user_id_path_uniq` UNIQUE (`user_id`, `path`);
+ALTER TABLE `retention_locks` ADD CONSTRAINT `retention_locks_user_id_fk_users_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+COMMIT;
\ No newline at end of file
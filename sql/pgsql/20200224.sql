@@ -0,0 +1,15 @@
+BEGIN;
+--
+-- Create model Folder
+--
+CREATE TABLE "folders" ("id" serial NOT NULL PRIMARY KEY, "name" varchar(255) NOT NULL UNIQUE, "mapped_path" varchar(512) NULL, "used_quota_size" bigint NOT NULL, "used_quota_files" integer NOT NULL, "last_quota_update" bigint NOT NULL, "filesystem" text NULL);
+--
+-- Create model FolderMapping
+--
+CREATE TABLE "folders_mapping" ("id" serial NOT NULL PRIMARY KEY, "virtual_path" varchar(512) NOT NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL, "folder_id" integer NOT NULL, "user_id" integer NOT NULL);
+ALTER TABLE "folders_mapping" ADD CONSTRAINT "folders_mapping_user_id_folder_id_uniq" UNIQUE ("user_id", "folder_id");
+ALTER TABLE "folders_mapping" ADD CONSTRAINT "folders_mapping_folder_id_fk_folders_id" FOREIGN KEY ("folder_id") REFERENCES "folders" ("id") ON DELETE CASCADE;
+ALTER TABLE "folders_mapping" ADD CONSTRAINT "folders_mapping_user_id_fk_users_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+CREATE INDEX "folders_mapping_folder_id_idx" ON "folders_mapping" ("folder_id");
+CREATE INDEX "folders_mapping_user_id_idx" ON "folders_mapping" ("user_id");
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+--
+-- Create model TransferQuota
+--
+CREATE TABLE "transfer_quotas" ("id" serial NOT NULL PRIMARY KEY, "used_upload_size" bigint NOT NULL, "used_download_size" bigint NOT NULL, "period_start" bigint NOT NULL, "last_update" bigint NOT NULL, "user_id" integer NOT NULL UNIQUE);
+ALTER TABLE "transfer_quotas" ADD CONSTRAINT "transfer_quotas_user_id_fk_users_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+--
+-- Create model RetentionLock
+--
+CREATE TABLE "retention_locks" ("id" serial NOT NULL PRIMARY KEY, "path" varchar(512) NOT NULL, "retain_until" bigint NOT NULL, "user_id" integer NOT NULL);
+ALTER TABLE "retention_locks" ADD CONSTRAINT "retention_locks_user_id_path_uniq" UNIQUE ("user_id", "path");
+ALTER TABLE "retention_locks" ADD CONSTRAINT "retention_locks_user_id_fk_users_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+CREATE INDEX "retention_locks_user_id_idx" ON "retention_locks" ("user_id");
+COMMIT;
\ No newline at end of file
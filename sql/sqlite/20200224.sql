@@ -0,0 +1,13 @@
+BEGIN;
+--
+-- Create model Folder
+--
+CREATE TABLE "folders" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "name" varchar(255) NOT NULL UNIQUE, "mapped_path" varchar(512) NULL, "used_quota_size" bigint NOT NULL, "used_quota_files" integer NOT NULL, "last_quota_update" bigint NOT NULL, "filesystem" text NULL);
+--
+-- Create model FolderMapping
+--
+CREATE TABLE "folders_mapping" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "virtual_path" varchar(512) NOT NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL, "folder_id" integer NOT NULL REFERENCES "folders" ("id") ON DELETE CASCADE, "user_id" integer NOT NULL REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "folders_mapping_user_id_folder_id_uniq" ON "folders_mapping" ("user_id", "folder_id");
+CREATE INDEX "folders_mapping_folder_id_idx" ON "folders_mapping" ("folder_id");
+CREATE INDEX "folders_mapping_user_id_idx" ON "folders_mapping" ("user_id");
+COMMIT;
\ No newline at end of file
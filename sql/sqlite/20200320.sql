@@ -0,0 +1,8 @@
+BEGIN;
+--
+-- Create model DirectoryQuota
+--
+CREATE TABLE "directory_quotas" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "path" varchar(512) NOT NULL, "used_quota_size" bigint NOT NULL, "used_quota_files" integer NOT NULL, "last_quota_update" bigint NOT NULL, "user_id" integer NOT NULL REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "directory_quotas_user_id_path_uniq" ON "directory_quotas" ("user_id", "path");
+CREATE INDEX "directory_quotas_user_id_idx" ON "directory_quotas" ("user_id");
+COMMIT;
\ No newline at end of file
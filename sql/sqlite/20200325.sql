@@ -0,0 +1,6 @@
+BEGIN;
+--
+-- Create model TransferQuota
+--
+CREATE TABLE "transfer_quotas" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "used_upload_size" bigint NOT NULL, "used_download_size" bigint NOT NULL, "period_start" bigint NOT NULL, "last_update" bigint NOT NULL, "user_id" integer NOT NULL UNIQUE REFERENCES "users" ("id") ON DELETE CASCADE);
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,8 @@
+BEGIN;
+--
+-- Create model RetentionLock
+--
+CREATE TABLE "retention_locks" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "path" varchar(512) NOT NULL, "retain_until" bigint NOT NULL, "user_id" integer NOT NULL REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "retention_locks_user_id_path_uniq" ON "retention_locks" ("user_id", "path");
+CREATE INDEX "retention_locks_user_id_idx" ON "retention_locks" ("user_id");
+COMMIT;
\ No newline at end of file
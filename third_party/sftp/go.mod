@@ -0,0 +1,10 @@
+module github.com/pkg/sftp
+
+go 1.15
+
+require (
+	github.com/kr/fs v0.1.0
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+)
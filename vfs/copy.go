@@ -0,0 +1,65 @@
+package vfs
+
+import (
+	"io"
+)
+
+// FileCopier is implemented by the Fs that can copy files server side, without
+// transferring the contents
+type FileCopier interface {
+	CopyFile(source, target string) error
+}
+
+// CopyFile copies the source file to target inside fs. If fs does not support
+// server side copies the contents are streamed using Open and Create
+func CopyFile(fs Fs, source, target string) error {
+	if copier, ok := fs.(FileCopier); ok {
+		return copier.CopyFile(source, target)
+	}
+	_, err := StreamFile(fs, fs, source, target)
+	return err
+}
+
+// StreamFile copies the source file from fs to the target path on dstFs reading
+// and writing the contents. It returns the number of bytes copied
+func StreamFile(fs, dstFs Fs, source, target string) (int64, error) {
+	file, r, cancelRead, err := fs.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	var reader io.ReadCloser = file
+	if file == nil {
+		reader = r
+	}
+	defer reader.Close()
+	dstFile, w, cancelWrite, err := dstFs.Create(target, 0)
+	if err != nil {
+		if cancelRead != nil {
+			cancelRead()
+		}
+		return 0, err
+	}
+	var n int64
+	if dstFile != nil {
+		n, err = io.Copy(dstFile, reader)
+		if errClose := dstFile.Close(); err == nil {
+			err = errClose
+		}
+	} else {
+		n, err = io.Copy(w, reader)
+		if err != nil && cancelWrite != nil {
+			cancelWrite()
+		}
+		if errClose := w.Close(); err == nil {
+			err = errClose
+		}
+		// the pipe reader is closed with the error returned by the storage backend, if any
+		if errRead := w.WaitForReader(); errRead != nil && errRead != io.EOF && err == nil {
+			err = errRead
+		}
+	}
+	if err != nil && cancelRead != nil {
+		cancelRead()
+	}
+	return n, err
+}
@@ -0,0 +1,527 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/eikenb/pipeat"
+	"github.com/freshvolk/sftpgo/logger"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files have the following layout:
+//
+// magic (6 bytes) | version (1 byte) | salt (32 bytes) | chunk 0 | chunk 1 | ... | chunk N
+//
+// every chunk contains at most cryptFsChunkSize plaintext bytes sealed using
+// AES-256-GCM. The encryption key is derived from the user's passphrase and the
+// random per file salt using HKDF-SHA256. The nonce contains the chunk counter
+// and a flag for the last chunk, so chunks cannot be reordered and truncations
+// are detected. Sealed chunks have a fixed size, chunk n starts at
+// header size + n * (cryptFsChunkSize + cryptFsTagSize)
+const (
+	cryptFsVersion   = 1
+	cryptFsSaltSize  = 32
+	cryptFsChunkSize = 65536
+	cryptFsTagSize   = 16
+	cryptFsKeyInfo   = "SFTPGo file encryption"
+)
+
+var (
+	cryptFsMagic      = []byte("SFTPGO")
+	cryptFsHeaderSize = int64(len(cryptFsMagic) + 1 + cryptFsSaltSize)
+	errCryptFsHeader  = errors.New("invalid encrypted file header")
+	errCryptFsTrunc   = errors.New("encrypted file is truncated")
+	errCryptFsTrail   = errors.New("unexpected data after the last encrypted chunk")
+	errCryptFsTooBig  = errors.New("file too large to be encrypted")
+)
+
+// CryptFsConfig defines the configuration for the encryption at rest
+type CryptFsConfig struct {
+	// Passphrase used to derive the file encryption keys.
+	// If empty files are stored unencrypted.
+	// Changing the passphrase makes the existing files unreadable
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// CryptFs is a Fs implementation that wraps another Fs and transparently
+// encrypts the file contents, so the storage backend never sees plaintext data.
+// Sizes are always reported as plaintext sizes
+type CryptFs struct {
+	Fs
+	localTempDir string
+	passphrase   []byte
+}
+
+// NewCryptFs returns a CryptFs object that encrypts the file contents
+// stored using the given Fs
+func NewCryptFs(fs Fs, localTempDir string, config CryptFsConfig) (Fs, error) {
+	if len(config.Passphrase) == 0 {
+		fs.Close()
+		return nil, errors.New("passphrase cannot be empty")
+	}
+	return &CryptFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		passphrase:   []byte(config.Passphrase),
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs CryptFs) Name() string {
+	return fmt.Sprintf("CryptFs %v", fs.Fs.Name())
+}
+
+// Stat returns a FileInfo describing the named file.
+// The reported size is the plaintext size
+func (fs CryptFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.Fs.Stat(name)
+	if err != nil {
+		return fi, err
+	}
+	return cryptFileInfo{fi}, nil
+}
+
+// Lstat returns a FileInfo describing the named file.
+// The reported size is the plaintext size
+func (fs CryptFs) Lstat(name string) (os.FileInfo, error) {
+	fi, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return fi, err
+	}
+	return cryptFileInfo{fi}, nil
+}
+
+// Open opens the named file for reading.
+// The chunks are read from the wrapped Fs and decrypted on demand, so the
+// plaintext is never stored and the SFTP clients can read at any offset
+func (fs CryptFs) Open(name string) (*os.File, FileReader, func(), error) {
+	f, ur, cancelFn, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var src FileReader = ur
+	if f != nil {
+		src = f
+	}
+	return nil, newCryptReader(src, fs.passphrase), cancelFn, nil
+}
+
+// Create creates or opens the named file for writing.
+// The received data are encrypted and written to the wrapped Fs. If the wrapped
+// Fs supports atomic uploads the data are written to a temporary file that
+// is renamed once the upload completes successfully, so an interrupted upload
+// never replaces an existing file
+func (fs CryptFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	uploadPath := name
+	if fs.Fs.IsAtomicUploadSupported() {
+		uploadPath = fs.Fs.GetAtomicUploadPath(name)
+	}
+	f, uw, uCancelFn, err := fs.Fs.Create(uploadPath, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		fs.closeUpload(uploadPath, f, uw, uCancelFn, err)
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		var dst io.Writer = uw
+		if f != nil {
+			dst = f
+		}
+		var n int64
+		cw, err := newCryptWriter(dst, fs.passphrase)
+		if err == nil {
+			n, err = io.Copy(cw, r)
+			if err == nil {
+				err = cw.Close()
+			}
+		}
+		if err == nil {
+			// the transfer was aborted, the received data are incomplete
+			err = ctx.Err()
+		}
+		err = fs.closeUpload(uploadPath, f, uw, uCancelFn, err)
+		if err == nil && uploadPath != name {
+			err = fs.Fs.Rename(uploadPath, name)
+			if err != nil {
+				fs.Fs.Remove(uploadPath, false)
+			}
+		}
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+// The reported sizes are the plaintext sizes
+func (fs CryptFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fs.Fs.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	result := make([]os.FileInfo, 0, len(list))
+	for _, fi := range list {
+		result = append(result, cryptFileInfo{fi})
+	}
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Encrypted files cannot be appended
+func (CryptFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// CryptFs handles atomic uploads itself, if the wrapped Fs supports them
+func (CryptFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their plaintext size
+func (fs CryptFs) ScanRootDirContents() (int, int64, error) {
+	rootPath, err := fs.Fs.ResolvePath("/")
+	if err != nil {
+		return 0, 0, err
+	}
+	return fs.scanDirContents(rootPath)
+}
+
+func (fs CryptFs) scanDirContents(dirPath string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	list, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return numFiles, size, err
+	}
+	for _, fi := range list {
+		if fi.IsDir() {
+			n, s, err := fs.scanDirContents(fs.Join(dirPath, fi.Name()))
+			if err != nil {
+				return numFiles, size, err
+			}
+			numFiles += n
+			size += s
+		} else if fi.Mode().IsRegular() {
+			numFiles++
+			size += fi.Size()
+		}
+	}
+	return numFiles, size, nil
+}
+
+// closeUpload closes the wrapped Fs writer and removes the partial
+// file if the upload failed
+func (fs CryptFs) closeUpload(uploadPath string, f *os.File, w *pipeat.PipeWriterAt, cancelFn func(), err error) error {
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fs.Fs.Remove(uploadPath, false)
+		}
+		return err
+	}
+	w.CloseWithError(err)
+	if readErr := w.WaitForReader(); err == nil && readErr != io.EOF {
+		err = readErr
+	}
+	return err
+}
+
+// cryptFileInfo reports the plaintext size for regular files
+type cryptFileInfo struct {
+	os.FileInfo
+}
+
+// Size returns the plaintext size for the file
+func (fi cryptFileInfo) Size() int64 {
+	if !fi.Mode().IsRegular() {
+		return fi.FileInfo.Size()
+	}
+	return getCryptFsPlaintextSize(fi.FileInfo.Size())
+}
+
+func getCryptFsPlaintextSize(size int64) int64 {
+	payload := size - cryptFsHeaderSize
+	if payload < cryptFsTagSize {
+		return 0
+	}
+	numChunks := (payload + cryptFsChunkSize + cryptFsTagSize - 1) / (cryptFsChunkSize + cryptFsTagSize)
+	return payload - numChunks*cryptFsTagSize
+}
+
+func getCryptFsAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, passphrase, salt, []byte(cryptFsKeyInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getCryptFsNonce(nonce []byte, counter uint32, isLast bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint32(nonce[len(nonce)-5:], counter)
+	if isLast {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// cryptWriter encrypts the data written to it and writes them to the wrapped writer
+type cryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	buf     []byte
+	sealed  []byte
+	counter uint32
+}
+
+func newCryptWriter(w io.Writer, passphrase []byte) (*cryptWriter, error) {
+	salt := make([]byte, cryptFsSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := getCryptFsAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, cryptFsHeaderSize)
+	header = append(header, cryptFsMagic...)
+	header = append(header, cryptFsVersion)
+	header = append(header, salt...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &cryptWriter{
+		w:      w,
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, cryptFsChunkSize),
+		sealed: make([]byte, 0, cryptFsChunkSize+cryptFsTagSize),
+	}, nil
+}
+
+// Write buffers the data and encrypts every complete chunk.
+// A complete chunk is written only when more data are available,
+// since we don't know yet if it is the last one
+func (w *cryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == cryptFsChunkSize {
+			if err := w.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, it does not close the wrapped writer
+func (w *cryptWriter) Close() error {
+	return w.writeChunk(true)
+}
+
+func (w *cryptWriter) writeChunk(isLast bool) error {
+	if w.counter == math.MaxUint32 {
+		return errCryptFsTooBig
+	}
+	w.sealed = w.aead.Seal(w.sealed[:0], getCryptFsNonce(w.nonce, w.counter, isLast), w.buf, nil)
+	if _, err := w.w.Write(w.sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.counter++
+	return nil
+}
+
+// cryptReader decrypts the chunks read from the wrapped reader when they are
+// requested. The chunks have a fixed size, so the one containing a given
+// plaintext offset can be read directly. The last decrypted chunk is cached,
+// the clients usually read less than a chunk for each request
+type cryptReader struct {
+	r          FileReader
+	passphrase []byte
+	sync.Mutex
+	aead  cipher.AEAD
+	nonce []byte
+	// sealed chunk plus one byte, to check if more chunks follow
+	sealed []byte
+	// plaintext for the cached chunk
+	plain      []byte
+	plainIndex int64
+	plainLast  bool
+	// offset for sequential reads
+	offset int64
+}
+
+func newCryptReader(r FileReader, passphrase []byte) *cryptReader {
+	return &cryptReader{
+		r:          r,
+		passphrase: passphrase,
+		plainIndex: -1,
+	}
+}
+
+// Read reads the plaintext sequentially
+func (r *cryptReader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	n, err := r.readAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads the plaintext at the given offset, only the needed chunks are decrypted
+func (r *cryptReader) ReadAt(p []byte, off int64) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.readAt(p, off)
+}
+
+// Close closes the wrapped reader
+func (r *cryptReader) Close() error {
+	return r.r.Close()
+}
+
+func (r *cryptReader) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if r.aead == nil {
+		if err := r.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		index := off / cryptFsChunkSize
+		if err := r.loadChunk(index); err != nil {
+			return n, err
+		}
+		chunkOffset := int(off - index*cryptFsChunkSize)
+		if chunkOffset >= len(r.plain) {
+			// only the last chunk can be shorter than cryptFsChunkSize
+			return n, io.EOF
+		}
+		copied := copy(p[n:], r.plain[chunkOffset:])
+		n += copied
+		off += int64(copied)
+		if r.plainLast && chunkOffset+copied == len(r.plain) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (r *cryptReader) readHeader() error {
+	header := make([]byte, cryptFsHeaderSize)
+	if _, err := r.r.ReadAt(header, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errCryptFsHeader
+		}
+		return err
+	}
+	if !bytes.Equal(header[:len(cryptFsMagic)], cryptFsMagic) || header[len(cryptFsMagic)] != cryptFsVersion {
+		return errCryptFsHeader
+	}
+	aead, err := getCryptFsAEAD(r.passphrase, header[len(cryptFsMagic)+1:])
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	r.nonce = make([]byte, aead.NonceSize())
+	r.sealed = make([]byte, cryptFsChunkSize+cryptFsTagSize+1)
+	return nil
+}
+
+// loadChunk decrypts the chunk with the given index, if it is not already cached.
+// Reading past the last chunk returns io.EOF
+func (r *cryptReader) loadChunk(index int64) error {
+	if index == r.plainIndex {
+		return nil
+	}
+	if index > math.MaxUint32 {
+		return io.EOF
+	}
+	sealedSize := int64(cryptFsChunkSize + cryptFsTagSize)
+	n, err := r.r.ReadAt(r.sealed, cryptFsHeaderSize+index*sealedSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n == 0 {
+		if index == 0 {
+			return errCryptFsTrunc
+		}
+		// the file ends after the previous chunk, it must be the last one
+		if err := r.loadChunk(index - 1); err != nil {
+			return err
+		}
+		if !r.plainLast {
+			return errCryptFsTrunc
+		}
+		return io.EOF
+	}
+	hasNext := n == len(r.sealed)
+	if hasNext {
+		n--
+	}
+	plain, err := r.aead.Open(r.plain[:0], getCryptFsNonce(r.nonce, uint32(index), !hasNext), r.sealed[:n], nil)
+	if err != nil {
+		r.plainIndex = -1
+		if hasNext {
+			// a chunk sealed as the last one followed by more data
+			if _, errLast := r.aead.Open(nil, getCryptFsNonce(r.nonce, uint32(index), true), r.sealed[:n], nil); errLast == nil {
+				return errCryptFsTrail
+			}
+		} else if n == len(r.sealed)-1 {
+			// a full size chunk not sealed as the last one, the next chunks are missing
+			if _, errNext := r.aead.Open(nil, getCryptFsNonce(r.nonce, uint32(index), false), r.sealed[:n], nil); errNext == nil {
+				return errCryptFsTrunc
+			}
+		}
+		return fmt.Errorf("unable to decrypt chunk %v: %v", index, err)
+	}
+	r.plain = plain
+	r.plainIndex = index
+	r.plainLast = !hasNext
+	return nil
+}
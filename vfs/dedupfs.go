@@ -0,0 +1,653 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/rs/xid"
+)
+
+const (
+	dedupFsName       = "dedupfs"
+	dedupBlobsDirName = "blobs"
+	dedupTempDirName  = "tmp"
+	dedupRefsSuffix   = ".refs"
+	dedupTempPrefix   = ".sftpgo-dedup."
+)
+
+var (
+	// the blob store can be shared between several users and folders,
+	// the changes to the reference counters must be serialized
+	dedupStoreLocks      = make(map[string]*sync.Mutex)
+	dedupStoreLocksMutex sync.Mutex
+)
+
+// DedupFsConfig defines the configuration for the content-addressed deduplicating filesystem
+type DedupFsConfig struct {
+	// StorePath is the local directory where the file contents are stored, by content hash.
+	// Users and folders with the same store path share the stored contents.
+	// It must be an absolute path on the same filesystem as the namespace
+	StorePath string `json:"store_path,omitempty"`
+}
+
+// dedupRef is the content of a file inside a user's or folder's namespace,
+// it references a blob inside the store
+type dedupRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// dedupFileInfo reports the logical size for a reference file
+type dedupFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+// Size returns the size of the referenced content
+func (fi dedupFileInfo) Size() int64 {
+	return fi.size
+}
+
+// DedupFs is a local Fs implementation that stores the file contents only once.
+// The directory tree lives inside the root directory as for the local filesystem,
+// but each regular file is a small reference to a blob identified by its SHA256 hash.
+// The blobs are shared between all the users and folders using the same store path
+// and they are removed when no longer referenced.
+type DedupFs struct {
+	OsFs
+	storePath string
+}
+
+// NewDedupFs returns a DedupFs object that allows to interact with a deduplicating local store
+func NewDedupFs(connectionID, rootDir string, config DedupFsConfig) (Fs, error) {
+	if err := ValidateDedupFsConfig(&config); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(rootDir) {
+		return nil, fmt.Errorf("invalid root path: %v", rootDir)
+	}
+	rootDir = filepath.Clean(rootDir)
+	if isSameOrSubPath(rootDir, config.StorePath) || isSameOrSubPath(config.StorePath, rootDir) {
+		return nil, fmt.Errorf("the store path %#v and the root path %#v cannot be nested", config.StorePath, rootDir)
+	}
+	for _, dir := range []string{filepath.Join(config.StorePath, dedupBlobsDirName),
+		filepath.Join(config.StorePath, dedupTempDirName)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("unable to create store dir %#v: %v", dir, err)
+		}
+	}
+	return &DedupFs{
+		OsFs: OsFs{
+			name:         dedupFsName,
+			connectionID: connectionID,
+			rootDir:      rootDir,
+		},
+		storePath: config.StorePath,
+	}, nil
+}
+
+// Stat returns a FileInfo describing the named file, the size
+// for regular files is the size of the referenced content
+func (fs DedupFs) Stat(name string) (os.FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.getFileInfo(name, info)
+}
+
+// Lstat returns a FileInfo describing the named file, the size
+// for regular files is the size of the referenced content
+func (fs DedupFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.getFileInfo(name, info)
+}
+
+// Open opens the blob referenced by the named file for reading
+func (fs DedupFs) Open(name string) (*os.File, FileReader, func(), error) {
+	ref, err := readDedupRef(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, err := os.Open(fs.getBlobPath(ref.Hash))
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to open blob %#v referenced by %#v: %v", ref.Hash, name, err)
+		return nil, nil, nil, fmt.Errorf("unable to open the content for %#v", name)
+	}
+	return f, nil, nil, nil
+}
+
+// Create creates or opens the named file for writing.
+// The received data are stored inside a temporary file while computing their hash,
+// the blob and the reference are stored when the upload completes
+func (fs DedupFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	isAtomic := flag == 0 || flag&os.O_TRUNC != 0
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return nil, nil, nil, &os.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+	}
+	if info, err := os.Stat(filepath.Dir(name)); err != nil {
+		return nil, nil, nil, err
+	} else if !info.IsDir() {
+		return nil, nil, nil, &os.PathError{Op: "create", Path: name, Err: errors.New("not a directory")}
+	}
+	var initialRef *dedupRef
+	if flag&os.O_APPEND != 0 {
+		ref, err := readDedupRef(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		initialRef = &ref
+	}
+	tempFile, err := ioutil.TempFile(filepath.Join(fs.storePath, dedupTempDirName), "upload")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.Pipe()
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		hasher := sha256.New()
+		writer := io.MultiWriter(tempFile, hasher)
+		var size, n int64
+		var err error
+		if initialRef != nil {
+			size, err = fs.copyBlob(initialRef.Hash, writer)
+		}
+		if err == nil {
+			n, err = io.Copy(writer, r)
+			size += n
+		}
+		if err == nil {
+			// the transfer was aborted, the received data are incomplete
+			err = ctx.Err()
+		}
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil || !isAtomic {
+			if storeErr := fs.storeFile(name, tempFile.Name(), hasher, size); err == nil {
+				err = storeErr
+			}
+		} else {
+			os.Remove(tempFile.Name())
+		}
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+// If target is an existing file, the blob it references is released
+func (fs DedupFs) Rename(source, target string) error {
+	targetInfo, err := os.Lstat(target)
+	if err != nil || !targetInfo.Mode().IsRegular() {
+		return os.Rename(source, target)
+	}
+	if sourceInfo, err := os.Lstat(source); err == nil && os.SameFile(sourceInfo, targetInfo) {
+		return os.Rename(source, target)
+	}
+	lock := getDedupStoreLock(fs.storePath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ref, refErr := readDedupRef(target)
+	if err = os.Rename(source, target); err != nil {
+		return err
+	}
+	if refErr != nil {
+		return nil
+	}
+	return fs.releaseBlob(ref.Hash)
+}
+
+// Remove removes the named file or (empty) directory.
+// The referenced blob is removed if there are no other references to it
+func (fs DedupFs) Remove(name string, isDir bool) error {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return os.Remove(name)
+	}
+	lock := getDedupStoreLock(fs.storePath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ref, refErr := readDedupRef(name)
+	if err = os.Remove(name); err != nil {
+		return err
+	}
+	if refErr != nil {
+		fsLog(fs, logger.LevelWarn, "removed invalid reference %#v: %v", name, refErr)
+		return nil
+	}
+	return fs.releaseBlob(ref.Hash)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs DedupFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	result := make([]os.FileInfo, 0, len(list))
+	for _, info := range list {
+		if strings.HasPrefix(info.Name(), dedupTempPrefix) {
+			continue
+		}
+		fi, err := fs.getFileInfo(filepath.Join(dirname, info.Name()), info)
+		if err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to read reference for %#v: %v", info.Name(), err)
+			fi = info
+		}
+		result = append(result, fi)
+	}
+	return result, nil
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// The uploads are always atomic for DedupFs, the reference is updated
+// only when the upload completes
+func (DedupFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their logical size
+func (fs DedupFs) ScanRootDirContents() (int, int64, error) {
+	return fs.ScanRootDirContentsWithOptions(context.Background(), ScanOptions{}, &ScanProgress{})
+}
+
+// ScanRootDirContentsWithOptions returns the number of files contained in the root
+// directory and their logical size scanning up to options.Parallelism sub directories
+// concurrently
+func (fs DedupFs) ScanRootDirContentsWithOptions(ctx context.Context, options ScanOptions, progress *ScanProgress) (int, int64, error) {
+	return newLocalScanner(ctx, fs.rootDir, options, progress, func(name string, info os.FileInfo) (bool, int64, error) {
+		if strings.HasPrefix(info.Name(), dedupTempPrefix) {
+			return false, 0, nil
+		}
+		ref, err := readDedupRef(name)
+		if err != nil {
+			return false, 0, err
+		}
+		return true, ref.Size, nil
+	}).scan()
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// DedupFs handles atomic uploads internally
+func (DedupFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+func (fs DedupFs) getFileInfo(name string, info os.FileInfo) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	ref, err := readDedupRef(name)
+	if err != nil {
+		return nil, err
+	}
+	return dedupFileInfo{FileInfo: info, size: ref.Size}, nil
+}
+
+func (fs DedupFs) getBlobPath(hash string) string {
+	return getDedupBlobPath(fs.storePath, hash)
+}
+
+func (fs DedupFs) copyBlob(hash string, w io.Writer) (int64, error) {
+	f, err := os.Open(fs.getBlobPath(hash))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// storeFile moves the uploaded data inside the store, if a blob with the same hash does not
+// already exist, and then updates the reference for the named file.
+// The reference counters are always updated before the references themselves,
+// so they can only be overestimated if SFTPGo is interrupted
+func (fs DedupFs) storeFile(name, tempPath string, hasher hash.Hash, size int64) error {
+	lock := getDedupStoreLock(fs.storePath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ref := dedupRef{
+		Hash: hex.EncodeToString(hasher.Sum(nil)),
+		Size: size,
+	}
+	blobPath := fs.getBlobPath(ref.Hash)
+	if _, err := os.Stat(blobPath); err == nil {
+		os.Remove(tempPath)
+	} else if os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(blobPath), 0700); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		if err = os.Rename(tempPath, blobPath); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		fsLog(fs, logger.LevelDebug, "new blob %#v stored, size: %v", ref.Hash, size)
+	} else {
+		os.Remove(tempPath)
+		return err
+	}
+	if _, err := addDedupBlobRefs(fs.storePath, ref.Hash, 1); err != nil {
+		return err
+	}
+	oldRef, oldRefErr := readDedupRef(name)
+	if err := writeDedupRef(name, ref); err != nil {
+		fs.releaseBlob(ref.Hash) //nolint:errcheck
+		return err
+	}
+	if oldRefErr == nil {
+		return fs.releaseBlob(oldRef.Hash)
+	}
+	return nil
+}
+
+// releaseBlob decrements the reference counter for the specified blob and
+// removes the blob if it is no longer referenced
+func (fs DedupFs) releaseBlob(hash string) error {
+	refs, err := addDedupBlobRefs(fs.storePath, hash, -1)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to update references for blob %#v: %v", hash, err)
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+	blobPath := fs.getBlobPath(hash)
+	err = os.Remove(blobPath)
+	if err == nil || os.IsNotExist(err) {
+		err = os.Remove(blobPath + dedupRefsSuffix)
+	}
+	fsLog(fs, logger.LevelDebug, "blob %#v no longer referenced, remove error: %v", hash, err)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ValidateDedupFsConfig returns nil if the specified deduplicating filesystem config is valid, otherwise an error
+func ValidateDedupFsConfig(config *DedupFsConfig) error {
+	if len(config.StorePath) == 0 {
+		return errors.New("store path cannot be empty")
+	}
+	if !filepath.IsAbs(config.StorePath) {
+		return fmt.Errorf("store path must be an absolute path, actual value: %#v", config.StorePath)
+	}
+	config.StorePath = filepath.Clean(config.StorePath)
+	return nil
+}
+
+// DedupStoreGCResult defines the results of a blob store check
+type DedupStoreGCResult struct {
+	// number of blobs found inside the store
+	Blobs int
+	// number of blobs referenced by at least a file
+	ReferencedBlobs int
+	// number of orphan blobs and their size. They are removed if not in dry run mode
+	OrphanBlobs int
+	OrphanSize  int64
+	// number of blobs with a wrong reference counter. The counter is fixed if not in dry run mode
+	FixedCounters int
+	// blobs whose contents do not match their hash, they are checked only if requested
+	CorruptedBlobs []string
+	// referenced blobs that are missing from the store
+	MissingBlobs []string
+	// files inside the namespaces that are not valid references
+	InvalidRefs []string
+}
+
+// CollectDedupStoreGarbage checks the blob store at storePath against the references found
+// inside the specified namespaces, that must include all the namespaces using this store.
+// Orphan blobs are removed and the reference counters are recomputed, nothing is modified
+// if dryRun is true. If verify is true the content of each blob is checked against its hash.
+// The store must not be in use while this function runs
+func CollectDedupStoreGarbage(storePath string, namespaces []string, verify, dryRun bool) (DedupStoreGCResult, error) {
+	var result DedupStoreGCResult
+	config := DedupFsConfig{StorePath: storePath}
+	if err := ValidateDedupFsConfig(&config); err != nil {
+		return result, err
+	}
+	storePath = config.StorePath
+	lock := getDedupStoreLock(storePath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	references := make(map[string]int64)
+	for _, namespace := range namespaces {
+		err := filepath.Walk(namespace, func(walkedPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if walkedPath == namespace && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), dedupTempPrefix) {
+				if !dryRun {
+					os.Remove(walkedPath)
+				}
+				return nil
+			}
+			ref, err := readDedupRef(walkedPath)
+			if err != nil {
+				result.InvalidRefs = append(result.InvalidRefs, walkedPath)
+				return nil
+			}
+			references[ref.Hash]++
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("unable to walk namespace %#v: %v", namespace, err)
+		}
+	}
+	found := make(map[string]bool)
+	blobsDir := filepath.Join(storePath, dedupBlobsDirName)
+	err := filepath.Walk(blobsDir, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), dedupRefsSuffix) {
+			return nil
+		}
+		hash := info.Name()
+		if !isValidDedupHash(hash) {
+			return nil
+		}
+		result.Blobs++
+		found[hash] = true
+		count := references[hash]
+		if count == 0 {
+			result.OrphanBlobs++
+			result.OrphanSize += info.Size()
+			if !dryRun {
+				if err := os.Remove(walkedPath); err != nil {
+					return err
+				}
+				os.Remove(walkedPath + dedupRefsSuffix)
+			}
+			return nil
+		}
+		result.ReferencedBlobs++
+		if verify {
+			if ok, err := checkDedupBlob(walkedPath, hash); err != nil {
+				return err
+			} else if !ok {
+				result.CorruptedBlobs = append(result.CorruptedBlobs, hash)
+			}
+		}
+		if stored, err := readDedupBlobRefs(storePath, hash); err != nil || stored != count {
+			result.FixedCounters++
+			if !dryRun {
+				if err := writeDedupBlobRefs(storePath, hash, count); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return result, fmt.Errorf("unable to walk store %#v: %v", storePath, err)
+	}
+	for hash := range references {
+		if !found[hash] {
+			result.MissingBlobs = append(result.MissingBlobs, hash)
+		}
+	}
+	if !dryRun {
+		// the store is not in use, the leftovers of interrupted uploads can be safely removed
+		tempDir := filepath.Join(storePath, dedupTempDirName)
+		if list, err := ioutil.ReadDir(tempDir); err == nil {
+			for _, info := range list {
+				os.Remove(filepath.Join(tempDir, info.Name()))
+			}
+		}
+	}
+	return result, nil
+}
+
+func getDedupStoreLock(storePath string) *sync.Mutex {
+	dedupStoreLocksMutex.Lock()
+	defer dedupStoreLocksMutex.Unlock()
+
+	lock, ok := dedupStoreLocks[storePath]
+	if !ok {
+		lock = new(sync.Mutex)
+		dedupStoreLocks[storePath] = lock
+	}
+	return lock
+}
+
+func getDedupBlobPath(storePath, hash string) string {
+	return filepath.Join(storePath, dedupBlobsDirName, hash[:2], hash)
+}
+
+func isValidDedupHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func checkDedupBlob(blobPath, expectedHash string) (bool, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == expectedHash, nil
+}
+
+func readDedupRef(name string) (dedupRef, error) {
+	var ref dedupRef
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ref, err
+	}
+	if err = json.Unmarshal(content, &ref); err != nil {
+		return ref, fmt.Errorf("invalid reference %#v: %v", name, err)
+	}
+	if !isValidDedupHash(ref.Hash) || ref.Size < 0 {
+		return ref, fmt.Errorf("invalid reference %#v", name)
+	}
+	return ref, nil
+}
+
+// writeDedupRef atomically replaces the named reference, an existing
+// reference keeps its permissions
+func writeDedupRef(name string, ref dedupRef) error {
+	content, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0666)
+	if info, err := os.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tempPath := filepath.Join(filepath.Dir(name), dedupTempPrefix+xid.New().String())
+	if err = ioutil.WriteFile(tempPath, content, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tempPath, name); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func readDedupBlobRefs(storePath, hash string) (int64, error) {
+	content, err := ioutil.ReadFile(getDedupBlobPath(storePath, hash) + dedupRefsSuffix)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+func writeDedupBlobRefs(storePath, hash string, refs int64) error {
+	refsPath := getDedupBlobPath(storePath, hash) + dedupRefsSuffix
+	tempPath := refsPath + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := ioutil.WriteFile(tempPath, []byte(strconv.FormatInt(refs, 10)), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, refsPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// addDedupBlobRefs adds delta to the reference counter for the specified blob
+// and returns the updated value. The store lock must be held
+func addDedupBlobRefs(storePath, hash string, delta int64) (int64, error) {
+	refs, err := readDedupBlobRefs(storePath, hash)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	refs += delta
+	if refs < 0 {
+		refs = 0
+	}
+	return refs, writeDedupBlobRefs(storePath, hash, refs)
+}
+
+func isSameOrSubPath(parent, sub string) bool {
+	return sub == parent || strings.HasPrefix(sub, parent+string(os.PathSeparator))
+}
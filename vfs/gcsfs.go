@@ -2,6 +2,7 @@ package vfs
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -40,7 +41,10 @@ type GCSFsConfig struct {
 	KeyPrefix      string `json:"key_prefix,omitempty"`
 	CredentialFile string `json:"-"`
 	Credentials    string `json:"credentials,omitempty"`
-	StorageClass   string `json:"storage_class,omitempty"`
+	// AutomaticCredentials enables Application Default Credentials, the
+	// credentials are searched in the environment and Credentials must be empty
+	AutomaticCredentials bool   `json:"automatic_credentials,omitempty"`
+	StorageClass         string `json:"storage_class,omitempty"`
 }
 
 // GCSFs is a Fs implementation for Google Cloud Storage.
@@ -51,6 +55,7 @@ type GCSFs struct {
 	svc            *storage.Client
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	cache          *metadataCache
 }
 
 // NewGCSFs returns an GCSFs object that allows to interact with Google Cloud Storage
@@ -67,7 +72,19 @@ func NewGCSFs(connectionID, localTempDir string, config GCSFsConfig) (Fs, error)
 		return fs, err
 	}
 	ctx := context.Background()
-	fs.svc, err = storage.NewClient(ctx, option.WithCredentialsFile(fs.config.CredentialFile))
+	if fs.config.AutomaticCredentials {
+		fs.svc, err = storage.NewClient(ctx)
+	} else if len(fs.config.Credentials) > 0 {
+		var credentials []byte
+		credentials, err = base64.StdEncoding.DecodeString(fs.config.Credentials)
+		if err != nil {
+			return fs, err
+		}
+		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON(credentials))
+	} else {
+		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsFile(fs.config.CredentialFile))
+	}
+	fs.cache = newMetadataCache(metrics.GCSMetadataCacheHit, metrics.GCSMetadataCacheMiss)
 	return fs, err
 }
 
@@ -83,6 +100,17 @@ func (fs GCSFs) ConnectionID() string {
 
 // Stat returns a FileInfo describing the named file
 func (fs GCSFs) Stat(name string) (os.FileInfo, error) {
+	if fi, ok := fs.cache.getStat(name); ok {
+		return fi, nil
+	}
+	fi, err := fs.stat(name)
+	if err == nil {
+		fs.cache.setStat(name, fi)
+	}
+	return fi, err
+}
+
+func (fs GCSFs) stat(name string) (os.FileInfo, error) {
 	var result FileInfo
 	var err error
 	if len(name) == 0 || name == "." {
@@ -141,7 +169,7 @@ func (fs GCSFs) Lstat(name string) (os.FileInfo, error) {
 }
 
 // Open opens the named file for reading
-func (fs GCSFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+func (fs GCSFs) Open(name string) (*os.File, FileReader, func(), error) {
 	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -169,6 +197,7 @@ func (fs GCSFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error
 
 // Create creates or opens the named file for writing
 func (fs GCSFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	fs.cache.invalidate(name)
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -182,6 +211,8 @@ func (fs GCSFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, f
 	}
 	go func() {
 		defer cancelFn()
+		// the object is visible after closing the writer
+		defer fs.cache.invalidate(name)
 		defer objectWriter.Close()
 		n, err := io.Copy(objectWriter, r)
 		r.CloseWithError(err)
@@ -200,12 +231,12 @@ func (fs GCSFs) Rename(source, target string) error {
 	if source == target {
 		return nil
 	}
-	fi, err := fs.Stat(source)
+	fi, err := fs.stat(source)
 	if err != nil {
 		return err
 	}
 	if fi.IsDir() {
-		contents, err := fs.ReadDir(source)
+		contents, err := fs.readDir(source)
 		if err != nil {
 			return err
 		}
@@ -219,6 +250,21 @@ func (fs GCSFs) Rename(source, target string) error {
 			target += "/"
 		}
 	}
+	if err = fs.copyObject(source, target); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// CopyFile copies the source object to target server side
+func (fs GCSFs) CopyFile(source, target string) error {
+	if source == target {
+		return nil
+	}
+	return fs.copyObject(source, target)
+}
+
+func (fs GCSFs) copyObject(source, target string) error {
 	src := fs.svc.Bucket(fs.config.Bucket).Object(source)
 	dst := fs.svc.Bucket(fs.config.Bucket).Object(target)
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
@@ -227,18 +273,17 @@ func (fs GCSFs) Rename(source, target string) error {
 	if len(fs.config.StorageClass) > 0 {
 		copier.StorageClass = fs.config.StorageClass
 	}
-	_, err = copier.Run(ctx)
+	_, err := copier.Run(ctx)
 	metrics.GCSCopyObjectCompleted(err)
-	if err != nil {
-		return err
-	}
-	return fs.Remove(source, fi.IsDir())
+	fs.cache.invalidate(target)
+	return err
 }
 
 // Remove removes the named file or (empty) directory.
 func (fs GCSFs) Remove(name string, isDir bool) error {
+	defer fs.cache.invalidate(name)
 	if isDir {
-		contents, err := fs.ReadDir(name)
+		contents, err := fs.readDir(name)
 		if err != nil {
 			return err
 		}
@@ -298,6 +343,17 @@ func (GCSFs) Chtimes(name string, atime, mtime time.Time) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if contents, ok := fs.cache.getDir(dirname); ok {
+		return contents, nil
+	}
+	contents, err := fs.readDir(dirname)
+	if err == nil {
+		fs.cache.setDir(dirname, contents)
+	}
+	return contents, err
+}
+
+func (fs GCSFs) readDir(dirname string) ([]os.FileInfo, error) {
 	var result []os.FileInfo
 	// dirname deve essere già cleaned
 	prefix := ""
@@ -458,6 +514,12 @@ func (GCSFs) Join(elem ...string) string {
 	return strings.TrimPrefix(path.Join(elem...), "/")
 }
 
+// Close releases the resources associated to this Fs implementation.
+// There is nothing to release for GCSFs
+func (GCSFs) Close() error {
+	return nil
+}
+
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs GCSFs) ResolvePath(sftpPath string) (string, error) {
 	if !path.IsAbs(sftpPath) {
@@ -0,0 +1,636 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/freshvolk/sftpgo/logger"
+)
+
+const (
+	memFsName = "MemFs"
+	// maximum number of symlinks to follow while resolving a path
+	memFsMaxSymlinks = 10
+)
+
+var (
+	// ErrMemFsFull is returned if an upload exceeds the memory filesystem size limit
+	ErrMemFsFull = errors.New("memory filesystem size limit exceeded")
+
+	memStorages      = make(map[string]*memStorage)
+	memStoragesMutex sync.Mutex
+)
+
+// MemFsConfig defines the configuration for an in memory filesystem
+type MemFsConfig struct {
+	// MaxSize is the maximum size, as bytes, of the stored files. 0 means unlimited
+	MaxSize int64 `json:"max_size"`
+	// ClearOnLogout defines if the stored files must be removed as soon as
+	// the last connection using this filesystem is closed.
+	// The stored files are always lost if SFTPGo is restarted
+	ClearOnLogout bool `json:"clear_on_logout"`
+	// StorageID identifies the memory storage to use, it is the same for
+	// all the connections of a user or a virtual folder
+	StorageID string `json:"-"`
+}
+
+type memNode struct {
+	isDir   bool
+	target  string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	uid     int
+	gid     int
+}
+
+func (n *memNode) isSymlink() bool {
+	return len(n.target) > 0
+}
+
+func (n *memNode) getFileInfo(name string) FileInfo {
+	info := NewFileInfo(name, n.isDir, int64(len(n.data)), n.modTime)
+	info.mode = n.mode
+	if n.isSymlink() {
+		info.mode = os.ModeSymlink | 0777
+		info.sizeInBytes = int64(len(n.target))
+	}
+	return info
+}
+
+// memStorage contains the files for an in memory filesystem.
+// The nodes are indexed using their absolute and clean path
+type memStorage struct {
+	sync.RWMutex
+	nodes map[string]*memNode
+	size  int64
+	refs  int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		nodes: map[string]*memNode{
+			"/": {
+				isDir:   true,
+				mode:    os.ModeDir | 0755,
+				modTime: time.Now(),
+			},
+		},
+	}
+}
+
+// MemFs is a Fs implementation that stores the files in memory.
+// The contents are shared between all the connections of the same user
+// and they are lost when SFTPGo is restarted
+type MemFs struct {
+	connectionID string
+	config       MemFsConfig
+	storage      *memStorage
+	closeOnce    *sync.Once
+}
+
+// NewMemFs returns an MemFs object that allows to interact with an in memory filesystem
+func NewMemFs(connectionID string, config MemFsConfig) (Fs, error) {
+	if err := ValidateMemFsConfig(&config); err != nil {
+		return nil, err
+	}
+	if len(config.StorageID) == 0 {
+		return nil, errors.New("storage id cannot be empty")
+	}
+	memStoragesMutex.Lock()
+	defer memStoragesMutex.Unlock()
+
+	storage, ok := memStorages[config.StorageID]
+	if !ok {
+		storage = newMemStorage()
+		memStorages[config.StorageID] = storage
+	}
+	storage.refs++
+	return MemFs{
+		connectionID: connectionID,
+		config:       config,
+		storage:      storage,
+		closeOnce:    new(sync.Once),
+	}, nil
+}
+
+// RemoveMemFsStorage removes the in memory storage with the given identifier.
+// The files stored inside it are lost
+func RemoveMemFsStorage(storageID string) {
+	memStoragesMutex.Lock()
+	defer memStoragesMutex.Unlock()
+
+	delete(memStorages, storageID)
+}
+
+// Name returns the name for the Fs implementation
+func (fs MemFs) Name() string {
+	return memFsName
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs MemFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs MemFs) Stat(name string) (os.FileInfo, error) {
+	fs.storage.RLock()
+	defer fs.storage.RUnlock()
+
+	_, node, err := fs.followSymlinks(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return node.getFileInfo(path.Base(path.Clean(name))), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs MemFs) Lstat(name string) (os.FileInfo, error) {
+	fs.storage.RLock()
+	defer fs.storage.RUnlock()
+
+	name = path.Clean(name)
+	node, ok := fs.storage.nodes[name]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.getFileInfo(path.Base(name)), nil
+}
+
+// Open opens the named file for reading
+func (fs MemFs) Open(name string) (*os.File, FileReader, func(), error) {
+	fs.storage.RLock()
+	_, node, err := fs.followSymlinks(name)
+	var data []byte
+	if err == nil {
+		if node.isDir {
+			err = errors.New("is a directory")
+		} else {
+			// stored data are never modified in place, a write replaces the whole slice
+			data = node.data
+		}
+	}
+	fs.storage.RUnlock()
+	if err != nil {
+		return nil, nil, nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	r, w, err := pipeat.AsyncWriterPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	go func() {
+		n, err := w.Write(data)
+		w.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, nil, nil
+}
+
+// Create creates or opens the named file for writing.
+// If os.O_APPEND is set the received data will be appended to the existing file
+// (upload resume). If flag is 0 or os.O_TRUNC is set the file is replaced only
+// when the upload completes successfully
+func (fs MemFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	name = path.Clean(name)
+	isAtomic := flag == 0 || flag&os.O_TRUNC != 0
+	var initialData []byte
+	fs.storage.RLock()
+	node, err := fs.getNodeForWrite(name)
+	if err == nil && node != nil && !isAtomic {
+		initialData = node.data
+	}
+	fs.storage.RUnlock()
+	if err != nil {
+		return nil, nil, nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	if flag&os.O_APPEND != 0 && node == nil {
+		return nil, nil, nil, &os.PathError{Op: "create", Path: name, Err: os.ErrNotExist}
+	}
+	writeOffset := int64(0)
+	if flag&os.O_APPEND != 0 {
+		writeOffset = int64(len(initialData))
+	}
+	r, w, err := pipeat.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		buf := &memFsBuffer{
+			data:    append([]byte(nil), initialData...),
+			offset:  writeOffset,
+			maxSize: fs.getMaxFileSize(name),
+		}
+		n, err := io.Copy(buf, r)
+		if err == nil {
+			// the transfer was aborted, the received data are incomplete
+			err = ctx.Err()
+		}
+		if err == nil || !isAtomic {
+			if storeErr := fs.storeFile(name, buf.data); err == nil {
+				err = storeErr
+			}
+		}
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// Rename renames (moves) source to target
+func (fs MemFs) Rename(source, target string) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	source = path.Clean(source)
+	target = path.Clean(target)
+	node, ok := fs.storage.nodes[source]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: os.ErrNotExist}
+	}
+	if source == target {
+		return nil
+	}
+	if source == "/" || strings.HasPrefix(target, source+"/") {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: errors.New("invalid argument")}
+	}
+	if err := fs.checkParentDir(target); err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	if existing, ok := fs.storage.nodes[target]; ok {
+		if existing.isDir != node.isDir {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: errors.New("file type mismatch")}
+		}
+		if existing.isDir && fs.hasChildren(target) {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: errors.New("directory not empty")}
+		}
+		fs.storage.size -= int64(len(existing.data))
+	}
+	delete(fs.storage.nodes, source)
+	fs.storage.nodes[target] = node
+	if node.isDir {
+		prefix := source + "/"
+		for p, n := range fs.storage.nodes {
+			if strings.HasPrefix(p, prefix) {
+				delete(fs.storage.nodes, p)
+				fs.storage.nodes[path.Join(target, strings.TrimPrefix(p, prefix))] = n
+			}
+		}
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs MemFs) Remove(name string, isDir bool) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	name = path.Clean(name)
+	node, ok := fs.storage.nodes[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	if node.isDir && fs.hasChildren(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(fs.storage.nodes, name)
+	fs.storage.size -= int64(len(node.data))
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs MemFs) Mkdir(name string) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := fs.storage.nodes[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := fs.checkParentDir(name); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	fs.storage.nodes[name] = &memNode{
+		isDir:   true,
+		mode:    os.ModeDir | 0755,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs MemFs) Symlink(source, target string) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	source = path.Clean(source)
+	target = path.Clean(target)
+	if _, ok := fs.storage.nodes[target]; ok {
+		return &os.LinkError{Op: "symlink", Old: source, New: target, Err: os.ErrExist}
+	}
+	if err := fs.checkParentDir(target); err != nil {
+		return &os.LinkError{Op: "symlink", Old: source, New: target, Err: err}
+	}
+	fs.storage.nodes[target] = &memNode{
+		target:  source,
+		mode:    os.ModeSymlink | 0777,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (fs MemFs) Chown(name string, uid int, gid int) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	_, node, err := fs.followSymlinks(name)
+	if err != nil {
+		return &os.PathError{Op: "chown", Path: name, Err: err}
+	}
+	node.uid = uid
+	node.gid = gid
+	return nil
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs MemFs) Chmod(name string, mode os.FileMode) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	_, node, err := fs.followSymlinks(name)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	node.mode = (node.mode &^ os.ModePerm) | (mode & os.ModePerm)
+	return nil
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (fs MemFs) Chtimes(name string, atime, mtime time.Time) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	_, node, err := fs.followSymlinks(name)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs MemFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.storage.RLock()
+	defer fs.storage.RUnlock()
+
+	dirname, node, err := fs.followSymlinks(dirname)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: err}
+	}
+	if !node.isDir {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: errors.New("not a directory")}
+	}
+	var result []os.FileInfo
+	for p, n := range fs.storage.nodes {
+		if p != "/" && path.Dir(p) == dirname {
+			result = append(result, n.getFileInfo(path.Base(p)))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported
+func (MemFs) IsUploadResumeSupported() bool {
+	return true
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// MemFs replaces a file only after a successful upload,
+// so SFTPGo doesn't need to do anything
+func (MemFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (MemFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (MemFs) IsPermission(err error) bool {
+	return os.IsPermission(err)
+}
+
+// CheckRootPath does nothing for MemFs, the root directory always exists
+func (MemFs) CheckRootPath(username string, uid int, gid int) bool {
+	return true
+}
+
+// ScanRootDirContents returns the number of files and their size
+func (fs MemFs) ScanRootDirContents() (int, int64, error) {
+	fs.storage.RLock()
+	defer fs.storage.RUnlock()
+
+	numFiles := 0
+	for _, n := range fs.storage.nodes {
+		if !n.isDir && !n.isSymlink() {
+			numFiles++
+		}
+	}
+	return numFiles, fs.storage.size, nil
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// MemFs handles atomic uploads itself, we never call this method for MemFs
+func (MemFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the filesystem root.
+// This is the path as seen by SFTP users
+func (MemFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if !path.IsAbs(rel) {
+		rel = path.Clean("/" + rel)
+	}
+	return rel
+}
+
+// Join joins any number of path elements into a single path
+func (MemFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path
+func (MemFs) ResolvePath(sftpPath string) (string, error) {
+	return path.Clean("/" + sftpPath), nil
+}
+
+// Close releases the memory storage. If ClearOnLogout is set the stored files
+// are removed when the last filesystem using the storage is closed
+func (fs MemFs) Close() error {
+	fs.closeOnce.Do(func() {
+		memStoragesMutex.Lock()
+		defer memStoragesMutex.Unlock()
+
+		fs.storage.refs--
+		if fs.storage.refs <= 0 && fs.config.ClearOnLogout && memStorages[fs.config.StorageID] == fs.storage {
+			delete(memStorages, fs.config.StorageID)
+			fsLog(fs, logger.LevelDebug, "no more connections, memory storage %#v cleared", fs.config.StorageID)
+		}
+	})
+	return nil
+}
+
+// followSymlinks returns the node for the given path resolving the symlinks.
+// The storage lock must be held by the caller
+func (fs MemFs) followSymlinks(name string) (string, *memNode, error) {
+	name = path.Clean(name)
+	for i := 0; i <= memFsMaxSymlinks; i++ {
+		node, ok := fs.storage.nodes[name]
+		if !ok {
+			return name, nil, os.ErrNotExist
+		}
+		if !node.isSymlink() {
+			return name, node, nil
+		}
+		name = node.target
+	}
+	return name, nil, errors.New("too many levels of symbolic links")
+}
+
+// getNodeForWrite returns the existing file for the given path, if any.
+// The storage lock must be held by the caller
+func (fs MemFs) getNodeForWrite(name string) (*memNode, error) {
+	if err := fs.checkParentDir(name); err != nil {
+		return nil, err
+	}
+	node, ok := fs.storage.nodes[name]
+	if !ok {
+		return nil, nil
+	}
+	if node.isDir || node.isSymlink() {
+		return nil, errors.New("not a regular file")
+	}
+	return node, nil
+}
+
+// checkParentDir returns an error if the parent for the given path is not an
+// existing directory. The storage lock must be held by the caller
+func (fs MemFs) checkParentDir(name string) error {
+	parent, ok := fs.storage.nodes[path.Dir(name)]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !parent.isDir {
+		return errors.New("not a directory")
+	}
+	return nil
+}
+
+// hasChildren returns true if the given directory is not empty.
+// The storage lock must be held by the caller
+func (fs MemFs) hasChildren(dirname string) bool {
+	prefix := dirname + "/"
+	for p := range fs.storage.nodes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMaxFileSize returns the maximum size allowed for the given file
+// based on the current storage usage. 0 means unlimited
+func (fs MemFs) getMaxFileSize(name string) int64 {
+	if fs.config.MaxSize <= 0 {
+		return 0
+	}
+	fs.storage.RLock()
+	defer fs.storage.RUnlock()
+
+	available := fs.config.MaxSize - fs.storage.size
+	if node, ok := fs.storage.nodes[name]; ok {
+		available += int64(len(node.data))
+	}
+	if available <= 0 {
+		// a negative value would mean unlimited
+		return -1
+	}
+	return available
+}
+
+func (fs MemFs) storeFile(name string, data []byte) error {
+	fs.storage.Lock()
+	defer fs.storage.Unlock()
+
+	node, err := fs.getNodeForWrite(name)
+	if err != nil {
+		return err
+	}
+	oldSize := int64(0)
+	if node != nil {
+		oldSize = int64(len(node.data))
+	}
+	// concurrent uploads are checked against the size limit only here
+	if fs.config.MaxSize > 0 && fs.storage.size-oldSize+int64(len(data)) > fs.config.MaxSize {
+		return ErrMemFsFull
+	}
+	if node == nil {
+		node = &memNode{
+			mode: 0644,
+		}
+		fs.storage.nodes[name] = node
+	}
+	node.data = data
+	node.modTime = time.Now()
+	fs.storage.size += int64(len(data)) - oldSize
+	return nil
+}
+
+// memFsBuffer is an io.Writer that writes to a byte slice
+// starting from the given offset
+type memFsBuffer struct {
+	data    []byte
+	offset  int64
+	maxSize int64
+}
+
+func (b *memFsBuffer) Write(p []byte) (int, error) {
+	end := b.offset + int64(len(p))
+	if b.maxSize != 0 && (b.maxSize < 0 || end > b.maxSize) {
+		return 0, ErrMemFsFull
+	}
+	if end > int64(len(b.data)) {
+		if end > int64(cap(b.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, b.data)
+			b.data = data
+		} else {
+			b.data = b.data[:end]
+		}
+	}
+	copy(b.data[b.offset:], p)
+	b.offset = end
+	return len(p), nil
+}
@@ -0,0 +1,201 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataCacheMaxEntries is the maximum number of entries for each cache,
+// if it is exceeded the expired entries are removed and if this is not enough
+// the cache is cleared
+const metadataCacheMaxEntries = 10000
+
+var (
+	metadataCacheTTL time.Duration
+)
+
+// SetMetadataCacheTTL sets the time to live for the cached metadata of the cloud
+// storage filesystems. The metadata are cached for each connection and they are
+// invalidated by the connection's own writes, renames and removes.
+// 0 disables the cache
+func SetMetadataCacheTTL(ttl time.Duration) {
+	metadataCacheTTL = ttl
+}
+
+type cachedStat struct {
+	info    os.FileInfo
+	expires time.Time
+}
+
+type cachedDir struct {
+	contents []os.FileInfo
+	expires  time.Time
+}
+
+// metadataCache caches the results of Stat and ReadDir so the repeated requests
+// for the same paths, common for GUI clients, don't hit the cloud storage.
+// A nil cache is valid and caches nothing
+type metadataCache struct {
+	sync.RWMutex
+	ttl    time.Duration
+	stats  map[string]cachedStat
+	dirs   map[string]cachedDir
+	onHit  func()
+	onMiss func()
+}
+
+// newMetadataCache returns a new cache using the configured TTL or nil if the cache is disabled.
+// onHit and onMiss are called for each lookup, they are used to update the metrics
+func newMetadataCache(onHit, onMiss func()) *metadataCache {
+	if metadataCacheTTL <= 0 {
+		return nil
+	}
+	return &metadataCache{
+		ttl:    metadataCacheTTL,
+		stats:  make(map[string]cachedStat),
+		dirs:   make(map[string]cachedDir),
+		onHit:  onHit,
+		onMiss: onMiss,
+	}
+}
+
+func (c *metadataCache) getStat(name string) (os.FileInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	name = cleanCacheKey(name)
+	now := time.Now()
+	c.RLock()
+	defer c.RUnlock()
+
+	if s, ok := c.stats[name]; ok && now.Before(s.expires) {
+		c.onHit()
+		return s.info, true
+	}
+	// the file info can be found inside the cached parent directory too
+	if d, ok := c.dirs[cleanCacheKey(path.Dir(name))]; ok && now.Before(d.expires) {
+		baseName := path.Base(name)
+		for _, fi := range d.contents {
+			if fi.Name() == baseName {
+				c.onHit()
+				return NewFileInfo(name, fi.IsDir(), fi.Size(), fi.ModTime()), true
+			}
+		}
+	}
+	c.onMiss()
+	return nil, false
+}
+
+func (c *metadataCache) setStat(name string, info os.FileInfo) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.stats) >= metadataCacheMaxEntries {
+		c.removeExpired()
+	}
+	c.stats[cleanCacheKey(name)] = cachedStat{
+		info:    info,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+func (c *metadataCache) getDir(dirname string) ([]os.FileInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.RLock()
+	defer c.RUnlock()
+
+	if d, ok := c.dirs[cleanCacheKey(dirname)]; ok && time.Now().Before(d.expires) {
+		c.onHit()
+		// the caller could modify the returned slice
+		contents := make([]os.FileInfo, len(d.contents))
+		copy(contents, d.contents)
+		return contents, true
+	}
+	c.onMiss()
+	return nil, false
+}
+
+func (c *metadataCache) setDir(dirname string, contents []os.FileInfo) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.dirs) >= metadataCacheMaxEntries {
+		c.removeExpired()
+	}
+	cached := make([]os.FileInfo, len(contents))
+	copy(cached, contents)
+	c.dirs[cleanCacheKey(dirname)] = cachedDir{
+		contents: cached,
+		expires:  time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate removes the cached metadata for the given paths, for their
+// parent directories and, for directories, for their contents
+func (c *metadataCache) invalidate(names ...string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	for _, name := range names {
+		name = cleanCacheKey(name)
+		delete(c.stats, name)
+		delete(c.dirs, name)
+		delete(c.dirs, cleanCacheKey(path.Dir(name)))
+		dirPrefix := name + "/"
+		for k := range c.stats {
+			if strings.HasPrefix(k, dirPrefix) {
+				delete(c.stats, k)
+			}
+		}
+		for k := range c.dirs {
+			if strings.HasPrefix(k, dirPrefix) {
+				delete(c.dirs, k)
+			}
+		}
+	}
+}
+
+// removeExpired must be called with the lock held
+func (c *metadataCache) removeExpired() {
+	now := time.Now()
+	for k, v := range c.stats {
+		if !now.Before(v.expires) {
+			delete(c.stats, k)
+		}
+	}
+	for k, v := range c.dirs {
+		if !now.Before(v.expires) {
+			delete(c.dirs, k)
+		}
+	}
+	if len(c.stats) >= metadataCacheMaxEntries {
+		c.stats = make(map[string]cachedStat)
+	}
+	if len(c.dirs) >= metadataCacheMaxEntries {
+		c.dirs = make(map[string]cachedDir)
+	}
+}
+
+// cleanCacheKey returns the same key for the different forms of a path:
+// with or without the leading and trailing slashes
+func cleanCacheKey(name string) string {
+	name = strings.Trim(name, "/")
+	if name == "." {
+		return ""
+	}
+	return name
+}
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,7 +56,7 @@ func (OsFs) Lstat(name string) (os.FileInfo, error) {
 }
 
 // Open opens the named file for reading
-func (OsFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+func (OsFs) Open(name string) (*os.File, FileReader, func(), error) {
 	f, err := os.Open(name)
 	return f, nil, nil, err
 }
@@ -153,22 +154,15 @@ func (fs OsFs) CheckRootPath(username string, uid int, gid int) bool {
 // ScanRootDirContents returns the number of files contained in a directory and
 // their size
 func (fs OsFs) ScanRootDirContents() (int, int64, error) {
-	numFiles := 0
-	size := int64(0)
-	isDir, err := IsDirectory(fs, fs.rootDir)
-	if err == nil && isDir {
-		err = filepath.Walk(fs.rootDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info != nil && info.Mode().IsRegular() {
-				size += info.Size()
-				numFiles++
-			}
-			return err
-		})
-	}
-	return numFiles, size, err
+	return fs.ScanRootDirContentsWithOptions(context.Background(), ScanOptions{}, &ScanProgress{})
+}
+
+// ScanRootDirContentsWithOptions returns the number of files contained in a directory
+// and their size scanning up to options.Parallelism sub directories concurrently
+func (fs OsFs) ScanRootDirContentsWithOptions(ctx context.Context, options ScanOptions, progress *ScanProgress) (int, int64, error) {
+	return newLocalScanner(ctx, fs.rootDir, options, progress, func(name string, info os.FileInfo) (bool, int64, error) {
+		return true, info.Size(), nil
+	}).scan()
 }
 
 // GetAtomicUploadPath returns the path to use for an atomic upload
@@ -196,6 +190,12 @@ func (OsFs) Join(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
+// Close releases the resources associated to this Fs implementation.
+// There is nothing to release for OsFs
+func (OsFs) Close() error {
+	return nil
+}
+
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs OsFs) ResolvePath(sftpPath string) (string, error) {
 	if !filepath.IsAbs(fs.rootDir) {
@@ -0,0 +1,338 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// directories modified, or containing files modified, less than this time before the scan start
+// are not saved inside the summary, a change in the same modification time unit would be missed
+const quotaScanSummaryMinAge = 2 * time.Second
+
+// ScanOptions defines the options for a quota scan
+type ScanOptions struct {
+	// maximum number of directories, or prefixes for object storages, scanned concurrently.
+	// Values lesser than 1 means 1
+	Parallelism int
+	// path of the file to use to persist the summary for each scanned directory.
+	// Empty means no summary. Summaries are supported for the local filesystems only
+	SummaryFile string
+	// if true the files inside the directories whose modification time and files, with
+	// their size and modification time, match the summary are not evaluated again
+	Incremental bool
+}
+
+func (o ScanOptions) getParallelism() int {
+	if o.Parallelism < 1 {
+		return 1
+	}
+	return o.Parallelism
+}
+
+// ScanProgress tracks the number of files, and their size, scanned so far.
+// The zero value is ready to use and it is safe for concurrent use
+type ScanProgress struct {
+	files int64
+	size  int64
+}
+
+// Get returns the number of files and their size scanned so far
+func (p *ScanProgress) Get() (int, int64) {
+	return int(atomic.LoadInt64(&p.files)), atomic.LoadInt64(&p.size)
+}
+
+func (p *ScanProgress) add(numFiles int, size int64) {
+	atomic.AddInt64(&p.files, int64(numFiles))
+	atomic.AddInt64(&p.size, size)
+}
+
+// ContentsScanner is implemented by the Fs that support parallel and cancellable quota scans
+type ContentsScanner interface {
+	ScanRootDirContentsWithOptions(ctx context.Context, options ScanOptions, progress *ScanProgress) (int, int64, error)
+}
+
+// ScanFsContents returns the number of files contained in the root directory of fs
+// and their size. The scan is stopped as soon as ctx is cancelled.
+// If fs does not support parallel scans ScanRootDirContents is used
+func ScanFsContents(ctx context.Context, fs Fs, options ScanOptions, progress *ScanProgress) (int, int64, error) {
+	if scanner, ok := fs.(ContentsScanner); ok {
+		return scanner.ScanRootDirContentsWithOptions(ctx, options, progress)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	numFiles, size, err := fs.ScanRootDirContents()
+	if err != nil {
+		return numFiles, size, err
+	}
+	progress.add(numFiles, size)
+	return numFiles, size, ctx.Err()
+}
+
+// dirSummary defines the contents of a directory as found in the last scan
+type dirSummary struct {
+	// modification time as unix timestamp in nanoseconds
+	ModTime int64 `json:"mtime"`
+	// number of files directly inside the directory and their size
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// names of the sub directories
+	Dirs []string `json:"dirs,omitempty"`
+	// fingerprint of the names, sizes and modification times for the files directly inside
+	// the directory. Overwriting a file in place does not change the directory modification time
+	Checksum uint64 `json:"checksum"`
+	// latest modification time for the directory and the files inside it
+	lastModTime int64
+}
+
+type scanSummary struct {
+	RootDir string `json:"root_dir"`
+	// the key is the directory path relative to the root directory
+	Dirs map[string]dirSummary `json:"dirs"`
+}
+
+// localScanner scans a local directory tree using up to parallelism goroutines.
+// fileSize returns if a regular file must be counted and its size
+type localScanner struct {
+	ctx         context.Context
+	rootDir     string
+	fileSize    func(name string, info os.FileInfo) (bool, int64, error)
+	progress    *ScanProgress
+	summaryFile string
+	minModTime  int64
+	previous    map[string]dirSummary
+	current     map[string]dirSummary
+	sem         chan struct{}
+	wg          sync.WaitGroup
+	sync.Mutex
+	numFiles int
+	size     int64
+	err      error
+}
+
+func newLocalScanner(ctx context.Context, rootDir string, options ScanOptions, progress *ScanProgress,
+	fileSize func(name string, info os.FileInfo) (bool, int64, error)) *localScanner {
+	s := &localScanner{
+		ctx:         ctx,
+		rootDir:     rootDir,
+		fileSize:    fileSize,
+		progress:    progress,
+		summaryFile: options.SummaryFile,
+		minModTime:  time.Now().Add(-quotaScanSummaryMinAge).UnixNano(),
+		previous:    make(map[string]dirSummary),
+		current:     make(map[string]dirSummary),
+		// the calling goroutine counts as a worker
+		sem: make(chan struct{}, options.getParallelism()-1),
+	}
+	if len(s.summaryFile) > 0 && options.Incremental {
+		s.previous = readScanSummary(s.summaryFile, rootDir)
+	}
+	return s
+}
+
+func (s *localScanner) scan() (int, int64, error) {
+	info, err := os.Stat(s.rootDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !info.IsDir() {
+		return 0, 0, nil
+	}
+	s.scanDir("/", info)
+	s.wg.Wait()
+	if s.err == nil {
+		s.err = s.ctx.Err()
+	}
+	if s.err == nil && len(s.summaryFile) > 0 {
+		if err := writeScanSummary(s.summaryFile, scanSummary{RootDir: s.rootDir, Dirs: s.current}); err != nil {
+			// the scan result is still valid, the next scan will be a full one
+			os.Remove(s.summaryFile)
+		}
+	}
+	return s.numFiles, s.size, s.err
+}
+
+func (s *localScanner) hasError() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.err != nil
+}
+
+func (s *localScanner) setError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *localScanner) scanDir(relPath string, info os.FileInfo) {
+	if err := s.ctx.Err(); err != nil {
+		s.setError(err)
+		return
+	}
+	if s.hasError() {
+		return
+	}
+	var previous *dirSummary
+	if summary, ok := s.previous[relPath]; ok {
+		previous = &summary
+	}
+	summary, err := s.readDir(relPath, info, previous)
+	if err != nil {
+		s.setError(err)
+		return
+	}
+	s.Lock()
+	s.numFiles += summary.Files
+	s.size += summary.Size
+	if len(s.summaryFile) > 0 && summary.lastModTime < s.minModTime {
+		s.current[relPath] = summary
+	}
+	s.Unlock()
+	s.progress.add(summary.Files, summary.Size)
+
+	for _, name := range summary.Dirs {
+		dirPath := path.Join(relPath, name)
+		dirInfo, err := os.Lstat(filepath.Join(s.rootDir, filepath.FromSlash(dirPath)))
+		if err != nil {
+			// removed while scanning
+			if os.IsNotExist(err) {
+				continue
+			}
+			s.setError(err)
+			return
+		}
+		if !dirInfo.IsDir() {
+			continue
+		}
+		select {
+		case s.sem <- struct{}{}:
+			s.wg.Add(1)
+			go func() {
+				defer func() {
+					<-s.sem
+					s.wg.Done()
+				}()
+				s.scanDir(dirPath, dirInfo)
+			}()
+		default:
+			s.scanDir(dirPath, dirInfo)
+		}
+	}
+}
+
+// readDir returns the summary for the given directory. The files are evaluated again only
+// if the directory or its files changed since the previous summary
+func (s *localScanner) readDir(relPath string, info os.FileInfo, previous *dirSummary) (dirSummary, error) {
+	summary := dirSummary{
+		ModTime:     info.ModTime().UnixNano(),
+		lastModTime: info.ModTime().UnixNano(),
+	}
+	dirPath := filepath.Join(s.rootDir, filepath.FromSlash(relPath))
+	f, err := os.Open(dirPath)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+	var files []os.FileInfo
+	for {
+		list, err := f.Readdir(1000)
+		for _, fi := range list {
+			if fi.IsDir() {
+				summary.Dirs = append(summary.Dirs, fi.Name())
+			} else if fi.Mode().IsRegular() {
+				files = append(files, fi)
+				summary.Checksum += getFileChecksum(fi)
+				if modTime := fi.ModTime().UnixNano(); modTime > summary.lastModTime {
+					summary.lastModTime = modTime
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return summary, err
+		}
+		if err = s.ctx.Err(); err != nil {
+			return summary, err
+		}
+	}
+	if previous != nil && previous.ModTime == summary.ModTime && previous.Checksum == summary.Checksum {
+		summary.Files = previous.Files
+		summary.Size = previous.Size
+		return summary, nil
+	}
+	for idx, fi := range files {
+		count, size, err := s.fileSize(filepath.Join(dirPath, fi.Name()), fi)
+		if err != nil {
+			return summary, err
+		}
+		if count {
+			summary.Files++
+			summary.Size += size
+		}
+		if idx%1000 == 999 {
+			if err = s.ctx.Err(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, nil
+}
+
+// getFileChecksum returns a fingerprint for the given file, the fingerprints for the files
+// inside a directory are added together so the result does not depend on the listing order
+func getFileChecksum(fi os.FileInfo) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(fi.Name()))
+	h.Write([]byte{0})
+	h.Write([]byte(fmt.Sprintf("%v:%v", fi.Size(), fi.ModTime().UnixNano())))
+	return h.Sum64()
+}
+
+// readScanSummary returns the directory summaries for rootDir, an invalid
+// summary or a summary for a different root directory is ignored
+func readScanSummary(name, rootDir string) map[string]dirSummary {
+	var summary scanSummary
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return make(map[string]dirSummary)
+	}
+	if err = json.Unmarshal(content, &summary); err != nil || summary.RootDir != rootDir || summary.Dirs == nil {
+		return make(map[string]dirSummary)
+	}
+	return summary.Dirs
+}
+
+func writeScanSummary(name string, summary scanSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	tempPath := name + "." + xid.New().String()
+	if err = ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tempPath, name); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
@@ -2,16 +2,19 @@ package vfs
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -21,6 +24,8 @@ import (
 	"github.com/eikenb/pipeat"
 )
 
+const s3DefaultPartSize = 5
+
 // S3FsConfig defines the configuration for S3 based filesystem
 type S3FsConfig struct {
 	Bucket string `json:"bucket,omitempty"`
@@ -30,12 +35,42 @@ type S3FsConfig struct {
 	// folder. The prefix, if not empty, must not start with "/" and must
 	// end with "/".
 	// If empty the whole bucket contents will be available
-	KeyPrefix    string `json:"key_prefix,omitempty"`
-	Region       string `json:"region,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	Region    string `json:"region,omitempty"`
+	// AccessKey and AccessSecret are the static credentials to use.
+	// If both are empty the default AWS credential chain is used: environment
+	// variables, shared config file, web identity token file and instance role
 	AccessKey    string `json:"access_key,omitempty"`
 	AccessSecret string `json:"access_secret,omitempty"`
+	// RoleARN is the optional role to assume using the static credentials,
+	// or the default credential chain if no static credentials are set
+	RoleARN string `json:"role_arn,omitempty"`
+	// ExternalID is the optional external ID to use when assuming RoleARN
+	ExternalID   string `json:"external_id,omitempty"`
 	Endpoint     string `json:"endpoint,omitempty"`
 	StorageClass string `json:"storage_class,omitempty"`
+	// The buffer size (in MB) to use for multipart uploads. The minimum allowed part size is 5MB.
+	// If this value is set to zero, the default value (5MB) will be used. This is also the
+	// granularity for resuming interrupted uploads
+	UploadPartSize int64 `json:"upload_part_size,omitempty"`
+	// ServerSideEncryption is the server-side encryption algorithm requested for the
+	// uploaded objects: "AES256" for SSE-S3 or "aws:kms" for SSE-KMS.
+	// Leave empty to use the bucket default or to use a customer provided key
+	ServerSideEncryption string `json:"server_side_encryption,omitempty"`
+	// SSEKMSKeyID is the KMS key to use for SSE-KMS. If empty the AWS managed key is used.
+	// It can be set only if ServerSideEncryption is "aws:kms"
+	SSEKMSKeyID string `json:"sse_kms_key_id,omitempty"`
+	// SSECustomerKey is the base64 encoded 256 bit key to use for SSE-C.
+	// It cannot be used together with ServerSideEncryption. The objects written
+	// using a customer key can only be read, copied and inspected using the same key
+	SSECustomerKey string `json:"sse_customer_key,omitempty"`
+	// ObjectLockMode is the Object Lock retention mode, "GOVERNANCE" or "COMPLIANCE", applied to
+	// the objects uploaded inside the user's retention directories. The bucket must have Object
+	// Lock enabled. If empty the retention policies are enforced by SFTPGo only
+	ObjectLockMode string `json:"object_lock_mode,omitempty"`
+	// RetentionPolicies are the user's write-once retention policies, they are not stored
+	// with the filesystem configuration
+	RetentionPolicies []RetentionPolicy `json:"-"`
 }
 
 // S3Fs is a Fs implementation for Amazon S3 compatible object storage.
@@ -46,6 +81,7 @@ type S3Fs struct {
 	svc            *s3.S3
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	cache          *metadataCache
 }
 
 // NewS3Fs returns an S3Fs object that allows to interact with an s3 compatible
@@ -61,24 +97,44 @@ func NewS3Fs(connectionID, localTempDir string, config S3FsConfig) (Fs, error) {
 	if err := ValidateS3FsConfig(&fs.config); err != nil {
 		return fs, err
 	}
-	accessSecret, err := utils.DecryptData(fs.config.AccessSecret)
-	if err != nil {
-		return fs, err
+	if fs.config.UploadPartSize == 0 {
+		fs.config.UploadPartSize = s3DefaultPartSize
 	}
-	fs.config.AccessSecret = accessSecret
-	awsConfig := &aws.Config{
-		Region:      aws.String(fs.config.Region),
-		Credentials: credentials.NewStaticCredentials(fs.config.AccessKey, fs.config.AccessSecret, ""),
+	fs.config.UploadPartSize *= 1024 * 1024
+	if len(fs.config.SSECustomerKey) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(fs.config.SSECustomerKey)
+		if err != nil {
+			return fs, err
+		}
+		fs.config.SSECustomerKey = string(decoded)
 	}
-	if len(fs.config.Endpoint) > 0 {
-		awsConfig.Endpoint = aws.String(fs.config.Endpoint)
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	sessOptions := session.Options{
+		Config: aws.Config{
+			Region: aws.String(fs.config.Region),
+		},
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if len(fs.config.AccessKey) > 0 {
+		sessOptions.Config.Credentials = credentials.NewStaticCredentials(fs.config.AccessKey, fs.config.AccessSecret, "")
 	}
-	sess, err := session.NewSession(awsConfig)
+	sess, err := session.NewSessionWithOptions(sessOptions)
 	if err != nil {
 		return fs, err
 	}
-	fs.svc = s3.New(sess)
+	// the custom endpoint is for S3 only, it must not be used to assume the role
+	s3Config := aws.NewConfig()
+	if len(fs.config.Endpoint) > 0 {
+		s3Config.WithEndpoint(fs.config.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if len(fs.config.RoleARN) > 0 {
+		s3Config.WithCredentials(stscreds.NewCredentials(sess, fs.config.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if len(fs.config.ExternalID) > 0 {
+				p.ExternalID = aws.String(fs.config.ExternalID)
+			}
+		}))
+	}
+	fs.svc = s3.New(sess, s3Config)
+	fs.cache = newMetadataCache(metrics.S3MetadataCacheHit, metrics.S3MetadataCacheMiss)
 	return fs, nil
 }
 
@@ -94,6 +150,17 @@ func (fs S3Fs) ConnectionID() string {
 
 // Stat returns a FileInfo describing the named file
 func (fs S3Fs) Stat(name string) (os.FileInfo, error) {
+	if fi, ok := fs.cache.getStat(name); ok {
+		return fi, nil
+	}
+	fi, err := fs.stat(name)
+	if err == nil {
+		fs.cache.setStat(name, fi)
+	}
+	return fi, err
+}
+
+func (fs S3Fs) stat(name string) (os.FileInfo, error) {
 	var result FileInfo
 	if name == "/" || name == "." {
 		err := fs.checkIfBucketExists()
@@ -105,6 +172,10 @@ func (fs S3Fs) Stat(name string) (os.FileInfo, error) {
 	if "/"+fs.config.KeyPrefix == name+"/" {
 		return NewFileInfo(name, true, 0, time.Time{}), nil
 	}
+	// an interrupted upload is reported with the size uploaded so far, so the client can resume it
+	if state, err := fs.getInterruptedUpload(name); err == nil {
+		return NewFileInfo(name, false, state.getSize(), state.getModTime()), nil
+	}
 	prefix := path.Dir(name)
 	if prefix == "/" || prefix == "." {
 		prefix = ""
@@ -151,7 +222,7 @@ func (fs S3Fs) Lstat(name string) (os.FileInfo, error) {
 }
 
 // Open opens the named file for reading
-func (fs S3Fs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+func (fs S3Fs) Open(name string) (*os.File, FileReader, func(), error) {
 	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -162,8 +233,10 @@ func (fs S3Fs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error)
 		defer cancelFn()
 		key := name
 		n, err := downloader.DownloadWithContext(ctx, w, &s3.GetObjectInput{
-			Bucket: aws.String(fs.config.Bucket),
-			Key:    aws.String(key),
+			Bucket:               aws.String(fs.config.Bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:       utils.NilIfEmpty(fs.config.SSECustomerKey),
 		})
 		w.CloseWithError(err)
 		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
@@ -172,8 +245,13 @@ func (fs S3Fs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error)
 	return nil, r, cancelFn, nil
 }
 
-// Create creates or opens the named file for writing
+// Create creates or opens the named file for writing.
+// If os.O_APPEND is set in flag an interrupted upload for the named file is resumed
 func (fs S3Fs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	fs.cache.invalidate(name)
+	if fs.IsUploadResumeSupported() {
+		return fs.createResumable(name, flag)
+	}
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -183,15 +261,24 @@ func (fs S3Fs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, fu
 	go func() {
 		defer cancelFn()
 		key := name
+		lockMode, retainUntil := fs.getObjectLock(key)
 		response, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-			Bucket:       aws.String(fs.config.Bucket),
-			Key:          aws.String(key),
-			Body:         r,
-			StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
+			Bucket:                    aws.String(fs.config.Bucket),
+			Key:                       aws.String(key),
+			Body:                      r,
+			StorageClass:              utils.NilIfEmpty(fs.config.StorageClass),
+			ServerSideEncryption:      utils.NilIfEmpty(fs.config.ServerSideEncryption),
+			SSEKMSKeyId:               utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+			SSECustomerAlgorithm:      fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:            utils.NilIfEmpty(fs.config.SSECustomerKey),
+			ObjectLockMode:            lockMode,
+			ObjectLockRetainUntilDate: retainUntil,
 		}, func(u *s3manager.Uploader) {
 			u.Concurrency = 2
+			u.PartSize = fs.config.UploadPartSize
 		})
 		r.CloseWithError(err)
+		fs.cache.invalidate(name)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, response: %v, readed bytes: %v, err: %v",
 			name, response, r.GetReadedBytes(), err)
 		metrics.S3TransferCompleted(r.GetReadedBytes(), 0, err)
@@ -199,6 +286,43 @@ func (fs S3Fs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, fu
 	return nil, w, cancelFn, nil
 }
 
+func (fs S3Fs) createResumable(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	state, err := fs.getInterruptedUpload(name)
+	if flag&os.O_APPEND != 0 {
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("unable to resume upload for %#v: %v", name, err)
+		}
+		fsLog(fs, logger.LevelDebug, "resuming multipart upload, path: %#v, upload id: %#v, uploaded parts: %v",
+			name, state.UploadID, len(state.Parts))
+	} else {
+		if err == nil {
+			// a new upload replaces the interrupted one
+			fs.abortUpload(&state)
+		}
+		state = s3UploadState{
+			Endpoint: fs.config.Endpoint,
+			Bucket:   fs.config.Bucket,
+			Key:      name,
+		}
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		initialSize := state.getSize()
+		err := fs.resumableUpload(ctx, r, &state)
+		r.CloseWithError(err)
+		fs.cache.invalidate(name)
+		fsLog(fs, logger.LevelDebug, "resumable upload completed, path: %#v, upload id: %#v, initial size: %v, "+
+			"readed bytes: %v, err: %v", name, state.UploadID, initialSize, r.GetReadedBytes(), err)
+		metrics.S3TransferCompleted(r.GetReadedBytes(), 0, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
 // Rename renames (moves) source to target.
 // We don't support renaming non empty directories since we should
 // rename all the contents too and this could take long time: think
@@ -213,13 +337,13 @@ func (fs S3Fs) Rename(source, target string) error {
 	if source == target {
 		return nil
 	}
-	fi, err := fs.Stat(source)
+	fi, err := fs.stat(source)
 	if err != nil {
 		return err
 	}
 	copySource := fs.Join(fs.config.Bucket, source)
 	if fi.IsDir() {
-		contents, err := fs.ReadDir(source)
+		contents, err := fs.readDir(source)
 		if err != nil {
 			return err
 		}
@@ -233,24 +357,53 @@ func (fs S3Fs) Rename(source, target string) error {
 			target += "/"
 		}
 	}
+	if err = fs.copyObject(copySource, target, fi.IsDir()); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// CopyFile copies the source object to target server side
+func (fs S3Fs) CopyFile(source, target string) error {
+	if source == target {
+		return nil
+	}
+	return fs.copyObject(fs.Join(fs.config.Bucket, source), target, false)
+}
+
+// copyObject copies copySource, the source object including the bucket name, to the target key
+func (fs S3Fs) copyObject(copySource, target string, isDir bool) error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
-	_, err = fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
-		Bucket:     aws.String(fs.config.Bucket),
-		CopySource: aws.String(copySource),
-		Key:        aws.String(target),
+	var lockMode *string
+	var retainUntil *time.Time
+	if !isDir {
+		// the copy is a new object, its retention starts now
+		lockMode, retainUntil = fs.getObjectLock(target)
+	}
+	_, err := fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:                         aws.String(fs.config.Bucket),
+		CopySource:                     aws.String(copySource),
+		Key:                            aws.String(target),
+		ServerSideEncryption:           utils.NilIfEmpty(fs.config.ServerSideEncryption),
+		SSEKMSKeyId:                    utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+		SSECustomerAlgorithm:           fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:                 utils.NilIfEmpty(fs.config.SSECustomerKey),
+		CopySourceSSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       utils.NilIfEmpty(fs.config.SSECustomerKey),
+		ObjectLockMode:                 lockMode,
+		ObjectLockRetainUntilDate:      retainUntil,
 	})
 	metrics.S3CopyObjectCompleted(err)
-	if err != nil {
-		return err
-	}
-	return fs.Remove(source, fi.IsDir())
+	fs.cache.invalidate(target)
+	return err
 }
 
 // Remove removes the named file or (empty) directory.
 func (fs S3Fs) Remove(name string, isDir bool) error {
+	defer fs.cache.invalidate(name)
 	if isDir {
-		contents, err := fs.ReadDir(name)
+		contents, err := fs.readDir(name)
 		if err != nil {
 			return err
 		}
@@ -260,6 +413,10 @@ func (fs S3Fs) Remove(name string, isDir bool) error {
 		if !strings.HasSuffix(name, "/") {
 			name += "/"
 		}
+	} else if state, err := fs.getInterruptedUpload(name); err == nil {
+		if err = fs.abortUpload(&state); err != nil {
+			return err
+		}
 	}
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
@@ -313,6 +470,17 @@ func (S3Fs) Chtimes(name string, atime, mtime time.Time) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if contents, ok := fs.cache.getDir(dirname); ok {
+		return contents, nil
+	}
+	contents, err := fs.readDir(dirname)
+	if err == nil {
+		fs.cache.setDir(dirname, contents)
+	}
+	return contents, err
+}
+
+func (fs S3Fs) readDir(dirname string) ([]os.FileInfo, error) {
 	var result []os.FileInfo
 	// dirname deve essere già cleaned
 	prefix := ""
@@ -345,13 +513,36 @@ func (fs S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 		return true
 	})
 	metrics.S3ListObjectsCompleted(err)
+	if err == nil {
+		result = fs.addInterruptedUploads(result, prefix)
+	}
 	return result, err
 }
 
+// addInterruptedUploads adds to the directory listing the interrupted uploads
+// for files inside the specified prefix
+func (fs S3Fs) addInterruptedUploads(result []os.FileInfo, prefix string) []os.FileInfo {
+	uploads := fs.getInterruptedUploads(prefix)
+	if len(uploads) == 0 {
+		return result
+	}
+	for idx, fi := range result {
+		if state, ok := uploads[fi.Name()]; ok && !fi.IsDir() {
+			result[idx] = NewFileInfo(fi.Name(), false, state.getSize(), state.getModTime())
+			delete(uploads, fi.Name())
+		}
+	}
+	for name, state := range uploads {
+		result = append(result, NewFileInfo(name, false, state.getSize(), state.getModTime()))
+	}
+	return result
+}
+
 // IsUploadResumeSupported returns true if upload resume is supported.
-// SFTP Resume is not supported on S3
+// SFTP Resume is supported on S3 for interrupted multipart uploads if
+// the directory to persist their state is configured
 func (S3Fs) IsUploadResumeSupported() bool {
-	return false
+	return len(s3UploadsStateDir) > 0
 }
 
 // IsAtomicUploadSupported returns true if atomic upload is supported.
@@ -424,6 +615,88 @@ func (fs S3Fs) ScanRootDirContents() (int, int64, error) {
 	return numFiles, size, err
 }
 
+// ScanRootDirContentsWithOptions returns the number of files contained in the bucket,
+// and their size. The prefixes at the first level are listed concurrently using up
+// to options.Parallelism goroutines. Incremental scans are not supported
+func (fs S3Fs) ScanRootDirContentsWithOptions(ctx context.Context, options ScanOptions, progress *ScanProgress) (int, int64, error) {
+	var prefixes []string
+	numFiles, size, err := fs.scanPrefix(ctx, fs.config.KeyPrefix, &prefixes, progress)
+	if err != nil {
+		return numFiles, size, err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	prefixesChan := make(chan string)
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	for i := 0; i < options.getParallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prefix := range prefixesChan {
+				prefixFiles, prefixSize, prefixErr := fs.scanPrefix(ctx, prefix, nil, progress)
+				mu.Lock()
+				numFiles += prefixFiles
+				size += prefixSize
+				if prefixErr != nil && err == nil {
+					err = prefixErr
+					cancelFn()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, prefix := range prefixes {
+		select {
+		case prefixesChan <- prefix:
+		case <-ctx.Done():
+		}
+	}
+	close(prefixesChan)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return numFiles, size, err
+}
+
+// scanPrefix returns the number of objects inside the specified prefix and their size.
+// If prefixes is not nil the listing stops at the first delimiter and the common
+// prefixes are appended to it
+func (fs S3Fs) scanPrefix(ctx context.Context, prefix string, prefixes *[]string, progress *ScanProgress) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	ctx, cancelFn := context.WithTimeout(ctx, fs.ctxLongTimeout)
+	defer cancelFn()
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(fs.config.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	if prefixes != nil {
+		input.Delimiter = aws.String("/")
+	}
+	err := fs.svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		pageFiles := 0
+		pageSize := int64(0)
+		for _, fileObject := range page.Contents {
+			pageFiles++
+			pageSize += *fileObject.Size
+		}
+		if prefixes != nil {
+			for _, p := range page.CommonPrefixes {
+				*prefixes = append(*prefixes, *p.Prefix)
+			}
+		}
+		numFiles += pageFiles
+		size += pageSize
+		progress.add(pageFiles, pageSize)
+		return true
+	})
+	metrics.S3ListObjectsCompleted(err)
+	return numFiles, size, err
+}
+
 // GetAtomicUploadPath returns the path to use for an atomic upload.
 // S3 uploads are already atomic, we never call this method for S3
 func (S3Fs) GetAtomicUploadPath(name string) string {
@@ -454,6 +727,12 @@ func (S3Fs) Join(elem ...string) string {
 	return path.Join(elem...)
 }
 
+// Close releases the resources associated to this Fs implementation.
+// There is nothing to release for S3Fs
+func (S3Fs) Close() error {
+	return nil
+}
+
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs S3Fs) ResolvePath(sftpPath string) (string, error) {
 	if !path.IsAbs(sftpPath) {
@@ -503,8 +782,33 @@ func (fs *S3Fs) getObjectDetails(key string) (*s3.HeadObjectOutput, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	input := &s3.HeadObjectInput{
-		Bucket: aws.String(fs.config.Bucket),
-		Key:    aws.String(key),
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       utils.NilIfEmpty(fs.config.SSECustomerKey),
 	}
 	return fs.svc.HeadObjectWithContext(ctx, input)
 }
+
+// getSSECustomerAlgorithm returns the algorithm to send together with the
+// customer provided encryption key, nil if SSE-C is not configured
+func (fs *S3Fs) getSSECustomerAlgorithm() *string {
+	if len(fs.config.SSECustomerKey) == 0 {
+		return nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256)
+}
+
+// getObjectLock returns the Object Lock mode and retain until date for a new
+// object with the given key. Both are nil if the object must not be locked
+func (fs *S3Fs) getObjectLock(key string) (*string, *time.Time) {
+	if len(fs.config.ObjectLockMode) == 0 {
+		return nil, nil
+	}
+	policy, ok := GetRetentionPolicyForPath(fs.config.RetentionPolicies, fs.GetRelativePath(key))
+	if !ok {
+		return nil, nil
+	}
+	retainUntil := time.Now().Add(time.Duration(policy.Days) * 24 * time.Hour).UTC()
+	return aws.String(fs.config.ObjectLockMode), &retainUntil
+}
@@ -0,0 +1,498 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/utils"
+)
+
+const (
+	s3UploadStateSuffix = ".json"
+	// S3 limits for multipart uploads
+	s3MaxUploadParts    = 10000
+	s3MaxUploadPartSize = 5 * 1024 * 1024 * 1024
+	// the part size is doubled every s3PartSizeStep parts, so the S3 parts limit
+	// is reached only for objects near the S3 maximum object size
+	s3PartSizeStep = 1000
+	// parts uploaded in parallel for resumable uploads
+	s3UploadConcurrency = 2
+	// parts bigger than this are spooled to a temporary file instead of being kept in memory,
+	// so an upload never needs more than (s3UploadConcurrency + 1) * s3MaxMemoryPartSize bytes of memory
+	s3MaxMemoryPartSize = 64 * 1024 * 1024
+)
+
+var (
+	// directory where the state of the in progress S3 multipart uploads is persisted.
+	// If empty the state is not persisted and S3 uploads cannot be resumed
+	s3UploadsStateDir  string
+	errNoS3UploadState = errors.New("no interrupted upload found")
+	errS3TooManyParts  = fmt.Errorf("the upload exceeds the maximum number of parts allowed by S3: %v", s3MaxUploadParts)
+)
+
+// SetS3UploadsStateDir sets the directory to use to persist the state of
+// the in progress S3 multipart uploads. Uploads interrupted by a client
+// disconnection can be resumed only if this directory is set.
+// An empty path disables S3 upload resume
+func SetS3UploadsStateDir(dir string) error {
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	s3UploadsStateDir = dir
+	return nil
+}
+
+// HasStaleS3Uploads returns true if there is at least an interrupted S3 upload
+// not updated for more than maxAge
+func HasStaleS3Uploads(maxAge time.Duration) bool {
+	for _, state := range getS3UploadStates() {
+		if state.isStale(maxAge) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveOrphanS3UploadStates removes the persisted state for the interrupted
+// uploads not updated for more than maxAge and returns the number of removed
+// states. It must be called after AbortStaleUploads was executed for all the
+// configured S3 filesystems, so only the uploads that cannot be aborted, for
+// example because the user was removed, are left. These uploads are not aborted
+// and will still use space inside the bucket, a bucket lifecycle rule should be
+// used to cleanup them
+func RemoveOrphanS3UploadStates(maxAge time.Duration) int {
+	removed := 0
+	for _, state := range getS3UploadStates() {
+		if !state.isStale(maxAge) {
+			continue
+		}
+		if err := state.remove(); err == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// s3UploadPart defines a completed part for a multipart upload
+type s3UploadPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+}
+
+// s3UploadState defines the persisted state for a multipart upload
+type s3UploadState struct {
+	Endpoint string         `json:"endpoint"`
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	UploadID string         `json:"upload_id"`
+	Parts    []s3UploadPart `json:"parts"`
+	// last update as unix timestamp in milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func getS3UploadStatePath(endpoint, bucket, key string) string {
+	h := sha256.Sum256([]byte(endpoint + "\x00" + bucket + "\x00" + key))
+	return filepath.Join(s3UploadsStateDir, hex.EncodeToString(h[:])+s3UploadStateSuffix)
+}
+
+func loadS3UploadState(statePath string) (s3UploadState, error) {
+	var state s3UploadState
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	if err == nil && len(state.UploadID) == 0 {
+		err = errNoS3UploadState
+	}
+	state.trimParts()
+	return state, err
+}
+
+func getS3UploadStates() []s3UploadState {
+	var states []s3UploadState
+	if len(s3UploadsStateDir) == 0 {
+		return states
+	}
+	files, err := ioutil.ReadDir(s3UploadsStateDir)
+	if err != nil {
+		return states
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), s3UploadStateSuffix) {
+			continue
+		}
+		state, err := loadS3UploadState(filepath.Join(s3UploadsStateDir, fi.Name()))
+		if err == nil {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func (s *s3UploadState) getPath() string {
+	return getS3UploadStatePath(s.Endpoint, s.Bucket, s.Key)
+}
+
+func (s *s3UploadState) getSize() int64 {
+	var size int64
+	for _, p := range s.Parts {
+		size += p.Size
+	}
+	return size
+}
+
+// trimParts removes the parts after the first missing one. Parts are uploaded in
+// parallel, so an interrupted upload can have completed parts after a missing one,
+// they will be uploaded again when the upload is resumed
+func (s *s3UploadState) trimParts() {
+	sort.Slice(s.Parts, func(i, j int) bool {
+		return s.Parts[i].PartNumber < s.Parts[j].PartNumber
+	})
+	for idx, p := range s.Parts {
+		if p.PartNumber != int64(idx+1) {
+			s.Parts = s.Parts[:idx]
+			return
+		}
+	}
+}
+
+func (s *s3UploadState) getModTime() time.Time {
+	return utils.GetTimeFromMsecSinceEpoch(s.UpdatedAt)
+}
+
+func (s *s3UploadState) isStale(maxAge time.Duration) bool {
+	return time.Since(s.getModTime()) > maxAge
+}
+
+func (s *s3UploadState) save() error {
+	s.UpdatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	statePath := s.getPath()
+	tempPath := statePath + ".tmp"
+	err = ioutil.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, statePath)
+}
+
+func (s *s3UploadState) remove() error {
+	return os.Remove(s.getPath())
+}
+
+func (s *s3UploadState) getCompletedParts() []*s3.CompletedPart {
+	sort.Slice(s.Parts, func(i, j int) bool {
+		return s.Parts[i].PartNumber < s.Parts[j].PartNumber
+	})
+	var parts []*s3.CompletedPart
+	for _, p := range s.Parts {
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(p.PartNumber),
+		})
+	}
+	return parts
+}
+
+// getInterruptedUpload returns the persisted state for an interrupted multipart upload
+// for the specified key, if any
+func (fs *S3Fs) getInterruptedUpload(key string) (s3UploadState, error) {
+	if len(s3UploadsStateDir) == 0 {
+		return s3UploadState{}, errNoS3UploadState
+	}
+	return loadS3UploadState(getS3UploadStatePath(fs.config.Endpoint, fs.config.Bucket, key))
+}
+
+// getInterruptedUploads returns the interrupted uploads for the files inside the specified
+// prefix, the returned map has the file names as keys
+func (fs *S3Fs) getInterruptedUploads(prefix string) map[string]s3UploadState {
+	result := make(map[string]s3UploadState)
+	for _, state := range getS3UploadStates() {
+		if state.Endpoint != fs.config.Endpoint || state.Bucket != fs.config.Bucket {
+			continue
+		}
+		key := strings.TrimPrefix(state.Key, "/")
+		if path.Dir(key)+"/" == prefix || (prefix == "" && path.Dir(key) == ".") {
+			result[path.Base(key)] = state
+		}
+	}
+	return result
+}
+
+func (fs *S3Fs) abortUpload(state *s3UploadState) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err := fs.svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	if err == nil {
+		err = state.remove()
+	}
+	fsLog(fs, logger.LevelDebug, "abort multipart upload, key: %#v, upload id: %#v, err: %v", state.Key,
+		state.UploadID, err)
+	return err
+}
+
+// AbortStaleUploads aborts the interrupted multipart uploads, inside the bucket
+// and key prefix configured for this Fs, not updated for more than maxAge.
+// It returns the number of aborted uploads
+func (fs S3Fs) AbortStaleUploads(maxAge time.Duration) int {
+	aborted := 0
+	for _, state := range getS3UploadStates() {
+		if state.Endpoint != fs.config.Endpoint || state.Bucket != fs.config.Bucket ||
+			!strings.HasPrefix(state.Key, "/"+fs.config.KeyPrefix) || !state.isStale(maxAge) {
+			continue
+		}
+		if err := fs.abortUpload(&state); err == nil {
+			aborted++
+		} else {
+			fsLog(fs, logger.LevelWarn, "unable to abort stale multipart upload for key %#v: %v", state.Key, err)
+		}
+	}
+	return aborted
+}
+
+// getS3PartSize returns the size for the specified part number. The configured part size
+// is used for the first parts and it grows with the part number to stay below the
+// parts limit: the part sizes only depend on the part number so an upload can be resumed
+func getS3PartSize(partSize, partNumber int64) int64 {
+	for step := (partNumber - 1) / s3PartSizeStep; step > 0 && partSize < s3MaxUploadPartSize; step-- {
+		partSize *= 2
+	}
+	if partSize > s3MaxUploadPartSize {
+		return s3MaxUploadPartSize
+	}
+	return partSize
+}
+
+// resumableUpload reads the data to upload from r and uploads it using a
+// multipart upload. The upload state is persisted after each completed part.
+// If the context is canceled, for example because the client disconnected,
+// the upload is not completed and the persisted state is preserved, so the
+// upload can be resumed later
+func (fs *S3Fs) resumableUpload(parentCtx context.Context, r io.Reader, state *s3UploadState) error {
+	ctx, cancelFn := context.WithCancel(parentCtx)
+	defer cancelFn()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+	guard := make(chan struct{}, s3UploadConcurrency)
+	setUploadErr := func(err error) {
+		mu.Lock()
+		if uploadErr == nil {
+			uploadErr = err
+		}
+		mu.Unlock()
+		cancelFn()
+	}
+	partNumber := int64(len(state.Parts))
+	for {
+		partNumber++
+		part, readErr := readS3Part(r, getS3PartSize(fs.config.UploadPartSize, partNumber), fs.localTempDir)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			part.close()
+			setUploadErr(readErr)
+			break
+		}
+		if ctx.Err() != nil {
+			// the transfer was interrupted, the last partial part, if any, is discarded
+			part.close()
+			break
+		}
+		if part.size > 0 {
+			if partNumber > s3MaxUploadParts {
+				part.close()
+				setUploadErr(errS3TooManyParts)
+				break
+			}
+			if len(state.UploadID) == 0 {
+				if err := fs.createMultipartUpload(ctx, state); err != nil {
+					part.close()
+					setUploadErr(err)
+					break
+				}
+			}
+			select {
+			case guard <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				part.close()
+				break
+			}
+			wg.Add(1)
+			go func(partNumber int64, part *s3PartBuffer) {
+				defer func() {
+					part.close()
+					<-guard
+					wg.Done()
+				}()
+				if err := fs.uploadPart(ctx, &mu, state, partNumber, part); err != nil {
+					setUploadErr(err)
+				}
+			}(partNumber, part)
+		} else {
+			part.close()
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if parentCtx.Err() != nil {
+		return parentCtx.Err()
+	}
+	if uploadErr != nil {
+		return uploadErr
+	}
+	if len(state.UploadID) == 0 {
+		// empty file
+		lockMode, retainUntil := fs.getObjectLock(state.Key)
+		_, err := fs.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:                    aws.String(fs.config.Bucket),
+			Key:                       aws.String(state.Key),
+			Body:                      bytes.NewReader(nil),
+			StorageClass:              utils.NilIfEmpty(fs.config.StorageClass),
+			ServerSideEncryption:      utils.NilIfEmpty(fs.config.ServerSideEncryption),
+			SSEKMSKeyId:               utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+			SSECustomerAlgorithm:      fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:            utils.NilIfEmpty(fs.config.SSECustomerKey),
+			ObjectLockMode:            lockMode,
+			ObjectLockRetainUntilDate: retainUntil,
+		})
+		return err
+	}
+	_, err := fs.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: state.getCompletedParts(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return state.remove()
+}
+
+func (fs *S3Fs) createMultipartUpload(ctx context.Context, state *s3UploadState) error {
+	// the retention period for resumed uploads starts when the multipart upload is created
+	lockMode, retainUntil := fs.getObjectLock(state.Key)
+	res, err := fs.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                    aws.String(state.Bucket),
+		Key:                       aws.String(state.Key),
+		StorageClass:              utils.NilIfEmpty(fs.config.StorageClass),
+		ServerSideEncryption:      utils.NilIfEmpty(fs.config.ServerSideEncryption),
+		SSEKMSKeyId:               utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+		SSECustomerAlgorithm:      fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:            utils.NilIfEmpty(fs.config.SSECustomerKey),
+		ObjectLockMode:            lockMode,
+		ObjectLockRetainUntilDate: retainUntil,
+	})
+	if err != nil {
+		return err
+	}
+	state.UploadID = aws.StringValue(res.UploadId)
+	return state.save()
+}
+
+func (fs *S3Fs) uploadPart(ctx context.Context, mu *sync.Mutex, state *s3UploadState, partNumber int64,
+	part *s3PartBuffer) error {
+	res, err := fs.svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:               aws.String(state.Bucket),
+		Key:                  aws.String(state.Key),
+		UploadId:             aws.String(state.UploadID),
+		PartNumber:           aws.Int64(partNumber),
+		Body:                 part.reader(),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       utils.NilIfEmpty(fs.config.SSECustomerKey),
+	})
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	state.Parts = append(state.Parts, s3UploadPart{
+		PartNumber: partNumber,
+		ETag:       aws.StringValue(res.ETag),
+		Size:       part.size,
+	})
+	return state.save()
+}
+
+// s3PartBuffer holds the data for a part waiting to be uploaded, in memory or,
+// for the big parts, inside a temporary file
+type s3PartBuffer struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// readS3Part reads a part of at most partSize bytes from r. As io.ReadFull it returns
+// io.EOF if no data was read and io.ErrUnexpectedEOF if the part is incomplete.
+// The returned part must be closed, even if there is an error
+func readS3Part(r io.Reader, partSize int64, tempDir string) (*s3PartBuffer, error) {
+	if partSize <= s3MaxMemoryPartSize {
+		buf := make([]byte, partSize)
+		n, err := io.ReadFull(r, buf)
+		return &s3PartBuffer{data: buf[:n], size: int64(n)}, err
+	}
+	f, err := ioutil.TempFile(tempDir, "s3part")
+	if err != nil {
+		return &s3PartBuffer{}, err
+	}
+	part := &s3PartBuffer{file: f}
+	part.size, err = io.CopyN(f, r, partSize)
+	if err == io.EOF && part.size > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return part, err
+}
+
+func (p *s3PartBuffer) reader() io.ReadSeeker {
+	if p.file != nil {
+		return io.NewSectionReader(p.file, 0, p.size)
+	}
+	return bytes.NewReader(p.data)
+}
+
+func (p *s3PartBuffer) close() {
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+		p.file = nil
+	}
+	p.data = nil
+}
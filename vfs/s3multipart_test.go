@@ -0,0 +1,230 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/freshvolk/sftpgo/utils"
+)
+
+func setTestS3UploadsStateDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "s3_uploads")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	initialDir := s3UploadsStateDir
+	if err = SetS3UploadsStateDir(dir); err != nil {
+		t.Fatalf("unable to set the S3 uploads state dir: %v", err)
+	}
+	return func() {
+		s3UploadsStateDir = initialDir
+		os.RemoveAll(dir)
+	}
+}
+
+// writeS3UploadState writes the state as is, save sets the update time to now
+func writeS3UploadState(t *testing.T, state s3UploadState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("unable to marshal state: %v", err)
+	}
+	if err = ioutil.WriteFile(state.getPath(), data, 0600); err != nil {
+		t.Fatalf("unable to write state: %v", err)
+	}
+}
+
+func TestS3UploadStateTrimParts(t *testing.T) {
+	defer setTestS3UploadsStateDir(t)()
+
+	tests := []struct {
+		name          string
+		partNumbers   []int64
+		expectedParts int
+	}{
+		{"no parts", nil, 0},
+		{"all parts", []int64{1, 2, 3}, 3},
+		{"unordered parts", []int64{3, 1, 2}, 3},
+		{"gap", []int64{1, 2, 4, 5}, 2},
+		{"unordered parts with gap", []int64{5, 2, 1, 4}, 2},
+		{"first part missing", []int64{2, 3}, 0},
+	}
+	for _, test := range tests {
+		state := s3UploadState{
+			Endpoint: "endpoint",
+			Bucket:   "bucket",
+			Key:      "/key",
+			UploadID: "upload id",
+		}
+		for _, n := range test.partNumbers {
+			state.Parts = append(state.Parts, s3UploadPart{PartNumber: n, ETag: "etag", Size: 10})
+		}
+		if err := state.save(); err != nil {
+			t.Fatalf("%v: unable to save state: %v", test.name, err)
+		}
+		loaded, err := loadS3UploadState(state.getPath())
+		if err != nil {
+			t.Errorf("%v: unable to load state: %v", test.name, err)
+			continue
+		}
+		if len(loaded.Parts) != test.expectedParts || loaded.getSize() != int64(10*test.expectedParts) {
+			t.Errorf("%v: unexpected parts: %+v", test.name, loaded.Parts)
+		}
+		for idx, p := range loaded.getCompletedParts() {
+			if *p.PartNumber != int64(idx+1) {
+				t.Errorf("%v: unexpected completed part number %v at index %v", test.name, *p.PartNumber, idx)
+			}
+		}
+	}
+	state := s3UploadState{Endpoint: "endpoint", Bucket: "bucket", Key: "/key"}
+	writeS3UploadState(t, state)
+	_, err := loadS3UploadState(state.getPath())
+	if err != errNoS3UploadState {
+		t.Errorf("a state without upload id must be ignored, err: %v", err)
+	}
+	if len(getS3UploadStates()) != 0 {
+		t.Errorf("a state without upload id must not be listed")
+	}
+}
+
+func TestS3PartSize(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		partSize   int64
+		partNumber int64
+		expected   int64
+	}{
+		{5 * mb, 1, 5 * mb},
+		{5 * mb, 1000, 5 * mb},
+		{5 * mb, 1001, 10 * mb},
+		{5 * mb, 2000, 10 * mb},
+		{5 * mb, 2001, 20 * mb},
+		{5 * mb, 10000, 2560 * mb},
+		{100 * mb, 1001, 200 * mb},
+		{100 * mb, 10000, s3MaxUploadPartSize},
+		{3 * 1024 * mb, 1001, s3MaxUploadPartSize},
+	}
+	for _, test := range tests {
+		if size := getS3PartSize(test.partSize, test.partNumber); size != test.expected {
+			t.Errorf("unexpected size for part %v with part size %v: %v, expected: %v", test.partNumber,
+				test.partSize, size, test.expected)
+		}
+	}
+	// the sizes only depend on the part number and they never decrease
+	var total int64
+	for n := int64(1); n <= s3MaxUploadParts; n++ {
+		size := getS3PartSize(5*mb, n)
+		if n > 1 && size < getS3PartSize(5*mb, n-1) {
+			t.Errorf("the size for part %v is smaller than the previous one", n)
+		}
+		total += size
+	}
+	// with the default part size the maximum upload size is near to the 5 TB S3 limit
+	if total < 4*1024*1024*mb {
+		t.Errorf("unexpected maximum upload size: %v", total)
+	}
+}
+
+func TestS3UploadsMaxAge(t *testing.T) {
+	defer setTestS3UploadsStateDir(t)()
+
+	maxAge := 24 * time.Hour
+	if HasStaleS3Uploads(maxAge) {
+		t.Errorf("there are no interrupted uploads")
+	}
+	fresh := s3UploadState{Endpoint: "endpoint", Bucket: "bucket", Key: "/fresh", UploadID: "id1",
+		UpdatedAt: utils.GetTimeAsMsSinceEpoch(time.Now().Add(-maxAge + time.Minute))}
+	writeS3UploadState(t, fresh)
+	if HasStaleS3Uploads(maxAge) {
+		t.Errorf("an upload updated within the max age is not stale")
+	}
+	stale := s3UploadState{Endpoint: "endpoint", Bucket: "bucket", Key: "/stale", UploadID: "id2",
+		UpdatedAt: utils.GetTimeAsMsSinceEpoch(time.Now().Add(-maxAge - time.Minute))}
+	writeS3UploadState(t, stale)
+	if !HasStaleS3Uploads(maxAge) {
+		t.Errorf("an upload not updated within the max age is stale")
+	}
+	if removed := RemoveOrphanS3UploadStates(maxAge); removed != 1 {
+		t.Errorf("unexpected removed states: %v", removed)
+	}
+	if _, err := os.Stat(stale.getPath()); !os.IsNotExist(err) {
+		t.Errorf("the stale state must be removed, err: %v", err)
+	}
+	if _, err := os.Stat(fresh.getPath()); err != nil {
+		t.Errorf("the fresh state must be preserved, err: %v", err)
+	}
+	// saving the state updates the last update time
+	stale.Key = "/updated"
+	if err := stale.save(); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	if HasStaleS3Uploads(maxAge) {
+		t.Errorf("a saved upload is not stale")
+	}
+	if removed := RemoveOrphanS3UploadStates(0); removed != 2 {
+		t.Errorf("unexpected removed states: %v", removed)
+	}
+}
+
+func TestReadS3Part(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "s3_parts")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		name        string
+		partSize    int64
+		inFile      bool
+		expectedLen int
+		expectedErr error
+	}{
+		{"memory part", 600, false, 600, nil},
+		{"incomplete memory part", 2000, false, 1000, io.ErrUnexpectedEOF},
+		{"file part", s3MaxMemoryPartSize + 1, true, 1000, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		part, err := readS3Part(bytes.NewReader(data), test.partSize, tempDir)
+		if err != test.expectedErr {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		}
+		if (part.file != nil) != test.inFile || part.size != int64(test.expectedLen) {
+			t.Errorf("%v: unexpected part, in file: %v size: %v", test.name, part.file != nil, part.size)
+		}
+		// the part can be read more times, for example if the upload is retried
+		for i := 0; i < 2; i++ {
+			r := part.reader()
+			contents, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(contents, data[:test.expectedLen]) {
+				t.Errorf("%v: unexpected part contents, err: %v", test.name, err)
+			}
+			if _, err = r.Seek(0, io.SeekStart); err != nil {
+				t.Errorf("%v: unable to seek: %v", test.name, err)
+			}
+		}
+		part.close()
+	}
+	part, err := readS3Part(bytes.NewReader(nil), s3MaxMemoryPartSize+1, tempDir)
+	if err != io.EOF || part.size != 0 {
+		t.Errorf("unexpected result for an empty part, size: %v err: %v", part.size, err)
+	}
+	part.close()
+	files, err := ioutil.ReadDir(tempDir)
+	if err != nil || len(files) != 0 {
+		t.Errorf("the temporary files must be removed, files: %v err: %v", len(files), err)
+	}
+	_, err = readS3Part(bytes.NewReader(data), s3MaxMemoryPartSize+1, filepath.Join(tempDir, "missing"))
+	if err == nil {
+		t.Errorf("spooling a part to a missing dir must fail")
+	}
+}
@@ -0,0 +1,436 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/pkg/sftp"
+	"github.com/rs/xid"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sftpFsDialTimeout = 10 * time.Second
+	// prefix for the temporary files used for atomic uploads
+	sftpFsUploadPrefix = ".sftpgo-upload."
+)
+
+// SFTPFsConfig defines the configuration for a remote SFTP server based filesystem
+type SFTPFsConfig struct {
+	// Endpoint is the remote SFTP server address as host:port
+	Endpoint string `json:"endpoint,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Password and PrivateKey are stored encrypted.
+	// At least one between password and private key is required
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	// SHA256 fingerprints to use for host key verification, for example
+	// "SHA256:KNb3n1Bb6tTm5ITfS4qz/hJQq5CZcZHhTKeFr1pKyRk".
+	// At least one fingerprint is required, the remote host key must match one of them
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// Prefix is similar to a chroot directory for the local filesystem.
+	// If specified the SFTP user will only see the contents of this remote
+	// directory. It must be an absolute path, if empty the whole remote
+	// filesystem available to the remote user will be accessible
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// SFTPFs is a Fs implementation for a remote SFTP server.
+// The files are stored on the remote server while SFTPGo still
+// handles authentication, quotas, permissions and actions
+type SFTPFs struct {
+	connectionID string
+	localTempDir string
+	config       SFTPFsConfig
+	sshClient    *ssh.Client
+	sftpClient   *sftp.Client
+}
+
+// NewSFTPFs returns an SFTPFs object that allows to interact with a remote SFTP server
+func NewSFTPFs(connectionID, localTempDir string, config SFTPFsConfig) (Fs, error) {
+	fs := SFTPFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		config:       config,
+	}
+	if err := ValidateSFTPFsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	err := fs.connect()
+	return fs, err
+}
+
+// Name returns the name for the Fs implementation
+func (fs SFTPFs) Name() string {
+	return fmt.Sprintf("SFTPFs endpoint: %#v username: %#v", fs.config.Endpoint, fs.config.Username)
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs SFTPFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs SFTPFs) Stat(name string) (os.FileInfo, error) {
+	return fs.sftpClient.Stat(name)
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs SFTPFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.sftpClient.Lstat(name)
+}
+
+// Open opens the named file for reading
+func (fs SFTPFs) Open(name string) (*os.File, FileReader, func(), error) {
+	f, err := fs.sftpClient.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	go func() {
+		defer f.Close()
+		n, err := io.Copy(w, f)
+		w.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, nil, nil
+}
+
+// Create creates or opens the named file for writing.
+// If os.O_APPEND is set the received data will be appended to the existing file
+// (upload resume), otherwise the data is uploaded to a temporary file that will
+// be renamed to the target name once the upload completes successfully
+func (fs SFTPFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	uploadPath := name
+	isAtomic := flag == 0 || flag&os.O_TRUNC != 0
+	if isAtomic {
+		uploadPath = fs.getTempUploadPath(name)
+	}
+	remoteFlag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	resumeOffset := int64(0)
+	if flag&os.O_APPEND != 0 {
+		// the remote server could ignore the append flag so we explicitly start writing at the end of the file.
+		// The size must be read before opening the file: the remote server could move it while it is open
+		info, err := fs.sftpClient.Stat(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		resumeOffset = info.Size()
+		remoteFlag = os.O_WRONLY | os.O_APPEND
+	} else if !isAtomic {
+		remoteFlag = os.O_WRONLY
+	}
+	f, err := fs.sftpClient.OpenFile(uploadPath, remoteFlag)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if resumeOffset > 0 {
+		if _, err = f.Seek(resumeOffset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		if isAtomic {
+			fs.sftpClient.Remove(uploadPath)
+		}
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		n, err := io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			// the transfer was aborted, the received data are incomplete
+			err = ctx.Err()
+		}
+		if isAtomic {
+			if err == nil {
+				err = fs.renameUpload(uploadPath, name)
+			} else {
+				fs.sftpClient.Remove(uploadPath)
+			}
+		}
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// Rename renames (moves) source to target
+func (fs SFTPFs) Rename(source, target string) error {
+	return fs.sftpClient.Rename(source, target)
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs SFTPFs) Remove(name string, isDir bool) error {
+	if isDir {
+		return fs.sftpClient.RemoveDirectory(name)
+	}
+	return fs.sftpClient.Remove(name)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs SFTPFs) Mkdir(name string) error {
+	return fs.sftpClient.Mkdir(name)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs SFTPFs) Symlink(source, target string) error {
+	return fs.sftpClient.Symlink(source, target)
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (fs SFTPFs) Chown(name string, uid int, gid int) error {
+	return fs.sftpClient.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs SFTPFs) Chmod(name string, mode os.FileMode) error {
+	return fs.sftpClient.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (fs SFTPFs) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.sftpClient.Chtimes(name, atime, mtime)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+// The temporary files used for atomic uploads are hidden
+func (fs SFTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fs.sftpClient.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	result := make([]os.FileInfo, 0, len(list))
+	for _, fi := range list {
+		if strings.HasPrefix(fi.Name(), sftpFsUploadPrefix) {
+			continue
+		}
+		result = append(result, fi)
+	}
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// The received data are appended to the remote file
+func (SFTPFs) IsUploadResumeSupported() bool {
+	return true
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// SFTPFs handles atomic uploads itself using a temporary file on the
+// remote server, so SFTPGo doesn't need to do anything
+func (SFTPFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (SFTPFs) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsNotExist(err) {
+		return true
+	}
+	if statusErr, ok := err.(*sftp.StatusError); ok {
+		return statusErr.Code == uint32(sftp.ErrSSHFxNoSuchFile)
+	}
+	return false
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (SFTPFs) IsPermission(err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsPermission(err) {
+		return true
+	}
+	if statusErr, ok := err.(*sftp.StatusError); ok {
+		return statusErr.Code == uint32(sftp.ErrSSHFxPermissionDenied)
+	}
+	return false
+}
+
+// CheckRootPath creates the specified root directory, on the remote server, if it does not exists
+func (fs SFTPFs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir)
+	osFs.CheckRootPath(username, uid, gid)
+	if fs.config.Prefix == "/" {
+		return true
+	}
+	if _, err := fs.sftpClient.Stat(fs.config.Prefix); fs.IsNotExist(err) {
+		err = fs.sftpClient.MkdirAll(fs.config.Prefix)
+		fsLog(fs, logger.LevelDebug, "root dir %#v does not exist, try to create, mkdir error: %v", fs.config.Prefix, err)
+		return err == nil
+	}
+	return true
+}
+
+// ScanRootDirContents returns the number of files contained in the remote prefix,
+// and their size
+func (fs SFTPFs) ScanRootDirContents() (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	walker := fs.sftpClient.Walk(fs.config.Prefix)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return numFiles, size, err
+		}
+		fi := walker.Stat()
+		if fi.Mode().IsRegular() {
+			numFiles++
+			size += fi.Size()
+		}
+	}
+	return numFiles, size, nil
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// SFTPFs handles atomic uploads itself, we never call this method for SFTPFs
+func (SFTPFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the remote prefix.
+// This is the path as seen by SFTP users
+func (fs SFTPFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		rel = "/" + rel
+	}
+	if fs.config.Prefix != "/" {
+		if !fs.isSubDir(rel) {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.config.Prefix))
+	}
+	return rel
+}
+
+// Join joins any number of path elements into a single path
+func (SFTPFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// ResolvePath returns the matching remote path for the specified sftp path
+func (fs SFTPFs) ResolvePath(sftpPath string) (string, error) {
+	if !path.IsAbs(sftpPath) {
+		sftpPath = path.Clean("/" + sftpPath)
+	}
+	return path.Join(fs.config.Prefix, sftpPath), nil
+}
+
+// Close closes the connection to the remote SFTP server
+func (fs SFTPFs) Close() error {
+	var err error
+	if fs.sftpClient != nil {
+		err = fs.sftpClient.Close()
+	}
+	if fs.sshClient != nil {
+		if closeErr := fs.sshClient.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (fs *SFTPFs) connect() error {
+	clientConfig := &ssh.ClientConfig{
+		User: fs.config.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fp := ssh.FingerprintSHA256(key)
+			if utils.IsStringInSlice(fp, fs.config.Fingerprints) {
+				return nil
+			}
+			return fmt.Errorf("invalid fingerprint %#v for host %#v", fp, hostname)
+		},
+		Timeout:       sftpFsDialTimeout,
+		ClientVersion: "SSH-2.0-SFTPGo",
+	}
+	if len(fs.config.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey([]byte(fs.config.PrivateKey))
+		if err != nil {
+			return fmt.Errorf("invalid private key: %v", err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if len(fs.config.Password) > 0 {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(fs.config.Password))
+	}
+	sshClient, err := ssh.Dial("tcp", fs.config.Endpoint, clientConfig)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to connect: %v", err)
+		return err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to create SFTP client: %v", err)
+		sshClient.Close()
+		return err
+	}
+	fs.sshClient = sshClient
+	fs.sftpClient = sftpClient
+	return nil
+}
+
+// renameUpload moves a completed upload to its final path.
+// posix-rename@openssh.com replaces the target atomically, if the remote server
+// does not support this extension we fallback to remove and rename
+func (fs SFTPFs) renameUpload(source, target string) error {
+	err := fs.sftpClient.PosixRename(source, target)
+	if err == nil {
+		return nil
+	}
+	fsLog(fs, logger.LevelDebug, "posix rename %#v -> %#v failed, fallback to standard rename: %v", source, target, err)
+	if _, err = fs.sftpClient.Lstat(target); err == nil {
+		if err = fs.sftpClient.Remove(target); err != nil {
+			fs.sftpClient.Remove(source)
+			return err
+		}
+	}
+	err = fs.sftpClient.Rename(source, target)
+	if err != nil {
+		fs.sftpClient.Remove(source)
+	}
+	return err
+}
+
+func (SFTPFs) getTempUploadPath(name string) string {
+	dir := path.Dir(name)
+	guid := xid.New().String()
+	return path.Join(dir, sftpFsUploadPrefix+guid+"."+path.Base(name))
+}
+
+func (fs SFTPFs) isSubDir(name string) bool {
+	if name == fs.config.Prefix {
+		return true
+	}
+	return strings.HasPrefix(name, fs.config.Prefix+"/")
+}
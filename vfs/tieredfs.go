@@ -0,0 +1,681 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/metrics"
+	"github.com/freshvolk/sftpgo/utils"
+	"github.com/rs/xid"
+)
+
+const (
+	tieredFsName      = "tieredfs"
+	tieringTempPrefix = ".sftpgo-tiering."
+	// the metadata tree mirrors the directory tree inside the root directory,
+	// the prefixes avoid conflicts between files and directories
+	tieringFilePrefix = "f_"
+	tieringDirPrefix  = "d_"
+	tieringTmpPrefix  = "t_"
+)
+
+var (
+	// directory where the metadata for the files moved to the cold tier are stored.
+	// If empty the tiering is not available
+	tieringStateDir       string
+	errTieringDisabled    = errors.New("tiering is not available: the tiering state path is not configured")
+	errTieringFileChanged = errors.New("the file was modified while moving it to the cold tier")
+)
+
+// SetTieringStateDir sets the directory where the metadata for the files moved
+// to the cold tier are stored. An empty path disables the tiering
+func SetTieringStateDir(dir string) error {
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tieringStateDir = dir
+	return nil
+}
+
+// tieringStub defines the metadata for a file moved to the cold tier.
+// The local file is replaced by a sparse file with the same size, permissions
+// and modification time, it is a valid stub only while its size and
+// modification time match the ones stored here
+type tieringStub struct {
+	// path of the file contents inside the cold tier
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// modification time as unix timestamp in nanoseconds
+	ModTime int64 `json:"mtime"`
+	// tiering time as unix timestamp in milliseconds
+	TieredAt int64 `json:"tiered_at"`
+}
+
+func (s *tieringStub) matches(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Size() == s.Size && info.ModTime().UnixNano() == s.ModTime
+}
+
+// TieredFs is a local Fs implementation that moves the cold files to a
+// secondary storage, usually an object storage.
+// A tiered file is replaced by a stub, so it is still listed with its size
+// and modification time. Opening a stub for reading streams the contents
+// from the cold tier or recalls the file to the local disk, based on the
+// configuration, writes that don't truncate the file always recall it
+type TieredFs struct {
+	OsFs
+	stateDir       string
+	tier           Fs
+	recallOnAccess bool
+}
+
+// NewTieredFs returns a TieredFs object for the given root directory and cold tier.
+// stateID identifies the metadata for the tiered files, it must be unique for each root directory
+func NewTieredFs(connectionID, rootDir, stateID string, tier Fs, recallOnAccess bool) (Fs, error) {
+	if len(tieringStateDir) == 0 {
+		tier.Close()
+		return nil, errTieringDisabled
+	}
+	if !filepath.IsAbs(rootDir) {
+		tier.Close()
+		return nil, fmt.Errorf("invalid root path: %v", rootDir)
+	}
+	return &TieredFs{
+		OsFs: OsFs{
+			name:         tieredFsName,
+			connectionID: connectionID,
+			rootDir:      filepath.Clean(rootDir),
+		},
+		stateDir:       getTieringStateDir(stateID),
+		tier:           tier,
+		recallOnAccess: recallOnAccess,
+	}, nil
+}
+
+// GetTieringUsage returns the number of tiered files and their size for the given state identifier.
+// Nothing can be tiered if the tiering state path is not configured
+func GetTieringUsage(stateID string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	if len(tieringStateDir) == 0 {
+		return numFiles, size, nil
+	}
+	stateDir := getTieringStateDir(stateID)
+	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+		return numFiles, size, nil
+	}
+	err := filepath.Walk(stateDir, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), tieringFilePrefix) {
+			return nil
+		}
+		stub, err := readTieringStub(walkedPath)
+		if err != nil {
+			return nil
+		}
+		numFiles++
+		size += stub.Size
+		return nil
+	})
+	return numFiles, size, err
+}
+
+// Open opens the named file for reading. For stubs the contents are read from
+// the cold tier or the file is recalled first
+func (fs TieredFs) Open(name string) (*os.File, FileReader, func(), error) {
+	stub, ok := fs.getStub(name)
+	if !ok {
+		return fs.OsFs.Open(name)
+	}
+	if !fs.recallOnAccess {
+		remotePath, err := fs.tier.ResolvePath(stub.Key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return fs.tier.Open(remotePath)
+	}
+	if err := fs.recall(name, stub); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to recall %#v from the cold tier: %v", name, err)
+		return nil, nil, nil, fmt.Errorf("unable to recall %#v from the cold tier", name)
+	}
+	return fs.OsFs.Open(name)
+}
+
+// Create creates or opens the named file for writing.
+// Stubs are recalled first unless the file is truncated
+func (fs TieredFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	isTruncate := flag == 0 || flag&os.O_TRUNC != 0
+	stub, isStub := fs.getStub(name)
+	if isStub && !isTruncate {
+		if err := fs.recall(name, stub); err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to recall %#v from the cold tier: %v", name, err)
+			return nil, nil, nil, fmt.Errorf("unable to recall %#v from the cold tier", name)
+		}
+		isStub = false
+	}
+	if flag&os.O_APPEND != 0 {
+		// resumed uploads are written at the requested offsets, as for the local filesystem
+		flag &^= os.O_APPEND
+		if flag == 0 {
+			flag = os.O_WRONLY
+		}
+	}
+	f, w, cancelFn, err := fs.OsFs.Create(name, flag)
+	if err == nil && isStub {
+		fs.removeStub(name, stub)
+	}
+	return f, w, cancelFn, err
+}
+
+// Rename renames (moves) source to target.
+// The metadata for the tiered files are moved too
+func (fs TieredFs) Rename(source, target string) error {
+	sourceInfo, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	targetStub, isTargetStub := fs.getStub(target)
+	if isTargetStub {
+		if targetInfo, err := os.Lstat(target); err == nil && os.SameFile(sourceInfo, targetInfo) {
+			isTargetStub = false
+		}
+	}
+	if err = os.Rename(source, target); err != nil {
+		return err
+	}
+	sourceState := fs.getStatePath(source, sourceInfo.IsDir())
+	targetState := fs.getStatePath(target, sourceInfo.IsDir())
+	if len(sourceState) > 0 && len(targetState) > 0 {
+		if _, err = os.Lstat(sourceState); err == nil {
+			if err = moveTieringState(sourceState, targetState, sourceInfo.IsDir()); err != nil {
+				fsLog(fs, logger.LevelWarn, "unable to move tiering metadata %#v -> %#v: %v", source, target, err)
+				if errRollback := os.Rename(target, source); errRollback != nil {
+					fsLog(fs, logger.LevelError, "unable to rollback rename %#v -> %#v: %v", source, target, errRollback)
+				}
+				return err
+			}
+			if isTargetStub {
+				// the target metadata were replaced by the source ones
+				fs.removeTieredContents(targetStub)
+				return nil
+			}
+		}
+	}
+	if isTargetStub {
+		fs.removeStub(target, targetStub)
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+// The contents for tiered files are removed from the cold tier too
+func (fs TieredFs) Remove(name string, isDir bool) error {
+	if isDir {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		if statePath := fs.getStatePath(name, true); len(statePath) > 0 {
+			os.RemoveAll(statePath)
+		}
+		return nil
+	}
+	stub, isStub := fs.getStub(name)
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	if isStub {
+		fs.removeStub(name, stub)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification times of the named file.
+// The metadata for tiered files are updated, so they remain valid stubs
+func (fs TieredFs) Chtimes(name string, atime, mtime time.Time) error {
+	stub, isStub := fs.getStub(name)
+	if err := os.Chtimes(name, atime, mtime); err != nil {
+		return err
+	}
+	if !isStub {
+		return nil
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	stub.ModTime = info.ModTime().UnixNano()
+	return writeTieringStub(fs.getStatePath(name, false), stub)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs TieredFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	result := make([]os.FileInfo, 0, len(list))
+	for _, info := range list {
+		if !strings.HasPrefix(info.Name(), tieringTempPrefix) {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size, stubs are counted with the size of the tiered file
+func (fs TieredFs) ScanRootDirContents() (int, int64, error) {
+	return fs.ScanRootDirContentsWithOptions(context.Background(), ScanOptions{}, &ScanProgress{})
+}
+
+// ScanRootDirContentsWithOptions returns the number of files contained in the root
+// directory and their size scanning up to options.Parallelism sub directories concurrently
+func (fs TieredFs) ScanRootDirContentsWithOptions(ctx context.Context, options ScanOptions, progress *ScanProgress) (int, int64, error) {
+	return newLocalScanner(ctx, fs.rootDir, options, progress, func(name string, info os.FileInfo) (bool, int64, error) {
+		return !strings.HasPrefix(info.Name(), tieringTempPrefix), info.Size(), nil
+	}).scan()
+}
+
+// CheckRootPath creates the root directory and the cold tier root directory if they don't exist
+func (fs TieredFs) CheckRootPath(username string, uid int, gid int) bool {
+	if !fs.tier.CheckRootPath(username, uid, gid) {
+		fsLog(fs, logger.LevelWarn, "unable to check the cold tier root directory for user %#v", username)
+	}
+	return fs.OsFs.CheckRootPath(username, uid, gid)
+}
+
+// Close closes the cold tier
+func (fs TieredFs) Close() error {
+	return fs.tier.Close()
+}
+
+// TierColdFiles moves to the cold tier the regular files not accessed or modified
+// since coldBefore and removes the metadata for the stubs no longer valid, for
+// example because the files were modified or removed outside SFTPGo.
+// It returns the number of files moved and their size
+func (fs TieredFs) TierColdFiles(coldBefore time.Time) (int, int64, error) {
+	fs.removeStaleStubs()
+	numFiles := 0
+	size := int64(0)
+	isDir, err := IsDirectory(fs, fs.rootDir)
+	if err != nil || !isDir {
+		return numFiles, size, err
+	}
+	err = filepath.Walk(fs.rootDir, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if walkedPath == fs.rootDir {
+				return err
+			}
+			// the path was removed while walking the tree
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 || strings.HasPrefix(info.Name(), tieringTempPrefix) {
+			return nil
+		}
+		if info.ModTime().After(coldBefore) || getLastAccessTime(info).After(coldBefore) {
+			return nil
+		}
+		if _, ok := fs.getStub(walkedPath); ok {
+			return nil
+		}
+		err = fs.tierFile(walkedPath, info)
+		metrics.FileTiered(info.Size(), err)
+		if err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to move %#v to the cold tier: %v", walkedPath, err)
+			return nil
+		}
+		numFiles++
+		size += info.Size()
+		return nil
+	})
+	return numFiles, size, err
+}
+
+// tierFile uploads the named file to the cold tier and replaces it with a stub
+func (fs TieredFs) tierFile(name string, info os.FileInfo) error {
+	stub := tieringStub{
+		Key:      "/" + xid.New().String(),
+		TieredAt: utils.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+	remotePath, err := fs.tier.ResolvePath(stub.Key)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = copyToFs(fs.tier, remotePath, f)
+	f.Close()
+	if err != nil {
+		fs.tier.Remove(remotePath, false) //nolint:errcheck
+		return err
+	}
+	tempPath := filepath.Join(filepath.Dir(name), tieringTempPrefix+xid.New().String())
+	err = fs.createStub(name, tempPath, info, &stub)
+	if err != nil {
+		os.Remove(tempPath)
+		fs.tier.Remove(remotePath, false) //nolint:errcheck
+		return err
+	}
+	fsLog(fs, logger.LevelDebug, "file %#v moved to the cold tier, key: %#v size: %v", name, stub.Key, stub.Size)
+	return nil
+}
+
+func (fs TieredFs) createStub(name, tempPath string, info os.FileInfo, stub *tieringStub) error {
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(info.Size())
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	if err = fs.copyFileAttributes(tempPath, info, getLastAccessTime(info)); err != nil {
+		return err
+	}
+	stubInfo, err := os.Lstat(tempPath)
+	if err != nil {
+		return err
+	}
+	stub.Size = stubInfo.Size()
+	stub.ModTime = stubInfo.ModTime().UnixNano()
+	current, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		return errTieringFileChanged
+	}
+	statePath := fs.getStatePath(name, false)
+	if len(statePath) == 0 {
+		return fmt.Errorf("%#v is outside the root directory", name)
+	}
+	if err = writeTieringStub(statePath, *stub); err != nil {
+		return err
+	}
+	if err = os.Rename(tempPath, name); err != nil {
+		os.Remove(statePath)
+		return err
+	}
+	return nil
+}
+
+// recall downloads the contents for the named stub from the cold tier and
+// then removes them from the cold tier
+func (fs TieredFs) recall(name string, stub tieringStub) (err error) {
+	defer func() {
+		metrics.FileRecalled(err)
+	}()
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	remotePath, err := fs.tier.ResolvePath(stub.Key)
+	if err != nil {
+		return err
+	}
+	file, r, cancelFn, err := fs.tier.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	var reader io.ReadCloser = file
+	if file == nil {
+		reader = r
+	}
+	defer reader.Close()
+	tempPath := filepath.Join(filepath.Dir(name), tieringTempPrefix+xid.New().String())
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		if cancelFn != nil {
+			cancelFn()
+		}
+		return err
+	}
+	n, err := io.Copy(f, reader)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil && n != stub.Size {
+		err = fmt.Errorf("size mismatch for the tiered contents, expected: %v actual: %v", stub.Size, n)
+	}
+	if err == nil {
+		err = fs.copyFileAttributes(tempPath, info, time.Now())
+	}
+	if err != nil {
+		if cancelFn != nil {
+			cancelFn()
+		}
+		os.Remove(tempPath)
+		return err
+	}
+	if current, ok := fs.getStub(name); !ok || current.Key != stub.Key {
+		// the file was recalled or replaced concurrently
+		os.Remove(tempPath)
+		return nil
+	}
+	if err = os.Rename(tempPath, name); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	fs.removeStub(name, stub)
+	fsLog(fs, logger.LevelDebug, "file %#v recalled from the cold tier, size: %v", name, n)
+	return nil
+}
+
+// copyFileAttributes sets the permissions, the owner and the modification time
+// of the file described by info to the named file
+func (fs TieredFs) copyFileAttributes(name string, info os.FileInfo, atime time.Time) error {
+	if err := os.Chmod(name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := copyFileOwner(name, info); err != nil {
+		return err
+	}
+	return os.Chtimes(name, atime, info.ModTime())
+}
+
+// removeStub removes the metadata for the named file and its contents from the cold tier
+func (fs TieredFs) removeStub(name string, stub tieringStub) {
+	if statePath := fs.getStatePath(name, false); len(statePath) > 0 {
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			fsLog(fs, logger.LevelWarn, "unable to remove tiering metadata for %#v: %v", name, err)
+		}
+	}
+	fs.removeTieredContents(stub)
+}
+
+func (fs TieredFs) removeTieredContents(stub tieringStub) {
+	remotePath, err := fs.tier.ResolvePath(stub.Key)
+	if err == nil {
+		err = fs.tier.Remove(remotePath, false)
+	}
+	if err != nil && !fs.tier.IsNotExist(err) {
+		fsLog(fs, logger.LevelWarn, "unable to remove tiered contents %#v: %v", stub.Key, err)
+	}
+}
+
+// removeStaleStubs removes the metadata, and the tiered contents, for the
+// files that are no longer valid stubs
+func (fs TieredFs) removeStaleStubs() {
+	if _, err := os.Stat(fs.stateDir); err != nil {
+		return
+	}
+	filepath.Walk(fs.stateDir, func(walkedPath string, info os.FileInfo, err error) error { //nolint:errcheck
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tieringTmpPrefix) {
+			os.Remove(walkedPath)
+			return nil
+		}
+		name := fs.getPathFromState(walkedPath)
+		if len(name) == 0 {
+			return nil
+		}
+		stub, err := readTieringStub(walkedPath)
+		if err != nil {
+			fsLog(fs, logger.LevelWarn, "removing invalid tiering metadata %#v: %v", walkedPath, err)
+			os.Remove(walkedPath)
+			return nil
+		}
+		if localInfo, err := os.Lstat(name); err == nil && stub.matches(localInfo) {
+			return nil
+		}
+		fsLog(fs, logger.LevelInfo, "removing stale tiering metadata for %#v, key: %#v", name, stub.Key)
+		fs.removeStub(name, stub)
+		return nil
+	})
+}
+
+func (fs TieredFs) getStub(name string) (tieringStub, bool) {
+	var stub tieringStub
+	statePath := fs.getStatePath(name, false)
+	if len(statePath) == 0 {
+		return stub, false
+	}
+	stub, err := readTieringStub(statePath)
+	if err != nil {
+		return stub, false
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return stub, false
+	}
+	return stub, stub.matches(info)
+}
+
+// getStatePath returns the metadata path for the named file or directory,
+// an empty string is returned for paths outside the root directory
+func (fs TieredFs) getStatePath(name string, isDir bool) string {
+	rel, err := filepath.Rel(fs.rootDir, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return ""
+	}
+	elems := strings.Split(rel, string(os.PathSeparator))
+	for idx := range elems {
+		if idx < len(elems)-1 || isDir {
+			elems[idx] = tieringDirPrefix + elems[idx]
+		} else {
+			elems[idx] = tieringFilePrefix + elems[idx]
+		}
+	}
+	return filepath.Join(fs.stateDir, filepath.Join(elems...))
+}
+
+// getPathFromState returns the file path for the given metadata path
+func (fs TieredFs) getPathFromState(statePath string) string {
+	rel, err := filepath.Rel(fs.stateDir, statePath)
+	if err != nil {
+		return ""
+	}
+	elems := strings.Split(rel, string(os.PathSeparator))
+	for idx, elem := range elems {
+		prefix := tieringDirPrefix
+		if idx == len(elems)-1 {
+			prefix = tieringFilePrefix
+		}
+		if !strings.HasPrefix(elem, prefix) {
+			return ""
+		}
+		elems[idx] = strings.TrimPrefix(elem, prefix)
+	}
+	return filepath.Join(fs.rootDir, filepath.Join(elems...))
+}
+
+func getTieringStateDir(stateID string) string {
+	h := sha256.Sum256([]byte(stateID))
+	return filepath.Join(tieringStateDir, hex.EncodeToString(h[:]))
+}
+
+// moveTieringState moves the metadata for a file or a directory tree.
+// A renamed directory replaces an empty one, so the existing target metadata are stale
+func moveTieringState(sourceState, targetState string, isDir bool) error {
+	if isDir {
+		if err := os.RemoveAll(targetState); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(targetState), 0700); err != nil {
+		return err
+	}
+	return os.Rename(sourceState, targetState)
+}
+
+func readTieringStub(statePath string) (tieringStub, error) {
+	var stub tieringStub
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return stub, err
+	}
+	err = json.Unmarshal(data, &stub)
+	if err == nil && len(stub.Key) == 0 {
+		err = errors.New("missing tiered contents key")
+	}
+	return stub, err
+}
+
+func writeTieringStub(statePath string, stub tieringStub) error {
+	data, err := json.Marshal(stub)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	tempPath := filepath.Join(filepath.Dir(statePath), tieringTmpPrefix+xid.New().String())
+	if err = ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tempPath, statePath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// copyToFs writes the contents read from reader to the named file inside fs
+func copyToFs(fs Fs, name string, reader io.Reader) error {
+	f, w, cancelFn, err := fs.Create(name, 0)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		_, err = io.Copy(f, reader)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	if err != nil && cancelFn != nil {
+		cancelFn()
+	}
+	if errClose := w.Close(); err == nil {
+		err = errClose
+	}
+	// the pipe reader is closed with the error returned by the storage backend, if any
+	if errRead := w.WaitForReader(); errRead != nil && errRead != io.EOF && err == nil {
+		err = errRead
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// getLastAccessTime returns the access time for the given file info,
+// the modification time is returned if the access time is not available
+func getLastAccessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	}
+	return info.ModTime()
+}
+
+// copyFileOwner sets the owner of the file described by info to the named file.
+// The owner is changed only if it differs from the current process one
+func copyFileOwner(name string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || (int(stat.Uid) == os.Getuid() && int(stat.Gid) == os.Getgid()) {
+		return nil
+	}
+	return os.Lchown(name, int(stat.Uid), int(stat.Gid))
+}
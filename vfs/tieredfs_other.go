@@ -0,0 +1,19 @@
+// +build !linux
+
+package vfs
+
+import (
+	"os"
+	"time"
+)
+
+// getLastAccessTime returns the modification time, the access time is
+// used only on Linux
+func getLastAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// copyFileOwner does nothing, the files keep the owner of the process
+func copyFileOwner(name string, info os.FileInfo) error {
+	return nil
+}
@@ -2,16 +2,23 @@
 package vfs
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"time"
 
-	"github.com/freshvolk/sftpgo/logger"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/eikenb/pipeat"
+	"github.com/freshvolk/sftpgo/logger"
+	"github.com/freshvolk/sftpgo/secrets"
+	"github.com/freshvolk/sftpgo/utils"
 	"github.com/pkg/sftp"
 )
 
@@ -21,7 +28,7 @@ type Fs interface {
 	ConnectionID() string
 	Stat(name string) (os.FileInfo, error)
 	Lstat(name string) (os.FileInfo, error)
-	Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error)
+	Open(name string) (*os.File, FileReader, func(), error)
 	Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error)
 	Rename(source, target string) error
 	Remove(name string, isDir bool) error
@@ -41,6 +48,43 @@ type Fs interface {
 	GetAtomicUploadPath(name string) string
 	GetRelativePath(name string) string
 	Join(elem ...string) string
+	Close() error
+}
+
+// FileReader is returned by Open for the files that cannot be read using an *os.File,
+// for example the ones downloaded from a remote filesystem.
+// The file contents can be read sequentially or at any offset
+type FileReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// RetentionPolicy defines a write-once retention period for the files inside a directory.
+// Once an upload completes the file cannot be overwritten, renamed, removed or modified
+// until its modification time plus the retention period
+type RetentionPolicy struct {
+	// SFTP path for the directory, "/" means the whole user's namespace
+	Path string `json:"path"`
+	// retention period as number of days
+	Days int `json:"days"`
+}
+
+// GetRetentionPolicyForPath returns the retention policy that applies to the given SFTP path.
+// If more policies match, the one for the most specific directory is returned
+func GetRetentionPolicyForPath(policies []RetentionPolicy, sftpPath string) (RetentionPolicy, bool) {
+	var result RetentionPolicy
+	found := false
+	sftpPath = path.Clean("/" + sftpPath)
+	for _, policy := range policies {
+		if policy.Path == "/" || sftpPath == policy.Path || strings.HasPrefix(sftpPath, policy.Path+"/") {
+			if !found || len(policy.Path) > len(result.Path) {
+				result = policy
+				found = true
+			}
+		}
+	}
+	return result, found
 }
 
 // IsDirectory checks if a path exists and is a directory
@@ -56,7 +100,7 @@ func IsDirectory(fs Fs, path string) (bool, error) {
 func GetSFTPError(fs Fs, err error) error {
 	if fs.IsNotExist(err) {
 		return sftp.ErrSSHFxNoSuchFile
-	} else if fs.IsPermission(err) {
+	} else if fs.IsPermission(err) || os.IsPermission(err) {
 		return sftp.ErrSSHFxPermissionDenied
 	} else if err != nil {
 		return sftp.ErrSSHFxFailure
@@ -69,6 +113,16 @@ func IsLocalOsFs(fs Fs) bool {
 	return fs.Name() == osFsName
 }
 
+// HasInterruptedS3Upload returns true if fs is an S3 filesystem and there is
+// an interrupted multipart upload, that can be resumed, for the specified path
+func HasInterruptedS3Upload(fs Fs, name string) bool {
+	if s3Fs, ok := fs.(S3Fs); ok {
+		_, err := s3Fs.getInterruptedUpload(name)
+		return err == nil
+	}
+	return false
+}
+
 // ValidateS3FsConfig returns nil if the specified s3 config is valid, otherwise an error
 func ValidateS3FsConfig(config *S3FsConfig) error {
 	if len(config.Bucket) == 0 {
@@ -77,11 +131,17 @@ func ValidateS3FsConfig(config *S3FsConfig) error {
 	if len(config.Region) == 0 {
 		return errors.New("region cannot be empty")
 	}
-	if len(config.AccessKey) == 0 {
-		return errors.New("access_key cannot be empty")
+	if len(config.AccessKey) == 0 && len(config.AccessSecret) > 0 {
+		return errors.New("access_key cannot be empty with access_secret")
 	}
-	if len(config.AccessSecret) == 0 {
-		return errors.New("access_secret cannot be empty")
+	if len(config.AccessKey) > 0 && len(config.AccessSecret) == 0 {
+		return errors.New("access_secret cannot be empty with access_key")
+	}
+	if len(config.RoleARN) > 0 && !arn.IsARN(config.RoleARN) {
+		return fmt.Errorf("invalid role_arn: %#v", config.RoleARN)
+	}
+	if len(config.ExternalID) > 0 && len(config.RoleARN) == 0 {
+		return errors.New("external_id requires role_arn")
 	}
 	if len(config.KeyPrefix) > 0 {
 		if strings.HasPrefix(config.KeyPrefix, "/") {
@@ -92,6 +152,41 @@ func ValidateS3FsConfig(config *S3FsConfig) error {
 			config.KeyPrefix += "/"
 		}
 	}
+	if config.UploadPartSize != 0 && (config.UploadPartSize < 5 || config.UploadPartSize > 5000) {
+		return fmt.Errorf("invalid upload part size: %v", config.UploadPartSize)
+	}
+	if !utils.IsStringInSlice(config.ObjectLockMode, []string{"", s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance}) {
+		return fmt.Errorf("invalid object lock mode %#v, valid values: \"GOVERNANCE\", \"COMPLIANCE\"", config.ObjectLockMode)
+	}
+	return validateS3SSEConfig(config)
+}
+
+func validateS3SSEConfig(config *S3FsConfig) error {
+	if !utils.IsStringInSlice(config.ServerSideEncryption, []string{"", s3.ServerSideEncryptionAes256,
+		s3.ServerSideEncryptionAwsKms}) {
+		return fmt.Errorf("invalid server side encryption %#v, valid values: \"AES256\", \"aws:kms\"",
+			config.ServerSideEncryption)
+	}
+	if len(config.SSEKMSKeyID) > 0 && config.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return errors.New("sse_kms_key_id requires aws:kms server side encryption")
+	}
+	if len(config.SSECustomerKey) == 0 {
+		return nil
+	}
+	if len(config.ServerSideEncryption) > 0 {
+		return errors.New("sse_customer_key cannot be used together with server_side_encryption")
+	}
+	// the key is stored encrypted, we can only validate it before encryption
+	if secrets.IsEncrypted(config.SSECustomerKey) {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(config.SSECustomerKey)
+	if err != nil {
+		return fmt.Errorf("invalid sse_customer_key, it must be base64 encoded: %v", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("invalid sse_customer_key, it must be a 256 bit key, got %v bits", len(key)*8)
+	}
 	return nil
 }
 
@@ -109,6 +204,12 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 			config.KeyPrefix += "/"
 		}
 	}
+	if config.AutomaticCredentials {
+		if len(config.Credentials) > 0 {
+			return errors.New("credentials cannot be provided with automatic_credentials")
+		}
+		return nil
+	}
 	if len(config.Credentials) == 0 {
 		fi, err := os.Stat(credentialsFilePath)
 		if err != nil {
@@ -121,13 +222,94 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 	return nil
 }
 
+// ValidateAzBlobFsConfig returns nil if the specified Azure Blob config is valid, otherwise an error
+func ValidateAzBlobFsConfig(config *AzBlobFsConfig) error {
+	if len(config.SASURL) == 0 {
+		if len(config.Container) == 0 {
+			return errors.New("container cannot be empty")
+		}
+		if len(config.AccountName) == 0 {
+			return errors.New("account_name cannot be empty")
+		}
+		if len(config.AccountKey) == 0 {
+			return errors.New("account_key cannot be empty")
+		}
+	}
+	if len(config.KeyPrefix) > 0 {
+		if strings.HasPrefix(config.KeyPrefix, "/") {
+			return errors.New("key_prefix cannot start with /")
+		}
+		config.KeyPrefix = path.Clean(config.KeyPrefix)
+		if !strings.HasSuffix(config.KeyPrefix, "/") {
+			config.KeyPrefix += "/"
+		}
+	}
+	if config.UploadPartSize < 0 || config.UploadPartSize > 100 {
+		return fmt.Errorf("invalid upload part size: %v", config.UploadPartSize)
+	}
+	if config.UploadConcurrency < 0 || config.UploadConcurrency > 64 {
+		return fmt.Errorf("invalid upload concurrency: %v", config.UploadConcurrency)
+	}
+	if !utils.IsStringInSlice(config.AccessTier, []string{"", "Archive", "Hot", "Cool"}) {
+		return fmt.Errorf("invalid access tier %#v, valid values: \"Archive\", \"Hot\", \"Cool\"", config.AccessTier)
+	}
+	return nil
+}
+
+// ValidateSFTPFsConfig returns nil if the specified SFTP config is valid, otherwise an error
+func ValidateSFTPFsConfig(config *SFTPFsConfig) error {
+	if len(config.Endpoint) == 0 {
+		return errors.New("endpoint cannot be empty")
+	}
+	if _, _, err := net.SplitHostPort(config.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %#v: %v", config.Endpoint, err)
+	}
+	if len(config.Username) == 0 {
+		return errors.New("username cannot be empty")
+	}
+	if len(config.Password) == 0 && len(config.PrivateKey) == 0 {
+		return errors.New("password or private key is mandatory")
+	}
+	if len(config.Prefix) == 0 {
+		config.Prefix = "/"
+	}
+	if !path.IsAbs(config.Prefix) {
+		return fmt.Errorf("prefix must be an absolute path, actual value: %#v", config.Prefix)
+	}
+	config.Prefix = path.Clean(config.Prefix)
+	var fingerprints []string
+	for _, fp := range config.Fingerprints {
+		fp = strings.TrimSpace(fp)
+		if len(fp) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("invalid fingerprint %#v, only SHA256 fingerprints are supported", fp)
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	if len(fingerprints) == 0 {
+		return errors.New("at least one host key fingerprint is required")
+	}
+	config.Fingerprints = fingerprints
+	return nil
+}
+
+// ValidateMemFsConfig returns nil if the specified memory filesystem config is valid, otherwise an error
+func ValidateMemFsConfig(config *MemFsConfig) error {
+	if config.MaxSize < 0 {
+		return fmt.Errorf("invalid max size: %v", config.MaxSize)
+	}
+	return nil
+}
+
 // SetPathPermissions calls fs.Chown.
-// It does nothing for local filesystem on windows
+// It does nothing for local filesystem on windows and for remote filesystems,
+// the remote side is responsible for the ownership of the files it stores.
+// The files inside a tiered filesystem are local files
 func SetPathPermissions(fs Fs, path string, uid int, gid int) {
-	if IsLocalOsFs(fs) {
-		if runtime.GOOS == "windows" {
-			return
-		}
+	if (!IsLocalOsFs(fs) && fs.Name() != tieredFsName) || runtime.GOOS == "windows" {
+		return
 	}
 	if err := fs.Chown(path, uid, gid); err != nil {
 		fsLog(fs, logger.LevelWarn, "error chowning path %v: %v", path, err)